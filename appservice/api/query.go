@@ -21,12 +21,26 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// AppServiceError is returned when an application service responds to a query
+// with an unexpected status code. It means that the application service may
+// be misconfigured or unhealthy, so the answer is inconclusive rather than
+// negative.
+type AppServiceError struct {
+	AppServiceID string
+	StatusCode   int
+}
+
+func (e *AppServiceError) Error() string {
+	return fmt.Sprintf("application service %q responded with unexpected status code %d", e.AppServiceID, e.StatusCode)
+}
+
 // RoomAliasExistsRequest is a request to an application service
 // about whether a room alias exists
 type RoomAliasExistsRequest struct {
@@ -61,6 +75,166 @@ type UserIDExistsResponse struct {
 	UserIDExists bool `json:"exists"`
 }
 
+// RoomAliasesOwnedRequest is a request to find out which of the given room
+// aliases fall within application service namespaces
+type RoomAliasesOwnedRequest struct {
+	Aliases []string `json:"aliases"`
+}
+
+// RoomAliasesOwnedResponse is a response to RoomAliasesOwned
+type RoomAliasesOwnedResponse struct {
+	// A map from room alias to the ID of the application service whose
+	// namespace covers it. Aliases which aren't covered by any application
+	// service namespace are omitted.
+	Owners map[string]string `json:"owners"`
+}
+
+// UserIDsOwnedRequest is a request to find out which of the given user IDs
+// fall within application service namespaces
+type UserIDsOwnedRequest struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+// UserIDsOwnedResponse is a response to UserIDsOwned
+type UserIDsOwnedResponse struct {
+	// A map from user ID to the ID of the application service whose
+	// namespace covers it. User IDs which aren't covered by any application
+	// service namespace are omitted.
+	Owners map[string]string `json:"owners"`
+}
+
+// ExistenceState is the outcome of asking application services whether a user
+// ID or room alias exists
+type ExistenceState string
+
+const (
+	// ExistenceConfirmed means an application service said that it exists.
+	ExistenceConfirmed ExistenceState = "exists"
+	// ExistenceAbsent means that every interested application service said
+	// that it doesn't exist, or that no application service is interested.
+	ExistenceAbsent ExistenceState = "absent"
+	// ExistenceIndeterminate means that no application service said that it
+	// exists, but at least one interested application service couldn't be
+	// asked, so it may exist after all. It must not be treated as absent.
+	ExistenceIndeterminate ExistenceState = "indeterminate"
+)
+
+// ExistenceResult is the result for a single user ID or room alias in a
+// BulkExistsResponse
+type ExistenceResult struct {
+	State ExistenceState `json:"state"`
+	// Why the result is indeterminate, if it is.
+	Error string `json:"error,omitempty"`
+}
+
+// BulkExistsRequest is a request to application services about whether some
+// user IDs and room aliases exist
+type BulkExistsRequest struct {
+	UserIDs []string `json:"user_ids"`
+	Aliases []string `json:"aliases"`
+}
+
+// BulkExistsResponse is a response to BulkExists. Every user ID and room alias
+// in the request has a result.
+type BulkExistsResponse struct {
+	UserIDs map[string]ExistenceResult `json:"user_ids"`
+	Aliases map[string]ExistenceResult `json:"aliases"`
+}
+
+// UserIDsExistRequest is a request to application services about whether
+// some user IDs exist
+type UserIDsExistRequest struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+// UserIDsExistResponse is a response to UserIDsExist
+type UserIDsExistResponse struct {
+	// A map from each user ID in the request to whether an application
+	// service said that it exists.
+	Exists map[string]bool `json:"exists"`
+}
+
+// ThirdPartyProtocolsRequest is a request for the third party protocols
+// provided by all application services
+type ThirdPartyProtocolsRequest struct{}
+
+// ThirdPartyProtocolsResponse is a response to ThirdPartyProtocols
+type ThirdPartyProtocolsResponse struct {
+	// A map from protocol ID to the merged protocol metadata.
+	Protocols map[string]ThirdPartyProtocol `json:"protocols"`
+}
+
+// ThirdPartyLocationRequest is a request to find the Matrix rooms which
+// bridge to a third party location
+type ThirdPartyLocationRequest struct {
+	Protocol string `json:"protocol"`
+	// The protocol-specific fields identifying the location, which are passed
+	// on to the application services as query parameters.
+	Fields map[string]string `json:"fields"`
+}
+
+// ThirdPartyLocationResponse is a response to ThirdPartyLocation
+type ThirdPartyLocationResponse struct {
+	Locations []ThirdPartyLocation `json:"locations"`
+}
+
+// ThirdPartyLocation is a Matrix room which bridges to a third party
+// location, as returned by the /thirdparty/location/{protocol} application
+// service API
+type ThirdPartyLocation struct {
+	Alias    string            `json:"alias"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// ThirdPartyUserRequest is a request to find the Matrix users which bridge to
+// a third party user
+type ThirdPartyUserRequest struct {
+	Protocol string `json:"protocol"`
+	// The protocol-specific fields identifying the user, which are passed on
+	// to the application services as query parameters.
+	Fields map[string]string `json:"fields"`
+}
+
+// ThirdPartyUserResponse is a response to ThirdPartyUser
+type ThirdPartyUserResponse struct {
+	Users []ThirdPartyUser `json:"users"`
+}
+
+// ThirdPartyUser is a Matrix user which bridges to a third party user, as
+// returned by the /thirdparty/user/{protocol} application service API
+type ThirdPartyUser struct {
+	UserID   string            `json:"userid"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// ThirdPartyProtocol describes a third party protocol, as returned by the
+// /thirdparty/protocol/{protocol} application service API
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           string                         `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []ThirdPartyProtocolInstance   `json:"instances"`
+}
+
+// ThirdPartyFieldType describes one of the fields of a third party protocol
+type ThirdPartyFieldType struct {
+	Regexp      string `json:"regexp"`
+	Placeholder string `json:"placeholder"`
+}
+
+// ThirdPartyProtocolInstance is a network that a third party protocol can
+// bridge to
+type ThirdPartyProtocolInstance struct {
+	Description string            `json:"desc"`
+	Icon        string            `json:"icon,omitempty"`
+	Fields      map[string]string `json:"fields"`
+	NetworkID   string            `json:"network_id"`
+	InstanceID  string            `json:"instance_id,omitempty"`
+}
+
 // AppServiceQueryAPI is used to query user and room alias data from application
 // services
 type AppServiceQueryAPI interface {
@@ -76,6 +250,57 @@ type AppServiceQueryAPI interface {
 		req *UserIDExistsRequest,
 		resp *UserIDExistsResponse,
 	) error
+	// Find out which room aliases fall within application service namespaces.
+	// Unlike RoomAliasExists, this doesn't contact the application services.
+	RoomAliasesOwned(
+		ctx context.Context,
+		req *RoomAliasesOwnedRequest,
+		resp *RoomAliasesOwnedResponse,
+	) error
+	// Find out which user IDs fall within application service namespaces.
+	// Unlike UserIDExists, this doesn't contact the application services.
+	UserIDsOwned(
+		ctx context.Context,
+		req *UserIDsOwnedRequest,
+		resp *UserIDsOwnedResponse,
+	) error
+	// Check whether many user IDs and room aliases exist within application
+	// service namespaces at once, reporting failures to ask the application
+	// services separately for each of them.
+	BulkExists(
+		ctx context.Context,
+		req *BulkExistsRequest,
+		resp *BulkExistsResponse,
+	) error
+	// Check whether many user IDs exist within application service namespaces
+	// at once, asking each interested application service about all of them
+	// together where possible.
+	UserIDsExist(
+		ctx context.Context,
+		req *UserIDsExistRequest,
+		resp *UserIDsExistResponse,
+	) error
+	// Get the third party protocols provided by all application services,
+	// merged by protocol ID.
+	ThirdPartyProtocols(
+		ctx context.Context,
+		req *ThirdPartyProtocolsRequest,
+		resp *ThirdPartyProtocolsResponse,
+	) error
+	// Find the Matrix rooms which bridge to a third party location, asking
+	// every application service which provides the protocol.
+	ThirdPartyLocation(
+		ctx context.Context,
+		req *ThirdPartyLocationRequest,
+		resp *ThirdPartyLocationResponse,
+	) error
+	// Find the Matrix users which bridge to a third party user, asking every
+	// application service which provides the protocol.
+	ThirdPartyUser(
+		ctx context.Context,
+		req *ThirdPartyUserRequest,
+		resp *ThirdPartyUserResponse,
+	) error
 }
 
 // RetrieveUserProfile is a wrapper that queries both the local database and
@@ -17,6 +17,7 @@ package appservice
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -42,6 +43,26 @@ func AddInternalRoutes(router *mux.Router, queryAPI appserviceAPI.AppServiceQuer
 	inthttp.AddRoutes(queryAPI, router)
 }
 
+// makeHTTPClient returns the HTTP client used for all requests to application
+// services. Connections are only reused if the config allows idle connections
+// to each application service.
+func makeHTTPClient(cfg *config.AppServiceAPI) *http.Client {
+	opts := cfg.HTTPClient
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			DialContext:         types.DialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}),
+			DisableKeepAlives:   opts.MaxIdleConnsPerHost == 0,
+			MaxIdleConns:        opts.MaxIdleConns,
+			MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+			IdleConnTimeout:     opts.IdleConnTimeout,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: cfg.DisableTLSValidation,
+			},
+		},
+	}
+}
+
 // NewInternalAPI returns a concerete implementation of the internal API. Callers
 // can call functions directly on the returned API or via an HTTP interface using AddInternalRoutes.
 func NewInternalAPI(
@@ -49,15 +70,7 @@ func NewInternalAPI(
 	userAPI userapi.UserInternalAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) appserviceAPI.AppServiceQueryAPI {
-	client := &http.Client{
-		Timeout: time.Second * 30,
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: base.Cfg.AppServiceAPI.DisableTLSValidation,
-			},
-		},
-	}
+	client := makeHTTPClient(&base.Cfg.AppServiceAPI)
 	js, _, _ := jetstream.Prepare(&base.Cfg.Global.JetStream)
 
 	// Create a connection to the appservice postgres DB
@@ -91,6 +104,7 @@ func NewInternalAPI(
 	appserviceQueryAPI := &query.AppServiceQueryAPI{
 		HTTPClient: client,
 		Cfg:        base.Cfg,
+		Pool:       query.NewRequestPool(base.Cfg.AppServiceAPI.MaxConcurrentRequests),
 	}
 
 	// Only consume if we actually have ASes to track, else we'll just chew cycles needlessly.
@@ -98,7 +112,7 @@ func NewInternalAPI(
 	if len(workerStates) > 0 {
 		consumer := consumers.NewOutputRoomEventConsumer(
 			base.ProcessContext, base.Cfg, js, appserviceDB,
-			rsAPI, workerStates,
+			rsAPI, workerStates, appserviceQueryAPI,
 		)
 		if err := consumer.Start(); err != nil {
 			logrus.WithError(err).Panicf("failed to start appservice roomserver consumer")
@@ -0,0 +1,55 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appservice
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestMakeHTTPClient(t *testing.T) {
+	cfg := &config.AppServiceAPI{}
+	cfg.Defaults(false)
+
+	// By default, connections aren't reused, as before this was configurable.
+	client := makeHTTPClient(cfg)
+	if client.Timeout != 30*time.Second {
+		t.Fatalf("got timeout %s, want 30s", client.Timeout)
+	}
+	if transport := client.Transport.(*http.Transport); !transport.DisableKeepAlives {
+		t.Fatal("expected keep-alives to be disabled")
+	}
+
+	cfg.DisableTLSValidation = true
+	cfg.HTTPClient.Timeout = 5 * time.Second
+	cfg.HTTPClient.MaxIdleConnsPerHost = 4
+	client = makeHTTPClient(cfg)
+	if client.Timeout != 5*time.Second {
+		t.Fatalf("got timeout %s, want 5s", client.Timeout)
+	}
+	transport := client.Transport.(*http.Transport)
+	if transport.DisableKeepAlives {
+		t.Fatal("expected keep-alives to be enabled")
+	}
+	if transport.MaxIdleConnsPerHost != 4 {
+		t.Fatalf("got %d idle connections per host, want 4", transport.MaxIdleConnsPerHost)
+	}
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("expected TLS validation to be disabled")
+	}
+}
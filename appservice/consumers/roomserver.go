@@ -34,12 +34,21 @@ import (
 type OutputRoomEventConsumer struct {
 	ctx          context.Context
 	jetstream    nats.JetStreamContext
-	durable      nats.SubOpt
+	stream       string
+	durable      string
 	topic        string
 	asDB         storage.Database
 	rsAPI        api.RoomserverInternalAPI
 	serverName   string
 	workerStates []types.ApplicationServiceWorkerState
+	cache        ExistenceCache
+}
+
+// ExistenceCache is told about user IDs and room aliases which we learn exist
+// from room events, so that it can forget any answers it has about them.
+type ExistenceCache interface {
+	ForgetUserID(userID string)
+	ForgetRoomAlias(alias string)
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call
@@ -51,22 +60,31 @@ func NewOutputRoomEventConsumer(
 	appserviceDB storage.Database,
 	rsAPI api.RoomserverInternalAPI,
 	workerStates []types.ApplicationServiceWorkerState,
+	cache ExistenceCache,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
-		ctx:          process.Context(),
-		jetstream:    js,
-		durable:      cfg.Global.JetStream.Durable("AppserviceRoomserverConsumer"),
-		topic:        cfg.Global.JetStream.TopicFor(jetstream.OutputRoomEvent),
+		ctx:       process.Context(),
+		jetstream: js,
+		stream:    cfg.Global.JetStream.TopicFor(jetstream.OutputRoomEvent),
+		durable:   cfg.Global.JetStream.TopicFor("AppserviceRoomserverConsumer"),
+		topic: jetstream.SubscribeSubject(
+			cfg.Global.JetStream.TopicFor(jetstream.OutputRoomEvent),
+			cfg.Global.JetStream.OutputRoomEventPartitions,
+		),
 		asDB:         appserviceDB,
 		rsAPI:        rsAPI,
 		serverName:   string(cfg.Global.ServerName),
 		workerStates: workerStates,
+		cache:        cache,
 	}
 }
 
 // Start consuming from room servers
 func (s *OutputRoomEventConsumer) Start() error {
-	_, err := s.jetstream.Subscribe(s.topic, s.onMessage, s.durable)
+	if err := jetstream.PrepareDurable(s.jetstream, s.stream, s.durable, s.topic); err != nil {
+		return err
+	}
+	_, err := s.jetstream.Subscribe(s.topic, s.onMessage, nats.Durable(s.durable))
 	return err
 }
 
@@ -88,6 +106,7 @@ func (s *OutputRoomEventConsumer) onMessage(msg *nats.Msg) {
 
 		events := []*gomatrixserverlib.HeaderedEvent{output.NewRoomEvent.Event}
 		events = append(events, output.NewRoomEvent.AddStateEvents...)
+		s.forgetCreated(events)
 
 		// Send event to any relevant application services
 		if err := s.filterRoomserverEvents(context.TODO(), events); err != nil {
@@ -99,6 +118,37 @@ func (s *OutputRoomEventConsumer) onMessage(msg *nats.Msg) {
 	})
 }
 
+// forgetCreated tells the cache about user IDs which have joined rooms and
+// room aliases which have been set as canonical aliases, since they must
+// exist now even if an application service said before that they didn't.
+func (s *OutputRoomEventConsumer) forgetCreated(events []*gomatrixserverlib.HeaderedEvent) {
+	if s.cache == nil {
+		return
+	}
+	for _, event := range events {
+		switch event.Type() {
+		case gomatrixserverlib.MRoomMember:
+			if event.StateKey() != nil {
+				s.cache.ForgetUserID(*event.StateKey())
+			}
+		case gomatrixserverlib.MRoomCanonicalAlias:
+			var content struct {
+				Alias      string   `json:"alias"`
+				AltAliases []string `json:"alt_aliases"`
+			}
+			if err := json.Unmarshal(event.Content(), &content); err != nil {
+				continue
+			}
+			if content.Alias != "" {
+				s.cache.ForgetRoomAlias(content.Alias)
+			}
+			for _, alias := range content.AltAliases {
+				s.cache.ForgetRoomAlias(alias)
+			}
+		}
+	}
+}
+
 // filterRoomserverEvents takes in events and decides whether any of them need
 // to be passed on to an external application service. It does this by checking
 // each namespace of each registered application service, and if there is a
@@ -12,8 +12,15 @@ import (
 
 // HTTP paths for the internal HTTP APIs
 const (
-	AppServiceRoomAliasExistsPath = "/appservice/RoomAliasExists"
-	AppServiceUserIDExistsPath    = "/appservice/UserIDExists"
+	AppServiceRoomAliasExistsPath     = "/appservice/RoomAliasExists"
+	AppServiceUserIDExistsPath        = "/appservice/UserIDExists"
+	AppServiceRoomAliasesOwnedPath    = "/appservice/RoomAliasesOwned"
+	AppServiceThirdPartyProtocolsPath = "/appservice/ThirdPartyProtocols"
+	AppServiceBulkExistsPath          = "/appservice/BulkExists"
+	AppServiceUserIDsOwnedPath        = "/appservice/UserIDsOwned"
+	AppServiceUserIDsExistPath        = "/appservice/UserIDsExist"
+	AppServiceThirdPartyLocationPath  = "/appservice/ThirdPartyLocation"
+	AppServiceThirdPartyUserPath      = "/appservice/ThirdPartyUser"
 )
 
 // httpAppServiceQueryAPI contains the URL to an appservice query API and a
@@ -61,3 +68,94 @@ func (h *httpAppServiceQueryAPI) UserIDExists(
 	apiURL := h.appserviceURL + AppServiceUserIDExistsPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// RoomAliasesOwned implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) RoomAliasesOwned(
+	ctx context.Context,
+	request *api.RoomAliasesOwnedRequest,
+	response *api.RoomAliasesOwnedResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceRoomAliasesOwned")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceRoomAliasesOwnedPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ThirdPartyProtocols implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyProtocols(
+	ctx context.Context,
+	request *api.ThirdPartyProtocolsRequest,
+	response *api.ThirdPartyProtocolsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyProtocols")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyProtocolsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// BulkExists implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) BulkExists(
+	ctx context.Context,
+	request *api.BulkExistsRequest,
+	response *api.BulkExistsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceBulkExists")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceBulkExistsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// UserIDsOwned implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) UserIDsOwned(
+	ctx context.Context,
+	request *api.UserIDsOwnedRequest,
+	response *api.UserIDsOwnedResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceUserIDsOwned")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceUserIDsOwnedPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// UserIDsExist implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) UserIDsExist(
+	ctx context.Context,
+	request *api.UserIDsExistRequest,
+	response *api.UserIDsExistResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceUserIDsExist")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceUserIDsExistPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ThirdPartyLocation implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyLocation(
+	ctx context.Context,
+	request *api.ThirdPartyLocationRequest,
+	response *api.ThirdPartyLocationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyLocation")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyLocationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ThirdPartyUser implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyUser(
+	ctx context.Context,
+	request *api.ThirdPartyUserRequest,
+	response *api.ThirdPartyUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyUser")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyUserPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -2,6 +2,7 @@ package inthttp
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -21,7 +22,7 @@ func AddRoutes(a api.AppServiceQueryAPI, internalAPIMux *mux.Router) {
 				return util.ErrorResponse(err)
 			}
 			if err := a.RoomAliasExists(req.Context(), &request, &response); err != nil {
-				return util.ErrorResponse(err)
+				return queryErrorResponse(err)
 			}
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
@@ -35,9 +36,119 @@ func AddRoutes(a api.AppServiceQueryAPI, internalAPIMux *mux.Router) {
 				return util.ErrorResponse(err)
 			}
 			if err := a.UserIDExists(req.Context(), &request, &response); err != nil {
+				return queryErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceRoomAliasesOwnedPath,
+		httputil.MakeInternalAPI("appserviceRoomAliasesOwned", func(req *http.Request) util.JSONResponse {
+			var request api.RoomAliasesOwnedRequest
+			var response api.RoomAliasesOwnedResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.RoomAliasesOwned(req.Context(), &request, &response); err != nil {
 				return util.ErrorResponse(err)
 			}
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(
+		AppServiceThirdPartyProtocolsPath,
+		httputil.MakeInternalAPI("appserviceThirdPartyProtocols", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyProtocolsRequest
+			var response api.ThirdPartyProtocolsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyProtocols(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceBulkExistsPath,
+		httputil.MakeInternalAPI("appserviceBulkExists", func(req *http.Request) util.JSONResponse {
+			var request api.BulkExistsRequest
+			var response api.BulkExistsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.BulkExists(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceUserIDsOwnedPath,
+		httputil.MakeInternalAPI("appserviceUserIDsOwned", func(req *http.Request) util.JSONResponse {
+			var request api.UserIDsOwnedRequest
+			var response api.UserIDsOwnedResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.UserIDsOwned(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceUserIDsExistPath,
+		httputil.MakeInternalAPI("appserviceUserIDsExist", func(req *http.Request) util.JSONResponse {
+			var request api.UserIDsExistRequest
+			var response api.UserIDsExistResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.UserIDsExist(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceThirdPartyLocationPath,
+		httputil.MakeInternalAPI("appserviceThirdPartyLocation", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyLocationRequest
+			var response api.ThirdPartyLocationResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyLocation(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceThirdPartyUserPath,
+		httputil.MakeInternalAPI("appserviceThirdPartyUser", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyUserRequest
+			var response api.ThirdPartyUserResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
+
+// queryErrorResponse builds the response for a failed query. If an application
+// service misbehaved then the answer is inconclusive, which is reported as a
+// bad gateway rather than an internal error.
+func queryErrorResponse(err error) util.JSONResponse {
+	res := util.ErrorResponse(err)
+	var asErr *api.AppServiceError
+	if errors.As(err, &asErr) {
+		res.Code = http.StatusBadGateway
+	}
+	return res
 }
@@ -0,0 +1,263 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	opentracing "github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// BulkExists asks the interested application services about each of the
+// given user IDs and room aliases in turn. Unlike UserIDExists and
+// RoomAliasExists, a failure to reach an application service doesn't fail the
+// whole request, but makes the result for that item indeterminate unless
+// another application service confirms that it exists.
+func (a *AppServiceQueryAPI) BulkExists(
+	ctx context.Context,
+	request *api.BulkExistsRequest,
+	response *api.BulkExistsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceBulkExists")
+	defer span.Finish()
+
+	response.UserIDs = make(map[string]api.ExistenceResult, len(request.UserIDs))
+	for _, userID := range request.UserIDs {
+		response.UserIDs[userID] = a.existsOnAppservices(
+			ctx, userIDExistsPath, userID,
+			func(appservice *config.ApplicationService) bool {
+				return appservice.IsInterestedInUserID(userID)
+			},
+		)
+	}
+	response.Aliases = make(map[string]api.ExistenceResult, len(request.Aliases))
+	for _, alias := range request.Aliases {
+		response.Aliases[alias] = a.existsOnAppservices(
+			ctx, roomAliasExistsPath, alias,
+			func(appservice *config.ApplicationService) bool {
+				return appservice.IsInterestedInRoomAlias(alias)
+			},
+		)
+	}
+	return nil
+}
+
+// existsOnAppservices asks each interested application service whether the ID
+// exists, stopping as soon as one says that it does.
+func (a *AppServiceQueryAPI) existsOnAppservices(
+	ctx context.Context, path, id string,
+	interested func(*config.ApplicationService) bool,
+) api.ExistenceResult {
+	result := api.ExistenceResult{State: api.ExistenceAbsent}
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !interested(appservice) {
+			continue
+		}
+		exists, err := a.existsOnAppservice(ctx, appservice, path, id)
+		if err != nil {
+			result.State = api.ExistenceIndeterminate
+			result.Error = fmt.Sprintf("application service %s: %s", appservice.ID, err)
+			continue
+		}
+		if exists {
+			return api.ExistenceResult{State: api.ExistenceConfirmed}
+		}
+	}
+	return result
+}
+
+// existsOnAppservice asks a single application service whether the ID exists.
+// An error is returned if the application service couldn't give an answer.
+func (a *AppServiceQueryAPI) existsOnAppservice(
+	ctx context.Context, appservice *config.ApplicationService, path, id string,
+) (bool, error) {
+	req, err := newAppserviceRequest(ctx, appservice, path, id)
+	if err != nil {
+		return false, err
+	}
+	started := time.Now()
+	resp, err := a.do(req)
+	observeQuery(appservice.ID, existenceEndpoint(path), started, resp, err)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("responded with status code %d", resp.StatusCode)
+	}
+}
+
+// userIDsExistPath is where application services that support bulk user ID
+// queries accept a POST with the user IDs to ask about. This isn't part of
+// the application service API, so application services which don't support
+// it are asked about each user ID in turn instead.
+const userIDsExistPath = "/users"
+
+// errBulkUnsupported is returned by userIDsExistInBulk when the application
+// service doesn't support bulk user ID queries.
+var errBulkUnsupported = errors.New("application service doesn't support bulk user ID queries")
+
+type userIDsExistRequest struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+type userIDsExistResponse struct {
+	// The user IDs from the request which exist.
+	Exists []string `json:"exists"`
+}
+
+// UserIDsExist asks the interested application services whether each of the
+// given user IDs exists. Each application service is asked about all of the
+// user IDs that it is interested in with a single request if it supports
+// that, or else with a request for each user ID, sent concurrently. Like
+// UserIDExists, an error is returned if an application service can't be
+// asked. Use BulkExists to get a result for each user ID regardless.
+func (a *AppServiceQueryAPI) UserIDsExist(
+	ctx context.Context,
+	request *api.UserIDsExistRequest,
+	response *api.UserIDsExistResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceUserIDsExist")
+	defer span.Finish()
+
+	response.Exists = make(map[string]bool, len(request.UserIDs))
+	for _, userID := range request.UserIDs {
+		response.Exists[userID] = false
+	}
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" {
+			continue
+		}
+		// Only ask about the user IDs that no other application service
+		// has already said exist.
+		var userIDs []string
+		asked := make(map[string]bool, len(request.UserIDs))
+		for _, userID := range request.UserIDs {
+			if !response.Exists[userID] && !asked[userID] && appservice.IsInterestedInUserID(userID) {
+				userIDs = append(userIDs, userID)
+				asked[userID] = true
+			}
+		}
+		if len(userIDs) == 0 {
+			continue
+		}
+		existing, err := a.userIDsExistOnAppservice(ctx, appservice, userIDs)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+			}).WithError(err).Error("issue querying user IDs on application service")
+			return err
+		}
+		for _, userID := range existing {
+			if asked[userID] {
+				response.Exists[userID] = true
+			}
+		}
+	}
+	return nil
+}
+
+// userIDsExistOnAppservice returns which of the given user IDs exist on the
+// application service, falling back to asking about each of them separately
+// if the application service doesn't support bulk queries.
+func (a *AppServiceQueryAPI) userIDsExistOnAppservice(
+	ctx context.Context, appservice *config.ApplicationService, userIDs []string,
+) ([]string, error) {
+	if _, ok := a.noBulkUserIDs.Load(appservice.ID); !ok {
+		existing, err := a.userIDsExistInBulk(ctx, appservice, userIDs)
+		if err != errBulkUnsupported {
+			return existing, err
+		}
+		a.noBulkUserIDs.Store(appservice.ID, struct{}{})
+	}
+
+	var wg sync.WaitGroup
+	exists := make([]bool, len(userIDs))
+	errs := make([]error, len(userIDs))
+	for i := range userIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			exists[i], errs[i] = a.existsOnAppservice(ctx, appservice, userIDExistsPath, userIDs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var existing []string
+	for i, userID := range userIDs {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("user ID %s: %w", userID, errs[i])
+		}
+		if exists[i] {
+			existing = append(existing, userID)
+		}
+	}
+	return existing, nil
+}
+
+// userIDsExistInBulk asks the application service about all of the given user
+// IDs with a single request. It returns errBulkUnsupported if the application
+// service doesn't recognise the request.
+func (a *AppServiceQueryAPI) userIDsExistInBulk(
+	ctx context.Context, appservice *config.ApplicationService, userIDs []string,
+) ([]string, error) {
+	body, err := json.Marshal(userIDsExistRequest{UserIDs: userIDs})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := newAppserviceRequestWithBody(
+		ctx, appservice, http.MethodPost, userIDsExistPath, "", bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	started := time.Now()
+	resp, err := a.doWithRetry(req)
+	observeQuery(appservice.ID, endpointUserIDs, started, resp, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, errBulkUnsupported
+	default:
+		return nil, fmt.Errorf("responded with status code %d", resp.StatusCode)
+	}
+	var res userIDsExistResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("json.Decode: %w", err)
+	}
+	return res.Exists, nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func namespace(regex string) config.ApplicationServiceNamespace {
+	return config.ApplicationServiceNamespace{Regex: regex, RegexpObject: regexp.MustCompile(regex)}
+}
+
+func TestBulkExistsMixedOutcomes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/broken/"):
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/irc/users/@irc_alice:localhost":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{
+			ID:  "irc",
+			URL: srv.URL + "/irc",
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users":   {namespace("@irc_.*")},
+				"aliases": {namespace("#irc_.*")},
+			},
+		},
+		{
+			ID:  "broken",
+			URL: srv.URL + "/broken",
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {namespace("@irc_.*"), namespace("@slack_.*")},
+			},
+		},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.BulkExistsResponse{}
+	if err := a.BulkExists(context.Background(), &api.BulkExistsRequest{
+		UserIDs: []string{"@irc_alice:localhost", "@irc_bob:localhost", "@slack_carol:localhost", "@nobody:localhost"},
+		Aliases: []string{"#irc_room:localhost"},
+	}, res); err != nil {
+		t.Fatal(err)
+	}
+
+	wantUsers := map[string]api.ExistenceState{
+		// Confirmed by the first application service, so the broken one
+		// isn't asked.
+		"@irc_alice:localhost": api.ExistenceConfirmed,
+		// Denied by one application service, but the other couldn't be asked.
+		"@irc_bob:localhost": api.ExistenceIndeterminate,
+		// Only the broken application service is interested.
+		"@slack_carol:localhost": api.ExistenceIndeterminate,
+		// No application service is interested.
+		"@nobody:localhost": api.ExistenceAbsent,
+	}
+	gotUsers := map[string]api.ExistenceState{}
+	for userID, result := range res.UserIDs {
+		gotUsers[userID] = result.State
+		if (result.State == api.ExistenceIndeterminate) != (result.Error != "") {
+			t.Errorf("%s: got error %q for state %q", userID, result.Error, result.State)
+		}
+	}
+	if !reflect.DeepEqual(gotUsers, wantUsers) {
+		t.Errorf("got user results %v, want %v", gotUsers, wantUsers)
+	}
+	if got := res.Aliases["#irc_room:localhost"].State; got != api.ExistenceAbsent {
+		t.Errorf("got alias result %q, want %q", got, api.ExistenceAbsent)
+	}
+}
+
+func TestUserIDsExistMixedBatch(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/irc/users":
+			// Supports bulk queries, and knows about alice but not bob.
+			var req userIDsExistRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			res := userIDsExistResponse{Exists: []string{}}
+			for _, userID := range req.UserIDs {
+				if userID == "@irc_alice:localhost" {
+					res.Exists = append(res.Exists, userID)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(res)
+		case r.URL.Path == "/slack/users/@slack_carol:localhost":
+			// Doesn't support bulk queries, and knows about carol.
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{
+			ID:  "irc",
+			URL: srv.URL + "/irc",
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {namespace("@irc_.*")},
+			},
+		},
+		{
+			ID:  "slack",
+			URL: srv.URL + "/slack",
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {namespace("@slack_.*")},
+			},
+		},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	userIDs := []string{
+		"@irc_alice:localhost", "@irc_bob:localhost",
+		"@slack_carol:localhost", "@slack_dave:localhost",
+		"@nobody:localhost",
+	}
+	res := &api.UserIDsExistResponse{}
+	if err := a.UserIDsExist(context.Background(), &api.UserIDsExistRequest{UserIDs: userIDs}, res); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"@irc_alice:localhost":   true,
+		"@irc_bob:localhost":     false,
+		"@slack_carol:localhost": true,
+		"@slack_dave:localhost":  false,
+		"@nobody:localhost":      false,
+	}
+	if !reflect.DeepEqual(res.Exists, want) {
+		t.Fatalf("got %v, want %v", res.Exists, want)
+	}
+	wantRequests := map[string]int{
+		"POST /irc/users":                         1,
+		"POST /slack/users":                       1,
+		"GET /slack/users/@slack_carol:localhost": 1,
+		"GET /slack/users/@slack_dave:localhost":  1,
+	}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Fatalf("got requests %v, want %v", requests, wantRequests)
+	}
+
+	// The application service without bulk queries isn't asked again.
+	res = &api.UserIDsExistResponse{}
+	if err := a.UserIDsExist(context.Background(), &api.UserIDsExistRequest{UserIDs: userIDs}, res); err != nil {
+		t.Fatal(err)
+	}
+	if got := requests["POST /slack/users"]; got != 1 {
+		t.Fatalf("got %d bulk requests to the application service without bulk queries, want 1", got)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(existenceCacheLookups)
+}
+
+var existenceCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "query_cache_lookups_total",
+		Help:      "Number of lookups in the cache of whether room aliases and user IDs exist on application services, by whether the answer was found",
+	},
+	[]string{"result"},
+)
+
+const (
+	existenceKindRoomAlias = "alias"
+	existenceKindUserID    = "user"
+)
+
+type existenceCacheKey struct {
+	kind string
+	id   string
+}
+
+type existenceCacheEntry struct {
+	key    existenceCacheKey
+	exists bool
+	added  time.Time
+}
+
+// existenceCache is a least-recently-used cache of whether application
+// services said that room aliases and user IDs exist. Answers that something
+// doesn't exist are kept for less time, since it may be created at any time.
+// The zero value is an empty cache.
+type existenceCache struct {
+	mu      sync.Mutex
+	entries map[existenceCacheKey]*list.Element
+	order   list.List // most recently used at the front
+}
+
+func (c *existenceCache) get(key existenceCacheKey, ttl, negativeTTL time.Duration, now time.Time) (exists, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	entry := element.Value.(*existenceCacheEntry)
+	if !entry.exists {
+		ttl = negativeTTL
+	}
+	if now.Sub(entry.added) >= ttl {
+		c.order.Remove(element)
+		delete(c.entries, entry.key)
+		return false, false
+	}
+	c.order.MoveToFront(element)
+	return entry.exists, true
+}
+
+func (c *existenceCache) add(key existenceCacheKey, exists bool, size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[existenceCacheKey]*list.Element)
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = &existenceCacheEntry{key, exists, now}
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&existenceCacheEntry{key, exists, now})
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*existenceCacheEntry).key)
+	}
+}
+
+func (c *existenceCache) remove(key existenceCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+func (a *AppServiceQueryAPI) queryCacheOptions() config.QueryCacheOptions {
+	if a.Cfg == nil {
+		return config.QueryCacheOptions{}
+	}
+	return a.Cfg.AppServiceAPI.QueryCache
+}
+
+// cachedExistence returns whether an application service recently said that
+// the room alias or user ID exists, and false for ok if we don't know.
+func (a *AppServiceQueryAPI) cachedExistence(kind, id string) (exists, ok bool) {
+	opts := a.queryCacheOptions()
+	if opts.Size <= 0 {
+		return false, false
+	}
+	exists, ok = a.cache.get(existenceCacheKey{kind, id}, opts.TTL, opts.NegativeTTL, time.Now())
+	if !ok {
+		existenceCacheLookups.WithLabelValues("miss").Inc()
+		return false, false
+	}
+	existenceCacheLookups.WithLabelValues("hit").Inc()
+	return exists, true
+}
+
+// cacheExistence remembers whether the application services said that the
+// room alias or user ID exists.
+func (a *AppServiceQueryAPI) cacheExistence(kind, id string, exists bool) {
+	opts := a.queryCacheOptions()
+	if opts.Size <= 0 || (!exists && opts.NegativeTTL <= 0) {
+		return
+	}
+	a.cache.add(existenceCacheKey{kind, id}, exists, opts.Size, time.Now())
+}
+
+// ForgetRoomAlias forgets any cached answer about whether the room alias
+// exists, e.g. because we've learned that it has just been created.
+func (a *AppServiceQueryAPI) ForgetRoomAlias(alias string) {
+	a.cache.remove(existenceCacheKey{existenceKindRoomAlias, alias})
+}
+
+// ForgetUserID forgets any cached answer about whether the user ID exists,
+// e.g. because we've learned that it has just been created.
+func (a *AppServiceQueryAPI) ForgetUserID(userID string) {
+	a.cache.remove(existenceCacheKey{existenceKindUserID, userID})
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestExistenceCacheExpiry(t *testing.T) {
+	var c existenceCache
+	now := time.Now()
+	exists := existenceCacheKey{existenceKindUserID, "@irc_alice:localhost"}
+	absent := existenceCacheKey{existenceKindUserID, "@irc_bob:localhost"}
+	c.add(exists, true, 10, now)
+	c.add(absent, false, 10, now)
+
+	// Answers that something doesn't exist expire sooner.
+	later := now.Add(30 * time.Second)
+	if got, ok := c.get(exists, time.Minute, 10*time.Second, later); !ok || !got {
+		t.Fatal("expected the positive answer to be cached")
+	}
+	if _, ok := c.get(absent, time.Minute, 10*time.Second, later); ok {
+		t.Fatal("expected the negative answer to have expired")
+	}
+	if _, ok := c.get(exists, time.Minute, 10*time.Second, now.Add(time.Minute)); ok {
+		t.Fatal("expected the positive answer to have expired")
+	}
+
+	// The least recently used answer is evicted.
+	c.add(exists, true, 1, now)
+	c.add(absent, false, 1, now)
+	if _, ok := c.get(exists, time.Minute, time.Minute, now); ok {
+		t.Fatal("expected the oldest answer to be evicted")
+	}
+}
+
+func TestRoomAliasExistsCached(t *testing.T) {
+	requests := 0
+	status := http.StatusNotFound
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.AppServiceAPI.QueryCache = config.QueryCacheOptions{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:  "irc",
+		URL: srv.URL,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"aliases": {namespace("#irc_.*")},
+		},
+	}}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+	lookup := func() bool {
+		res := &api.RoomAliasExistsResponse{}
+		if err := a.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, res); err != nil {
+			t.Fatal(err)
+		}
+		return res.AliasExists
+	}
+
+	// The second lookup is answered from the cache.
+	if lookup() || lookup() {
+		t.Fatal("expected alias not to exist")
+	}
+	if requests != 1 {
+		t.Fatalf("got %d requests, want 1", requests)
+	}
+
+	// Once the alias is known to have been created, the application
+	// service is asked again.
+	status = http.StatusOK
+	a.ForgetRoomAlias("#irc_test:localhost")
+	if !lookup() || !lookup() {
+		t.Fatal("expected alias to exist")
+	}
+	if requests != 2 {
+		t.Fatalf("got %d requests, want 2", requests)
+	}
+}
+
+func TestUserIDExistsNotCachedOnServerError(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.AppServiceAPI.QueryCache = config.QueryCacheOptions{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:  "irc",
+		URL: srv.URL,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {namespace("@irc_.*")},
+		},
+	}}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	for i := 0; i < 2; i++ {
+		res := &api.UserIDExistsResponse{}
+		err := a.UserIDExists(context.Background(), &api.UserIDExistsRequest{UserID: "@irc_test:localhost"}, res)
+		var asErr *api.AppServiceError
+		if !errors.As(err, &asErr) {
+			t.Fatalf("expected an application service error, got %v", err)
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("got %d requests, want 2", requests)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(queryDuration, queryFailures)
+}
+
+// The endpoints that queries to application services are labelled with.
+const (
+	endpointRoomAlias      = "room_alias"
+	endpointUserID         = "user_id"
+	endpointUserIDs        = "user_ids"
+	endpointProtocol       = "protocol"
+	endpointLocation       = "location"
+	endpointThirdPartyUser = "third_party_user"
+)
+
+var queryDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "query_duration_seconds",
+		Help:      "How long queries to application services took, including any retries, by application service and endpoint",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"appservice_id", "endpoint"},
+)
+
+var queryFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "query_failures_total",
+		Help:      "Number of queries to application services which failed or got an error response, by application service and endpoint",
+	},
+	[]string{"appservice_id", "endpoint"},
+)
+
+// observeQuery records how long a query to an application service took, and
+// whether it failed. A 404 is an answer rather than a failure, as it is how
+// application services say that something doesn't exist.
+func observeQuery(appserviceID, endpoint string, started time.Time, resp *http.Response, err error) {
+	queryDuration.WithLabelValues(appserviceID, endpoint).Observe(time.Since(started).Seconds())
+	if err != nil || (resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound) {
+		queryFailures.WithLabelValues(appserviceID, endpoint).Inc()
+	}
+}
+
+// existenceEndpoint returns the endpoint label for a query about whether a
+// user ID or room alias exists.
+func existenceEndpoint(path string) string {
+	if path == userIDExistsPath {
+		return endpointUserID
+	}
+	return endpointRoomAlias
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueriesAreObserved(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:  "metrics_test",
+		URL: srv.URL,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {namespace("@irc_.*")},
+		},
+	}}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	series := testutil.CollectAndCount(queryDuration)
+	res := &api.UserIDExistsResponse{}
+	err := a.UserIDExists(context.Background(), &api.UserIDExistsRequest{UserID: "@irc_test:localhost"}, res)
+	var asErr *api.AppServiceError
+	if !errors.As(err, &asErr) {
+		t.Fatalf("expected an application service error, got %v", err)
+	}
+	if got := testutil.CollectAndCount(queryDuration); got != series+1 {
+		t.Fatalf("got %d duration series, want %d", got, series+1)
+	}
+	if got := testutil.ToFloat64(queryFailures.WithLabelValues("metrics_test", endpointUserID)); got != 1 {
+		t.Fatalf("got %v failures, want 1", got)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(requestPoolSize, requestPoolInFlight, requestPoolWaits)
+}
+
+var requestPoolSize = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "query_pool_size",
+		Help:      "Maximum number of concurrent outbound application service query requests, or 0 if unbounded",
+	},
+)
+
+var requestPoolInFlight = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "query_pool_in_flight",
+		Help:      "Number of outbound application service query requests currently in flight",
+	},
+)
+
+var requestPoolWaits = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "query_pool_waits_total",
+		Help:      "Number of outbound application service query requests which had to wait for a free slot in the pool",
+	},
+)
+
+// RequestPool caps the number of outbound requests to application services
+// which are in flight at once, across all queries. A request holds its slot
+// in the pool until the response body is closed, since the connection is in
+// use until then.
+type RequestPool struct {
+	slots chan struct{}
+}
+
+// NewRequestPool returns a pool which allows up to size requests to be in
+// flight at once. If size is zero or less then the number of requests isn't
+// limited.
+func NewRequestPool(size int) *RequestPool {
+	if size <= 0 {
+		requestPoolSize.Set(0)
+		return &RequestPool{}
+	}
+	requestPoolSize.Set(float64(size))
+	return &RequestPool{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Do sends the request using the client once there is a free slot in the
+// pool. The slot is released when the response body is closed, or straight
+// away if the request fails. The caller must close the response body.
+func (p *RequestPool) Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if err := p.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(p.release)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		release()
+		return resp, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (p *RequestPool) acquire(ctx context.Context) error {
+	if p == nil || p.slots == nil {
+		requestPoolInFlight.Inc()
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		requestPoolWaits.Inc()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	requestPoolInFlight.Inc()
+	return nil
+}
+
+func (p *RequestPool) release() {
+	requestPoolInFlight.Dec()
+	if p == nil || p.slots == nil {
+		return
+	}
+	<-p.slots
+}
+
+// releasingBody releases a slot in the pool when the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// do sends a request to an application service through the shared pool.
+func (a *AppServiceQueryAPI) do(req *http.Request) (*http.Response, error) {
+	return a.Pool.Do(a.HTTPClient, req)
+}
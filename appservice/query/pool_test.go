@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestRequestPoolCapsConcurrency(t *testing.T) {
+	const poolSize = 3
+	var inFlight, maxInFlight, requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 5)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	// Both application services are interested in every user, so that each
+	// query makes more than one request.
+	cfg := &config.Dendrite{}
+	for _, id := range []string{"one", "two"} {
+		cfg.Derived.ApplicationServices = append(cfg.Derived.ApplicationServices, config.ApplicationService{
+			ID:  id,
+			URL: srv.URL,
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {{Regex: "@.*", RegexpObject: regexp.MustCompile("@.*")}},
+			},
+		})
+	}
+	a := &AppServiceQueryAPI{
+		HTTPClient: srv.Client(),
+		Cfg:        cfg,
+		Pool:       NewRequestPool(poolSize),
+	}
+
+	const queries = 50
+	var wg sync.WaitGroup
+	wg.Add(queries)
+	for i := 0; i < queries; i++ {
+		go func() {
+			defer wg.Done()
+			res := &api.UserIDExistsResponse{}
+			if err := a.UserIDExists(context.Background(), &api.UserIDExistsRequest{UserID: "@alice:localhost"}, res); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&requests); got != queries*2 {
+		t.Errorf("got %d requests, want %d", got, queries*2)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > poolSize {
+		t.Errorf("got %d requests in flight at once, want at most %d", got, poolSize)
+	}
+}
+
+func TestRequestPoolHonoursContext(t *testing.T) {
+	pool := NewRequestPool(1)
+	if err := pool.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.release()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := pool.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected a full pool to wait until the context expires, got %v", err)
+	}
+}
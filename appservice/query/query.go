@@ -18,10 +18,15 @@ package query
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	opentracing "github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
@@ -34,10 +39,70 @@ const userIDExistsPath = "/users/"
 type AppServiceQueryAPI struct {
 	HTTPClient *http.Client
 	Cfg        *config.Dendrite
+	// All requests to application services go through this pool, which
+	// caps how many are in flight at once. If nil then there is no cap.
+	Pool *RequestPool
+	// The IDs of application services which turned out not to support
+	// bulk user ID queries, so that we don't keep trying them.
+	noBulkUserIDs sync.Map // appservice ID -> struct{}
+	// Recent answers from RoomAliasExists and UserIDExists.
+	cache existenceCache
+	// The last answer from ThirdPartyProtocols.
+	protocols protocolCache
+}
+
+// newAppserviceRequest builds a GET request to the given path on the
+// application service, followed by the given ID. The hs token is sent in the
+// Authorization header, and also in the query string for older application
+// services if configured.
+// If the application service has a URL template or extra request headers
+// configured then these are applied. Application services with a unix://
+// URL are reached over their Unix domain socket.
+func newAppserviceRequest(
+	ctx context.Context, appservice *config.ApplicationService, path, id string,
+) (*http.Request, error) {
+	return newAppserviceRequestWithBody(ctx, appservice, http.MethodGet, path, id, nil)
+}
+
+// newAppserviceRequestWithBody is like newAppserviceRequest, but builds a
+// request with the given method and body.
+func newAppserviceRequestWithBody(
+	ctx context.Context, appservice *config.ApplicationService, method, path, id string, body io.Reader,
+) (*http.Request, error) {
+	var apiURL string
+	if appservice.URLTemplate != "" {
+		apiURL = appservice.ExpandURLTemplate((&url.URL{Path: path + id}).EscapedPath())
+	} else {
+		// The full path to the API, including the hs token if needed
+		var baseURL string
+		baseURL, ctx = types.ResolveURL(ctx, appservice.URL)
+		URL, err := url.Parse(baseURL + path)
+		if err != nil {
+			return nil, err
+		}
+		URL.Path += id
+		if appservice.AccessTokenInQuery {
+			URL.RawQuery = url.Values{"access_token": {appservice.HSToken}}.Encode()
+		}
+		apiURL = URL.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+appservice.HSToken)
+	for header, value := range appservice.RequestHeaders {
+		req.Header.Set(header, value)
+	}
+	return req, nil
 }
 
 // RoomAliasExists performs a request to '/room/{roomAlias}' on all known
-// handling application services until one admits to owning the room
+// handling application services concurrently, returning as soon as one admits
+// to owning the room. An error is only returned if none of them could be asked,
+// if one of them responded with an unexpected status code, or if the context is
+// cancelled before they have all answered.
 func (a *AppServiceQueryAPI) RoomAliasExists(
 	ctx context.Context,
 	request *api.RoomAliasExistsRequest,
@@ -46,65 +111,132 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceRoomAlias")
 	defer span.Finish()
 
-	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
-		if appservice.URL != "" && appservice.IsInterestedInRoomAlias(request.Alias) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + roomAliasExistsPath)
-			if err != nil {
-				return err
-			}
+	if exists, ok := a.cachedExistence(existenceKindRoomAlias, request.Alias); ok {
+		response.AliasExists = exists
+		return nil
+	}
 
-			URL.Path += request.Alias
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
+	// Once one application service says that the room exists, the requests
+	// to the others are cancelled.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			// Send a request to each application service. If one responds that it has
-			// created the room, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			req = req.WithContext(ctx)
-
-			resp, err := a.HTTPClient.Do(req)
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).WithError(err).Error("Unable to close application service response body")
-					}
-				}()
-			}
-			if err != nil {
-				log.WithError(err).Errorf("Issue querying room alias on application service %s", appservice.ID)
-				return err
-			}
-			switch resp.StatusCode {
-			case http.StatusOK:
-				// OK received from appservice. Room exists
-				response.AliasExists = true
-				return nil
-			case http.StatusNotFound:
-				// Room does not exist
-			default:
-				// Application service reported an error. Warn
-				log.WithFields(log.Fields{
-					"appservice_id": appservice.ID,
-					"status_code":   resp.StatusCode,
-				}).Warn("Application service responded with non-OK status code")
-			}
+	// Determine which application services should handle this request, and
+	// send a request to each of them.
+	type result struct {
+		appserviceID string
+		exists       bool
+		err          error
+	}
+	results := make(chan result, len(a.Cfg.Derived.ApplicationServices))
+	asked := 0
+	for i := range a.Cfg.Derived.ApplicationServices {
+		// Don't ask any more application services if the caller has gone.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !appservice.IsInterestedInRoomAlias(request.Alias) {
+			continue
 		}
+		asked++
+		go func() {
+			exists, err := a.roomAliasExistsOnAppservice(ctx, appservice, request.Alias)
+			results <- result{appservice.ID, exists, err}
+		}()
+	}
+
+	// The answer is only cached if every interested application service
+	// gave a definitive answer.
+	definitive := true
+	var failed int
+	var lastErr error
+	var asErr *api.AppServiceError
+	for i := 0; i < asked; i++ {
+		var res result
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case res = <-results:
+		}
+		switch {
+		case errors.As(res.err, &asErr):
+			definitive = false
+		case res.err != nil:
+			log.WithError(res.err).Errorf("Issue querying room alias on application service %s", res.appserviceID)
+			failed++
+			lastErr = res.err
+			definitive = false
+		case res.exists:
+			response.AliasExists = true
+			a.cacheExistence(existenceKindRoomAlias, request.Alias, true)
+			return nil
+		}
+	}
+	if asked > 0 && failed == asked {
+		return lastErr
+	}
+	if asErr != nil {
+		// Don't mistake a misbehaving application service for one which
+		// doesn't know about the room.
+		return asErr
 	}
 
 	response.AliasExists = false
+	if definitive {
+		a.cacheExistence(existenceKindRoomAlias, request.Alias, false)
+	}
 	return nil
 }
 
+// roomAliasExistsOnAppservice asks a single application service whether it
+// owns the room alias. An *api.AppServiceError is returned if the application
+// service responded with an unexpected status code.
+func (a *AppServiceQueryAPI) roomAliasExistsOnAppservice(
+	ctx context.Context, appservice *config.ApplicationService, alias string,
+) (exists bool, err error) {
+	req, err := newAppserviceRequest(ctx, appservice, roomAliasExistsPath, alias)
+	if err != nil {
+		return false, err
+	}
+	started := time.Now()
+	resp, err := a.doWithRetry(req)
+	observeQuery(appservice.ID, endpointRoomAlias, started, resp, err)
+	if err != nil {
+		return false, err
+	}
+	// Close the body straight away rather than deferring, so that the
+	// request doesn't hold its slot in the pool any longer than needed.
+	if err = resp.Body.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"appservice_id": appservice.ID,
+			"status_code":   resp.StatusCode,
+		}).WithError(err).Error("Unable to close application service response body")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// OK received from appservice. Room exists
+		return true, nil
+	case http.StatusNotFound:
+		// Room does not exist
+		return false, nil
+	default:
+		// Application service reported an error. Warn
+		log.WithFields(log.Fields{
+			"appservice_id": appservice.ID,
+			"status_code":   resp.StatusCode,
+		}).Warn("Application service responded with non-OK status code")
+		return false, &api.AppServiceError{AppServiceID: appservice.ID, StatusCode: resp.StatusCode}
+	}
+}
+
 // UserIDExists performs a request to '/users/{userID}' on all known
-// handling application services until one admits to owning the user ID
+// handling application services until one admits to owning the user ID. It
+// stops asking them if the context is cancelled. If none of them own the user
+// ID but one responded with an unexpected status code, then an
+// *api.AppServiceError is returned.
 func (a *AppServiceQueryAPI) UserIDExists(
 	ctx context.Context,
 	request *api.UserIDExistsRequest,
@@ -113,55 +245,112 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceUserID")
 	defer span.Finish()
 
+	if exists, ok := a.cachedExistence(existenceKindUserID, request.UserID); ok {
+		response.UserIDExists = exists
+		return nil
+	}
+
+	// Don't mistake a misbehaving application service for one which doesn't
+	// know about the user, unless another one does.
+	var asErr *api.AppServiceError
+
 	// Determine which application service should handle this request
 	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+		// Don't ask any more application services if the caller has gone.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		if appservice.URL != "" && appservice.IsInterestedInUserID(request.UserID) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + userIDExistsPath)
-			if err != nil {
-				return err
-			}
-			URL.Path += request.UserID
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
 			// Send a request to each application service. If one responds that it has
 			// created the user, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+			req, err := newAppserviceRequest(ctx, &appservice, userIDExistsPath, request.UserID)
 			if err != nil {
 				return err
 			}
-			resp, err := a.HTTPClient.Do(req.WithContext(ctx))
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).Error("Unable to close application service response body")
-					}
-				}()
-			}
+			started := time.Now()
+			resp, err := a.doWithRetry(req)
+			observeQuery(appservice.ID, endpointUserID, started, resp, err)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"appservice_id": appservice.ID,
 				}).WithError(err).Error("issue querying user ID on application service")
 				return err
 			}
+			if err = resp.Body.Close(); err != nil {
+				log.WithFields(log.Fields{
+					"appservice_id": appservice.ID,
+					"status_code":   resp.StatusCode,
+				}).Error("Unable to close application service response body")
+			}
 			if resp.StatusCode == http.StatusOK {
 				// StatusOK received from appservice. User ID exists
 				response.UserIDExists = true
+				a.cacheExistence(existenceKindUserID, request.UserID, true)
 				return nil
 			}
+			if resp.StatusCode == http.StatusNotFound {
+				continue
+			}
 
 			// Log non OK
 			log.WithFields(log.Fields{
 				"appservice_id": appservice.ID,
 				"status_code":   resp.StatusCode,
 			}).Warn("application service responded with non-OK status code")
+			if asErr == nil {
+				asErr = &api.AppServiceError{AppServiceID: appservice.ID, StatusCode: resp.StatusCode}
+			}
 		}
 	}
 
 	response.UserIDExists = false
+	if asErr != nil {
+		return asErr
+	}
+	a.cacheExistence(existenceKindUserID, request.UserID, false)
+	return nil
+}
+
+// RoomAliasesOwned matches the given room aliases against the alias namespaces
+// of all known application services. The first application service whose
+// namespace covers an alias is reported as its owner. No requests are made to
+// the application services.
+func (a *AppServiceQueryAPI) RoomAliasesOwned(
+	ctx context.Context,
+	request *api.RoomAliasesOwnedRequest,
+	response *api.RoomAliasesOwnedResponse,
+) error {
+	response.Owners = make(map[string]string)
+	for _, alias := range request.Aliases {
+		for _, appservice := range a.Cfg.Derived.ApplicationServices {
+			if appservice.IsInterestedInRoomAlias(alias) {
+				response.Owners[alias] = appservice.ID
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// UserIDsOwned matches the given user IDs against the user namespaces of all
+// known application services. The first application service whose namespace
+// covers a user ID is reported as its owner. No requests are made to the
+// application services.
+func (a *AppServiceQueryAPI) UserIDsOwned(
+	ctx context.Context,
+	request *api.UserIDsOwnedRequest,
+	response *api.UserIDsOwnedResponse,
+) error {
+	response.Owners = make(map[string]string)
+	for _, userID := range request.UserIDs {
+		for _, appservice := range a.Cfg.Derived.ApplicationServices {
+			if appservice.IsInterestedInUserID(userID) {
+				response.Owners[userID] = appservice.ID
+				break
+			}
+		}
+	}
 	return nil
 }
@@ -0,0 +1,429 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestNewAppserviceRequestDefaultURL(t *testing.T) {
+	appservice := &config.ApplicationService{
+		URL:     "http://localhost:9000",
+		HSToken: "hs_token",
+	}
+	req, err := newAppserviceRequest(context.Background(), appservice, roomAliasExistsPath, "#alias:localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "http://localhost:9000/rooms/%23alias:localhost"
+	if got := req.URL.String(); got != want {
+		t.Fatalf("got URL %q, want %q", got, want)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer hs_token" {
+		t.Fatalf("got Authorization header %q, want %q", got, "Bearer hs_token")
+	}
+	if len(req.Header) != 1 {
+		t.Fatalf("expected no extra headers, got %v", req.Header)
+	}
+}
+
+func TestNewAppserviceRequestAccessTokenInQuery(t *testing.T) {
+	appservice := &config.ApplicationService{
+		URL:                "http://localhost:9000",
+		HSToken:            "hs_token",
+		AccessTokenInQuery: true,
+	}
+	req, err := newAppserviceRequest(context.Background(), appservice, roomAliasExistsPath, "#alias:localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "http://localhost:9000/rooms/%23alias:localhost?access_token=hs_token"
+	if got := req.URL.String(); got != want {
+		t.Fatalf("got URL %q, want %q", got, want)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer hs_token" {
+		t.Fatalf("got Authorization header %q, want %q", got, "Bearer hs_token")
+	}
+}
+
+func TestUserIDExistsSendsAuthorizationHeader(t *testing.T) {
+	var gotAuthorization, gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthorization = r.Header.Get("Authorization")
+		gotQuery = r.URL.RawQuery
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:      "irc",
+		URL:     srv.URL,
+		HSToken: "hs_token",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {{Regex: "@irc_.*", RegexpObject: regexp.MustCompile("@irc_.*")}},
+		},
+	}}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.UserIDExistsResponse{}
+	if err := a.UserIDExists(context.Background(), &api.UserIDExistsRequest{UserID: "@irc_test:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.UserIDExists {
+		t.Fatal("expected user ID to exist")
+	}
+	if gotAuthorization != "Bearer hs_token" {
+		t.Errorf("got Authorization header %q, want %q", gotAuthorization, "Bearer hs_token")
+	}
+	if strings.Contains(gotQuery, "hs_token") {
+		t.Errorf("expected the token not to be in the query string, got %q", gotQuery)
+	}
+}
+
+func TestRoomAliasExistsWithURLTemplate(t *testing.T) {
+	var gotPath, gotQuery, gotHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		gotQuery = r.URL.RawQuery
+		gotHeader = r.Header.Get("X-Gateway-Route")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	appservice := config.ApplicationService{
+		ID:          "irc",
+		URL:         "http://bridge.internal:9000",
+		HSToken:     "hs token",
+		URLTemplate: srv.URL + "/gateway/irc{path}?token={access_token}&route=irc",
+		RequestHeaders: map[string]string{
+			"X-Gateway-Route": "irc",
+		},
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"aliases": {{Regex: "#irc_.*", RegexpObject: regexp.MustCompile("#irc_.*")}},
+		},
+	}
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{appservice}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.RoomAliasExistsResponse{}
+	if err := a.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.AliasExists {
+		t.Fatal("expected alias to exist")
+	}
+	if want := "/gateway/irc/rooms/%23irc_test:localhost"; gotPath != want {
+		t.Errorf("got path %q, want %q", gotPath, want)
+	}
+	if want := "token=hs+token&route=irc"; gotQuery != want {
+		t.Errorf("got query %q, want %q", gotQuery, want)
+	}
+	if gotHeader != "irc" {
+		t.Errorf("got header %q, want %q", gotHeader, "irc")
+	}
+}
+
+func TestRoomAliasExistsRetriesServerErrors(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.AppServiceAPI.QueryRetry = config.QueryRetryOptions{Attempts: 3, BaseDelay: time.Millisecond}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:  "irc",
+		URL: srv.URL,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"aliases": {{Regex: "#irc_.*", RegexpObject: regexp.MustCompile("#irc_.*")}},
+		},
+	}}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.RoomAliasExistsResponse{}
+	if err := a.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.AliasExists {
+		t.Fatal("expected alias to exist")
+	}
+	if requests != 3 {
+		t.Fatalf("got %d requests, want 3", requests)
+	}
+}
+
+func TestUserIDExistsDoesNotRetryNotFound(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.AppServiceAPI.QueryRetry = config.QueryRetryOptions{Attempts: 3, BaseDelay: time.Millisecond}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:  "irc",
+		URL: srv.URL,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {{Regex: "@irc_.*", RegexpObject: regexp.MustCompile("@irc_.*")}},
+		},
+	}}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.UserIDExistsResponse{}
+	if err := a.UserIDExists(context.Background(), &api.UserIDExistsRequest{UserID: "@irc_test:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.UserIDExists {
+		t.Fatal("expected user ID not to exist")
+	}
+	if requests != 1 {
+		t.Fatalf("got %d requests, want 1", requests)
+	}
+}
+
+func TestExistenceQueriesSurfaceAppServiceErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:  "irc",
+		URL: srv.URL,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users":   {{Regex: "@irc_.*", RegexpObject: regexp.MustCompile("@irc_.*")}},
+			"aliases": {{Regex: "#irc_.*", RegexpObject: regexp.MustCompile("#irc_.*")}},
+		},
+	}}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	// A broken application service isn't mistaken for one which doesn't
+	// know about the user or the room alias.
+	var asErr *api.AppServiceError
+	userRes := &api.UserIDExistsResponse{}
+	err := a.UserIDExists(context.Background(), &api.UserIDExistsRequest{UserID: "@irc_test:localhost"}, userRes)
+	if !errors.As(err, &asErr) {
+		t.Fatalf("expected an application service error, got %v", err)
+	}
+	if asErr.AppServiceID != "irc" || asErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected application service error %+v", asErr)
+	}
+	asErr = nil
+	aliasRes := &api.RoomAliasExistsResponse{}
+	err = a.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, aliasRes)
+	if !errors.As(err, &asErr) {
+		t.Fatalf("expected an application service error, got %v", err)
+	}
+	if asErr.AppServiceID != "irc" || asErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected application service error %+v", asErr)
+	}
+}
+
+func TestUserIDExistsStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first application service doesn't know the user, but the caller
+	// goes away while it is answering.
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer first.Close()
+	var later int32
+	rest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&later, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer rest.Close()
+
+	users := map[string][]config.ApplicationServiceNamespace{
+		"users": {{Regex: "@irc_.*", RegexpObject: regexp.MustCompile("@irc_.*")}},
+	}
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "first", URL: first.URL, NamespaceMap: users},
+		{ID: "second", URL: rest.URL, NamespaceMap: users},
+		{ID: "third", URL: rest.URL, NamespaceMap: users},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: &http.Client{}, Cfg: cfg}
+
+	res := &api.UserIDExistsResponse{}
+	err := a.UserIDExists(ctx, &api.UserIDExistsRequest{UserID: "@irc_test:localhost"}, res)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context to be cancelled, got %v", err)
+	}
+	if res.UserIDExists {
+		t.Fatal("expected user ID not to exist")
+	}
+	if n := atomic.LoadInt32(&later); n != 0 {
+		t.Fatalf("expected no more application services to be asked, got %d requests", n)
+	}
+}
+
+func TestRoomAliasExistsStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Neither application service answers until the caller goes away.
+	asked := make(chan struct{}, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	aliases := map[string][]config.ApplicationServiceNamespace{
+		"aliases": {{Regex: "#irc_.*", RegexpObject: regexp.MustCompile("#irc_.*")}},
+	}
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "first", URL: srv.URL, NamespaceMap: aliases},
+		{ID: "second", URL: srv.URL, NamespaceMap: aliases},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: &http.Client{}, Cfg: cfg}
+
+	go func() {
+		<-asked
+		cancel()
+	}()
+	started := time.Now()
+	res := &api.RoomAliasExistsResponse{}
+	err := a.RoomAliasExists(ctx, &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, res)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context to be cancelled, got %v", err)
+	}
+	if took := time.Since(started); took > 5*time.Second {
+		t.Fatalf("expected to stop waiting once cancelled, took %s", took)
+	}
+}
+
+func TestRoomAliasExistsAsksAppservicesConcurrently(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	broken.Close()
+
+	aliases := map[string][]config.ApplicationServiceNamespace{
+		"aliases": {{Regex: "#irc_.*", RegexpObject: regexp.MustCompile("#irc_.*")}},
+	}
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "slow", URL: slow.URL, NamespaceMap: aliases},
+		{ID: "broken", URL: broken.URL, NamespaceMap: aliases},
+		{ID: "fast", URL: fast.URL, NamespaceMap: aliases},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: &http.Client{}, Cfg: cfg}
+
+	// The fast application service answers without waiting for the slow
+	// one, and the one which can't be reached doesn't fail the query.
+	started := time.Now()
+	res := &api.RoomAliasExistsResponse{}
+	if err := a.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.AliasExists {
+		t.Fatal("expected alias to exist")
+	}
+	if took := time.Since(started); took > 5*time.Second {
+		t.Fatalf("expected the fast application service to answer first, took %s", took)
+	}
+
+	// If none of the application services can be asked then that's an error.
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "broken", URL: broken.URL, NamespaceMap: aliases},
+	}
+	if err := a.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, res); err == nil {
+		t.Fatal("expected an error when no application service can be asked")
+	}
+}
+
+func TestRoomAliasExistsOverUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "bridge.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotPath string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		w.WriteHeader(http.StatusOK)
+	}))
+	_ = srv.Listener.Close()
+	srv.Listener = listener
+	srv.Start()
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:  "irc",
+		URL: "unix://" + socket,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"aliases": {{Regex: "#irc_.*", RegexpObject: regexp.MustCompile("#irc_.*")}},
+		},
+	}}
+	client := &http.Client{Transport: &http.Transport{DialContext: types.DialContext(&net.Dialer{})}}
+	a := &AppServiceQueryAPI{HTTPClient: client, Cfg: cfg}
+
+	res := &api.RoomAliasExistsResponse{}
+	if err := a.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#irc_test:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.AliasExists {
+		t.Fatal("expected alias to exist")
+	}
+	if want := "/rooms/%23irc_test:localhost"; gotPath != want {
+		t.Fatalf("got path %q, want %q", gotPath, want)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+func (a *AppServiceQueryAPI) retryOptions() config.QueryRetryOptions {
+	if a.Cfg == nil {
+		return config.QueryRetryOptions{}
+	}
+	return a.Cfg.AppServiceAPI.QueryRetry
+}
+
+// doWithRetry sends a request to an application service like do, but retries
+// it with an exponential backoff if the request fails or the application
+// service responds with a server error, as it may just be restarting. Any
+// other response, such as a 404, is definitive and is returned straight away.
+// The request must not have a body, so that it can be sent more than once.
+func (a *AppServiceQueryAPI) doWithRetry(req *http.Request) (*http.Response, error) {
+	opts := a.retryOptions()
+	for attempt := 1; ; attempt++ {
+		resp, err := a.do(req)
+		if attempt >= opts.Attempts || !isRetryableResponse(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		fields := log.Fields{
+			"path":    req.URL.Path,
+			"attempt": attempt,
+		}
+		if err == nil {
+			fields["status_code"] = resp.StatusCode
+			_ = resp.Body.Close()
+		}
+		log.WithFields(fields).WithError(err).Warn("Application service query failed, retrying")
+		if err = sleepContext(req.Context(), retryDelay(opts.BaseDelay, attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isRetryableResponse returns true if the request failed or the application
+// service responded with a server error, other than that the request isn't
+// implemented, which won't change if we ask again.
+func isRetryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented
+}
+
+// retryDelay returns how long to wait before the given retry, doubling the
+// base delay for each retry and adding up to half as much again as jitter, so
+// that queries which failed together aren't all retried at the same moment.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt-1)
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	opentracing "github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const thirdPartyProtocolPath = "/_matrix/app/v1/thirdparty/protocol/"
+const thirdPartyLocationPath = "/_matrix/app/v1/thirdparty/location/"
+const thirdPartyUserPath = "/_matrix/app/v1/thirdparty/user/"
+
+// ThirdPartyProtocols asks each application service about the protocols that
+// it claims to provide and merges the results by protocol ID. The metadata of
+// the first application service to describe a protocol is used, and the
+// instances from all application services that provide it are combined.
+// Application services which can't be reached are skipped. The results are
+// cached for the configured refresh interval, as long as every application
+// service could be reached.
+func (a *AppServiceQueryAPI) ThirdPartyProtocols(
+	ctx context.Context,
+	request *api.ThirdPartyProtocolsRequest,
+	response *api.ThirdPartyProtocolsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyProtocols")
+	defer span.Finish()
+
+	interval := a.thirdPartyProtocolsRefreshInterval()
+	var generation uint64
+	if interval > 0 {
+		var ok bool
+		if response.Protocols, _, ok = a.protocols.get(interval, time.Now()); ok {
+			return nil
+		}
+		a.protocols.refreshMu.Lock()
+		defer a.protocols.refreshMu.Unlock()
+		// Another caller may have refreshed the protocols while we waited.
+		if response.Protocols, generation, ok = a.protocols.get(interval, time.Now()); ok {
+			return nil
+		}
+	}
+
+	complete := true
+	response.Protocols = make(map[string]api.ThirdPartyProtocol)
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" {
+			continue
+		}
+		for _, protocolID := range appservice.Protocols {
+			protocol, err := a.queryThirdPartyProtocol(ctx, appservice, protocolID)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"appservice_id": appservice.ID,
+					"protocol":      protocolID,
+				}).WithError(err).Warn("Unable to query third party protocol on application service")
+				complete = false
+				continue
+			}
+			if protocol == nil {
+				continue
+			}
+			var conflicts []string
+			response.Protocols[protocolID], conflicts = mergeThirdPartyProtocol(
+				response.Protocols[protocolID], *protocol, appservice.ID,
+			)
+			if len(conflicts) > 0 {
+				log.WithFields(log.Fields{
+					"appservice_id": appservice.ID,
+					"protocol":      protocolID,
+					"fields":        conflicts,
+				}).Warn("Application service describes third party protocol fields differently to another, keeping the first")
+			}
+		}
+	}
+	if interval > 0 && complete {
+		a.protocols.set(response.Protocols, generation, time.Now())
+	}
+	return nil
+}
+
+// queryThirdPartyProtocol fetches a protocol from an application service. It
+// returns nil if the application service doesn't know about the protocol.
+func (a *AppServiceQueryAPI) queryThirdPartyProtocol(
+	ctx context.Context, appservice *config.ApplicationService, protocolID string,
+) (*api.ThirdPartyProtocol, error) {
+	req, err := newAppserviceRequest(ctx, appservice, thirdPartyProtocolPath, protocolID)
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	resp, err := a.do(req)
+	observeQuery(appservice.ID, endpointProtocol, started, resp, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("application service responded with status code %d", resp.StatusCode)
+	}
+	var protocol api.ThirdPartyProtocol
+	if err = json.NewDecoder(resp.Body).Decode(&protocol); err != nil {
+		return nil, fmt.Errorf("json.Decode: %w", err)
+	}
+	return &protocol, nil
+}
+
+// mergeThirdPartyProtocol merges a protocol from the given application service
+// into what we know about the protocol so far. Fields that are already known
+// take precedence, and instances are deduplicated by their instance ID, which
+// is derived from the application service ID and network ID when not given.
+// Returns the names of any field types which the application service described
+// differently to an earlier one, in which case the earlier description is kept.
+func mergeThirdPartyProtocol(
+	merged, protocol api.ThirdPartyProtocol, appserviceID string,
+) (api.ThirdPartyProtocol, []string) {
+	if len(merged.UserFields) == 0 {
+		merged.UserFields = protocol.UserFields
+	}
+	if len(merged.LocationFields) == 0 {
+		merged.LocationFields = protocol.LocationFields
+	}
+	if merged.Icon == "" {
+		merged.Icon = protocol.Icon
+	}
+	if merged.FieldTypes == nil {
+		merged.FieldTypes = make(map[string]api.ThirdPartyFieldType, len(protocol.FieldTypes))
+	}
+	var conflicts []string
+	for field, fieldType := range protocol.FieldTypes {
+		existing, ok := merged.FieldTypes[field]
+		if !ok {
+			merged.FieldTypes[field] = fieldType
+		} else if existing != fieldType {
+			conflicts = append(conflicts, field)
+		}
+	}
+	sort.Strings(conflicts)
+
+	seen := make(map[string]struct{}, len(merged.Instances))
+	for _, instance := range merged.Instances {
+		seen[instance.InstanceID] = struct{}{}
+	}
+	for _, instance := range protocol.Instances {
+		if instance.InstanceID == "" {
+			instance.InstanceID = appserviceID + "|" + instance.NetworkID
+		}
+		if _, ok := seen[instance.InstanceID]; ok {
+			continue
+		}
+		seen[instance.InstanceID] = struct{}{}
+		merged.Instances = append(merged.Instances, instance)
+	}
+	sort.SliceStable(merged.Instances, func(i, j int) bool {
+		return merged.Instances[i].InstanceID < merged.Instances[j].InstanceID
+	})
+	if merged.UserFields == nil {
+		merged.UserFields = []string{}
+	}
+	if merged.LocationFields == nil {
+		merged.LocationFields = []string{}
+	}
+	if merged.Instances == nil {
+		merged.Instances = []api.ThirdPartyProtocolInstance{}
+	}
+	return merged, conflicts
+}
+
+// ThirdPartyLocation asks each application service which provides the
+// protocol for the Matrix rooms bridging to the location described by the
+// given fields, and combines the results. Application services which can't be
+// reached are skipped.
+func (a *AppServiceQueryAPI) ThirdPartyLocation(
+	ctx context.Context,
+	request *api.ThirdPartyLocationRequest,
+	response *api.ThirdPartyLocationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyLocation")
+	defer span.Finish()
+
+	response.Locations = []api.ThirdPartyLocation{}
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !providesProtocol(appservice, request.Protocol) {
+			continue
+		}
+		locations, err := a.queryThirdPartyLocation(ctx, appservice, request.Protocol, request.Fields)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"protocol":      request.Protocol,
+			}).WithError(err).Warn("Unable to query third party location on application service")
+			continue
+		}
+		response.Locations = append(response.Locations, locations...)
+	}
+	return nil
+}
+
+func providesProtocol(appservice *config.ApplicationService, protocolID string) bool {
+	for _, protocol := range appservice.Protocols {
+		if protocol == protocolID {
+			return true
+		}
+	}
+	return false
+}
+
+// queryThirdPartyLocation fetches the locations matching the given fields from
+// an application service.
+func (a *AppServiceQueryAPI) queryThirdPartyLocation(
+	ctx context.Context, appservice *config.ApplicationService, protocolID string, fields map[string]string,
+) ([]api.ThirdPartyLocation, error) {
+	var locations []api.ThirdPartyLocation
+	err := a.queryThirdPartyLookup(ctx, appservice, thirdPartyLocationPath, endpointLocation, protocolID, fields, &locations)
+	return locations, err
+}
+
+// ThirdPartyUser asks each application service which provides the protocol
+// for the Matrix users bridging to the third party user described by the given
+// fields, and combines the results. A user reported by more than one
+// application service is only included once. Application services which can't
+// be reached are skipped.
+func (a *AppServiceQueryAPI) ThirdPartyUser(
+	ctx context.Context,
+	request *api.ThirdPartyUserRequest,
+	response *api.ThirdPartyUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyUser")
+	defer span.Finish()
+
+	response.Users = []api.ThirdPartyUser{}
+	seen := map[string]struct{}{}
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !providesProtocol(appservice, request.Protocol) {
+			continue
+		}
+		var users []api.ThirdPartyUser
+		if err := a.queryThirdPartyLookup(ctx, appservice, thirdPartyUserPath, endpointThirdPartyUser, request.Protocol, request.Fields, &users); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"protocol":      request.Protocol,
+			}).WithError(err).Warn("Unable to query third party user on application service")
+			continue
+		}
+		for _, user := range users {
+			if _, ok := seen[user.UserID]; ok {
+				continue
+			}
+			seen[user.UserID] = struct{}{}
+			response.Users = append(response.Users, user)
+		}
+	}
+	return nil
+}
+
+// queryThirdPartyLookup looks up the third party locations or users matching
+// the given fields on an application service, decoding the results into res.
+// The fields are sent as query parameters. If the application service doesn't
+// know about any then res is left alone.
+func (a *AppServiceQueryAPI) queryThirdPartyLookup(
+	ctx context.Context, appservice *config.ApplicationService, path, endpoint, protocolID string,
+	fields map[string]string, res interface{},
+) error {
+	req, err := newAppserviceRequest(ctx, appservice, path, protocolID)
+	if err != nil {
+		return err
+	}
+	query := req.URL.Query()
+	for field, value := range fields {
+		query.Set(field, value)
+	}
+	req.URL.RawQuery = query.Encode()
+	started := time.Now()
+	resp, err := a.do(req)
+	observeQuery(appservice.ID, endpoint, started, resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("application service responded with status code %d", resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("json.Decode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+)
+
+// protocolCache remembers the merged third party protocols which were last
+// described by the application services. The zero value is an empty cache.
+type protocolCache struct {
+	mu         sync.RWMutex
+	protocols  map[string]api.ThirdPartyProtocol
+	fetched    time.Time
+	generation uint64 // incremented whenever the cache is invalidated
+	// Held while asking the application services, so that concurrent
+	// callers wait for one refresh rather than all asking at once.
+	refreshMu sync.Mutex
+}
+
+// get returns a copy of the cached protocols, or false if there aren't any
+// or they were fetched at least interval ago. It also returns the current
+// generation, which must be given to set.
+func (c *protocolCache) get(interval time.Duration, now time.Time) (map[string]api.ThirdPartyProtocol, uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.protocols == nil || now.Sub(c.fetched) >= interval {
+		return nil, c.generation, false
+	}
+	protocols := make(map[string]api.ThirdPartyProtocol, len(c.protocols))
+	for protocolID, protocol := range c.protocols {
+		protocols[protocolID] = protocol
+	}
+	return protocols, c.generation, true
+}
+
+// set caches the protocols, unless the cache was invalidated since the given
+// generation was returned by get, in which case they may already be stale.
+func (c *protocolCache) set(protocols map[string]api.ThirdPartyProtocol, generation uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.protocols = make(map[string]api.ThirdPartyProtocol, len(protocols))
+	for protocolID, protocol := range protocols {
+		c.protocols[protocolID] = protocol
+	}
+	c.fetched = now
+}
+
+func (c *protocolCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.protocols = nil
+	c.generation++
+}
+
+func (a *AppServiceQueryAPI) thirdPartyProtocolsRefreshInterval() time.Duration {
+	if a.Cfg == nil {
+		return 0
+	}
+	return a.Cfg.AppServiceAPI.ThirdPartyProtocolsRefreshInterval
+}
+
+// ForgetThirdPartyProtocols forgets the cached third party protocols, so that
+// the application services are asked about them again next time, e.g.
+// because an application service has been reconfigured.
+func (a *AppServiceQueryAPI) ForgetThirdPartyProtocols() {
+	a.protocols.invalidate()
+}
@@ -0,0 +1,313 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestThirdPartyProtocolsMergesAppservices(t *testing.T) {
+	responses := map[string]string{
+		"/as1/_matrix/app/v1/thirdparty/protocol/irc": `{
+			"user_fields": ["network", "nickname"],
+			"location_fields": ["network", "channel"],
+			"icon": "mxc://example.org/irc",
+			"field_types": {
+				"network": {"regexp": "([a-z0-9]+\\.)*[a-z0-9]+", "placeholder": "irc.example.org"}
+			},
+			"instances": [
+				{"desc": "Libera", "fields": {"network": "libera.chat"}, "network_id": "libera"}
+			]
+		}`,
+		"/as2/_matrix/app/v1/thirdparty/protocol/irc": `{
+			"user_fields": ["ignored"],
+			"icon": "mxc://example.org/ignored",
+			"field_types": {
+				"network": {"regexp": "ignored", "placeholder": "ignored"},
+				"channel": {"regexp": "#[^\\s]+", "placeholder": "#foo"}
+			},
+			"instances": [
+				{"desc": "OFTC", "fields": {"network": "oftc.net"}, "network_id": "oftc"},
+				{"desc": "OFTC again", "fields": {"network": "oftc.net"}, "network_id": "oftc"}
+			]
+		}`,
+		"/as2/_matrix/app/v1/thirdparty/protocol/gitter": `{
+			"user_fields": ["username"],
+			"location_fields": ["room"],
+			"icon": "",
+			"field_types": {},
+			"instances": []
+		}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "as1", URL: srv.URL + "/as1", Protocols: []string{"irc"}},
+		{ID: "as2", URL: srv.URL + "/as2", Protocols: []string{"irc", "gitter", "slack"}},
+		{ID: "as3", URL: "", Protocols: []string{"irc"}},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.ThirdPartyProtocolsResponse{}
+	if err := a.ThirdPartyProtocols(context.Background(), &api.ThirdPartyProtocolsRequest{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Protocols) != 2 {
+		t.Fatalf("expected 2 protocols, got %d: %+v", len(res.Protocols), res.Protocols)
+	}
+	if _, ok := res.Protocols["slack"]; ok {
+		t.Fatal("expected unknown protocol to be omitted")
+	}
+
+	irc := res.Protocols["irc"]
+	if len(irc.UserFields) != 2 || irc.UserFields[0] != "network" {
+		t.Errorf("expected user fields from the first appservice, got %v", irc.UserFields)
+	}
+	if irc.Icon != "mxc://example.org/irc" {
+		t.Errorf("expected icon from the first appservice, got %q", irc.Icon)
+	}
+	if got := irc.FieldTypes["network"].Placeholder; got != "irc.example.org" {
+		t.Errorf("expected network field type from the first appservice, got %q", got)
+	}
+	if got := irc.FieldTypes["channel"].Placeholder; got != "#foo" {
+		t.Errorf("expected channel field type from the second appservice, got %q", got)
+	}
+	wantInstances := []string{"as1|libera", "as2|oftc"}
+	if len(irc.Instances) != len(wantInstances) {
+		t.Fatalf("expected instances %v, got %+v", wantInstances, irc.Instances)
+	}
+	for i, want := range wantInstances {
+		if got := irc.Instances[i].InstanceID; got != want {
+			t.Errorf("instance %d: got instance ID %q, want %q", i, got, want)
+		}
+	}
+
+	gitter := res.Protocols["gitter"]
+	if gitter.Instances == nil || len(gitter.Instances) != 0 {
+		t.Errorf("expected no instances for gitter, got %+v", gitter.Instances)
+	}
+}
+
+func TestMergeThirdPartyProtocolConflicts(t *testing.T) {
+	first := api.ThirdPartyProtocol{
+		FieldTypes: map[string]api.ThirdPartyFieldType{
+			"network": {Regexp: "[a-z.]+", Placeholder: "irc.example.org"},
+			"channel": {Regexp: "#[^\\s]+", Placeholder: "#foo"},
+		},
+		Instances: []api.ThirdPartyProtocolInstance{{NetworkID: "libera"}},
+	}
+	second := api.ThirdPartyProtocol{
+		FieldTypes: map[string]api.ThirdPartyFieldType{
+			"network":  {Regexp: ".*", Placeholder: "anything"},
+			"channel":  {Regexp: "#[^\\s]+", Placeholder: "#foo"},
+			"nickname": {Regexp: "[^\\s]+", Placeholder: "alice"},
+		},
+		Instances: []api.ThirdPartyProtocolInstance{{NetworkID: "libera"}, {NetworkID: "oftc"}},
+	}
+
+	merged, conflicts := mergeThirdPartyProtocol(api.ThirdPartyProtocol{}, first, "as1")
+	if len(conflicts) != 0 {
+		t.Fatalf("expected no conflicts for the first appservice, got %v", conflicts)
+	}
+	merged, conflicts = mergeThirdPartyProtocol(merged, second, "as2")
+	if len(conflicts) != 1 || conflicts[0] != "network" {
+		t.Fatalf("expected the network field to conflict, got %v", conflicts)
+	}
+	if got := merged.FieldTypes["network"].Placeholder; got != "irc.example.org" {
+		t.Errorf("expected the first description of the network field to be kept, got %q", got)
+	}
+	if _, ok := merged.FieldTypes["nickname"]; !ok || len(merged.FieldTypes) != 3 {
+		t.Errorf("expected the field types to be combined, got %+v", merged.FieldTypes)
+	}
+	// The same network ID from different appservices is a different instance.
+	wantInstances := []string{"as1|libera", "as2|libera", "as2|oftc"}
+	if len(merged.Instances) != len(wantInstances) {
+		t.Fatalf("expected instances %v, got %+v", wantInstances, merged.Instances)
+	}
+	for i, want := range wantInstances {
+		if got := merged.Instances[i].InstanceID; got != want {
+			t.Errorf("instance %d: got instance ID %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestThirdPartyProtocolsCached(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{"user_fields": [], "location_fields": [], "icon": "", "field_types": {}, "instances": []}`))
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.AppServiceAPI.ThirdPartyProtocolsRefreshInterval = time.Minute
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "as1", URL: srv.URL, Protocols: []string{"irc"}},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	// Concurrent reads within the refresh interval only ask once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &api.ThirdPartyProtocolsResponse{}
+			if err := a.ThirdPartyProtocols(context.Background(), &api.ThirdPartyProtocolsRequest{}, res); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, ok := res.Protocols["irc"]; !ok || len(res.Protocols) != 1 {
+				t.Errorf("expected the irc protocol, got %+v", res.Protocols)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("expected the appservice to be asked once, got %d", got)
+	}
+
+	// Once forgotten, the appservice is asked again.
+	a.ForgetThirdPartyProtocols()
+	res := &api.ThirdPartyProtocolsResponse{}
+	if err := a.ThirdPartyProtocols(context.Background(), &api.ThirdPartyProtocolsRequest{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("expected the appservice to be asked again, got %d", got)
+	}
+
+	// Once the refresh interval has passed, the appservice is asked again.
+	a.protocols.mu.Lock()
+	a.protocols.fetched = a.protocols.fetched.Add(-time.Minute)
+	a.protocols.mu.Unlock()
+	if err := a.ThirdPartyProtocols(context.Background(), &api.ThirdPartyProtocolsRequest{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Fatalf("expected the appservice to be asked after the refresh interval, got %d", got)
+	}
+}
+
+func TestThirdPartyLocationCombinesAppservices(t *testing.T) {
+	var gotChannel string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/irc/_matrix/app/v1/thirdparty/location/irc":
+			gotChannel = r.URL.Query().Get("channel")
+			_, _ = w.Write([]byte(`[
+				{"alias": "#irc_libera_#foo:localhost", "protocol": "irc", "fields": {"network": "libera.chat", "channel": "#foo"}},
+				{"alias": "#irc_oftc_#foo:localhost", "protocol": "irc", "fields": {"network": "oftc.net", "channel": "#foo"}}
+			]`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "irc", URL: srv.URL + "/irc", Protocols: []string{"irc"}},
+		{ID: "broken", URL: srv.URL + "/broken", Protocols: []string{"irc"}},
+		{ID: "gitter", URL: srv.URL + "/gitter", Protocols: []string{"gitter"}},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.ThirdPartyLocationResponse{}
+	if err := a.ThirdPartyLocation(context.Background(), &api.ThirdPartyLocationRequest{
+		Protocol: "irc",
+		Fields:   map[string]string{"channel": "#foo"},
+	}, res); err != nil {
+		t.Fatal(err)
+	}
+	if gotChannel != "#foo" {
+		t.Errorf("got channel field %q, want %q", gotChannel, "#foo")
+	}
+	if len(res.Locations) != 2 {
+		t.Fatalf("got %d locations, want 2", len(res.Locations))
+	}
+	for i, want := range []string{"#irc_libera_#foo:localhost", "#irc_oftc_#foo:localhost"} {
+		if res.Locations[i].Alias != want || res.Locations[i].Protocol != "irc" {
+			t.Errorf("location %d: got %+v, want alias %q", i, res.Locations[i], want)
+		}
+	}
+}
+
+func TestThirdPartyUserMergesAppservices(t *testing.T) {
+	var gotNickname []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/as1/_matrix/app/v1/thirdparty/user/irc":
+			gotNickname = append(gotNickname, r.URL.Query().Get("nickname"))
+			_, _ = w.Write([]byte(`[
+				{"userid": "@irc_libera_alice:localhost", "protocol": "irc", "fields": {"network": "libera.chat", "nickname": "alice"}}
+			]`))
+		case "/as2/_matrix/app/v1/thirdparty/user/irc":
+			gotNickname = append(gotNickname, r.URL.Query().Get("nickname"))
+			_, _ = w.Write([]byte(`[
+				{"userid": "@irc_libera_alice:localhost", "protocol": "irc", "fields": {"network": "libera.chat", "nickname": "alice"}},
+				{"userid": "@irc_oftc_alice:localhost", "protocol": "irc", "fields": {"network": "oftc.net", "nickname": "alice"}}
+			]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ID: "as1", URL: srv.URL + "/as1", Protocols: []string{"irc"}},
+		{ID: "as2", URL: srv.URL + "/as2", Protocols: []string{"irc"}},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: srv.Client(), Cfg: cfg}
+
+	res := &api.ThirdPartyUserResponse{}
+	if err := a.ThirdPartyUser(context.Background(), &api.ThirdPartyUserRequest{
+		Protocol: "irc",
+		Fields:   map[string]string{"nickname": "alice"},
+	}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotNickname) != 2 || gotNickname[0] != "alice" || gotNickname[1] != "alice" {
+		t.Errorf("got nickname fields %v, want alice from both application services", gotNickname)
+	}
+	want := []string{"@irc_libera_alice:localhost", "@irc_oftc_alice:localhost"}
+	if len(res.Users) != len(want) {
+		t.Fatalf("got %d users, want %d", len(res.Users), len(want))
+	}
+	for i, userID := range want {
+		if res.Users[i].UserID != userID {
+			t.Errorf("user %d: got %q, want %q", i, res.Users[i].UserID, userID)
+		}
+	}
+}
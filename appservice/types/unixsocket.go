@@ -0,0 +1,59 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/url"
+)
+
+// UnixSocketScheme is the URL scheme of application services which are
+// reached over a Unix domain socket rather than TCP, e.g.
+// unix:///run/bridge.sock.
+const UnixSocketScheme = "unix"
+
+type unixSocketContextKey struct{}
+
+// ResolveURL returns the base URL to use for requests to an application
+// service with the given URL, along with the context to send them with. If the
+// application service is reached over a Unix domain socket then requests are
+// sent over HTTP to a host name standing in for the socket, so that request
+// paths are preserved and connections to different sockets aren't mixed up,
+// and the returned context tells a dialer from DialContext which socket to
+// dial. Otherwise the URL and context are returned as they are.
+func ResolveURL(ctx context.Context, baseURL string) (string, context.Context) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme != UnixSocketScheme {
+		return baseURL, ctx
+	}
+	sum := sha256.Sum256([]byte(u.Path))
+	host := hex.EncodeToString(sum[:8]) + ".unix"
+	return "http://" + host, context.WithValue(ctx, unixSocketContextKey{}, u.Path)
+}
+
+// DialContext returns a function to use as the DialContext of the transport
+// for requests to application services. It dials the Unix domain socket for
+// requests sent with a context from ResolveURL, and otherwise dials as usual.
+func DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if path, ok := ctx.Value(unixSocketContextKey{}).(string); ok {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
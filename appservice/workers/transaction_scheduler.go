@@ -207,12 +207,17 @@ func send(
 ) (err error) {
 	// PUT a transaction to our AS
 	// https://matrix.org/docs/spec/application_service/r0.1.2#put-matrix-app-v1-transactions-txnid
-	address := fmt.Sprintf("%s/transactions/%d?access_token=%s", appservice.URL, txnID, url.QueryEscape(appservice.HSToken))
-	req, err := http.NewRequest("PUT", address, bytes.NewBuffer(transaction))
+	baseURL, ctx := types.ResolveURL(context.Background(), appservice.URL)
+	address := fmt.Sprintf("%s/transactions/%d", baseURL, txnID)
+	if appservice.AccessTokenInQuery {
+		address += "?access_token=" + url.QueryEscape(appservice.HSToken)
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", address, bytes.NewBuffer(transaction))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+appservice.HSToken)
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
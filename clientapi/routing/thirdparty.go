@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// GetThirdPartyProtocols implements:
+//     GET /thirdparty/protocols
+func GetThirdPartyProtocols(req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI) util.JSONResponse {
+	var res appserviceAPI.ThirdPartyProtocolsResponse
+	if err := asAPI.ThirdPartyProtocols(req.Context(), &appserviceAPI.ThirdPartyProtocolsRequest{}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyProtocols failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Protocols,
+	}
+}
+
+// GetThirdPartyLocation implements:
+//     GET /thirdparty/location/{protocol}
+func GetThirdPartyLocation(req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string) util.JSONResponse {
+	var res appserviceAPI.ThirdPartyLocationResponse
+	if err := asAPI.ThirdPartyLocation(req.Context(), &appserviceAPI.ThirdPartyLocationRequest{
+		Protocol: protocol,
+		Fields:   thirdPartyFields(req),
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyLocation failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Locations,
+	}
+}
+
+// GetThirdPartyUser implements:
+//     GET /thirdparty/user/{protocol}
+func GetThirdPartyUser(req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string) util.JSONResponse {
+	var res appserviceAPI.ThirdPartyUserResponse
+	if err := asAPI.ThirdPartyUser(req.Context(), &appserviceAPI.ThirdPartyUserRequest{
+		Protocol: protocol,
+		Fields:   thirdPartyFields(req),
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyUser failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Users,
+	}
+}
+
+// thirdPartyFields returns the protocol-specific fields of a third party
+// lookup, which are given as query parameters.
+func thirdPartyFields(req *http.Request) map[string]string {
+	query := req.URL.Query()
+	fields := make(map[string]string, len(query))
+	for field := range query {
+		fields[field] = query.Get(field)
+	}
+	return fields
+}
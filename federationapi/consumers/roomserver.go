@@ -37,7 +37,8 @@ type OutputRoomEventConsumer struct {
 	cfg       *config.FederationAPI
 	rsAPI     api.RoomserverInternalAPI
 	jetstream nats.JetStreamContext
-	durable   nats.SubOpt
+	stream    string
+	durable   string
 	db        storage.Database
 	queues    *queue.OutgoingQueues
 	topic     string
@@ -59,15 +60,22 @@ func NewOutputRoomEventConsumer(
 		db:        store,
 		queues:    queues,
 		rsAPI:     rsAPI,
-		durable:   cfg.Matrix.JetStream.Durable("FederationAPIRoomServerConsumer"),
-		topic:     cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
+		stream:    cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
+		durable:   cfg.Matrix.JetStream.TopicFor("FederationAPIRoomServerConsumer"),
+		topic: jetstream.SubscribeSubject(
+			cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
+			cfg.Matrix.JetStream.OutputRoomEventPartitions,
+		),
 	}
 }
 
 // Start consuming from room servers
 func (s *OutputRoomEventConsumer) Start() error {
+	if err := jetstream.PrepareDurable(s.jetstream, s.stream, s.durable, s.topic); err != nil {
+		return err
+	}
 	_, err := s.jetstream.Subscribe(
-		s.topic, s.onMessage, s.durable,
+		s.topic, s.onMessage, nats.Durable(s.durable),
 		nats.DeliverAll(),
 		nats.ManualAck(),
 	)
@@ -187,3 +187,30 @@ func RedactEvent(redactionEvent, redactedEvent *gomatrixserverlib.Event) (*gomat
 	}
 	return r, nil
 }
+
+// RedactionAllowed returns whether the sender of the redaction event is allowed
+// to redact the redacted event. Users can always redact their own events, and
+// otherwise need the "redact" power level. The power levels are taken from the
+// given auth events of the redaction event.
+func RedactionAllowed(
+	redactionEvent, redactedEvent *gomatrixserverlib.Event, authEventsList []*gomatrixserverlib.Event,
+) (bool, error) {
+	if redactionEvent.Sender() == redactedEvent.Sender() {
+		return true, nil
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for _, authEvent := range authEventsList {
+		if err := authEvents.AddEvent(authEvent); err != nil {
+			return false, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+	}
+	create, err := gomatrixserverlib.NewCreateContentFromAuthEvents(&authEvents)
+	if err != nil {
+		return false, fmt.Errorf("gomatrixserverlib.NewCreateContentFromAuthEvents: %w", err)
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, create.Creator)
+	if err != nil {
+		return false, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromAuthEvents: %w", err)
+	}
+	return powerLevels.UserLevel(redactionEvent.Sender()) >= powerLevels.Redact, nil
+}
@@ -84,3 +84,34 @@ type RemoveRoomAliasResponse struct {
 	// Did we remove it?
 	Removed bool `json:"removed"`
 }
+
+// QueryAliasesForRoomRequest is a request to QueryAliasesForRoom
+type QueryAliasesForRoomRequest struct {
+	// The room ID we want to find aliases for
+	RoomID string `json:"room_id"`
+}
+
+// RoomAlias is an alias of a room, as returned by QueryAliasesForRoom
+type RoomAlias struct {
+	Alias string `json:"alias"`
+	// Is the alias in our room directory?
+	Local bool `json:"local"`
+	// Is the alias the canonical alias or one of the alternative aliases
+	// in the m.room.canonical_alias event of the room?
+	Published bool `json:"published"`
+	// The ID of the application service whose namespace covers the alias,
+	// or empty if the alias isn't owned by an application service.
+	AppserviceID string `json:"appservice_id,omitempty"`
+}
+
+// QueryAliasesForRoomResponse is a response to QueryAliasesForRoom
+type QueryAliasesForRoomResponse struct {
+	// Does the room exist on this roomserver?
+	RoomExists bool `json:"room_exists"`
+	// The canonical alias from the m.room.canonical_alias event, if any
+	CanonicalAlias string `json:"canonical_alias,omitempty"`
+	// The alternative aliases from the m.room.canonical_alias event, if any
+	AltAliases []string `json:"alt_aliases,omitempty"`
+	// All known aliases of the room, sorted
+	Aliases []RoomAlias `json:"aliases"`
+}
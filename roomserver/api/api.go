@@ -21,6 +21,14 @@ type RoomserverInternalAPI interface {
 		response *InputRoomEventsResponse,
 	)
 
+	// Tell the roomserver that users are actively looking at some rooms, so
+	// that input events for those rooms can be prioritised for a while.
+	InputRoomActivityHints(
+		ctx context.Context,
+		request *InputRoomActivityHintsRequest,
+		response *InputRoomActivityHintsResponse,
+	)
+
 	PerformInvite(
 		ctx context.Context,
 		req *PerformInviteRequest,
@@ -57,6 +65,48 @@ type RoomserverInternalAPI interface {
 		res *PerformPublishResponse,
 	)
 
+	// Put a room into, or take a room out of, maintenance mode. New events for
+	// rooms in maintenance mode are deferred until maintenance mode is cleared.
+	PerformRoomMaintenance(
+		ctx context.Context,
+		req *PerformRoomMaintenanceRequest,
+		res *PerformRoomMaintenanceResponse,
+	)
+
+	// Replace the current state of a room with the state after an earlier
+	// event. This is extremely destructive and is intended only for recovering
+	// from state corruption. See PerformRewindRoomStateRequest.
+	PerformRewindRoomState(
+		ctx context.Context,
+		req *PerformRewindRoomStateRequest,
+		res *PerformRewindRoomStateResponse,
+	)
+
+	// Re-evaluate events in a room which were soft-failed recently, accepting
+	// any which now pass auth against the current room state.
+	PerformReevaluateSoftFailedEvents(
+		ctx context.Context,
+		req *PerformReevaluateSoftFailedEventsRequest,
+		res *PerformReevaluateSoftFailedEventsResponse,
+	)
+
+	// Re-run the auth checks for events in a room which were rejected by
+	// auth against freshly fetched auth events, un-rejecting any which now
+	// pass. Events which were rejected for any other reason are left alone.
+	PerformReprocessRejectedEvents(
+		ctx context.Context,
+		req *PerformReprocessRejectedEventsRequest,
+		res *PerformReprocessRejectedEventsResponse,
+	)
+
+	// Re-submit input events which failed to be processed because of an error.
+	// Events which are processed successfully are forgotten about.
+	PerformResubmitInputDeadLetters(
+		ctx context.Context,
+		req *PerformResubmitInputDeadLettersRequest,
+		res *PerformResubmitInputDeadLettersResponse,
+	)
+
 	PerformInboundPeek(
 		ctx context.Context,
 		req *PerformInboundPeekRequest,
@@ -163,6 +213,56 @@ type RoomserverInternalAPI interface {
 	QueryKnownUsers(ctx context.Context, req *QueryKnownUsersRequest, res *QueryKnownUsersResponse) error
 	// QueryServerBannedFromRoom returns whether a server is banned from a room by server ACLs.
 	QueryServerBannedFromRoom(ctx context.Context, req *QueryServerBannedFromRoomRequest, res *QueryServerBannedFromRoomResponse) error
+	// QueryStateSnapshotDiff returns the state entries which differ between two state snapshots.
+	QueryStateSnapshotDiff(ctx context.Context, req *QueryStateSnapshotDiffRequest, res *QueryStateSnapshotDiffResponse) error
+	// QueryInviteInfo returns the invite event and stripped state for a pending invite.
+	QueryInviteInfo(ctx context.Context, req *QueryInviteInfoRequest, res *QueryInviteInfoResponse) error
+	// QueryJoinedUsersInRoom returns the user IDs of all users currently joined to a room.
+	QueryJoinedUsersInRoom(ctx context.Context, req *QueryJoinedUsersInRoomRequest, res *QueryJoinedUsersInRoomResponse) error
+	// Query missing events in a room ranked by how useful they would be to backfill.
+	QueryBackfillCandidates(ctx context.Context, req *QueryBackfillCandidatesRequest, res *QueryBackfillCandidatesResponse) error
+	// Query which rooms are in maintenance mode.
+	QueryRoomsInMaintenance(ctx context.Context, req *QueryRoomsInMaintenanceRequest, res *QueryRoomsInMaintenanceResponse) error
+	// Query the recorded state rewinds for a room, oldest first.
+	QueryStateRewinds(ctx context.Context, req *QueryStateRewindsRequest, res *QueryStateRewindsResponse) error
+	// QueryHasLocalJoinedUsers returns whether any local users are currently joined to a room.
+	QueryHasLocalJoinedUsers(ctx context.Context, req *QueryHasLocalJoinedUsersRequest, res *QueryHasLocalJoinedUsersResponse) error
+	// QueryLocalJoinedCount returns the number of local users currently joined to a room.
+	QueryLocalJoinedCount(ctx context.Context, req *QueryLocalJoinedCountRequest, res *QueryLocalJoinedCountResponse) error
+	// QueryEventSignatures returns which servers have signatures on a stored event.
+	QueryEventSignatures(ctx context.Context, req *QueryEventSignaturesRequest, res *QueryEventSignaturesResponse) error
+	// QueryRoomCreator returns the user ID of the creator of a room, applying the rules for the room version.
+	QueryRoomCreator(ctx context.Context, req *QueryRoomCreatorRequest, res *QueryRoomCreatorResponse) error
+	// QueryEventDepths looks up the depths of events without loading the events themselves.
+	QueryEventDepths(ctx context.Context, req *QueryEventDepthsRequest, res *QueryEventDepthsResponse) error
+	// QueryAliasesForRoom lists the aliases of a room, including which are owned by application services.
+	QueryAliasesForRoom(ctx context.Context, req *QueryAliasesForRoomRequest, res *QueryAliasesForRoomResponse) error
+	// QueryRoomEncryption returns whether a room is encrypted and how, from its current state.
+	QueryRoomEncryption(ctx context.Context, req *QueryRoomEncryptionRequest, res *QueryRoomEncryptionResponse) error
+	// QueryPurgeCandidateRooms lists rooms which could be purged to reclaim space.
+	QueryPurgeCandidateRooms(ctx context.Context, req *QueryPurgeCandidateRoomsRequest, res *QueryPurgeCandidateRoomsResponse) error
+	// QueryEventForwardGraph returns the prev and auth event IDs of the events in a room, in chunks.
+	QueryEventForwardGraph(ctx context.Context, req *QueryEventForwardGraphRequest, res *QueryEventForwardGraphResponse) error
+	// QueryUserCapability asks whether a user is currently allowed to perform an action in a room.
+	QueryUserCapability(ctx context.Context, req *QueryUserCapabilityRequest, res *QueryUserCapabilityResponse) error
+	// QueryMostRecentEvents returns the most recent events in a world-readable room, for previews.
+	QueryMostRecentEvents(ctx context.Context, req *QueryMostRecentEventsRequest, res *QueryMostRecentEventsResponse) error
+	// QueryEventsRedactedBy returns what a redaction event redacted, or will redact once its target arrives.
+	QueryEventsRedactedBy(ctx context.Context, req *QueryEventsRedactedByRequest, res *QueryEventsRedactedByResponse) error
+	// QueryRedactionsByUser returns all of the redactions that a user sent in a room.
+	QueryRedactionsByUser(ctx context.Context, req *QueryRedactionsByUserRequest, res *QueryRedactionsByUserResponse) error
+	// QueryServerKeysUsedForRoom returns the distinct server signing keys which signed the events stored for a room.
+	QueryServerKeysUsedForRoom(ctx context.Context, req *QueryServerKeysUsedForRoomRequest, res *QueryServerKeysUsedForRoomResponse) error
+	// QueryEventRejectionReason returns whether an event was rejected and why.
+	QueryEventRejectionReason(ctx context.Context, req *QueryEventRejectionReasonRequest, res *QueryEventRejectionReasonResponse) error
+	// QueryEventAuthChain returns the auth chain of an event from the database,
+	// ordered so that every event comes after its own auth events. Unlike
+	// QueryAuthChain, it fails if any auth event in the chain is missing.
+	QueryEventAuthChain(ctx context.Context, req *QueryEventAuthChainRequest, res *QueryEventAuthChainResponse) error
+	// QueryEventProvenance returns which server gave us an event, if it was fetched over federation.
+	QueryEventProvenance(ctx context.Context, req *QueryEventProvenanceRequest, res *QueryEventProvenanceResponse) error
+	// Query input events which failed to be processed because of an error.
+	QueryInputDeadLetters(ctx context.Context, req *QueryInputDeadLettersRequest, res *QueryInputDeadLettersResponse) error
 
 	// Query a given amount (or less) of events prior to a given set of events.
 	PerformBackfill(
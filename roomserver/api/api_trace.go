@@ -34,6 +34,15 @@ func (t *RoomserverInternalAPITrace) InputRoomEvents(
 	util.GetLogger(ctx).Infof("InputRoomEvents req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) InputRoomActivityHints(
+	ctx context.Context,
+	req *InputRoomActivityHintsRequest,
+	res *InputRoomActivityHintsResponse,
+) {
+	t.Impl.InputRoomActivityHints(ctx, req, res)
+	util.GetLogger(ctx).Infof("InputRoomActivityHints req=%+v res=%+v", js(req), js(res))
+}
+
 func (t *RoomserverInternalAPITrace) PerformInvite(
 	ctx context.Context,
 	req *PerformInviteRequest,
@@ -89,6 +98,51 @@ func (t *RoomserverInternalAPITrace) PerformPublish(
 	util.GetLogger(ctx).Infof("PerformPublish req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) PerformRoomMaintenance(
+	ctx context.Context,
+	req *PerformRoomMaintenanceRequest,
+	res *PerformRoomMaintenanceResponse,
+) {
+	t.Impl.PerformRoomMaintenance(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRoomMaintenance req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformReevaluateSoftFailedEvents(
+	ctx context.Context,
+	req *PerformReevaluateSoftFailedEventsRequest,
+	res *PerformReevaluateSoftFailedEventsResponse,
+) {
+	t.Impl.PerformReevaluateSoftFailedEvents(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformReevaluateSoftFailedEvents req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformReprocessRejectedEvents(
+	ctx context.Context,
+	req *PerformReprocessRejectedEventsRequest,
+	res *PerformReprocessRejectedEventsResponse,
+) {
+	t.Impl.PerformReprocessRejectedEvents(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformReprocessRejectedEvents req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformRewindRoomState(
+	ctx context.Context,
+	req *PerformRewindRoomStateRequest,
+	res *PerformRewindRoomStateResponse,
+) {
+	t.Impl.PerformRewindRoomState(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRewindRoomState req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformResubmitInputDeadLetters(
+	ctx context.Context,
+	req *PerformResubmitInputDeadLettersRequest,
+	res *PerformResubmitInputDeadLettersResponse,
+) {
+	t.Impl.PerformResubmitInputDeadLetters(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformResubmitInputDeadLetters req=%+v res=%+v", js(req), js(res))
+}
+
 func (t *RoomserverInternalAPITrace) PerformInboundPeek(
 	ctx context.Context,
 	req *PerformInboundPeekRequest,
@@ -350,6 +404,176 @@ func (t *RoomserverInternalAPITrace) QueryAuthChain(
 	return err
 }
 
+// QueryStateSnapshotDiff returns the state entries which differ between two state snapshots.
+func (t *RoomserverInternalAPITrace) QueryStateSnapshotDiff(ctx context.Context, req *QueryStateSnapshotDiffRequest, res *QueryStateSnapshotDiffResponse) error {
+	err := t.Impl.QueryStateSnapshotDiff(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryStateSnapshotDiff req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryInviteInfo returns the invite event and stripped state for a pending invite.
+func (t *RoomserverInternalAPITrace) QueryInviteInfo(ctx context.Context, req *QueryInviteInfoRequest, res *QueryInviteInfoResponse) error {
+	err := t.Impl.QueryInviteInfo(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryInviteInfo req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryJoinedUsersInRoom returns the user IDs of all users currently joined to a room.
+func (t *RoomserverInternalAPITrace) QueryJoinedUsersInRoom(ctx context.Context, req *QueryJoinedUsersInRoomRequest, res *QueryJoinedUsersInRoomResponse) error {
+	err := t.Impl.QueryJoinedUsersInRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryJoinedUsersInRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// Query missing events in a room ranked by how useful they would be to backfill.
+func (t *RoomserverInternalAPITrace) QueryBackfillCandidates(ctx context.Context, req *QueryBackfillCandidatesRequest, res *QueryBackfillCandidatesResponse) error {
+	err := t.Impl.QueryBackfillCandidates(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryBackfillCandidates req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// Query which rooms are in maintenance mode.
+func (t *RoomserverInternalAPITrace) QueryRoomsInMaintenance(ctx context.Context, req *QueryRoomsInMaintenanceRequest, res *QueryRoomsInMaintenanceResponse) error {
+	err := t.Impl.QueryRoomsInMaintenance(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomsInMaintenance req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// Query the recorded state rewinds for a room, oldest first.
+func (t *RoomserverInternalAPITrace) QueryStateRewinds(ctx context.Context, req *QueryStateRewindsRequest, res *QueryStateRewindsResponse) error {
+	err := t.Impl.QueryStateRewinds(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryStateRewinds req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryHasLocalJoinedUsers returns whether any local users are currently joined to a room.
+func (t *RoomserverInternalAPITrace) QueryHasLocalJoinedUsers(ctx context.Context, req *QueryHasLocalJoinedUsersRequest, res *QueryHasLocalJoinedUsersResponse) error {
+	err := t.Impl.QueryHasLocalJoinedUsers(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryHasLocalJoinedUsers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryLocalJoinedCount returns the number of local users currently joined to a room.
+func (t *RoomserverInternalAPITrace) QueryLocalJoinedCount(ctx context.Context, req *QueryLocalJoinedCountRequest, res *QueryLocalJoinedCountResponse) error {
+	err := t.Impl.QueryLocalJoinedCount(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryLocalJoinedCount req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventSignatures returns which servers have signatures on a stored event.
+func (t *RoomserverInternalAPITrace) QueryEventSignatures(ctx context.Context, req *QueryEventSignaturesRequest, res *QueryEventSignaturesResponse) error {
+	err := t.Impl.QueryEventSignatures(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventSignatures req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomCreator returns the user ID of the creator of a room, applying the rules for the room version.
+func (t *RoomserverInternalAPITrace) QueryRoomCreator(ctx context.Context, req *QueryRoomCreatorRequest, res *QueryRoomCreatorResponse) error {
+	err := t.Impl.QueryRoomCreator(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomCreator req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventDepths looks up the depths of events without loading the events themselves.
+func (t *RoomserverInternalAPITrace) QueryEventDepths(ctx context.Context, req *QueryEventDepthsRequest, res *QueryEventDepthsResponse) error {
+	err := t.Impl.QueryEventDepths(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventDepths req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryAliasesForRoom lists the aliases of a room, including which are owned by application services.
+func (t *RoomserverInternalAPITrace) QueryAliasesForRoom(ctx context.Context, req *QueryAliasesForRoomRequest, res *QueryAliasesForRoomResponse) error {
+	err := t.Impl.QueryAliasesForRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryAliasesForRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomEncryption returns whether a room is encrypted and how, from its current state.
+func (t *RoomserverInternalAPITrace) QueryRoomEncryption(ctx context.Context, req *QueryRoomEncryptionRequest, res *QueryRoomEncryptionResponse) error {
+	err := t.Impl.QueryRoomEncryption(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomEncryption req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryPurgeCandidateRooms lists rooms which could be purged to reclaim space.
+func (t *RoomserverInternalAPITrace) QueryPurgeCandidateRooms(ctx context.Context, req *QueryPurgeCandidateRoomsRequest, res *QueryPurgeCandidateRoomsResponse) error {
+	err := t.Impl.QueryPurgeCandidateRooms(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryPurgeCandidateRooms req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventForwardGraph returns the prev and auth event IDs of the events in a room, in chunks.
+func (t *RoomserverInternalAPITrace) QueryEventForwardGraph(ctx context.Context, req *QueryEventForwardGraphRequest, res *QueryEventForwardGraphResponse) error {
+	err := t.Impl.QueryEventForwardGraph(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventForwardGraph req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryUserCapability asks whether a user is currently allowed to perform an action in a room.
+func (t *RoomserverInternalAPITrace) QueryUserCapability(ctx context.Context, req *QueryUserCapabilityRequest, res *QueryUserCapabilityResponse) error {
+	err := t.Impl.QueryUserCapability(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryUserCapability req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryMostRecentEvents returns the most recent events in a world-readable room, for previews.
+func (t *RoomserverInternalAPITrace) QueryMostRecentEvents(ctx context.Context, req *QueryMostRecentEventsRequest, res *QueryMostRecentEventsResponse) error {
+	err := t.Impl.QueryMostRecentEvents(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryMostRecentEvents req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventsRedactedBy returns what a redaction event redacted, or will redact once its target arrives.
+func (t *RoomserverInternalAPITrace) QueryEventsRedactedBy(ctx context.Context, req *QueryEventsRedactedByRequest, res *QueryEventsRedactedByResponse) error {
+	err := t.Impl.QueryEventsRedactedBy(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventsRedactedBy req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRedactionsByUser returns all of the redactions that a user sent in a room.
+func (t *RoomserverInternalAPITrace) QueryRedactionsByUser(ctx context.Context, req *QueryRedactionsByUserRequest, res *QueryRedactionsByUserResponse) error {
+	err := t.Impl.QueryRedactionsByUser(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRedactionsByUser req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryServerKeysUsedForRoom returns the distinct server signing keys which signed the events stored for a room.
+func (t *RoomserverInternalAPITrace) QueryServerKeysUsedForRoom(ctx context.Context, req *QueryServerKeysUsedForRoomRequest, res *QueryServerKeysUsedForRoomResponse) error {
+	err := t.Impl.QueryServerKeysUsedForRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryServerKeysUsedForRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventRejectionReason returns whether an event was rejected and why.
+func (t *RoomserverInternalAPITrace) QueryEventRejectionReason(ctx context.Context, req *QueryEventRejectionReasonRequest, res *QueryEventRejectionReasonResponse) error {
+	err := t.Impl.QueryEventRejectionReason(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventRejectionReason req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventAuthChain returns the auth chain of an event from the database,
+// ordered so that every event comes after its own auth events. Unlike
+// QueryAuthChain, it fails if any auth event in the chain is missing.
+func (t *RoomserverInternalAPITrace) QueryEventAuthChain(ctx context.Context, req *QueryEventAuthChainRequest, res *QueryEventAuthChainResponse) error {
+	err := t.Impl.QueryEventAuthChain(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventAuthChain req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventProvenance returns which server gave us an event, if it was fetched over federation.
+func (t *RoomserverInternalAPITrace) QueryEventProvenance(ctx context.Context, req *QueryEventProvenanceRequest, res *QueryEventProvenanceResponse) error {
+	err := t.Impl.QueryEventProvenance(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventProvenance req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// Query input events which failed to be processed because of an error.
+func (t *RoomserverInternalAPITrace) QueryInputDeadLetters(ctx context.Context, req *QueryInputDeadLettersRequest, res *QueryInputDeadLettersResponse) error {
+	err := t.Impl.QueryInputDeadLetters(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryInputDeadLetters req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func js(thing interface{}) string {
 	b, err := json.Marshal(thing)
 	if err != nil {
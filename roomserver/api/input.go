@@ -17,6 +17,7 @@ package api
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -40,6 +41,12 @@ const (
 	// considered for forward extremities, and output events will NOT
 	// be generated for them.
 	KindOld
+	// KindBackfill events are history that we asked another server for
+	// with /backfill. Like KindOld events they will not be considered for
+	// forward extremities, and missing prev events will not be fetched for
+	// them. They are reported to downstream components as backfilled room
+	// events so that they can be placed before the existing timeline.
+	KindBackfill
 )
 
 // DoNotSendToOtherServers tells us not to send the event to other matrix
@@ -49,7 +56,7 @@ const DoNotSendToOtherServers = ""
 // InputRoomEvent is a matrix room event to add to the room server database.
 // TODO: Implement UnmarshalJSON/MarshalJSON in a way that does something sensible with the event JSON.
 type InputRoomEvent struct {
-	// Whether this event is new, backfilled or an outlier.
+	// Whether this event is new, old, backfilled or an outlier.
 	// This controls how the event is processed.
 	Kind Kind `json:"kind"`
 	// The event JSON for the event to add.
@@ -64,12 +71,26 @@ type InputRoomEvent struct {
 	// These are only used if HasState is true.
 	// The list can be empty, for example when storing the first event in a room.
 	StateEventIDs []string `json:"state_event_ids"`
+	// Whether StateEventIDs is only part of the state before the event, as
+	// returned by a partial state (faster) room join. The event is accepted
+	// using the partial state, and the full state is fetched from the origin
+	// in the background afterwards. Only used if HasState is true.
+	PartialState bool `json:"partial_state,omitempty"`
 	// The server name to use to push this event to other servers.
 	// Or empty if this event shouldn't be pushed to other servers.
 	SendAsServer string `json:"send_as_server"`
 	// The transaction ID of the send request if sent by a local user and one
 	// was specified
 	TransactionID *TransactionID `json:"transaction_id"`
+	// Whether to accept the event even if it would be soft-failed by the
+	// current room state. This is only intended for administrative recovery
+	// and is ignored for events that arrived from other servers.
+	BypassSoftFail bool `json:"bypass_soft_fail,omitempty"`
+	// How long the roomserver can spend processing the event, starting from
+	// when it picks the event up from the input queue. This can only shorten
+	// the time allowed, never extend it past the roomserver's own limit. If
+	// zero then the roomserver's limit is used.
+	ProcessingTimeout time.Duration `json:"processing_timeout,omitempty"`
 }
 
 // TransactionID contains the transaction ID sent by a client when sending an
@@ -83,14 +104,48 @@ type TransactionID struct {
 type InputRoomEventsRequest struct {
 	InputRoomEvents []InputRoomEvent `json:"input_room_events"`
 	Asynchronous    bool             `json:"async"`
+	// If true then the events are processed in dependency order, so that each
+	// event is processed after any of its auth and prev events which are also
+	// in the request, e.g. for a slice of backfilled events. When synchronous,
+	// every event is processed even if some of them fail.
+	TopologicalOrder bool `json:"topological_order"`
 }
 
 // InputRoomEventsResponse is a response to InputRoomEvents
 type InputRoomEventsResponse struct {
 	ErrMsg     string // set if there was any error
 	NotAllowed bool   // true if an event in the input was not allowed.
+	// The outcome of each input event, in the same order as the request.
+	// Only populated for synchronous requests.
+	Results []InputRoomEventResult
 }
 
+// InputRoomEventResult is the outcome of processing an input event.
+type InputRoomEventResult struct {
+	EventID string `json:"event_id"`
+	// True if the event was stored as rejected, for whatever reason.
+	Rejected bool `json:"rejected,omitempty"`
+	// True if the event was rejected because it isn't allowed by its auth
+	// events. Implies Rejected.
+	NotAllowed bool `json:"not_allowed,omitempty"`
+	// True if the event was stored but soft-failed, so it isn't one of the
+	// latest events in the room and won't be sent to clients.
+	SoftFailed bool `json:"soft_failed,omitempty"`
+	// True if the event was stored, or had already been stored. False if
+	// the event wasn't processed, for instance because it was already
+	// being processed for another request.
+	Stored bool `json:"stored,omitempty"`
+}
+
+// InputRoomActivityHintsRequest is a request to InputRoomActivityHints
+type InputRoomActivityHintsRequest struct {
+	// The rooms that users are actively looking at right now.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// InputRoomActivityHintsResponse is a response to InputRoomActivityHints
+type InputRoomActivityHintsResponse struct{}
+
 func (r *InputRoomEventsResponse) Err() error {
 	if r.ErrMsg == "" {
 		return nil
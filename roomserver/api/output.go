@@ -26,6 +26,8 @@ const (
 	OutputTypeNewRoomEvent OutputType = "new_room_event"
 	// OutputTypeOldRoomEvent indicates that the event is an OutputOldRoomEvent
 	OutputTypeOldRoomEvent OutputType = "old_room_event"
+	// OutputTypeBackfilledRoomEvent indicates that the event is an OutputBackfilledRoomEvent
+	OutputTypeBackfilledRoomEvent OutputType = "backfilled_room_event"
 	// OutputTypeNewInviteEvent indicates that the event is an OutputNewInviteEvent
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
@@ -55,6 +57,10 @@ const (
 	OutputTypeNewInboundPeek OutputType = "new_inbound_peek"
 	// OutputTypeRetirePeek indicates that the kafka event is an OutputRetirePeek
 	OutputTypeRetirePeek OutputType = "retire_peek"
+	// OutputTypeSoftFailedEvent indicates that the event is an OutputSoftFailedEvent
+	OutputTypeSoftFailedEvent OutputType = "soft_failed_event"
+	// OutputTypeStateReset indicates that the event is an OutputStateReset
+	OutputTypeStateReset OutputType = "state_reset"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -66,6 +72,8 @@ type OutputEvent struct {
 	NewRoomEvent *OutputNewRoomEvent `json:"new_room_event,omitempty"`
 	// The content of event with type OutputTypeOldRoomEvent
 	OldRoomEvent *OutputOldRoomEvent `json:"old_room_event,omitempty"`
+	// The content of event with type OutputTypeBackfilledRoomEvent
+	BackfilledRoomEvent *OutputBackfilledRoomEvent `json:"backfilled_room_event,omitempty"`
 	// The content of event with type OutputTypeNewInviteEvent
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
@@ -78,6 +86,10 @@ type OutputEvent struct {
 	NewInboundPeek *OutputNewInboundPeek `json:"new_inbound_peek,omitempty"`
 	// The content of event with type OutputTypeRetirePeek
 	RetirePeek *OutputRetirePeek `json:"retire_peek,omitempty"`
+	// The content of event with type OutputTypeSoftFailedEvent
+	SoftFailedEvent *OutputSoftFailedEvent `json:"soft_failed_event,omitempty"`
+	// The content of event with type OutputTypeStateReset
+	StateReset *OutputStateReset `json:"state_reset,omitempty"`
 }
 
 // Type of the OutputNewRoomEvent.
@@ -91,6 +103,31 @@ const (
 	OutputRoomState
 )
 
+// EventID returns the ID of the event that this output event was emitted for,
+// or an empty string if the output event doesn't relate to a specific event.
+func (o *OutputEvent) EventID() string {
+	switch {
+	case o.NewRoomEvent != nil && o.NewRoomEvent.Event != nil:
+		return o.NewRoomEvent.Event.EventID()
+	case o.OldRoomEvent != nil && o.OldRoomEvent.Event != nil:
+		return o.OldRoomEvent.Event.EventID()
+	case o.BackfilledRoomEvent != nil && o.BackfilledRoomEvent.Event != nil:
+		return o.BackfilledRoomEvent.Event.EventID()
+	case o.NewInviteEvent != nil && o.NewInviteEvent.Event != nil:
+		return o.NewInviteEvent.Event.EventID()
+	case o.RetireInviteEvent != nil:
+		return o.RetireInviteEvent.EventID
+	case o.RedactedEvent != nil && o.RedactedEvent.RedactedBecause != nil:
+		return o.RedactedEvent.RedactedBecause.EventID()
+	case o.SoftFailedEvent != nil && o.SoftFailedEvent.Event != nil:
+		return o.SoftFailedEvent.Event.EventID()
+	case o.StateReset != nil && o.StateReset.Event != nil:
+		return o.StateReset.Event.EventID()
+	default:
+		return ""
+	}
+}
+
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
 // It contains the full matrix room event and enough information for a
 // consumer to construct the current state of the room and the state before the
@@ -204,6 +241,14 @@ type OutputOldRoomEvent struct {
 	Event *gomatrixserverlib.HeaderedEvent `json:"event"`
 }
 
+// An OutputBackfilledRoomEvent is written when the roomserver receives an
+// event that was backfilled from another server. It precedes the events that
+// we already know about in the room, so it should not be treated as new.
+type OutputBackfilledRoomEvent struct {
+	// The Event.
+	Event *gomatrixserverlib.HeaderedEvent `json:"event"`
+}
+
 // An OutputNewInviteEvent is written whenever an invite becomes active.
 // Invite events can be received outside of an existing room so have to be
 // tracked separately from the room events themselves.
@@ -268,3 +313,34 @@ type OutputRetirePeek struct {
 	UserID   string
 	DeviceID string
 }
+
+// An OutputSoftFailedEvent is written when the roomserver receives a new event
+// which soft-fails. The event has been stored, but it isn't one of the latest
+// events in the room and doesn't change the room state, so it mustn't be sent
+// to clients. Consumers which don't care about soft-failed events can ignore
+// this output event.
+type OutputSoftFailedEvent struct {
+	// The soft-failed event.
+	Event *gomatrixserverlib.HeaderedEvent `json:"event"`
+	// Why the event soft-failed.
+	Reason string `json:"reason"`
+}
+
+// An OutputStateReset is written when the state of a room was overwritten
+// with state that a remote server gave us with an event, and the new state
+// looks like a state reset, e.g. because none of the room's admins are joined
+// any more. The new state has still been applied. Consumers can use this to
+// alert server admins to rooms which might need attention.
+type OutputStateReset struct {
+	// The event whose state overwrote the room state.
+	Event *gomatrixserverlib.HeaderedEvent `json:"event"`
+	// Why the new state looks like a state reset.
+	Reasons []string `json:"reasons"`
+	// The number of joined members before and after the state was overwritten.
+	PreviousJoinedCount int `json:"previous_joined_count"`
+	JoinedCount         int `json:"joined_count"`
+	// The joined users with admin power levels before and after the state
+	// was overwritten.
+	PreviousAdmins []string `json:"previous_admins"`
+	Admins         []string `json:"admins"`
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -172,6 +173,80 @@ type PerformPublishResponse struct {
 	Error *PerformError
 }
 
+type PerformRoomMaintenanceRequest struct {
+	RoomID string `json:"room_id"`
+	// True to put the room into maintenance mode, false to take it out again.
+	Enabled bool `json:"enabled"`
+}
+
+type PerformRoomMaintenanceResponse struct {
+	// If non-nil, the request failed. Contains more information why it failed.
+	Error *PerformError `json:"error,omitempty"`
+}
+
+// PerformRewindRoomStateRequest asks for the current state of a room to be
+// replaced with the state after the target event, which also becomes the only
+// forward extremity of the room.
+//
+// This is extremely destructive. Any state changes after the target event,
+// including joins, leaves, bans and power level changes, will be discarded
+// from the current state of the room. Downstream components will replace their
+// copy of the room state, so clients will see the rewound state. Other servers
+// are not told about the rewind, and our view of the room may diverge from
+// theirs until new events are sent. Only use this to recover from state
+// corruption, and only with a target event that is known to be good.
+type PerformRewindRoomStateRequest struct {
+	RoomID        string `json:"room_id"`
+	TargetEventID string `json:"target_event_id"`
+	// Must be set to the same value as RoomID, to confirm that the caller
+	// really does intend to rewind the state of this room.
+	ConfirmRoomID string `json:"confirm_room_id"`
+}
+
+type PerformRewindRoomStateResponse struct {
+	// A record of the rewind, including the previous state snapshot and forward
+	// extremities of the room, which can be used to undo the rewind.
+	Rewind *types.StateRewind `json:"rewind,omitempty"`
+	// If non-nil, the request failed. Contains more information why it failed.
+	Error *PerformError `json:"error,omitempty"`
+}
+
+type PerformReevaluateSoftFailedEventsRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type PerformReevaluateSoftFailedEventsResponse struct {
+	// The number of soft-failed events which were accepted.
+	Accepted int `json:"accepted"`
+	// If non-nil, the request failed. Contains more information why it failed.
+	Error *PerformError `json:"error,omitempty"`
+}
+
+type PerformReprocessRejectedEventsRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type PerformReprocessRejectedEventsResponse struct {
+	// The number of rejected events which now pass auth and are no longer rejected.
+	Unrejected int `json:"unrejected"`
+	// If non-nil, the request failed. Contains more information why it failed.
+	Error *PerformError `json:"error,omitempty"`
+}
+
+type PerformResubmitInputDeadLettersRequest struct {
+	// The event IDs of the dead letters to re-submit.
+	EventIDs []string `json:"event_ids"`
+}
+
+type PerformResubmitInputDeadLettersResponse struct {
+	// The event IDs which were processed successfully this time.
+	Resubmitted []string `json:"resubmitted"`
+	// The event IDs which still couldn't be processed, and why.
+	Failed map[string]string `json:"failed,omitempty"`
+	// If non-nil, the request failed. Contains more information why it failed.
+	Error *PerformError `json:"error,omitempty"`
+}
+
 type PerformInboundPeekRequest struct {
 	UserID          string                       `json:"user_id"`
 	RoomID          string                       `json:"room_id"`
@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -81,6 +82,10 @@ type QueryStateAfterEventsResponse struct {
 	// The state events requested.
 	// This list will be in an arbitrary order.
 	StateEvents []*gomatrixserverlib.HeaderedEvent `json:"state_events"`
+	// Whether each of the previous events was rejected, keyed by event ID.
+	// A rejected event doesn't change the state, so the state after it is
+	// the same as the state before it.
+	Rejected map[string]bool `json:"rejected,omitempty"`
 }
 
 type QueryMissingAuthPrevEventsRequest struct {
@@ -419,3 +424,467 @@ func (r *QueryCurrentStateResponse) UnmarshalJSON(data []byte) error {
 	}
 	return nil
 }
+
+// QueryStateSnapshotDiffRequest asks for the differences between two state
+// snapshots. A snapshot NID of 0 is treated as the empty state.
+type QueryStateSnapshotDiffRequest struct {
+	OldStateSnapshotNID types.StateSnapshotNID `json:"old_state_snapshot_nid"`
+	NewStateSnapshotNID types.StateSnapshotNID `json:"new_state_snapshot_nid"`
+}
+
+// QueryStateSnapshotDiffResponse is a response to QueryStateSnapshotDiff
+type QueryStateSnapshotDiffResponse struct {
+	// State events for state keys that only appear in the new snapshot.
+	Added []*gomatrixserverlib.HeaderedEvent `json:"added"`
+	// State events for state keys that only appear in the old snapshot.
+	Removed []*gomatrixserverlib.HeaderedEvent `json:"removed"`
+	// State keys that appear in both snapshots but with different events.
+	Changed []StateSnapshotChange `json:"changed"`
+}
+
+// StateSnapshotChange is a state key whose event differs between two snapshots.
+type StateSnapshotChange struct {
+	Old *gomatrixserverlib.HeaderedEvent `json:"old"`
+	New *gomatrixserverlib.HeaderedEvent `json:"new"`
+}
+
+// QueryInviteInfoRequest asks for the pending invite for a user in a room.
+type QueryInviteInfoRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+}
+
+// QueryInviteInfoResponse is a response to QueryInviteInfo
+type QueryInviteInfoResponse struct {
+	// True if there is a pending invite for the user in the room. This will be
+	// false if the user was never invited or if the invite has been retired,
+	// i.e. rejected, rescinded or superseded by another membership change.
+	InviteExists bool `json:"invite_exists"`
+	// The invite event.
+	Event *gomatrixserverlib.HeaderedEvent `json:"event,omitempty"`
+	// The stripped state that accompanied the invite.
+	InviteRoomState []gomatrixserverlib.InviteV2StrippedState `json:"invite_room_state,omitempty"`
+}
+
+// QueryJoinedUsersInRoomRequest asks for the users currently joined to a room.
+type QueryJoinedUsersInRoomRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryJoinedUsersInRoomResponse is a response to QueryJoinedUsersInRoom
+type QueryJoinedUsersInRoomResponse struct {
+	// True if the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// The user IDs of all users, local and remote, joined to the room in
+	// the current room state.
+	UserIDs []string `json:"user_ids"`
+}
+
+// QueryBackfillCandidatesRequest asks for the events missing from a room's
+// DAG, ranked so that the most useful ones to backfill come first.
+type QueryBackfillCandidatesRequest struct {
+	RoomID string `json:"room_id"`
+	// The maximum number of known events to walk back through from the forward
+	// extremities looking for gaps. If zero, a default of 1000 is used.
+	WalkLimit int `json:"walk_limit"`
+	// The maximum number of candidates to return. If zero, all are returned.
+	Limit int `json:"limit"`
+}
+
+// BackfillCandidate is an event which is referenced by the prev_events of an
+// event in the room but which we don't have.
+type BackfillCandidate struct {
+	EventID string `json:"event_id"`
+	// How many prev_events hops the missing event is from the nearest forward
+	// extremity of the room.
+	Distance int `json:"distance"`
+	// The highest depth of the known events that reference the missing event.
+	ReferencedAtDepth int64 `json:"referenced_at_depth"`
+	// How many known events reference the missing event.
+	ReferenceCount int `json:"reference_count"`
+}
+
+// QueryBackfillCandidatesResponse is a response to QueryBackfillCandidates
+type QueryBackfillCandidatesResponse struct {
+	// True if the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// The missing events, most useful to backfill first. See
+	// SortBackfillCandidates in the query package for the ranking.
+	Candidates []BackfillCandidate `json:"candidates"`
+}
+
+// QueryRoomsInMaintenanceRequest asks which rooms are in maintenance mode.
+type QueryRoomsInMaintenanceRequest struct {
+}
+
+// QueryRoomsInMaintenanceResponse is a response to QueryRoomsInMaintenance
+type QueryRoomsInMaintenanceResponse struct {
+	// The room IDs of all rooms in maintenance mode.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// QueryStateRewindsRequest asks for the recorded state rewinds for a room.
+type QueryStateRewindsRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryStateRewindsResponse is a response to QueryStateRewinds
+type QueryStateRewindsResponse struct {
+	// All recorded rewinds of the room state, oldest first.
+	Rewinds []types.StateRewind `json:"rewinds"`
+}
+
+// QueryHasLocalJoinedUsersRequest asks whether any local users are joined to a room.
+type QueryHasLocalJoinedUsersRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryHasLocalJoinedUsersResponse is a response to QueryHasLocalJoinedUsers
+type QueryHasLocalJoinedUsersResponse struct {
+	// True if the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// True if at least one local user is joined to the room in the current
+	// room state.
+	HasLocalJoinedUsers bool `json:"has_local_joined_users"`
+}
+
+// QueryLocalJoinedCountRequest asks how many local users are joined to a room.
+type QueryLocalJoinedCountRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryLocalJoinedCountResponse is a response to QueryLocalJoinedCount
+type QueryLocalJoinedCountResponse struct {
+	// True if the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// The number of local users joined to the room in the current room state.
+	Count int `json:"count"`
+}
+
+// QueryEventSignaturesRequest asks which servers have signed an event.
+type QueryEventSignaturesRequest struct {
+	EventID string `json:"event_id"`
+}
+
+// EventSignature identifies a signature on an event.
+type EventSignature struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	KeyID      gomatrixserverlib.KeyID      `json:"key_id"`
+}
+
+// QueryEventSignaturesResponse is a response to QueryEventSignatures
+type QueryEventSignaturesResponse struct {
+	// True if the event is known to the roomserver.
+	EventExists bool `json:"event_exists"`
+	// The signatures present on the stored event, sorted by server name and
+	// then key ID. The signatures are listed as they are stored and are not
+	// verified again. Empty if the event has no signatures.
+	Signatures []EventSignature `json:"signatures"`
+}
+
+// QueryRoomCreatorRequest asks who created a room.
+type QueryRoomCreatorRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryRoomCreatorResponse is a response to QueryRoomCreator
+type QueryRoomCreatorResponse struct {
+	// True if the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// The user ID of the room creator. This is the creator field of the
+	// m.room.create event content in room versions that have it, and the
+	// sender of the m.room.create event otherwise.
+	Creator string `json:"creator"`
+}
+
+// QueryEventDepthsRequest asks for the depths of some events.
+type QueryEventDepthsRequest struct {
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryEventDepthsResponse is a response to QueryEventDepths
+type QueryEventDepthsResponse struct {
+	// A map from event ID to depth. Events which aren't known to the
+	// roomserver are omitted.
+	Depths map[string]int64 `json:"depths"`
+}
+
+// QueryRoomEncryptionRequest asks whether a room is encrypted.
+type QueryRoomEncryptionRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryRoomEncryptionResponse is a response to QueryRoomEncryption
+type QueryRoomEncryptionResponse struct {
+	// Whether the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// Whether the room has an m.room.encryption event in its current state.
+	// If not then the remaining fields are empty.
+	Encrypted bool `json:"encrypted"`
+	// The encryption algorithm, e.g. m.megolm.v1.aes-sha2.
+	Algorithm string `json:"algorithm,omitempty"`
+	// How often sessions should be rotated. If the state event doesn't say
+	// then these are the defaults from the spec.
+	RotationPeriodMs   int64 `json:"rotation_period_ms,omitempty"`
+	RotationPeriodMsgs int64 `json:"rotation_period_msgs,omitempty"`
+}
+
+// QueryPurgeCandidateRoomsRequest asks for rooms that could be purged.
+type QueryPurgeCandidateRoomsRequest struct {
+	// Only rooms that no local user has had a membership event in since
+	// this time are candidates.
+	NoLocalMembersSince gomatrixserverlib.Timestamp `json:"no_local_members_since"`
+	// Only rooms whose latest events are all older than this time are
+	// candidates.
+	InactiveSince gomatrixserverlib.Timestamp `json:"inactive_since"`
+}
+
+// QueryPurgeCandidateRoomsResponse is a response to QueryPurgeCandidateRooms
+type QueryPurgeCandidateRoomsResponse struct {
+	// Rooms with no joined or invited local users, no recent local membership
+	// changes and no recent events. Nothing is purged by this query.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// QueryEventForwardGraphRequest asks for a chunk of the event graph of a room.
+//
+// To walk the whole graph, start with an empty After and then keep making
+// requests with After set to the Next of the previous response until Next is
+// empty. Each event in the room that we have stored appears in exactly one
+// chunk. The chunks are in the order that we stored the events in, not in
+// topological order, so a tool checking the graph should collect all of the
+// chunks before checking that every referenced event is present.
+type QueryEventForwardGraphRequest struct {
+	RoomID string `json:"room_id"`
+	// The cursor to continue from, or empty to start from the beginning.
+	// Cursors are opaque and only valid for the same room.
+	After string `json:"after,omitempty"`
+	// The maximum number of events to return. Defaults to 100, and is capped
+	// at 1000.
+	Limit int `json:"limit,omitempty"`
+}
+
+// EventGraphEntry is the graph information for a single event.
+type EventGraphEntry struct {
+	EventID      string   `json:"event_id"`
+	PrevEventIDs []string `json:"prev_event_ids"`
+	AuthEventIDs []string `json:"auth_event_ids"`
+}
+
+// QueryEventForwardGraphResponse is a response to QueryEventForwardGraph
+type QueryEventForwardGraphResponse struct {
+	// Whether the room is known to the roomserver.
+	RoomExists bool              `json:"room_exists"`
+	Events     []EventGraphEntry `json:"events"`
+	// The cursor for the next chunk, or empty if this was the last chunk.
+	Next string `json:"next,omitempty"`
+}
+
+const (
+	// CapabilitySendMessage is the capability to send a message event of a given type.
+	CapabilitySendMessage = "send_message"
+	// CapabilitySendState is the capability to send a state event of a given type and state key.
+	CapabilitySendState = "send_state"
+	// CapabilityInvite is the capability to invite users to the room.
+	CapabilityInvite = "invite"
+	// CapabilityKick is the capability to kick users from the room.
+	CapabilityKick = "kick"
+	// CapabilityBan is the capability to ban users from the room.
+	CapabilityBan = "ban"
+	// CapabilityRedact is the capability to redact events sent by other users.
+	CapabilityRedact = "redact"
+)
+
+// QueryUserCapabilityRequest asks whether a user is currently allowed to
+// perform an action in a room, based on the current state of the room.
+type QueryUserCapabilityRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// One of the Capability constants.
+	Action string `json:"action"`
+	// The event type for CapabilitySendMessage and CapabilitySendState.
+	EventType string `json:"event_type,omitempty"`
+	// The state key for CapabilitySendState.
+	StateKey string `json:"state_key,omitempty"`
+	// The user to invite, kick or ban. If empty then the answer is for a
+	// user who isn't in the room and has the default power level.
+	TargetUserID string `json:"target_user_id,omitempty"`
+}
+
+// QueryUserCapabilityResponse is a response to QueryUserCapability
+type QueryUserCapabilityResponse struct {
+	// Whether the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// Whether the user is allowed to perform the action.
+	Allowed bool `json:"allowed"`
+	// Why the user isn't allowed to perform the action.
+	Reason string `json:"reason,omitempty"`
+}
+
+// QueryMostRecentEventsRequest asks for the most recent events in a room,
+// for previewing the room without joining it.
+type QueryMostRecentEventsRequest struct {
+	RoomID string `json:"room_id"`
+	// The maximum number of events to return. Defaults to 20, and is capped
+	// at 100.
+	Limit int `json:"limit,omitempty"`
+}
+
+// QueryMostRecentEventsResponse is a response to QueryMostRecentEvents
+type QueryMostRecentEventsResponse struct {
+	// Whether the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// Whether the history of the room is world-readable. If not then no
+	// events are returned.
+	WorldReadable bool `json:"world_readable"`
+	// The most recent events which were accepted into the room, newest
+	// first. Redacted events are returned in their redacted form.
+	// Soft-failed and rejected events are never returned.
+	Events []*gomatrixserverlib.HeaderedEvent `json:"events"`
+}
+
+const (
+	// RedactionApplied means that the redacted event has been redacted.
+	RedactionApplied = "applied"
+	// RedactionPending means that we don't have the redacted event yet. It
+	// will be redacted when it arrives.
+	RedactionPending = "pending"
+	// RedactionNotApplied means that we have the redacted event but it
+	// wasn't redacted, e.g. because it is in a different room.
+	RedactionNotApplied = "not_applied"
+)
+
+// Redaction describes a redaction event and what it redacted.
+type Redaction struct {
+	RedactionEventID string `json:"redaction_event_id"`
+	RedactsEventID   string `json:"redacts_event_id"`
+	// One of RedactionApplied, RedactionPending or RedactionNotApplied.
+	State string `json:"state"`
+	// The redaction event itself.
+	RedactionEvent *gomatrixserverlib.HeaderedEvent `json:"redaction_event,omitempty"`
+	// The redacted event, in its redacted form if the redaction was applied.
+	// Not set if the redaction is pending.
+	TargetEvent *gomatrixserverlib.HeaderedEvent `json:"target_event,omitempty"`
+}
+
+// QueryEventsRedactedByRequest asks what a redaction event redacted.
+type QueryEventsRedactedByRequest struct {
+	RedactionEventID string `json:"redaction_event_id"`
+}
+
+// QueryEventsRedactedByResponse is a response to QueryEventsRedactedBy
+type QueryEventsRedactedByResponse struct {
+	// Whether the redaction event is known to the roomserver.
+	RedactionExists bool `json:"redaction_exists"`
+	// The redaction, if it exists.
+	Redaction *Redaction `json:"redaction,omitempty"`
+}
+
+// QueryRedactionsByUserRequest asks for the redactions a user sent in a room.
+type QueryRedactionsByUserRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+}
+
+// QueryRedactionsByUserResponse is a response to QueryRedactionsByUser
+type QueryRedactionsByUserResponse struct {
+	// Whether the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// The redactions sent by the user, oldest first.
+	Redactions []Redaction `json:"redactions"`
+}
+
+// QueryServerKeysUsedForRoomRequest asks which server signing keys signed the
+// events stored for a room. Every event in the room is loaded, up to
+// MaxEvents, so this is expensive for large rooms.
+type QueryServerKeysUsedForRoomRequest struct {
+	RoomID string `json:"room_id"`
+	// The maximum number of events to look at. Defaults to 10000, and is
+	// capped at 100000.
+	MaxEvents int `json:"max_events,omitempty"`
+}
+
+// ServerKeyUsage describes a signing key which signed events in a room.
+type ServerKeyUsage struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	KeyID      gomatrixserverlib.KeyID      `json:"key_id"`
+	// The number of events in the room signed by the key.
+	EventCount int `json:"event_count"`
+}
+
+// QueryServerKeysUsedForRoomResponse is a response to QueryServerKeysUsedForRoom
+type QueryServerKeysUsedForRoomResponse struct {
+	// Whether the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// The keys which signed events in the room, sorted by server name and
+	// then key ID.
+	Keys []ServerKeyUsage `json:"keys"`
+	// The number of events which were looked at.
+	EventsScanned int `json:"events_scanned"`
+	// Whether there were more events in the room than MaxEvents, in which
+	// case Keys may be incomplete.
+	Truncated bool `json:"truncated"`
+}
+
+// QueryEventRejectionReasonRequest asks why an event was rejected.
+type QueryEventRejectionReasonRequest struct {
+	EventID string `json:"event_id"`
+}
+
+// QueryEventRejectionReasonResponse is a response to QueryEventRejectionReason
+type QueryEventRejectionReasonResponse struct {
+	// Whether the event is known to the roomserver.
+	EventExists bool `json:"event_exists"`
+	// Whether the event was rejected.
+	Rejected bool `json:"rejected"`
+	// Why the event was rejected. This is empty if the event wasn't rejected
+	// or was rejected before reasons were recorded.
+	Reason string `json:"reason,omitempty"`
+}
+
+// QueryEventAuthChainRequest asks for the auth chain of an event in a room.
+type QueryEventAuthChainRequest struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+}
+
+// QueryEventAuthChainResponse is a response to QueryEventAuthChain
+type QueryEventAuthChainResponse struct {
+	// Whether the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// Whether the event is known to the roomserver and is in the room.
+	EventExists bool `json:"event_exists"`
+	// The auth chain of the event, not including the event itself, ordered
+	// so that every event comes after its own auth events.
+	AuthChain []*gomatrixserverlib.HeaderedEvent `json:"auth_chain"`
+}
+
+// QueryEventProvenanceRequest asks which server gave us an event.
+type QueryEventProvenanceRequest struct {
+	EventID string `json:"event_id"`
+}
+
+// QueryEventProvenanceResponse is a response to QueryEventProvenance
+type QueryEventProvenanceResponse struct {
+	// Whether the event is known to the roomserver.
+	EventExists bool `json:"event_exists"`
+	// The server which gave us the event. This is empty if the event wasn't
+	// fetched over federation, e.g. because it was created locally or was
+	// sent to us, or if it was fetched before this was recorded.
+	ServerName gomatrixserverlib.ServerName `json:"server_name,omitempty"`
+	// When we received the event from the server.
+	ReceivedAt gomatrixserverlib.Timestamp `json:"received_at,omitempty"`
+}
+
+// QueryInputDeadLettersRequest asks for input events which failed to be
+// processed because of an error, rather than because they were rejected.
+type QueryInputDeadLettersRequest struct {
+	// The maximum number of dead letters to return. Defaults to 100.
+	Limit int `json:"limit"`
+}
+
+// QueryInputDeadLettersResponse is a response to QueryInputDeadLetters
+type QueryInputDeadLettersResponse struct {
+	// The dead letters, oldest first.
+	DeadLetters []types.InputDeadLetter `json:"dead_letters"`
+}
@@ -16,7 +16,9 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -191,3 +193,90 @@ func (r *RoomserverInternalAPI) RemoveRoomAlias(
 	response.Removed = true
 	return nil
 }
+
+// QueryAliasesForRoom implements alias.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryAliasesForRoom(
+	ctx context.Context,
+	request *api.QueryAliasesForRoomRequest,
+	response *api.QueryAliasesForRoomResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, request.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	response.RoomExists = true
+
+	local, err := r.DB.GetAliasesForRoomID(ctx, request.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetAliasesForRoomID: %w", err)
+	}
+	canonicalEvent, err := r.DB.GetStateEvent(ctx, request.RoomID, gomatrixserverlib.MRoomCanonicalAlias, "")
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if canonicalEvent != nil {
+		var content struct {
+			Alias      string   `json:"alias"`
+			AltAliases []string `json:"alt_aliases"`
+		}
+		// A malformed event just means that there are no published aliases.
+		if json.Unmarshal(canonicalEvent.Content(), &content) == nil {
+			response.CanonicalAlias = content.Alias
+			response.AltAliases = content.AltAliases
+		}
+	}
+
+	response.Aliases = mergeRoomAliases(local, response.CanonicalAlias, response.AltAliases)
+	if r.asAPI != nil && len(response.Aliases) > 0 {
+		// This only matches the aliases against the namespaces of the
+		// application services, it doesn't ask them about the aliases.
+		ownedReq := &asAPI.RoomAliasesOwnedRequest{}
+		for _, alias := range response.Aliases {
+			ownedReq.Aliases = append(ownedReq.Aliases, alias.Alias)
+		}
+		ownedRes := &asAPI.RoomAliasesOwnedResponse{}
+		if err = r.asAPI.RoomAliasesOwned(ctx, ownedReq, ownedRes); err != nil {
+			return fmt.Errorf("r.asAPI.RoomAliasesOwned: %w", err)
+		}
+		for i := range response.Aliases {
+			response.Aliases[i].AppserviceID = ownedRes.Owners[response.Aliases[i].Alias]
+		}
+	}
+	return nil
+}
+
+// mergeRoomAliases combines the aliases from our room directory with those
+// published in the m.room.canonical_alias event, sorted and without duplicates.
+func mergeRoomAliases(local []string, canonical string, altAliases []string) []api.RoomAlias {
+	byAlias := map[string]*api.RoomAlias{}
+	add := func(alias string) *api.RoomAlias {
+		if a, ok := byAlias[alias]; ok {
+			return a
+		}
+		a := &api.RoomAlias{Alias: alias}
+		byAlias[alias] = a
+		return a
+	}
+	for _, alias := range local {
+		add(alias).Local = true
+	}
+	if canonical != "" {
+		add(canonical).Published = true
+	}
+	for _, alias := range altAliases {
+		if alias != "" {
+			add(alias).Published = true
+		}
+	}
+	aliases := make([]api.RoomAlias, 0, len(byAlias))
+	for _, a := range byAlias {
+		aliases = append(aliases, *a)
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].Alias < aliases[j].Alias
+	})
+	return aliases
+}
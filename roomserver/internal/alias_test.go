@@ -0,0 +1,109 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+
+	asQuery "github.com/matrix-org/dendrite/appservice/query"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeAliasDB knows about a single room with some aliases. Calling any other
+// storage.Database method will panic.
+type fakeAliasDB struct {
+	storage.Database
+	roomID    string
+	aliases   []string
+	canonical *gomatrixserverlib.HeaderedEvent
+}
+
+func (d *fakeAliasDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != d.roomID {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (d *fakeAliasDB) GetAliasesForRoomID(ctx context.Context, roomID string) ([]string, error) {
+	return d.aliases, nil
+}
+
+func (d *fakeAliasDB) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	if evType != gomatrixserverlib.MRoomCanonicalAlias {
+		return nil, nil
+	}
+	return d.canonical, nil
+}
+
+func TestQueryAliasesForRoom(t *testing.T) {
+	canonical, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id": "$canonical:localhost",
+		"room_id": "!room:localhost",
+		"sender": "@alice:localhost",
+		"type": "m.room.canonical_alias",
+		"state_key": "",
+		"content": {"alias": "#main:localhost", "alt_aliases": ["#irc_main:localhost", "#other:remote"]}
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &fakeAliasDB{
+		roomID:    "!room:localhost",
+		aliases:   []string{"#main:localhost", "#irc_main:localhost", "#irc_extra:localhost"},
+		canonical: canonical.Headered(gomatrixserverlib.RoomVersionV1),
+	}
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID: "irc",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"aliases": {{Regex: "#irc_.*", RegexpObject: regexp.MustCompile("#irc_.*")}},
+		},
+	}}
+	r := &RoomserverInternalAPI{DB: db}
+	r.SetAppserviceAPI(&asQuery.AppServiceQueryAPI{Cfg: cfg})
+
+	res := &api.QueryAliasesForRoomResponse{}
+	if err = r.QueryAliasesForRoom(context.Background(), &api.QueryAliasesForRoomRequest{RoomID: "!room:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.RoomExists || res.CanonicalAlias != "#main:localhost" || len(res.AltAliases) != 2 {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+	want := []api.RoomAlias{
+		{Alias: "#irc_extra:localhost", Local: true, AppserviceID: "irc"},
+		{Alias: "#irc_main:localhost", Local: true, Published: true, AppserviceID: "irc"},
+		{Alias: "#main:localhost", Local: true, Published: true},
+		{Alias: "#other:remote", Published: true},
+	}
+	if !reflect.DeepEqual(res.Aliases, want) {
+		t.Fatalf("got aliases %+v, want %+v", res.Aliases, want)
+	}
+
+	res = &api.QueryAliasesForRoomResponse{}
+	if err = r.QueryAliasesForRoom(context.Background(), &api.QueryAliasesForRoomRequest{RoomID: "!unknown:localhost"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.RoomExists || len(res.Aliases) != 0 {
+		t.Fatalf("expected unknown room to have no aliases, got %+v", res)
+	}
+}
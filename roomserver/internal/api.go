@@ -13,6 +13,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/perform"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/validator"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/nats-io/nats.go"
@@ -30,6 +31,11 @@ type RoomserverInternalAPI struct {
 	*perform.Unpeeker
 	*perform.Leaver
 	*perform.Publisher
+	*perform.RoomMaintainer
+	*perform.DeadLetterResubmitter
+	*perform.RoomRewinder
+	*perform.SoftFailReevaluator
+	*perform.RejectedEventReprocessor
 	*perform.Backfiller
 	*perform.Forgetter
 	DB                     storage.Database
@@ -83,6 +89,7 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.FederationInternalA
 	r.KeyRing = keyRing
 
 	r.Inputer = &input.Inputer{
+		Cfg:                  r.Cfg,
 		DB:                   r.DB,
 		InputRoomEventTopic:  r.InputRoomEventTopic,
 		OutputRoomEventTopic: r.OutputRoomEventTopic,
@@ -90,9 +97,11 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.FederationInternalA
 		Durable:              r.Durable,
 		ServerName:           r.Cfg.Matrix.ServerName,
 		FSAPI:                fsAPI,
+		ASAPI:                r.asAPI,
 		KeyRing:              keyRing,
 		ACLs:                 r.ServerACLs,
 		Queryer:              r.Queryer,
+		Validators:           validator.Registered(),
 	}
 	r.Inviter = &perform.Inviter{
 		DB:      r.DB,
@@ -136,6 +145,21 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.FederationInternalA
 	r.Publisher = &perform.Publisher{
 		DB: r.DB,
 	}
+	r.RoomMaintainer = &perform.RoomMaintainer{
+		Inputer: r.Inputer,
+	}
+	r.RoomRewinder = &perform.RoomRewinder{
+		Inputer: r.Inputer,
+	}
+	r.SoftFailReevaluator = &perform.SoftFailReevaluator{
+		Inputer: r.Inputer,
+	}
+	r.RejectedEventReprocessor = &perform.RejectedEventReprocessor{
+		Inputer: r.Inputer,
+	}
+	r.DeadLetterResubmitter = &perform.DeadLetterResubmitter{
+		Inputer: r.Inputer,
+	}
 	r.Backfiller = &perform.Backfiller{
 		ServerName: r.ServerName,
 		DB:         r.DB,
@@ -157,6 +181,9 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.FederationInternalA
 
 func (r *RoomserverInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceQueryAPI) {
 	r.asAPI = asAPI
+	if r.Inputer != nil {
+		r.Inputer.ASAPI = asAPI
+	}
 }
 
 func (r *RoomserverInternalAPI) PerformInvite(
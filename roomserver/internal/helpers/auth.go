@@ -27,14 +27,16 @@ import (
 
 // CheckForSoftFail returns true if the event should be soft-failed
 // and false otherwise. The return error value should be checked before
-// the soft-fail bool.
+// the soft-fail bool. If stateEventIDs is nil then the event is checked
+// against the current state of the room, otherwise it is checked against
+// the supplied state.
 func CheckForSoftFail(
 	ctx context.Context,
 	db storage.Database,
 	event *gomatrixserverlib.HeaderedEvent,
 	stateEventIDs []string,
 ) (bool, error) {
-	rewritesState := len(stateEventIDs) > 1
+	rewritesState := stateEventIDs != nil
 
 	var authStateEntries []types.StateEntry
 	var err error
@@ -19,17 +19,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/Arceliar/phony"
 	"github.com/getsentry/sentry-go"
+	asAPI "github.com/matrix-org/dendrite/appservice/api"
 	fedapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/hooks"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/roomserver/validator"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/nats-io/nats.go"
@@ -45,25 +50,78 @@ var keyContentFields = map[string]string{
 }
 
 type Inputer struct {
+	Cfg                  *config.RoomServer
 	DB                   storage.Database
 	JetStream            nats.JetStreamContext
 	Durable              nats.SubOpt
 	ServerName           gomatrixserverlib.ServerName
 	FSAPI                fedapi.FederationInternalAPI
+	ASAPI                asAPI.AppServiceQueryAPI
 	KeyRing              gomatrixserverlib.JSONVerifier
 	ACLs                 *acls.ServerACLs
 	InputRoomEventTopic  string
 	OutputRoomEventTopic string
+	Validators           []validator.Named
 	workers              sync.Map // room ID -> *phony.Inbox
+	maintenance          sync.Map // room ID -> struct{}
+	origins              originTracker
+	priorities           roomPriorities
+	redactions           redactionDedupWindow
+	authDeferrals        sync.Map // event ID -> time.Time
+	decisions            *decisionLog
+	authCache            authEventCache
+	serverReputation     serverReputation
+	transactions         transactionCache
+	eventFetches         inflightEventFetches
+	stateResolutions     stateResolutionCache
+	partialStateWake     chan struct{}
+	rejections           *rejectionWebhook
+	eventDuration        *roomEventDuration
+	stateResMetrics      *stateResolutionMetrics
 
 	Queryer *query.Queryer
 }
 
+// workerForRoom returns the worker which processes input events for the room.
+// Work queued onto a room's worker runs in order, one item at a time, but the
+// workers for different rooms run concurrently.
 func (r *Inputer) workerForRoom(roomID string) *phony.Inbox {
 	inbox, _ := r.workers.LoadOrStore(roomID, &phony.Inbox{})
 	return inbox.(*phony.Inbox)
 }
 
+const (
+	// deferredInputRetryMinDelay is how long we wait before retrying an event
+	// that was deferred for the first time.
+	deferredInputRetryMinDelay = time.Second
+	// deferredInputRetryMaxDelay caps the delay between retries. This must be
+	// lower than the NATS ack wait, otherwise NATS will redeliver the message
+	// itself.
+	deferredInputRetryMaxDelay = time.Minute
+)
+
+// isDeferredInput returns true if processRoomEvent didn't process an event
+// because it should be retried later, e.g. because the room is in maintenance
+// mode, the origin server is over its quota or the auth events of the event
+// couldn't be fetched.
+func isDeferredInput(err error) bool {
+	return errors.Is(err, errRoomInMaintenance) || errors.Is(err, errOriginQuotaExceeded) ||
+		errors.Is(err, errAuthEventsDeferred)
+}
+
+// deferredInputRetryDelay returns how long to wait before retrying an event
+// that was deferred, doubling with each delivery attempt.
+func deferredInputRetryDelay(numDelivered uint64) time.Duration {
+	delay := deferredInputRetryMinDelay
+	for i := uint64(1); i < numDelivered && delay < deferredInputRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > deferredInputRetryMaxDelay {
+		delay = deferredInputRetryMaxDelay
+	}
+	return delay
+}
+
 // eventsInProgress is an in-memory map to keep a track of which events we have
 // queued up for processing. If we get a redelivery from NATS and we still have
 // the queued up item then we won't do anything with the redelivered message. If
@@ -73,6 +131,21 @@ var eventsInProgress sync.Map
 
 // onMessage is called when a new event arrives in the roomserver input stream.
 func (r *Inputer) Start() error {
+	if err := r.loadRoomMaintenance(context.Background()); err != nil {
+		return err
+	}
+	if err := r.resumePendingInput(context.Background()); err != nil {
+		return err
+	}
+	r.startPartialStateCompletion()
+	r.startOutputEventPruning()
+	if err := r.startDecisionLog(); err != nil {
+		return err
+	}
+	r.startRejectionWebhook()
+	if err := r.startEventMetrics(); err != nil {
+		return err
+	}
 	_, err := r.JetStream.Subscribe(
 		r.InputRoomEventTopic,
 		// We specifically don't use jetstream.WithJetStreamMessage here because we
@@ -96,15 +169,36 @@ func (r *Inputer) Start() error {
 				return
 			}
 
-			roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Inc()
-			r.workerForRoom(roomID).Act(nil, func() {
+			r.queueInput(roomID, func() {
 				_ = msg.InProgress() // resets the acknowledgement wait timer
 				defer eventsInProgress.Delete(index)
-				defer roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Dec()
-				if err := r.processRoomEvent(context.Background(), &inputRoomEvent); err != nil {
+				release, err := r.acquirePriority(context.Background(), roomID)
+				if err != nil {
+					return
+				}
+				defer release()
+				if _, err = r.processRoomEvent(context.Background(), &inputRoomEvent); err != nil {
+					if isDeferredInput(err) {
+						// Don't acknowledge the message, so that it stays in the
+						// stream even if we restart. Ask NATS to redeliver it once
+						// we've waited for a bit.
+						var numDelivered uint64 = 1
+						if meta, merr := msg.Metadata(); merr == nil {
+							numDelivered = meta.NumDelivered
+						}
+						time.AfterFunc(deferredInputRetryDelay(numDelivered), func() {
+							_ = msg.Nak()
+						})
+						return
+					}
 					if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
 						sentry.CaptureException(err)
 					}
+					if shouldDeadLetter(err) {
+						// We're about to acknowledge the message, so keep a
+						// copy of the event for someone to look at later.
+						r.deadLetterInput(&inputRoomEvent, err)
+					}
 				} else {
 					go hooks.Run(hooks.KindNewEventPersisted, inputRoomEvent.Event)
 				}
@@ -128,22 +222,42 @@ func (r *Inputer) Start() error {
 	return err
 }
 
+// inputRoomEventMsg builds a NATS message for queuing an input event onto
+// the roomserver input stream.
+func (r *Inputer) inputRoomEventMsg(e *api.InputRoomEvent) (*nats.Msg, error) {
+	msg := &nats.Msg{
+		Subject: r.InputRoomEventTopic,
+		Header:  nats.Header{},
+	}
+	msg.Header.Set("room_id", e.Event.RoomID())
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	msg.Data = data
+	return msg, nil
+}
+
 // InputRoomEvents implements api.RoomserverInternalAPI
 func (r *Inputer) InputRoomEvents(
 	ctx context.Context,
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) {
+	inputRoomEvents := request.InputRoomEvents
+	// order holds the indexes of the events in the order that they should
+	// be processed in, so that results can still be reported in the order
+	// of the request.
+	order := make([]int, len(inputRoomEvents))
+	for i := range order {
+		order[i] = i
+	}
+	if request.TopologicalOrder {
+		order = orderInputTopologically(inputRoomEvents)
+	}
 	if request.Asynchronous {
-		var err error
-		for _, e := range request.InputRoomEvents {
-			msg := &nats.Msg{
-				Subject: r.InputRoomEventTopic,
-				Header:  nats.Header{},
-			}
-			roomID := e.Event.RoomID()
-			msg.Header.Set("room_id", roomID)
-			msg.Data, err = json.Marshal(e)
+		for _, i := range order {
+			msg, err := r.inputRoomEventMsg(&inputRoomEvents[i])
 			if err != nil {
 				response.ErrMsg = err.Error()
 				return
@@ -153,60 +267,201 @@ func (r *Inputer) InputRoomEvents(
 			}
 		}
 	} else {
-		responses := make(chan error, len(request.InputRoomEvents))
+		type processed struct {
+			index  int
+			result api.InputRoomEventResult
+			err    error
+		}
+		responses := make(chan processed, len(inputRoomEvents))
 		defer close(responses)
-		for _, e := range request.InputRoomEvents {
-			inputRoomEvent := e
+		response.Results = make([]api.InputRoomEventResult, len(inputRoomEvents))
+		for _, i := range order {
+			index, inputRoomEvent := i, inputRoomEvents[i]
+			response.Results[index].EventID = inputRoomEvent.Event.EventID()
 			roomID := inputRoomEvent.Event.RoomID()
-			index := roomID + "\000" + inputRoomEvent.Event.EventID()
-			if _, ok := eventsInProgress.LoadOrStore(index, struct{}{}); ok {
+			inProgressKey := roomID + "\000" + inputRoomEvent.Event.EventID()
+			if _, ok := eventsInProgress.LoadOrStore(inProgressKey, struct{}{}); ok {
 				// We're already waiting to deal with this event, so there's no
 				// point in queuing it up again. We've notified NATS that we're
 				// working on the message still, so that will have deferred the
 				// redelivery by a bit.
 				return
 			}
-			roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Inc()
-			worker := r.workerForRoom(roomID)
-			worker.Act(nil, func() {
-				defer eventsInProgress.Delete(index)
-				defer roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Dec()
-				err := r.processRoomEvent(ctx, &inputRoomEvent)
-				if err != nil {
-					if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
-						sentry.CaptureException(err)
+			// Journal the event before queuing it, so that it isn't lost if
+			// we crash before it has been processed.
+			journalled := r.journalInput(ctx, &inputRoomEvent)
+			r.queueInput(roomID, func() {
+				defer eventsInProgress.Delete(inProgressKey)
+				var result api.InputRoomEventResult
+				release, err := r.acquirePriority(ctx, roomID)
+				if err == nil {
+					result, err = r.processRoomEvent(ctx, &inputRoomEvent)
+					release()
+				}
+				abandoned := ctx.Err() != nil && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled))
+				if isDeferredInput(err) || abandoned {
+					// We can't hold up the caller until the event can be
+					// processed, or the caller gave up before it was, so
+					// queue the event onto the input stream instead, where
+					// it will be retried until it succeeds. If that fails
+					// then the event stays in the journal, if it's in there,
+					// to be resumed after a restart.
+					var msg *nats.Msg
+					if msg, err = r.inputRoomEventMsg(&inputRoomEvent); err == nil {
+						_, err = r.JetStream.PublishMsg(msg)
+					}
+					if err != nil {
+						log.WithError(err).WithFields(log.Fields{
+							"room_id":  roomID,
+							"event_id": inputRoomEvent.Event.EventID(),
+						}).Error("Failed to queue input event onto the input stream")
+					} else if journalled {
+						r.unjournalInput(&inputRoomEvent)
 					}
 				} else {
-					go hooks.Run(hooks.KindNewEventPersisted, inputRoomEvent.Event)
+					if journalled {
+						r.unjournalInput(&inputRoomEvent)
+					}
+					if err != nil {
+						sentry.CaptureException(err)
+						if shouldDeadLetter(err) {
+							r.deadLetterInput(&inputRoomEvent, err)
+						}
+					} else {
+						go hooks.Run(hooks.KindNewEventPersisted, inputRoomEvent.Event)
+					}
 				}
 				select {
 				case <-ctx.Done():
 				default:
-					responses <- err
+					responses <- processed{index, result, err}
 				}
 			})
 		}
-		for i := 0; i < len(request.InputRoomEvents); i++ {
+		var firstErr error
+		for i := 0; i < len(inputRoomEvents); i++ {
 			select {
 			case <-ctx.Done():
 				response.ErrMsg = context.DeadlineExceeded.Error()
 				return
-			case err := <-responses:
-				if err != nil {
-					response.ErrMsg = err.Error()
+			case res := <-responses:
+				response.Results[res.index] = res.result
+				if res.err != nil && !request.TopologicalOrder {
+					response.ErrMsg = res.err.Error()
+					response.NotAllowed = res.result.NotAllowed
 					return
 				}
+				if res.err != nil && firstErr == nil {
+					firstErr = res.err
+					response.NotAllowed = res.result.NotAllowed
+				}
 			}
 		}
+		if firstErr != nil {
+			response.ErrMsg = firstErr.Error()
+		}
 	}
 }
 
+// outputEventTracker records which output events have already been emitted,
+// so that reprocessing an input event after a crash doesn't emit the same
+// output events downstream a second time.
+type outputEventTracker interface {
+	OutputEventsSent(keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error)
+	MarkOutputEventsAsSent(keys []types.OutputEventKey) error
+}
+
+// dbOutputEventTracker is an outputEventTracker for use outside of a
+// database transaction.
+type dbOutputEventTracker struct {
+	ctx context.Context
+	db  storage.Database
+}
+
+func (t dbOutputEventTracker) OutputEventsSent(keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	return t.db.OutputEventsSent(t.ctx, keys)
+}
+
+func (t dbOutputEventTracker) MarkOutputEventsAsSent(keys []types.OutputEventKey) error {
+	return t.db.MarkOutputEventsAsSent(t.ctx, keys)
+}
+
+// outputRoomEventPartitions returns how many partitions output room events
+// are spread over, or zero if they aren't partitioned.
+func (r *Inputer) outputRoomEventPartitions() int {
+	if r.Cfg == nil || r.Cfg.Matrix == nil {
+		return 0
+	}
+	return r.Cfg.Matrix.JetStream.OutputRoomEventPartitions
+}
+
 // WriteOutputEvents implements OutputRoomEventWriter
 func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
-	var err error
-	for _, update := range updates {
+	return r.writeOutputEvents(dbOutputEventTracker{context.Background(), r.DB}, roomID, updates)
+}
+
+// writeOutputEvents produces the given output events, skipping any that the
+// tracker says have already been emitted and marking the rest as emitted once
+// they have been produced. The tracker is asked about all of the output events
+// at once, and the ones that were produced are marked together at the end, even
+// if producing a later one failed. If the tracker is backed by a database
+// transaction then the markers are only persisted if that transaction commits.
+func (r *Inputer) writeOutputEvents(tracker outputEventTracker, roomID string, updates []api.OutputEvent) (err error) {
+	windowSize := r.redactionDedupWindowSize()
+	recentlySeen := make([]bool, len(updates))
+	keys := make([]types.OutputEventKey, 0, len(updates))
+	for i := range updates {
+		if redaction, isRedaction := redactionPairFor(&updates[i]); isRedaction && r.redactions.seen(redaction, windowSize) {
+			recentlySeen[i] = true
+			continue
+		}
+		if eventID := updates[i].EventID(); eventID != "" {
+			keys = append(keys, types.OutputEventKey{EventID: eventID, OutputType: string(updates[i].Type)})
+		}
+	}
+	sent := make(map[types.OutputEventKey]bool, len(keys))
+	if len(keys) > 0 {
+		var alreadySent map[types.OutputEventKey]bool
+		if alreadySent, err = tracker.OutputEventsSent(keys); err != nil {
+			return fmt.Errorf("tracker.OutputEventsSent: %w", err)
+		}
+		for key, ok := range alreadySent {
+			sent[key] = ok
+		}
+	}
+	var produced []types.OutputEventKey
+	defer func() {
+		if markErr := tracker.MarkOutputEventsAsSent(produced); markErr != nil && err == nil {
+			err = fmt.Errorf("tracker.MarkOutputEventsAsSent: %w", markErr)
+		}
+	}()
+	for i, update := range updates {
+		eventID := update.EventID()
+		key := types.OutputEventKey{EventID: eventID, OutputType: string(update.Type)}
+		redaction, isRedaction := redactionPairFor(&update)
+		if recentlySeen[i] {
+			log.WithFields(log.Fields{
+				"room_id":  roomID,
+				"event_id": eventID,
+				"type":     update.Type,
+			}).Debug("Redaction output event recently produced, skipping")
+			continue
+		}
+		if eventID != "" {
+			if sent[key] {
+				if isRedaction {
+					r.redactions.add(redaction, windowSize)
+				}
+				log.WithFields(log.Fields{
+					"room_id":  roomID,
+					"event_id": eventID,
+					"type":     update.Type,
+				}).Debug("Output event already produced, skipping")
+				continue
+			}
+		}
 		msg := &nats.Msg{
-			Subject: r.OutputRoomEventTopic,
+			Subject: jetstream.RoomSubject(r.OutputRoomEventTopic, roomID, r.outputRoomEventPartitions()),
 			Header:  nats.Header{},
 		}
 		msg.Header.Set(jetstream.RoomID, roomID)
@@ -244,11 +499,18 @@ func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) er
 				defer r.ACLs.OnServerACLUpdate(ev)
 			}
 		}
-		logger.Tracef("Producing to topic '%s'", r.OutputRoomEventTopic)
+		logger.Tracef("Producing to topic '%s'", msg.Subject)
 		if _, err := r.JetStream.PublishMsg(msg); err != nil {
-			logger.WithError(err).Errorf("Failed to produce to topic '%s': %s", r.OutputRoomEventTopic, err)
+			logger.WithError(err).Errorf("Failed to produce to topic '%s': %s", msg.Subject, err)
 			return err
 		}
+		if eventID != "" {
+			sent[key] = true
+			produced = append(produced, key)
+		}
+		if isRedaction {
+			r.redactions.add(redaction, windowSize)
+		}
 	}
 	return nil
 }
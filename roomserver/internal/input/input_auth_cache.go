@@ -0,0 +1,128 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(authEventCacheLookups)
+}
+
+var authEventCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "auth_event_cache_lookups_total",
+		Help:      "Number of lookups in the cache of recently fetched auth events, by whether the event was found",
+	},
+	[]string{"result"},
+)
+
+type authEventCacheKey struct {
+	roomID  string
+	eventID string
+}
+
+type authEventCacheEntry struct {
+	key   authEventCacheKey
+	event *types.Event
+	added time.Time
+}
+
+// authEventCache is a least-recently-used cache of auth events which have
+// been fetched over federation, verified and stored. Events are cached per
+// room, so an event is only ever reused for other events in the same room.
+// The zero value is an empty cache.
+type authEventCache struct {
+	mu      sync.Mutex
+	entries map[authEventCacheKey]*list.Element
+	order   list.List // most recently used at the front
+}
+
+func (c *authEventCache) get(roomID, eventID string, ttl time.Duration, now time.Time) *types.Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[authEventCacheKey{roomID, eventID}]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*authEventCacheEntry)
+	if now.Sub(entry.added) >= ttl {
+		c.order.Remove(element)
+		delete(c.entries, entry.key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry.event
+}
+
+func (c *authEventCache) add(roomID string, event *types.Event, size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[authEventCacheKey]*list.Element)
+	}
+	key := authEventCacheKey{roomID, event.EventID()}
+	if element, ok := c.entries[key]; ok {
+		element.Value = &authEventCacheEntry{key, event, now}
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&authEventCacheEntry{key, event, now})
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*authEventCacheEntry).key)
+	}
+}
+
+func (r *Inputer) authEventCacheOptions() config.AuthEventCacheOptions {
+	if r.Cfg == nil {
+		return config.AuthEventCacheOptions{}
+	}
+	return r.Cfg.AuthEventCache
+}
+
+// cachedAuthEvent returns the auth event with the given ID if it was
+// recently fetched for another event in the room, or nil if not.
+func (r *Inputer) cachedAuthEvent(roomID, eventID string) *types.Event {
+	opts := r.authEventCacheOptions()
+	if opts.Size <= 0 {
+		return nil
+	}
+	event := r.authCache.get(roomID, eventID, opts.TTL, time.Now())
+	if event == nil {
+		authEventCacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+	authEventCacheLookups.WithLabelValues("hit").Inc()
+	return event
+}
+
+// cacheAuthEvent remembers an auth event which was fetched, verified and
+// stored, so that it can be reused for other events in the room.
+func (r *Inputer) cacheAuthEvent(roomID string, event *types.Event) {
+	if opts := r.authEventCacheOptions(); opts.Size > 0 {
+		r.authCache.add(roomID, event, opts.Size, time.Now())
+	}
+}
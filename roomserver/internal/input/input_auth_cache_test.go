@@ -0,0 +1,132 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFetchAuthEventsReusesCachedAuthEvents(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	join := mustBuildSignedEvent(t, private, 2, gomatrixserverlib.MRoomMember, "@alice:remote", map[string]interface{}{
+		"membership": "join",
+	}, []string{create.EventID()})
+	invite := mustBuildSignedEvent(t, private, 3, gomatrixserverlib.MRoomMember, "@bob:remote", map[string]interface{}{
+		"membership": "invite",
+	}, []string{create.EventID(), join.EventID()})
+	first := mustBuildSignedEvent(t, private, 3, "m.room.topic", "", map[string]interface{}{
+		"topic": "first",
+	}, []string{create.EventID(), join.EventID()})
+	// The second event only has the create event as a direct auth event in
+	// common with the first, but its auth chain overlaps with the first's.
+	second := mustBuildSignedEvent(t, private, 4, "m.room.topic", "", map[string]interface{}{
+		"topic": "second",
+	}, []string{create.EventID(), invite.EventID()})
+
+	tests := []struct {
+		name       string
+		cacheSize  int
+		wantStored []string
+	}{
+		{"without cache", 0, []string{create.EventID(), join.EventID(), join.EventID(), invite.EventID()}},
+		{"with cache", 10, []string{create.EventID(), join.EventID(), invite.EventID()}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := &fakeAuthFallbackDB{events: map[string]types.Event{}}
+			fsAPI := &fakeAuthFallbackFSAPI{
+				keyRing: &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+				events:  map[string]*gomatrixserverlib.Event{},
+			}
+			r := &Inputer{
+				Cfg: &config.RoomServer{
+					AuthEventCache: config.AuthEventCacheOptions{Size: tc.cacheSize, TTL: time.Minute},
+				},
+				DB:    db,
+				FSAPI: fsAPI,
+			}
+			for _, step := range []struct {
+				event     *gomatrixserverlib.Event
+				authChain []*gomatrixserverlib.Event
+			}{
+				{first, []*gomatrixserverlib.Event{create, join}},
+				{second, []*gomatrixserverlib.Event{create, join, invite}},
+			} {
+				event := step.event
+				fsAPI.eventAuth = step.authChain
+				auth := gomatrixserverlib.NewAuthEvents(nil)
+				known := map[string]*types.Event{}
+				if err := r.fetchAuthEvents(
+					context.Background(), logrus.WithField("test", t.Name()),
+					event.Headered(gomatrixserverlib.RoomVersionV6), &auth, known,
+					[]gomatrixserverlib.ServerName{"remote"},
+				); err != nil {
+					t.Fatal(err)
+				}
+				for _, authEventID := range event.AuthEventIDs() {
+					if known[authEventID] == nil {
+						t.Fatalf("expected auth event %s to be known", authEventID)
+					}
+				}
+			}
+			if !reflect.DeepEqual(db.stored, tc.wantStored) {
+				t.Fatalf("stored %v, want %v", db.stored, tc.wantStored)
+			}
+		})
+	}
+}
+
+func TestAuthEventCacheEviction(t *testing.T) {
+	var cache authEventCache
+	now := time.Now()
+	events := make([]*types.Event, 3)
+	for i := range events {
+		events[i] = &types.Event{
+			EventNID: types.EventNID(i + 1),
+			Event:    mustCreateEvent(t, map[string]interface{}{"event_id": "$" + string(rune('a'+i)) + ":localhost"}),
+		}
+	}
+	cache.add("!room:localhost", events[0], 2, now)
+	cache.add("!room:localhost", events[1], 2, now)
+	// Using the first event makes the second the least recently used.
+	if cache.get("!room:localhost", events[0].EventID(), time.Minute, now) == nil {
+		t.Fatal("expected the first event to be cached")
+	}
+	cache.add("!room:localhost", events[2], 2, now)
+	if cache.get("!room:localhost", events[1].EventID(), time.Minute, now) != nil {
+		t.Fatal("expected the second event to have been evicted")
+	}
+	if cache.get("!other:localhost", events[0].EventID(), time.Minute, now) != nil {
+		t.Fatal("expected cached events not to be shared between rooms")
+	}
+	if cache.get("!room:localhost", events[2].EventID(), time.Minute, now.Add(time.Minute)) != nil {
+		t.Fatal("expected the third event to have expired")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(authFetchFailures)
+}
+
+var authFetchFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "auth_fetch_failures_total",
+		Help:      "Number of new events whose auth events couldn't be fetched from any server, by what happened to them",
+	},
+	[]string{"outcome"},
+)
+
+// ErrNoServersForAuth is matched by errors.Is on the error returned when none
+// of the servers in a room could provide the auth events of an event. Unlike
+// an event being rejected, this doesn't say anything about the event itself,
+// so the event may still be accepted if it's retried later.
+var ErrNoServersForAuth = errors.New("no servers provided event auth")
+
+// errAuthEventsDeferred is returned by processRoomEvent when the auth events
+// of a new event couldn't be fetched and the event should be retried later.
+var errAuthEventsDeferred = errors.New("auth events could not be fetched, deferring")
+
+// authEventsDeferredError wraps the error which caused an event to be
+// deferred, so that it matches both errAuthEventsDeferred and that error.
+type authEventsDeferredError struct {
+	err error
+}
+
+func (e *authEventsDeferredError) Error() string {
+	return fmt.Sprintf("%s: %s", errAuthEventsDeferred, e.err)
+}
+
+func (e *authEventsDeferredError) Is(target error) bool {
+	return target == errAuthEventsDeferred
+}
+
+func (e *authEventsDeferredError) Unwrap() error {
+	return e.err
+}
+
+// authEventsUnavailableError is returned by fetchAuthEvents when none of the
+// servers that we asked could provide the auth events of an event. It matches
+// ErrNoServersForAuth.
+type authEventsUnavailableError struct {
+	eventID string
+	servers []gomatrixserverlib.ServerName
+	err     error
+}
+
+func (e *authEventsUnavailableError) Error() string {
+	return fmt.Sprintf("no servers provided event auth for event ID %q, tried servers %v: %s", e.eventID, e.servers, e.err)
+}
+
+func (e *authEventsUnavailableError) Is(target error) bool {
+	return target == ErrNoServersForAuth
+}
+
+func (e *authEventsUnavailableError) Unwrap() error {
+	return e.err
+}
+
+func (r *Inputer) authFetchFailure() config.AuthFetchFailureOptions {
+	if r.Cfg == nil {
+		return config.AuthFetchFailureOptions{}
+	}
+	return r.Cfg.AuthFetchFailure
+}
+
+// authFetchFailed decides what to do with a new event whose auth events
+// couldn't be fetched, according to the configured policy. It either returns
+// the original error, so that the event is given up on, or an error matching
+// errAuthEventsDeferred, so that the event is retried later with a backoff.
+// Either way, the returned error still matches ErrNoServersForAuth.
+// By the time the event is retried, servers which can provide the auth events
+// may have joined the room. Events are only deferred for up to the maximum
+// age, counted from when they were first deferred by this process.
+func (r *Inputer) authFetchFailed(logger *logrus.Entry, input *api.InputRoomEvent, err error, now time.Time) error {
+	if input.Kind != api.KindNew || !errors.Is(err, ErrNoServersForAuth) {
+		return err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	opts := r.authFetchFailure()
+	if opts.Action != config.AuthFetchFailureActionDefer {
+		authFetchFailures.WithLabelValues("rejected").Inc()
+		return err
+	}
+	eventID := input.Event.EventID()
+	first, _ := r.authDeferrals.LoadOrStore(eventID, now)
+	if deferredFor := now.Sub(first.(time.Time)); deferredFor >= opts.MaxDeferAge {
+		r.authDeferrals.Delete(eventID)
+		authFetchFailures.WithLabelValues("expired").Inc()
+		logger.WithField("deferred_for", deferredFor).Warn("Giving up on event as its auth events still can't be fetched")
+		return err
+	}
+	authFetchFailures.WithLabelValues("deferred").Inc()
+	logger.WithError(err).Info("Deferring event as its auth events can't be fetched")
+	return &authEventsDeferredError{err: err}
+}
+
+// forgetAuthFetchDeferral forgets about any earlier deferrals of an event
+// once its auth events have been fetched.
+func (r *Inputer) forgetAuthFetchDeferral(input *api.InputRoomEvent) {
+	if input.Kind == api.KindNew {
+		r.authDeferrals.Delete(input.Event.EventID())
+	}
+}
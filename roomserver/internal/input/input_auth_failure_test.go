@@ -0,0 +1,181 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAuthFetchFailedReject(t *testing.T) {
+	r := &Inputer{Cfg: &config.RoomServer{}}
+	r.Cfg.AuthFetchFailure.Defaults()
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)}
+	fetchErr := &authEventsUnavailableError{eventID: input.Event.EventID(), err: errors.New("not found")}
+
+	err := r.authFetchFailed(logrus.WithField("test", t.Name()), input, fetchErr, time.Now())
+	if err != error(fetchErr) {
+		t.Fatalf("expected the original error, got %v", err)
+	}
+	if isDeferredInput(err) {
+		t.Fatal("expected the event not to be deferred")
+	}
+}
+
+func TestAuthFetchFailedDefer(t *testing.T) {
+	r := &Inputer{Cfg: &config.RoomServer{}}
+	r.Cfg.AuthFetchFailure = config.AuthFetchFailureOptions{
+		Action:      config.AuthFetchFailureActionDefer,
+		MaxDeferAge: time.Hour,
+	}
+	logger := logrus.WithField("test", t.Name())
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)}
+	fetchErr := &authEventsUnavailableError{
+		eventID: input.Event.EventID(),
+		servers: []gomatrixserverlib.ServerName{"remote"},
+		err:     errors.New("not found"),
+	}
+	start := time.Now()
+
+	// The event is deferred until it has been deferred for the maximum age.
+	for _, after := range []time.Duration{0, time.Minute, time.Hour - time.Second} {
+		if err := r.authFetchFailed(logger, input, fetchErr, start.Add(after)); !isDeferredInput(err) {
+			t.Fatalf("after %s: expected the event to be deferred, got %v", after, err)
+		}
+	}
+	if err := r.authFetchFailed(logger, input, fetchErr, start.Add(time.Hour)); err != error(fetchErr) {
+		t.Fatalf("expected the event to be given up on, got %v", err)
+	}
+
+	// Giving up on the event forgets about it, so it can be deferred again
+	// if it is received again.
+	if err := r.authFetchFailed(logger, input, fetchErr, start.Add(2*time.Hour)); !isDeferredInput(err) {
+		t.Fatalf("expected the event to be deferred again, got %v", err)
+	}
+	r.forgetAuthFetchDeferral(input)
+	if _, ok := r.authDeferrals.Load(input.Event.EventID()); ok {
+		t.Fatal("expected the deferral to be forgotten")
+	}
+
+	// Only new events which failed because no server had the auth events
+	// are deferred.
+	outlier := &api.InputRoomEvent{Kind: api.KindOutlier, Event: input.Event}
+	if err := r.authFetchFailed(logger, outlier, fetchErr, start); isDeferredInput(err) {
+		t.Fatal("expected outliers not to be deferred")
+	}
+	otherErr := errors.New("database is unavailable")
+	if err := r.authFetchFailed(logger, input, otherErr, start); err != otherErr {
+		t.Fatalf("expected other errors to be returned as-is, got %v", err)
+	}
+	cancelled := &authEventsUnavailableError{eventID: input.Event.EventID(), err: context.Canceled}
+	if err := r.authFetchFailed(logger, input, cancelled, start); isDeferredInput(err) {
+		t.Fatal("expected cancellation not to be deferred")
+	}
+}
+
+// unavailableAuthDB is a room in which none of the auth or prev events of
+// new events are known.
+type unavailableAuthDB struct {
+	fakeAuthFallbackDB
+}
+
+func (d *unavailableAuthDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV6}, nil
+}
+
+func (d *unavailableAuthDB) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	return map[string]types.EventNID{}, nil
+}
+
+func (d *unavailableAuthDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	return nil, nil
+}
+
+type unavailableAuthFSAPI struct {
+	fakeAuthFallbackFSAPI
+}
+
+func (f *unavailableAuthFSAPI) QueryJoinedHostServerNamesInRoom(
+	ctx context.Context, req *fedapi.QueryJoinedHostServerNamesInRoomRequest, res *fedapi.QueryJoinedHostServerNamesInRoomResponse,
+) error {
+	res.ServerNames = []gomatrixserverlib.ServerName{"remote"}
+	return nil
+}
+
+func TestProcessRoomEventReturnsErrNoServersForAuth(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	event := mustBuildSignedEvent(t, private, 2, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{create.EventID()})
+
+	db := &unavailableAuthDB{fakeAuthFallbackDB{events: map[string]types.Event{}}}
+	r := &Inputer{
+		Cfg:     &config.RoomServer{},
+		DB:      db,
+		Queryer: &query.Queryer{DB: db},
+		FSAPI: &unavailableAuthFSAPI{fakeAuthFallbackFSAPI{
+			keyRing: &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+			events:  map[string]*gomatrixserverlib.Event{},
+		}},
+	}
+	r.Cfg.AuthFetchFailure.Defaults()
+	input := &api.InputRoomEvent{
+		Kind:  api.KindNew,
+		Event: event.Headered(gomatrixserverlib.RoomVersionV6),
+	}
+
+	// When rejecting, the error tells the caller that the event wasn't
+	// processed because no server had its auth events.
+	_, err = r.processRoomEvent(context.Background(), input)
+	if !errors.Is(err, ErrNoServersForAuth) {
+		t.Fatalf("expected ErrNoServersForAuth, got %v", err)
+	}
+	if isDeferredInput(err) {
+		t.Fatal("expected the event not to be deferred")
+	}
+	if len(db.stored) != 0 {
+		t.Fatalf("expected nothing to be stored, got %v", db.stored)
+	}
+
+	// When deferring, the error still says why the event was deferred.
+	r.Cfg.AuthFetchFailure = config.AuthFetchFailureOptions{
+		Action:      config.AuthFetchFailureActionDefer,
+		MaxDeferAge: time.Hour,
+	}
+	_, err = r.processRoomEvent(context.Background(), input)
+	if !errors.Is(err, ErrNoServersForAuth) {
+		t.Fatalf("expected ErrNoServersForAuth, got %v", err)
+	}
+	if !isDeferredInput(err) {
+		t.Fatal("expected the event to be deferred")
+	}
+}
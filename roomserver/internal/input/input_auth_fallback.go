@@ -0,0 +1,195 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(authEventsFromIndividualFetches)
+}
+
+var authEventsFromIndividualFetches = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "auth_events_from_individual_fetches_total",
+		Help:      "Number of auth events that were fetched one at a time over federation because the full auth chain was unavailable or incomplete",
+	},
+)
+
+// maxIndividualAuthEventFetches limits how many auth events we will fetch one
+// at a time for a single event, since each one is a separate request.
+const maxIndividualAuthEventFetches = 100
+
+// missingFromAuthChain returns the IDs of the auth events which are needed,
+// either because they are unknown auth events of the event itself or because
+// they are auth events of an event in the chain, but which are neither known
+// nor in the chain.
+func missingFromAuthChain(
+	unknown map[string]struct{}, chain []*gomatrixserverlib.Event, known map[string]*types.Event,
+) []string {
+	have := make(map[string]struct{}, len(chain))
+	for _, ev := range chain {
+		have[ev.EventID()] = struct{}{}
+	}
+	var missing []string
+	check := func(eventID string) {
+		if _, ok := have[eventID]; ok {
+			return
+		}
+		if ev, ok := known[eventID]; ok && ev != nil {
+			return
+		}
+		have[eventID] = struct{}{} // don't report it twice
+		missing = append(missing, eventID)
+	}
+	for eventID := range unknown {
+		check(eventID)
+	}
+	for _, ev := range chain {
+		for _, eventID := range ev.AuthEventIDs() {
+			check(eventID)
+		}
+	}
+	return missing
+}
+
+// fetchAuthEventsIndividually fetches the given auth events, and any of their
+// auth events that we don't already have, one at a time using /event. This is
+// a fallback for servers which don't serve /event_auth, or which served us an
+// incomplete auth chain. Events that turn out to be in the database are added
+// to known rather than fetched. The fetched events are returned in no
+// particular order and their signatures have not been verified. The server
+// which gave us each fetched event is recorded in suppliedBy.
+func (r *Inputer) fetchAuthEventsIndividually(
+	ctx context.Context,
+	logger *logrus.Entry,
+	roomVersion gomatrixserverlib.RoomVersion,
+	roomID string,
+	missing []string,
+	chain []*gomatrixserverlib.Event,
+	known map[string]*types.Event,
+	servers []gomatrixserverlib.ServerName,
+	suppliedBy map[string]gomatrixserverlib.ServerName,
+	backoff *federationBackoff,
+) ([]*gomatrixserverlib.Event, error) {
+	have := make(map[string]struct{}, len(chain))
+	for _, ev := range chain {
+		have[ev.EventID()] = struct{}{}
+	}
+	var fetched []*gomatrixserverlib.Event
+	queue := append([]string{}, missing...)
+	for len(queue) > 0 {
+		eventID := queue[0]
+		queue = queue[1:]
+		if _, ok := have[eventID]; ok {
+			continue
+		}
+		if ev, ok := known[eventID]; ok && ev != nil {
+			continue
+		}
+		have[eventID] = struct{}{}
+
+		// We might already have the event in the database, in which case we
+		// know its auth events too.
+		events, err := r.DB.EventsFromIDs(ctx, []string{eventID})
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+		}
+		if len(events) == 1 && events[0].Event != nil {
+			ev := events[0]
+			known[eventID] = &ev
+			continue
+		}
+
+		if len(fetched) >= maxIndividualAuthEventFetches {
+			return nil, fmt.Errorf("auth chain needs more than %d individually fetched events", maxIndividualAuthEventFetches)
+		}
+		ev, serverName, err := r.fetchAuthEvent(ctx, logger, roomVersion, roomID, eventID, servers, backoff)
+		if err != nil {
+			return nil, err
+		}
+		suppliedBy[eventID] = serverName
+		authEventsFromIndividualFetches.Inc()
+		fetched = append(fetched, ev)
+		queue = append(queue, ev.AuthEventIDs()...)
+	}
+	return fetched, nil
+}
+
+// fetchAuthEvent fetches a single auth event from the first of the servers
+// that will give it to us, returning the event and the server. Requests are
+// spaced out and limited by the backoff once servers start failing.
+func (r *Inputer) fetchAuthEvent(
+	ctx context.Context,
+	logger *logrus.Entry,
+	roomVersion gomatrixserverlib.RoomVersion,
+	roomID, eventID string,
+	servers []gomatrixserverlib.ServerName,
+	backoff *federationBackoff,
+) (*gomatrixserverlib.Event, gomatrixserverlib.ServerName, error) {
+	for _, serverName := range servers {
+		if err := backoff.wait(ctx); err != nil {
+			return nil, "", fmt.Errorf("giving up on auth event %q: %w", eventID, err)
+		}
+		ev, err := r.fetchAuthEventFromServer(ctx, roomVersion, serverName, eventID)
+		if err != nil {
+			logger.WithError(err).WithField("server", serverName).Warnf("Failed to get auth event %q from federation", eventID)
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+			backoff.failed()
+			continue
+		}
+		if ev.EventID() != eventID || ev.RoomID() != roomID {
+			logger.WithField("server", serverName).Warnf("Server returned event %q in room %q when asked for auth event %q", ev.EventID(), ev.RoomID(), eventID)
+			backoff.failed()
+			continue
+		}
+		backoff.succeeded()
+		return ev, serverName, nil
+	}
+	return nil, "", fmt.Errorf("no servers provided auth event %q, tried servers %v", eventID, servers)
+}
+
+func (r *Inputer) fetchAuthEventFromServer(
+	ctx context.Context,
+	roomVersion gomatrixserverlib.RoomVersion,
+	serverName gomatrixserverlib.ServerName,
+	eventID string,
+) (*gomatrixserverlib.Event, error) {
+	reqctx, cancel := withFederationRequestTimeout(ctx)
+	defer cancel()
+	txn, err := r.eventFetches.getEvent(reqctx, r.FSAPI, serverName, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("r.eventFetches.getEvent: %w", err)
+	}
+	if len(txn.PDUs) == 0 {
+		return nil, fmt.Errorf("no events returned")
+	}
+	ev, err := gomatrixserverlib.NewEventFromUntrustedJSON(txn.PDUs[0], roomVersion)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.NewEventFromUntrustedJSON: %w", err)
+	}
+	return ev, nil
+}
@@ -0,0 +1,402 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const testKeyID = gomatrixserverlib.KeyID("ed25519:test")
+
+// fakeKeyDatabase returns the same public key for every request.
+type fakeKeyDatabase struct {
+	public ed25519.PublicKey
+}
+
+func (d *fakeKeyDatabase) FetcherName() string { return "fakeKeyDatabase" }
+
+func (d *fakeKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes(d.public)},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	return results, nil
+}
+
+func (d *fakeKeyDatabase) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+// fakeAuthFallbackFSAPI serves events over /event, and optionally some of
+// them over /event_auth.
+type fakeAuthFallbackFSAPI struct {
+	fedapi.FederationInternalAPI
+	keyRing   *gomatrixserverlib.KeyRing
+	events    map[string]*gomatrixserverlib.Event
+	eventAuth []*gomatrixserverlib.Event // if nil, /event_auth fails
+}
+
+func (f *fakeAuthFallbackFSAPI) KeyRing() *gomatrixserverlib.KeyRing {
+	return f.keyRing
+}
+
+func (f *fakeAuthFallbackFSAPI) GetEventAuth(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string,
+) (gomatrixserverlib.RespEventAuth, error) {
+	if f.eventAuth == nil {
+		return gomatrixserverlib.RespEventAuth{}, errors.New("event auth not supported")
+	}
+	return gomatrixserverlib.RespEventAuth{AuthEvents: f.eventAuth}, nil
+}
+
+func (f *fakeAuthFallbackFSAPI) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	ev, ok := f.events[eventID]
+	if !ok {
+		return gomatrixserverlib.Transaction{}, fmt.Errorf("event %s not found", eventID)
+	}
+	return gomatrixserverlib.Transaction{PDUs: []json.RawMessage{ev.JSON()}}, nil
+}
+
+// fakeAuthFallbackDB stores events in memory. Calling any other
+// storage.Database method will panic.
+type fakeAuthFallbackDB struct {
+	storage.Database
+	events     map[string]types.Event
+	stored     []string
+	suppliedBy map[string]gomatrixserverlib.ServerName
+}
+
+func (d *fakeAuthFallbackDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	var events []types.Event
+	for _, eventID := range eventIDs {
+		if ev, ok := d.events[eventID]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func (d *fakeAuthFallbackDB) StoreEvent(
+	ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID, isRejected, rejectedByAuth bool, rejectionReason string,
+) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	nid := types.EventNID(len(d.events) + 1)
+	d.events[event.EventID()] = types.Event{EventNID: nid, Event: event}
+	d.stored = append(d.stored, event.EventID())
+	return nid, 1, types.StateAtEvent{}, nil, "", nil
+}
+
+func (d *fakeAuthFallbackDB) StoreEvents(
+	ctx context.Context, events []types.EventToStore, knownNIDs map[string]types.EventNID,
+) ([]types.EventNID, error) {
+	if d.suppliedBy == nil {
+		d.suppliedBy = map[string]gomatrixserverlib.ServerName{}
+	}
+	for _, ev := range events {
+		d.suppliedBy[ev.Event.EventID()] = ev.SuppliedBy
+	}
+	return storeEventsOneByOne(ctx, d.StoreEvent, events, knownNIDs)
+}
+
+// storeEventsOneByOne implements StoreEvents on top of StoreEvent.
+func storeEventsOneByOne(
+	ctx context.Context,
+	storeEvent func(context.Context, *gomatrixserverlib.Event, []types.EventNID, bool, bool, string) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error),
+	events []types.EventToStore, knownNIDs map[string]types.EventNID,
+) ([]types.EventNID, error) {
+	nids := make(map[string]types.EventNID, len(knownNIDs)+len(events))
+	for eventID, nid := range knownNIDs {
+		nids[eventID] = nid
+	}
+	eventNIDs := make([]types.EventNID, 0, len(events))
+	for _, ev := range events {
+		authEventNIDs := make([]types.EventNID, 0, len(ev.Event.AuthEventIDs()))
+		for _, authEventID := range ev.Event.AuthEventIDs() {
+			nid, ok := nids[authEventID]
+			if !ok {
+				return nil, fmt.Errorf("missing auth event %s for %s", authEventID, ev.Event.EventID())
+			}
+			authEventNIDs = append(authEventNIDs, nid)
+		}
+		nid, _, _, _, _, err := storeEvent(ctx, ev.Event, authEventNIDs, ev.IsRejected, ev.RejectedByAuth, ev.RejectionReason)
+		if err != nil {
+			return nil, err
+		}
+		nids[ev.Event.EventID()] = nid
+		eventNIDs = append(eventNIDs, nid)
+	}
+	return eventNIDs, nil
+}
+
+func mustBuildSignedEvent(
+	t *testing.T, private ed25519.PrivateKey, depth int64,
+	eventType, stateKey string, content interface{}, authEvents []string,
+) *gomatrixserverlib.Event {
+	t.Helper()
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     "@alice:remote",
+		RoomID:     "!room:remote",
+		Type:       eventType,
+		StateKey:   &stateKey,
+		PrevEvents: authEvents,
+		AuthEvents: authEvents,
+		Depth:      depth,
+	}
+	if err := builder.SetContent(content); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "remote", testKeyID, private, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestFetchAuthEventsFallsBackToIndividualEvents(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	join := mustBuildSignedEvent(t, private, 2, gomatrixserverlib.MRoomMember, "@alice:remote", map[string]interface{}{
+		"membership": "join",
+	}, []string{create.EventID()})
+	// The event only lists the join as an auth event, so that the create
+	// event can only be found by walking the auth chain.
+	event := mustBuildSignedEvent(t, private, 3, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{join.EventID()})
+
+	tests := []struct {
+		name      string
+		eventAuth []*gomatrixserverlib.Event
+	}{
+		{"event auth fails", nil},
+		{"event auth incomplete", []*gomatrixserverlib.Event{join}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := &fakeAuthFallbackDB{events: map[string]types.Event{}}
+			r := &Inputer{
+				DB: db,
+				FSAPI: &fakeAuthFallbackFSAPI{
+					keyRing: &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+					events: map[string]*gomatrixserverlib.Event{
+						create.EventID(): create,
+						join.EventID():   join,
+					},
+					eventAuth: tc.eventAuth,
+				},
+			}
+			auth := gomatrixserverlib.NewAuthEvents(nil)
+			known := map[string]*types.Event{}
+			err := r.fetchAuthEvents(
+				context.Background(), logrus.WithField("test", t.Name()),
+				event.Headered(gomatrixserverlib.RoomVersionV6), &auth, known,
+				[]gomatrixserverlib.ServerName{"remote"},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{create.EventID(), join.EventID()}
+			if !reflect.DeepEqual(db.stored, want) {
+				t.Fatalf("stored %v, want %v", db.stored, want)
+			}
+			if known[join.EventID()] == nil {
+				t.Fatal("expected auth event to be known")
+			}
+			for _, eventID := range want {
+				if db.suppliedBy[eventID] != "remote" {
+					t.Fatalf("expected %s to be recorded as supplied by remote, got %q", eventID, db.suppliedBy[eventID])
+				}
+			}
+		})
+	}
+}
+
+func TestFetchAuthEventsFailsWhenEventsUnavailable(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	event := mustBuildSignedEvent(t, private, 2, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{create.EventID()})
+
+	r := &Inputer{
+		DB: &fakeAuthFallbackDB{events: map[string]types.Event{}},
+		FSAPI: &fakeAuthFallbackFSAPI{
+			keyRing: &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+			events:  map[string]*gomatrixserverlib.Event{},
+		},
+	}
+	auth := gomatrixserverlib.NewAuthEvents(nil)
+	err = r.fetchAuthEvents(
+		context.Background(), logrus.WithField("test", t.Name()),
+		event.Headered(gomatrixserverlib.RoomVersionV6), &auth, map[string]*types.Event{},
+		[]gomatrixserverlib.ServerName{"remote"},
+	)
+	if err == nil {
+		t.Fatal("expected an error when no server provides the auth events")
+	}
+	var unavailable *authEventsUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Fatalf("expected an authEventsUnavailableError, got %s", err)
+	}
+}
+
+// cancellingAuthDB cancels the context once the given number of events
+// have been stored, and refuses to store anything after that, like a real
+// database would, rolling back the rest of the batch of events that they
+// were being stored in. It remembers the auth event NIDs of each stored event.
+type cancellingAuthDB struct {
+	fakeAuthFallbackDB
+	cancel        context.CancelFunc
+	cancelAfter   int
+	authEventNIDs map[types.EventNID][]types.EventNID
+}
+
+func (d *cancellingAuthDB) StoreEvent(
+	ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID, isRejected, rejectedByAuth bool, rejectionReason string,
+) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, types.StateAtEvent{}, nil, "", err
+	}
+	nid, roomNID, stateAtEvent, redacted, redactedID, err := d.fakeAuthFallbackDB.StoreEvent(ctx, event, authEventNIDs, isRejected, rejectedByAuth, rejectionReason)
+	d.authEventNIDs[nid] = authEventNIDs
+	if len(d.stored) == d.cancelAfter {
+		d.cancel()
+	}
+	return nid, roomNID, stateAtEvent, redacted, redactedID, err
+}
+
+func (d *cancellingAuthDB) StoreEvents(
+	ctx context.Context, events []types.EventToStore, knownNIDs map[string]types.EventNID,
+) ([]types.EventNID, error) {
+	before := make(map[string]types.Event, len(d.events))
+	for eventID, ev := range d.events {
+		before[eventID] = ev
+	}
+	stored := len(d.stored)
+	eventNIDs, err := storeEventsOneByOne(ctx, d.StoreEvent, events, knownNIDs)
+	if err != nil {
+		d.events, d.stored = before, d.stored[:stored]
+		return nil, err
+	}
+	return eventNIDs, nil
+}
+
+func TestFetchAuthEventsCancelledMidChain(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	join := mustBuildSignedEvent(t, private, 2, gomatrixserverlib.MRoomMember, "@alice:remote", map[string]interface{}{
+		"membership": "join",
+	}, []string{create.EventID()})
+	powerLevels := mustBuildSignedEvent(t, private, 3, gomatrixserverlib.MRoomPowerLevels, "", map[string]interface{}{
+		"users": map[string]int{"@alice:remote": 100},
+	}, []string{create.EventID(), join.EventID()})
+	event := mustBuildSignedEvent(t, private, 4, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{create.EventID(), join.EventID(), powerLevels.EventID()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := &cancellingAuthDB{
+		fakeAuthFallbackDB: fakeAuthFallbackDB{events: map[string]types.Event{}},
+		cancel:             cancel,
+		cancelAfter:        1,
+		authEventNIDs:      map[types.EventNID][]types.EventNID{},
+	}
+	r := &Inputer{
+		DB: db,
+		FSAPI: &fakeAuthFallbackFSAPI{
+			keyRing:   &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+			eventAuth: []*gomatrixserverlib.Event{powerLevels, join, create},
+		},
+	}
+	fetch := func(ctx context.Context) error {
+		auth := gomatrixserverlib.NewAuthEvents(nil)
+		return r.fetchAuthEvents(
+			ctx, logrus.WithField("test", t.Name()),
+			event.Headered(gomatrixserverlib.RoomVersionV6), &auth, map[string]*types.Event{},
+			[]gomatrixserverlib.ServerName{"remote"},
+		)
+	}
+
+	if err = fetch(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the fetch to be cancelled, got %v", err)
+	}
+	// The auth events are stored in a single transaction, so nothing
+	// should have been stored.
+	if len(db.stored) != 0 {
+		t.Fatalf("stored %v, want nothing", db.stored)
+	}
+
+	// Fetching again afterwards stores the whole auth chain.
+	if err = fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{create.EventID(), join.EventID(), powerLevels.EventID()}; !reflect.DeepEqual(db.stored, want) {
+		t.Fatalf("stored %v, want %v", db.stored, want)
+	}
+
+	// Every stored auth event refers only to auth events which were stored
+	// before it, and refers to all of them.
+	for _, eventID := range db.stored {
+		stored := db.events[eventID]
+		nids := db.authEventNIDs[stored.EventNID]
+		if len(nids) != len(stored.AuthEventIDs()) {
+			t.Fatalf("event %s has %d auth event NIDs, want %d", eventID, len(nids), len(stored.AuthEventIDs()))
+		}
+		for i, authEventID := range stored.AuthEventIDs() {
+			authEvent, ok := db.events[authEventID]
+			if !ok || authEvent.EventNID != nids[i] || authEvent.EventNID >= stored.EventNID {
+				t.Fatalf("event %s has a dangling auth event NID %d for %s", eventID, nids[i], authEventID)
+			}
+		}
+	}
+}
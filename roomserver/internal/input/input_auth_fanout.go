@@ -0,0 +1,96 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// eventAuthFetchConcurrency is how many servers we'll ask for the auth chain
+// of an event at the same time.
+const eventAuthFetchConcurrency = 3
+
+// getEventAuthFromServers asks the servers for the auth chain of the event,
+// up to eventAuthFetchConcurrency at a time, and returns the first auth chain
+// that any of them gives us. The remaining requests are cancelled. Servers
+// which recently answered are asked first, and new requests are spaced out
+// and limited by the backoff once servers start failing. Returns the server
+// which gave us the auth chain, or false if none of the servers did.
+func (r *Inputer) getEventAuthFromServers(
+	ctx context.Context,
+	logger *logrus.Entry,
+	event *gomatrixserverlib.HeaderedEvent,
+	servers []gomatrixserverlib.ServerName,
+	backoff *federationBackoff,
+) (gomatrixserverlib.RespEventAuth, gomatrixserverlib.ServerName, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		serverName gomatrixserverlib.ServerName
+		res        gomatrixserverlib.RespEventAuth
+		err        error
+	}
+	// Buffered so that requests which are still running when we return
+	// don't block forever.
+	results := make(chan result, len(servers))
+	ordered := r.orderServers(event.RoomID(), servers)
+	next, inFlight := 0, 0
+	start := func() {
+		serverName := ordered[next]
+		next++
+		inFlight++
+		go func() {
+			// Request the entire auth chain for the event in question. This
+			// should contain all of the auth events — including ones that we
+			// already know — so the caller will need to filter through them.
+			// Each server only gets a share of the remaining time, so that
+			// a slow server can't stop us from asking the others.
+			reqctx, reqcancel := withFederationRequestTimeout(ctx)
+			defer reqcancel()
+			res, err := r.FSAPI.GetEventAuth(reqctx, serverName, event.RoomVersion, event.RoomID(), event.EventID())
+			results <- result{serverName, res, err}
+		}()
+	}
+	for next < len(ordered) && inFlight < eventAuthFetchConcurrency {
+		if backoff.wait(ctx) != nil {
+			break
+		}
+		start()
+	}
+	for inFlight > 0 {
+		result := <-results
+		inFlight--
+		if result.err == nil {
+			backoff.succeeded()
+			r.markServer(event.RoomID(), result.serverName, true)
+			return result.res, result.serverName, true
+		}
+		logger.WithError(result.err).Warnf("Failed to get event auth from federation for %q: %s", event.EventID(), result.err)
+		authEventsFederationFailures.With(prometheus.Labels{
+			"server": string(result.serverName),
+		}).Inc()
+		r.markServer(event.RoomID(), result.serverName, false)
+		backoff.failed()
+		if next < len(ordered) && backoff.wait(ctx) == nil {
+			start()
+		}
+	}
+	return gomatrixserverlib.RespEventAuth{}, "", false
+}
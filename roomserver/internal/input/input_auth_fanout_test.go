@@ -0,0 +1,171 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeFanoutFSAPI blocks /event_auth requests to the servers in block until
+// they are cancelled, and fails them to the servers in fail.
+type fakeFanoutFSAPI struct {
+	fedapi.FederationInternalAPI
+	block     map[gomatrixserverlib.ServerName]bool
+	fail      map[gomatrixserverlib.ServerName]bool
+	authChain []*gomatrixserverlib.Event
+	mu        sync.Mutex
+	asked     []gomatrixserverlib.ServerName
+	cancelled int
+}
+
+func (f *fakeFanoutFSAPI) GetEventAuth(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string,
+) (gomatrixserverlib.RespEventAuth, error) {
+	f.mu.Lock()
+	f.asked = append(f.asked, s)
+	f.mu.Unlock()
+	switch {
+	case f.block[s]:
+		<-ctx.Done()
+		f.mu.Lock()
+		f.cancelled++
+		f.mu.Unlock()
+		return gomatrixserverlib.RespEventAuth{}, ctx.Err()
+	case f.fail[s]:
+		return gomatrixserverlib.RespEventAuth{}, errors.New("event auth not supported")
+	}
+	return gomatrixserverlib.RespEventAuth{AuthEvents: f.authChain}, nil
+}
+
+func TestGetEventAuthFromServersConcurrently(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{"creator": "@alice:remote"}, nil)
+	event := create.Headered(create.Version())
+
+	fsAPI := &fakeFanoutFSAPI{
+		block:     map[gomatrixserverlib.ServerName]bool{"a": true, "b": true},
+		authChain: []*gomatrixserverlib.Event{create},
+	}
+	r := &Inputer{Cfg: testServerReputationConfig(), FSAPI: fsAPI}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	done := make(chan struct{})
+	var res gomatrixserverlib.RespEventAuth
+	var serverName gomatrixserverlib.ServerName
+	var found bool
+	go func() {
+		defer close(done)
+		res, serverName, found = r.getEventAuthFromServers(context.Background(), logger, event, []gomatrixserverlib.ServerName{"a", "b", "c"}, r.newFederationBackoff())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event auth, servers weren't asked concurrently")
+	}
+	if !found || serverName != "c" {
+		t.Fatalf("expected to get the event auth from c, got %q", serverName)
+	}
+	if len(res.AuthEvents) != 1 || res.AuthEvents[0].EventID() != create.EventID() {
+		t.Fatalf("got the wrong auth chain: %v", res.AuthEvents)
+	}
+
+	// The blocked requests should be cancelled once we have an answer, and
+	// shouldn't count against the servers.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fsAPI.mu.Lock()
+		cancelled := fsAPI.cancelled
+		fsAPI.mu.Unlock()
+		if cancelled == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 requests to be cancelled, got %d", cancelled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for serverName, want := range map[gomatrixserverlib.ServerName]int{"a": 1, "b": 1, "c": 0} {
+		if got := r.serverReputation.rank(event.RoomID(), serverName, time.Minute, time.Now()); got != want {
+			t.Fatalf("server %q: got rank %d, want %d", serverName, got, want)
+		}
+	}
+}
+
+func TestGetEventAuthFromServersPrefersKnownGood(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{"creator": "@alice:remote"}, nil)
+	event := create.Headered(create.Version())
+	servers := []gomatrixserverlib.ServerName{"a", "b", "c", "d", "e"}
+
+	fsAPI := &fakeFanoutFSAPI{
+		fail:      map[gomatrixserverlib.ServerName]bool{"a": true, "b": true, "c": true, "d": true},
+		authChain: []*gomatrixserverlib.Event{create},
+	}
+	r := &Inputer{Cfg: testServerReputationConfig(), FSAPI: fsAPI}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	// Only the fifth server can answer, so it has to be asked after one of
+	// the first three fails.
+	if _, _, found := r.getEventAuthFromServers(context.Background(), logger, event, servers, r.newFederationBackoff()); !found {
+		t.Fatal("expected to get the event auth")
+	}
+	// Requests which were still running when the fifth server answered
+	// might not have been recorded, but at least one must have been for the
+	// fifth server to be asked at all.
+	var failed []gomatrixserverlib.ServerName
+	for _, serverName := range servers {
+		switch r.serverReputation.rank(event.RoomID(), serverName, time.Minute, time.Now()) {
+		case 0:
+			if serverName != "e" {
+				t.Fatalf("server %q shouldn't be recorded as answering", serverName)
+			}
+		case 2:
+			failed = append(failed, serverName)
+		}
+	}
+	if len(failed) == 0 {
+		t.Fatal("expected the failing servers to be recorded")
+	}
+
+	// Next time, the server which answered should be asked first and the
+	// servers which failed should be asked last.
+	ordered := r.orderServers(event.RoomID(), servers)
+	if ordered[0] != "e" || !reflect.DeepEqual(ordered[len(ordered)-len(failed):], failed) {
+		t.Fatalf("expected the known-good server first and the failing servers last, got %v", ordered)
+	}
+}
+
+func testServerReputationConfig() *config.RoomServer {
+	return &config.RoomServer{
+		ServerReputation: config.ServerReputationOptions{Size: 100, TTL: time.Minute},
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// missingEventsFSAPI counts the requests made to fill in missing prev events.
+// Calling any other FederationInternalAPI method will panic.
+type missingEventsFSAPI struct {
+	fedapi.FederationInternalAPI
+	serverQueries int
+	lookups       int
+}
+
+func (f *missingEventsFSAPI) QueryJoinedHostServerNamesInRoom(
+	ctx context.Context, req *fedapi.QueryJoinedHostServerNamesInRoomRequest, res *fedapi.QueryJoinedHostServerNamesInRoomResponse,
+) error {
+	f.serverQueries++
+	res.ServerNames = []gomatrixserverlib.ServerName{"remote"}
+	return nil
+}
+
+func (f *missingEventsFSAPI) LookupMissingEvents(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespMissingEvents, error) {
+	f.lookups++
+	return gomatrixserverlib.RespMissingEvents{}, nil
+}
+
+func TestProcessBackfilledEvent(t *testing.T) {
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "",
+		"content": map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$join:localhost", "type": gomatrixserverlib.MRoomMember, "state_key": "@test:localhost",
+		"content": map[string]interface{}{"membership": "join"}, "auth_events": eventRefs("$create:localhost"),
+		"prev_events": eventRefs("$create:localhost"),
+	})
+	db := &resultsDB{
+		fakeAuthFallbackDB: fakeAuthFallbackDB{events: map[string]types.Event{
+			create.EventID(): {EventNID: 1, Event: create},
+			join.EventID():   {EventNID: 2, Event: join},
+		}},
+		sent: map[string]bool{},
+	}
+	fsAPI := &missingEventsFSAPI{}
+	js := &fakeJetStream{}
+	r := &Inputer{
+		DB:         db,
+		Queryer:    &query.Queryer{DB: db},
+		FSAPI:      fsAPI,
+		JetStream:  js,
+		ServerName: "localhost",
+	}
+
+	// The backfilled event refers to a prev event that we don't have, as
+	// there is always more history beyond what has been backfilled so far.
+	input := &api.InputRoomEvent{
+		Kind:   api.KindBackfill,
+		Origin: "remote",
+		Event: mustCreateEvent(t, map[string]interface{}{
+			"event_id":    "$backfilled:localhost",
+			"auth_events": eventRefs("$create:localhost", "$join:localhost"),
+			"prev_events": eventRefs("$join:localhost", "$older:localhost"),
+			"depth":       3,
+		}).Headered(gomatrixserverlib.RoomVersionV1),
+	}
+	result, err := r.processRoomEvent(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rejected || result.SoftFailed {
+		t.Fatalf("expected the backfilled event to be accepted, got %+v", result)
+	}
+	if fsAPI.lookups != 0 {
+		t.Fatalf("expected no missing events to be fetched, got %d lookups", fsAPI.lookups)
+	}
+	if len(js.published) != 1 {
+		t.Fatalf("got %d published messages, want 1", len(js.published))
+	}
+	var output api.OutputEvent
+	if err = json.Unmarshal(js.published[0].Data, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Type != api.OutputTypeBackfilledRoomEvent || output.BackfilledRoomEvent == nil {
+		t.Fatalf("got output type %q, want %q", output.Type, api.OutputTypeBackfilledRoomEvent)
+	}
+	if output.EventID() != "$backfilled:localhost" {
+		t.Fatalf("got output for event %q, want %q", output.EventID(), "$backfilled:localhost")
+	}
+}
+
+func TestProcessEventWithStateDoesNotLookForServers(t *testing.T) {
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "",
+		"content": map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$join:localhost", "type": gomatrixserverlib.MRoomMember, "state_key": "@test:localhost",
+		"content": map[string]interface{}{"membership": "join"}, "auth_events": eventRefs("$create:localhost"),
+		"prev_events": eventRefs("$create:localhost"),
+	})
+	db := &resultsDB{
+		fakeAuthFallbackDB: fakeAuthFallbackDB{events: map[string]types.Event{
+			create.EventID(): {EventNID: 1, Event: create},
+			join.EventID():   {EventNID: 2, Event: join},
+		}},
+		sent: map[string]bool{},
+	}
+	fsAPI := &missingEventsFSAPI{}
+	r := &Inputer{
+		DB:         db,
+		Queryer:    &query.Queryer{DB: db},
+		FSAPI:      fsAPI,
+		JetStream:  &fakeJetStream{},
+		ServerName: "localhost",
+	}
+
+	// The event's prev event is missing, but as we've been told the state
+	// before the event, the prev event won't be fetched.
+	input := &api.InputRoomEvent{
+		Kind:          api.KindOld,
+		HasState:      true,
+		StateEventIDs: []string{"$create:localhost", "$join:localhost"},
+		Event: mustCreateEvent(t, map[string]interface{}{
+			"event_id":    "$withstate:localhost",
+			"auth_events": eventRefs("$create:localhost", "$join:localhost"),
+			"prev_events": eventRefs("$elsewhere:localhost"),
+			"depth":       3,
+		}).Headered(gomatrixserverlib.RoomVersionV1),
+	}
+	if _, err := r.processRoomEvent(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+	if fsAPI.serverQueries != 0 {
+		t.Fatalf("expected no joined servers query, got %d", fsAPI.serverQueries)
+	}
+
+	// Without the state, the servers are needed to fetch the prev event.
+	input.HasState, input.StateEventIDs = false, nil
+	input.Event = mustCreateEvent(t, map[string]interface{}{
+		"event_id":    "$withoutstate:localhost",
+		"auth_events": eventRefs("$create:localhost", "$join:localhost"),
+		"prev_events": eventRefs("$elsewhere:localhost"),
+		"depth":       3,
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	if _, err := r.processRoomEvent(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+	if fsAPI.serverQueries != 1 {
+		t.Fatalf("got %d joined servers queries, want 1", fsAPI.serverQueries)
+	}
+}
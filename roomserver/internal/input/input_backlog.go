@@ -0,0 +1,97 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(roomserverInputQueueLength, roomserverInputQueueOldestAge)
+}
+
+var roomserverInputQueueLength = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_queue_length",
+		Help:      "How many input events are queued and waiting to be processed, across all rooms",
+	},
+)
+
+var roomserverInputQueueOldestAge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_queue_oldest_age_seconds",
+		Help:      "How long the oldest queued input event has been waiting to be processed, or zero if none are waiting",
+	},
+	func() float64 {
+		return queuedInput.oldestAge(time.Now()).Seconds()
+	},
+)
+
+// queuedInput tracks the input events which are waiting on room workers to
+// be processed. Since the events for each room are processed one at a time,
+// a backlog can build up without anything else noticing.
+var queuedInput inputBacklog
+
+// inputBacklog is a list of the times at which queued input events were
+// queued, oldest first.
+type inputBacklog struct {
+	mu     sync.Mutex
+	queued list.List
+}
+
+func (b *inputBacklog) add(now time.Time) *list.Element {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.queued.PushBack(now)
+	roomserverInputQueueLength.Set(float64(b.queued.Len()))
+	return e
+}
+
+func (b *inputBacklog) remove(e *list.Element) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queued.Remove(e)
+	roomserverInputQueueLength.Set(float64(b.queued.Len()))
+}
+
+func (b *inputBacklog) oldestAge(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	oldest := b.queued.Front()
+	if oldest == nil {
+		return 0
+	}
+	return now.Sub(oldest.Value.(time.Time))
+}
+
+// queueInput queues the processing of an input event onto the worker for
+// the room, keeping track of the backlog of events waiting to be processed.
+func (r *Inputer) queueInput(roomID string, process func()) {
+	roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Inc()
+	queued := queuedInput.add(time.Now())
+	r.workerForRoom(roomID).Act(nil, func() {
+		queuedInput.remove(queued)
+		defer roomserverInputBackpressure.With(prometheus.Labels{"room_id": roomID}).Dec()
+		process()
+	})
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInputQueueMetricsReflectBacklog(t *testing.T) {
+	r := &Inputer{}
+	roomID := "!backlog:localhost"
+	before := testutil.ToFloat64(roomserverInputQueueLength)
+
+	// Block the room's worker so that everything queued after this waits.
+	started, unblock := make(chan struct{}), make(chan struct{})
+	r.queueInput(roomID, func() {
+		close(started)
+		<-unblock
+	})
+	<-started
+
+	var processed sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		processed.Add(1)
+		r.queueInput(roomID, processed.Done)
+	}
+	if got := testutil.ToFloat64(roomserverInputQueueLength); got != before+3 {
+		t.Fatalf("expected queue length %v, got %v", before+3, got)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if age := testutil.ToFloat64(roomserverInputQueueOldestAge); age < 0.01 {
+		t.Fatalf("expected the oldest queued event to be at least 10ms old, got %vs", age)
+	}
+
+	close(unblock)
+	processed.Wait()
+	if got := testutil.ToFloat64(roomserverInputQueueLength); got != before {
+		t.Fatalf("expected queue length %v once the backlog was processed, got %v", before, got)
+	}
+	if age := testutil.ToFloat64(roomserverInputQueueOldestAge); before == 0 && age != 0 {
+		t.Fatalf("expected no age once the backlog was processed, got %vs", age)
+	}
+}
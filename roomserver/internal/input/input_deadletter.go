@@ -0,0 +1,143 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Input events which fail to be processed because of an error, e.g. the
+// database was unavailable or the federation timed out, would otherwise be
+// dropped with nothing but a log line to show for it. Instead, they are kept
+// in the dead-letter table along with the error, so that they can be looked
+// at and re-submitted once the problem has been fixed. Events which are
+// rejected are stored as rejected events as normal, and events which are
+// deferred will be retried anyway, so neither of those are dead-lettered.
+
+func init() {
+	prometheus.MustRegister(inputDeadLetters)
+}
+
+var inputDeadLetters = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_dead_letters_total",
+		Help:      "Number of input events which failed to be processed because of an error and were dead-lettered",
+	},
+)
+
+// shouldDeadLetter returns true if processRoomEvent failed with an error that
+// means the event was dropped, rather than rejected, deferred or cancelled.
+// Running out of time to process the event counts as dropping it: callers
+// deal with events which were abandoned by their own caller before getting
+// this far.
+func shouldDeadLetter(err error) bool {
+	switch {
+	case err == nil, isDeferredInput(err):
+		return false
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, errMalformedCreateEvent), errors.Is(err, errTooManyKnownAuthEvents), errors.Is(err, errAuthChainTooLong):
+		// These are refusals of bad input rather than processing failures.
+		return false
+	}
+	var rejected *rejectedEventError
+	return !errors.As(err, &rejected)
+}
+
+// deadLetterInput records an input event which failed to be processed. This
+// deliberately doesn't use the caller's context, since the caller may have
+// given up by now. Failures are logged rather than returned, since there's
+// nowhere left to report them to.
+func (r *Inputer) deadLetterInput(input *api.InputRoomEvent, processErr error) {
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":  input.Event.RoomID(),
+		"event_id": input.Event.EventID(),
+	})
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal input event for the dead-letter table")
+		return
+	}
+	if err = r.DB.AddInputDeadLetter(context.Background(), &types.InputDeadLetter{
+		EventID:   input.Event.EventID(),
+		RoomID:    input.Event.RoomID(),
+		InputJSON: inputJSON,
+		Error:     processErr.Error(),
+		FailedAt:  gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		logger.WithError(err).Error("Failed to dead-letter input event")
+		return
+	}
+	inputDeadLetters.Inc()
+	logger.WithError(processErr).Warn("Dead-lettered input event which failed to be processed")
+}
+
+// ResubmitInputDeadLetters processes dead-lettered input events again, one
+// at a time, waiting for each to be processed. Events which are processed
+// successfully are removed from the dead-letter table, and events which fail
+// again stay there with their new error. Returns the event IDs which were
+// processed successfully, along with why each of the others failed.
+func (r *Inputer) ResubmitInputDeadLetters(
+	ctx context.Context, eventIDs []string,
+) ([]string, map[string]error, error) {
+	var resubmitted []string
+	failed := map[string]error{}
+	for _, eventID := range eventIDs {
+		deadLetter, err := r.DB.GetInputDeadLetter(ctx, eventID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("r.DB.GetInputDeadLetter: %w", err)
+		}
+		if deadLetter == nil {
+			failed[eventID] = fmt.Errorf("no dead letter for event %s", eventID)
+			continue
+		}
+		var input api.InputRoomEvent
+		if err = json.Unmarshal(deadLetter.InputJSON, &input); err != nil {
+			failed[eventID] = fmt.Errorf("json.Unmarshal: %w", err)
+			continue
+		}
+		res := &api.InputRoomEventsResponse{}
+		r.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+			InputRoomEvents: []api.InputRoomEvent{input},
+		}, res)
+		if res.ErrMsg != "" {
+			failed[eventID] = errors.New(res.ErrMsg)
+			continue
+		}
+		// No error doesn't mean that the event was processed, since it
+		// isn't queued again if it's already being processed.
+		if len(res.Results) != 1 || !res.Results[0].Stored {
+			failed[eventID] = fmt.Errorf("event %s was not processed", eventID)
+			continue
+		}
+		if err = r.DB.RemoveInputDeadLetter(ctx, eventID); err != nil {
+			return nil, nil, fmt.Errorf("r.DB.RemoveInputDeadLetter: %w", err)
+		}
+		resubmitted = append(resubmitted, eventID)
+	}
+	return resubmitted, failed, nil
+}
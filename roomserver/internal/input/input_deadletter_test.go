@@ -0,0 +1,157 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// failingStoreDB fails to store any events, and keeps the dead-letter table
+// in memory. Calling any other storage.Database method will panic.
+type failingStoreDB struct {
+	storage.Database
+	mu          sync.Mutex
+	deadLetters map[string]types.InputDeadLetter
+}
+
+func (d *failingStoreDB) StoreEvent(
+	ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID, isRejected, rejectedByAuth bool, rejectionReason string,
+) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	return 0, 0, types.StateAtEvent{}, nil, "", fmt.Errorf("database is unavailable")
+}
+
+func (d *failingStoreDB) AddInputDeadLetter(ctx context.Context, deadLetter *types.InputDeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadLetters[deadLetter.EventID] = *deadLetter
+	return nil
+}
+
+func (d *failingStoreDB) RemoveInputDeadLetter(ctx context.Context, eventID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.deadLetters, eventID)
+	return nil
+}
+
+func (d *failingStoreDB) GetInputDeadLetter(ctx context.Context, eventID string) (*types.InputDeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deadLetter, ok := d.deadLetters[eventID]
+	if !ok {
+		return nil, nil
+	}
+	return &deadLetter, nil
+}
+
+func TestInputDeadLetters(t *testing.T) {
+	db := &failingStoreDB{deadLetters: map[string]types.InputDeadLetter{}}
+	r := &Inputer{DB: db}
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id":  "$create:localhost",
+		"type":      gomatrixserverlib.MRoomCreate,
+		"state_key": "",
+		"content":   map[string]interface{}{"creator": "@test:localhost"},
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+
+	// Failing to store the event is a processing error, so the event should
+	// be dead-lettered along with the error.
+	res := &api.InputRoomEventsResponse{}
+	r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{Kind: api.KindOld, Event: create}},
+	}, res)
+	if res.ErrMsg == "" {
+		t.Fatalf("expected processing the event to fail")
+	}
+	deadLetter, ok := db.deadLetters[create.EventID()]
+	if !ok {
+		t.Fatalf("expected the event to be dead-lettered")
+	}
+	if deadLetter.RoomID != create.RoomID() || !strings.Contains(deadLetter.Error, "database is unavailable") || deadLetter.FailedAt == 0 {
+		t.Fatalf("dead letter has the wrong details: %+v", deadLetter)
+	}
+	var input api.InputRoomEvent
+	if err := json.Unmarshal(deadLetter.InputJSON, &input); err != nil {
+		t.Fatal(err)
+	}
+	if input.Event.EventID() != create.EventID() || input.Kind != api.KindOld {
+		t.Fatalf("dead-lettered the wrong input event: %s (kind %d)", input.Event.EventID(), input.Kind)
+	}
+
+	// Re-submitting the event while the database is still failing leaves it
+	// in the dead-letter table.
+	resubmitted, failed, err := r.ResubmitInputDeadLetters(context.Background(), []string{create.EventID(), "$unknown:localhost"})
+	if err != nil {
+		t.Fatalf("ResubmitInputDeadLetters: %s", err)
+	}
+	if len(resubmitted) != 0 || len(failed) != 2 {
+		t.Fatalf("expected both events to fail, got resubmitted %v, failed %v", resubmitted, failed)
+	}
+	if _, ok = db.deadLetters[create.EventID()]; !ok || len(db.deadLetters) != 1 {
+		t.Fatalf("expected the event to still be dead-lettered, got %v", db.deadLetters)
+	}
+
+	// Nor does re-submitting the event while it's already being processed,
+	// since the event isn't processed again.
+	inProgressKey := create.RoomID() + "\000" + create.EventID()
+	eventsInProgress.Store(inProgressKey, struct{}{})
+	resubmitted, failed, err = r.ResubmitInputDeadLetters(context.Background(), []string{create.EventID()})
+	eventsInProgress.Delete(inProgressKey)
+	if err != nil {
+		t.Fatalf("ResubmitInputDeadLetters: %s", err)
+	}
+	if len(resubmitted) != 0 || len(failed) != 1 {
+		t.Fatalf("expected the event to fail, got resubmitted %v, failed %v", resubmitted, failed)
+	}
+	if _, ok = db.deadLetters[create.EventID()]; !ok {
+		t.Fatalf("expected the event to still be dead-lettered")
+	}
+
+	// Malformed events are refused rather than failing to be processed, so
+	// they aren't dead-lettered.
+	malformed := mustCreateEvent(t, map[string]interface{}{
+		"event_id":  "$malformed:localhost",
+		"type":      gomatrixserverlib.MRoomCreate,
+		"state_key": "@test:localhost",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{Kind: api.KindNew, Event: malformed}},
+	}, &api.InputRoomEventsResponse{})
+	if _, ok = db.deadLetters[malformed.EventID()]; ok {
+		t.Fatalf("expected the malformed event not to be dead-lettered")
+	}
+	// Nor are events which were processed and stored as rejected.
+	if shouldDeadLetter(&rejectedEventError{err: fmt.Errorf("event not allowed")}) {
+		t.Fatalf("expected rejected events not to be dead-lettered")
+	}
+	// Events which ran out of time to be processed were dropped, but ones
+	// which were cancelled weren't.
+	if !shouldDeadLetter(fmt.Errorf("r.fetchAuthEvents: %w", context.DeadlineExceeded)) {
+		t.Fatalf("expected events which timed out to be dead-lettered")
+	}
+	if shouldDeadLetter(fmt.Errorf("r.fetchAuthEvents: %w", context.Canceled)) {
+		t.Fatalf("expected cancelled events not to be dead-lettered")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(decisionLogDropped)
+}
+
+var decisionLogDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "decision_log_dropped_total",
+		Help:      "Number of decisions which weren't written to the decision log because it couldn't keep up",
+	},
+)
+
+// The decisions that can be made about a processed event.
+const (
+	decisionAccepted    = "accepted"
+	decisionRejected    = "rejected"
+	decisionSoftFailed  = "soft_failed"
+	decisionQuarantined = "quarantined"
+)
+
+var decisionLogKinds = map[api.Kind]string{
+	api.KindOutlier:  "outlier",
+	api.KindNew:      "new",
+	api.KindOld:      "old",
+	api.KindBackfill: "backfill",
+}
+
+// decisionLogEntry is a single line of the decision log.
+type decisionLogEntry struct {
+	Timestamp        gomatrixserverlib.Timestamp `json:"ts"`
+	EventID          string                      `json:"event_id"`
+	RoomID           string                      `json:"room_id"`
+	Kind             string                      `json:"kind"`
+	Origin           string                      `json:"origin,omitempty"`
+	Decision         string                      `json:"decision"`
+	Reason           string                      `json:"reason,omitempty"`
+	StateSnapshotNID types.StateSnapshotNID      `json:"state_snapshot_nid,omitempty"`
+	DurationMs       float64                     `json:"duration_ms"`
+}
+
+// decisionLog writes decisions to a sink in the background, so that event
+// processing never waits for the sink. Decisions are dropped if the buffer
+// is full.
+type decisionLog struct {
+	entries chan decisionLogEntry
+	done    chan struct{}
+}
+
+func newDecisionLog(w io.Writer, bufferSize int) *decisionLog {
+	l := &decisionLog{
+		entries: make(chan decisionLogEntry, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go l.write(w)
+	return l
+}
+
+func (l *decisionLog) write(w io.Writer) {
+	defer close(l.done)
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	for entry := range l.entries {
+		if err := encoder.Encode(entry); err != nil {
+			logrus.WithError(err).Error("Failed to write to the decision log")
+		}
+		// Only flush once we've caught up, so that bursts of decisions are
+		// written together.
+		if len(l.entries) == 0 {
+			if err := buffered.Flush(); err != nil {
+				logrus.WithError(err).Error("Failed to flush the decision log")
+			}
+		}
+	}
+	_ = buffered.Flush()
+}
+
+func (l *decisionLog) add(entry decisionLogEntry) {
+	select {
+	case l.entries <- entry:
+	default:
+		decisionLogDropped.Inc()
+	}
+}
+
+// close stops accepting decisions and waits for the waiting ones to be written.
+func (l *decisionLog) close() {
+	close(l.entries)
+	<-l.done
+}
+
+// startDecisionLog opens the decision log file if one is configured.
+func (r *Inputer) startDecisionLog() error {
+	if r.Cfg == nil || r.Cfg.DecisionLog.Path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(string(r.Cfg.DecisionLog.Path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %w", err)
+	}
+	r.decisions = newDecisionLog(f, r.Cfg.DecisionLog.BufferSize)
+	return nil
+}
+
+// logDecision records the decision made about an event in the decision log,
+// if there is one. Soft-fail and quarantine only apply to new events.
+func (r *Inputer) logDecision(
+	input *api.InputRoomEvent, isRejected, softfail, quarantined bool,
+	rejectionErr error, softfailReason string,
+	snapshotNID types.StateSnapshotNID, started time.Time,
+) {
+	if r.decisions == nil {
+		return
+	}
+	entry := decisionLogEntry{
+		Timestamp:        gomatrixserverlib.AsTimestamp(time.Now()),
+		EventID:          input.Event.EventID(),
+		RoomID:           input.Event.RoomID(),
+		Kind:             decisionLogKinds[input.Kind],
+		Origin:           string(input.Origin),
+		Decision:         decisionAccepted,
+		StateSnapshotNID: snapshotNID,
+		DurationMs:       float64(time.Since(started).Microseconds()) / 1000,
+	}
+	switch {
+	case isRejected:
+		entry.Decision = decisionRejected
+		if rejectionErr != nil {
+			entry.Reason = rejectionErr.Error()
+		}
+	case quarantined:
+		entry.Decision = decisionQuarantined
+		entry.Reason = softfailReason
+	case softfail:
+		entry.Decision = decisionSoftFailed
+		entry.Reason = softfailReason
+	}
+	r.decisions.add(entry)
+}
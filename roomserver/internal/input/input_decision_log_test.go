@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestDecisionLog(t *testing.T) {
+	var buf bytes.Buffer
+	r := &Inputer{decisions: newDecisionLog(&buf, 10)}
+	event := mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)
+	newEvent := &api.InputRoomEvent{Kind: api.KindNew, Event: event, Origin: "remote"}
+	outlier := &api.InputRoomEvent{Kind: api.KindOutlier, Event: event}
+	started := time.Now()
+
+	r.logDecision(newEvent, false, false, false, nil, "", 5, started)
+	r.logDecision(newEvent, true, false, false, errors.New("not allowed"), "", 6, started)
+	r.logDecision(newEvent, false, true, false, nil, "event fails auth against the current room state", 7, started)
+	r.logDecision(newEvent, false, true, true, nil, "looks like spam", 8, started)
+	r.logDecision(outlier, false, false, false, nil, "", 0, started)
+	r.decisions.close()
+
+	want := []decisionLogEntry{
+		{Kind: "new", Origin: "remote", Decision: decisionAccepted, StateSnapshotNID: 5},
+		{Kind: "new", Origin: "remote", Decision: decisionRejected, Reason: "not allowed", StateSnapshotNID: 6},
+		{Kind: "new", Origin: "remote", Decision: decisionSoftFailed, Reason: "event fails auth against the current room state", StateSnapshotNID: 7},
+		{Kind: "new", Origin: "remote", Decision: decisionQuarantined, Reason: "looks like spam", StateSnapshotNID: 8},
+		{Kind: "outlier", Decision: decisionAccepted},
+	}
+	scanner := bufio.NewScanner(&buf)
+	var got []decisionLogEntry
+	for scanner.Scan() {
+		var entry decisionLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("failed to parse %q: %s", scanner.Text(), err)
+		}
+		got = append(got, entry)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i, entry := range got {
+		if entry.EventID != event.EventID() || entry.RoomID != event.RoomID() || entry.Timestamp == 0 || entry.DurationMs < 0 {
+			t.Errorf("entry %d: unexpected event details %+v", i, entry)
+		}
+		want[i].EventID, want[i].RoomID = entry.EventID, entry.RoomID
+		want[i].Timestamp, want[i].DurationMs = entry.Timestamp, entry.DurationMs
+		if entry != want[i] {
+			t.Errorf("entry %d: got %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestDecisionLogDisabled(t *testing.T) {
+	r := &Inputer{}
+	event := mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)
+	// This must not panic when there's no decision log.
+	r.logDecision(&api.InputRoomEvent{Kind: api.KindNew, Event: event}, false, false, false, nil, "", 0, time.Now())
+	if err := r.startDecisionLog(); err != nil || r.decisions != nil {
+		t.Fatalf("expected no decision log, got %v, %v", r.decisions, err)
+	}
+}
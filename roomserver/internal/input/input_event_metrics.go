@@ -0,0 +1,155 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// roomLabelNames returns the names of the labels that event metrics are
+// labelled by room with, according to the configuration.
+func roomLabelNames(opts config.EventMetricsOptions) []string {
+	switch opts.RoomLabel {
+	case config.EventMetricsRoomLabelRoomVersion:
+		return []string{"room_version"}
+	case config.EventMetricsRoomLabelRoomHash:
+		return []string{"room_hash"}
+	case config.EventMetricsRoomLabelNone:
+		return nil
+	default:
+		return []string{"room_id"}
+	}
+}
+
+// roomLabels returns the labels to observe an event in the room with.
+func roomLabels(opts config.EventMetricsOptions, roomID string, roomVersion gomatrixserverlib.RoomVersion) prometheus.Labels {
+	switch opts.RoomLabel {
+	case config.EventMetricsRoomLabelRoomVersion:
+		return prometheus.Labels{"room_version": string(roomVersion)}
+	case config.EventMetricsRoomLabelRoomHash:
+		buckets := opts.RoomHashBuckets
+		if buckets <= 0 {
+			buckets = 1
+		}
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(roomID))
+		return prometheus.Labels{"room_hash": strconv.Itoa(int(h.Sum32() % uint32(buckets)))}
+	case config.EventMetricsRoomLabelNone:
+		return prometheus.Labels{}
+	default:
+		return prometheus.Labels{"room_id": roomID}
+	}
+}
+
+// registerEventMetric registers a metric which is labelled by room, returning
+// the metric which was registered already if another Inputer in this process
+// registered it first.
+func registerEventMetric(c prometheus.Collector) (prometheus.Collector, error) {
+	if err := prometheus.Register(c); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, fmt.Errorf("prometheus.Register: %w", err)
+		}
+		return existing.ExistingCollector, nil
+	}
+	return c, nil
+}
+
+// roomEventDuration is a histogram of how long it takes to process events,
+// labelled by room in the configured way.
+type roomEventDuration struct {
+	opts      config.EventMetricsOptions
+	histogram *prometheus.HistogramVec
+}
+
+func newRoomEventDuration(opts config.EventMetricsOptions) *roomEventDuration {
+	return &roomEventDuration{
+		opts: opts,
+		histogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "dendrite",
+				Subsystem: "roomserver",
+				Name:      "processroomevent_duration_millis",
+				Help:      "How long it takes the roomserver to process an event",
+				Buckets: []float64{ // milliseconds
+					5, 10, 25, 50, 75, 100, 250, 500,
+					1000, 2000, 3000, 4000, 5000, 6000,
+					7000, 8000, 9000, 10000, 15000, 20000,
+				},
+			},
+			roomLabelNames(opts),
+		),
+	}
+}
+
+func (r *Inputer) eventMetricsOptions() config.EventMetricsOptions {
+	if r.Cfg == nil {
+		return config.EventMetricsOptions{}
+	}
+	return r.Cfg.EventMetrics
+}
+
+// startEventMetrics builds the metrics which are labelled by room and
+// registers them. Their labels depend on the configuration, so unlike the
+// other metrics they can't be registered in init().
+func (r *Inputer) startEventMetrics() error {
+	opts := r.eventMetricsOptions()
+	duration := newRoomEventDuration(opts)
+	collector, err := registerEventMetric(duration.histogram)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if duration.histogram, ok = collector.(*prometheus.HistogramVec); !ok {
+		return fmt.Errorf("processroomevent_duration_millis is already registered as a %T", collector)
+	}
+	stateRes := newStateResolutionMetrics(opts)
+	if collector, err = registerEventMetric(stateRes.duration); err != nil {
+		return err
+	}
+	if stateRes.duration, ok = collector.(*prometheus.HistogramVec); !ok {
+		return fmt.Errorf("state_resolution_duration_millis is already registered as a %T", collector)
+	}
+	if collector, err = registerEventMetric(stateRes.conflictingStateSets); err != nil {
+		return err
+	}
+	if stateRes.conflictingStateSets, ok = collector.(*prometheus.CounterVec); !ok {
+		return fmt.Errorf("state_resolution_conflicting_state_sets_total is already registered as a %T", collector)
+	}
+	r.eventDuration = duration
+	r.stateResMetrics = stateRes
+	return nil
+}
+
+// observeEventDuration records how long it took to process the event, if the
+// histogram has been registered.
+func (r *Inputer) observeEventDuration(event *gomatrixserverlib.HeaderedEvent, timetaken time.Duration) {
+	if r.eventDuration == nil {
+		return
+	}
+	r.eventDuration.observe(event, timetaken)
+}
+
+func (d *roomEventDuration) observe(event *gomatrixserverlib.HeaderedEvent, timetaken time.Duration) {
+	labels := roomLabels(d.opts, event.RoomID(), event.RoomVersion)
+	d.histogram.With(labels).Observe(float64(timetaken.Milliseconds()))
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRoomEventDurationLabels(t *testing.T) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 5; i++ {
+		event := mustCreateEvent(t, map[string]interface{}{
+			"event_id": fmt.Sprintf("$%d:localhost", i),
+			"room_id":  fmt.Sprintf("!%d:localhost", i),
+		})
+		events = append(events, event.Headered(gomatrixserverlib.RoomVersionV1))
+	}
+
+	for _, tc := range []struct {
+		roomLabel string
+		series    int
+	}{
+		{config.EventMetricsRoomLabelRoomID, 5},
+		{config.EventMetricsRoomLabelRoomVersion, 1},
+		{config.EventMetricsRoomLabelNone, 1},
+	} {
+		duration := newRoomEventDuration(config.EventMetricsOptions{RoomLabel: tc.roomLabel})
+		for _, event := range events {
+			duration.observe(event, time.Millisecond*20)
+		}
+		if got := testutil.CollectAndCount(duration.histogram); got != tc.series {
+			t.Errorf("labelling by %q: got %d series, want %d", tc.roomLabel, got, tc.series)
+		}
+	}
+}
+
+func TestStartEventMetricsRegistersConfiguredHistogram(t *testing.T) {
+	cfg := &config.RoomServer{EventMetrics: config.EventMetricsOptions{RoomLabel: config.EventMetricsRoomLabelNone}}
+	first, second := &Inputer{Cfg: cfg}, &Inputer{Cfg: cfg}
+	if err := first.startEventMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	// A second Inputer in the same process shares the registered histogram.
+	if err := second.startEventMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if first.eventDuration.histogram != second.eventDuration.histogram {
+		t.Fatal("expected the Inputers to share the histogram")
+	}
+	for i := 0; i < 5; i++ {
+		event := mustCreateEvent(t, map[string]interface{}{
+			"event_id": fmt.Sprintf("$%d:localhost", i),
+			"room_id":  fmt.Sprintf("!%d:localhost", i),
+		})
+		first.observeEventDuration(event.Headered(gomatrixserverlib.RoomVersionV1), time.Millisecond*20)
+		first.observeStateResolution(event.RoomID(), gomatrixserverlib.RoomVersionV1, time.Millisecond*20, 1)
+	}
+	if got := testutil.CollectAndCount(first.eventDuration.histogram); got != 1 {
+		t.Fatalf("got %d series, want 1", got)
+	}
+	if got := testutil.CollectAndCount(first.stateResMetrics.duration); got != 1 {
+		t.Fatalf("got %d state resolution series, want 1", got)
+	}
+}
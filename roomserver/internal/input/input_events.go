@@ -17,85 +17,190 @@
 package input
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
 	"time"
 
 	fedapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
-	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
-	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/roomserver/validator"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
 func init() {
-	prometheus.MustRegister(processRoomEventDuration)
+	prometheus.MustRegister(authEventsFromDB)
+	prometheus.MustRegister(authEventsFromFederation)
+	prometheus.MustRegister(authEventsFederationFailures)
 }
 
 // TODO: Does this value make sense?
 const MaximumProcessingTime = time.Minute * 2
 
-var processRoomEventDuration = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
+// processingTimeout returns how long we'll spend processing an input event.
+// This is the timeout that the caller asked for, as long as it is shorter
+// than MaximumProcessingTime.
+func processingTimeout(input *api.InputRoomEvent) time.Duration {
+	if input.ProcessingTimeout > 0 && input.ProcessingTimeout < MaximumProcessingTime {
+		return input.ProcessingTimeout
+	}
+	return MaximumProcessingTime
+}
+
+var authEventsFromDB = prometheus.NewCounter(
+	prometheus.CounterOpts{
 		Namespace: "dendrite",
 		Subsystem: "roomserver",
-		Name:      "processroomevent_duration_millis",
-		Help:      "How long it takes the roomserver to process an event",
-		Buckets: []float64{ // milliseconds
-			5, 10, 25, 50, 75, 100, 250, 500,
-			1000, 2000, 3000, 4000, 5000, 6000,
-			7000, 8000, 9000, 10000, 15000, 20000,
-		},
+		Name:      "auth_events_from_db_total",
+		Help:      "Number of auth events that were loaded from the database when processing events",
 	},
-	[]string{"room_id"},
 )
 
-// processRoomEvent can only be called once at a time
-//
-// TODO(#375): This should be rewritten to allow concurrent calls. The
-// difficulty is in ensuring that we correctly annotate events with the correct
-// state deltas when sending to kafka streams
-// TODO: Break up function - we should probably do transaction ID checks before calling this.
+var authEventsFromFederation = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "auth_events_from_federation_total",
+		Help:      "Number of auth events that were fetched over federation when processing events",
+	},
+)
+
+var authEventsFederationFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "auth_events_federation_failures_total",
+		Help:      "Number of failed requests to remote servers for the auth events of an event",
+	},
+	[]string{"server"},
+)
+
+// errMalformedCreateEvent is returned when an event has the type of a create
+// event but doesn't have an empty state key. The event hasn't been processed.
+var errMalformedCreateEvent = errors.New("create event must have an empty state key")
+
+// startEventSpan starts a span, as a child of any span in the context, which
+// is tagged with the room and event IDs of the event being processed.
+func startEventSpan(ctx context.Context, operationName string, event *gomatrixserverlib.Event) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName)
+	span.SetTag("room_id", event.RoomID())
+	span.SetTag("event_id", event.EventID())
+	return span, ctx
+}
+
+// rejectedEventError is returned when an event was stored as rejected. The
+// event has been processed, so this isn't a processing failure.
+type rejectedEventError struct {
+	err error
+}
+
+func (e *rejectedEventError) Error() string { return e.err.Error() }
+func (e *rejectedEventError) Unwrap() error { return e.err }
+
+// isRoomCreateEvent returns true if the event is a create event, or an error
+// if it has the type of a create event but isn't a valid one.
+func isRoomCreateEvent(event *gomatrixserverlib.Event) (bool, error) {
+	if event.Type() != gomatrixserverlib.MRoomCreate {
+		return false, nil
+	}
+	if !event.StateKeyEquals("") {
+		return false, fmt.Errorf("event %s: %w", event.EventID(), errMalformedCreateEvent)
+	}
+	return true, nil
+}
+
+// processRoomEvent must only be called on the worker for the event's room, as
+// returned by workerForRoom. Events in the same room are then processed one at
+// a time in the order that they were queued, which is what keeps the state
+// deltas that we annotate output events with correct, while events in
+// different rooms are processed concurrently.
+// TODO: Break up function.
 // nolint:gocyclo
 func (r *Inputer) processRoomEvent(
 	inctx context.Context,
 	input *api.InputRoomEvent,
-) (err error) {
+) (result api.InputRoomEventResult, err error) {
+	result.EventID = input.Event.EventID()
 	select {
 	case <-inctx.Done():
 		// Before we do anything, make sure the context hasn't expired for this pending task.
 		// If it has then we'll give up straight away — it's probably a synchronous input
 		// request and the caller has already given up, but the inbox task was still queued.
-		return context.DeadlineExceeded
+		return result, context.DeadlineExceeded
 	default:
 	}
 
+	// Server notices are delivered under a relaxed acceptance policy.
+	notice := r.isServerNotice(input)
+
+	// If the room is in maintenance mode then defer new events until it isn't.
+	// Other kinds of input are still processed, as they are typically needed
+	// to fill in gaps for events that we're already processing.
+	if input.Kind == api.KindNew && !notice && r.isRoomInMaintenance(input.Event.RoomID()) {
+		maintenanceDeferredEvents.WithLabelValues(input.Event.RoomID()).Inc()
+		return result, errRoomInMaintenance
+	}
+
+	// If the origin server is over its quota then either defer or soft-fail
+	// new events from it. We never limit events that originated locally.
+	var quotaSoftFail bool
+	if input.Kind == api.KindNew && input.Origin != "" && input.Origin != r.ServerName {
+		if limits := r.originLimits(); limits.EventsPerSecond > 0 && !r.origins.allow(string(input.Origin), limits, time.Now()) {
+			originQuotaExceeded.WithLabelValues(limits.Action).Inc()
+			logrus.WithFields(logrus.Fields{
+				"event_id": input.Event.EventID(),
+				"room_id":  input.Event.RoomID(),
+				"origin":   input.Origin,
+				"action":   limits.Action,
+			}).Warn("Origin server is over its quota")
+			if limits.Action != config.OriginQuotaActionSoftFail {
+				return result, errOriginQuotaExceeded
+			}
+			quotaSoftFail = true
+		}
+	}
+
 	// Wrap the context with a time limit. We'll allow no more than MaximumProcessingTime for
 	// everything that we need to do for this event, or it's possible that we could end up wedging
-	// the roomserver for a very long time.
+	// the roomserver for a very long time. The caller may ask for less.
 	var cancel context.CancelFunc
-	ctx, cancel := context.WithTimeout(inctx, MaximumProcessingTime)
+	ctx, cancel := context.WithTimeout(inctx, processingTimeout(input))
 	defer cancel()
 
 	// Measure how long it takes to process this event.
 	started := time.Now()
 	defer func() {
 		timetaken := time.Since(started)
-		processRoomEventDuration.With(prometheus.Labels{
-			"room_id": input.Event.RoomID(),
-		}).Observe(float64(timetaken.Milliseconds()))
+		r.observeEventDuration(input.Event, timetaken)
+		if input.Origin != "" {
+			r.origins.observe(string(input.Origin), r.originLimits().MetricsTopServers, timetaken, time.Now())
+		}
 	}()
 
 	// Parse and validate the event JSON
 	headered := input.Event
 	event := headered.Unwrap()
+
+	// Trace the event through each of the major phases of processing it.
+	span, ctx := startEventSpan(ctx, "processRoomEvent", event)
+	defer func() {
+		// Rejected events are tagged as such below, and aren't errors.
+		var rejected *rejectedEventError
+		if err != nil && !errors.As(err, &rejected) {
+			span.SetTag("error", true)
+		}
+		span.Finish()
+	}()
 	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
 		"event_id": event.EventID(),
 		"room_id":  event.RoomID(),
@@ -104,45 +209,59 @@ func (r *Inputer) processRoomEvent(
 
 	// if we have already got this event then do not process it again, if the input kind is an outlier.
 	// Outliers contain no extra information which may warrant a re-processing.
-	if input.Kind == api.KindOutlier {
-		evs, err2 := r.DB.EventsFromIDs(ctx, []string{event.EventID()})
-		if err2 == nil && len(evs) == 1 {
-			// check hash matches if we're on early room versions where the event ID was a random string
-			idFormat, err2 := headered.RoomVersion.EventIDFormat()
-			if err2 == nil {
-				switch idFormat {
-				case gomatrixserverlib.EventIDFormatV1:
-					if bytes.Equal(event.EventReference().EventSHA256, evs[0].EventReference().EventSHA256) {
-						logger.Debugf("Already processed event; ignoring")
-						return nil
-					}
-				default:
-					logger.Debugf("Already processed event; ignoring")
-					return nil
-				}
-			}
-		}
+	if input.Kind == api.KindOutlier && r.isOutlierAlreadyStored(ctx, logger, headered) {
+		logger.Debugf("Already processed event; ignoring")
+		result.Stored = true
+		return result, nil
 	}
 
+	// If a client retried sending an event and we already processed the event
+	// from its first attempt then don't process the new one as well.
+	if eventID, ok := r.processedTransaction(input); ok {
+		duplicateTransactions.Inc()
+		logger.WithField("original_event_id", eventID).Info("Already processed an event for this transaction; ignoring")
+		result.EventID = eventID
+		return result, nil
+	}
+
+	// A create event has no auth or prev events, so there's nothing to look
+	// for. Anything else claiming to be a create event is malformed.
+	isCreate, err := isRoomCreateEvent(event)
+	if err != nil {
+		return result, err
+	}
+
+	// New events that we created ourselves already have all of their auth
+	// events in the database, so there's no need to go looking for them.
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	knownEvents := map[string]*types.Event{}
+	localAuth := !isCreate && r.loadLocalAuthEvents(ctx, logger, input, &authEvents, knownEvents)
+
 	missingRes := &api.QueryMissingAuthPrevEventsResponse{}
 	serverRes := &fedapi.QueryJoinedHostServerNamesInRoomResponse{}
-	if event.Type() != gomatrixserverlib.MRoomCreate || !event.StateKeyEquals("") {
+	if !isCreate {
 		missingReq := &api.QueryMissingAuthPrevEventsRequest{
 			RoomID:       event.RoomID(),
-			AuthEventIDs: event.AuthEventIDs(),
 			PrevEventIDs: event.PrevEventIDs(),
 		}
+		if !localAuth {
+			missingReq.AuthEventIDs = event.AuthEventIDs()
+		}
 		if err = r.Queryer.QueryMissingAuthPrevEvents(ctx, missingReq, missingRes); err != nil {
-			return fmt.Errorf("r.Queryer.QueryMissingAuthPrevEvents: %w", err)
+			return result, fmt.Errorf("r.Queryer.QueryMissingAuthPrevEvents: %w", err)
 		}
 	}
-	if len(missingRes.MissingAuthEventIDs) > 0 || len(missingRes.MissingPrevEventIDs) > 0 {
+	// Missing prev events aren't fetched if we were told the state before the
+	// event, as in a room join, so there is no need to find servers for them.
+	needServers := len(missingRes.MissingAuthEventIDs) > 0 ||
+		(!input.HasState && len(missingRes.MissingPrevEventIDs) > 0)
+	if needServers {
 		serverReq := &fedapi.QueryJoinedHostServerNamesInRoomRequest{
 			RoomID:      event.RoomID(),
 			ExcludeSelf: true,
 		}
 		if err = r.FSAPI.QueryJoinedHostServerNamesInRoom(ctx, serverReq, serverRes); err != nil {
-			return fmt.Errorf("r.FSAPI.QueryJoinedHostServerNamesInRoom: %w", err)
+			return result, fmt.Errorf("r.FSAPI.QueryJoinedHostServerNamesInRoom: %w", err)
 		}
 	}
 	if input.Origin != "" {
@@ -152,18 +271,30 @@ func (r *Inputer) processRoomEvent(
 	// First of all, check that the auth events of the event are known.
 	// If they aren't then we will ask the federation API for them.
 	isRejected := false
-	authEvents := gomatrixserverlib.NewAuthEvents(nil)
-	knownEvents := map[string]*types.Event{}
-	if err = r.fetchAuthEvents(ctx, logger, headered, &authEvents, knownEvents, serverRes.ServerNames); err != nil {
-		return fmt.Errorf("r.checkForMissingAuthEvents: %w", err)
+	if !localAuth {
+		authSpan, authCtx := startEventSpan(ctx, "fetchAuthEvents", event)
+		err = r.fetchAuthEvents(authCtx, logger, headered, &authEvents, knownEvents, serverRes.ServerNames)
+		authSpan.Finish()
+		if err != nil {
+			return result, r.authFetchFailed(logger, input, fmt.Errorf("r.checkForMissingAuthEvents: %w", err), time.Now())
+		}
+		r.forgetAuthFetchDeferral(input)
 	}
 
 	// Check if the event is allowed by its auth events. If it isn't then
 	// we consider the event to be "rejected" — it will still be persisted.
 	var rejectionErr error
+	notAllowed := false
 	if rejectionErr = gomatrixserverlib.Allowed(event, &authEvents); rejectionErr != nil {
 		isRejected = true
+		notAllowed = true
 		logger.WithError(rejectionErr).Warnf("Event %s rejected", event.EventID())
+		if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			logger.WithError(rejectionErr).WithFields(logrus.Fields{
+				"claimed_auth_event_ids": event.AuthEventIDs(),
+				"loaded_auth_event_ids":  loadedAuthEventIDs(event, &authEvents),
+			}).Debug("Auth events considered for rejected event")
+		}
 	}
 
 	// Accumulate the auth event NIDs.
@@ -171,19 +302,86 @@ func (r *Inputer) processRoomEvent(
 	authEventNIDs := make([]types.EventNID, 0, len(authEventIDs))
 	for _, authEventID := range authEventIDs {
 		if _, ok := knownEvents[authEventID]; !ok {
-			return fmt.Errorf("missing auth event %s", authEventID)
+			return result, fmt.Errorf("missing auth event %s", authEventID)
 		}
 		authEventNIDs = append(authEventNIDs, knownEvents[authEventID].EventNID)
 	}
 
-	var softfail bool
+	var softfail, quarantined bool
+	var softfailReason string
+	softFail := func(reason string) {
+		if !softfail {
+			softfailReason = reason
+		}
+		softfail = true
+	}
 	if input.Kind == api.KindNew {
 		// Check that the event passes authentication checks based on the
 		// current room state.
-		softfail, err = helpers.CheckForSoftFail(ctx, r.DB, headered, input.StateEventIDs)
+		softFailSpan, softFailCtx := startEventSpan(ctx, "CheckForSoftFail", event)
+		softfail, err = r.checkForSoftFail(softFailCtx, input)
+		softFailSpan.Finish()
 		if err != nil {
 			logger.WithError(err).Info("Error authing soft-failed event")
 		}
+		if softfail {
+			softfailReason = "event fails auth against the current room state"
+		}
+
+		// Check that the event isn't dated implausibly far into the future.
+		if flagged, fail := r.checkFutureEvent(event, input.Origin, time.Now()); flagged {
+			logger.WithField("origin_server_ts", event.OriginServerTS()).WithField("soft_fail", fail).Warn("Event is dated too far into the future")
+			if fail {
+				softFail("event is dated too far into the future")
+			}
+		}
+
+		// Check that the event was sent to us by a server that is in the room.
+		if flagged, fail, nerr := r.checkNonMemberOrigin(ctx, event, input.Origin); nerr != nil {
+			logger.WithError(nerr).Warn("Failed to check if origin server is in the room")
+		} else if flagged {
+			logger.WithField("origin", input.Origin).WithField("soft_fail", fail).Warn("Event was sent by a server that isn't in the room")
+			if fail {
+				softFail("event was sent by a server that isn't in the room")
+			}
+		}
+
+		if quotaSoftFail {
+			softFail("origin server is over its quota")
+		}
+
+		if softfail && r.bypassSoftFail(logger, input) {
+			softfail = false
+		}
+
+		if r.serverNoticeOverridesSoftFail(logger, input, softfail, notice) {
+			softfail = false
+		}
+	}
+
+	// If an acceptance webhook is configured then give it the opportunity to
+	// veto the event now that it has passed auth. Vetoed events are stored as
+	// rejected.
+	if input.Kind == api.KindNew && !isRejected && !softfail && !notice {
+		if werr := r.checkAcceptanceWebhook(ctx, logger, input); werr != nil {
+			isRejected = true
+			rejectionErr = werr
+			logger.WithError(werr).Warnf("Event %s rejected by acceptance webhook", event.EventID())
+		}
+	}
+
+	// Give any registered event validators the opportunity to reject or
+	// quarantine the event based on its content. Quarantined events are
+	// stored but soft-failed.
+	if input.Kind == api.KindNew && !isRejected && !softfail && !notice && len(r.Validators) > 0 {
+		switch res := r.runEventValidators(ctx, logger, input); res.Outcome {
+		case validator.Reject:
+			isRejected = true
+			rejectionErr = fmt.Errorf("event rejected by validator: %s", res.Reason)
+		case validator.Quarantine:
+			quarantined = true
+			softFail(res.Reason)
+		}
 	}
 
 	// At this point we are checking whether we know all of the prev events, and
@@ -197,10 +395,12 @@ func (r *Inputer) processRoomEvent(
 	// because we may not be allowed to see them and we have no choice but to trust
 	// the state event IDs provided to us in the join instead.
 	missingPrev := !input.HasState && len(missingRes.MissingPrevEventIDs) > 0
+	missingPrevRejected := false
 	if missingPrev && input.Kind == api.KindNew {
 		// Don't do this for KindOld events, otherwise old events that we fetch
 		// to satisfy missing prev events/state will end up recursively calling
-		// processRoomEvent.
+		// processRoomEvent. KindBackfill events are history, so they will
+		// always be missing prev events until we backfill further.
 		if len(serverRes.ServerNames) > 0 {
 			missingState := missingStateReq{
 				origin:     input.Origin,
@@ -213,33 +413,76 @@ func (r *Inputer) processRoomEvent(
 				servers:    map[gomatrixserverlib.ServerName]struct{}{},
 				hadEvents:  map[string]bool{},
 				haveEvents: map[string]*gomatrixserverlib.HeaderedEvent{},
+				maxFetched: r.maxMissingEvents(),
 			}
 			for _, serverName := range serverRes.ServerNames {
 				missingState.servers[serverName] = struct{}{}
 			}
-			if err = missingState.processEventWithMissingState(ctx, event, headered.RoomVersion); err != nil {
+			missingSpan, missingCtx := startEventSpan(ctx, "processEventWithMissingState", event)
+			err = missingState.processEventWithMissingState(missingCtx, event, headered.RoomVersion)
+			missingSpan.Finish()
+			if err != nil {
 				isRejected = true
+				missingPrevRejected = true
 				rejectionErr = fmt.Errorf("missingState.processEventWithMissingState: %w", err)
 			} else {
 				missingPrev = false
 			}
 		} else {
 			isRejected = true
+			missingPrevRejected = true
 			rejectionErr = fmt.Errorf("missing prev events and no other servers to ask")
 		}
 	}
 
-	// Store the event.
-	_, _, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(ctx, event, authEventNIDs, isRejected)
+	// A redaction is only allowed to redact events that its sender sent, or
+	// if its sender has the power level to redact other users' events.
+	if !isRejected && event.Type() == gomatrixserverlib.MRoomRedaction && event.StateKey() == nil {
+		rejectionErr, err = r.checkRedactionAllowed(ctx, event)
+		if err != nil {
+			return result, fmt.Errorf("r.checkRedactionAllowed: %w", err)
+		}
+		if rejectionErr != nil {
+			isRejected = true
+			logger.WithError(rejectionErr).Warnf("Redaction %s rejected", event.EventID())
+		}
+	}
+
+	// Store the event. Only events which were rejected because they failed
+	// auth, and for no other reason, are worth reprocessing later on.
+	var rejectionReason string
+	if isRejected && rejectionErr != nil {
+		rejectionReason = rejectionErr.Error()
+	}
+	rejectedByAuth := notAllowed && !missingPrevRejected
+	span.SetTag("rejected", isRejected)
+	span.SetTag("soft_failed", softfail)
+	storeSpan, storeCtx := startEventSpan(ctx, "StoreEvent", event)
+	_, roomNID, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(storeCtx, event, authEventNIDs, isRejected, rejectedByAuth, rejectionReason)
+	storeSpan.Finish()
 	if err != nil {
-		return fmt.Errorf("r.DB.StoreEvent: %w", err)
+		return result, fmt.Errorf("r.DB.StoreEvent: %w", err)
+	}
+	result.Stored = true
+	if isRejected {
+		r.notifyRejection(input, rejectionErr)
 	}
+	result.Rejected = isRejected
+	result.NotAllowed = isRejected && notAllowed
+	result.SoftFailed = softfail && !isRejected
 
-	// if storing this event results in it being redacted then do so.
+	// A redaction changes the content of a stored event, so a cached state
+	// resolver for the room might be holding a copy which is now stale.
+	if redactedEventID != "" {
+		r.stateResolutions.forget(roomNID)
+	}
+
+	// if storing this event results in it being redacted then do so. The
+	// database only applies redactions whose sender was allowed to redact.
 	if !isRejected && redactedEventID == event.EventID() {
 		r, rerr := eventutil.RedactEvent(redactionEvent, event)
 		if rerr != nil {
-			return fmt.Errorf("eventutil.RedactEvent: %w", rerr)
+			return result, fmt.Errorf("eventutil.RedactEvent: %w", rerr)
 		}
 		event = r
 	}
@@ -249,30 +492,52 @@ func (r *Inputer) processRoomEvent(
 	// notify anyone about it.
 	if input.Kind == api.KindOutlier {
 		logger.Debug("Stored outlier")
-		return nil
+		r.logDecision(input, isRejected, false, false, rejectionErr, "", stateAtEvent.BeforeStateSnapshotNID, started)
+		return result, nil
 	}
 
 	roomInfo, err := r.DB.RoomInfo(ctx, event.RoomID())
 	if err != nil {
-		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+		return result, fmt.Errorf("r.DB.RoomInfo: %w", err)
 	}
 	if roomInfo == nil {
-		return fmt.Errorf("r.DB.RoomInfo missing for room %s", event.RoomID())
+		return result, fmt.Errorf("r.DB.RoomInfo missing for room %s", event.RoomID())
 	}
 
 	if !missingPrev && stateAtEvent.BeforeStateSnapshotNID == 0 {
 		// We haven't calculated a state for this event yet.
 		// Lets calculate one.
-		err = r.calculateAndSetState(ctx, input, roomInfo, &stateAtEvent, event, isRejected)
+		stateSpan, stateCtx := startEventSpan(ctx, "calculateAndSetState", event)
+		err = r.calculateAndSetState(stateCtx, input, roomInfo, &stateAtEvent, event, isRejected)
+		stateSpan.Finish()
 		if err != nil {
-			return fmt.Errorf("r.calculateAndSetState: %w", err)
+			return result, fmt.Errorf("r.calculateAndSetState: %w", err)
 		}
 	}
 
 	// We stop here if the event is rejected: We've stored it but won't update forward extremities or notify anyone about it.
 	if isRejected || softfail {
 		logger.WithError(rejectionErr).WithField("soft_fail", softfail).Debug("Stored rejected event")
-		return rejectionErr
+		r.logDecision(input, isRejected, softfail, quarantined, rejectionErr, softfailReason, stateAtEvent.BeforeStateSnapshotNID, started)
+		// Remember soft-failed events that we know the state before, so that
+		// they can be accepted later if the room state changes in their favour.
+		if !isRejected && input.Kind == api.KindNew && stateAtEvent.BeforeStateSnapshotNID != 0 {
+			if serr := r.recordSoftFailedEvent(ctx, roomInfo, stateAtEvent); serr != nil {
+				logger.WithError(serr).Warn("Failed to record soft-failed event")
+			}
+		}
+		// Let downstream components know about soft-failed new events, so
+		// that they can tell why they won't be sent to clients.
+		if !isRejected && input.Kind == api.KindNew {
+			if err = r.writeSoftFailedEvent(headered, softfailReason); err != nil {
+				return result, fmt.Errorf("r.writeSoftFailedEvent: %w", err)
+			}
+		}
+		r.rememberTransaction(input)
+		if rejectionErr != nil {
+			return result, &rejectedEventError{err: rejectionErr}
+		}
+		return result, nil
 	}
 
 	switch input.Kind {
@@ -286,7 +551,14 @@ func (r *Inputer) processRoomEvent(
 			input.TransactionID, // transaction ID
 			input.HasState,      // rewrites state?
 		); err != nil {
-			return fmt.Errorf("r.updateLatestEvents: %w", err)
+			return result, fmt.Errorf("r.updateLatestEvents: %w", err)
+		}
+		// A change to the room state may mean that events which were
+		// soft-failed recently would now be allowed.
+		if event.StateKey() != nil {
+			if _, serr := r.reevaluateSoftFailedEvents(ctx, roomInfo); serr != nil {
+				logger.WithError(serr).Warn("Failed to re-evaluate soft-failed events")
+			}
 		}
 	case api.KindOld:
 		err = r.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
@@ -298,7 +570,19 @@ func (r *Inputer) processRoomEvent(
 			},
 		})
 		if err != nil {
-			return fmt.Errorf("r.WriteOutputEvents (old): %w", err)
+			return result, fmt.Errorf("r.WriteOutputEvents (old): %w", err)
+		}
+	case api.KindBackfill:
+		err = r.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
+			{
+				Type: api.OutputTypeBackfilledRoomEvent,
+				BackfilledRoomEvent: &api.OutputBackfilledRoomEvent{
+					Event: headered,
+				},
+			},
+		})
+		if err != nil {
+			return result, fmt.Errorf("r.WriteOutputEvents (backfilled): %w", err)
 		}
 	}
 
@@ -317,12 +601,18 @@ func (r *Inputer) processRoomEvent(
 			},
 		})
 		if err != nil {
-			return fmt.Errorf("r.WriteOutputEvents (redactions): %w", err)
+			return result, fmt.Errorf("r.WriteOutputEvents (redactions): %w", err)
 		}
 	}
 
+	// Only remember the transaction now that the event has been fully
+	// processed and sent on, so that if anything above failed then the
+	// client's retry is processed rather than ignored.
+	r.rememberTransaction(input)
+	r.logDecision(input, false, false, false, nil, "", stateAtEvent.BeforeStateSnapshotNID, started)
+
 	// Update the extremities of the event graph for the room
-	return nil
+	return result, nil
 }
 
 // fetchAuthEvents will check to see if any of the
@@ -345,14 +635,25 @@ func (r *Inputer) fetchAuthEvents(
 	if len(authEventIDs) == 0 {
 		return nil
 	}
+	defer func() {
+		knownAuthEventsPerEvent.Observe(float64(len(known)))
+	}()
 
 	for _, authEventID := range authEventIDs {
+		if ev := r.cachedAuthEvent(event.RoomID(), authEventID); ev != nil {
+			known[authEventID] = ev
+			if err := auth.AddEvent(ev.Event); err != nil {
+				return fmt.Errorf("auth.AddEvent: %w", err)
+			}
+			continue
+		}
 		authEvents, err := r.DB.EventsFromIDs(ctx, []string{authEventID})
 		if err != nil || len(authEvents) == 0 || authEvents[0].Event == nil {
 			unknown[authEventID] = struct{}{}
 			continue
 		}
 		ev := authEvents[0]
+		authEventsFromDB.Inc()
 		known[authEventID] = &ev // don't take the pointer of the iterated event
 		if err = auth.AddEvent(ev.Event); err != nil {
 			return fmt.Errorf("auth.AddEvent: %w", err)
@@ -365,27 +666,47 @@ func (r *Inputer) fetchAuthEvents(
 		return nil
 	}
 
-	var err error
-	var res gomatrixserverlib.RespEventAuth
-	var found bool
-	for _, serverName := range servers {
-		// Request the entire auth chain for the event in question. This should
-		// contain all of the auth events — including ones that we already know —
-		// so we'll need to filter through those in the next section.
-		res, err = r.FSAPI.GetEventAuth(ctx, serverName, event.RoomVersion, event.RoomID(), event.EventID())
-		if err != nil {
-			logger.WithError(err).Warnf("Failed to get event auth from federation for %q: %s", event.EventID(), err)
-			continue
+	// The same backoff is used for all of the requests that we make for the
+	// auth events, so that failures carry over from asking for the auth chain
+	// to asking for the auth events one at a time.
+	backoff := r.newFederationBackoff()
+	res, suppliedByServer, found := r.getEventAuthFromServers(ctx, logger, event, servers, backoff)
+	if found {
+		if err := r.checkAuthChainLength(event.EventID(), suppliedByServer, len(res.AuthEvents)); err != nil {
+			return err
 		}
-		found = true
-		break
 	}
-	if !found {
-		return fmt.Errorf("no servers provided event auth for event ID %q, tried servers %v", event.EventID(), servers)
+
+	// Remember which server gave us each auth event, for investigating abuse.
+	suppliedBy := make(map[string]gomatrixserverlib.ServerName, len(res.AuthEvents))
+	for _, authEvent := range res.AuthEvents {
+		suppliedBy[authEvent.EventID()] = suppliedByServer
 	}
 
+	// If no servers gave us the auth chain, or the auth chain that we got is
+	// missing events, then try to fetch the missing events one at a time and
+	// walk the chain ourselves instead.
+	authChain := res.AuthEvents
+	if missing := missingFromAuthChain(unknown, authChain, known); len(missing) > 0 {
+		if found {
+			logger.Warnf("Event auth from federation for %q is missing %d event(s), fetching them individually", event.EventID(), len(missing))
+		}
+		fetched, ferr := r.fetchAuthEventsIndividually(ctx, logger, event.RoomVersion, event.RoomID(), missing, authChain, known, servers, suppliedBy, backoff)
+		if ferr != nil {
+			if !found {
+				return &authEventsUnavailableError{eventID: event.EventID(), servers: servers, err: ferr}
+			}
+			return fmt.Errorf("r.fetchAuthEventsIndividually: %w", ferr)
+		}
+		authChain = append(authChain, fetched...)
+	}
+
+	// Work out which of the auth events we don't already know about from the
+	// database, in the order that they need to be added and checked.
+	newAuthEvents := make([]*gomatrixserverlib.Event, 0, len(authChain))
+	seen := make(map[string]struct{}, len(authChain))
 	for _, authEvent := range gomatrixserverlib.ReverseTopologicalOrdering(
-		res.AuthEvents,
+		authChain,
 		gomatrixserverlib.TopologicalOrderByAuthEvents,
 	) {
 		// If we already know about this event from the database then we don't
@@ -394,25 +715,61 @@ func (r *Inputer) fetchAuthEvents(
 		if ev, ok := known[authEvent.EventID()]; ok && ev != nil {
 			continue
 		}
+		// If we fetched and stored this event recently for another event in
+		// the room then we don't need to verify and store it again.
+		if ev := r.cachedAuthEvent(event.RoomID(), authEvent.EventID()); ev != nil {
+			known[authEvent.EventID()] = ev
+			continue
+		}
+		if _, ok := seen[authEvent.EventID()]; ok {
+			continue
+		}
+		seen[authEvent.EventID()] = struct{}{}
+		newAuthEvents = append(newAuthEvents, authEvent)
+	}
+
+	// Give up before verifying and storing anything if we'd end up holding
+	// more auth events in memory for this one event than we allow.
+	if err := r.checkKnownAuthEventsLimit(event.EventID(), len(known)+len(newAuthEvents)); err != nil {
+		return err
+	}
 
-		// Check the signatures of the event.
-		// TODO: It really makes sense for the federation API to be doing this,
-		// because then it can attempt another server if one serves up an event
-		// with an invalid signature. For now this will do.
-		if err := authEvent.VerifyEventSignatures(ctx, r.FSAPI.KeyRing()); err != nil {
-			return fmt.Errorf("event.VerifyEventSignatures: %w", err)
+	// Check the signatures of the events. Verifying one event doesn't depend
+	// on any other, so this can happen concurrently, unlike the auth checks
+	// below which need the events to be added in order.
+	// TODO: It really makes sense for the federation API to be doing this,
+	// because then it can attempt another server if one serves up an event
+	// with an invalid signature. For now this will do.
+	verifyErrs := verifyEventSignatures(ctx, r.FSAPI.KeyRing(), newAuthEvents, r.authEventVerificationWorkers())
+
+	// The auth checks happen one event at a time in dependency order, since
+	// each event is checked against the ones before it, and then the auth
+	// events are all stored together in a single transaction. If an event has
+	// a bad signature then the auth events before it are still stored, since
+	// they are complete outliers which will be reused the next time that they
+	// are needed. If we give up because the context has been cancelled, then
+	// nothing is stored and the auth events will be fetched again.
+	toStore := make([]types.EventToStore, 0, len(newAuthEvents))
+	queued := make(map[string]struct{}, len(newAuthEvents))
+	var verifyErr error
+	for i, authEvent := range newAuthEvents {
+		if err := verifyErrs[i]; err != nil {
+			verifyErr = fmt.Errorf("event.VerifyEventSignatures: %w", err)
+			break
 		}
 
-		// In order to store the new auth event, we need to know its auth chain
-		// as NIDs for the `auth_event_nids` column. Let's see if we can find those.
-		authEventNIDs := make([]types.EventNID, 0, len(authEvent.AuthEventIDs()))
+		// We need to know the auth chain of the new auth event as NIDs for
+		// the `auth_event_nids` column, so all of its auth events must either
+		// be known already or be stored before it.
 		for _, eventID := range authEvent.AuthEventIDs() {
-			knownEvent, ok := known[eventID]
-			if !ok {
+			if ev, ok := known[eventID]; ok && ev != nil {
+				continue
+			}
+			if _, ok := queued[eventID]; !ok {
 				return fmt.Errorf("missing auth event %s for %s", eventID, authEvent.EventID())
 			}
-			authEventNIDs = append(authEventNIDs, knownEvent.EventNID)
 		}
+		queued[authEvent.EventID()] = struct{}{}
 
 		// Let's take a note of the fact that we now know about this event.
 		if err := auth.AddEvent(authEvent); err != nil {
@@ -421,25 +778,123 @@ func (r *Inputer) fetchAuthEvents(
 
 		// Check if the auth event should be rejected.
 		isRejected := false
+		var rejectionReason string
 		if err := gomatrixserverlib.Allowed(authEvent, auth); err != nil {
 			isRejected = true
+			rejectionReason = err.Error()
 			logger.WithError(err).Warnf("Auth event %s rejected", authEvent.EventID())
 		}
+		toStore = append(toStore, types.EventToStore{
+			Event:           authEvent,
+			IsRejected:      isRejected,
+			RejectionReason: rejectionReason,
+			RejectedByAuth:  isRejected,
+			SuppliedBy:      suppliedBy[authEvent.EventID()],
+		})
+	}
+	if len(toStore) == 0 {
+		return verifyErr
+	}
 
-		// Finally, store the event in the database.
-		eventNID, _, _, _, _, err := r.DB.StoreEvent(ctx, authEvent, authEventNIDs, isRejected)
-		if err != nil {
-			return fmt.Errorf("r.DB.StoreEvent: %w", err)
+	// Don't start storing the events if we've already run out of time.
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("stopped storing auth events for %s: %w", event.EventID(), err)
+	}
+
+	// Finally, store the events in the database.
+	knownNIDs := make(map[string]types.EventNID, len(known))
+	for eventID, ev := range known {
+		if ev != nil {
+			knownNIDs[eventID] = ev.EventNID
 		}
+	}
+	eventNIDs, err := r.DB.StoreEvents(ctx, toStore, knownNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.StoreEvents: %w", err)
+	}
 
-		// Now we know about this event, it was stored and the signatures were OK.
-		known[authEvent.EventID()] = &types.Event{
-			EventNID: eventNID,
-			Event:    authEvent,
+	// Now we know about these events, they were stored and the signatures were OK.
+	for i, ev := range toStore {
+		authEventsFromFederation.Inc()
+		known[ev.Event.EventID()] = &types.Event{
+			EventNID: eventNIDs[i],
+			Event:    ev.Event,
 		}
+		r.cacheAuthEvent(event.RoomID(), known[ev.Event.EventID()])
 	}
 
-	return nil
+	return verifyErr
+}
+
+// bypassSoftFail returns true if the input has asked for the soft-fail
+// check to be skipped and is allowed to do so. Only events that were input
+// locally can bypass soft-failing, never those that arrived over federation.
+func (r *Inputer) bypassSoftFail(logger *logrus.Entry, input *api.InputRoomEvent) bool {
+	if !input.BypassSoftFail {
+		return false
+	}
+	if input.Origin != "" && input.Origin != r.ServerName {
+		logger.WithField("origin", input.Origin).Warn("Ignoring request to bypass soft-fail check for event from remote origin")
+		return false
+	}
+	logger.WithFields(logrus.Fields{
+		"audit":        true,
+		"sender":       input.Event.Sender(),
+		"send_as":      input.SendAsServer,
+		"origin":       input.Origin,
+		"has_state":    input.HasState,
+		"state_events": len(input.StateEventIDs),
+	}).Warn("AUDIT: Bypassing soft-fail check for event, it will be accepted despite failing auth against the current room state")
+	return true
+}
+
+// authEventVerificationWorkers returns how many auth events from a single
+// auth chain can have their signatures verified at the same time. Verifying
+// signatures is CPU-bound, so unless configured otherwise, this is the number
+// of CPUs that we can use.
+func (r *Inputer) authEventVerificationWorkers() int {
+	if r.Cfg == nil || r.Cfg.AuthEventVerificationWorkers < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return r.Cfg.AuthEventVerificationWorkers
+}
+
+// verifyEventSignatures verifies the signatures of the given events using up
+// to the given number of workers. The returned slice contains the result of
+// the verification of each event in the same order as the events were given.
+func verifyEventSignatures(
+	ctx context.Context,
+	verifier gomatrixserverlib.JSONVerifier,
+	events []*gomatrixserverlib.Event,
+	workers int,
+) []error {
+	errs := make([]error, len(events))
+	if workers > len(events) {
+		workers = len(events)
+	}
+	if workers <= 1 {
+		for i, event := range events {
+			errs[i] = event.VerifyEventSignatures(ctx, verifier)
+		}
+		return errs
+	}
+	pending := make(chan int, len(events))
+	for i := range events {
+		pending <- i
+	}
+	close(pending)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				errs[i] = events[i].VerifyEventSignatures(ctx, verifier)
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
 }
 
 func (r *Inputer) calculateAndSetState(
@@ -449,21 +904,16 @@ func (r *Inputer) calculateAndSetState(
 	stateAtEvent *types.StateAtEvent,
 	event *gomatrixserverlib.Event,
 	isRejected bool,
-) error {
-	var err error
-	roomState := state.NewStateResolution(r.DB, roomInfo)
+) (err error) {
+	roomState := r.acquireStateResolution(roomInfo, event.RoomID())
+	defer func() {
+		r.releaseStateResolution(roomInfo, roomState, err)
+	}()
 
+	var stateReset *api.OutputStateReset
 	if input.HasState && !isRejected {
 		// Check here if we think we're in the room already.
-		stateAtEvent.Overwrite = true
-		var joinEventNIDs []types.EventNID
-		// Request join memberships only for local users only.
-		if joinEventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true); err == nil {
-			// If we have no local users that are joined to the room then any state about
-			// the room that we have is quite possibly out of date. Therefore in that case
-			// we should overwrite it rather than merge it.
-			stateAtEvent.Overwrite = len(joinEventNIDs) == 0
-		}
+		stateAtEvent.Overwrite = r.shouldOverwriteState(ctx, roomInfo, event.RoomID())
 
 		// We've been told what the state at the event is so we don't need to calculate it.
 		// Check that those state events are in the database and store the state.
@@ -473,6 +923,19 @@ func (r *Inputer) calculateAndSetState(
 		}
 		entries = types.DeduplicateStateEntries(entries)
 
+		// Overwriting the room state with what a remote server told us can
+		// cause a state reset, so check for the obvious signs of one first.
+		// Partial state is expected to be missing things, so it would always
+		// look like a state reset.
+		if stateAtEvent.Overwrite && !input.PartialState {
+			if stateReset, err = r.detectStateReset(ctx, roomInfo, &roomState, event, entries); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"room_id":  event.RoomID(),
+					"event_id": event.EventID(),
+				}).Warn("Failed to check whether overwriting the room state is a state reset")
+			}
+		}
+
 		if stateAtEvent.BeforeStateSnapshotNID, err = r.DB.AddState(ctx, roomInfo.RoomNID, nil, entries); err != nil {
 			return fmt.Errorf("r.DB.AddState: %w", err)
 		}
@@ -480,7 +943,16 @@ func (r *Inputer) calculateAndSetState(
 		stateAtEvent.Overwrite = false
 
 		// We haven't been told what the state at the event is so we need to calculate it from the prev_events
-		if stateAtEvent.BeforeStateSnapshotNID, err = roomState.CalculateAndStoreStateBeforeEvent(ctx, event, isRejected); err != nil {
+		stateResSpan, stateResCtx := startEventSpan(ctx, "CalculateAndStoreStateBeforeEvent", event)
+		started := time.Now()
+		stateAtEvent.BeforeStateSnapshotNID, err = roomState.CalculateAndStoreStateBeforeEvent(stateResCtx, event, isRejected)
+		sets := roomState.ConflictingStateSets()
+		r.observeStateResolution(event.RoomID(), roomInfo.RoomVersion, time.Since(started), sets)
+		if sets > 0 {
+			stateResSpan.SetTag("conflicting_state_sets", sets)
+		}
+		stateResSpan.Finish()
+		if err != nil {
 			return fmt.Errorf("roomState.CalculateAndStoreStateBeforeEvent: %w", err)
 		}
 	}
@@ -489,5 +961,60 @@ func (r *Inputer) calculateAndSetState(
 	if err != nil {
 		return fmt.Errorf("r.DB.SetState: %w", err)
 	}
+	if input.HasState && input.PartialState && !isRejected {
+		// Remember that the state is incomplete so that the rest of it is
+		// fetched in the background. The event can be built upon using the
+		// partial state in the meantime, so local users can still join.
+		serverName := input.Origin
+		if serverName == "" {
+			serverName = event.Origin()
+		}
+		if err = r.DB.RecordPartialStateEvent(ctx, roomInfo.RoomNID, stateAtEvent.EventNID, serverName); err != nil {
+			return fmt.Errorf("r.DB.RecordPartialStateEvent: %w", err)
+		}
+		r.wakePartialStateCompletion()
+	}
+	if stateReset != nil {
+		if err = r.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
+			{
+				Type:       api.OutputTypeStateReset,
+				StateReset: stateReset,
+			},
+		}); err != nil {
+			return fmt.Errorf("r.WriteOutputEvents (state reset): %w", err)
+		}
+	}
 	return nil
 }
+
+// loadedAuthEventIDs returns the IDs of the events in the auth event set that
+// the auth checks for the event would have looked at, so that they can be
+// compared to the auth events that the event claims.
+func loadedAuthEventIDs(event *gomatrixserverlib.Event, authEvents *gomatrixserverlib.AuthEvents) []string {
+	eventIDs := []string{}
+	seen := map[string]struct{}{}
+	for _, tuple := range gomatrixserverlib.StateNeededForAuth([]*gomatrixserverlib.Event{event}).Tuples() {
+		var ev *gomatrixserverlib.Event
+		switch tuple.EventType {
+		case gomatrixserverlib.MRoomCreate:
+			ev, _ = authEvents.Create()
+		case gomatrixserverlib.MRoomJoinRules:
+			ev, _ = authEvents.JoinRules()
+		case gomatrixserverlib.MRoomPowerLevels:
+			ev, _ = authEvents.PowerLevels()
+		case gomatrixserverlib.MRoomMember:
+			ev, _ = authEvents.Member(tuple.StateKey)
+		case gomatrixserverlib.MRoomThirdPartyInvite:
+			ev, _ = authEvents.ThirdPartyInvite(tuple.StateKey)
+		}
+		if ev == nil {
+			continue
+		}
+		if _, ok := seen[ev.EventID()]; ok {
+			continue
+		}
+		seen[ev.EventID()] = struct{}{}
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	return eventIDs
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// errFederationAttemptsExhausted is returned once we've made as many
+// requests to other servers for an event as we allow.
+var errFederationAttemptsExhausted = errors.New("too many requests to other servers")
+
+// federationRetrySleep waits before asking the next server. It is a variable
+// so that tests can see the delays without waiting for them.
+var federationRetrySleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Inputer) federationRetryOptions() config.FederationRetryOptions {
+	if r.Cfg == nil {
+		return config.FederationRetryOptions{}
+	}
+	return r.Cfg.FederationRetry
+}
+
+// federationBackoff spaces out the requests that we make to a list of
+// servers when consecutive servers fail to answer, so that a run of
+// unreachable servers doesn't get a burst of requests, and limits how
+// many requests are made in total. It isn't safe for concurrent use.
+type federationBackoff struct {
+	opts     config.FederationRetryOptions
+	attempts int
+	failures int
+}
+
+func (r *Inputer) newFederationBackoff() *federationBackoff {
+	return &federationBackoff{opts: r.federationRetryOptions()}
+}
+
+// wait is called before each request. It waits if the previous servers
+// failed, and returns an error if no more requests should be made.
+func (b *federationBackoff) wait(ctx context.Context) error {
+	if b.opts.MaxAttempts > 0 && b.attempts >= b.opts.MaxAttempts {
+		return errFederationAttemptsExhausted
+	}
+	b.attempts++
+	if b.failures == 0 || b.opts.BaseDelay <= 0 {
+		return nil
+	}
+	return federationRetrySleep(ctx, b.delay())
+}
+
+// delay returns how long to wait after the current run of failures, doubling
+// the base delay for each consecutive failure and adding up to half as much
+// again as jitter.
+func (b *federationBackoff) delay() time.Duration {
+	delay := b.opts.BaseDelay
+	for i := 1; i < b.failures && delay < b.opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	if b.opts.MaxDelay > 0 && delay > b.opts.MaxDelay {
+		delay = b.opts.MaxDelay
+	}
+	return delay
+}
+
+// failed records that a server failed to answer.
+func (b *federationBackoff) failed() {
+	b.failures++
+}
+
+// succeeded records that a server answered, so that the next request is
+// made straight away.
+func (b *federationBackoff) succeeded() {
+	b.failures = 0
+}
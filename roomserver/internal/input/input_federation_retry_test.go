@@ -0,0 +1,128 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// failingAuthFSAPI fails every request for auth events, counting them.
+type failingAuthFSAPI struct {
+	fakeAuthFallbackFSAPI
+	mu       sync.Mutex
+	requests int
+}
+
+func (f *failingAuthFSAPI) GetEventAuth(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string,
+) (gomatrixserverlib.RespEventAuth, error) {
+	f.mu.Lock()
+	f.requests++
+	f.mu.Unlock()
+	return f.fakeAuthFallbackFSAPI.GetEventAuth(ctx, s, roomVersion, roomID, eventID)
+}
+
+func (f *failingAuthFSAPI) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	f.mu.Lock()
+	f.requests++
+	f.mu.Unlock()
+	return f.fakeAuthFallbackFSAPI.GetEvent(ctx, s, eventID)
+}
+
+func TestFetchAuthEventsBacksOffAcrossServers(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := mustBuildSignedEvent(t, private, 3, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{"$unknown:remote"})
+
+	var delays []time.Duration
+	sleep := federationRetrySleep
+	federationRetrySleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	defer func() { federationRetrySleep = sleep }()
+
+	fsAPI := &failingAuthFSAPI{
+		fakeAuthFallbackFSAPI: fakeAuthFallbackFSAPI{events: map[string]*gomatrixserverlib.Event{}},
+	}
+	r := &Inputer{
+		Cfg: &config.RoomServer{
+			FederationRetry: config.FederationRetryOptions{
+				MaxAttempts: 5,
+				BaseDelay:   time.Millisecond * 10,
+				MaxDelay:    time.Second,
+			},
+		},
+		DB:    &fakeAuthFallbackDB{events: map[string]types.Event{}},
+		FSAPI: fsAPI,
+	}
+
+	// All three servers are asked for the auth chain at once, and all of
+	// them fail. Then the auth event is asked for on its own, which only
+	// leaves room for two more requests, each after a longer delay.
+	auth := gomatrixserverlib.NewAuthEvents(nil)
+	err = r.fetchAuthEvents(
+		context.Background(), logrus.WithField("test", t.Name()),
+		event.Headered(gomatrixserverlib.RoomVersionV6), &auth, map[string]*types.Event{},
+		[]gomatrixserverlib.ServerName{"a", "b", "c"},
+	)
+	if err == nil {
+		t.Fatal("expected fetching the auth events to fail")
+	}
+	if fsAPI.requests != 5 {
+		t.Fatalf("got %d requests, want 5", fsAPI.requests)
+	}
+	if len(delays) != 2 {
+		t.Fatalf("got delays %v, want 2", delays)
+	}
+	if delays[0] < time.Millisecond*40 || delays[1] <= delays[0] {
+		t.Fatalf("got delays %v, want them to grow with each failure", delays)
+	}
+}
+
+func TestFederationBackoffResetsOnSuccess(t *testing.T) {
+	b := &federationBackoff{opts: config.FederationRetryOptions{
+		BaseDelay: time.Millisecond * 10,
+		MaxDelay:  time.Millisecond * 50,
+	}}
+	for i := 0; i < 10; i++ {
+		b.failed()
+	}
+	if delay := b.delay(); delay != time.Millisecond*50 {
+		t.Fatalf("got delay %s after many failures, want the maximum", delay)
+	}
+	b.succeeded()
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b.failures != 0 {
+		t.Fatalf("got %d failures after a success, want 0", b.failures)
+	}
+}
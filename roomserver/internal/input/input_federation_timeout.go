@@ -0,0 +1,50 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"time"
+)
+
+// maxFederationRequestTimeout is the longest that we'll wait for a single
+// federation request made while processing an input event.
+const maxFederationRequestTimeout = time.Second * 30
+
+// federationRequestBudgetShare is the fraction of the remaining processing
+// time that a single federation request may use, so that one slow server
+// can't use up all of the time that we have to process an event.
+const federationRequestBudgetShare = 4
+
+// federationRequestTimeout returns how long a single federation request may
+// take, given the deadline of the context that the event is being processed
+// with, if it has one.
+func federationRequestTimeout(ctx context.Context, now time.Time) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return maxFederationRequestTimeout
+	}
+	timeout := deadline.Sub(now) / federationRequestBudgetShare
+	if timeout > maxFederationRequestTimeout {
+		return maxFederationRequestTimeout
+	}
+	return timeout
+}
+
+// withFederationRequestTimeout returns a context for a single federation
+// request, with a timeout derived from the remaining processing time.
+func withFederationRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, federationRequestTimeout(ctx, time.Now()))
+}
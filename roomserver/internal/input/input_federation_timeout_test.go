@@ -0,0 +1,74 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFederationRequestTimeout(t *testing.T) {
+	now := time.Now()
+	if timeout := federationRequestTimeout(context.Background(), now); timeout != maxFederationRequestTimeout {
+		t.Fatalf("expected %s without a deadline, got %s", maxFederationRequestTimeout, timeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(time.Minute*2))
+	defer cancel()
+	if timeout := federationRequestTimeout(ctx, now); timeout != maxFederationRequestTimeout {
+		t.Fatalf("expected %s with plenty of time left, got %s", maxFederationRequestTimeout, timeout)
+	}
+	if timeout := federationRequestTimeout(ctx, now.Add(time.Minute+time.Second*40)); timeout != time.Second*5 {
+		t.Fatalf("expected 5s with 20s left, got %s", timeout)
+	}
+}
+
+func TestGetEventAuthFromServersTimesOutSlowServers(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{"creator": "@alice:remote"}, nil)
+	event := create.Headered(create.Version())
+
+	// The first servers that we ask block until their requests are cancelled,
+	// which would use up all of the time that we have if the requests weren't
+	// given their own shorter timeout.
+	fsAPI := &fakeFanoutFSAPI{
+		block:     map[gomatrixserverlib.ServerName]bool{"a": true, "b": true, "c": true},
+		authChain: []*gomatrixserverlib.Event{create},
+	}
+	r := &Inputer{FSAPI: fsAPI}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	budget := time.Second * 2
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+	started := time.Now()
+	res, serverName, found := r.getEventAuthFromServers(ctx, logger, event, []gomatrixserverlib.ServerName{"a", "b", "c", "d"}, r.newFederationBackoff())
+	if !found || serverName != "d" || len(res.AuthEvents) != 1 {
+		t.Fatalf("expected the auth chain from d, got %v from %q", found, serverName)
+	}
+	if elapsed := time.Since(started); elapsed >= budget {
+		t.Fatalf("expected the slow servers to time out before the processing deadline, took %s", elapsed)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the processing context to still be live")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(eventFetchesCoalesced)
+}
+
+var eventFetchesCoalesced = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "event_fetches_coalesced_total",
+		Help:      "Number of federation fetches of an event which waited for a fetch of the same event that was already in flight",
+	},
+)
+
+// inflightEventFetches coalesces concurrent fetches of the same event over
+// federation, e.g. when several events being backfilled are missing the same
+// auth or prev event, so that only one request is made and everyone waiting
+// for the event shares the result.
+type inflightEventFetches struct {
+	mu      sync.Mutex
+	fetches map[string]*inflightEventFetch // event ID -> fetch
+}
+
+type inflightEventFetch struct {
+	done chan struct{}
+	txn  gomatrixserverlib.Transaction
+	err  error
+}
+
+// getEvent fetches an event from the given server, unless a fetch of the same
+// event is already in flight, in which case it waits for that one to finish
+// and returns its result instead, even if it was asking a different server.
+// If the caller gives up waiting then the fetch carries on for the others.
+func (f *inflightEventFetches) getEvent(
+	ctx context.Context, federation fedapi.FederationInternalAPI, serverName gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	f.mu.Lock()
+	for {
+		fetch, ok := f.fetches[eventID]
+		if !ok {
+			break
+		}
+		f.mu.Unlock()
+		eventFetchesCoalesced.Inc()
+		select {
+		case <-fetch.done:
+		case <-ctx.Done():
+			return gomatrixserverlib.Transaction{}, ctx.Err()
+		}
+		// If the fetch we waited for failed only because whoever started it
+		// gave up, then we haven't really had an answer, so try again.
+		if !isContextError(fetch.err) || ctx.Err() != nil {
+			return fetch.txn, fetch.err
+		}
+		f.mu.Lock()
+	}
+	if f.fetches == nil {
+		f.fetches = map[string]*inflightEventFetch{}
+	}
+	fetch := &inflightEventFetch{done: make(chan struct{})}
+	f.fetches[eventID] = fetch
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.fetches, eventID)
+		f.mu.Unlock()
+		close(fetch.done)
+	}()
+	fetch.txn, fetch.err = federation.GetEvent(ctx, serverName, eventID)
+	return fetch.txn, fetch.err
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
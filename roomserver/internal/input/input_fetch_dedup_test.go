@@ -0,0 +1,93 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingGetEventFSAPI counts requests for events, and doesn't answer them
+// until it is released.
+type blockingGetEventFSAPI struct {
+	fedapi.FederationInternalAPI
+	calls   int32
+	release chan struct{}
+}
+
+func (f *blockingGetEventFSAPI) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	atomic.AddInt32(&f.calls, 1)
+	<-f.release
+	return gomatrixserverlib.Transaction{PDUs: []json.RawMessage{json.RawMessage(`{"event_id":"` + eventID + `"}`)}}, nil
+}
+
+// waitFor polls until the condition is true, failing the test if it takes
+// too long.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestConcurrentEventFetchesAreCoalesced(t *testing.T) {
+	fsAPI := &blockingGetEventFSAPI{release: make(chan struct{})}
+	r := &Inputer{FSAPI: fsAPI}
+	coalesced := testutil.ToFloat64(eventFetchesCoalesced)
+
+	var wg sync.WaitGroup
+	results := make([]gomatrixserverlib.Transaction, 2)
+	errs := make([]error, 2)
+	fetch := func(i int, serverName gomatrixserverlib.ServerName) {
+		defer wg.Done()
+		results[i], errs[i] = r.eventFetches.getEvent(context.Background(), r.FSAPI, serverName, "$missing:remote")
+	}
+
+	// Start one fetch and wait for it to reach the federation, then start
+	// another and wait for it to join the first.
+	wg.Add(2)
+	go fetch(0, "a.remote")
+	waitFor(t, "the first fetch", func() bool { return atomic.LoadInt32(&fsAPI.calls) == 1 })
+	go fetch(1, "b.remote")
+	waitFor(t, "the second fetch", func() bool { return testutil.ToFloat64(eventFetchesCoalesced) == coalesced+1 })
+	close(fsAPI.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&fsAPI.calls); calls != 1 {
+		t.Fatalf("expected 1 federation request, got %d", calls)
+	}
+	for i := range results {
+		if errs[i] != nil || len(results[i].PDUs) != 1 {
+			t.Fatalf("fetch %d: got %v, %v", i, results[i], errs[i])
+		}
+	}
+	r.eventFetches.mu.Lock()
+	defer r.eventFetches.mu.Unlock()
+	if len(r.eventFetches.fetches) != 0 {
+		t.Fatalf("expected no fetches to be left in flight, got %d", len(r.eventFetches.fetches))
+	}
+}
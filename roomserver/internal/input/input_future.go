@@ -0,0 +1,70 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(futureEventsCounter)
+}
+
+var futureEventsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "future_events_total",
+		Help:      "Number of new events with an origin_server_ts too far in the future, by origin server and action",
+	},
+	[]string{"origin", "action"},
+)
+
+// isFutureEvent returns true if the origin_server_ts of the event is further
+// ahead of now than the configured maximum skew allows.
+func isFutureEvent(opts config.FutureEventsOptions, event *gomatrixserverlib.Event, now time.Time) bool {
+	return event.OriginServerTS().Time().Sub(now) > opts.MaxSkew
+}
+
+// checkFutureEvent applies the configured future-dated event policy to a new
+// event. It returns whether the event was flagged as future-dated and whether
+// it should be soft-failed as a result. Backfilled and outlier events are never
+// passed through here, so historical events are not affected by this policy.
+func (r *Inputer) checkFutureEvent(event *gomatrixserverlib.Event, origin gomatrixserverlib.ServerName, now time.Time) (flagged, softfail bool) {
+	if r.Cfg == nil {
+		return false, false
+	}
+	opts := r.Cfg.FutureEvents
+	switch opts.Action {
+	case config.FutureEventsActionFlag, config.FutureEventsActionSoftFail:
+	default:
+		return false, false
+	}
+	if !isFutureEvent(opts, event, now) {
+		return false, false
+	}
+	if origin == "" {
+		origin = event.Origin()
+	}
+	futureEventsCounter.With(prometheus.Labels{
+		"origin": string(origin),
+		"action": opts.Action,
+	}).Inc()
+	return true, opts.Action == config.FutureEventsActionSoftFail
+}
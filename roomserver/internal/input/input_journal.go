@@ -0,0 +1,115 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// The input journal makes synchronous input durable. Asynchronous input is
+// queued in JetStream and is only acknowledged once it has been processed,
+// but synchronous input is handed straight to the room workers, so it would
+// be lost if we crashed before processing it.
+//
+// When enabled, each synchronous input event is journalled to the database
+// before it is queued for processing, and is removed from the journal once it
+// has been processed or handed over to JetStream. Events which the caller gave
+// up waiting for are handed over to JetStream as soon as their room worker
+// gets to them, rather than waiting for a restart. On startup, anything left
+// in the journal is moved onto the JetStream input stream to be processed. This
+// gives at-least-once semantics: an event which was processed just before a
+// crash may be processed again, which is harmless since storing an event is
+// idempotent and output events are only produced once per event.
+
+func (r *Inputer) persistInputQueue() bool {
+	return r.Cfg != nil && r.Cfg.PersistInputQueue
+}
+
+// journalInput journals an input event if the input queue is persistent,
+// returning true if it was journalled. Failures are logged rather than
+// returned, since we can still process the event, just not durably.
+func (r *Inputer) journalInput(ctx context.Context, input *api.InputRoomEvent) bool {
+	if !r.persistInputQueue() {
+		return false
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":  input.Event.RoomID(),
+		"event_id": input.Event.EventID(),
+	})
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal input event for the journal")
+		return false
+	}
+	if err = r.DB.AddPendingInput(
+		ctx, input.Event.RoomID(), input.Event.EventID(), inputJSON, gomatrixserverlib.AsTimestamp(time.Now()),
+	); err != nil {
+		logger.WithError(err).Error("Failed to journal input event")
+		return false
+	}
+	return true
+}
+
+// unjournalInput removes an input event from the journal once it has been
+// dealt with. This deliberately doesn't use the caller's context, since the
+// caller may have given up by the time the event is processed.
+func (r *Inputer) unjournalInput(input *api.InputRoomEvent) {
+	if err := r.DB.RemovePendingInput(context.Background(), input.Event.EventID()); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"room_id":  input.Event.RoomID(),
+			"event_id": input.Event.EventID(),
+		}).Error("Failed to remove input event from the journal")
+	}
+}
+
+// resumePendingInput moves any input events left in the journal, because we
+// stopped before processing them, onto the JetStream input stream. This must
+// be called before we start accepting synchronous input.
+func (r *Inputer) resumePendingInput(ctx context.Context) error {
+	inputs, err := r.DB.GetPendingInput(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetPendingInput: %w", err)
+	}
+	for _, inputJSON := range inputs {
+		var input api.InputRoomEvent
+		if err = json.Unmarshal(inputJSON, &input); err != nil {
+			// There's nothing we can do with this, but leave it in the
+			// journal in case someone wants to look at it.
+			logrus.WithError(err).Error("Failed to unmarshal journalled input event")
+			continue
+		}
+		msg, err := r.inputRoomEventMsg(&input)
+		if err != nil {
+			return fmt.Errorf("r.inputRoomEventMsg: %w", err)
+		}
+		if _, err = r.JetStream.PublishMsg(msg); err != nil {
+			return fmt.Errorf("r.JetStream.PublishMsg: %w", err)
+		}
+		if err = r.DB.RemovePendingInput(ctx, input.Event.EventID()); err != nil {
+			return fmt.Errorf("r.DB.RemovePendingInput: %w", err)
+		}
+	}
+	if len(inputs) > 0 {
+		logrus.WithField("events", len(inputs)).Info("Resumed input events which were pending when the roomserver stopped")
+	}
+	return nil
+}
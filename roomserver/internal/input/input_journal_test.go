@@ -0,0 +1,160 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeJournalDB stores the input journal in memory. It outlives the Inputers
+// which use it, in the same way that the database outlives the process.
+// Calling any other storage.Database method will panic.
+type fakeJournalDB struct {
+	storage.Database
+	mu      sync.Mutex
+	pending map[string][]byte
+}
+
+func (d *fakeJournalDB) AddPendingInput(ctx context.Context, roomID, eventID string, inputJSON []byte, queuedAt gomatrixserverlib.Timestamp) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[eventID] = inputJSON
+	return nil
+}
+
+func (d *fakeJournalDB) RemovePendingInput(ctx context.Context, eventID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, eventID)
+	return nil
+}
+
+func (d *fakeJournalDB) GetPendingInput(ctx context.Context) ([][]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var inputs [][]byte
+	for _, inputJSON := range d.pending {
+		inputs = append(inputs, inputJSON)
+	}
+	return inputs, nil
+}
+
+func TestPendingInputIsResumedAfterRestart(t *testing.T) {
+	db := &fakeJournalDB{pending: map[string][]byte{}}
+	cfg := &config.RoomServer{PersistInputQueue: true}
+	event := mustCreateEvent(t, map[string]interface{}{"event_id": "$pending:localhost"})
+
+	// Submit an event synchronously while the room worker is busy, and give
+	// up waiting before it gets to the event. This is as far as we get before
+	// "crashing": the event has been accepted but not processed.
+	before := &Inputer{Cfg: cfg, DB: db, JetStream: &fakeJetStream{}, InputRoomEventTopic: "input"}
+	busy := make(chan struct{})
+	defer func() {
+		close(busy)
+		phony.Block(before.workerForRoom(event.RoomID()), func() {})
+	}()
+	before.workerForRoom(event.RoomID()).Act(nil, func() { <-busy })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	res := &api.InputRoomEventsResponse{}
+	before.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{
+			Kind:  api.KindNew,
+			Event: event.Headered(gomatrixserverlib.RoomVersionV1),
+		}},
+	}, res)
+	if res.ErrMsg == "" {
+		t.Fatalf("expected the input request to time out")
+	}
+	if len(db.pending) != 1 {
+		t.Fatalf("expected the unprocessed event to be journalled, got %d journalled events", len(db.pending))
+	}
+
+	// After restarting, the event should be queued onto the input stream.
+	js := &fakeJetStream{}
+	after := &Inputer{Cfg: cfg, DB: db, JetStream: js, InputRoomEventTopic: "input"}
+	if err := after.resumePendingInput(context.Background()); err != nil {
+		t.Fatalf("resumePendingInput: %s", err)
+	}
+	if len(js.published) != 1 {
+		t.Fatalf("expected 1 event to be queued for input, got %d", len(js.published))
+	}
+	var input api.InputRoomEvent
+	if err := json.Unmarshal(js.published[0].Data, &input); err != nil {
+		t.Fatal(err)
+	}
+	if input.Event.EventID() != event.EventID() || input.Kind != api.KindNew {
+		t.Fatalf("queued the wrong input event: %s (kind %d)", input.Event.EventID(), input.Kind)
+	}
+	if js.published[0].Header.Get("room_id") != event.RoomID() {
+		t.Fatalf("queued input event has the wrong room ID header")
+	}
+	if len(db.pending) != 0 {
+		t.Fatalf("expected the journal to be empty, got %d journalled events", len(db.pending))
+	}
+}
+
+func TestAbandonedInputIsQueued(t *testing.T) {
+	db := &fakeJournalDB{pending: map[string][]byte{}}
+	cfg := &config.RoomServer{PersistInputQueue: true}
+	event := mustCreateEvent(t, map[string]interface{}{"event_id": "$abandoned:localhost"})
+
+	// Submit an event synchronously while the room worker is busy, and give
+	// up waiting before it gets to the event.
+	js := &fakeJetStream{}
+	r := &Inputer{Cfg: cfg, DB: db, JetStream: js, InputRoomEventTopic: "input"}
+	busy := make(chan struct{})
+	r.workerForRoom(event.RoomID()).Act(nil, func() { <-busy })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	res := &api.InputRoomEventsResponse{}
+	r.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{
+			Kind:  api.KindNew,
+			Event: event.Headered(gomatrixserverlib.RoomVersionV1),
+		}},
+	}, res)
+	if res.ErrMsg == "" {
+		t.Fatalf("expected the input request to time out")
+	}
+
+	// Once the worker gets to the event, it should be queued onto the input
+	// stream straight away rather than being left in the journal.
+	close(busy)
+	phony.Block(r.workerForRoom(event.RoomID()), func() {})
+	if len(js.published) != 1 {
+		t.Fatalf("expected 1 event to be queued for input, got %d", len(js.published))
+	}
+	var input api.InputRoomEvent
+	if err := json.Unmarshal(js.published[0].Data, &input); err != nil {
+		t.Fatal(err)
+	}
+	if input.Event.EventID() != event.EventID() {
+		t.Fatalf("queued the wrong input event: %s", input.Event.EventID())
+	}
+	if len(db.pending) != 0 {
+		t.Fatalf("expected the journal to be empty, got %d journalled events", len(db.pending))
+	}
+}
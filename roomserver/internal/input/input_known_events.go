@@ -0,0 +1,104 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(knownAuthEventsPerEvent, knownAuthEventsLimitExceeded, authChainLengthExceeded)
+}
+
+var knownAuthEventsPerEvent = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "known_auth_events_per_event",
+		Help:      "How many auth events were held in memory at once while processing an event",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
+	},
+)
+
+var knownAuthEventsLimitExceeded = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "known_auth_events_limit_exceeded_total",
+		Help:      "Number of events which were given up on because they needed too many auth events in memory at once",
+	},
+)
+
+var authChainLengthExceeded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "auth_chain_length_exceeded_total",
+		Help:      "Number of auth chains from remote servers which were refused because they were too long",
+	},
+	[]string{"server"},
+)
+
+// errTooManyKnownAuthEvents is returned by fetchAuthEvents when processing an
+// event would need more auth events in memory at once than we allow.
+var errTooManyKnownAuthEvents = errors.New("too many auth events")
+
+func (r *Inputer) maxKnownAuthEvents() int {
+	if r.Cfg == nil {
+		return 0
+	}
+	return r.Cfg.MaxKnownAuthEvents
+}
+
+// checkKnownAuthEventsLimit returns an error if holding the given number of
+// auth events in memory while processing an event would exceed the limit.
+// The auth events that we know about are only ever added to while processing
+// an event, so checking before adding new ones bounds the peak.
+func (r *Inputer) checkKnownAuthEventsLimit(eventID string, count int) error {
+	limit := r.maxKnownAuthEvents()
+	if limit <= 0 || count <= limit {
+		return nil
+	}
+	knownAuthEventsLimitExceeded.Inc()
+	return fmt.Errorf("%w: event %s needs %d auth events, the limit is %d", errTooManyKnownAuthEvents, eventID, count, limit)
+}
+
+// errAuthChainTooLong is returned by fetchAuthEvents when a server gives us
+// an auth chain which is longer than we allow.
+var errAuthChainTooLong = errors.New("auth chain too long")
+
+func (r *Inputer) maxAuthChainLength() int {
+	if r.Cfg == nil {
+		return 0
+	}
+	return r.Cfg.MaxAuthChainLength
+}
+
+// checkAuthChainLength returns an error if the auth chain that the server gave
+// us for an event is longer than the limit. This is checked before anything
+// is done with the auth chain, so that a server can't make us waste time
+// verifying or storing an abusively large one.
+func (r *Inputer) checkAuthChainLength(eventID string, serverName gomatrixserverlib.ServerName, length int) error {
+	limit := r.maxAuthChainLength()
+	if limit <= 0 || length <= limit {
+		return nil
+	}
+	authChainLengthExceeded.WithLabelValues(string(serverName)).Inc()
+	return fmt.Errorf("%w: %s gave us %d auth events for event %s, the limit is %d", errAuthChainTooLong, serverName, length, eventID, limit)
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFetchAuthEventsKnownEventsLimit(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Build a long auth chain, where each event is authed by the one before.
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	chain := []*gomatrixserverlib.Event{create}
+	for i := 0; i < 8; i++ {
+		prev := chain[len(chain)-1]
+		chain = append(chain, mustBuildSignedEvent(t, private, int64(i+2), "m.room.topic", "", map[string]interface{}{
+			"topic": "test",
+		}, []string{prev.EventID()}))
+	}
+	event := mustBuildSignedEvent(t, private, 10, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{chain[len(chain)-1].EventID()})
+
+	for _, tc := range []struct {
+		limit   int
+		wantErr bool
+	}{
+		{0, false},
+		{len(chain), false},
+		{len(chain) - 1, true},
+	} {
+		db := &fakeAuthFallbackDB{events: map[string]types.Event{}}
+		r := &Inputer{
+			Cfg: &config.RoomServer{MaxKnownAuthEvents: tc.limit},
+			DB:  db,
+			FSAPI: &fakeAuthFallbackFSAPI{
+				keyRing:   &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+				events:    map[string]*gomatrixserverlib.Event{},
+				eventAuth: chain,
+			},
+		}
+		auth := gomatrixserverlib.NewAuthEvents(nil)
+		known := map[string]*types.Event{}
+		err = r.fetchAuthEvents(
+			context.Background(), logrus.WithField("test", t.Name()),
+			event.Headered(gomatrixserverlib.RoomVersionV6), &auth, known,
+			[]gomatrixserverlib.ServerName{"remote"},
+		)
+		if !tc.wantErr {
+			if err != nil {
+				t.Fatalf("limit %d: %s", tc.limit, err)
+			}
+			if len(db.stored) != len(chain) {
+				t.Fatalf("limit %d: stored %d events, want %d", tc.limit, len(db.stored), len(chain))
+			}
+			continue
+		}
+		if !errors.Is(err, errTooManyKnownAuthEvents) {
+			t.Fatalf("limit %d: expected errTooManyKnownAuthEvents, got %v", tc.limit, err)
+		}
+		if len(db.stored) != 0 || len(known) != 0 {
+			t.Fatalf("limit %d: expected nothing to be stored or known, stored %d and knew %d", tc.limit, len(db.stored), len(known))
+		}
+	}
+}
+
+func TestFetchAuthEventsRefusesLongAuthChains(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	chain := []*gomatrixserverlib.Event{create}
+	for i := 0; i < 5; i++ {
+		prev := chain[len(chain)-1]
+		chain = append(chain, mustBuildSignedEvent(t, private, int64(i+2), "m.room.topic", "", map[string]interface{}{
+			"topic": "test",
+		}, []string{prev.EventID()}))
+	}
+	event := mustBuildSignedEvent(t, private, 7, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{chain[len(chain)-1].EventID()})
+
+	db := &fakeAuthFallbackDB{events: map[string]types.Event{}}
+	r := &Inputer{
+		Cfg: &config.RoomServer{MaxAuthChainLength: len(chain) - 1},
+		DB:  db,
+		// There's no key ring, so this would fail differently if the
+		// signatures were checked before the length of the auth chain.
+		FSAPI: &fakeAuthFallbackFSAPI{
+			events:    map[string]*gomatrixserverlib.Event{},
+			eventAuth: chain,
+		},
+	}
+	auth := gomatrixserverlib.NewAuthEvents(nil)
+	err = r.fetchAuthEvents(
+		context.Background(), logrus.WithField("test", t.Name()),
+		event.Headered(gomatrixserverlib.RoomVersionV6), &auth, map[string]*types.Event{},
+		[]gomatrixserverlib.ServerName{"remote"},
+	)
+	if !errors.Is(err, errAuthChainTooLong) {
+		t.Fatalf("expected errAuthChainTooLong, got %v", err)
+	}
+	if want := "remote gave us 6 auth events"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected the error to say %q, got %q", want, err)
+	}
+	if len(db.stored) != 0 {
+		t.Fatalf("expected nothing to be stored, stored %v", db.stored)
+	}
+}
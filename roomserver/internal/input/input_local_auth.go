@@ -0,0 +1,106 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(localAuthEventsFastPath)
+}
+
+var localAuthEventsFastPath = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "local_auth_events_fast_path_total",
+		Help:      "Number of new local events whose auth events were loaded without the federation fetch machinery, by whether they were all known",
+	},
+	[]string{"result"},
+)
+
+func (r *Inputer) trustLocalAuthEvents() bool {
+	if r.Cfg == nil {
+		return false
+	}
+	return r.Cfg.TrustLocalAuthEvents
+}
+
+// loadLocalAuthEvents is a fast path for new events which were created on
+// this server, whose auth events are always already known to us. If all of
+// the auth events of the event are in the database then they are added to
+// auth and known, and true is returned, so that the caller doesn't need to
+// call fetchAuthEvents. Otherwise nothing is changed and false is returned,
+// and the caller should fetch the auth events as usual. Events which were
+// received over federation never take the fast path, and the auth checks
+// against the auth events still happen either way.
+func (r *Inputer) loadLocalAuthEvents(
+	ctx context.Context,
+	logger *logrus.Entry,
+	input *api.InputRoomEvent,
+	auth *gomatrixserverlib.AuthEvents,
+	known map[string]*types.Event,
+) bool {
+	if !r.trustLocalAuthEvents() || input.Kind != api.KindNew || input.Origin != "" {
+		return false
+	}
+	event := input.Event
+	if _, domain, err := gomatrixserverlib.SplitID('@', event.Sender()); err != nil || domain != r.ServerName {
+		return false
+	}
+	authEventIDs := event.AuthEventIDs()
+	if len(authEventIDs) == 0 {
+		return false
+	}
+	authEvents, err := r.DB.EventsFromIDs(ctx, authEventIDs)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load auth events of local event, fetching them instead")
+		localAuthEventsFastPath.WithLabelValues("error").Inc()
+		return false
+	}
+	found := make(map[string]*types.Event, len(authEvents))
+	for i := range authEvents {
+		if authEvents[i].Event != nil {
+			found[authEvents[i].EventID()] = &authEvents[i]
+		}
+	}
+	for _, authEventID := range authEventIDs {
+		if _, ok := found[authEventID]; !ok {
+			localAuthEventsFastPath.WithLabelValues("missing").Inc()
+			return false
+		}
+	}
+	loaded := gomatrixserverlib.NewAuthEvents(nil)
+	for _, authEventID := range authEventIDs {
+		if err = loaded.AddEvent(found[authEventID].Event); err != nil {
+			logger.WithError(err).Warn("Failed to add auth event of local event, fetching them instead")
+			localAuthEventsFastPath.WithLabelValues("error").Inc()
+			return false
+		}
+	}
+	*auth = loaded
+	for _, authEventID := range authEventIDs {
+		known[authEventID] = found[authEventID]
+	}
+	localAuthEventsFastPath.WithLabelValues("hit").Inc()
+	return true
+}
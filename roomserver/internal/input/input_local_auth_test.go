@@ -0,0 +1,146 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"testing"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// forbiddenFSAPI fails the test if anything is fetched over federation.
+type forbiddenFSAPI struct {
+	fedapi.FederationInternalAPI
+	tb testing.TB
+}
+
+func (f *forbiddenFSAPI) GetEventAuth(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string,
+) (gomatrixserverlib.RespEventAuth, error) {
+	f.tb.Fatalf("unexpected /event_auth request to %s for %s", s, eventID)
+	return gomatrixserverlib.RespEventAuth{}, nil
+}
+
+func (f *forbiddenFSAPI) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	f.tb.Fatalf("unexpected /event request to %s for %s", s, eventID)
+	return gomatrixserverlib.Transaction{}, nil
+}
+
+// newLocalAuthInputer returns an Inputer which knows about the create and
+// join events of a room, and an event in the room which they are the auth
+// events of.
+func newLocalAuthInputer(tb testing.TB) (*Inputer, *gomatrixserverlib.Event) {
+	ref := func(eventIDs ...string) [][]interface{} {
+		var refs [][]interface{}
+		for _, eventID := range eventIDs {
+			refs = append(refs, []interface{}{eventID, map[string]string{"sha256": ""}})
+		}
+		return refs
+	}
+	create := mustCreateEvent(tb, map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "",
+		"content": map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(tb, map[string]interface{}{
+		"event_id": "$join:localhost", "type": gomatrixserverlib.MRoomMember, "state_key": "@test:localhost",
+		"content": map[string]interface{}{"membership": "join"}, "auth_events": ref("$create:localhost"),
+	})
+	event := mustCreateEvent(tb, map[string]interface{}{
+		"auth_events": ref("$create:localhost", "$join:localhost"),
+	})
+	r := &Inputer{
+		Cfg:        &config.RoomServer{TrustLocalAuthEvents: true},
+		ServerName: "localhost",
+		DB: &fakeAuthFallbackDB{events: map[string]types.Event{
+			create.EventID(): {EventNID: 1, Event: create},
+			join.EventID():   {EventNID: 2, Event: join},
+		}},
+		FSAPI: &forbiddenFSAPI{tb: tb},
+	}
+	return r, event
+}
+
+func TestLoadLocalAuthEvents(t *testing.T) {
+	r, event := newLocalAuthInputer(t)
+	logger := logrus.WithField("test", t.Name())
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: event.Headered(gomatrixserverlib.RoomVersionV1)}
+
+	auth := gomatrixserverlib.NewAuthEvents(nil)
+	known := map[string]*types.Event{}
+	if !r.loadLocalAuthEvents(context.Background(), logger, input, &auth, known) {
+		t.Fatal("expected a local event to take the fast path")
+	}
+	if len(known) != 2 || known["$create:localhost"] == nil || known["$join:localhost"] == nil {
+		t.Fatalf("expected both auth events to be known, got %v", known)
+	}
+	if err := gomatrixserverlib.Allowed(event, &auth); err != nil {
+		t.Fatalf("expected the event to be allowed by its auth events: %s", err)
+	}
+
+	// Events received over federation, or from remote senders, never take
+	// the fast path, and nor do events whose auth events we don't have.
+	for name, modify := range map[string]func(*Inputer, *api.InputRoomEvent){
+		"federated":     func(r *Inputer, input *api.InputRoomEvent) { input.Origin = "remote" },
+		"remote sender": func(r *Inputer, input *api.InputRoomEvent) { r.ServerName = "elsewhere" },
+		"missing auth": func(r *Inputer, input *api.InputRoomEvent) {
+			delete(r.DB.(*fakeAuthFallbackDB).events, "$join:localhost")
+		},
+		"disabled":        func(r *Inputer, input *api.InputRoomEvent) { r.Cfg.TrustLocalAuthEvents = false },
+		"not a new event": func(r *Inputer, input *api.InputRoomEvent) { input.Kind = api.KindOld },
+	} {
+		r, event = newLocalAuthInputer(t)
+		input = &api.InputRoomEvent{Kind: api.KindNew, Event: event.Headered(gomatrixserverlib.RoomVersionV1)}
+		modify(r, input)
+		auth = gomatrixserverlib.NewAuthEvents(nil)
+		known = map[string]*types.Event{}
+		if r.loadLocalAuthEvents(context.Background(), logger, input, &auth, known) {
+			t.Fatalf("%s: expected the fast path not to be taken", name)
+		}
+		if len(known) != 0 {
+			t.Fatalf("%s: expected nothing to be known, got %v", name, known)
+		}
+	}
+}
+
+func BenchmarkLoadAuthEventsForLocalEvent(b *testing.B) {
+	r, event := newLocalAuthInputer(b)
+	logger := logrus.WithField("benchmark", b.Name())
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: event.Headered(gomatrixserverlib.RoomVersionV1)}
+
+	b.Run("fetchAuthEvents", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			auth := gomatrixserverlib.NewAuthEvents(nil)
+			if err := r.fetchAuthEvents(context.Background(), logger, input.Event, &auth, map[string]*types.Event{}, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("loadLocalAuthEvents", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			auth := gomatrixserverlib.NewAuthEvents(nil)
+			if !r.loadLocalAuthEvents(context.Background(), logger, input, &auth, map[string]*types.Event{}) {
+				b.Fatal("expected the fast path to be taken")
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(roomsInMaintenance)
+	prometheus.MustRegister(maintenanceDeferredEvents)
+}
+
+var roomsInMaintenance = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "rooms_in_maintenance",
+		Help:      "Set to 1 for each room that is in maintenance mode",
+	},
+	[]string{"room_id"},
+)
+
+var maintenanceDeferredEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "maintenance_deferred_events_total",
+		Help:      "Number of times a new event was deferred because its room was in maintenance mode",
+	},
+	[]string{"room_id"},
+)
+
+// errRoomInMaintenance is returned by processRoomEvent when a new event is
+// received for a room in maintenance mode. The event hasn't been processed and
+// should be retried later.
+var errRoomInMaintenance = errors.New("room is in maintenance mode")
+
+// loadRoomMaintenance populates the in-memory set of rooms in maintenance mode
+// from the database. This must be called before we start consuming input events
+// so that events for rooms in maintenance mode aren't processed after a restart.
+func (r *Inputer) loadRoomMaintenance(ctx context.Context) error {
+	roomIDs, err := r.DB.GetRoomsInMaintenance(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetRoomsInMaintenance: %w", err)
+	}
+	for _, roomID := range roomIDs {
+		r.maintenance.Store(roomID, struct{}{})
+		roomsInMaintenance.WithLabelValues(roomID).Set(1)
+	}
+	return nil
+}
+
+// SetRoomMaintenance puts a room into, or takes a room out of, maintenance mode.
+// While a room is in maintenance mode, new events for it are deferred rather
+// than processed. The setting is persisted so that it survives restarts.
+func (r *Inputer) SetRoomMaintenance(ctx context.Context, roomID string, enabled bool) error {
+	if err := r.DB.SetRoomMaintenance(ctx, roomID, enabled); err != nil {
+		return fmt.Errorf("r.DB.SetRoomMaintenance: %w", err)
+	}
+	if enabled {
+		r.maintenance.Store(roomID, struct{}{})
+		roomsInMaintenance.WithLabelValues(roomID).Set(1)
+	} else {
+		r.maintenance.Delete(roomID)
+		roomsInMaintenance.DeleteLabelValues(roomID)
+	}
+	return nil
+}
+
+func (r *Inputer) isRoomInMaintenance(roomID string) bool {
+	_, ok := r.maintenance.Load(roomID)
+	return ok
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeMaintenanceDB stores the rooms in maintenance mode in memory. Calling
+// any other storage.Database method will panic.
+type fakeMaintenanceDB struct {
+	storage.Database
+	rooms map[string]struct{}
+}
+
+func (d *fakeMaintenanceDB) SetRoomMaintenance(ctx context.Context, roomID string, enabled bool) error {
+	if enabled {
+		d.rooms[roomID] = struct{}{}
+	} else {
+		delete(d.rooms, roomID)
+	}
+	return nil
+}
+
+func (d *fakeMaintenanceDB) GetRoomsInMaintenance(ctx context.Context) ([]string, error) {
+	var roomIDs []string
+	for roomID := range d.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, nil
+}
+
+func TestDeferredInputRetryDelay(t *testing.T) {
+	tests := map[uint64]time.Duration{
+		0:    time.Second,
+		1:    time.Second,
+		2:    time.Second * 2,
+		3:    time.Second * 4,
+		7:    time.Second * 60,
+		1000: time.Second * 60,
+	}
+	for numDelivered, want := range tests {
+		if got := deferredInputRetryDelay(numDelivered); got != want {
+			t.Errorf("deferredInputRetryDelay(%d): wanted %s, got %s", numDelivered, want, got)
+		}
+	}
+}
+
+func TestRoomMaintenanceDefersNewEvents(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeMaintenanceDB{rooms: map[string]struct{}{}}
+	r := &Inputer{DB: db}
+	event := mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)
+
+	if err := r.SetRoomMaintenance(ctx, event.RoomID(), true); err != nil {
+		t.Fatal(err)
+	}
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: event}
+	if _, err := r.processRoomEvent(ctx, input); !errors.Is(err, errRoomInMaintenance) {
+		t.Fatalf("expected errRoomInMaintenance, got %v", err)
+	}
+
+	// Maintenance mode must survive a restart.
+	restarted := &Inputer{DB: db}
+	if err := restarted.loadRoomMaintenance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.isRoomInMaintenance(event.RoomID()) {
+		t.Fatal("expected room to still be in maintenance mode after restart")
+	}
+
+	if err := restarted.SetRoomMaintenance(ctx, event.RoomID(), false); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.isRoomInMaintenance(event.RoomID()) {
+		t.Fatal("expected room to be out of maintenance mode")
+	}
+	if _, ok := db.rooms[event.RoomID()]; ok {
+		t.Fatal("expected maintenance mode to be cleared in the database")
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
-	"time"
 
 	fedapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal"
@@ -30,6 +30,10 @@ type missingStateReq struct {
 	hadEventsMutex  sync.Mutex
 	haveEvents      map[string]*gomatrixserverlib.HeaderedEvent
 	haveEventsMutex sync.Mutex
+	// The maximum number of events to fetch over federation for this event,
+	// or zero for no limit, and how many have been fetched so far.
+	maxFetched int
+	fetched    int64
 }
 
 // processEventWithMissingState is the entrypoint for a missingStateReq
@@ -74,7 +78,7 @@ func (t *missingStateReq) processEventWithMissingState(
 		// we can just inject all the newEvents as new as we may have only missed 1 or 2 events and have filled
 		// in the gap in the DAG
 		for _, newEvent := range newEvents {
-			err = t.inputer.processRoomEvent(ctx, &api.InputRoomEvent{
+			_, err = t.inputer.processRoomEvent(ctx, &api.InputRoomEvent{
 				Kind:         api.KindNew,
 				Event:        newEvent.Headered(roomVersion),
 				Origin:       t.origin,
@@ -183,7 +187,7 @@ func (t *missingStateReq) processEventWithMissingState(
 	}
 	// TODO: we could do this concurrently?
 	for _, ire := range outlierRoomEvents {
-		if err = t.inputer.processRoomEvent(ctx, &ire); err != nil {
+		if _, err = t.inputer.processRoomEvent(ctx, &ire); err != nil {
 			return fmt.Errorf("t.inputer.processRoomEvent[outlier]: %w", err)
 		}
 	}
@@ -196,7 +200,7 @@ func (t *missingStateReq) processEventWithMissingState(
 		stateIDs = append(stateIDs, event.EventID())
 	}
 
-	err = t.inputer.processRoomEvent(ctx, &api.InputRoomEvent{
+	_, err = t.inputer.processRoomEvent(ctx, &api.InputRoomEvent{
 		Kind:          api.KindOld,
 		Event:         backwardsExtremity.Headered(roomVersion),
 		Origin:        t.origin,
@@ -213,7 +217,7 @@ func (t *missingStateReq) processEventWithMissingState(
 	// they will automatically fast-forward based on the room state at the
 	// extremity in the last step.
 	for _, newEvent := range newEvents {
-		err = t.inputer.processRoomEvent(ctx, &api.InputRoomEvent{
+		_, err = t.inputer.processRoomEvent(ctx, &api.InputRoomEvent{
 			Kind:         api.KindOld,
 			Event:        newEvent.Headered(roomVersion),
 			Origin:       t.origin,
@@ -413,19 +417,24 @@ func (t *missingStateReq) getMissingEvents(ctx context.Context, e *gomatrixserve
 	}
 
 	var missingResp *gomatrixserverlib.RespMissingEvents
-	for server := range t.servers {
+	for _, server := range t.orderedServers(e.RoomID()) {
 		var m gomatrixserverlib.RespMissingEvents
-		if m, err = t.federation.LookupMissingEvents(ctx, server, e.RoomID(), gomatrixserverlib.MissingEvents{
+		reqctx, cancel := withFederationRequestTimeout(ctx)
+		m, err = t.federation.LookupMissingEvents(reqctx, server, e.RoomID(), gomatrixserverlib.MissingEvents{
 			Limit: 20,
 			// The latest event IDs that the sender already has. These are skipped when retrieving the previous events of latest_events.
 			EarliestEvents: latestEvents,
 			// The event IDs to retrieve the previous events for.
 			LatestEvents: []string{e.EventID()},
-		}, roomVersion); err == nil {
+		}, roomVersion)
+		cancel()
+		if err == nil {
+			t.inputer.markServer(e.RoomID(), server, true)
 			missingResp = &m
 			break
 		} else {
 			logger.WithError(err).Errorf("%s pushed us an event but %q did not respond to /get_missing_events", t.origin, server)
+			t.inputer.markServer(e.RoomID(), server, false)
 			if errors.Is(err, context.DeadlineExceeded) {
 				select {
 				case <-ctx.Done(): // the parent request context timed out
@@ -451,6 +460,9 @@ func (t *missingStateReq) getMissingEvents(ctx context.Context, e *gomatrixserve
 	// Make sure events from the missingResp are using the cache - missing events
 	// will be added and duplicates will be removed.
 	logger.Infof("get_missing_events returned %d events", len(missingResp.Events))
+	if err = t.countFetched(len(missingResp.Events)); err != nil {
+		return nil, false, err
+	}
 	for i, ev := range missingResp.Events {
 		missingResp.Events[i] = t.cacheAndReturn(ev.Headered(roomVersion)).Unwrap()
 	}
@@ -499,7 +511,9 @@ Event:
 
 func (t *missingStateReq) lookupMissingStateViaState(ctx context.Context, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
 	respState *gomatrixserverlib.RespState, err error) {
-	state, err := t.federation.LookupState(ctx, t.origin, roomID, eventID, roomVersion)
+	reqctx, cancel := withFederationRequestTimeout(ctx)
+	defer cancel()
+	state, err := t.federation.LookupState(reqctx, t.origin, roomID, eventID, roomVersion)
 	if err != nil {
 		return nil, err
 	}
@@ -522,7 +536,9 @@ func (t *missingStateReq) lookupMissingStateViaStateIDs(ctx context.Context, roo
 	*gomatrixserverlib.RespState, error) {
 	util.GetLogger(ctx).WithField("room_id", roomID).Infof("lookupMissingStateViaStateIDs %s", eventID)
 	// fetch the state event IDs at the time of the event
-	stateIDs, err := t.federation.LookupStateIDs(ctx, t.origin, roomID, eventID)
+	reqctx, cancel := withFederationRequestTimeout(ctx)
+	stateIDs, err := t.federation.LookupStateIDs(reqctx, t.origin, roomID, eventID)
+	cancel()
 	if err != nil {
 		return nil, err
 	}
@@ -608,11 +624,17 @@ func (t *missingStateReq) lookupMissingStateViaStateIDs(ctx context.Context, roo
 		// multiple goroutines, and everywhere else is blocked on this
 		// synchronous function anyway.
 		var haveEventsMutex sync.Mutex
+		var limitErr error
 
 		// Define what we'll do in order to fetch the missing event ID.
 		fetch := func(missingEventID string) {
-			var h *gomatrixserverlib.HeaderedEvent
-			h, err = t.lookupEvent(ctx, roomVersion, roomID, missingEventID, false)
+			h, err := t.lookupEvent(ctx, roomVersion, roomID, missingEventID, false)
+			if errors.Is(err, errTooManyMissingEvents) {
+				haveEventsMutex.Lock()
+				limitErr = err
+				haveEventsMutex.Unlock()
+				return
+			}
 			switch err.(type) {
 			case verifySigError:
 				return
@@ -645,6 +667,9 @@ func (t *missingStateReq) lookupMissingStateViaStateIDs(ctx context.Context, roo
 
 		// Wait for the workers to finish.
 		fetchgroup.Wait()
+		if limitErr != nil {
+			return nil, limitErr
+		}
 	}
 
 	resp, err := t.createRespStateFromStateIDs(stateIDs)
@@ -681,7 +706,7 @@ func (t *missingStateReq) createRespStateFromStateIDs(stateIDs gomatrixserverlib
 	return &respState, nil
 }
 
-func (t *missingStateReq) lookupEvent(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion, _, missingEventID string, localFirst bool) (*gomatrixserverlib.HeaderedEvent, error) {
+func (t *missingStateReq) lookupEvent(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion, roomID, missingEventID string, localFirst bool) (*gomatrixserverlib.HeaderedEvent, error) {
 	if localFirst {
 		// fetch from the roomserver
 		queryReq := api.QueryEventsByIDRequest{
@@ -694,14 +719,18 @@ func (t *missingStateReq) lookupEvent(ctx context.Context, roomVersion gomatrixs
 			return queryRes.Events[0], nil
 		}
 	}
+	if err := t.countFetched(1); err != nil {
+		return nil, err
+	}
 	var event *gomatrixserverlib.Event
 	found := false
-	for serverName := range t.servers {
-		reqctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	for _, serverName := range t.orderedServers(roomID) {
+		reqctx, cancel := withFederationRequestTimeout(ctx)
 		defer cancel()
-		txn, err := t.federation.GetEvent(reqctx, serverName, missingEventID)
+		txn, err := t.inputer.eventFetches.getEvent(reqctx, t.federation, serverName, missingEventID)
 		if err != nil || len(txn.PDUs) == 0 {
 			util.GetLogger(ctx).WithError(err).WithField("event_id", missingEventID).Warn("Failed to get missing /event for event ID")
+			t.inputer.markServer(roomID, serverName, false)
 			if errors.Is(err, context.DeadlineExceeded) {
 				select {
 				case <-reqctx.Done(): // this server took too long
@@ -717,6 +746,7 @@ func (t *missingStateReq) lookupEvent(ctx context.Context, roomVersion gomatrixs
 			util.GetLogger(ctx).WithError(err).WithField("event_id", missingEventID).Warnf("Transaction: Failed to parse event JSON of event")
 			continue
 		}
+		t.inputer.markServer(roomID, serverName, true)
 		found = true
 		break
 	}
@@ -742,6 +772,20 @@ func checkAllowedByState(e *gomatrixserverlib.Event, stateEvents []*gomatrixserv
 	return gomatrixserverlib.Allowed(e, &authUsingState)
 }
 
+// orderedServers returns the servers that we can ask for events, with those
+// which recently answered for the room first and those which recently failed
+// last.
+func (t *missingStateReq) orderedServers(roomID string) []gomatrixserverlib.ServerName {
+	servers := make([]gomatrixserverlib.ServerName, 0, len(t.servers))
+	for serverName := range t.servers {
+		servers = append(servers, serverName)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i] < servers[j]
+	})
+	return t.inputer.orderServers(roomID, servers)
+}
+
 func (t *missingStateReq) hadEvent(eventID string) {
 	t.hadEventsMutex.Lock()
 	defer t.hadEventsMutex.Unlock()
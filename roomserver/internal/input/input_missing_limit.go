@@ -0,0 +1,64 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(missingEventsLimitExceeded)
+}
+
+var missingEventsLimitExceeded = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "missing_events_limit_exceeded_total",
+		Help:      "Number of events which were rejected because filling in their missing prev events and state needed too many events",
+	},
+)
+
+// errTooManyMissingEvents is returned when filling in the missing prev events
+// and state of an event would need more events than we allow.
+var errTooManyMissingEvents = errors.New("too many missing events")
+
+func (r *Inputer) maxMissingEvents() int {
+	if r.Cfg == nil {
+		return 0
+	}
+	return r.Cfg.MaxMissingEvents
+}
+
+// countFetched records that n more events are being fetched over federation
+// for the event, returning an error if that takes it over the limit. It is
+// safe to call from multiple goroutines.
+func (t *missingStateReq) countFetched(n int) error {
+	if t.maxFetched <= 0 {
+		return nil
+	}
+	fetched := atomic.AddInt64(&t.fetched, int64(n))
+	if fetched <= int64(t.maxFetched) {
+		return nil
+	}
+	if fetched-int64(n) <= int64(t.maxFetched) {
+		missingEventsLimitExceeded.Inc()
+	}
+	return fmt.Errorf("%w: needed %d events, the limit is %d", errTooManyMissingEvents, fetched, t.maxFetched)
+}
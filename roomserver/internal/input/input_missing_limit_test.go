@@ -0,0 +1,105 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// countingEventsFSAPI counts the events that are asked for over /event.
+type countingEventsFSAPI struct {
+	fakeAuthFallbackFSAPI
+	gets int
+}
+
+func (f *countingEventsFSAPI) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	f.gets++
+	return f.fakeAuthFallbackFSAPI.GetEvent(ctx, s, eventID)
+}
+
+func TestMissingEventsLimit(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a long chain of history, none of which we have.
+	events := map[string]*gomatrixserverlib.Event{}
+	prev := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, nil)
+	events[prev.EventID()] = prev
+	for depth := int64(2); depth <= 20; depth++ {
+		ev := mustBuildSignedEvent(t, private, depth, "m.room.topic", "", map[string]interface{}{
+			"topic": "more history",
+		}, []string{prev.EventID()})
+		events[ev.EventID()] = ev
+		prev = ev
+	}
+
+	const limit = 5
+	fsAPI := &countingEventsFSAPI{fakeAuthFallbackFSAPI: fakeAuthFallbackFSAPI{events: events}}
+	req := &missingStateReq{
+		inputer:    &Inputer{FSAPI: fsAPI},
+		federation: fsAPI,
+		keys:       &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+		servers:    map[gomatrixserverlib.ServerName]struct{}{"remote": {}},
+		haveEvents: map[string]*gomatrixserverlib.HeaderedEvent{},
+		maxFetched: limit,
+	}
+
+	// Walk back through the chain until the limit stops us.
+	eventID := prev.PrevEventIDs()[0]
+	fetched := 0
+	for {
+		ev, lerr := req.lookupEvent(context.Background(), gomatrixserverlib.RoomVersionV6, "!room:remote", eventID, false)
+		if lerr != nil {
+			err = lerr
+			break
+		}
+		fetched++
+		prevIDs := ev.PrevEventIDs()
+		if len(prevIDs) == 0 {
+			break
+		}
+		eventID = prevIDs[0]
+	}
+	if !errors.Is(err, errTooManyMissingEvents) {
+		t.Fatalf("expected the walk to stop at the limit, got %v", err)
+	}
+	if fetched != limit || fsAPI.gets != limit {
+		t.Fatalf("fetched %d events with %d requests, want %d", fetched, fsAPI.gets, limit)
+	}
+
+	// The limit is per event, so another event can fetch its own.
+	other := &missingStateReq{
+		inputer:    req.inputer,
+		federation: fsAPI,
+		keys:       req.keys,
+		servers:    req.servers,
+		haveEvents: map[string]*gomatrixserverlib.HeaderedEvent{},
+		maxFetched: limit,
+	}
+	if _, err = other.lookupEvent(context.Background(), gomatrixserverlib.RoomVersionV6, "!room:remote", eventID, false); err != nil {
+		t.Fatalf("expected another event to have its own limit, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(nonMemberOriginEventsCounter)
+}
+
+var nonMemberOriginEventsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "non_member_origin_events_total",
+		Help:      "Number of new events received from origin servers that aren't in the room, by action",
+	},
+	[]string{"action"},
+)
+
+// checkNonMemberOrigin applies the configured policy for new events that were
+// sent to us by a server that isn't in the room according to the current room
+// state. It returns whether the event was flagged and whether it should be
+// soft-failed as a result. Backfilled and outlier events are never passed
+// through here, since they are routinely fetched from any server.
+func (r *Inputer) checkNonMemberOrigin(
+	ctx context.Context, event *gomatrixserverlib.Event, origin gomatrixserverlib.ServerName,
+) (flagged, softfail bool, err error) {
+	if r.Cfg == nil {
+		return false, false, nil
+	}
+	action := r.Cfg.NonMemberOrigins.Action
+	switch action {
+	case config.NonMemberOriginsActionFlag, config.NonMemberOriginsActionSoftFail:
+	default:
+		return false, false, nil
+	}
+	if origin == "" || origin == r.ServerName {
+		return false, false, nil
+	}
+	// A server sending a membership event for one of its own users is how
+	// that server joins, or knocks on, the room in the first place.
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKey() != nil {
+		if _, domain, derr := gomatrixserverlib.SplitID('@', *event.StateKey()); derr == nil && domain == origin {
+			return false, false, nil
+		}
+	}
+	roomInfo, err := r.DB.RoomInfo(ctx, event.RoomID())
+	if err != nil {
+		return false, false, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		// We don't have any current state to compare against.
+		return false, false, nil
+	}
+	inRoom, err := r.DB.GetServerInRoom(ctx, roomInfo.RoomNID, origin)
+	if err != nil {
+		return false, false, fmt.Errorf("r.DB.GetServerInRoom: %w", err)
+	}
+	if inRoom {
+		return false, false, nil
+	}
+	nonMemberOriginEventsCounter.WithLabelValues(action).Inc()
+	return true, action == config.NonMemberOriginsActionSoftFail, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeRoomMembersDB knows about a single room and which servers are in it.
+// Calling any other storage.Database method will panic.
+type fakeRoomMembersDB struct {
+	storage.Database
+	roomID  string
+	servers map[gomatrixserverlib.ServerName]bool
+}
+
+func (d *fakeRoomMembersDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != d.roomID {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (d *fakeRoomMembersDB) GetServerInRoom(ctx context.Context, roomNID types.RoomNID, serverName gomatrixserverlib.ServerName) (bool, error) {
+	return d.servers[serverName], nil
+}
+
+func TestCheckNonMemberOrigin(t *testing.T) {
+	db := &fakeRoomMembersDB{
+		roomID:  "!test:localhost",
+		servers: map[gomatrixserverlib.ServerName]bool{"localhost": true, "member.com": true},
+	}
+	message := mustCreateEvent(t, nil)
+	otherRoom := mustCreateEvent(t, map[string]interface{}{"room_id": "!other:localhost"})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"type":      "m.room.member",
+		"state_key": "@alice:joining.com",
+		"sender":    "@alice:joining.com",
+		"content":   map[string]interface{}{"membership": "join"},
+	})
+
+	tests := []struct {
+		name         string
+		action       string
+		event        *gomatrixserverlib.Event
+		origin       gomatrixserverlib.ServerName
+		wantFlagged  bool
+		wantSoftFail bool
+	}{
+		{"allow non-member", config.NonMemberOriginsActionAllow, message, "stranger.com", false, false},
+		{"flag member", config.NonMemberOriginsActionFlag, message, "member.com", false, false},
+		{"flag non-member", config.NonMemberOriginsActionFlag, message, "stranger.com", true, false},
+		{"soft fail member", config.NonMemberOriginsActionSoftFail, message, "member.com", false, false},
+		{"soft fail non-member", config.NonMemberOriginsActionSoftFail, message, "stranger.com", true, true},
+		{"soft fail local", config.NonMemberOriginsActionSoftFail, message, "localhost", false, false},
+		{"soft fail no origin", config.NonMemberOriginsActionSoftFail, message, "", false, false},
+		{"soft fail unknown room", config.NonMemberOriginsActionSoftFail, otherRoom, "stranger.com", false, false},
+		{"soft fail own join", config.NonMemberOriginsActionSoftFail, join, "joining.com", false, false},
+		{"soft fail relayed join", config.NonMemberOriginsActionSoftFail, join, "stranger.com", true, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Inputer{
+				DB:         db,
+				ServerName: "localhost",
+				Cfg: &config.RoomServer{
+					NonMemberOrigins: config.NonMemberOriginsOptions{Action: tc.action},
+				},
+			}
+			flagged, softfail, err := r.checkNonMemberOrigin(context.Background(), tc.event, tc.origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if flagged != tc.wantFlagged || softfail != tc.wantSoftFail {
+				t.Errorf("got flagged=%v softfail=%v, want flagged=%v softfail=%v", flagged, softfail, tc.wantFlagged, tc.wantSoftFail)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(originEventsProcessed)
+	prometheus.MustRegister(originProcessingTime)
+	prometheus.MustRegister(originQuotaExceeded)
+}
+
+var originEventsProcessed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "origin_events_total",
+		Help:      "Number of input events processed, by origin server. Less busy servers are aggregated as \"other\"",
+	},
+	[]string{"origin"},
+)
+
+var originProcessingTime = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "origin_processing_seconds_total",
+		Help:      "Time spent processing input events, by origin server. Less busy servers are aggregated as \"other\"",
+	},
+	[]string{"origin"},
+)
+
+var originQuotaExceeded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "origin_quota_exceeded_total",
+		Help:      "Number of new events which were over their origin server's quota, by action taken",
+	},
+	[]string{"action"},
+)
+
+// errOriginQuotaExceeded is returned by processRoomEvent when a new event is
+// received from an origin server that is over its quota and the configured
+// action is to defer. The event hasn't been processed and should be retried later.
+var errOriginQuotaExceeded = errors.New("origin server is over its quota")
+
+const (
+	// originOther is the metric label used for origin servers that aren't
+	// among the busiest.
+	originOther = "other"
+	// originWindow is how often we work out which origin servers are the
+	// busiest, based on the number of events seen from each since last time.
+	originWindow = time.Minute * 10
+)
+
+// originTracker attributes input events to their origin servers, for metrics
+// and quotas. The zero value is ready to use.
+//
+// To keep the number of metric series bounded, only the busiest origin servers
+// get their own labels. Until the first window has passed, the first servers
+// seen are labelled. After each window, the servers which sent the most events
+// during that window are labelled, and the series for servers which are no
+// longer among the busiest are removed.
+type originTracker struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]uint64       // events seen from each server in this window
+	labelled    map[string]struct{}     // servers with their own metric labels
+	buckets     map[string]*originQuota // quota state for each server
+}
+
+// originQuota is a token bucket.
+type originQuota struct {
+	tokens float64
+	last   time.Time
+}
+
+func (t *originTracker) init(now time.Time) {
+	if t.counts == nil {
+		t.windowStart = now
+		t.counts = make(map[string]uint64)
+		t.labelled = make(map[string]struct{})
+		t.buckets = make(map[string]*originQuota)
+	}
+}
+
+// observe records that an event from the given origin server took the given
+// time to process.
+func (t *originTracker) observe(origin string, topServers int, took time.Duration, now time.Time) {
+	label := t.label(origin, topServers, now)
+	originEventsProcessed.WithLabelValues(label).Inc()
+	originProcessingTime.WithLabelValues(label).Add(took.Seconds())
+}
+
+// label counts an event from the given origin server and returns the metric
+// label to use for it.
+func (t *originTracker) label(origin string, topServers int, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init(now)
+	if now.Sub(t.windowStart) >= originWindow {
+		t.rotate(topServers, now)
+	}
+	t.counts[origin]++
+	if _, ok := t.labelled[origin]; ok {
+		return origin
+	}
+	if len(t.labelled) < topServers {
+		t.labelled[origin] = struct{}{}
+		return origin
+	}
+	return originOther
+}
+
+// rotate starts a new window, labelling the busiest servers from the window
+// that has just finished. Must be called with the mutex held.
+func (t *originTracker) rotate(topServers int, now time.Time) {
+	labelled := make(map[string]struct{}, topServers)
+	for _, origin := range busiestOrigins(t.counts, topServers) {
+		labelled[origin] = struct{}{}
+	}
+	for origin := range t.labelled {
+		if _, ok := labelled[origin]; !ok {
+			originEventsProcessed.DeleteLabelValues(origin)
+			originProcessingTime.DeleteLabelValues(origin)
+		}
+	}
+	t.labelled = labelled
+	t.counts = make(map[string]uint64, len(t.counts))
+	t.windowStart = now
+}
+
+// busiestOrigins returns up to n origin servers with the highest counts,
+// busiest first. Ties are broken by server name so that the result is stable.
+func busiestOrigins(counts map[string]uint64, n int) []string {
+	origins := make([]string, 0, len(counts))
+	for origin := range counts {
+		origins = append(origins, origin)
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		if counts[origins[i]] != counts[origins[j]] {
+			return counts[origins[i]] > counts[origins[j]]
+		}
+		return origins[i] < origins[j]
+	})
+	if len(origins) > n {
+		origins = origins[:n]
+	}
+	return origins
+}
+
+// allow returns true if the origin server is within its quota, in which case
+// the event counts towards the quota.
+func (t *originTracker) allow(origin string, opts config.OriginLimitsOptions, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init(now)
+	burst := float64(opts.Burst)
+	quota, ok := t.buckets[origin]
+	if !ok {
+		quota = &originQuota{tokens: burst, last: now}
+		t.buckets[origin] = quota
+	}
+	quota.tokens += now.Sub(quota.last).Seconds() * opts.EventsPerSecond
+	if quota.tokens > burst {
+		quota.tokens = burst
+	}
+	quota.last = now
+	if quota.tokens < 1 {
+		return false
+	}
+	quota.tokens--
+	// Servers which have a full bucket are no different to servers that we
+	// haven't seen, so forget about them to stop the map growing forever.
+	// We only do this occasionally, since it means looking at every server.
+	if len(t.buckets) > 1 && now.Sub(t.windowStart) >= originWindow {
+		for o, q := range t.buckets {
+			if q.tokens+now.Sub(q.last).Seconds()*opts.EventsPerSecond >= burst {
+				delete(t.buckets, o)
+			}
+		}
+	}
+	return true
+}
+
+func (r *Inputer) originLimits() config.OriginLimitsOptions {
+	if r.Cfg == nil {
+		return config.OriginLimitsOptions{}
+	}
+	return r.Cfg.OriginLimits
+}
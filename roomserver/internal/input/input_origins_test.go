@@ -0,0 +1,103 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestOriginTrackerQuota(t *testing.T) {
+	var tracker originTracker
+	opts := config.OriginLimitsOptions{EventsPerSecond: 2, Burst: 3}
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if !tracker.allow("a.com", opts, now) {
+			t.Fatalf("event %d: expected to be allowed within burst", i)
+		}
+	}
+	if tracker.allow("a.com", opts, now) {
+		t.Fatal("expected event to be over quota after burst")
+	}
+	if !tracker.allow("b.com", opts, now) {
+		t.Fatal("expected other origin servers to have their own quota")
+	}
+
+	// After half a second at 2 events/sec, one more event is allowed.
+	now = now.Add(time.Millisecond * 500)
+	if !tracker.allow("a.com", opts, now) {
+		t.Fatal("expected quota to have refilled")
+	}
+	if tracker.allow("a.com", opts, now) {
+		t.Fatal("expected event to be over quota again")
+	}
+}
+
+func TestOriginTrackerLabelsBusiestServers(t *testing.T) {
+	var tracker originTracker
+	now := time.Unix(1000, 0)
+
+	// Before the first window has passed, the first servers seen are labelled.
+	for _, origin := range []string{"a.com", "b.com", "c.com", "c.com", "c.com", "b.com", "b.com"} {
+		tracker.label(origin, 2, now)
+	}
+	if got := tracker.label("a.com", 2, now); got != "a.com" {
+		t.Fatalf("expected a.com to be labelled, got %q", got)
+	}
+	if got := tracker.label("c.com", 2, now); got != originOther {
+		t.Fatalf("expected c.com to be aggregated, got %q", got)
+	}
+
+	// Once the window has passed, the busiest servers take over the labels.
+	now = now.Add(originWindow)
+	if got := tracker.label("c.com", 2, now); got != "c.com" {
+		t.Fatalf("expected c.com to be labelled, got %q", got)
+	}
+	if got := tracker.label("b.com", 2, now); got != "b.com" {
+		t.Fatalf("expected b.com to be labelled, got %q", got)
+	}
+	if got := tracker.label("a.com", 2, now); got != originOther {
+		t.Fatalf("expected a.com to be aggregated, got %q", got)
+	}
+}
+
+func TestOriginQuotaDefersNewEvents(t *testing.T) {
+	cfg := &config.RoomServer{}
+	cfg.OriginLimits.Defaults()
+	cfg.OriginLimits.EventsPerSecond = 1
+	cfg.OriginLimits.Burst = 1
+	r := &Inputer{Cfg: cfg, ServerName: "localhost"}
+	event := mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)
+
+	// Use up the quota for the origin server.
+	if !r.origins.allow("remote.com", cfg.OriginLimits, time.Now()) {
+		t.Fatal("expected first event to be allowed")
+	}
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: event, Origin: "remote.com"}
+	_, err := r.processRoomEvent(context.Background(), input)
+	if !errors.Is(err, errOriginQuotaExceeded) {
+		t.Fatalf("expected errOriginQuotaExceeded, got %v", err)
+	}
+	if !isDeferredInput(err) {
+		t.Fatal("expected quota errors to be deferred")
+	}
+}
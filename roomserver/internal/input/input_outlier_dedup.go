@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(outlierDedupTimeouts)
+}
+
+var outlierDedupTimeouts = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "outlier_dedup_timeouts_total",
+		Help:      "Number of times checking whether an outlier was already stored took too long",
+	},
+)
+
+func (r *Inputer) outlierDedupTimeout() time.Duration {
+	if r.Cfg == nil {
+		return 0
+	}
+	return r.Cfg.OutlierDedupTimeout
+}
+
+// isOutlierAlreadyStored returns true if we already have the given outlier,
+// so that it doesn't need to be processed again. If the database takes longer
+// than the configured timeout to answer then the outlier is processed anyway,
+// which is safe since storing an event that we already have does no harm.
+func (r *Inputer) isOutlierAlreadyStored(
+	ctx context.Context, logger *logrus.Entry, headered *gomatrixserverlib.HeaderedEvent,
+) bool {
+	if timeout := r.outlierDedupTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	event := headered.Unwrap()
+	evs, err := r.DB.EventsFromIDs(ctx, []string{event.EventID()})
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			outlierDedupTimeouts.Inc()
+			logger.WithError(err).Warn("Timed out checking whether outlier was already stored, processing it anyway")
+		}
+		return false
+	}
+	if len(evs) != 1 {
+		return false
+	}
+	// check hash matches if we're on early room versions where the event ID was a random string
+	idFormat, err := headered.RoomVersion.EventIDFormat()
+	if err != nil {
+		return false
+	}
+	switch idFormat {
+	case gomatrixserverlib.EventIDFormatV1:
+		return bytes.Equal(event.EventReference().EventSHA256, evs[0].EventReference().EventSHA256)
+	default:
+		return true
+	}
+}
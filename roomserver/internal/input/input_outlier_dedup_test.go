@@ -0,0 +1,70 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// slowEventsDB blocks in EventsFromIDs until the context is done, unless it
+// is fast, in which case it returns the event straight away.
+type slowEventsDB struct {
+	storage.Database
+	fast  bool
+	event *gomatrixserverlib.Event
+}
+
+func (d *slowEventsDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	if d.fast {
+		return []types.Event{{EventNID: 1, Event: d.event}}, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestOutlierDedupTimeout(t *testing.T) {
+	event := mustCreateEvent(t, nil)
+	headered := event.Headered(gomatrixserverlib.RoomVersionV1)
+	logger := logrus.WithField("test", t.Name())
+	db := &slowEventsDB{event: event}
+	r := &Inputer{
+		DB:  db,
+		Cfg: &config.RoomServer{OutlierDedupTimeout: time.Millisecond * 10},
+	}
+
+	// A slow database doesn't hold us up for longer than the timeout, and
+	// the outlier is treated as not yet stored.
+	started := time.Now()
+	if r.isOutlierAlreadyStored(context.Background(), logger, headered) {
+		t.Fatal("expected the outlier to be processed when the dedup check times out")
+	}
+	if taken := time.Since(started); taken > time.Second {
+		t.Fatalf("dedup check took %s despite the timeout", taken)
+	}
+
+	// A database that answers in time is believed.
+	db.fast = true
+	if !r.isOutlierAlreadyStored(context.Background(), logger, headered) {
+		t.Fatal("expected the outlier to be recognised as already stored")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// outputEventPruneInterval is how often the markers for output events which
+// were emitted longer ago than the retention period are deleted.
+const outputEventPruneInterval = time.Hour
+
+// startOutputEventPruning starts forgetting about output events which were
+// emitted longer ago than the configured retention period, so that the
+// markers don't pile up forever. By then the input events which caused them
+// have long been acknowledged and won't be reprocessed.
+func (r *Inputer) startOutputEventPruning() {
+	if r.Cfg == nil || r.Cfg.OutputEventRetention <= 0 {
+		return
+	}
+	retention := r.Cfg.OutputEventRetention
+	go func() {
+		ticker := time.NewTicker(outputEventPruneInterval)
+		defer ticker.Stop()
+		for {
+			r.pruneOutputEvents(context.Background(), time.Now().Add(-retention))
+			<-ticker.C
+		}
+	}()
+}
+
+// pruneOutputEvents deletes the markers for output events which were emitted
+// before the given time.
+func (r *Inputer) pruneOutputEvents(ctx context.Context, before time.Time) {
+	pruned, err := r.DB.PruneOutputEvents(ctx, before)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to prune output event markers")
+		return
+	}
+	if pruned > 0 {
+		logrus.WithField("pruned", pruned).Debug("Pruned output event markers")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+)
+
+// fakeJetStream counts the messages that have been published to it.
+type fakeJetStream struct {
+	nats.JetStreamContext
+	published []*nats.Msg
+}
+
+func (f *fakeJetStream) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	f.published = append(f.published, m)
+	return &nats.PubAck{}, nil
+}
+
+// fakeOutputEventTracker is an in-memory outputEventTracker. If crash is set
+// then marking an output event as sent fails, as if the process had died
+// after producing the output event but before the marker was committed.
+type fakeOutputEventTracker struct {
+	sent  map[string]bool
+	crash bool
+}
+
+func (f *fakeOutputEventTracker) OutputEventsSent(keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	sent := map[types.OutputEventKey]bool{}
+	for _, key := range keys {
+		sent[key] = f.sent[key.EventID+key.OutputType]
+	}
+	return sent, nil
+}
+
+func (f *fakeOutputEventTracker) MarkOutputEventsAsSent(keys []types.OutputEventKey) error {
+	if f.crash {
+		return fmt.Errorf("crashed")
+	}
+	for _, key := range keys {
+		f.sent[key.EventID+key.OutputType] = true
+	}
+	return nil
+}
+
+func TestWriteOutputEventsIsIdempotent(t *testing.T) {
+	event := mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)
+	updates := []api.OutputEvent{
+		{
+			Type:         api.OutputTypeOldRoomEvent,
+			OldRoomEvent: &api.OutputOldRoomEvent{Event: event},
+		},
+		{
+			Type:    api.OutputTypeNewPeek,
+			NewPeek: &api.OutputNewPeek{RoomID: event.RoomID()},
+		},
+	}
+
+	js := &fakeJetStream{}
+	r := &Inputer{JetStream: js}
+	tracker := &fakeOutputEventTracker{sent: map[string]bool{}}
+
+	// Crash after producing the output events but before the markers were
+	// persisted. The input event would be redelivered and reprocessed, so the
+	// output events are produced again, as we can't know that they were sent.
+	tracker.crash = true
+	if err := r.writeOutputEvents(tracker, event.RoomID(), updates); err == nil {
+		t.Fatalf("expected an error from the crashed tracker")
+	}
+	if len(js.published) != 2 {
+		t.Fatalf("got %d published messages, want 2", len(js.published))
+	}
+
+	// Reprocess without crashing this time.
+	tracker.crash = false
+	if err := r.writeOutputEvents(tracker, event.RoomID(), updates); err != nil {
+		t.Fatalf("writeOutputEvents: %s", err)
+	}
+	if len(js.published) != 4 {
+		t.Fatalf("got %d published messages, want 4", len(js.published))
+	}
+
+	// Crash after the markers were committed but before the input event was
+	// acknowledged. When reprocessing, only the output events that aren't tied
+	// to an event ID can be produced again.
+	if err := r.writeOutputEvents(tracker, event.RoomID(), updates); err != nil {
+		t.Fatalf("writeOutputEvents: %s", err)
+	}
+	if len(js.published) != 5 {
+		t.Fatalf("got %d published messages, want 5", len(js.published))
+	}
+	if got := js.published[4].Header.Get("room_id"); got != event.RoomID() {
+		t.Fatalf("got room ID %q, want %q", got, event.RoomID())
+	}
+}
+
+func TestWriteOutputEventsPartitionsByRoom(t *testing.T) {
+	const partitions = 4
+	js := &fakeJetStream{}
+	r := &Inputer{
+		JetStream:            js,
+		OutputRoomEventTopic: "OutputRoomEvent",
+		Cfg: &config.RoomServer{
+			Matrix: &config.Global{
+				JetStream: config.JetStream{OutputRoomEventPartitions: partitions},
+			},
+		},
+	}
+	tracker := &fakeOutputEventTracker{sent: map[string]bool{}}
+
+	// Interleave events from several rooms.
+	roomIDs := []string{"!a:localhost", "!b:localhost", "!c:localhost", "!d:localhost", "!e:localhost"}
+	for i := 0; i < 3; i++ {
+		for _, roomID := range roomIDs {
+			event := mustCreateEvent(t, map[string]interface{}{
+				"event_id": fmt.Sprintf("$%s-%d", roomID, i),
+				"room_id":  roomID,
+			}).Headered(gomatrixserverlib.RoomVersionV1)
+			if err := r.writeOutputEvents(tracker, roomID, []api.OutputEvent{
+				{
+					Type:         api.OutputTypeOldRoomEvent,
+					OldRoomEvent: &api.OutputOldRoomEvent{Event: event},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Each room's events all land on the same partition, in the order that
+	// they were written.
+	subjects := map[string]string{}
+	next := map[string]int{}
+	for _, msg := range js.published {
+		var update api.OutputEvent
+		if err := json.Unmarshal(msg.Data, &update); err != nil {
+			t.Fatal(err)
+		}
+		roomID := update.OldRoomEvent.Event.RoomID()
+		if subject, ok := subjects[roomID]; ok && subject != msg.Subject {
+			t.Fatalf("room %s published to both %q and %q", roomID, subject, msg.Subject)
+		}
+		subjects[roomID] = msg.Subject
+		if want := jetstream.RoomSubject("OutputRoomEvent", roomID, partitions); msg.Subject != want {
+			t.Fatalf("room %s published to %q, want %q", roomID, msg.Subject, want)
+		}
+		if want := fmt.Sprintf("$%s-%d", roomID, next[roomID]); update.EventID() != want {
+			t.Fatalf("room %s: got event %s, want %s", roomID, update.EventID(), want)
+		}
+		next[roomID]++
+	}
+	for _, roomID := range roomIDs {
+		partition := jetstream.PartitionForRoom(roomID, partitions)
+		if partition < 0 || partition >= partitions {
+			t.Fatalf("room %s mapped to partition %d out of %d", roomID, partition, partitions)
+		}
+		if next[roomID] != 3 {
+			t.Fatalf("room %s: got %d events, want 3", roomID, next[roomID])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+
+	asAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/sirupsen/logrus"
+)
+
+// shouldOverwriteState decides whether the state given to us with an event
+// should replace the state of the room that we already have, rather than being
+// merged with it. If none of our users are joined to the room then the state
+// that we have is quite possibly out of date, so it's overwritten. However, if
+// any joined user belongs to an application service, or the room is configured
+// to never be overwritten, then the state that we have is kept.
+func (r *Inputer) shouldOverwriteState(ctx context.Context, roomInfo *types.RoomInfo, roomID string) bool {
+	if r.Cfg != nil {
+		for _, neverOverwrite := range r.Cfg.NeverOverwriteStateRooms {
+			if neverOverwrite == roomID {
+				return false
+			}
+		}
+	}
+
+	// Count join memberships for local users only.
+	localJoinedCount, err := r.DB.GetLocalJoinedCount(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return true
+	}
+	if localJoinedCount > 0 {
+		return false
+	}
+
+	// Application service users might not be on our server name, so they
+	// aren't necessarily counted as local. Check for any that are joined.
+	ghostJoined, err := r.appserviceUsersJoined(ctx, roomInfo)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to check for joined application service users")
+		return true
+	}
+	return !ghostJoined
+}
+
+// appserviceUsersJoined returns true if any user who is joined to the room
+// falls within an application service namespace.
+func (r *Inputer) appserviceUsersJoined(ctx context.Context, roomInfo *types.RoomInfo) (bool, error) {
+	if r.ASAPI == nil {
+		return false, nil
+	}
+	membershipNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, false)
+	if err != nil {
+		return false, err
+	}
+	if len(membershipNIDs) == 0 {
+		return false, nil
+	}
+	memberships, err := r.DB.Events(ctx, membershipNIDs)
+	if err != nil {
+		return false, err
+	}
+	userIDs := make([]string, 0, len(memberships))
+	for _, membership := range memberships {
+		if stateKey := membership.StateKey(); stateKey != nil {
+			userIDs = append(userIDs, *stateKey)
+		}
+	}
+	var res asAPI.UserIDsOwnedResponse
+	if err = r.ASAPI.UserIDsOwned(ctx, &asAPI.UserIDsOwnedRequest{UserIDs: userIDs}, &res); err != nil {
+		return false, err
+	}
+	return len(res.Owners) > 0, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	asQuery "github.com/matrix-org/dendrite/appservice/query"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// overwriteDB serves the joined members of a single room. Calling any other
+// storage.Database method will panic.
+type overwriteDB struct {
+	storage.Database
+	localJoined int
+	joined      []types.Event
+}
+
+func (d *overwriteDB) GetLocalJoinedCount(ctx context.Context, roomNID types.RoomNID) (int, error) {
+	return d.localJoined, nil
+}
+
+func (d *overwriteDB) GetMembershipEventNIDsForRoom(
+	ctx context.Context, roomNID types.RoomNID, joinOnly bool, localOnly bool,
+) ([]types.EventNID, error) {
+	nids := make([]types.EventNID, 0, len(d.joined))
+	for _, event := range d.joined {
+		nids = append(nids, event.EventNID)
+	}
+	return nids, nil
+}
+
+func (d *overwriteDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	return d.joined, nil
+}
+
+func joinedMember(t *testing.T, nid types.EventNID, userID string) types.Event {
+	event := mustCreateEvent(t, map[string]interface{}{
+		"event_id":  "$join" + userID,
+		"type":      gomatrixserverlib.MRoomMember,
+		"state_key": userID,
+		"sender":    userID,
+		"content":   map[string]interface{}{"membership": "join"},
+	})
+	return types.Event{EventNID: nid, Event: event}
+}
+
+func TestShouldOverwriteState(t *testing.T) {
+	asCfg := &config.Dendrite{}
+	asCfg.Derived.ApplicationServices = []config.ApplicationService{
+		{
+			ID: "irc",
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {{Regex: "@irc_.*", RegexpObject: regexp.MustCompile("@irc_.*")}},
+			},
+		},
+	}
+	roomInfo := &types.RoomInfo{RoomNID: 1}
+	ghost := joinedMember(t, 1, "@irc_alice:bridge.localhost")
+	remote := joinedMember(t, 2, "@bob:remote")
+
+	tests := []struct {
+		name    string
+		db      *overwriteDB
+		neverOn []string
+		want    bool
+	}{
+		{"local users joined", &overwriteDB{localJoined: 1}, nil, false},
+		{"only remote users joined", &overwriteDB{joined: []types.Event{remote}}, nil, true},
+		{"only ghost users joined", &overwriteDB{joined: []types.Event{ghost}}, nil, false},
+		{"ghost and remote users joined", &overwriteDB{joined: []types.Event{remote, ghost}}, nil, false},
+		{"never overwritten", &overwriteDB{joined: []types.Event{remote}}, []string{"!test:localhost"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Inputer{
+				Cfg:   &config.RoomServer{NeverOverwriteStateRooms: tc.neverOn},
+				DB:    tc.db,
+				ASAPI: &asQuery.AppServiceQueryAPI{Cfg: asCfg},
+			}
+			if got := r.shouldOverwriteState(context.Background(), roomInfo, "!test:localhost"); got != tc.want {
+				t.Fatalf("got overwrite %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(partialStateCompletions)
+}
+
+var partialStateCompletions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "partial_state_completions_total",
+		Help:      "Number of attempts to fetch the full state of events which were accepted with partial state",
+	},
+	[]string{"outcome"},
+)
+
+// partialStateRetryInterval is how long we wait before trying again to
+// complete the state of events whose full state couldn't be fetched.
+const partialStateRetryInterval = time.Minute
+
+// startPartialStateCompletion starts completing the state of events which
+// were accepted with partial state in the background, including any that
+// were left over from before a restart.
+func (r *Inputer) startPartialStateCompletion() {
+	r.partialStateWake = make(chan struct{}, 1)
+	go r.partialStateWorker()
+	r.wakePartialStateCompletion()
+}
+
+// wakePartialStateCompletion tells the background worker that there are
+// events with partial state to complete. It does nothing if the worker
+// hasn't been started.
+func (r *Inputer) wakePartialStateCompletion() {
+	select {
+	case r.partialStateWake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Inputer) partialStateWorker() {
+	ticker := time.NewTicker(partialStateRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.partialStateWake:
+		case <-ticker.C:
+		}
+		r.completePartialStates(context.Background())
+	}
+}
+
+// completePartialStates tries to complete the state of every event which
+// is still waiting for its full state. Events which fail are left for the
+// next attempt.
+func (r *Inputer) completePartialStates(ctx context.Context) {
+	partial, err := r.DB.GetPartialStateEvents(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to look up events with partial state")
+		return
+	}
+	for _, p := range partial {
+		if err = r.completePartialState(ctx, p); err != nil {
+			partialStateCompletions.WithLabelValues("failed").Inc()
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"event_nid":   p.EventNID,
+				"server_name": p.ServerName,
+			}).Warn("Failed to complete partial state, will retry later")
+			continue
+		}
+		partialStateCompletions.WithLabelValues("completed").Inc()
+	}
+}
+
+// completePartialState fetches the full state before an event which was
+// accepted with partial state, upgrades the state snapshot of the event to
+// the full state and then merges the missing state into the current state
+// of the room.
+func (r *Inputer) completePartialState(ctx context.Context, p types.PartialStateEvent) error {
+	events, err := r.DB.Events(ctx, []types.EventNID{p.EventNID})
+	if err != nil {
+		return fmt.Errorf("r.DB.Events: %w", err)
+	}
+	if len(events) != 1 {
+		return fmt.Errorf("event NID %d is not known", p.EventNID)
+	}
+	event := events[0]
+	roomID := event.RoomID()
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return fmt.Errorf("room %q is not known", roomID)
+	}
+
+	// Most of the state will be missing, so ask for all of it with /state
+	// rather than with /state_ids, which would need an /event request for
+	// each missing event. Fetching the state can take a long time in big
+	// rooms, so do it before taking over the room's worker, so that new
+	// events for the room aren't held up in the meantime.
+	req := &missingStateReq{
+		origin:     p.ServerName,
+		inputer:    r,
+		queryer:    r.Queryer,
+		db:         r.DB,
+		federation: r.FSAPI,
+		keys:       r.KeyRing,
+		roomsMu:    internal.NewMutexByRoom(),
+		servers:    map[gomatrixserverlib.ServerName]struct{}{p.ServerName: {}},
+		hadEvents:  map[string]bool{},
+		haveEvents: map[string]*gomatrixserverlib.HeaderedEvent{},
+	}
+	state, err := req.lookupMissingStateViaState(ctx, roomID, event.EventID(), roomInfo.RoomVersion)
+	if err != nil {
+		return fmt.Errorf("req.lookupMissingStateViaState: %w", err)
+	}
+
+	phony.Block(r.workerForRoom(roomID), func() {
+		err = r.applyFullState(ctx, p.ServerName, event, state)
+	})
+	if err != nil {
+		return err
+	}
+	if err = r.DB.RemovePartialStateEvent(ctx, p.EventNID); err != nil {
+		return fmt.Errorf("r.DB.RemovePartialStateEvent: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":      roomID,
+		"event_id":     event.EventID(),
+		"state_events": len(state.StateEvents),
+	}).Info("Completed partial state")
+	return nil
+}
+
+// applyFullState stores the full state before an event which was accepted
+// with partial state. It must be called on the room's worker.
+func (r *Inputer) applyFullState(
+	ctx context.Context, origin gomatrixserverlib.ServerName, event types.Event, state *gomatrixserverlib.RespState,
+) error {
+	roomInfo, err := r.DB.RoomInfo(ctx, event.RoomID())
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil {
+		return fmt.Errorf("room %q is not known", event.RoomID())
+	}
+
+	// Store the state and auth events as outliers, auth events first, so
+	// that we can refer to them below. Events that we already have are
+	// skipped by processRoomEvent.
+	outliers, err := state.Events()
+	if err != nil {
+		return fmt.Errorf("state.Events: %w", err)
+	}
+	for _, outlier := range outliers {
+		if _, err = r.processRoomEvent(ctx, &api.InputRoomEvent{
+			Kind:   api.KindOutlier,
+			Event:  outlier.Headered(roomInfo.RoomVersion),
+			Origin: origin,
+		}); err != nil {
+			return fmt.Errorf("r.processRoomEvent[outlier]: %w", err)
+		}
+	}
+
+	stateIDs := make([]string, 0, len(state.StateEvents))
+	for _, stateEvent := range state.StateEvents {
+		stateIDs = append(stateIDs, stateEvent.EventID())
+	}
+	entries, err := r.DB.StateEntriesForEventIDs(ctx, stateIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.StateEntriesForEventIDs: %w", err)
+	}
+	entries = types.DeduplicateStateEntries(entries)
+	fullStateNID, err := r.DB.AddState(ctx, roomInfo.RoomNID, nil, entries)
+	if err != nil {
+		return fmt.Errorf("r.DB.AddState: %w", err)
+	}
+	if err = r.DB.SetState(ctx, event.EventNID, fullStateNID); err != nil {
+		return fmt.Errorf("r.DB.SetState: %w", err)
+	}
+
+	// Any cached resolver for the room has loaded state that was worked out
+	// from the partial state, so don't use it again.
+	r.stateResolutions.forget(roomInfo.RoomNID)
+	return r.mergeFullState(ctx, roomInfo, event)
+}
+
+// mergeFullState works out the current state of the room again now that the
+// full state before the event is known, and tells downstream components about
+// the state events which are added or removed as a result. The forward
+// extremities of the room are left alone.
+func (r *Inputer) mergeFullState(
+	ctx context.Context, roomInfo *types.RoomInfo, event types.Event,
+) (err error) {
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, []string{event.EventID()})
+	if err != nil {
+		return fmt.Errorf("r.DB.StateAtEventIDs: %w", err)
+	}
+	stateAtEvent := stateAtEvents[0]
+
+	updater, err := r.DB.GetLatestEventsForUpdate(ctx, *roomInfo)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetLatestEventsForUpdate: %w", err)
+	}
+	succeeded := false
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+
+	// Work out the full state after the event ourselves. Adding the event to
+	// the state before it as a separate state block doesn't work here, since
+	// state blocks are combined in the order that they were created, and the
+	// block holding the event was created before the full state was known.
+	roomState := r.newStateResolution(roomInfo, event.RoomID())
+	stateAfterNID := stateAtEvent.BeforeStateSnapshotNID
+	if stateAtEvent.IsStateEvent() && !stateAtEvent.IsRejected {
+		var entries []types.StateEntry
+		if entries, err = roomState.LoadStateAtSnapshot(ctx, stateAtEvent.BeforeStateSnapshotNID); err != nil {
+			return fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+		}
+		stateAfter := make([]types.StateEntry, 0, len(entries)+1)
+		for _, entry := range entries {
+			if entry.StateKeyTuple != stateAtEvent.StateKeyTuple {
+				stateAfter = append(stateAfter, entry)
+			}
+		}
+		stateAfter = append(stateAfter, stateAtEvent.StateEntry)
+		if stateAfterNID, err = r.DB.AddState(ctx, roomInfo.RoomNID, nil, stateAfter); err != nil {
+			return fmt.Errorf("r.DB.AddState: %w", err)
+		}
+	}
+
+	// The state at the latest events was worked out from the partial state,
+	// so resolve it together with the full state after the event to fill in
+	// whatever was missing. The state after the event already includes the
+	// event, so it's passed on as if the event weren't a state event.
+	latest := updater.LatestEvents()
+	prevStates := []types.StateAtEvent{{
+		BeforeStateSnapshotNID: stateAfterNID,
+		StateEntry:             types.StateEntry{EventNID: stateAtEvent.EventNID},
+	}}
+	for _, l := range latest {
+		if l.EventNID != stateAtEvent.EventNID {
+			prevStates = append(prevStates, l.StateAtEvent)
+		}
+	}
+	newStateNID, err := roomState.CalculateAndStoreStateAfterEvents(ctx, prevStates)
+	if err != nil {
+		return fmt.Errorf("roomState.CalculateAndStoreStateAfterEvents: %w", err)
+	}
+
+	oldStateNID := updater.CurrentStateSnapshotNID()
+	removed, added, err := roomState.DifferenceBetweeenStateSnapshots(ctx, oldStateNID, newStateNID)
+	if err != nil {
+		return fmt.Errorf("roomState.DifferenceBetweeenStateSnapshots: %w", err)
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		succeeded = true
+		return nil
+	}
+	updates, err := r.updateMemberships(ctx, updater, removed, added)
+	if err != nil {
+		return fmt.Errorf("r.updateMemberships: %w", err)
+	}
+
+	// The event has already been sent downstream with its partial state, so
+	// send it again with the difference so that the state is filled in.
+	u := latestEventsUpdater{
+		ctx:             ctx,
+		api:             r,
+		updater:         updater,
+		roomInfo:        roomInfo,
+		stateAtEvent:    stateAtEvent,
+		event:           event.Event,
+		lastEventIDSent: updater.LastEventIDSent(),
+		latest:          latest,
+		removed:         removed,
+		added:           added,
+		oldStateNID:     oldStateNID,
+		newStateNID:     newStateNID,
+	}
+	if u.stateBeforeEventRemoves, u.stateBeforeEventAdds, err = roomState.DifferenceBetweeenStateSnapshots(
+		ctx, newStateNID, stateAtEvent.BeforeStateSnapshotNID,
+	); err != nil {
+		return fmt.Errorf("roomState.DifferenceBetweeenStateSnapshots: %w", err)
+	}
+	update, err := u.makeOutputNewRoomEvent()
+	if err != nil {
+		return fmt.Errorf("u.makeOutputNewRoomEvent: %w", err)
+	}
+	updates = append(updates, *update)
+
+	if err = r.writeOutputEvents(rewindOutputEventTracker{updater}, event.RoomID(), updates); err != nil {
+		return fmt.Errorf("r.writeOutputEvents: %w", err)
+	}
+	if err = updater.SetLatestEvents(roomInfo.RoomNID, latest, stateAtEvent.EventNID, newStateNID); err != nil {
+		return fmt.Errorf("updater.SetLatestEvents: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
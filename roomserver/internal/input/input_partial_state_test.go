@@ -0,0 +1,209 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fullStateFSAPI answers /state requests with the full state of the room,
+// and knows of no other servers in the room.
+// Calling any other FederationInternalAPI method will panic.
+type fullStateFSAPI struct {
+	fedapi.FederationInternalAPI
+	keyRing *gomatrixserverlib.KeyRing
+	state   gomatrixserverlib.RespState
+	lookups int
+}
+
+func (f *fullStateFSAPI) KeyRing() *gomatrixserverlib.KeyRing {
+	return f.keyRing
+}
+
+func (f *fullStateFSAPI) LookupState(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespState, error) {
+	f.lookups++
+	return f.state, nil
+}
+
+func (f *fullStateFSAPI) QueryJoinedHostServerNamesInRoom(
+	ctx context.Context, request *fedapi.QueryJoinedHostServerNamesInRoomRequest, response *fedapi.QueryJoinedHostServerNamesInRoomResponse,
+) error {
+	return nil
+}
+
+func mustOpenRoomserverDatabase(t *testing.T) storage.Database {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "roomserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	cache, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "roomserver.db")),
+	}, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// currentStateEventIDs returns the event IDs of the current state of the room.
+func currentStateEventIDs(t *testing.T, r *Inputer, roomID string) map[string]bool {
+	t.Helper()
+	res := &api.QueryLatestEventsAndStateResponse{}
+	if err := r.Queryer.QueryLatestEventsAndState(context.Background(), &api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, res); err != nil {
+		t.Fatal(err)
+	}
+	eventIDs := map[string]bool{}
+	for _, event := range res.StateEvents {
+		eventIDs[event.EventID()] = true
+	}
+	return eventIDs
+}
+
+func TestPartialStateJoinCompletes(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator":      "@alice:remote",
+		"room_version": gomatrixserverlib.RoomVersionV6,
+	}, []string{})
+	join := mustBuildSignedEvent(t, private, 2, gomatrixserverlib.MRoomMember, "@alice:remote", map[string]interface{}{
+		"membership": "join",
+	}, []string{create.EventID()})
+	topic := mustBuildSignedEvent(t, private, 3, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{create.EventID(), join.EventID()})
+	rejoin := mustBuildSignedEvent(t, private, 4, gomatrixserverlib.MRoomMember, "@alice:remote", map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Alice",
+	}, []string{create.EventID(), join.EventID()})
+
+	ctx := context.Background()
+	db := mustOpenRoomserverDatabase(t)
+	keyRing := &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}}
+	fsAPI := &fullStateFSAPI{
+		keyRing: keyRing,
+		state: gomatrixserverlib.RespState{
+			StateEvents: []*gomatrixserverlib.Event{create, join, topic},
+			AuthEvents:  []*gomatrixserverlib.Event{create, join},
+		},
+	}
+	js := &fakeJetStream{}
+	r := &Inputer{
+		DB:         db,
+		Queryer:    &query.Queryer{DB: db},
+		FSAPI:      fsAPI,
+		KeyRing:    keyRing,
+		JetStream:  js,
+		ServerName: "localhost",
+	}
+
+	for _, outlier := range []*gomatrixserverlib.Event{create, join} {
+		if _, err = r.processRoomEvent(ctx, &api.InputRoomEvent{
+			Kind:   api.KindOutlier,
+			Event:  outlier.Headered(gomatrixserverlib.RoomVersionV6),
+			Origin: "remote",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The join only comes with part of the state, which is missing the topic.
+	result, err := r.processRoomEvent(ctx, &api.InputRoomEvent{
+		Kind:          api.KindNew,
+		Event:         rejoin.Headered(gomatrixserverlib.RoomVersionV6),
+		Origin:        "remote",
+		HasState:      true,
+		PartialState:  true,
+		StateEventIDs: []string{create.EventID(), join.EventID()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rejected || result.SoftFailed {
+		t.Fatalf("expected the join to be accepted, got %+v", result)
+	}
+	partial, err := db.GetPartialStateEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partial) != 1 || partial[0].ServerName != "remote" {
+		t.Fatalf("got partial state events %+v, want one from remote", partial)
+	}
+
+	// The room is usable with the partial state in the meantime.
+	state := currentStateEventIDs(t, r, rejoin.RoomID())
+	if !state[rejoin.EventID()] || state[topic.EventID()] {
+		t.Fatalf("got current state %v before completing, want the join and no topic", state)
+	}
+
+	js.published = nil
+	if err = r.completePartialState(ctx, partial[0]); err != nil {
+		t.Fatal(err)
+	}
+	if fsAPI.lookups != 1 {
+		t.Fatalf("got %d /state lookups, want 1", fsAPI.lookups)
+	}
+	if partial, err = db.GetPartialStateEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(partial) != 0 {
+		t.Fatalf("got partial state events %+v after completing, want none", partial)
+	}
+	state = currentStateEventIDs(t, r, rejoin.RoomID())
+	if !state[rejoin.EventID()] || !state[topic.EventID()] {
+		t.Fatalf("got current state %v after completing, want the join and the topic", state)
+	}
+
+	// Downstream components are told about the state that was missing.
+	if len(js.published) != 1 {
+		t.Fatalf("got %d published messages, want 1", len(js.published))
+	}
+	var output api.OutputEvent
+	if err = json.Unmarshal(js.published[0].Data, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Type != api.OutputTypeNewRoomEvent || output.NewRoomEvent == nil {
+		t.Fatalf("got output type %q, want %q", output.Type, api.OutputTypeNewRoomEvent)
+	}
+	if adds := output.NewRoomEvent.AddsStateEventIDs; len(adds) != 1 || adds[0] != topic.EventID() {
+		t.Fatalf("got added state %v, want only the topic", adds)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(priorityQueueDepth)
+}
+
+var priorityQueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_priority_queue_depth",
+		Help:      "Number of input events waiting to be processed, by room priority",
+	},
+	[]string{"priority"},
+)
+
+const (
+	priorityActive = iota // rooms that users are looking at
+	priorityNormal        // all other rooms
+	priorityCount
+)
+
+var priorityNames = [priorityCount]string{
+	priorityActive: "active",
+	priorityNormal: "normal",
+}
+
+// roomPriorities limits how many input events are processed at the same time
+// and decides which event gets to go next when that limit is reached. Events
+// for rooms which have been hinted as active go ahead of everything else, and
+// otherwise events go in the order that they arrived.
+type roomPriorities struct {
+	mu        sync.Mutex
+	hints     map[string]time.Time // room ID -> when the hint expires
+	nextSweep time.Time            // when to next forget about expired hints
+	running   int
+	waiting   [priorityCount][]chan struct{}
+}
+
+func (r *Inputer) activityPriority() config.ActivityPriorityOptions {
+	if r.Cfg == nil {
+		return config.ActivityPriorityOptions{}
+	}
+	return r.Cfg.ActivityPriority
+}
+
+// InputRoomActivityHints implements api.RoomserverInternalAPI
+func (r *Inputer) InputRoomActivityHints(
+	_ context.Context,
+	request *api.InputRoomActivityHintsRequest,
+	_ *api.InputRoomActivityHintsResponse,
+) {
+	opts := r.activityPriority()
+	if opts.MaxConcurrentEvents <= 0 {
+		return
+	}
+	now := time.Now()
+	r.priorities.hint(request.RoomIDs, now, now.Add(opts.HintDuration))
+}
+
+// acquirePriority waits until an input event for the given room is allowed to
+// be processed, or until the context is done. Unless an error is returned, the
+// returned function must be called once processing is done.
+func (r *Inputer) acquirePriority(ctx context.Context, roomID string) (func(), error) {
+	return r.priorities.acquire(ctx, roomID, r.activityPriority().MaxConcurrentEvents, time.Now())
+}
+
+// hint marks the rooms as active until the given time. Hints for rooms which
+// no events arrive for would otherwise never be looked up and forgotten, so
+// expired hints are swept away every so often too.
+func (p *roomPriorities) hint(roomIDs []string, now, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hints == nil {
+		p.hints = make(map[string]time.Time, len(roomIDs))
+	}
+	if !now.Before(p.nextSweep) {
+		for roomID, expires := range p.hints {
+			if !now.Before(expires) {
+				delete(p.hints, roomID)
+			}
+		}
+		p.nextSweep = until
+	}
+	for _, roomID := range roomIDs {
+		if until.After(p.hints[roomID]) {
+			p.hints[roomID] = until
+		}
+	}
+}
+
+// priority returns the priority of the room, forgetting about the hint for
+// the room if it has expired. Must be called with the lock held.
+func (p *roomPriorities) priority(roomID string, now time.Time) int {
+	until, ok := p.hints[roomID]
+	if !ok {
+		return priorityNormal
+	}
+	if !now.Before(until) {
+		delete(p.hints, roomID)
+		return priorityNormal
+	}
+	return priorityActive
+}
+
+// acquire blocks until there is room to process another event, given that at
+// most limit events can be processed at once. If the limit is zero or less then
+// it never blocks. If the context is done first then the event gives up its
+// place in the queue and the context's error is returned.
+func (p *roomPriorities) acquire(ctx context.Context, roomID string, limit int, now time.Time) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	p.mu.Lock()
+	if p.running < limit && p.queued() == 0 {
+		p.running++
+		p.mu.Unlock()
+		return p.release, nil
+	}
+	priority := p.priority(roomID, now)
+	ready := make(chan struct{})
+	p.waiting[priority] = append(p.waiting[priority], ready)
+	priorityQueueDepth.WithLabelValues(priorityNames[priority]).Inc()
+	p.mu.Unlock()
+	select {
+	case <-ready:
+		return p.release, nil
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	for i, waiting := range p.waiting[priority] {
+		if waiting == ready {
+			p.waiting[priority] = append(p.waiting[priority][:i], p.waiting[priority][i+1:]...)
+			priorityQueueDepth.WithLabelValues(priorityNames[priority]).Dec()
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	p.mu.Unlock()
+	// The slot was handed to us just as we gave up, so pass it on.
+	p.release()
+	return nil, ctx.Err()
+}
+
+// release hands the slot of a finished event to the next waiting event, if
+// there is one.
+func (p *roomPriorities) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for priority := range p.waiting {
+		if len(p.waiting[priority]) == 0 {
+			continue
+		}
+		next := p.waiting[priority][0]
+		p.waiting[priority] = p.waiting[priority][1:]
+		priorityQueueDepth.WithLabelValues(priorityNames[priority]).Dec()
+		close(next) // the slot passes straight to the waiter
+		return
+	}
+	p.running--
+}
+
+// queued returns how many events are waiting. Must be called with the lock held.
+func (p *roomPriorities) queued() int {
+	n := 0
+	for _, waiting := range p.waiting {
+		n += len(waiting)
+	}
+	return n
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForQueued blocks until the given number of events are waiting.
+func waitForQueued(t *testing.T, p *roomPriorities, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		p.mu.Lock()
+		queued := p.queued()
+		p.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d events to be waiting", n)
+}
+
+func TestRoomPrioritiesActiveRoomsGoFirst(t *testing.T) {
+	var p roomPriorities
+	now := time.Unix(1000, 0)
+	p.hint([]string{"!active:a.com"}, now, now.Add(time.Minute))
+
+	releaseFirst, err := p.acquire(context.Background(), "!busy:a.com", 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	acquire := func(roomID string) {
+		defer wg.Done()
+		release, err := p.acquire(context.Background(), roomID, 1, now)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		order <- roomID
+		release()
+	}
+	go acquire("!quiet:a.com")
+	waitForQueued(t, &p, 1)
+	go acquire("!active:a.com")
+	waitForQueued(t, &p, 2)
+
+	releaseFirst()
+	if got := <-order; got != "!active:a.com" {
+		t.Fatalf("expected the active room to go first, got %q", got)
+	}
+	if got := <-order; got != "!quiet:a.com" {
+		t.Fatalf("expected the quiet room to go second, got %q", got)
+	}
+	wg.Wait()
+	if p.running != 0 {
+		t.Fatalf("expected nothing to be running, got %d", p.running)
+	}
+}
+
+func TestRoomPrioritiesHintsExpire(t *testing.T) {
+	var p roomPriorities
+	now := time.Unix(1000, 0)
+	p.hint([]string{"!room:a.com"}, now, now.Add(time.Minute))
+
+	if got := p.priority("!room:a.com", now); got != priorityActive {
+		t.Fatalf("expected room to be active, got priority %d", got)
+	}
+	if got := p.priority("!room:a.com", now.Add(time.Minute)); got != priorityNormal {
+		t.Fatalf("expected hint to have expired, got priority %d", got)
+	}
+	if _, ok := p.hints["!room:a.com"]; ok {
+		t.Fatal("expected expired hint to be forgotten")
+	}
+}
+
+func TestRoomPrioritiesExpiredHintsAreSwept(t *testing.T) {
+	var p roomPriorities
+	now := time.Unix(1000, 0)
+	p.hint([]string{"!old:a.com"}, now, now.Add(time.Minute))
+	p.hint([]string{"!recent:a.com"}, now.Add(time.Second*30), now.Add(time.Second*90))
+
+	// No events arrive for either room, but hinting another room after the
+	// first hint has expired forgets about it.
+	later := now.Add(time.Minute)
+	p.hint([]string{"!new:a.com"}, later, later.Add(time.Minute))
+	if _, ok := p.hints["!old:a.com"]; ok {
+		t.Fatal("expected the expired hint to be swept")
+	}
+	for _, roomID := range []string{"!recent:a.com", "!new:a.com"} {
+		if _, ok := p.hints[roomID]; !ok {
+			t.Fatalf("expected the hint for %s to be kept", roomID)
+		}
+	}
+}
+
+func TestRoomPrioritiesUnlimited(t *testing.T) {
+	var p roomPriorities
+	for i := 0; i < 10; i++ {
+		if _, err := p.acquire(context.Background(), "!room:a.com", 0, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.running != 0 {
+		t.Fatalf("expected no tracking without a limit, got %d running", p.running)
+	}
+}
+
+func TestRoomPrioritiesGiveUpWhenContextDone(t *testing.T) {
+	var p roomPriorities
+	now := time.Now()
+	releaseFirst, err := p.acquire(context.Background(), "!busy:a.com", 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, aerr := p.acquire(ctx, "!room:a.com", 1, now)
+		errs <- aerr
+	}()
+	waitForQueued(t, &p, 1)
+	cancel()
+	if err = <-errs; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	waitForQueued(t, &p, 0)
+
+	releaseFirst()
+	if p.running != 0 {
+		t.Fatalf("expected nothing to be running, got %d", p.running)
+	}
+}
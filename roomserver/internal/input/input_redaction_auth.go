@@ -0,0 +1,60 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// checkRedactionAllowed checks that the sender of a redaction event is allowed
+// to redact the event that it redacts. It returns an error explaining why the
+// redaction should be rejected, or nil if it is allowed. If we don't have the
+// redacted event yet then nil is returned, and the database makes the same
+// check when the redacted event arrives instead, as only then can it apply the
+// redaction.
+func (r *Inputer) checkRedactionAllowed(
+	ctx context.Context, event *gomatrixserverlib.Event,
+) (rejectionErr error, err error) {
+	if event.Redacts() == "" || event.Redacts() == event.EventID() {
+		return nil, nil
+	}
+	redacted, err := r.DB.EventsFromIDs(ctx, []string{event.Redacts()})
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	if len(redacted) == 0 || redacted[0].Event == nil || redacted[0].RoomID() != event.RoomID() {
+		return nil, nil
+	}
+	authEvents, err := r.DB.EventsFromIDs(ctx, event.AuthEventIDs())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	authEventsList := make([]*gomatrixserverlib.Event, 0, len(authEvents))
+	for _, authEvent := range authEvents {
+		authEventsList = append(authEventsList, authEvent.Event)
+	}
+	allowed, err := eventutil.RedactionAllowed(event, redacted[0].Event, authEventsList)
+	if err != nil {
+		return nil, fmt.Errorf("eventutil.RedactionAllowed: %w", err)
+	}
+	if !allowed {
+		return fmt.Errorf("%s is not allowed to redact event %s sent by %s", event.Sender(), event.Redacts(), redacted[0].Sender()), nil
+	}
+	return nil, nil
+}
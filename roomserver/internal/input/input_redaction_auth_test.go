@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestCheckRedactionAllowed(t *testing.T) {
+	db := &fakeAuthFallbackDB{events: map[string]types.Event{}}
+	add := func(fields map[string]interface{}) *gomatrixserverlib.Event {
+		event := mustCreateEvent(t, fields)
+		db.events[event.EventID()] = types.Event{EventNID: types.EventNID(len(db.events) + 1), Event: event}
+		return event
+	}
+	authEvents := func(eventIDs ...string) [][]interface{} {
+		var refs [][]interface{}
+		for _, eventID := range eventIDs {
+			refs = append(refs, []interface{}{eventID, map[string]string{"sha256": ""}})
+		}
+		return refs
+	}
+	add(map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "", "sender": "@alice:localhost",
+		"content": map[string]interface{}{"creator": "@alice:localhost"},
+	})
+	add(map[string]interface{}{
+		"event_id": "$powerlevels:localhost", "type": gomatrixserverlib.MRoomPowerLevels, "state_key": "", "sender": "@alice:localhost",
+		"content": map[string]interface{}{"users": map[string]interface{}{"@alice:localhost": 100}, "redact": 50},
+	})
+	add(map[string]interface{}{"event_id": "$alicemessage:localhost", "sender": "@alice:localhost"})
+	add(map[string]interface{}{"event_id": "$bobmessage:localhost", "sender": "@bob:localhost"})
+	r := &Inputer{DB: db}
+
+	tests := []struct {
+		name        string
+		sender      string
+		redacts     string
+		wantAllowed bool
+	}{
+		{"own event", "@bob:localhost", "$bobmessage:localhost", true},
+		{"with the redact power level", "@alice:localhost", "$bobmessage:localhost", true},
+		{"without the redact power level", "@bob:localhost", "$alicemessage:localhost", false},
+		{"unknown event", "@bob:localhost", "$unknown:localhost", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			redaction := mustCreateEvent(t, map[string]interface{}{
+				"event_id":    "$redaction:localhost",
+				"type":        gomatrixserverlib.MRoomRedaction,
+				"sender":      tc.sender,
+				"redacts":     tc.redacts,
+				"auth_events": authEvents("$create:localhost", "$powerlevels:localhost"),
+			})
+			rejectionErr, err := r.checkRedactionAllowed(context.Background(), redaction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed := rejectionErr == nil; allowed != tc.wantAllowed {
+				t.Fatalf("got allowed %v (%v), want %v", allowed, rejectionErr, tc.wantAllowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(redactionDedupLookups)
+}
+
+var redactionDedupLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "redaction_dedup_lookups_total",
+		Help:      "Number of redaction output events checked against the in-memory dedup window, by whether they were found there",
+	},
+	[]string{"result"},
+)
+
+// redactionPair identifies a redaction output event.
+type redactionPair struct {
+	redactionEventID string
+	redactedEventID  string
+}
+
+func redactionPairFor(update *api.OutputEvent) (redactionPair, bool) {
+	if update.RedactedEvent == nil || update.RedactedEvent.RedactedBecause == nil {
+		return redactionPair{}, false
+	}
+	return redactionPair{
+		redactionEventID: update.RedactedEvent.RedactedBecause.EventID(),
+		redactedEventID:  update.RedactedEvent.RedactedEventID,
+	}, true
+}
+
+// redactionDedupWindow remembers the most recently emitted redactions, up to
+// a fixed number of them. It only ever saves a trip to the database: anything
+// that isn't in the window is checked against the output event markers.
+type redactionDedupWindow struct {
+	mu      sync.Mutex
+	entries map[redactionPair]struct{}
+	order   []redactionPair // ring buffer of entries, oldest first from next
+	next    int
+}
+
+// seen returns true if the redaction is in the window.
+func (w *redactionDedupWindow) seen(pair redactionPair, size int) bool {
+	if size <= 0 {
+		return false
+	}
+	w.mu.Lock()
+	_, ok := w.entries[pair]
+	w.mu.Unlock()
+	if ok {
+		redactionDedupLookups.WithLabelValues("hit").Inc()
+	} else {
+		redactionDedupLookups.WithLabelValues("miss").Inc()
+	}
+	return ok
+}
+
+// add puts the redaction into the window, pushing out the oldest redaction
+// if the window is full.
+func (w *redactionDedupWindow) add(pair redactionPair, size int) {
+	if size <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.entries == nil {
+		w.entries = make(map[redactionPair]struct{}, size)
+	}
+	if _, ok := w.entries[pair]; ok {
+		return
+	}
+	if len(w.order) < size {
+		w.order = append(w.order, pair)
+	} else {
+		delete(w.entries, w.order[w.next])
+		w.order[w.next] = pair
+		w.next = (w.next + 1) % len(w.order)
+	}
+	w.entries[pair] = struct{}{}
+}
+
+func (r *Inputer) redactionDedupWindowSize() int {
+	if r.Cfg == nil {
+		return 0
+	}
+	return r.Cfg.RedactionDedupWindow
+}
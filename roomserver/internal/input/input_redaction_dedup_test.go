@@ -0,0 +1,99 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// countingOutputEventTracker counts how often the database would be asked
+// whether an output event has been sent.
+type countingOutputEventTracker struct {
+	fakeOutputEventTracker
+	lookups int
+}
+
+func (c *countingOutputEventTracker) OutputEventsSent(keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	c.lookups++
+	return c.fakeOutputEventTracker.OutputEventsSent(keys)
+}
+
+func redactionOutput(t *testing.T, redactionEventID, redactedEventID string) []api.OutputEvent {
+	redaction := mustCreateEvent(t, map[string]interface{}{
+		"event_id": redactionEventID,
+		"type":     gomatrixserverlib.MRoomRedaction,
+		"redacts":  redactedEventID,
+	})
+	return []api.OutputEvent{
+		{
+			Type: api.OutputTypeRedactedEvent,
+			RedactedEvent: &api.OutputRedactedEvent{
+				RedactedEventID: redactedEventID,
+				RedactedBecause: redaction.Headered(gomatrixserverlib.RoomVersionV1),
+			},
+		},
+	}
+}
+
+func TestRedactionDedupWindow(t *testing.T) {
+	js := &fakeJetStream{}
+	r := &Inputer{
+		JetStream: js,
+		Cfg:       &config.RoomServer{RedactionDedupWindow: 1},
+	}
+	tracker := &countingOutputEventTracker{
+		fakeOutputEventTracker: fakeOutputEventTracker{sent: map[string]bool{}},
+	}
+	first := redactionOutput(t, "$redaction1:localhost", "$event1:localhost")
+	second := redactionOutput(t, "$redaction2:localhost", "$event2:localhost")
+
+	if err := r.writeOutputEvents(tracker, "!test:localhost", first); err != nil {
+		t.Fatal(err)
+	}
+	if len(js.published) != 1 || tracker.lookups != 1 {
+		t.Fatalf("expected 1 publish and 1 lookup, got %d and %d", len(js.published), tracker.lookups)
+	}
+
+	// The same redaction again, within the window, is skipped without
+	// asking the database.
+	if err := r.writeOutputEvents(tracker, "!test:localhost", first); err != nil {
+		t.Fatal(err)
+	}
+	if len(js.published) != 1 || tracker.lookups != 1 {
+		t.Fatalf("expected 1 publish and 1 lookup, got %d and %d", len(js.published), tracker.lookups)
+	}
+
+	// Another redaction pushes the first one out of the window.
+	if err := r.writeOutputEvents(tracker, "!test:localhost", second); err != nil {
+		t.Fatal(err)
+	}
+	if len(js.published) != 2 || tracker.lookups != 2 {
+		t.Fatalf("expected 2 publishes and 2 lookups, got %d and %d", len(js.published), tracker.lookups)
+	}
+
+	// The first redaction again, now outside the window, falls back to the
+	// database, which still knows that it was sent.
+	if err := r.writeOutputEvents(tracker, "!test:localhost", first); err != nil {
+		t.Fatal(err)
+	}
+	if len(js.published) != 2 || tracker.lookups != 3 {
+		t.Fatalf("expected 2 publishes and 3 lookups, got %d and %d", len(js.published), tracker.lookups)
+	}
+}
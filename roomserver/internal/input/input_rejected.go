@@ -0,0 +1,188 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Arceliar/phony"
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(rejectedEventsUnrejected)
+}
+
+var rejectedEventsUnrejected = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "rejected_events_unrejected_total",
+		Help:      "Number of rejected events which passed auth when reprocessed and are no longer rejected",
+	},
+)
+
+// rejectedEventsPageSize is how many rejected events are loaded from the
+// database at a time when reprocessing them.
+const rejectedEventsPageSize = 100
+
+// ReprocessRejectedEvents re-runs the auth checks for the events in the room
+// which were rejected by auth against freshly fetched auth events, and
+// un-rejects any which now pass. Events which were rejected for any other
+// reason, such as being vetoed by the acceptance webhook or a validator, or
+// missing their prev events, are never reconsidered since passing auth says
+// nothing about whether they should still be rejected. Un-rejected events
+// which have a state are brought into the room as if they had just arrived,
+// so they may still be soft-failed. It returns the number of events
+// un-rejected. It is safe to call repeatedly, since events which are no
+// longer rejected are never looked at again.
+func (r *Inputer) ReprocessRejectedEvents(ctx context.Context, roomID string) (unrejected int, err error) {
+	// Run on the room's worker, so that we aren't racing with any input
+	// events for the room that are being processed at the same time.
+	phony.Block(r.workerForRoom(roomID), func() {
+		var roomInfo *types.RoomInfo
+		roomInfo, err = r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			err = fmt.Errorf("r.DB.RoomInfo: %w", err)
+			return
+		}
+		if roomInfo == nil || roomInfo.IsStub {
+			err = fmt.Errorf("room %q is not known", roomID)
+			return
+		}
+		serverReq := &fedapi.QueryJoinedHostServerNamesInRoomRequest{
+			RoomID:      roomID,
+			ExcludeSelf: true,
+		}
+		serverRes := &fedapi.QueryJoinedHostServerNamesInRoomResponse{}
+		if qerr := r.FSAPI.QueryJoinedHostServerNamesInRoom(ctx, serverReq, serverRes); qerr != nil {
+			// We can still reprocess events whose auth events we already have.
+			logrus.WithError(qerr).WithField("room_id", roomID).Warn("Failed to find servers to fetch auth events from")
+		}
+		unrejected, err = r.reprocessRejected(ctx, roomInfo, serverRes.ServerNames, func(stateAtEvent types.StateAtEvent, event *gomatrixserverlib.HeaderedEvent) error {
+			return r.acceptUnrejectedEvent(ctx, roomInfo, stateAtEvent, event)
+		})
+	})
+	return
+}
+
+// acceptUnrejectedEvent brings an event which is no longer rejected into the
+// room, unless it fails auth against the current state of the room, in which
+// case it is soft-failed instead.
+func (r *Inputer) acceptUnrejectedEvent(
+	ctx context.Context, roomInfo *types.RoomInfo, stateAtEvent types.StateAtEvent, event *gomatrixserverlib.HeaderedEvent,
+) error {
+	softfail, err := helpers.CheckForSoftFail(ctx, r.DB, event, nil)
+	if err != nil {
+		return fmt.Errorf("helpers.CheckForSoftFail: %w", err)
+	}
+	if softfail {
+		if err = r.recordSoftFailedEvent(ctx, roomInfo, stateAtEvent); err != nil {
+			return err
+		}
+		return r.writeSoftFailedEvent(event, "event fails auth against the current room state")
+	}
+	return r.updateLatestEvents(ctx, roomInfo, stateAtEvent, event.Unwrap(), "", nil, false)
+}
+
+// reprocessRejected does the work of ReprocessRejectedEvents. The function which
+// brings an un-rejected event into the room is a parameter so that it can be
+// replaced in tests.
+//
+// Each event is only un-rejected once it has been accepted. If we fail in
+// between then it will be accepted again next time, which is harmless since
+// updateLatestEvents ignores events which have already been sent.
+func (r *Inputer) reprocessRejected(
+	ctx context.Context, roomInfo *types.RoomInfo, servers []gomatrixserverlib.ServerName,
+	accept func(types.StateAtEvent, *gomatrixserverlib.HeaderedEvent) error,
+) (int, error) {
+	unrejected := 0
+	var afterNID types.EventNID
+	for {
+		eventNIDs, err := r.DB.GetRejectedEventNIDs(ctx, roomInfo.RoomNID, afterNID, rejectedEventsPageSize)
+		if err != nil {
+			return unrejected, fmt.Errorf("r.DB.GetRejectedEventNIDs: %w", err)
+		}
+		if len(eventNIDs) == 0 {
+			return unrejected, nil
+		}
+		afterNID = eventNIDs[len(eventNIDs)-1]
+		events, err := r.DB.Events(ctx, eventNIDs)
+		if err != nil {
+			return unrejected, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		for _, event := range events {
+			ok, err := r.reprocessRejectedEvent(ctx, roomInfo, servers, event, accept)
+			if err != nil {
+				return unrejected, err
+			}
+			if ok {
+				unrejected++
+			}
+		}
+	}
+}
+
+func (r *Inputer) reprocessRejectedEvent(
+	ctx context.Context, roomInfo *types.RoomInfo, servers []gomatrixserverlib.ServerName, event types.Event,
+	accept func(types.StateAtEvent, *gomatrixserverlib.HeaderedEvent) error,
+) (bool, error) {
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":  event.RoomID(),
+		"event_id": event.EventID(),
+	})
+	headered := event.Headered(roomInfo.RoomVersion)
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	if err := r.fetchAuthEvents(ctx, logger, headered, &authEvents, map[string]*types.Event{}, servers); err != nil {
+		logger.WithError(err).Warn("Failed to fetch auth events for rejected event")
+		return false, nil
+	}
+	if err := gomatrixserverlib.Allowed(event.Event, &authEvents); err != nil {
+		logger.WithError(err).Debug("Rejected event still fails auth")
+		return false, nil
+	}
+
+	// If we know the state before the event then it is bringing it into the
+	// room, otherwise it is an outlier and there's nothing more to do than
+	// un-rejecting it.
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, []string{event.EventID()})
+	switch err.(type) {
+	case nil:
+		if len(stateAtEvents) != 1 {
+			return false, fmt.Errorf("r.DB.StateAtEventIDs: expected 1 result, got %d", len(stateAtEvents))
+		}
+		stateAtEvent := stateAtEvents[0]
+		stateAtEvent.IsRejected = false
+		if err = accept(stateAtEvent, headered); err != nil {
+			return false, fmt.Errorf("accept: %w", err)
+		}
+	case types.MissingEventError:
+	default:
+		return false, fmt.Errorf("r.DB.StateAtEventIDs: %w", err)
+	}
+
+	if err = r.DB.UnrejectEvent(ctx, event.EventNID); err != nil {
+		return false, fmt.Errorf("r.DB.UnrejectEvent: %w", err)
+	}
+	rejectedEventsUnrejected.Inc()
+	logger.Info("Rejected event now passes auth and is no longer rejected")
+	return true, nil
+}
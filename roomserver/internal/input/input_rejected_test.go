@@ -0,0 +1,148 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// rejectedEventsDB extends fakeAuthFallbackDB with a set of rejected events.
+type rejectedEventsDB struct {
+	fakeAuthFallbackDB
+	rejected map[types.EventNID]struct{}
+}
+
+func (d *rejectedEventsDB) GetRejectedEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, afterNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	var eventNIDs []types.EventNID
+	for eventNID := range d.rejected {
+		if eventNID > afterNID {
+			eventNIDs = append(eventNIDs, eventNID)
+		}
+	}
+	sort.Slice(eventNIDs, func(i, j int) bool { return eventNIDs[i] < eventNIDs[j] })
+	if len(eventNIDs) > limit {
+		eventNIDs = eventNIDs[:limit]
+	}
+	return eventNIDs, nil
+}
+
+func (d *rejectedEventsDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var events []types.Event
+	for _, eventNID := range eventNIDs {
+		for _, ev := range d.events {
+			if ev.EventNID == eventNID {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (d *rejectedEventsDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	ev := d.events[eventIDs[0]]
+	_, rejected := d.rejected[ev.EventNID]
+	return []types.StateAtEvent{{
+		BeforeStateSnapshotNID: 1,
+		IsRejected:             rejected,
+		StateEntry:             types.StateEntry{EventNID: ev.EventNID},
+	}}, nil
+}
+
+func (d *rejectedEventsDB) UnrejectEvent(ctx context.Context, eventNID types.EventNID) error {
+	delete(d.rejected, eventNID)
+	return nil
+}
+
+func TestReprocessRejectedEvents(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := mustBuildSignedEvent(t, private, 1, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:remote",
+	}, []string{})
+	join := mustBuildSignedEvent(t, private, 2, gomatrixserverlib.MRoomMember, "@alice:remote", map[string]interface{}{
+		"membership": "join",
+	}, []string{create.EventID()})
+	event := mustBuildSignedEvent(t, private, 3, "m.room.topic", "", map[string]interface{}{
+		"topic": "test",
+	}, []string{create.EventID(), join.EventID()})
+
+	// The event was rejected, and its join auth event isn't known to us or
+	// available over federation.
+	db := &rejectedEventsDB{
+		fakeAuthFallbackDB: fakeAuthFallbackDB{events: map[string]types.Event{
+			create.EventID(): {EventNID: 1, Event: create},
+			event.EventID():  {EventNID: 3, Event: event},
+		}},
+		rejected: map[types.EventNID]struct{}{3: {}},
+	}
+	r := &Inputer{
+		DB: db,
+		FSAPI: &fakeAuthFallbackFSAPI{
+			keyRing: &gomatrixserverlib.KeyRing{KeyDatabase: &fakeKeyDatabase{public}},
+			events:  map[string]*gomatrixserverlib.Event{},
+		},
+	}
+	roomInfo := &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV6}
+	servers := []gomatrixserverlib.ServerName{"remote"}
+
+	var acceptedEventIDs []string
+	accept := func(stateAtEvent types.StateAtEvent, ev *gomatrixserverlib.HeaderedEvent) error {
+		if stateAtEvent.IsRejected {
+			t.Errorf("accepted event is still rejected: %+v", stateAtEvent)
+		}
+		acceptedEventIDs = append(acceptedEventIDs, ev.EventID())
+		return nil
+	}
+
+	unrejected, err := r.reprocessRejected(context.Background(), roomInfo, servers, accept)
+	if err != nil {
+		t.Fatalf("reprocessRejected: %s", err)
+	}
+	if unrejected != 0 || len(acceptedEventIDs) != 0 || len(db.rejected) != 1 {
+		t.Fatalf("expected the event to stay rejected, got %d unrejected: %v", unrejected, acceptedEventIDs)
+	}
+
+	// Once the missing auth event is present, the event passes auth.
+	db.events[join.EventID()] = types.Event{EventNID: 2, Event: join}
+	unrejected, err = r.reprocessRejected(context.Background(), roomInfo, servers, accept)
+	if err != nil {
+		t.Fatalf("reprocessRejected: %s", err)
+	}
+	if unrejected != 1 || len(acceptedEventIDs) != 1 || acceptedEventIDs[0] != event.EventID() {
+		t.Fatalf("expected %s to be unrejected and accepted, got %d: %v", event.EventID(), unrejected, acceptedEventIDs)
+	}
+	if len(db.rejected) != 0 {
+		t.Fatalf("expected no events to remain rejected, got %v", db.rejected)
+	}
+
+	// Reprocessing again is a no-op.
+	unrejected, err = r.reprocessRejected(context.Background(), roomInfo, servers, accept)
+	if err != nil {
+		t.Fatalf("reprocessRejected: %s", err)
+	}
+	if unrejected != 0 || len(acceptedEventIDs) != 1 {
+		t.Fatalf("expected nothing more to happen, got %d: %v", unrejected, acceptedEventIDs)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRejectedEventLogsAuthEvents(t *testing.T) {
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "",
+		"content": map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$join:localhost", "type": gomatrixserverlib.MRoomMember, "state_key": "@test:localhost",
+		"content": map[string]interface{}{"membership": "join"}, "auth_events": eventRefs("$create:localhost"),
+		"prev_events": eventRefs("$create:localhost"),
+	})
+	db := &resultsDB{
+		fakeAuthFallbackDB: fakeAuthFallbackDB{events: map[string]types.Event{
+			create.EventID(): {EventNID: 1, Event: create},
+			join.EventID():   {EventNID: 2, Event: join},
+		}},
+		sent: map[string]bool{},
+	}
+	r := &Inputer{
+		DB:         db,
+		Queryer:    &query.Queryer{DB: db},
+		JetStream:  &fakeJetStream{},
+		ServerName: "localhost",
+	}
+
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	ctx := util.ContextWithLogger(context.Background(), logrus.NewEntry(logger))
+
+	// The stranger claims someone else's membership as an auth event, which
+	// the auth checks don't look at for their event.
+	input := &api.InputRoomEvent{
+		Kind: api.KindOld,
+		Event: mustCreateEvent(t, map[string]interface{}{
+			"event_id":    "$rejected:localhost",
+			"sender":      "@stranger:localhost",
+			"auth_events": eventRefs("$create:localhost", "$join:localhost"),
+			"prev_events": eventRefs("$join:localhost"),
+			"depth":       3,
+		}).Headered(gomatrixserverlib.RoomVersionV1),
+	}
+	if _, err := r.processRoomEvent(ctx, input); err == nil {
+		t.Fatal("expected the event to be rejected")
+	}
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level != logrus.DebugLevel || entry.Message != "Auth events considered for rejected event" {
+			continue
+		}
+		if got, want := entry.Data["claimed_auth_event_ids"], []string{"$create:localhost", "$join:localhost"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got claimed auth events %v, want %v", got, want)
+		}
+		if got, want := entry.Data["loaded_auth_event_ids"], []string{"$create:localhost"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got loaded auth events %v, want %v", got, want)
+		}
+		if entry.Data[logrus.ErrorKey] == nil {
+			t.Error("expected the rejection error to be logged")
+		}
+		return
+	}
+	t.Fatal("expected the auth events of the rejected event to be logged")
+}
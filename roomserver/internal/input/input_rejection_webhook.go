@@ -0,0 +1,163 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(rejectionWebhookNotifications)
+}
+
+var rejectionWebhookNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "rejection_webhook_notifications_total",
+		Help:      "Number of rejected events which the rejection webhook was told about, by outcome",
+	},
+	[]string{"outcome"},
+)
+
+// rejectionWebhookRequest is the body POSTed to the rejection webhook.
+type rejectionWebhookRequest struct {
+	Timestamp gomatrixserverlib.Timestamp  `json:"ts"`
+	EventID   string                       `json:"event_id"`
+	RoomID    string                       `json:"room_id"`
+	Sender    string                       `json:"sender"`
+	Type      string                       `json:"type"`
+	Kind      string                       `json:"kind"`
+	Origin    gomatrixserverlib.ServerName `json:"origin,omitempty"`
+	Reason    string                       `json:"reason"`
+}
+
+// rejectionWebhook sends rejected events to the webhook in the background,
+// so that event processing never waits for the webhook. Rejections are
+// dropped if the buffer is full.
+type rejectionWebhook struct {
+	client   *http.Client
+	url      string
+	requests chan rejectionWebhookRequest
+}
+
+func newRejectionWebhook(client *http.Client, url string, bufferSize int) *rejectionWebhook {
+	w := &rejectionWebhook{
+		client:   client,
+		url:      url,
+		requests: make(chan rejectionWebhookRequest, bufferSize),
+	}
+	go w.send()
+	return w
+}
+
+// makeRejectionWebhookClient returns an HTTP client for the rejection
+// webhook which keeps its connection open, since the webhook is sent to
+// from a single goroutine.
+func makeRejectionWebhookClient(opts *config.RejectionWebhookOptions) *http.Client {
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConns:        1,
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+func (w *rejectionWebhook) send() {
+	for req := range w.requests {
+		if err := w.post(req); err != nil {
+			rejectionWebhookNotifications.WithLabelValues("failed").Inc()
+			logrus.WithError(err).WithField("event_id", req.EventID).Warn("Failed to tell the rejection webhook about a rejected event")
+			continue
+		}
+		rejectionWebhookNotifications.WithLabelValues("sent").Inc()
+	}
+}
+
+func (w *rejectionWebhook) post(req rejectionWebhookRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("w.client.Do: %w", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("received HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *rejectionWebhook) add(req rejectionWebhookRequest) {
+	select {
+	case w.requests <- req:
+	default:
+		rejectionWebhookNotifications.WithLabelValues("dropped").Inc()
+	}
+}
+
+// startRejectionWebhook starts sending rejected events to the rejection
+// webhook if one is configured.
+func (r *Inputer) startRejectionWebhook() {
+	if r.Cfg == nil || r.Cfg.RejectionWebhook.URL == "" {
+		return
+	}
+	opts := &r.Cfg.RejectionWebhook
+	r.rejections = newRejectionWebhook(makeRejectionWebhookClient(opts), opts.URL, opts.BufferSize)
+}
+
+// notifyRejection tells the rejection webhook, if there is one, that an
+// event was rejected. It never blocks.
+func (r *Inputer) notifyRejection(input *api.InputRoomEvent, rejectionErr error) {
+	if r.rejections == nil {
+		return
+	}
+	req := rejectionWebhookRequest{
+		Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+		EventID:   input.Event.EventID(),
+		RoomID:    input.Event.RoomID(),
+		Sender:    input.Event.Sender(),
+		Type:      input.Event.Type(),
+		Kind:      decisionLogKinds[input.Kind],
+		Origin:    input.Origin,
+	}
+	if rejectionErr != nil {
+		req.Reason = rejectionErr.Error()
+	}
+	r.rejections.add(req)
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestRejectionWebhook(t *testing.T) {
+	received := make(chan rejectionWebhookRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rejectionWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode webhook request: %s", err)
+		}
+		received <- req
+	}))
+	defer server.Close()
+
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "",
+		"content": map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$join:localhost", "type": gomatrixserverlib.MRoomMember, "state_key": "@test:localhost",
+		"content": map[string]interface{}{"membership": "join"}, "auth_events": eventRefs("$create:localhost"),
+		"prev_events": eventRefs("$create:localhost"),
+	})
+	db := &resultsDB{
+		fakeAuthFallbackDB: fakeAuthFallbackDB{events: map[string]types.Event{
+			create.EventID(): {EventNID: 1, Event: create},
+			join.EventID():   {EventNID: 2, Event: join},
+		}},
+		sent: map[string]bool{},
+	}
+	r := &Inputer{
+		DB:         db,
+		Queryer:    &query.Queryer{DB: db},
+		JetStream:  &fakeJetStream{},
+		ServerName: "localhost",
+		rejections: newRejectionWebhook(server.Client(), server.URL, 1),
+	}
+
+	// A stranger who isn't in the room can't send events to it.
+	input := &api.InputRoomEvent{
+		Kind:   api.KindOld,
+		Origin: "remote",
+		Event: mustCreateEvent(t, map[string]interface{}{
+			"event_id":    "$rejected:localhost",
+			"sender":      "@stranger:localhost",
+			"auth_events": eventRefs("$create:localhost", "$join:localhost"),
+			"prev_events": eventRefs("$join:localhost"),
+			"depth":       3,
+		}).Headered(gomatrixserverlib.RoomVersionV1),
+	}
+	if _, err := r.processRoomEvent(context.Background(), input); err == nil {
+		t.Fatal("expected the event to be rejected")
+	}
+
+	select {
+	case req := <-received:
+		if req.EventID != "$rejected:localhost" || req.RoomID != "!test:localhost" {
+			t.Errorf("got event %q in room %q, want %q in room %q", req.EventID, req.RoomID, "$rejected:localhost", "!test:localhost")
+		}
+		if req.Sender != "@stranger:localhost" || req.Origin != "remote" || req.Kind != "old" {
+			t.Errorf("got sender %q, origin %q and kind %q", req.Sender, req.Origin, req.Kind)
+		}
+		if !strings.Contains(req.Reason, "@stranger:localhost") {
+			t.Errorf("got reason %q, want it to mention the sender", req.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the rejection webhook")
+	}
+}
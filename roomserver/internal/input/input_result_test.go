@@ -0,0 +1,225 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/roomserver/validator"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// resultsDB is a room in which every known event has a state, so that
+// processing an event never needs to calculate one. Calling any other
+// storage.Database method will panic.
+type resultsDB struct {
+	fakeAuthFallbackDB
+	sent           map[string]bool
+	rejectedByAuth map[string]bool
+}
+
+func (d *resultsDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (d *resultsDB) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	nids := map[string]types.EventNID{}
+	for _, eventID := range eventIDs {
+		if ev, ok := d.events[eventID]; ok {
+			nids[eventID] = ev.EventNID
+		}
+	}
+	return nids, nil
+}
+
+func (d *resultsDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	var states []types.StateAtEvent
+	for _, eventID := range eventIDs {
+		if ev, ok := d.events[eventID]; ok {
+			states = append(states, types.StateAtEvent{
+				BeforeStateSnapshotNID: 1,
+				StateEntry:             types.StateEntry{EventNID: ev.EventNID},
+			})
+		}
+	}
+	return states, nil
+}
+
+func (d *resultsDB) StoreEvent(
+	ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID, isRejected, rejectedByAuth bool, rejectionReason string,
+) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	nid, roomNID, _, _, _, err := d.fakeAuthFallbackDB.StoreEvent(ctx, event, authEventNIDs, isRejected, rejectedByAuth, rejectionReason)
+	if d.rejectedByAuth != nil {
+		d.rejectedByAuth[event.EventID()] = rejectedByAuth
+	}
+	return nid, roomNID, types.StateAtEvent{
+		BeforeStateSnapshotNID: 1,
+		IsRejected:             isRejected,
+		StateEntry:             types.StateEntry{EventNID: nid},
+	}, nil, "", err
+}
+
+func (d *resultsDB) OutputEventsSent(ctx context.Context, keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	sent := map[types.OutputEventKey]bool{}
+	for _, key := range keys {
+		sent[key] = d.sent[key.EventID+key.OutputType]
+	}
+	return sent, nil
+}
+
+func (d *resultsDB) MarkOutputEventsAsSent(ctx context.Context, keys []types.OutputEventKey) error {
+	for _, key := range keys {
+		d.sent[key.EventID+key.OutputType] = true
+	}
+	return nil
+}
+
+// eventRefs builds the auth_events or prev_events of a V1 event.
+func eventRefs(eventIDs ...string) [][]interface{} {
+	var refs [][]interface{}
+	for _, eventID := range eventIDs {
+		refs = append(refs, []interface{}{eventID, map[string]string{"sha256": ""}})
+	}
+	return refs
+}
+
+func TestProcessRoomEventResults(t *testing.T) {
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "",
+		"content": map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$join:localhost", "type": gomatrixserverlib.MRoomMember, "state_key": "@test:localhost",
+		"content": map[string]interface{}{"membership": "join"}, "auth_events": eventRefs("$create:localhost"),
+		"prev_events": eventRefs("$create:localhost"),
+	})
+	db := &resultsDB{
+		fakeAuthFallbackDB: fakeAuthFallbackDB{events: map[string]types.Event{
+			create.EventID(): {EventNID: 1, Event: create},
+			join.EventID():   {EventNID: 2, Event: join},
+		}},
+		sent:           map[string]bool{},
+		rejectedByAuth: map[string]bool{},
+	}
+	cfg := &config.RoomServer{
+		FutureEvents: config.FutureEventsOptions{
+			Action:  config.FutureEventsActionSoftFail,
+			MaxSkew: time.Minute,
+		},
+		// Skip the soft-fail checks against the current room state, which
+		// would need the full room state.
+		SoftFailDisabledRooms: []string{"!test:localhost"},
+	}
+	r := &Inputer{
+		Cfg:        cfg,
+		DB:         db,
+		Queryer:    &query.Queryer{DB: db},
+		JetStream:  &fakeJetStream{},
+		ServerName: "localhost",
+		Validators: []validator.Named{{
+			Name: "veto",
+			Validator: validator.Func(func(_ context.Context, ev *gomatrixserverlib.HeaderedEvent, _ gomatrixserverlib.ServerName) (validator.Result, error) {
+				if ev.EventID() == "$vetoed:localhost" {
+					return validator.Result{Outcome: validator.Reject, Reason: "vetoed"}, nil
+				}
+				return validator.Result{Outcome: validator.Accept}, nil
+			}),
+		}},
+	}
+
+	tests := []struct {
+		name    string
+		kind    api.Kind
+		fields  map[string]interface{}
+		want    api.InputRoomEventResult
+		wantErr bool
+		// Whether the event should be stored as rejected only because it
+		// failed auth, so that it is reprocessed later.
+		wantRejectedByAuth bool
+	}{
+		{
+			name: "accepted",
+			kind: api.KindOld,
+			fields: map[string]interface{}{
+				"event_id": "$accepted:localhost",
+			},
+			want: api.InputRoomEventResult{EventID: "$accepted:localhost", Stored: true},
+		},
+		{
+			name: "not allowed",
+			kind: api.KindOld,
+			fields: map[string]interface{}{
+				"event_id": "$rejected:localhost", "sender": "@stranger:localhost",
+				"auth_events": eventRefs("$create:localhost"),
+			},
+			want:               api.InputRoomEventResult{EventID: "$rejected:localhost", Rejected: true, NotAllowed: true, Stored: true},
+			wantErr:            true,
+			wantRejectedByAuth: true,
+		},
+		{
+			name: "rejected by validator",
+			kind: api.KindNew,
+			fields: map[string]interface{}{
+				"event_id": "$vetoed:localhost",
+			},
+			want:    api.InputRoomEventResult{EventID: "$vetoed:localhost", Rejected: true, Stored: true},
+			wantErr: true,
+		},
+		{
+			name: "soft-failed",
+			kind: api.KindNew,
+			fields: map[string]interface{}{
+				"event_id":         "$softfailed:localhost",
+				"origin_server_ts": gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+			},
+			want: api.InputRoomEventResult{EventID: "$softfailed:localhost", SoftFailed: true, Stored: true},
+		},
+	}
+	for _, tc := range tests {
+		fields := map[string]interface{}{
+			"auth_events": eventRefs("$create:localhost", "$join:localhost"),
+			"prev_events": eventRefs("$join:localhost"),
+			"depth":       3,
+		}
+		for k, v := range tc.fields {
+			fields[k] = v
+		}
+		input := &api.InputRoomEvent{
+			Kind:  tc.kind,
+			Event: mustCreateEvent(t, fields).Headered(gomatrixserverlib.RoomVersionV1),
+		}
+		result, err := r.processRoomEvent(context.Background(), input)
+		var rejected *rejectedEventError
+		if tc.wantErr && !errors.As(err, &rejected) {
+			t.Fatalf("%s: expected a rejection error, got %v", tc.name, err)
+		}
+		if !tc.wantErr && err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.name, err)
+		}
+		if result != tc.want {
+			t.Fatalf("%s: got result %+v, want %+v", tc.name, result, tc.want)
+		}
+		if got := db.rejectedByAuth[result.EventID]; got != tc.wantRejectedByAuth {
+			t.Fatalf("%s: got rejected by auth %v, want %v", tc.name, got, tc.wantRejectedByAuth)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// rewindOutputEventTracker forces output events to be sent even if they have
+// been sent before, since rewinding (or completing partial state) deliberately
+// replays an event so that downstream components can resync the room state.
+// Output events are still marked as sent afterwards.
+type rewindOutputEventTracker struct {
+	outputEventTracker
+}
+
+func (t rewindOutputEventTracker) OutputEventsSent(keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	return nil, nil
+}
+
+// RewindRoomState replaces the current state of a room with the state after
+// the given target event, and makes the target event the only forward
+// extremity of the room.
+//
+// This is intended for recovering from state corruption and is extremely
+// destructive: any state changes after the target event are discarded from
+// the current state, memberships are updated to match, and downstream
+// components are told to throw away their copy of the room state and replace
+// it with the rewound state. New events will be built on top of the target
+// event. Events that were sent after the target event are not deleted, but
+// they will no longer be reachable from the forward extremities until other
+// servers send events that reference them.
+//
+// A record of the previous state snapshot and forward extremities is stored
+// and returned, so that the rewind can be inspected or undone later.
+func (r *Inputer) RewindRoomState(
+	ctx context.Context, roomID, targetEventID string,
+) (rewind *types.StateRewind, err error) {
+	// Run on the room's worker, so that we aren't racing with any input
+	// events for the room that are being processed at the same time.
+	phony.Block(r.workerForRoom(roomID), func() {
+		rewind, err = r.rewindRoomState(ctx, roomID, targetEventID)
+	})
+	return
+}
+
+func (r *Inputer) rewindRoomState(
+	ctx context.Context, roomID, targetEventID string,
+) (rewind *types.StateRewind, err error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return nil, fmt.Errorf("room %q is not known", roomID)
+	}
+
+	events, err := r.DB.EventsFromIDs(ctx, []string{targetEventID})
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	if len(events) != 1 {
+		return nil, fmt.Errorf("event %q is not known", targetEventID)
+	}
+	target := events[0]
+	if target.RoomID() != roomID {
+		return nil, fmt.Errorf("event %q is not in room %q", targetEventID, roomID)
+	}
+
+	// This will fail if the event is an outlier, since we won't know the
+	// state before it.
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, []string{targetEventID})
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.StateAtEventIDs: %w", err)
+	}
+	stateAtTarget := stateAtEvents[0]
+	if stateAtTarget.IsRejected {
+		return nil, fmt.Errorf("event %q was rejected", targetEventID)
+	}
+
+	// Work out the state after the target event. This becomes the new
+	// current state of the room.
+	roomState := r.newStateResolution(roomInfo, roomID)
+	newStateNID, err := roomState.CalculateAndStoreStateAfterEvents(ctx, []types.StateAtEvent{stateAtTarget})
+	if err != nil {
+		return nil, fmt.Errorf("roomState.CalculateAndStoreStateAfterEvents: %w", err)
+	}
+
+	updater, err := r.DB.GetLatestEventsForUpdate(ctx, *roomInfo)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetLatestEventsForUpdate: %w", err)
+	}
+	succeeded := false
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+
+	oldStateNID := updater.CurrentStateSnapshotNID()
+	rewind = &types.StateRewind{
+		RoomID:                   roomID,
+		TargetEventID:            targetEventID,
+		RewoundAt:                gomatrixserverlib.AsTimestamp(time.Now()),
+		PreviousStateSnapshotNID: oldStateNID,
+		PreviousLatestEventIDs:   []string{},
+		NewStateSnapshotNID:      newStateNID,
+	}
+	for _, latest := range updater.LatestEvents() {
+		rewind.PreviousLatestEventIDs = append(rewind.PreviousLatestEventIDs, latest.EventID)
+	}
+
+	// Update the membership table based on the actual difference between
+	// the old and new current state, so that users who joined or left after
+	// the target event are handled properly.
+	removed, added, err := roomState.DifferenceBetweeenStateSnapshots(ctx, oldStateNID, newStateNID)
+	if err != nil {
+		return nil, fmt.Errorf("roomState.DifferenceBetweeenStateSnapshots: %w", err)
+	}
+	updates, err := r.updateMemberships(ctx, updater, removed, added)
+	if err != nil {
+		return nil, fmt.Errorf("r.updateMemberships: %w", err)
+	}
+
+	// Downstream components purge their copy of the room state when they see
+	// an output event that rewrites state, so the output event needs to list
+	// the entire new state rather than just the difference.
+	latest := types.StateAtEventAndReference{
+		StateAtEvent:   stateAtTarget,
+		EventReference: target.EventReference(),
+	}
+	u := latestEventsUpdater{
+		ctx:             ctx,
+		api:             r,
+		updater:         updater,
+		roomInfo:        roomInfo,
+		stateAtEvent:    stateAtTarget,
+		event:           target.Event,
+		rewritesState:   true,
+		lastEventIDSent: updater.LastEventIDSent(),
+		latest:          []types.StateAtEventAndReference{latest},
+		oldStateNID:     oldStateNID,
+		newStateNID:     newStateNID,
+	}
+	if _, u.added, err = roomState.DifferenceBetweeenStateSnapshots(ctx, 0, newStateNID); err != nil {
+		return nil, fmt.Errorf("roomState.DifferenceBetweeenStateSnapshots: %w", err)
+	}
+	if u.stateBeforeEventRemoves, u.stateBeforeEventAdds, err = roomState.DifferenceBetweeenStateSnapshots(
+		ctx, newStateNID, stateAtTarget.BeforeStateSnapshotNID,
+	); err != nil {
+		return nil, fmt.Errorf("roomState.DifferenceBetweeenStateSnapshots: %w", err)
+	}
+	update, err := u.makeOutputNewRoomEvent()
+	if err != nil {
+		return nil, fmt.Errorf("u.makeOutputNewRoomEvent: %w", err)
+	}
+	updates = append(updates, *update)
+
+	if err = updater.RecordStateRewind(rewind); err != nil {
+		return nil, fmt.Errorf("updater.RecordStateRewind: %w", err)
+	}
+	if err = r.writeOutputEvents(rewindOutputEventTracker{updater}, roomID, updates); err != nil {
+		return nil, fmt.Errorf("r.writeOutputEvents: %w", err)
+	}
+	if err = updater.SetLatestEvents(roomInfo.RoomNID, u.latest, stateAtTarget.EventNID, newStateNID); err != nil {
+		return nil, fmt.Errorf("updater.SetLatestEvents: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"room_id":                     roomID,
+		"target_event_id":             targetEventID,
+		"previous_state_snapshot_nid": oldStateNID,
+		"previous_latest_event_ids":   rewind.PreviousLatestEventIDs,
+		"new_state_snapshot_nid":      newStateNID,
+		"removed_state_events":        len(removed),
+		"added_state_events":          len(added),
+	}).Warn("AUDIT: Room state has been rewound")
+
+	succeeded = true
+	return rewind, nil
+}
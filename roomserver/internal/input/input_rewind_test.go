@@ -0,0 +1,114 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeRewindDB knows about a single room and a set of events. Calling any
+// other storage.Database method will panic.
+type fakeRewindDB struct {
+	storage.Database
+	roomID string
+	events map[string]*gomatrixserverlib.Event
+}
+
+func (d *fakeRewindDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != d.roomID {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (d *fakeRewindDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	var events []types.Event
+	for _, eventID := range eventIDs {
+		if event, ok := d.events[eventID]; ok {
+			events = append(events, types.Event{Event: event})
+		}
+	}
+	return events, nil
+}
+
+func TestRewindRoomStateRejectsBadTargets(t *testing.T) {
+	otherRoomEvent := mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$other:localhost",
+		"room_id":  "!other:localhost",
+	})
+	db := &fakeRewindDB{
+		roomID: "!test:localhost",
+		events: map[string]*gomatrixserverlib.Event{
+			otherRoomEvent.EventID(): otherRoomEvent,
+		},
+	}
+	r := &Inputer{DB: db}
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		roomID        string
+		targetEventID string
+	}{
+		{"unknown room", "!unknown:localhost", "$other:localhost"},
+		{"unknown event", "!test:localhost", "$unknown:localhost"},
+		{"event in another room", "!test:localhost", "$other:localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewind, err := r.RewindRoomState(ctx, tt.roomID, tt.targetEventID)
+			if err == nil {
+				t.Fatalf("expected an error, got rewind %+v", rewind)
+			}
+		})
+	}
+}
+
+func TestRewindOutputEventTrackerResendsOutputEvents(t *testing.T) {
+	event := mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)
+	updates := []api.OutputEvent{
+		{
+			Type:         api.OutputTypeNewRoomEvent,
+			NewRoomEvent: &api.OutputNewRoomEvent{Event: event, RewritesState: true},
+		},
+	}
+
+	js := &fakeJetStream{}
+	r := &Inputer{JetStream: js}
+	tracker := &fakeOutputEventTracker{sent: map[string]bool{
+		event.EventID() + string(api.OutputTypeNewRoomEvent): true,
+	}}
+
+	// The normal tracker suppresses the output event as it has been sent
+	// before, but rewinding has to send it again.
+	if err := r.writeOutputEvents(tracker, event.RoomID(), updates); err != nil {
+		t.Fatalf("writeOutputEvents: %s", err)
+	}
+	if len(js.published) != 0 {
+		t.Fatalf("got %d published messages, want 0", len(js.published))
+	}
+	if err := r.writeOutputEvents(rewindOutputEventTracker{tracker}, event.RoomID(), updates); err != nil {
+		t.Fatalf("writeOutputEvents: %s", err)
+	}
+	if len(js.published) != 1 {
+		t.Fatalf("got %d published messages, want 1", len(js.published))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/sirupsen/logrus"
+)
+
+// isServerNotice returns true if the input is a new server notice, which is
+// delivered under a relaxed acceptance policy: it isn't deferred by room
+// maintenance, can't be soft-failed, and isn't subject to the acceptance
+// webhook or event validators. It must still pass auth against its own auth
+// events. Only events that were input locally, sent by the configured server
+// notices user and, if configured, in one of the server notice rooms qualify.
+func (r *Inputer) isServerNotice(input *api.InputRoomEvent) bool {
+	if r.Cfg == nil || !r.Cfg.ServerNotices.Enabled || input.Kind != api.KindNew {
+		return false
+	}
+	if input.Origin != "" && input.Origin != r.ServerName {
+		return false
+	}
+	if input.Event.Sender() != fmt.Sprintf("@%s:%s", r.Cfg.ServerNotices.LocalPart, r.ServerName) {
+		return false
+	}
+	if roomIDs := r.Cfg.ServerNotices.RoomIDs; len(roomIDs) > 0 {
+		for _, roomID := range roomIDs {
+			if roomID == input.Event.RoomID() {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// serverNoticeOverridesSoftFail returns true if the event would have been
+// soft-failed, but is a server notice and so should be accepted anyway.
+func (r *Inputer) serverNoticeOverridesSoftFail(logger *logrus.Entry, input *api.InputRoomEvent, softfail, notice bool) bool {
+	if !softfail || !notice {
+		return false
+	}
+	logger.WithFields(logrus.Fields{
+		"audit":  true,
+		"sender": input.Event.Sender(),
+	}).Warn("AUDIT: Accepting server notice despite failing auth against the current room state")
+	return true
+}
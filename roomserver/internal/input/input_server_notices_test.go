@@ -0,0 +1,91 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestIsServerNotice(t *testing.T) {
+	notice := mustCreateEvent(t, map[string]interface{}{
+		"sender":  "@notices:localhost",
+		"room_id": "!notices:localhost",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	otherRoom := mustCreateEvent(t, map[string]interface{}{
+		"sender":  "@notices:localhost",
+		"room_id": "!other:localhost",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	normal := mustCreateEvent(t, map[string]interface{}{
+		"sender":  "@alice:localhost",
+		"room_id": "!notices:localhost",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	remote := mustCreateEvent(t, map[string]interface{}{
+		"sender":  "@notices:remote",
+		"room_id": "!notices:localhost",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+
+	enabled := config.ServerNoticesOptions{Enabled: true, LocalPart: "notices"}
+	inRoom := config.ServerNoticesOptions{Enabled: true, LocalPart: "notices", RoomIDs: []string{"!notices:localhost"}}
+
+	tests := []struct {
+		name    string
+		options config.ServerNoticesOptions
+		input   api.InputRoomEvent
+		want    bool
+	}{
+		{"notice", enabled, api.InputRoomEvent{Kind: api.KindNew, Event: notice}, true},
+		{"notice with local origin", enabled, api.InputRoomEvent{Kind: api.KindNew, Event: notice, Origin: "localhost"}, true},
+		{"notice in configured room", inRoom, api.InputRoomEvent{Kind: api.KindNew, Event: notice}, true},
+		{"disabled", config.ServerNoticesOptions{LocalPart: "notices"}, api.InputRoomEvent{Kind: api.KindNew, Event: notice}, false},
+		{"normal sender", enabled, api.InputRoomEvent{Kind: api.KindNew, Event: normal}, false},
+		{"remote sender with same localpart", enabled, api.InputRoomEvent{Kind: api.KindNew, Event: remote}, false},
+		{"over federation", enabled, api.InputRoomEvent{Kind: api.KindNew, Event: notice, Origin: "remote"}, false},
+		{"outlier", enabled, api.InputRoomEvent{Kind: api.KindOutlier, Event: notice}, false},
+		{"outside configured rooms", inRoom, api.InputRoomEvent{Kind: api.KindNew, Event: otherRoom}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Inputer{
+				ServerName: "localhost",
+				Cfg:        &config.RoomServer{ServerNotices: tc.options},
+			}
+			input := tc.input
+			if got := r.isServerNotice(&input); got != tc.want {
+				t.Fatalf("got server notice %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServerNoticeOverridesSoftFail(t *testing.T) {
+	r := &Inputer{ServerName: "localhost"}
+	logger := logrus.WithField("test", t.Name())
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)}
+
+	if !r.serverNoticeOverridesSoftFail(logger, input, true, true) {
+		t.Fatal("expected a soft-failed server notice to be accepted")
+	}
+	if r.serverNoticeOverridesSoftFail(logger, input, true, false) {
+		t.Fatal("expected a soft-failed normal event to stay soft-failed")
+	}
+	if r.serverNoticeOverridesSoftFail(logger, input, false, true) {
+		t.Fatal("expected nothing to override for a server notice that passed")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type serverReputationKey struct {
+	roomID     string
+	serverName gomatrixserverlib.ServerName
+}
+
+type serverReputationEntry struct {
+	key    serverReputationKey
+	good   bool
+	marked time.Time
+}
+
+// serverReputation is a least-recently-used cache of whether servers recently
+// answered our federation requests for a room or not, so that we can ask the
+// servers which answered first and the ones which failed last. The zero value
+// is an empty cache.
+type serverReputation struct {
+	mu      sync.Mutex
+	entries map[serverReputationKey]*list.Element
+	lru     list.List // most recently marked at the front
+}
+
+func (c *serverReputation) mark(roomID string, serverName gomatrixserverlib.ServerName, good bool, size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[serverReputationKey]*list.Element)
+	}
+	key := serverReputationKey{roomID, serverName}
+	if element, ok := c.entries[key]; ok {
+		element.Value = &serverReputationEntry{key, good, now}
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&serverReputationEntry{key, good, now})
+	for c.lru.Len() > size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*serverReputationEntry).key)
+	}
+}
+
+// rankLocked returns 0 if the server recently answered, 2 if it recently
+// failed and 1 if we don't know, forgetting the server if its entry has
+// expired. c.mu must be held.
+func (c *serverReputation) rankLocked(roomID string, serverName gomatrixserverlib.ServerName, ttl time.Duration, now time.Time) int {
+	element, ok := c.entries[serverReputationKey{roomID, serverName}]
+	if !ok {
+		return 1
+	}
+	entry := element.Value.(*serverReputationEntry)
+	if now.Sub(entry.marked) >= ttl {
+		c.lru.Remove(element)
+		delete(c.entries, entry.key)
+		return 1
+	}
+	if entry.good {
+		return 0
+	}
+	return 2
+}
+
+// order returns the servers with those which recently answered first and
+// those which recently failed last, otherwise keeping the order that they
+// were given in.
+func (c *serverReputation) order(roomID string, servers []gomatrixserverlib.ServerName, ttl time.Duration, now time.Time) []gomatrixserverlib.ServerName {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ranks := make(map[gomatrixserverlib.ServerName]int, len(servers))
+	for _, serverName := range servers {
+		ranks[serverName] = c.rankLocked(roomID, serverName, ttl, now)
+	}
+	ordered := make([]gomatrixserverlib.ServerName, len(servers))
+	copy(ordered, servers)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ranks[ordered[i]] < ranks[ordered[j]]
+	})
+	return ordered
+}
+
+func (r *Inputer) serverReputationOptions() config.ServerReputationOptions {
+	if r.Cfg == nil {
+		return config.ServerReputationOptions{}
+	}
+	return r.Cfg.ServerReputation
+}
+
+// markServer remembers whether the server answered a federation request for
+// the room or not.
+func (r *Inputer) markServer(roomID string, serverName gomatrixserverlib.ServerName, good bool) {
+	opts := r.serverReputationOptions()
+	if opts.Size <= 0 {
+		return
+	}
+	r.serverReputation.mark(roomID, serverName, good, opts.Size, time.Now())
+}
+
+// orderServers returns the servers in the order that they should be asked
+// for events in the room.
+func (r *Inputer) orderServers(roomID string, servers []gomatrixserverlib.ServerName) []gomatrixserverlib.ServerName {
+	opts := r.serverReputationOptions()
+	if opts.Size <= 0 {
+		return servers
+	}
+	return r.serverReputation.order(roomID, servers, opts.TTL, time.Now())
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeReputationFSAPI fails every /event request, recording which servers
+// were asked in order.
+type fakeReputationFSAPI struct {
+	fedapi.FederationInternalAPI
+	asked []gomatrixserverlib.ServerName
+}
+
+func (f *fakeReputationFSAPI) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	f.asked = append(f.asked, s)
+	return gomatrixserverlib.Transaction{}, errors.New("event not found")
+}
+
+// rank returns the rank of the server, taking the lock.
+func (c *serverReputation) rank(roomID string, serverName gomatrixserverlib.ServerName, ttl time.Duration, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rankLocked(roomID, serverName, ttl, now)
+}
+
+func TestLookupEventAsksBadServersLast(t *testing.T) {
+	fsAPI := &fakeReputationFSAPI{}
+	r := &Inputer{Cfg: testServerReputationConfig(), FSAPI: fsAPI}
+	req := &missingStateReq{
+		inputer:    r,
+		federation: fsAPI,
+		servers: map[gomatrixserverlib.ServerName]struct{}{
+			"a": {}, "b": {}, "c": {},
+		},
+	}
+
+	r.markServer("!room:remote", "a", false)
+	r.markServer("!room:remote", "c", true)
+	if _, err := req.lookupEvent(context.Background(), gomatrixserverlib.RoomVersionV6, "!room:remote", "$event", false); err == nil {
+		t.Fatal("expected the lookup to fail")
+	}
+	want := []gomatrixserverlib.ServerName{"c", "b", "a"}
+	if !reflect.DeepEqual(fsAPI.asked, want) {
+		t.Fatalf("got servers asked %v, want %v", fsAPI.asked, want)
+	}
+
+	// Every server failed this time, so they should now all be asked in
+	// the order that they were found, and reputations are per room.
+	fsAPI.asked = nil
+	if _, err := req.lookupEvent(context.Background(), gomatrixserverlib.RoomVersionV6, "!room:remote", "$event", false); err == nil {
+		t.Fatal("expected the lookup to fail")
+	}
+	want = []gomatrixserverlib.ServerName{"a", "b", "c"}
+	if !reflect.DeepEqual(fsAPI.asked, want) {
+		t.Fatalf("got servers asked %v, want %v", fsAPI.asked, want)
+	}
+	if got := r.orderServers("!other:remote", []gomatrixserverlib.ServerName{"c", "b"}); !reflect.DeepEqual(got, []gomatrixserverlib.ServerName{"c", "b"}) {
+		t.Fatalf("reputation leaked between rooms: %v", got)
+	}
+}
+
+func TestServerReputationIsBoundedAndExpires(t *testing.T) {
+	var c serverReputation
+	now := time.Now()
+	c.mark("!room:remote", "a", true, 2, now)
+	c.mark("!room:remote", "b", false, 2, now)
+	c.mark("!room:remote", "c", false, 2, now)
+	if c.lru.Len() != 2 {
+		t.Fatalf("expected 2 servers to be remembered, got %d", c.lru.Len())
+	}
+
+	// a was forgotten when c was marked, so it's no longer asked first.
+	servers := []gomatrixserverlib.ServerName{"c", "a", "d"}
+	want := []gomatrixserverlib.ServerName{"a", "d", "c"}
+	if got := c.order("!room:remote", servers, time.Minute, now); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got order %v, want %v", got, want)
+	}
+
+	// Once the TTL has passed, c is forgotten too and removed.
+	if got := c.order("!room:remote", servers, time.Minute, now.Add(time.Minute)); !reflect.DeepEqual(got, servers) {
+		t.Fatalf("got order %v after the TTL, want %v", got, servers)
+	}
+	if c.lru.Len() != 1 {
+		t.Fatalf("expected the expired server to be removed, got %d", c.lru.Len())
+	}
+}
+
+func TestServerReputationConcurrentUse(t *testing.T) {
+	var c serverReputation
+	servers := []gomatrixserverlib.ServerName{"a", "b", "c", "d"}
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.mark("!room:remote", servers[(i+j)%len(servers)], j%2 == 0, 3, now)
+				// Expire entries while others are being marked.
+				_ = c.order("!room:remote", servers, time.Millisecond, now.Add(time.Duration(j%2)*time.Second))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if c.lru.Len() > 3 || c.lru.Len() != len(c.entries) {
+		t.Fatalf("got %d servers in the list and %d in the map", c.lru.Len(), len(c.entries))
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(softFailedEventsReaccepted, softFailChecksSkipped)
+}
+
+var softFailedEventsReaccepted = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "soft_failed_events_reaccepted_total",
+		Help:      "Number of soft-failed events which were accepted after the state of their room changed",
+	},
+)
+
+var softFailChecksSkipped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "soft_fail_checks_skipped_total",
+		Help:      "Number of new events which weren't checked for soft-failing because soft-fail is disabled for their room",
+	},
+	[]string{"room_id"},
+)
+
+// softFailDisabled returns true if soft-fail is disabled for the room. This is
+// only ever the case for rooms which were explicitly configured and which were
+// created on this server.
+func (r *Inputer) softFailDisabled(roomID string) bool {
+	if r.Cfg == nil {
+		return false
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('!', roomID); err != nil || domain != r.ServerName {
+		return false
+	}
+	for _, disabled := range r.Cfg.SoftFailDisabledRooms {
+		if disabled == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkForSoftFail checks whether a new event fails auth against the current
+// state of the room, unless soft-fail is disabled for the room. If the input
+// explicitly provides the state before the event, e.g. when joining a room
+// over federation, then the event is checked against that state instead, as
+// our view of the current room state may be missing or out of date.
+func (r *Inputer) checkForSoftFail(ctx context.Context, input *api.InputRoomEvent) (bool, error) {
+	if roomID := input.Event.RoomID(); r.softFailDisabled(roomID) {
+		softFailChecksSkipped.WithLabelValues(roomID).Inc()
+		return false, nil
+	}
+	var stateEventIDs []string
+	if input.HasState {
+		stateEventIDs = append([]string{}, input.StateEventIDs...)
+	}
+	return helpers.CheckForSoftFail(ctx, r.DB, input.Event, stateEventIDs)
+}
+
+func (r *Inputer) softFailReevaluation() config.SoftFailReevaluationOptions {
+	if r.Cfg == nil {
+		return config.SoftFailReevaluationOptions{}
+	}
+	return r.Cfg.SoftFailReevaluation
+}
+
+// recordSoftFailedEvent remembers that a new event was soft-failed so that it
+// can be re-evaluated when the state of the room changes.
+func (r *Inputer) recordSoftFailedEvent(
+	ctx context.Context, roomInfo *types.RoomInfo, stateAtEvent types.StateAtEvent,
+) error {
+	if !r.softFailReevaluation().Enabled {
+		return nil
+	}
+	if err := r.DB.RecordSoftFailedEvent(
+		ctx, roomInfo.RoomNID, stateAtEvent.EventNID, gomatrixserverlib.AsTimestamp(time.Now()),
+	); err != nil {
+		return fmt.Errorf("r.DB.RecordSoftFailedEvent: %w", err)
+	}
+	return nil
+}
+
+// writeSoftFailedEvent tells downstream components that a new event was
+// soft-failed and why. Unlike accepted new events, it isn't written as an
+// OutputNewRoomEvent, as it isn't one of the latest events in the room.
+func (r *Inputer) writeSoftFailedEvent(event *gomatrixserverlib.HeaderedEvent, reason string) error {
+	return r.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
+		{
+			Type: api.OutputTypeSoftFailedEvent,
+			SoftFailedEvent: &api.OutputSoftFailedEvent{
+				Event:  event,
+				Reason: reason,
+			},
+		},
+	})
+}
+
+// ReevaluateSoftFailedEvents re-runs the soft-fail checks against the current
+// state of the room for events in the room which were soft-failed recently,
+// and accepts any which now pass. It returns the number of events accepted.
+// At most the configured number of events are re-evaluated per call.
+func (r *Inputer) ReevaluateSoftFailedEvents(ctx context.Context, roomID string) (accepted int, err error) {
+	// Run on the room's worker, so that we aren't racing with any input
+	// events for the room that are being processed at the same time.
+	phony.Block(r.workerForRoom(roomID), func() {
+		var roomInfo *types.RoomInfo
+		roomInfo, err = r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			err = fmt.Errorf("r.DB.RoomInfo: %w", err)
+			return
+		}
+		if roomInfo == nil || roomInfo.IsStub {
+			err = fmt.Errorf("room %q is not known", roomID)
+			return
+		}
+		accepted, err = r.reevaluateSoftFailedEvents(ctx, roomInfo)
+	})
+	return
+}
+
+// reevaluateSoftFailedEvents must be called on the room's worker.
+func (r *Inputer) reevaluateSoftFailedEvents(ctx context.Context, roomInfo *types.RoomInfo) (int, error) {
+	return r.reevaluateSoftFailed(
+		ctx, roomInfo,
+		func(event *gomatrixserverlib.HeaderedEvent) (bool, error) {
+			return helpers.CheckForSoftFail(ctx, r.DB, event, nil)
+		},
+		func(stateAtEvent types.StateAtEvent, event *gomatrixserverlib.Event) error {
+			return r.updateLatestEvents(ctx, roomInfo, stateAtEvent, event, "", nil, false)
+		},
+	)
+}
+
+// reevaluateSoftFailed does the work of reevaluateSoftFailedEvents. The soft-fail
+// check and the function which brings an event into the room are parameters so
+// that they can be replaced in tests.
+//
+// Each event is forgotten about once it has been accepted. If we fail after
+// accepting an event but before forgetting about it then it will be accepted
+// again next time, which is harmless since updateLatestEvents ignores events
+// which have already been sent.
+func (r *Inputer) reevaluateSoftFailed(
+	ctx context.Context, roomInfo *types.RoomInfo,
+	stillSoftFails func(*gomatrixserverlib.HeaderedEvent) (bool, error),
+	accept func(types.StateAtEvent, *gomatrixserverlib.Event) error,
+) (int, error) {
+	opts := r.softFailReevaluation()
+	if !opts.Enabled || opts.MaxEventsPerPass <= 0 {
+		return 0, nil
+	}
+	notBefore := gomatrixserverlib.AsTimestamp(time.Now().Add(-opts.MaxAge))
+	eventNIDs, err := r.DB.GetSoftFailedEventNIDs(ctx, roomInfo.RoomNID, notBefore, opts.MaxEventsPerPass)
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.GetSoftFailedEventNIDs: %w", err)
+	}
+	if len(eventNIDs) == 0 {
+		return 0, nil
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.Events: %w", err)
+	}
+
+	accepted := 0
+	for _, event := range events {
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id":  event.RoomID(),
+			"event_id": event.EventID(),
+		})
+		softfail, err := stillSoftFails(event.Headered(roomInfo.RoomVersion))
+		if err != nil {
+			logger.WithError(err).Warn("Failed to re-evaluate soft-failed event")
+			continue
+		}
+		if softfail {
+			continue
+		}
+		stateAtEvents, err := r.DB.StateAtEventIDs(ctx, []string{event.EventID()})
+		if err != nil {
+			return accepted, fmt.Errorf("r.DB.StateAtEventIDs: %w", err)
+		}
+		if len(stateAtEvents) != 1 || stateAtEvents[0].IsRejected {
+			// We don't know the state before the event, or it was rejected
+			// since, so it can't be accepted. Stop trying.
+			if err = r.DB.ClearSoftFailedEvent(ctx, event.EventNID); err != nil {
+				return accepted, fmt.Errorf("r.DB.ClearSoftFailedEvent: %w", err)
+			}
+			continue
+		}
+		if err = accept(stateAtEvents[0], event.Event); err != nil {
+			return accepted, fmt.Errorf("accept: %w", err)
+		}
+		if err = r.DB.ClearSoftFailedEvent(ctx, event.EventNID); err != nil {
+			return accepted, fmt.Errorf("r.DB.ClearSoftFailedEvent: %w", err)
+		}
+		accepted++
+		softFailedEventsReaccepted.Inc()
+		logger.Info("Soft-failed event now passes auth against the current room state and has been accepted")
+	}
+	return accepted, nil
+}
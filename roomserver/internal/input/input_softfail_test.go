@@ -0,0 +1,357 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeSoftFailedDB knows about a set of soft-failed events. Calling any other
+// storage.Database method will panic.
+type fakeSoftFailedDB struct {
+	storage.Database
+	events     map[types.EventNID]*gomatrixserverlib.Event
+	softFailed map[types.EventNID]struct{}
+	rejected   map[string]bool
+}
+
+func (d *fakeSoftFailedDB) GetSoftFailedEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, notBefore gomatrixserverlib.Timestamp, limit int,
+) ([]types.EventNID, error) {
+	var eventNIDs []types.EventNID
+	for eventNID := range d.softFailed {
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	sort.Slice(eventNIDs, func(i, j int) bool { return eventNIDs[i] < eventNIDs[j] })
+	if len(eventNIDs) > limit {
+		eventNIDs = eventNIDs[:limit]
+	}
+	return eventNIDs, nil
+}
+
+func (d *fakeSoftFailedDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	events := make([]types.Event, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		events = append(events, types.Event{EventNID: eventNID, Event: d.events[eventNID]})
+	}
+	return events, nil
+}
+
+func (d *fakeSoftFailedDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	for eventNID, event := range d.events {
+		if event.EventID() == eventIDs[0] {
+			return []types.StateAtEvent{{
+				BeforeStateSnapshotNID: 1,
+				IsRejected:             d.rejected[event.EventID()],
+				StateEntry:             types.StateEntry{EventNID: eventNID},
+			}}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown event %s", eventIDs[0])
+}
+
+func (d *fakeSoftFailedDB) ClearSoftFailedEvent(ctx context.Context, eventNID types.EventNID) error {
+	delete(d.softFailed, eventNID)
+	return nil
+}
+
+func TestReevaluateSoftFailedEvents(t *testing.T) {
+	stillFails := mustCreateEvent(t, map[string]interface{}{"event_id": "$fails:localhost"})
+	nowPasses := mustCreateEvent(t, map[string]interface{}{"event_id": "$passes:localhost"})
+	rejected := mustCreateEvent(t, map[string]interface{}{"event_id": "$rejected:localhost"})
+	db := &fakeSoftFailedDB{
+		events: map[types.EventNID]*gomatrixserverlib.Event{
+			1: stillFails, 2: nowPasses, 3: rejected,
+		},
+		softFailed: map[types.EventNID]struct{}{1: {}, 2: {}, 3: {}},
+		rejected:   map[string]bool{rejected.EventID(): true},
+	}
+	r := &Inputer{
+		DB: db,
+		Cfg: &config.RoomServer{
+			SoftFailReevaluation: config.SoftFailReevaluationOptions{
+				Enabled:          true,
+				MaxAge:           time.Hour,
+				MaxEventsPerPass: 10,
+			},
+		},
+	}
+	roomInfo := &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}
+
+	var acceptedEventIDs []string
+	check := func(event *gomatrixserverlib.HeaderedEvent) (bool, error) {
+		return event.EventID() == stillFails.EventID(), nil
+	}
+	accept := func(stateAtEvent types.StateAtEvent, event *gomatrixserverlib.Event) error {
+		if stateAtEvent.EventNID != 2 {
+			t.Errorf("accepted event has wrong state: %+v", stateAtEvent)
+		}
+		acceptedEventIDs = append(acceptedEventIDs, event.EventID())
+		return nil
+	}
+
+	accepted, err := r.reevaluateSoftFailed(context.Background(), roomInfo, check, accept)
+	if err != nil {
+		t.Fatalf("reevaluateSoftFailed: %s", err)
+	}
+	if accepted != 1 || len(acceptedEventIDs) != 1 || acceptedEventIDs[0] != nowPasses.EventID() {
+		t.Fatalf("expected only %s to be accepted, got %d: %v", nowPasses.EventID(), accepted, acceptedEventIDs)
+	}
+	// The event that still fails should be kept for next time, and the others forgotten.
+	if _, ok := db.softFailed[1]; !ok || len(db.softFailed) != 1 {
+		t.Fatalf("expected only the still soft-failed event to remain, got %v", db.softFailed)
+	}
+
+	// Re-evaluating again shouldn't accept anything else.
+	accepted, err = r.reevaluateSoftFailed(context.Background(), roomInfo, check, accept)
+	if err != nil {
+		t.Fatalf("reevaluateSoftFailed: %s", err)
+	}
+	if accepted != 0 || len(acceptedEventIDs) != 1 {
+		t.Fatalf("expected nothing more to be accepted, got %d: %v", accepted, acceptedEventIDs)
+	}
+}
+
+func TestReevaluateSoftFailedEventsBounded(t *testing.T) {
+	db := &fakeSoftFailedDB{
+		events:     map[types.EventNID]*gomatrixserverlib.Event{},
+		softFailed: map[types.EventNID]struct{}{},
+	}
+	for i := types.EventNID(1); i <= 5; i++ {
+		db.events[i] = mustCreateEvent(t, map[string]interface{}{"event_id": fmt.Sprintf("$%d:localhost", i)})
+		db.softFailed[i] = struct{}{}
+	}
+	r := &Inputer{
+		DB: db,
+		Cfg: &config.RoomServer{
+			SoftFailReevaluation: config.SoftFailReevaluationOptions{
+				Enabled:          true,
+				MaxAge:           time.Hour,
+				MaxEventsPerPass: 2,
+			},
+		},
+	}
+	roomInfo := &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}
+	check := func(*gomatrixserverlib.HeaderedEvent) (bool, error) { return false, nil }
+	accept := func(types.StateAtEvent, *gomatrixserverlib.Event) error { return nil }
+
+	accepted, err := r.reevaluateSoftFailed(context.Background(), roomInfo, check, accept)
+	if err != nil {
+		t.Fatalf("reevaluateSoftFailed: %s", err)
+	}
+	if accepted != 2 || len(db.softFailed) != 3 {
+		t.Fatalf("expected 2 events to be accepted and 3 to remain, got %d and %d", accepted, len(db.softFailed))
+	}
+
+	// When disabled, nothing is touched.
+	r.Cfg.SoftFailReevaluation.Enabled = false
+	if accepted, err = r.reevaluateSoftFailed(context.Background(), roomInfo, check, accept); err != nil || accepted != 0 {
+		t.Fatalf("expected nothing to happen when disabled, got %d, %v", accepted, err)
+	}
+	if len(db.softFailed) != 3 {
+		t.Fatalf("expected 3 events to remain, got %d", len(db.softFailed))
+	}
+}
+
+// roomInfoCountingDB counts how many times the room info was looked up, and
+// doesn't know about any rooms. Calling any other storage.Database method
+// will panic.
+type roomInfoCountingDB struct {
+	storage.Database
+	lookups int
+}
+
+func (d *roomInfoCountingDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	d.lookups++
+	return nil, nil
+}
+
+func TestSoftFailDisabledRooms(t *testing.T) {
+	tests := []struct {
+		roomID      string
+		wantSkipped bool
+	}{
+		{"!admin:localhost", true},
+		{"!other:localhost", false},
+		// Rooms created on other servers are never skipped, even if listed.
+		{"!admin:remote", false},
+	}
+	for _, tc := range tests {
+		db := &roomInfoCountingDB{}
+		r := &Inputer{
+			DB:         db,
+			ServerName: "localhost",
+			Cfg: &config.RoomServer{
+				SoftFailDisabledRooms: []string{"!admin:localhost", "!admin:remote"},
+			},
+		}
+		event := mustCreateEvent(t, map[string]interface{}{"room_id": tc.roomID}).Headered(gomatrixserverlib.RoomVersionV1)
+		softfail, err := r.checkForSoftFail(context.Background(), &api.InputRoomEvent{Kind: api.KindNew, Event: event})
+		if err != nil || softfail {
+			t.Fatalf("%s: unexpected result %v, %v", tc.roomID, softfail, err)
+		}
+		if skipped := db.lookups == 0; skipped != tc.wantSkipped {
+			t.Errorf("%s: got skipped %v, want %v", tc.roomID, skipped, tc.wantSkipped)
+		}
+	}
+}
+
+// outputTrackingDB remembers which output events have been sent.
+type outputTrackingDB struct {
+	storage.Database
+	sent map[string]bool
+}
+
+func (d *outputTrackingDB) OutputEventsSent(ctx context.Context, keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	sent := map[types.OutputEventKey]bool{}
+	for _, key := range keys {
+		sent[key] = d.sent[key.EventID+key.OutputType]
+	}
+	return sent, nil
+}
+
+func (d *outputTrackingDB) MarkOutputEventsAsSent(ctx context.Context, keys []types.OutputEventKey) error {
+	for _, key := range keys {
+		d.sent[key.EventID+key.OutputType] = true
+	}
+	return nil
+}
+
+func TestWriteSoftFailedEvent(t *testing.T) {
+	js := &fakeJetStream{}
+	r := &Inputer{DB: &outputTrackingDB{sent: map[string]bool{}}, JetStream: js}
+	event := mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1)
+
+	if err := r.writeSoftFailedEvent(event, "event fails auth against the current room state"); err != nil {
+		t.Fatal(err)
+	}
+	if len(js.published) != 1 {
+		t.Fatalf("got %d published messages, want 1", len(js.published))
+	}
+	var output api.OutputEvent
+	if err := json.Unmarshal(js.published[0].Data, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Type != api.OutputTypeSoftFailedEvent || output.SoftFailedEvent == nil {
+		t.Fatalf("got output type %q, want %q", output.Type, api.OutputTypeSoftFailedEvent)
+	}
+	if output.SoftFailedEvent.Event.EventID() != event.EventID() {
+		t.Errorf("got event %s, want %s", output.SoftFailedEvent.Event.EventID(), event.EventID())
+	}
+	if output.SoftFailedEvent.Reason != "event fails auth against the current room state" {
+		t.Errorf("got reason %q", output.SoftFailedEvent.Reason)
+	}
+	// Soft-failed events aren't latest events, so consumers which only look
+	// at new room events never see them.
+	if output.NewRoomEvent != nil {
+		t.Error("expected no new room event")
+	}
+}
+
+// providedStateDB only knows about the state provided with an input event. It
+// can't load the current state of the room, so any attempt to check against
+// the current state will fail. Calling any other storage.Database method
+// will panic.
+type providedStateDB struct {
+	roomInfoCountingDB
+	create *gomatrixserverlib.Event
+}
+
+func (d *providedStateDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	d.lookups++
+	return &types.RoomInfo{RoomNID: 1, StateSnapshotNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (d *providedStateDB) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	return nil, fmt.Errorf("current room state is unavailable")
+}
+
+func (d *providedStateDB) StateEntriesForEventIDs(ctx context.Context, eventIDs []string) ([]types.StateEntry, error) {
+	if len(eventIDs) != 1 || eventIDs[0] != d.create.EventID() {
+		return nil, fmt.Errorf("unexpected state event IDs %v", eventIDs)
+	}
+	return []types.StateEntry{{
+		StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomCreateNID, EventStateKeyNID: types.EmptyStateKeyNID},
+		EventNID:      1,
+	}}, nil
+}
+
+func (d *providedStateDB) EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	return map[string]types.EventStateKeyNID{}, nil
+}
+
+func (d *providedStateDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	events := make([]types.Event, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		if eventNID == 1 {
+			events = append(events, types.Event{EventNID: 1, Event: d.create})
+		}
+	}
+	return events, nil
+}
+
+func TestCheckForSoftFailUsesProvidedState(t *testing.T) {
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id":  "$create:localhost",
+		"type":      gomatrixserverlib.MRoomCreate,
+		"state_key": "",
+		"content":   map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"event_id":    "$join:localhost",
+		"type":        gomatrixserverlib.MRoomMember,
+		"state_key":   "@test:localhost",
+		"content":     map[string]interface{}{"membership": gomatrixserverlib.Join},
+		"prev_events": []interface{}{[]interface{}{create.EventID(), map[string]interface{}{}}},
+		"auth_events": []interface{}{[]interface{}{create.EventID(), map[string]interface{}{}}},
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	db := &providedStateDB{create: create}
+	r := &Inputer{DB: db, ServerName: "localhost"}
+
+	// The join comes with the state before it, which only has a single event.
+	// This used to be ignored in favour of the current room state, which
+	// spuriously soft-failed the join.
+	softfail, err := r.checkForSoftFail(context.Background(), &api.InputRoomEvent{
+		Kind:          api.KindNew,
+		Event:         join,
+		HasState:      true,
+		StateEventIDs: []string{create.EventID()},
+	})
+	if err != nil || softfail {
+		t.Fatalf("expected join not to be soft-failed, got %v, %v", softfail, err)
+	}
+	if db.lookups != 0 {
+		t.Errorf("expected the current room state not to be consulted, got %d lookups", db.lookups)
+	}
+
+	// Without the state, the current room state is used instead.
+	if softfail, err = r.checkForSoftFail(context.Background(), &api.InputRoomEvent{
+		Kind:  api.KindNew,
+		Event: join,
+	}); err == nil || !softfail {
+		t.Fatalf("expected check against the current room state to fail, got %v, %v", softfail, err)
+	}
+}
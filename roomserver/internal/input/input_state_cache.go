@@ -0,0 +1,139 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(stateResolutionCacheLookups)
+}
+
+var stateResolutionCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resolution_cache_lookups_total",
+		Help:      "Number of lookups in the cache of state resolvers for recently active rooms, by whether a resolver was reused",
+	},
+	[]string{"result"},
+)
+
+type stateResolutionCacheEntry struct {
+	roomNID     types.RoomNID
+	roomVersion gomatrixserverlib.RoomVersion
+	resolver    state.StateResolution
+}
+
+// stateResolutionCache is a least-recently-used cache of state resolvers,
+// keyed by room NID. A resolver keeps the state events it has loaded, so
+// reusing it for consecutive events in a room saves loading them again.
+// Resolvers are taken out of the cache while they are in use, so that no
+// two events ever share one. The zero value is an empty cache.
+type stateResolutionCache struct {
+	mu      sync.Mutex
+	entries map[types.RoomNID]*list.Element
+	order   list.List // most recently used at the front
+}
+
+// take removes the resolver for the room from the cache and returns it. A
+// resolver which was cached for a different room version is thrown away.
+func (c *stateResolutionCache) take(roomInfo *types.RoomInfo) (state.StateResolution, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[roomInfo.RoomNID]
+	if !ok {
+		return state.StateResolution{}, false
+	}
+	c.order.Remove(element)
+	delete(c.entries, roomInfo.RoomNID)
+	entry := element.Value.(*stateResolutionCacheEntry)
+	if entry.roomVersion != roomInfo.RoomVersion {
+		return state.StateResolution{}, false
+	}
+	return entry.resolver, true
+}
+
+func (c *stateResolutionCache) put(roomInfo *types.RoomInfo, resolver state.StateResolution, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[types.RoomNID]*list.Element)
+	}
+	entry := &stateResolutionCacheEntry{roomInfo.RoomNID, roomInfo.RoomVersion, resolver}
+	if element, ok := c.entries[roomInfo.RoomNID]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[roomInfo.RoomNID] = c.order.PushFront(entry)
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*stateResolutionCacheEntry).roomNID)
+	}
+}
+
+// forget throws away the cached resolver for the room, if there is one.
+func (c *stateResolutionCache) forget(roomNID types.RoomNID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[roomNID]; ok {
+		c.order.Remove(element)
+		delete(c.entries, roomNID)
+	}
+}
+
+func (r *Inputer) stateResolutionCacheOptions() config.StateResolutionCacheOptions {
+	if r.Cfg == nil {
+		return config.StateResolutionCacheOptions{}
+	}
+	return r.Cfg.StateResolutionCache
+}
+
+// acquireStateResolution returns the cached state resolver for the room if
+// there is one, or a new one if not. The resolver should be handed back with
+// releaseStateResolution once the caller has finished with it.
+func (r *Inputer) acquireStateResolution(roomInfo *types.RoomInfo, roomID string) state.StateResolution {
+	if r.stateResolutionCacheOptions().Size <= 0 {
+		return r.newStateResolution(roomInfo, roomID)
+	}
+	if resolver, ok := r.stateResolutions.take(roomInfo); ok {
+		stateResolutionCacheLookups.WithLabelValues("hit").Inc()
+		resolver.SetRoomInfo(roomInfo)
+		return resolver
+	}
+	stateResolutionCacheLookups.WithLabelValues("miss").Inc()
+	return r.newStateResolution(roomInfo, roomID)
+}
+
+// releaseStateResolution puts a resolver from acquireStateResolution back
+// into the cache. Resolvers which failed, or which have loaded too many
+// events to be worth keeping in memory, are thrown away instead.
+func (r *Inputer) releaseStateResolution(roomInfo *types.RoomInfo, resolver state.StateResolution, err error) {
+	opts := r.stateResolutionCacheOptions()
+	if opts.Size <= 0 || err != nil || resolver.LoadedEvents() > opts.MaxEvents {
+		return
+	}
+	r.stateResolutions.put(roomInfo, resolver, opts.Size)
+}
@@ -0,0 +1,247 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const stateCacheTopicNID types.EventTypeNID = 100
+
+// stateCacheDB is a room whose state is forked: snapshots 1 and 2 have the
+// same members but a different topic, so the state after both of them has
+// to be resolved.
+type stateCacheDB struct {
+	storage.Database
+	eventJSON    map[types.EventNID][]byte
+	blocks       map[types.StateBlockNID][]types.StateEntry
+	stateKeyNIDs map[string]types.EventStateKeyNID
+	loaded       int
+	lastAdded    []types.StateEntry
+}
+
+func newStateCacheDB(tb testing.TB, members int) *stateCacheDB {
+	d := &stateCacheDB{
+		eventJSON:    map[types.EventNID][]byte{},
+		blocks:       map[types.StateBlockNID][]types.StateEntry{},
+		stateKeyNIDs: map[string]types.EventStateKeyNID{},
+	}
+	var common []types.StateEntry
+	add := func(eventNID types.EventNID, typeNID types.EventTypeNID, stateKeyNID types.EventStateKeyNID, fields map[string]interface{}) types.StateEntry {
+		d.eventJSON[eventNID] = mustCreateEvent(tb, fields).JSON()
+		return types.StateEntry{
+			StateKeyTuple: types.StateKeyTuple{EventTypeNID: typeNID, EventStateKeyNID: stateKeyNID},
+			EventNID:      eventNID,
+		}
+	}
+	common = append(common, add(1, types.MRoomCreateNID, types.EmptyStateKeyNID, map[string]interface{}{
+		"event_id": "$create:localhost", "type": gomatrixserverlib.MRoomCreate, "state_key": "",
+		"content": map[string]interface{}{"creator": "@test:localhost"},
+	}))
+	d.stateKeyNIDs["@test:localhost"] = 2
+	common = append(common, add(2, types.MRoomMemberNID, 2, map[string]interface{}{
+		"event_id": "$join:localhost", "type": gomatrixserverlib.MRoomMember, "state_key": "@test:localhost",
+		"content": map[string]interface{}{"membership": "join"},
+	}))
+	for i := 0; i < members; i++ {
+		userID := fmt.Sprintf("@user%d:localhost", i)
+		stateKeyNID := types.EventStateKeyNID(10 + i)
+		d.stateKeyNIDs[userID] = stateKeyNID
+		common = append(common, add(types.EventNID(10+i), types.MRoomMemberNID, stateKeyNID, map[string]interface{}{
+			"event_id": fmt.Sprintf("$join%d:localhost", i), "type": gomatrixserverlib.MRoomMember, "state_key": userID,
+			"sender": userID, "content": map[string]interface{}{"membership": "join"},
+		}))
+	}
+	for i, topic := range []string{"first", "second"} {
+		entry := add(types.EventNID(100000+i), stateCacheTopicNID, types.EmptyStateKeyNID, map[string]interface{}{
+			"event_id": "$" + topic + ":localhost", "type": "m.room.topic", "state_key": "",
+			"origin_server_ts": 1000 + i, "content": map[string]interface{}{"topic": topic},
+		})
+		d.blocks[types.StateBlockNID(i+1)] = append(append([]types.StateEntry{}, common...), entry)
+	}
+	return d
+}
+
+func (d *stateCacheDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	return []types.StateAtEvent{
+		{BeforeStateSnapshotNID: 1, StateEntry: types.StateEntry{EventNID: 200000}},
+		{BeforeStateSnapshotNID: 2, StateEntry: types.StateEntry{EventNID: 200001}},
+	}, nil
+}
+
+func (d *stateCacheDB) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	var lists []types.StateBlockNIDList
+	for _, stateNID := range stateNIDs {
+		lists = append(lists, types.StateBlockNIDList{
+			StateSnapshotNID: stateNID,
+			StateBlockNIDs:   []types.StateBlockNID{types.StateBlockNID(stateNID)},
+		})
+	}
+	return lists, nil
+}
+
+func (d *stateCacheDB) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	var lists []types.StateEntryList
+	for _, stateBlockNID := range stateBlockNIDs {
+		lists = append(lists, types.StateEntryList{
+			StateBlockNID: stateBlockNID,
+			StateEntries:  append([]types.StateEntry{}, d.blocks[stateBlockNID]...),
+		})
+	}
+	return lists, nil
+}
+
+func (d *stateCacheDB) EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	result := map[string]types.EventStateKeyNID{}
+	for _, stateKey := range eventStateKeys {
+		if stateKeyNID, ok := d.stateKeyNIDs[stateKey]; ok {
+			result[stateKey] = stateKeyNID
+		}
+	}
+	return result, nil
+}
+
+// Events parses the events from their JSON every time, like the real
+// database does, so that loading events has a realistic cost.
+func (d *stateCacheDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var events []types.Event
+	for _, eventNID := range eventNIDs {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(d.eventJSON[eventNID], false, gomatrixserverlib.RoomVersionV2)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, types.Event{EventNID: eventNID, Event: event})
+		d.loaded++
+	}
+	return events, nil
+}
+
+func (d *stateCacheDB) AddState(
+	ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	d.lastAdded = state
+	return 3, nil
+}
+
+func (d *stateCacheDB) SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	return nil
+}
+
+func calculateStateForSequentialEvent(tb testing.TB, r *Inputer, roomInfo *types.RoomInfo, i int) {
+	event := mustCreateEvent(tb, map[string]interface{}{
+		"event_id": fmt.Sprintf("$message%d:localhost", i),
+	})
+	stateAtEvent := &types.StateAtEvent{StateEntry: types.StateEntry{EventNID: types.EventNID(300000 + i)}}
+	if err := r.calculateAndSetState(context.Background(), &api.InputRoomEvent{}, roomInfo, stateAtEvent, event, false); err != nil {
+		tb.Fatal(err)
+	}
+	if stateAtEvent.BeforeStateSnapshotNID != 3 {
+		tb.Fatalf("got state snapshot %d, want 3", stateAtEvent.BeforeStateSnapshotNID)
+	}
+}
+
+func TestCalculateAndSetStateReusesStateResolution(t *testing.T) {
+	roomInfo := &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV2}
+	tests := []struct {
+		name       string
+		cacheSize  int
+		wantLoaded int
+	}{
+		{"without cache", 0, 2},
+		{"with cache", 16, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newStateCacheDB(t, 10)
+			r := &Inputer{
+				Cfg: &config.RoomServer{
+					StateResolutionCache: config.StateResolutionCacheOptions{Size: tc.cacheSize, MaxEvents: 1000},
+				},
+				DB: db,
+			}
+			calculateStateForSequentialEvent(t, r, roomInfo, 0)
+			loadedForFirst, stateForFirst := db.loaded, db.lastAdded
+			// The room info is looked up again for every event, so the
+			// second event gets a different, but equivalent, room info.
+			calculateStateForSequentialEvent(t, r, &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV2}, 1)
+			if db.loaded != loadedForFirst*tc.wantLoaded {
+				t.Fatalf("loaded %d events for two events, want %d", db.loaded, loadedForFirst*tc.wantLoaded)
+			}
+			if !reflect.DeepEqual(db.lastAdded, stateForFirst) {
+				t.Fatalf("got state %v for the second event, want %v", db.lastAdded, stateForFirst)
+			}
+		})
+	}
+}
+
+func TestStateResolutionCacheInvalidation(t *testing.T) {
+	var cache stateResolutionCache
+	rooms := []*types.RoomInfo{
+		{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1},
+		{RoomNID: 2, RoomVersion: gomatrixserverlib.RoomVersionV1},
+		{RoomNID: 3, RoomVersion: gomatrixserverlib.RoomVersionV1},
+	}
+	for _, roomInfo := range rooms {
+		cache.put(roomInfo, state.NewStateResolution(nil, roomInfo), 2)
+	}
+	if _, ok := cache.take(rooms[0]); ok {
+		t.Fatal("expected the least recently used room to have been evicted")
+	}
+	if _, ok := cache.take(rooms[1]); !ok {
+		t.Fatal("expected the second room to be cached")
+	}
+	if _, ok := cache.take(rooms[1]); ok {
+		t.Fatal("expected a resolver to be removed from the cache while it is in use")
+	}
+	if _, ok := cache.take(&types.RoomInfo{RoomNID: 3, RoomVersion: gomatrixserverlib.RoomVersionV6}); ok {
+		t.Fatal("expected a resolver for a different room version not to be reused")
+	}
+	cache.put(rooms[2], state.NewStateResolution(nil, rooms[2]), 2)
+	cache.forget(rooms[2].RoomNID)
+	if _, ok := cache.take(rooms[2]); ok {
+		t.Fatal("expected a forgotten resolver not to be reused")
+	}
+}
+
+// BenchmarkCalculateAndSetStateSequentialEvents calculates the state before
+// a run of events in one room whose state is forked, with and without
+// reusing the room's state resolver between events.
+func BenchmarkCalculateAndSetStateSequentialEvents(b *testing.B) {
+	for _, cacheSize := range []int{0, 16} {
+		b.Run(fmt.Sprintf("cache_size=%d", cacheSize), func(b *testing.B) {
+			r := &Inputer{
+				Cfg: &config.RoomServer{
+					StateResolutionCache: config.StateResolutionCacheOptions{Size: cacheSize, MaxEvents: 1000},
+				},
+				DB: newStateCacheDB(b, 500),
+			}
+			roomInfo := &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV2}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				calculateStateForSequentialEvent(b, r, roomInfo, i)
+			}
+		})
+	}
+}
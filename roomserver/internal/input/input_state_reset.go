@@ -0,0 +1,158 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(stateResetsDetected)
+}
+
+var stateResetsDetected = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resets_detected_total",
+		Help:      "Number of times that overwriting the state of a room with state from a remote server looked like a state reset",
+	},
+)
+
+// stateResetMinJoinedCount is the smallest number of joined members that a
+// room must have had for a drop in membership to count as a state reset, so
+// that a small room losing a couple of members isn't flagged.
+const stateResetMinJoinedCount = 10
+
+// stateSummary is what we look at to decide whether some state looks like
+// a state reset.
+type stateSummary struct {
+	joinedCount int
+	admins      []string // joined users with admin power levels, sorted
+}
+
+// summariseState loads the create, power levels and membership events from
+// the state entries and works out who is joined and which of them are admins.
+func (r *Inputer) summariseState(ctx context.Context, entries []types.StateEntry) (*stateSummary, error) {
+	var eventNIDs []types.EventNID
+	for _, entry := range entries {
+		switch entry.EventTypeNID {
+		case types.MRoomCreateNID, types.MRoomPowerLevelsNID, types.MRoomMemberNID:
+			eventNIDs = append(eventNIDs, entry.EventNID)
+		}
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.Events: %w", err)
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	var joined []string
+	for _, event := range events {
+		if err = authEvents.AddEvent(event.Event); err != nil {
+			return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+		if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+			continue
+		}
+		membership, merr := event.Membership()
+		if merr == nil && membership == gomatrixserverlib.Join {
+			joined = append(joined, *event.StateKey())
+		}
+	}
+	create, err := gomatrixserverlib.NewCreateContentFromAuthEvents(&authEvents)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.NewCreateContentFromAuthEvents: %w", err)
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, create.Creator)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromAuthEvents: %w", err)
+	}
+	summary := &stateSummary{joinedCount: len(joined)}
+	for _, userID := range joined {
+		if powerLevels.UserLevel(userID) >= 100 {
+			summary.admins = append(summary.admins, userID)
+		}
+	}
+	sort.Strings(summary.admins)
+	return summary, nil
+}
+
+// stateResetReasons returns why the change from one state to another looks
+// like a state reset, or nothing if it doesn't.
+func stateResetReasons(before, after *stateSummary) []string {
+	var reasons []string
+	if len(before.admins) > 0 && len(after.admins) == 0 {
+		reasons = append(reasons, fmt.Sprintf("all %d joined admins were removed", len(before.admins)))
+	}
+	if before.joinedCount >= stateResetMinJoinedCount && after.joinedCount*2 < before.joinedCount {
+		reasons = append(reasons, fmt.Sprintf("joined members dropped from %d to %d", before.joinedCount, after.joinedCount))
+	}
+	return reasons
+}
+
+// detectStateReset compares the current state of the room with the state
+// that is about to overwrite it. If the new state looks like a state reset
+// then it returns an output event describing it, otherwise it returns nil.
+func (r *Inputer) detectStateReset(
+	ctx context.Context,
+	roomInfo *types.RoomInfo,
+	roomState *state.StateResolution,
+	event *gomatrixserverlib.Event,
+	entries []types.StateEntry,
+) (*api.OutputStateReset, error) {
+	if roomInfo.IsStub || roomInfo.StateSnapshotNID == 0 {
+		// We don't have any state of our own to lose.
+		return nil, nil
+	}
+	currentEntries, err := roomState.LoadStateAtSnapshot(ctx, roomInfo.StateSnapshotNID)
+	if err != nil {
+		return nil, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+	}
+	before, err := r.summariseState(ctx, currentEntries)
+	if err != nil {
+		return nil, fmt.Errorf("r.summariseState (before): %w", err)
+	}
+	after, err := r.summariseState(ctx, entries)
+	if err != nil {
+		return nil, fmt.Errorf("r.summariseState (after): %w", err)
+	}
+	reasons := stateResetReasons(before, after)
+	if len(reasons) == 0 {
+		return nil, nil
+	}
+	stateResetsDetected.Inc()
+	logrus.WithFields(logrus.Fields{
+		"room_id":  event.RoomID(),
+		"event_id": event.EventID(),
+		"reasons":  reasons,
+	}).Warn("Overwriting the room state with state from a remote server looks like a state reset")
+	return &api.OutputStateReset{
+		Event:               event.Headered(roomInfo.RoomVersion),
+		Reasons:             reasons,
+		PreviousJoinedCount: before.joinedCount,
+		JoinedCount:         after.joinedCount,
+		PreviousAdmins:      before.admins,
+		Admins:              after.admins,
+	}, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// stateResetDB is a room with no local users, an admin and a regular user,
+// whose state is about to be overwritten by some state from an event.
+type stateResetDB struct {
+	storage.Database
+	events       map[types.EventNID]*gomatrixserverlib.Event
+	currentState []types.StateEntry
+	givenState   map[string]types.StateEntry
+}
+
+func (d *stateResetDB) GetLocalJoinedCount(ctx context.Context, roomNID types.RoomNID) (int, error) {
+	return 0, nil
+}
+
+func (d *stateResetDB) StateEntriesForEventIDs(ctx context.Context, eventIDs []string) ([]types.StateEntry, error) {
+	var entries []types.StateEntry
+	for _, eventID := range eventIDs {
+		entries = append(entries, d.givenState[eventID])
+	}
+	return entries, nil
+}
+
+func (d *stateResetDB) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	return []types.StateBlockNIDList{{StateSnapshotNID: 1, StateBlockNIDs: []types.StateBlockNID{1}}}, nil
+}
+
+func (d *stateResetDB) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	return []types.StateEntryList{{StateBlockNID: 1, StateEntries: d.currentState}}, nil
+}
+
+func (d *stateResetDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var events []types.Event
+	for _, eventNID := range eventNIDs {
+		events = append(events, types.Event{EventNID: eventNID, Event: d.events[eventNID]})
+	}
+	return events, nil
+}
+
+func (d *stateResetDB) AddState(
+	ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	return 2, nil
+}
+
+func (d *stateResetDB) SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	return nil
+}
+
+func (d *stateResetDB) OutputEventsSent(ctx context.Context, keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	return nil, nil
+}
+
+func (d *stateResetDB) MarkOutputEventsAsSent(ctx context.Context, keys []types.OutputEventKey) error {
+	return nil
+}
+
+func TestCalculateAndSetStateFlagsStateReset(t *testing.T) {
+	db := &stateResetDB{
+		events:     map[types.EventNID]*gomatrixserverlib.Event{},
+		givenState: map[string]types.StateEntry{},
+	}
+	addEvent := func(eventNID types.EventNID, typeNID types.EventTypeNID, stateKeyNID types.EventStateKeyNID, fields map[string]interface{}) types.StateEntry {
+		event := mustCreateEvent(t, fields)
+		db.events[eventNID] = event
+		entry := types.StateEntry{
+			StateKeyTuple: types.StateKeyTuple{EventTypeNID: typeNID, EventStateKeyNID: stateKeyNID},
+			EventNID:      eventNID,
+		}
+		db.givenState[event.EventID()] = entry
+		return entry
+	}
+	create := addEvent(1, types.MRoomCreateNID, types.EmptyStateKeyNID, map[string]interface{}{
+		"event_id": "$create:remote", "type": gomatrixserverlib.MRoomCreate, "state_key": "", "sender": "@admin:remote",
+		"content": map[string]interface{}{"creator": "@admin:remote"},
+	})
+	powerLevels := addEvent(2, types.MRoomPowerLevelsNID, types.EmptyStateKeyNID, map[string]interface{}{
+		"event_id": "$powerlevels:remote", "type": gomatrixserverlib.MRoomPowerLevels, "state_key": "", "sender": "@admin:remote",
+		"content": map[string]interface{}{"users": map[string]interface{}{"@admin:remote": 100}},
+	})
+	adminJoin := addEvent(3, types.MRoomMemberNID, 10, map[string]interface{}{
+		"event_id": "$adminjoin:remote", "type": gomatrixserverlib.MRoomMember, "state_key": "@admin:remote", "sender": "@admin:remote",
+		"content": map[string]interface{}{"membership": "join"},
+	})
+	userJoin := addEvent(4, types.MRoomMemberNID, 11, map[string]interface{}{
+		"event_id": "$userjoin:remote", "type": gomatrixserverlib.MRoomMember, "state_key": "@user:remote", "sender": "@user:remote",
+		"content": map[string]interface{}{"membership": "join"},
+	})
+	// The admin leaving is only ever in the state that the room is
+	// overwritten with, not in the current state.
+	addEvent(5, types.MRoomMemberNID, 10, map[string]interface{}{
+		"event_id": "$adminleave:remote", "type": gomatrixserverlib.MRoomMember, "state_key": "@admin:remote", "sender": "@admin:remote",
+		"content": map[string]interface{}{"membership": "leave"},
+	})
+	db.currentState = []types.StateEntry{create, powerLevels, adminJoin, userJoin}
+	roomInfo := &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1, StateSnapshotNID: 1}
+
+	tests := []struct {
+		name          string
+		stateEventIDs []string
+		wantReset     bool
+	}{
+		{"overwrite keeps the admin", []string{"$create:remote", "$powerlevels:remote", "$adminjoin:remote"}, false},
+		{"overwrite removes all admins", []string{"$create:remote", "$powerlevels:remote", "$adminleave:remote", "$userjoin:remote"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			js := &fakeJetStream{}
+			r := &Inputer{DB: db, JetStream: js}
+			input := &api.InputRoomEvent{HasState: true, StateEventIDs: tc.stateEventIDs}
+			event := mustCreateEvent(t, map[string]interface{}{"event_id": "$event:remote"})
+			stateAtEvent := &types.StateAtEvent{StateEntry: types.StateEntry{EventNID: 6}}
+			if err := r.calculateAndSetState(context.Background(), input, roomInfo, stateAtEvent, event, false); err != nil {
+				t.Fatal(err)
+			}
+			if !stateAtEvent.Overwrite {
+				t.Fatal("expected the room state to be overwritten")
+			}
+			if stateAtEvent.BeforeStateSnapshotNID != 2 {
+				t.Fatalf("got state snapshot %d, want the new state to be applied anyway", stateAtEvent.BeforeStateSnapshotNID)
+			}
+			if !tc.wantReset {
+				if len(js.published) != 0 {
+					t.Fatalf("got %d output events, want none", len(js.published))
+				}
+				return
+			}
+			if len(js.published) != 1 {
+				t.Fatalf("got %d output events, want 1", len(js.published))
+			}
+			var output api.OutputEvent
+			if err := json.Unmarshal(js.published[0].Data, &output); err != nil {
+				t.Fatal(err)
+			}
+			if output.Type != api.OutputTypeStateReset || output.StateReset == nil {
+				t.Fatalf("got output event %+v, want a state reset", output)
+			}
+			if !reflect.DeepEqual(output.StateReset.PreviousAdmins, []string{"@admin:remote"}) || len(output.StateReset.Admins) != 0 {
+				t.Fatalf("got admins %v before and %v after", output.StateReset.PreviousAdmins, output.StateReset.Admins)
+			}
+			if output.StateReset.PreviousJoinedCount != 2 || output.StateReset.JoinedCount != 1 {
+				t.Fatalf("got %d joined before and %d after", output.StateReset.PreviousJoinedCount, output.StateReset.JoinedCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(stateResAlgorithmSelected)
+}
+
+var stateResAlgorithmSelected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resolution_algorithm_selected_total",
+		Help:      "Number of times a state resolution algorithm was selected for calculating room state",
+	},
+	[]string{"algorithm", "forced"},
+)
+
+// stateResolutionMetrics measure how long it takes to calculate the state
+// before events from their prev events, labelled by room in the same way as
+// the processroomevent_duration_millis histogram.
+type stateResolutionMetrics struct {
+	opts                 config.EventMetricsOptions
+	duration             *prometheus.HistogramVec
+	conflictingStateSets *prometheus.CounterVec
+}
+
+func newStateResolutionMetrics(opts config.EventMetricsOptions) *stateResolutionMetrics {
+	return &stateResolutionMetrics{
+		opts: opts,
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "dendrite",
+				Subsystem: "roomserver",
+				Name:      "state_resolution_duration_millis",
+				Help:      "How long it takes the roomserver to calculate and store the state before an event from its prev events",
+				Buckets: []float64{ // milliseconds
+					1, 5, 10, 25, 50, 100, 250, 500,
+					1000, 2500, 5000, 10000, 30000, 60000,
+				},
+			},
+			roomLabelNames(opts),
+		),
+		conflictingStateSets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "dendrite",
+				Subsystem: "roomserver",
+				Name:      "state_resolution_conflicting_state_sets_total",
+				Help:      "Number of conflicting state sets which were resolved when calculating the state before an event",
+			},
+			roomLabelNames(opts),
+		),
+	}
+}
+
+// observeStateResolution records how long it took to calculate the state
+// before an event in the room and how many conflicting state sets there were,
+// if the metrics have been registered.
+func (r *Inputer) observeStateResolution(
+	roomID string, roomVersion gomatrixserverlib.RoomVersion, timetaken time.Duration, conflictingStateSets int,
+) {
+	if r.stateResMetrics == nil {
+		return
+	}
+	labels := roomLabels(r.stateResMetrics.opts, roomID, roomVersion)
+	r.stateResMetrics.duration.With(labels).Observe(float64(timetaken.Milliseconds()))
+	if conflictingStateSets > 0 {
+		r.stateResMetrics.conflictingStateSets.With(labels).Add(float64(conflictingStateSets))
+	}
+}
+
+// stateResAlgorithm returns the state resolution algorithm to use for a room.
+// This is the algorithm mandated by the room version, unless a different one
+// has been forced for the room in the config.
+func (r *Inputer) stateResAlgorithm(
+	roomID string, roomVersion gomatrixserverlib.RoomVersion,
+) (algorithm gomatrixserverlib.StateResAlgorithm, forced bool, err error) {
+	if r.Cfg != nil && r.Cfg.ForcedStateResolution.Enabled {
+		switch r.Cfg.ForcedStateResolution.Rooms[roomID] {
+		case config.StateResolutionV1:
+			return gomatrixserverlib.StateResV1, true, nil
+		case config.StateResolutionV2:
+			return gomatrixserverlib.StateResV2, true, nil
+		}
+	}
+	algorithm, err = state.AlgorithmForRoomVersion(roomVersion)
+	return algorithm, false, err
+}
+
+// newStateResolution returns a state resolver for the room which uses the
+// algorithm from stateResAlgorithm.
+func (r *Inputer) newStateResolution(roomInfo *types.RoomInfo, roomID string) state.StateResolution {
+	roomState := state.NewStateResolution(r.DB, roomInfo)
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":      roomID,
+		"room_version": roomInfo.RoomVersion,
+	})
+	algorithm, forced, err := r.stateResAlgorithm(roomID, roomInfo.RoomVersion)
+	if err != nil {
+		// Resolving any conflicts will fail with the same error, so there's
+		// no need to do anything more here.
+		logger.WithError(err).Warn("Failed to select a state resolution algorithm")
+		return roomState
+	}
+	logger = logger.WithField("algorithm", state.AlgorithmName(algorithm))
+	if forced {
+		roomState.ForceAlgorithm(algorithm)
+		logger.Warn("Using a forced state resolution algorithm for room")
+	} else {
+		logger.Debug("Using the state resolution algorithm for the room version")
+	}
+	stateResAlgorithmSelected.WithLabelValues(state.AlgorithmName(algorithm), strconv.FormatBool(forced)).Inc()
+	return roomState
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStateResAlgorithm(t *testing.T) {
+	forced := config.ForcedStateResolutionOptions{
+		Rooms: map[string]string{"!forced:localhost": config.StateResolutionV1},
+	}
+	tests := []struct {
+		name        string
+		cfg         *config.RoomServer
+		roomID      string
+		roomVersion gomatrixserverlib.RoomVersion
+		want        gomatrixserverlib.StateResAlgorithm
+		wantForced  bool
+	}{
+		{"v1 room", nil, "!room:localhost", gomatrixserverlib.RoomVersionV1, gomatrixserverlib.StateResV1, false},
+		{"v2 room", nil, "!room:localhost", gomatrixserverlib.RoomVersionV2, gomatrixserverlib.StateResV2, false},
+		{"v6 room", nil, "!room:localhost", gomatrixserverlib.RoomVersionV6, gomatrixserverlib.StateResV2, false},
+		{"override not enabled", &config.RoomServer{ForcedStateResolution: forced}, "!forced:localhost", gomatrixserverlib.RoomVersionV6, gomatrixserverlib.StateResV2, false},
+		{"override enabled", &config.RoomServer{ForcedStateResolution: config.ForcedStateResolutionOptions{Enabled: true, Rooms: forced.Rooms}}, "!forced:localhost", gomatrixserverlib.RoomVersionV6, gomatrixserverlib.StateResV1, true},
+		{"override for another room", &config.RoomServer{ForcedStateResolution: config.ForcedStateResolutionOptions{Enabled: true, Rooms: forced.Rooms}}, "!room:localhost", gomatrixserverlib.RoomVersionV6, gomatrixserverlib.StateResV2, false},
+	}
+	for _, tc := range tests {
+		r := &Inputer{Cfg: tc.cfg}
+		algorithm, isForced, err := r.stateResAlgorithm(tc.roomID, tc.roomVersion)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if algorithm != tc.want || isForced != tc.wantForced {
+			t.Errorf("%s: got %v (forced %v), want %v (forced %v)", tc.name, algorithm, isForced, tc.want, tc.wantForced)
+		}
+
+		roomState := r.newStateResolution(&types.RoomInfo{RoomVersion: tc.roomVersion}, tc.roomID)
+		if algorithm, err = roomState.Algorithm(tc.roomVersion); err != nil || algorithm != tc.want {
+			t.Errorf("%s: state resolver uses %v, %v, want %v", tc.name, algorithm, err, tc.want)
+		}
+	}
+
+	// Unknown room versions don't have an algorithm.
+	if _, _, err := (&Inputer{}).stateResAlgorithm("!room:localhost", "unknown"); err == nil {
+		t.Errorf("expected an error for an unknown room version")
+	}
+}
+
+func TestCalculateAndSetStateRecordsStateResolution(t *testing.T) {
+	metrics := newStateResolutionMetrics(config.EventMetricsOptions{RoomLabel: config.EventMetricsRoomLabelRoomID})
+	r := &Inputer{DB: newStateCacheDB(t, 10), stateResMetrics: metrics}
+	roomID := "!stateresmetrics:localhost"
+	event := mustCreateEvent(t, map[string]interface{}{
+		"room_id": roomID,
+	})
+	roomInfo := &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV2}
+	stateAtEvent := &types.StateAtEvent{StateEntry: types.StateEntry{EventNID: 300000}}
+	if err := r.calculateAndSetState(context.Background(), &api.InputRoomEvent{}, roomInfo, stateAtEvent, event, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(metrics.duration); got != 1 {
+		t.Fatalf("got %d state resolution duration series, want 1", got)
+	}
+	// Both of the prev events' state sets had a different topic.
+	if got := testutil.ToFloat64(metrics.conflictingStateSets.WithLabelValues(roomID)); got != 2 {
+		t.Fatalf("got %v conflicting state sets, want 2", got)
+	}
+}
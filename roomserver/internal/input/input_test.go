@@ -0,0 +1,329 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/sirupsen/logrus"
+)
+
+// mustCreateEvent builds a fake event from the given JSON fields.
+func mustCreateEvent(t testing.TB, fields map[string]interface{}) *gomatrixserverlib.Event {
+	t.Helper()
+	builder := map[string]interface{}{
+		"event_id": "$test:localhost",
+		"room_id":  "!test:localhost",
+		"sender":   "@test:localhost",
+		"origin":   "localhost",
+		"type":     "m.room.message",
+		"content":  map[string]interface{}{},
+	}
+	for k, v := range fields {
+		builder[k] = v
+	}
+	eventJSON, err := json.Marshal(&builder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(
+		eventJSON, false, gomatrixserverlib.RoomVersionV1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestCheckFutureEvent(t *testing.T) {
+	now := time.Now()
+	nearSkew := mustCreateEvent(t, map[string]interface{}{
+		"origin_server_ts": gomatrixserverlib.AsTimestamp(now.Add(time.Minute * 4)),
+	})
+	farFuture := mustCreateEvent(t, map[string]interface{}{
+		"origin_server_ts": gomatrixserverlib.AsTimestamp(now.Add(time.Hour * 24 * 365)),
+	})
+	past := mustCreateEvent(t, map[string]interface{}{
+		"origin_server_ts": gomatrixserverlib.AsTimestamp(now.Add(-time.Hour * 24 * 365)),
+	})
+
+	tests := []struct {
+		name         string
+		action       string
+		event        *gomatrixserverlib.Event
+		wantFlagged  bool
+		wantSoftFail bool
+	}{
+		{"allow far future", config.FutureEventsActionAllow, farFuture, false, false},
+		{"flag near skew", config.FutureEventsActionFlag, nearSkew, false, false},
+		{"flag far future", config.FutureEventsActionFlag, farFuture, true, false},
+		{"soft fail near skew", config.FutureEventsActionSoftFail, nearSkew, false, false},
+		{"soft fail far future", config.FutureEventsActionSoftFail, farFuture, true, true},
+		{"soft fail past", config.FutureEventsActionSoftFail, past, false, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.RoomServer{}
+			cfg.FutureEvents.Defaults()
+			cfg.FutureEvents.Action = tc.action
+			r := &Inputer{Cfg: cfg}
+			flagged, softfail := r.checkFutureEvent(tc.event, "remote", now)
+			if flagged != tc.wantFlagged {
+				t.Errorf("got flagged %v, want %v", flagged, tc.wantFlagged)
+			}
+			if softfail != tc.wantSoftFail {
+				t.Errorf("got soft-fail %v, want %v", softfail, tc.wantSoftFail)
+			}
+		})
+	}
+}
+
+// cpuVerifier is a JSONVerifier which does the same amount of work as checking
+// a single ed25519 signature for each request, without needing real keys.
+type cpuVerifier struct {
+	public    ed25519.PublicKey
+	message   []byte
+	signature []byte
+}
+
+func newCPUVerifier() *cpuVerifier {
+	public, private, _ := ed25519.GenerateKey(nil)
+	message := []byte("auth event")
+	return &cpuVerifier{
+		public:    public,
+		message:   message,
+		signature: ed25519.Sign(private, message),
+	}
+}
+
+func (v *cpuVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i := range requests {
+		if !ed25519.Verify(v.public, v.message, v.signature) {
+			results[i].Error = fmt.Errorf("bad signature")
+		}
+	}
+	return results, nil
+}
+
+func mustCreateAuthChain(t testing.TB, length int) []*gomatrixserverlib.Event {
+	events := make([]*gomatrixserverlib.Event, 0, length)
+	for i := 0; i < length; i++ {
+		events = append(events, mustCreateEvent(t, map[string]interface{}{
+			"event_id":  fmt.Sprintf("$%d:remote", i),
+			"sender":    "@user:remote",
+			"origin":    "remote",
+			"type":      "m.room.power_levels",
+			"state_key": "",
+		}))
+	}
+	return events
+}
+
+func TestVerifyEventSignaturesOrder(t *testing.T) {
+	events := mustCreateAuthChain(t, 50)
+	events[20] = mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$bad:remote",
+		"sender":   "not a user ID",
+	})
+	for _, workers := range []int{1, 4, 100} {
+		errs := verifyEventSignatures(context.Background(), newCPUVerifier(), events, workers)
+		if len(errs) != len(events) {
+			t.Fatalf("workers=%d: got %d results, want %d", workers, len(errs), len(events))
+		}
+		for i, err := range errs {
+			if (err != nil) != (i == 20) {
+				t.Errorf("workers=%d: event %d: unexpected result %v", workers, i, err)
+			}
+		}
+	}
+}
+
+func BenchmarkVerifyEventSignatures(b *testing.B) {
+	events := mustCreateAuthChain(b, 1000)
+	verifier := newCPUVerifier()
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				verifyEventSignatures(context.Background(), verifier, events, workers)
+			}
+		})
+	}
+}
+
+// BenchmarkVerifyAuthChainSignatures compares verifying the signatures of an
+// auth chain of a typical size one at a time with verifying them using the
+// default number of workers.
+func BenchmarkVerifyAuthChainSignatures(b *testing.B) {
+	events := mustCreateAuthChain(b, 300)
+	verifier := newCPUVerifier()
+	r := &Inputer{}
+	for name, workers := range map[string]int{
+		"serial":   1,
+		"parallel": r.authEventVerificationWorkers(),
+	} {
+		workers := workers
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				verifyEventSignatures(context.Background(), verifier, events, workers)
+			}
+		})
+	}
+}
+
+func TestBypassSoftFail(t *testing.T) {
+	event := mustCreateEvent(t, map[string]interface{}{
+		"type":      "m.room.power_levels",
+		"state_key": "",
+	})
+	r := &Inputer{ServerName: "localhost"}
+	logger := logrus.WithField("test", t.Name())
+
+	tests := []struct {
+		name       string
+		input      api.InputRoomEvent
+		wantBypass bool
+	}{
+		{"not requested", api.InputRoomEvent{Kind: api.KindNew, Origin: "localhost"}, false},
+		{"requested locally", api.InputRoomEvent{Kind: api.KindNew, Origin: "localhost", BypassSoftFail: true}, true},
+		{"requested without origin", api.InputRoomEvent{Kind: api.KindNew, BypassSoftFail: true}, true},
+		{"requested over federation", api.InputRoomEvent{Kind: api.KindNew, Origin: "remote", BypassSoftFail: true}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			input := tc.input
+			input.Event = event.Headered(gomatrixserverlib.RoomVersionV1)
+			// The event is assumed to have been soft-failed by the current room state.
+			softfail := true
+			if softfail && r.bypassSoftFail(logger, &input) {
+				softfail = false
+			}
+			if softfail == tc.wantBypass {
+				t.Errorf("got soft-fail %v, want bypass %v", softfail, tc.wantBypass)
+			}
+		})
+	}
+}
+
+func TestProcessingTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"not set", 0, MaximumProcessingTime},
+		{"shorter", time.Second * 5, time.Second * 5},
+		{"longer", MaximumProcessingTime * 2, MaximumProcessingTime},
+		{"negative", -time.Second, MaximumProcessingTime},
+	}
+	for _, tc := range tests {
+		if got := processingTimeout(&api.InputRoomEvent{ProcessingTimeout: tc.timeout}); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIsRoomCreateEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		fields     map[string]interface{}
+		wantCreate bool
+		wantErr    bool
+	}{
+		{"create", map[string]interface{}{"type": "m.room.create", "state_key": ""}, true, false},
+		{"create with state key", map[string]interface{}{"type": "m.room.create", "state_key": "@test:localhost"}, false, true},
+		{"create without state key", map[string]interface{}{"type": "m.room.create"}, false, true},
+		{"not a create", map[string]interface{}{"type": "m.room.topic", "state_key": ""}, false, false},
+	}
+	for _, tc := range tests {
+		isCreate, err := isRoomCreateEvent(mustCreateEvent(t, tc.fields))
+		if isCreate != tc.wantCreate || (err != nil) != tc.wantErr {
+			t.Errorf("%s: got create %v, error %v", tc.name, isCreate, err)
+		}
+		if err != nil && !errors.Is(err, errMalformedCreateEvent) {
+			t.Errorf("%s: expected errMalformedCreateEvent, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestProcessRoomEventRejectsMalformedCreate(t *testing.T) {
+	// The Inputer has no Queryer, so this would panic if the event got as far
+	// as looking for missing auth and prev events.
+	r := &Inputer{}
+	event := mustCreateEvent(t, map[string]interface{}{
+		"type":      "m.room.create",
+		"state_key": "@test:localhost",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: event}
+	if _, err := r.processRoomEvent(context.Background(), input); !errors.Is(err, errMalformedCreateEvent) {
+		t.Fatalf("expected errMalformedCreateEvent, got %v", err)
+	}
+}
+
+func TestProcessRoomEventSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	r := &Inputer{DB: &failingStoreDB{}}
+	event := mustCreateEvent(t, map[string]interface{}{
+		"type":      gomatrixserverlib.MRoomCreate,
+		"state_key": "",
+		"content":   map[string]interface{}{"creator": "@test:localhost"},
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	input := &api.InputRoomEvent{Kind: api.KindOld, Event: event}
+	if _, err := r.processRoomEvent(context.Background(), input); err == nil {
+		t.Fatalf("expected storing the event to fail")
+	}
+
+	spans := map[string]*mocktracer.MockSpan{}
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	root, ok := spans["processRoomEvent"]
+	if !ok {
+		t.Fatalf("expected a processRoomEvent span, got %v", spans)
+	}
+	if root.Tag("error") != true || root.Tag("rejected") != false || root.Tag("soft_failed") != false {
+		t.Errorf("processRoomEvent span has the wrong tags: %v", root.Tags())
+	}
+	for _, name := range []string{"fetchAuthEvents", "StoreEvent"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("expected a %s span, got %v", name, spans)
+		}
+		if span.ParentID != root.SpanContext.SpanID {
+			t.Errorf("%s span isn't a child of the processRoomEvent span", name)
+		}
+		if span.Tag("room_id") != event.RoomID() || span.Tag("event_id") != event.EventID() {
+			t.Errorf("%s span has the wrong tags: %v", name, span.Tags())
+		}
+	}
+	// The event isn't new, so it isn't checked for soft-failing.
+	if _, ok = spans["CheckForSoftFail"]; ok {
+		t.Errorf("didn't expect a CheckForSoftFail span")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// orderInputTopologically returns the indexes of the input events, sorted so
+// that each event comes after any of its auth and prev events which are also
+// in the input. Events are queued onto their room's worker in this order and
+// processed one at a time, so by the time an event is processed, the events
+// that it refers to from the same batch have already been stored and don't
+// need to be fetched. Indexes are returned rather than the events themselves
+// so that the result of each event can be reported in its original position.
+//
+// Events which don't depend on each other keep their original order. If the
+// events refer to each other in a loop, which no valid events can do, then
+// the events in the loop are left in their original order at the end.
+func orderInputTopologically(inputs []api.InputRoomEvent) []int {
+	index := make(map[string]int, len(inputs))
+	for i := range inputs {
+		index[inputs[i].Event.EventID()] = i
+	}
+
+	// dependents[i] lists the inputs which refer to input i, and waiting[i]
+	// counts the inputs which input i refers to that haven't been ordered yet.
+	dependents := make([][]int, len(inputs))
+	waiting := make([]int, len(inputs))
+	for i := range inputs {
+		refs := map[int]struct{}{}
+		for _, eventIDs := range [][]string{inputs[i].Event.AuthEventIDs(), inputs[i].Event.PrevEventIDs()} {
+			for _, eventID := range eventIDs {
+				if j, ok := index[eventID]; ok && j != i {
+					refs[j] = struct{}{}
+				}
+			}
+		}
+		for j := range refs {
+			dependents[j] = append(dependents[j], i)
+			waiting[i]++
+		}
+	}
+
+	// Kahn's algorithm, always taking the earliest input that isn't waiting
+	// for anything else.
+	ordered := make([]int, 0, len(inputs))
+	done := make([]bool, len(inputs))
+	for len(ordered) < len(inputs) {
+		next := -1
+		for i := range inputs {
+			if !done[i] && waiting[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			for i := range inputs {
+				if !done[i] {
+					ordered = append(ordered, i)
+				}
+			}
+			break
+		}
+		done[next] = true
+		ordered = append(ordered, next)
+		for _, dependent := range dependents[next] {
+			waiting[dependent]--
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// batchDB stores events in memory, remembering the order that they were
+// stored in. Calling any other storage.Database method will panic.
+type batchDB struct {
+	storage.Database
+	mu       sync.Mutex
+	events   map[string]types.Event
+	stored   []string
+	rejected map[string]bool
+}
+
+func (d *batchDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (d *batchDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var events []types.Event
+	for _, eventID := range eventIDs {
+		if ev, ok := d.events[eventID]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func (d *batchDB) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nids := map[string]types.EventNID{}
+	for _, eventID := range eventIDs {
+		if ev, ok := d.events[eventID]; ok {
+			nids[eventID] = ev.EventNID
+		}
+	}
+	return nids, nil
+}
+
+func (d *batchDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var states []types.StateAtEvent
+	for _, eventID := range eventIDs {
+		ev, ok := d.events[eventID]
+		if !ok {
+			return nil, fmt.Errorf("unknown event %s", eventID)
+		}
+		states = append(states, types.StateAtEvent{StateEntry: types.StateEntry{EventNID: ev.EventNID}})
+	}
+	return states, nil
+}
+
+func (d *batchDB) StoreEvent(
+	ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID, isRejected, rejectedByAuth bool, rejectionReason string,
+) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nid := types.EventNID(len(d.events) + 1)
+	d.events[event.EventID()] = types.Event{EventNID: nid, Event: event}
+	d.stored = append(d.stored, event.EventID())
+	d.rejected[event.EventID()] = isRejected
+	return nid, 1, types.StateAtEvent{}, nil, "", nil
+}
+
+func TestInputRoomEventsInTopologicalOrder(t *testing.T) {
+	ref := func(eventIDs ...string) []interface{} {
+		refs := make([]interface{}, 0, len(eventIDs))
+		for _, eventID := range eventIDs {
+			refs = append(refs, []interface{}{eventID, map[string]interface{}{}})
+		}
+		return refs
+	}
+	create := mustCreateEvent(t, map[string]interface{}{
+		"event_id":  "$create:localhost",
+		"type":      gomatrixserverlib.MRoomCreate,
+		"state_key": "",
+		"content":   map[string]interface{}{"creator": "@test:localhost"},
+	})
+	join := mustCreateEvent(t, map[string]interface{}{
+		"event_id":    "$join:localhost",
+		"type":        gomatrixserverlib.MRoomMember,
+		"state_key":   "@test:localhost",
+		"content":     map[string]interface{}{"membership": gomatrixserverlib.Join},
+		"auth_events": ref("$create:localhost"),
+		"prev_events": ref("$create:localhost"),
+	})
+	first := mustCreateEvent(t, map[string]interface{}{
+		"event_id":    "$first:localhost",
+		"auth_events": ref("$create:localhost", "$join:localhost"),
+		"prev_events": ref("$join:localhost"),
+	})
+	// The sender of this one isn't in the room, so it will be rejected.
+	notAllowed := mustCreateEvent(t, map[string]interface{}{
+		"event_id":    "$notallowed:localhost",
+		"sender":      "@other:localhost",
+		"auth_events": ref("$create:localhost"),
+		"prev_events": ref("$first:localhost"),
+	})
+	last := mustCreateEvent(t, map[string]interface{}{
+		"event_id":    "$last:localhost",
+		"auth_events": ref("$create:localhost", "$join:localhost"),
+		"prev_events": ref("$notallowed:localhost"),
+	})
+
+	db := &batchDB{events: map[string]types.Event{}, rejected: map[string]bool{}}
+	r := &Inputer{DB: db, Queryer: &query.Queryer{DB: db}}
+	req := &api.InputRoomEventsRequest{TopologicalOrder: true}
+	for _, event := range []*gomatrixserverlib.Event{last, first, notAllowed, join, create} {
+		req.InputRoomEvents = append(req.InputRoomEvents, api.InputRoomEvent{
+			Kind:  api.KindOutlier,
+			Event: event.Headered(gomatrixserverlib.RoomVersionV1),
+		})
+	}
+	res := &api.InputRoomEventsResponse{}
+	r.InputRoomEvents(context.Background(), req, res)
+	if res.ErrMsg != "" {
+		t.Fatalf("InputRoomEvents: %s", res.ErrMsg)
+	}
+
+	want := []string{create.EventID(), join.EventID(), first.EventID(), notAllowed.EventID(), last.EventID()}
+	if !reflect.DeepEqual(db.stored, want) {
+		t.Fatalf("events were stored in the wrong order, got %v, want %v", db.stored, want)
+	}
+	for _, eventID := range want {
+		if wantRejected := eventID == notAllowed.EventID(); db.rejected[eventID] != wantRejected {
+			t.Errorf("%s: got rejected %v, want %v", eventID, db.rejected[eventID], wantRejected)
+		}
+	}
+
+	// The results should be in the order of the request, not the order that
+	// the events were processed in.
+	if len(res.Results) != len(req.InputRoomEvents) {
+		t.Fatalf("got %d results, want %d", len(res.Results), len(req.InputRoomEvents))
+	}
+	for i, result := range res.Results {
+		eventID := req.InputRoomEvents[i].Event.EventID()
+		if result.EventID != eventID {
+			t.Errorf("result %d: got event ID %s, want %s", i, result.EventID, eventID)
+		}
+		if wantRejected := eventID == notAllowed.EventID(); result.Rejected != wantRejected {
+			t.Errorf("result %d: got rejected %v, want %v", i, result.Rejected, wantRejected)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(duplicateTransactions)
+}
+
+var duplicateTransactions = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "duplicate_transactions_total",
+		Help:      "Number of new events which weren't processed because an event with the same transaction ID already was",
+	},
+)
+
+// transactionKey identifies a client transaction. Clients only have to keep
+// transaction IDs unique per endpoint, so the same transaction ID can be used
+// to send different events to different rooms, or with different event types.
+type transactionKey struct {
+	sendAsServer  string
+	sender        string
+	sessionID     int64
+	transactionID string
+	roomID        string
+	eventType     string
+}
+
+type transactionEntry struct {
+	key     transactionKey
+	eventID string
+	added   time.Time
+}
+
+// transactionCache is a least-recently-used cache of the events which were
+// recently processed for each client transaction ID, so that an event sent
+// again by a client retrying the same transaction isn't processed twice. The
+// zero value is an empty cache.
+type transactionCache struct {
+	mu      sync.Mutex
+	entries map[transactionKey]*list.Element
+	order   list.List // most recently used at the front
+}
+
+func (c *transactionCache) get(key transactionKey, ttl time.Duration, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*transactionEntry)
+	if now.Sub(entry.added) >= ttl {
+		c.order.Remove(element)
+		delete(c.entries, entry.key)
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return entry.eventID, true
+}
+
+func (c *transactionCache) add(key transactionKey, eventID string, size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[transactionKey]*list.Element)
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = &transactionEntry{key, eventID, now}
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&transactionEntry{key, eventID, now})
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*transactionEntry).key)
+	}
+}
+
+func (r *Inputer) transactionDedupOptions() config.TransactionDedupOptions {
+	if r.Cfg == nil {
+		return config.TransactionDedupOptions{}
+	}
+	return r.Cfg.TransactionDedup
+}
+
+// transactionKeyForInput returns the key of the client transaction that the
+// input event was sent in, or false if it wasn't sent in one.
+func transactionKeyForInput(input *api.InputRoomEvent) (transactionKey, bool) {
+	if input.Kind != api.KindNew || input.TransactionID == nil || input.TransactionID.TransactionID == "" {
+		return transactionKey{}, false
+	}
+	return transactionKey{
+		sendAsServer:  input.SendAsServer,
+		sender:        input.Event.Sender(),
+		sessionID:     input.TransactionID.SessionID,
+		transactionID: input.TransactionID.TransactionID,
+		roomID:        input.Event.RoomID(),
+		eventType:     input.Event.Type(),
+	}, true
+}
+
+// processedTransaction returns the ID of the event which was already processed
+// for the same client transaction as the input event, if there was one.
+func (r *Inputer) processedTransaction(input *api.InputRoomEvent) (string, bool) {
+	opts := r.transactionDedupOptions()
+	if opts.Size <= 0 {
+		return "", false
+	}
+	key, ok := transactionKeyForInput(input)
+	if !ok {
+		return "", false
+	}
+	return r.transactions.get(key, opts.TTL, time.Now())
+}
+
+// rememberTransaction remembers that the input event was processed for its
+// client transaction, if it was sent in one.
+func (r *Inputer) rememberTransaction(input *api.InputRoomEvent) {
+	opts := r.transactionDedupOptions()
+	if opts.Size <= 0 {
+		return
+	}
+	if key, ok := transactionKeyForInput(input); ok {
+		r.transactions.add(key, input.Event.EventID(), opts.Size, time.Now())
+	}
+}
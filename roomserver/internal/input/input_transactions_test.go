@@ -0,0 +1,143 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestProcessRoomEventIgnoresRetriedTransactions(t *testing.T) {
+	cfg := &config.RoomServer{}
+	cfg.TransactionDedup.Defaults()
+	// The Inputer has no Queryer, so this would panic if the retried event
+	// got as far as looking for missing auth and prev events.
+	db := &fakeAuthFallbackDB{events: map[string]types.Event{}}
+	r := &Inputer{Cfg: cfg, DB: db}
+	txnID := &api.TransactionID{SessionID: 1, TransactionID: "m1"}
+	first := &api.InputRoomEvent{
+		Kind:          api.KindNew,
+		Event:         mustCreateEvent(t, map[string]interface{}{"event_id": "$first:localhost"}).Headered(gomatrixserverlib.RoomVersionV1),
+		SendAsServer:  "localhost",
+		TransactionID: txnID,
+	}
+	retry := &api.InputRoomEvent{
+		Kind:          api.KindNew,
+		Event:         mustCreateEvent(t, map[string]interface{}{"event_id": "$retry:localhost"}).Headered(gomatrixserverlib.RoomVersionV1),
+		SendAsServer:  "localhost",
+		TransactionID: txnID,
+	}
+
+	if _, ok := r.processedTransaction(retry); ok {
+		t.Fatal("expected the transaction not to be known yet")
+	}
+	// The first event was processed and stored.
+	db.events["$first:localhost"] = types.Event{EventNID: 1, Event: first.Event.Unwrap()}
+	db.stored = append(db.stored, "$first:localhost")
+	r.rememberTransaction(first)
+
+	result, err := r.processRoomEvent(context.Background(), retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.EventID != "$first:localhost" {
+		t.Fatalf("expected the result to give the original event ID, got %q", result.EventID)
+	}
+	if len(db.stored) != 1 {
+		t.Fatalf("expected a single stored event, got %v", db.stored)
+	}
+	if eventID, ok := r.processedTransaction(retry); !ok || eventID != "$first:localhost" {
+		t.Fatalf("expected the retry to be a duplicate of the first event, got %q", eventID)
+	}
+
+	// The same transaction ID from another session is a different transaction.
+	other := *retry
+	other.TransactionID = &api.TransactionID{SessionID: 2, TransactionID: "m1"}
+	if _, ok := r.processedTransaction(&other); ok {
+		t.Fatal("expected a transaction from another session not to be a duplicate")
+	}
+
+	// The same transaction ID can be used to send to another room.
+	otherRoom := *retry
+	otherRoom.Event = mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$otherroom:localhost",
+		"room_id":  "!other:localhost",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	if _, ok := r.processedTransaction(&otherRoom); ok {
+		t.Fatal("expected a transaction in another room not to be a duplicate")
+	}
+
+	// Or to send an event of a different type.
+	otherType := *retry
+	otherType.Event = mustCreateEvent(t, map[string]interface{}{
+		"event_id": "$othertype:localhost",
+		"type":     "m.reaction",
+	}).Headered(gomatrixserverlib.RoomVersionV1)
+	if _, ok := r.processedTransaction(&otherType); ok {
+		t.Fatal("expected a transaction with another event type not to be a duplicate")
+	}
+
+	// Transactions are forgotten after the TTL.
+	key, _ := transactionKeyForInput(retry)
+	if _, ok := r.transactions.get(key, cfg.TransactionDedup.TTL, time.Now().Add(cfg.TransactionDedup.TTL)); ok {
+		t.Fatal("expected the transaction to be forgotten after the TTL")
+	}
+}
+
+// roomInfoFailingDB stores events but fails to look up the room afterwards.
+type roomInfoFailingDB struct {
+	fakeAuthFallbackDB
+}
+
+func (d *roomInfoFailingDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	return nil, errors.New("database is unavailable")
+}
+
+func TestProcessRoomEventForgetsFailedTransactions(t *testing.T) {
+	cfg := &config.RoomServer{}
+	cfg.TransactionDedup.Defaults()
+	db := &roomInfoFailingDB{fakeAuthFallbackDB{events: map[string]types.Event{}}}
+	r := &Inputer{Cfg: cfg, DB: db}
+	input := &api.InputRoomEvent{
+		Kind: api.KindNew,
+		Event: mustCreateEvent(t, map[string]interface{}{
+			"event_id":  "$create:localhost",
+			"type":      gomatrixserverlib.MRoomCreate,
+			"state_key": "",
+			"content":   map[string]interface{}{"creator": "@test:localhost"},
+		}).Headered(gomatrixserverlib.RoomVersionV1),
+		SendAsServer:  "localhost",
+		TransactionID: &api.TransactionID{SessionID: 1, TransactionID: "m1"},
+	}
+
+	// The event is stored before processing fails, but the transaction
+	// mustn't be remembered, or the client's retry would be ignored.
+	if _, err := r.processRoomEvent(context.Background(), input); err == nil {
+		t.Fatal("expected processing the event to fail")
+	}
+	if len(db.stored) != 1 {
+		t.Fatalf("expected the event to be stored, got %v", db.stored)
+	}
+	if _, ok := r.processedTransaction(input); ok {
+		t.Fatal("expected the transaction not to be remembered")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/validator"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(eventValidatorResults)
+}
+
+var eventValidatorResults = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "event_validator_results_total",
+		Help:      "Number of new events checked by each event validator, by outcome",
+	},
+	[]string{"validator", "outcome"},
+)
+
+// defaultEventValidatorTimeout is used if there is no roomserver config, e.g.
+// in tests.
+const defaultEventValidatorTimeout = time.Millisecond * 500
+
+type eventValidatorResponse struct {
+	result validator.Result
+	err    error
+}
+
+// runEventValidators runs the event through each of the registered validators
+// in turn, stopping at the first one that doesn't accept it. Validators that
+// fail or time out are logged and skipped, so that a broken validator can't
+// stop the room from making progress.
+func (r *Inputer) runEventValidators(ctx context.Context, logger *logrus.Entry, input *api.InputRoomEvent) validator.Result {
+	timeout := defaultEventValidatorTimeout
+	if r.Cfg != nil && r.Cfg.EventValidatorTimeout > 0 {
+		timeout = r.Cfg.EventValidatorTimeout
+	}
+	for _, v := range r.Validators {
+		res, err := runEventValidator(ctx, timeout, v.Validator, input)
+		switch {
+		case err == context.DeadlineExceeded:
+			eventValidatorResults.WithLabelValues(v.Name, "timeout").Inc()
+			logger.WithField("validator", v.Name).Warnf("Event validator didn't respond within %s, skipping", timeout)
+			continue
+		case err != nil:
+			eventValidatorResults.WithLabelValues(v.Name, "error").Inc()
+			logger.WithField("validator", v.Name).WithError(err).Warn("Event validator failed, skipping")
+			continue
+		}
+		eventValidatorResults.WithLabelValues(v.Name, res.Outcome.String()).Inc()
+		if res.Outcome != validator.Accept {
+			logger.WithFields(logrus.Fields{
+				"validator": v.Name,
+				"outcome":   res.Outcome.String(),
+				"reason":    res.Reason,
+			}).Warn("Event validator did not accept event")
+			return res
+		}
+	}
+	return validator.Result{Outcome: validator.Accept}
+}
+
+func runEventValidator(
+	ctx context.Context, timeout time.Duration, v validator.Validator, input *api.InputRoomEvent,
+) (validator.Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The channel is buffered so that a validator which ignores the context
+	// doesn't block forever once we've stopped waiting for it.
+	ch := make(chan eventValidatorResponse, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				ch <- eventValidatorResponse{err: fmt.Errorf("validator panicked: %v", p)}
+			}
+		}()
+		res, err := v.Validate(ctx, input.Event, input.Origin)
+		ch <- eventValidatorResponse{res, err}
+	}()
+
+	select {
+	case resp := <-ch:
+		if err := ctx.Err(); err != nil {
+			// The validator only responded because the context expired.
+			return validator.Result{}, err
+		}
+		return resp.result, resp.err
+	case <-ctx.Done():
+		return validator.Result{}, ctx.Err()
+	}
+}
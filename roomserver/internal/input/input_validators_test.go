@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/validator"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRunEventValidators(t *testing.T) {
+	accept := validator.Func(func(context.Context, *gomatrixserverlib.HeaderedEvent, gomatrixserverlib.ServerName) (validator.Result, error) {
+		return validator.Result{Outcome: validator.Accept}, nil
+	})
+	reject := validator.Func(func(context.Context, *gomatrixserverlib.HeaderedEvent, gomatrixserverlib.ServerName) (validator.Result, error) {
+		return validator.Result{Outcome: validator.Reject, Reason: "rejected"}, nil
+	})
+	quarantine := validator.Func(func(context.Context, *gomatrixserverlib.HeaderedEvent, gomatrixserverlib.ServerName) (validator.Result, error) {
+		return validator.Result{Outcome: validator.Quarantine, Reason: "quarantined"}, nil
+	})
+	slow := validator.Func(func(ctx context.Context, _ *gomatrixserverlib.HeaderedEvent, _ gomatrixserverlib.ServerName) (validator.Result, error) {
+		<-ctx.Done()
+		return validator.Result{Outcome: validator.Reject, Reason: "too late"}, nil
+	})
+	failing := validator.Func(func(context.Context, *gomatrixserverlib.HeaderedEvent, gomatrixserverlib.ServerName) (validator.Result, error) {
+		return validator.Result{Outcome: validator.Reject, Reason: "ignored"}, errors.New("broken")
+	})
+	panicking := validator.Func(func(context.Context, *gomatrixserverlib.HeaderedEvent, gomatrixserverlib.ServerName) (validator.Result, error) {
+		panic("oops")
+	})
+
+	tests := []struct {
+		name        string
+		validators  []validator.Validator
+		wantOutcome validator.Outcome
+		wantReason  string
+	}{
+		{"no validators", nil, validator.Accept, ""},
+		{"accept", []validator.Validator{accept}, validator.Accept, ""},
+		{"reject", []validator.Validator{accept, reject}, validator.Reject, "rejected"},
+		{"quarantine", []validator.Validator{quarantine, reject}, validator.Quarantine, "quarantined"},
+		{"timeout skipped", []validator.Validator{slow, quarantine}, validator.Quarantine, "quarantined"},
+		{"timeout only", []validator.Validator{slow}, validator.Accept, ""},
+		{"error skipped", []validator.Validator{failing}, validator.Accept, ""},
+		{"panic skipped", []validator.Validator{panicking, reject}, validator.Reject, "rejected"},
+	}
+
+	input := &api.InputRoomEvent{
+		Kind:  api.KindNew,
+		Event: mustCreateEvent(t, nil).Headered(gomatrixserverlib.RoomVersionV1),
+	}
+	logger := logrus.WithField("test", t.Name())
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Inputer{Cfg: &config.RoomServer{EventValidatorTimeout: time.Millisecond * 50}}
+			for _, v := range tc.validators {
+				r.Validators = append(r.Validators, validator.Named{Name: tc.name, Validator: v})
+			}
+			res := r.runEventValidators(context.Background(), logger, input)
+			if res.Outcome != tc.wantOutcome || res.Reason != tc.wantReason {
+				t.Fatalf("got %s (%q), want %s (%q)", res.Outcome, res.Reason, tc.wantOutcome, tc.wantReason)
+			}
+		})
+	}
+}
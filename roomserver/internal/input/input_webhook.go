@@ -0,0 +1,132 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// acceptanceWebhookRequest is the body POSTed to the acceptance webhook.
+type acceptanceWebhookRequest struct {
+	RoomVersion   gomatrixserverlib.RoomVersion `json:"room_version"`
+	Event         json.RawMessage               `json:"event"`
+	Origin        gomatrixserverlib.ServerName  `json:"origin,omitempty"`
+	AuthEventIDs  []string                      `json:"auth_event_ids"`
+	PrevEventIDs  []string                      `json:"prev_event_ids"`
+	HasState      bool                          `json:"has_state"`
+	StateEventIDs []string                      `json:"state_event_ids,omitempty"`
+}
+
+// acceptanceWebhookResponse is the optional body returned by the acceptance
+// webhook. An empty body is treated as allowing the event.
+type acceptanceWebhookResponse struct {
+	Allow  *bool  `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// acceptanceWebhookVetoError is returned when the acceptance webhook
+// doesn't want the event to be accepted.
+type acceptanceWebhookVetoError struct {
+	reason string
+}
+
+func (e acceptanceWebhookVetoError) Error() string {
+	return fmt.Sprintf("event vetoed by acceptance webhook: %s", e.reason)
+}
+
+var acceptanceWebhookClient = &http.Client{}
+
+// checkAcceptanceWebhook asks the acceptance webhook, if one is configured,
+// whether the event should be accepted. It returns nil if the event should be
+// accepted and an error describing why otherwise. If the webhook can't be
+// reached then the event is accepted or rejected depending on whether the
+// webhook is configured to fail open or closed.
+func (r *Inputer) checkAcceptanceWebhook(ctx context.Context, logger *logrus.Entry, input *api.InputRoomEvent) error {
+	if r.Cfg == nil || r.Cfg.AcceptanceWebhook.URL == "" {
+		return nil
+	}
+	opts := r.Cfg.AcceptanceWebhook
+	err := callAcceptanceWebhook(ctx, opts.URL, opts.Timeout, input)
+	switch err.(type) {
+	case nil:
+		return nil
+	case acceptanceWebhookVetoError:
+		return err
+	default:
+		if opts.FailClosed {
+			return fmt.Errorf("acceptance webhook failed: %w", err)
+		}
+		logger.WithError(err).Warn("Acceptance webhook failed, accepting event anyway")
+		return nil
+	}
+}
+
+func callAcceptanceWebhook(ctx context.Context, url string, timeout time.Duration, input *api.InputRoomEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(acceptanceWebhookRequest{
+		RoomVersion:   input.Event.RoomVersion,
+		Event:         input.Event.JSON(),
+		Origin:        input.Origin,
+		AuthEventIDs:  input.Event.AuthEventIDs(),
+		PrevEventIDs:  input.Event.PrevEventIDs(),
+		HasState:      input.HasState,
+		StateEventIDs: input.StateEventIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := acceptanceWebhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("acceptanceWebhookClient.Do: %w", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return acceptanceWebhookVetoError{fmt.Sprintf("received HTTP status %d", resp.StatusCode)}
+	}
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadAll: %w", err)
+	}
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return nil
+	}
+	var res acceptanceWebhookResponse
+	if err = json.Unmarshal(respBody, &res); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if res.Allow != nil && !*res.Allow {
+		return acceptanceWebhookVetoError{res.Reason}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAcceptanceWebhook(t *testing.T) {
+	event := mustCreateEvent(t, nil)
+	input := &api.InputRoomEvent{
+		Kind:   api.KindNew,
+		Event:  event.Headered(gomatrixserverlib.RoomVersionV1),
+		Origin: "remote",
+	}
+	logger := logrus.WithField("test", t.Name())
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		failClosed bool
+		wantErr    bool
+	}{
+		{
+			name: "allow",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"allow":true}`))
+			},
+		},
+		{
+			name: "allow with empty body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			name: "veto",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"allow":false,"reason":"no thanks"}`))
+			},
+			wantErr: true,
+		},
+		{
+			name: "veto with status code",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			},
+			wantErr: true,
+		},
+		{
+			name: "timeout fails open",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				// The request context is only cancelled when the client goes
+				// away once the body has been read.
+				_, _ = io.Copy(ioutil.Discard, r.Body)
+				<-r.Context().Done()
+			},
+		},
+		{
+			name: "timeout fails closed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				// The request context is only cancelled when the client goes
+				// away once the body has been read.
+				_, _ = io.Copy(ioutil.Discard, r.Body)
+				<-r.Context().Done()
+			},
+			failClosed: true,
+			wantErr:    true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+			cfg := &config.RoomServer{}
+			cfg.AcceptanceWebhook.Defaults()
+			cfg.AcceptanceWebhook.URL = srv.URL
+			cfg.AcceptanceWebhook.Timeout = time.Millisecond * 100
+			cfg.AcceptanceWebhook.FailClosed = tc.failClosed
+			r := &Inputer{Cfg: cfg}
+			err := r.checkAcceptanceWebhook(context.Background(), logger, input)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("got error %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestAcceptanceWebhookDisabled(t *testing.T) {
+	cfg := &config.RoomServer{}
+	cfg.AcceptanceWebhook.Defaults()
+	r := &Inputer{Cfg: cfg}
+	if err := r.checkAcceptanceWebhook(context.Background(), logrus.WithField("test", t.Name()), &api.InputRoomEvent{}); err != nil {
+		t.Errorf("expected no error when webhook is disabled, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoomWorkersOrderingAndConcurrency(t *testing.T) {
+	r := &Inputer{}
+	var mu sync.Mutex
+	processed := map[string][]int{}
+	record := func(roomID string, i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		processed[roomID] = append(processed[roomID], i)
+	}
+
+	// Room A's first event blocks until all of room B's events have been
+	// processed, which can only happen if the rooms are processed in
+	// parallel.
+	const events = 20
+	unblock := make(chan struct{})
+	var roomB sync.WaitGroup
+	roomB.Add(events)
+	var done sync.WaitGroup
+	done.Add(events * 2)
+	for i := 0; i < events; i++ {
+		i := i
+		r.workerForRoom("!a:localhost").Act(nil, func() {
+			defer done.Done()
+			if i == 0 {
+				select {
+				case <-unblock:
+				case <-time.After(time.Second * 5):
+					t.Error("room B wasn't processed while room A was busy")
+				}
+			}
+			record("!a:localhost", i)
+		})
+		r.workerForRoom("!b:localhost").Act(nil, func() {
+			defer done.Done()
+			defer roomB.Done()
+			record("!b:localhost", i)
+		})
+	}
+	roomB.Wait()
+	close(unblock)
+	done.Wait()
+
+	want := make([]int, events)
+	for i := range want {
+		want[i] = i
+	}
+	for _, roomID := range []string{"!a:localhost", "!b:localhost"} {
+		if !reflect.DeepEqual(processed[roomID], want) {
+			t.Errorf("%s: events processed out of order: %v", roomID, processed[roomID])
+		}
+	}
+}
+
+func BenchmarkRoomWorkers(b *testing.B) {
+	for _, rooms := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("rooms=%d", rooms), func(b *testing.B) {
+			r := &Inputer{}
+			var wg sync.WaitGroup
+			wg.Add(b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Simulate an event which spends most of its time waiting on
+				// the database, spread over the given number of rooms.
+				r.workerForRoom(fmt.Sprintf("!%d:localhost", i%rooms)).Act(nil, func() {
+					defer wg.Done()
+					time.Sleep(time.Millisecond)
+				})
+			}
+			wg.Wait()
+		})
+	}
+}
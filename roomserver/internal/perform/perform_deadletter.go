@@ -0,0 +1,59 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/sirupsen/logrus"
+)
+
+type DeadLetterResubmitter struct {
+	Inputer *input.Inputer
+}
+
+func (r *DeadLetterResubmitter) PerformResubmitInputDeadLetters(
+	ctx context.Context,
+	req *api.PerformResubmitInputDeadLettersRequest,
+	res *api.PerformResubmitInputDeadLettersResponse,
+) {
+	if len(req.EventIDs) == 0 {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "event IDs must be specified",
+		}
+		return
+	}
+	resubmitted, failed, err := r.Inputer.ResubmitInputDeadLetters(ctx, req.EventIDs)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: err.Error(),
+		}
+		return
+	}
+	res.Resubmitted = resubmitted
+	if len(failed) > 0 {
+		res.Failed = make(map[string]string, len(failed))
+		for eventID, ferr := range failed {
+			res.Failed[eventID] = ferr.Error()
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"resubmitted": len(resubmitted),
+		"failed":      len(failed),
+	}).Info("Re-submitted dead-lettered input events")
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/sirupsen/logrus"
+)
+
+type RoomMaintainer struct {
+	Inputer *input.Inputer
+}
+
+func (r *RoomMaintainer) PerformRoomMaintenance(
+	ctx context.Context,
+	req *api.PerformRoomMaintenanceRequest,
+	res *api.PerformRoomMaintenanceResponse,
+) {
+	if req.RoomID == "" {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "room ID must be specified",
+		}
+		return
+	}
+	if err := r.Inputer.SetRoomMaintenance(ctx, req.RoomID, req.Enabled); err != nil {
+		res.Error = &api.PerformError{
+			Msg: err.Error(),
+		}
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id": req.RoomID,
+		"enabled": req.Enabled,
+	}).Info("Room maintenance mode changed")
+}
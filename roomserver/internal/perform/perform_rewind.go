@@ -0,0 +1,67 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/sirupsen/logrus"
+)
+
+type RoomRewinder struct {
+	Inputer *input.Inputer
+}
+
+// PerformRewindRoomState implements api.RoomserverInternalAPI
+func (r *RoomRewinder) PerformRewindRoomState(
+	ctx context.Context,
+	req *api.PerformRewindRoomStateRequest,
+	res *api.PerformRewindRoomStateResponse,
+) {
+	if req.RoomID == "" || req.TargetEventID == "" {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "room ID and target event ID must be specified",
+		}
+		return
+	}
+	if req.ConfirmRoomID != req.RoomID {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "rewinding room state is destructive and must be confirmed by setting confirm_room_id to the room ID",
+		}
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"room_id":         req.RoomID,
+		"target_event_id": req.TargetEventID,
+	}).Warn("AUDIT: Rewinding room state")
+
+	rewind, err := r.Inputer.RewindRoomState(ctx, req.RoomID, req.TargetEventID)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"room_id":         req.RoomID,
+			"target_event_id": req.TargetEventID,
+		}).Error("AUDIT: Failed to rewind room state")
+		res.Error = &api.PerformError{
+			Msg: err.Error(),
+		}
+		return
+	}
+	res.Rewind = rewind
+}
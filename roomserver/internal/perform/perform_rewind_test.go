@@ -0,0 +1,59 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+func TestPerformRewindRoomStateRequiresConfirmation(t *testing.T) {
+	// No Inputer is set, so this will panic if the request gets as far as
+	// actually rewinding anything.
+	r := &RoomRewinder{}
+
+	tests := []struct {
+		name string
+		req  api.PerformRewindRoomStateRequest
+	}{
+		{"missing target", api.PerformRewindRoomStateRequest{
+			RoomID:        "!test:localhost",
+			ConfirmRoomID: "!test:localhost",
+		}},
+		{"missing confirmation", api.PerformRewindRoomStateRequest{
+			RoomID:        "!test:localhost",
+			TargetEventID: "$target:localhost",
+		}},
+		{"wrong confirmation", api.PerformRewindRoomStateRequest{
+			RoomID:        "!test:localhost",
+			TargetEventID: "$target:localhost",
+			ConfirmRoomID: "!other:localhost",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res api.PerformRewindRoomStateResponse
+			r.PerformRewindRoomState(context.Background(), &tt.req, &res)
+			if res.Error == nil || res.Error.Code != api.PerformErrorBadRequest {
+				t.Fatalf("expected a bad request error, got %+v", res.Error)
+			}
+			if res.Rewind != nil {
+				t.Fatalf("expected no rewind to happen")
+			}
+		})
+	}
+}
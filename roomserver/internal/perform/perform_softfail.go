@@ -0,0 +1,54 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/sirupsen/logrus"
+)
+
+type SoftFailReevaluator struct {
+	Inputer *input.Inputer
+}
+
+// PerformReevaluateSoftFailedEvents implements api.RoomserverInternalAPI
+func (r *SoftFailReevaluator) PerformReevaluateSoftFailedEvents(
+	ctx context.Context,
+	req *api.PerformReevaluateSoftFailedEventsRequest,
+	res *api.PerformReevaluateSoftFailedEventsResponse,
+) {
+	if req.RoomID == "" {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "room ID must be specified",
+		}
+		return
+	}
+	accepted, err := r.Inputer.ReevaluateSoftFailedEvents(ctx, req.RoomID)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: err.Error(),
+		}
+		return
+	}
+	res.Accepted = accepted
+	logrus.WithFields(logrus.Fields{
+		"room_id":  req.RoomID,
+		"accepted": accepted,
+	}).Info("Re-evaluated soft-failed events")
+}
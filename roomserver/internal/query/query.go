@@ -16,21 +16,29 @@ package query
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 type Queryer struct {
@@ -79,6 +87,21 @@ func (r *Queryer) QueryStateAfterEvents(
 	}
 	response.PrevEventsExist = true
 
+	// The state at each previous event doesn't include its event ID, so look
+	// them up in order to say which of the previous events were rejected.
+	prevEventNIDs := make([]types.EventNID, 0, len(prevStates))
+	for _, prevState := range prevStates {
+		prevEventNIDs = append(prevEventNIDs, prevState.EventNID)
+	}
+	prevEventIDs, err := r.DB.EventIDs(ctx, prevEventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventIDs: %w", err)
+	}
+	response.Rejected = make(map[string]bool, len(prevStates))
+	for _, prevState := range prevStates {
+		response.Rejected[prevEventIDs[prevState.EventNID]] = prevState.IsRejected
+	}
+
 	var stateEntries []types.StateEntry
 	if len(request.StateToFetch) == 0 {
 		// Look up all of the current room state.
@@ -756,3 +779,1110 @@ func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainReq
 	res.AuthChain = hchain
 	return nil
 }
+
+func (r *Queryer) QueryStateSnapshotDiff(ctx context.Context, req *api.QueryStateSnapshotDiffRequest, res *api.QueryStateSnapshotDiffResponse) error {
+	roomState := state.NewStateResolution(r.DB, nil)
+	removed, added, err := roomState.DifferenceBetweeenStateSnapshots(ctx, req.OldStateSnapshotNID, req.NewStateSnapshotNID)
+	if err != nil {
+		return fmt.Errorf("roomState.DifferenceBetweeenStateSnapshots: %w", err)
+	}
+
+	eventNIDs := make([]types.EventNID, 0, len(removed)+len(added))
+	for _, entry := range removed {
+		eventNIDs = append(eventNIDs, entry.EventNID)
+	}
+	for _, entry := range added {
+		eventNIDs = append(eventNIDs, entry.EventNID)
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.Events: %w", err)
+	}
+	eventsByNID := make(map[types.EventNID]*gomatrixserverlib.HeaderedEvent, len(events))
+	for _, event := range events {
+		eventsByNID[event.EventNID] = event.Headered(event.Version())
+	}
+
+	// A state key which was removed from the old snapshot and added to
+	// the new snapshot has been changed rather than removed outright.
+	removedByTuple := make(map[types.StateKeyTuple]types.StateEntry, len(removed))
+	for _, entry := range removed {
+		removedByTuple[entry.StateKeyTuple] = entry
+	}
+	for _, entry := range added {
+		if old, ok := removedByTuple[entry.StateKeyTuple]; ok {
+			res.Changed = append(res.Changed, api.StateSnapshotChange{
+				Old: eventsByNID[old.EventNID],
+				New: eventsByNID[entry.EventNID],
+			})
+			delete(removedByTuple, entry.StateKeyTuple)
+			continue
+		}
+		res.Added = append(res.Added, eventsByNID[entry.EventNID])
+	}
+	for _, entry := range removed {
+		if _, ok := removedByTuple[entry.StateKeyTuple]; ok {
+			res.Removed = append(res.Removed, eventsByNID[entry.EventNID])
+		}
+	}
+	return nil
+}
+
+func (r *Queryer) QueryInviteInfo(ctx context.Context, req *api.QueryInviteInfoRequest, res *api.QueryInviteInfoResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil {
+		return nil
+	}
+	targetUserNIDs, err := r.DB.EventStateKeyNIDs(ctx, []string{req.UserID})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventStateKeyNIDs: %w", err)
+	}
+	targetUserNID, ok := targetUserNIDs[req.UserID]
+	if !ok {
+		return nil
+	}
+	_, eventIDs, err := r.DB.GetInvitesForUser(ctx, info.RoomNID, targetUserNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetInvitesForUser: %w", err)
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	// The invites are ordered oldest first, so use the most recent one.
+	inviteJSON, err := r.DB.GetInviteEventJSON(ctx, eventIDs[len(eventIDs)-1])
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("r.DB.GetInviteEventJSON: %w", err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(inviteJSON, false, info.RoomVersion)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.NewEventFromTrustedJSON: %w", err)
+	}
+	res.InviteExists = true
+	res.Event = event.Headered(info.RoomVersion)
+	if inviteState := gjson.GetBytes(event.Unsigned(), "invite_room_state"); inviteState.IsArray() {
+		if err = json.Unmarshal([]byte(inviteState.Raw), &res.InviteRoomState); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *Queryer) QueryJoinedUsersInRoom(ctx context.Context, req *api.QueryJoinedUsersInRoomRequest, res *api.QueryJoinedUsersInRoomResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	// The membership table tracks the current state of the room, so
+	// this won't include users who have since left.
+	joined, err := r.DB.JoinedUsersSetInRooms(ctx, []string{req.RoomID})
+	if err != nil {
+		return fmt.Errorf("r.DB.JoinedUsersSetInRooms: %w", err)
+	}
+	res.UserIDs = make([]string, 0, len(joined))
+	for userID := range joined {
+		res.UserIDs = append(res.UserIDs, userID)
+	}
+	sort.Strings(res.UserIDs)
+	return nil
+}
+
+// defaultBackfillCandidatesWalkLimit is how many known events QueryBackfillCandidates
+// will walk through looking for gaps if the request doesn't say otherwise.
+const defaultBackfillCandidatesWalkLimit = 1000
+
+func (r *Queryer) QueryBackfillCandidates(ctx context.Context, req *api.QueryBackfillCandidatesRequest, res *api.QueryBackfillCandidatesResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	latestEvents, _, _, err := r.DB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	extremities := make([]string, 0, len(latestEvents))
+	for _, ref := range latestEvents {
+		extremities = append(extremities, ref.EventID)
+	}
+	walkLimit := req.WalkLimit
+	if walkLimit <= 0 {
+		walkLimit = defaultBackfillCandidatesWalkLimit
+	}
+	res.Candidates, err = findBackfillCandidates(ctx, r.DB.EventsFromIDs, extremities, walkLimit)
+	if err != nil {
+		return fmt.Errorf("findBackfillCandidates: %w", err)
+	}
+	SortBackfillCandidates(res.Candidates)
+	if req.Limit > 0 && len(res.Candidates) > req.Limit {
+		res.Candidates = res.Candidates[:req.Limit]
+	}
+	return nil
+}
+
+// findBackfillCandidates walks backwards through prev_events from the given
+// forward extremities, one hop at a time, and returns the events that are
+// referenced but which we don't have. The walk stops once walkLimit known
+// events have been visited, or when there is nothing left to walk. Since the
+// walk is breadth-first, the distance recorded for each candidate is the
+// shortest number of hops from any of the forward extremities.
+func findBackfillCandidates(
+	ctx context.Context, fn eventsFromIDs, extremities []string, walkLimit int,
+) ([]api.BackfillCandidate, error) {
+	referenced := make(map[string]*api.BackfillCandidate, len(extremities))
+	frontier := make([]string, 0, len(extremities))
+	for _, eventID := range extremities {
+		if _, ok := referenced[eventID]; ok {
+			continue
+		}
+		referenced[eventID] = &api.BackfillCandidate{EventID: eventID}
+		frontier = append(frontier, eventID)
+	}
+
+	var missing []*api.BackfillCandidate
+	walked := 0
+	for distance := 0; len(frontier) > 0 && walked < walkLimit; distance++ {
+		events, err := fn(ctx, frontier)
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]struct{}, len(events))
+		var next []string
+		for _, event := range events {
+			if event.Event == nil {
+				continue
+			}
+			found[event.EventID()] = struct{}{}
+			walked++
+			for _, prevEventID := range event.PrevEventIDs() {
+				candidate, ok := referenced[prevEventID]
+				if !ok {
+					candidate = &api.BackfillCandidate{
+						EventID:  prevEventID,
+						Distance: distance + 1,
+					}
+					referenced[prevEventID] = candidate
+					next = append(next, prevEventID)
+				}
+				candidate.ReferenceCount++
+				if depth := event.Depth(); depth > candidate.ReferencedAtDepth {
+					candidate.ReferencedAtDepth = depth
+				}
+			}
+		}
+		for _, eventID := range frontier {
+			if _, ok := found[eventID]; !ok {
+				missing = append(missing, referenced[eventID])
+			}
+		}
+		frontier = next
+	}
+
+	// Reference counts and depths can still be updated after an event has been
+	// found to be missing, so only copy them out once the walk is done.
+	candidates := make([]api.BackfillCandidate, 0, len(missing))
+	for _, candidate := range missing {
+		candidates = append(candidates, *candidate)
+	}
+	return candidates, nil
+}
+
+// SortBackfillCandidates ranks missing events so that the ones most likely to
+// be seen by clients come first:
+//  1. Events closer to the forward extremities of the room, i.e. with a
+//     lower Distance, are ranked first, as gaps near the tip of the room are
+//     the ones that clients viewing the room will run into.
+//  2. Among events at the same distance, more recent events, i.e. with a
+//     higher ReferencedAtDepth, are ranked first.
+//  3. Then events referenced by more known events, as filling them in
+//     connects more of the DAG.
+//  4. Finally, ties are broken by event ID so that the order is stable.
+func SortBackfillCandidates(candidates []api.BackfillCandidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if a.ReferencedAtDepth != b.ReferencedAtDepth {
+			return a.ReferencedAtDepth > b.ReferencedAtDepth
+		}
+		if a.ReferenceCount != b.ReferenceCount {
+			return a.ReferenceCount > b.ReferenceCount
+		}
+		return a.EventID < b.EventID
+	})
+}
+
+func (r *Queryer) QueryRoomsInMaintenance(ctx context.Context, req *api.QueryRoomsInMaintenanceRequest, res *api.QueryRoomsInMaintenanceResponse) error {
+	roomIDs, err := r.DB.GetRoomsInMaintenance(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetRoomsInMaintenance: %w", err)
+	}
+	sort.Strings(roomIDs)
+	res.RoomIDs = roomIDs
+	return nil
+}
+
+func (r *Queryer) QueryStateRewinds(ctx context.Context, req *api.QueryStateRewindsRequest, res *api.QueryStateRewindsResponse) error {
+	rewinds, err := r.DB.GetStateRewinds(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateRewinds: %w", err)
+	}
+	res.Rewinds = rewinds
+	return nil
+}
+
+func (r *Queryer) QueryHasLocalJoinedUsers(ctx context.Context, req *api.QueryHasLocalJoinedUsersRequest, res *api.QueryHasLocalJoinedUsersResponse) error {
+	countRes := &api.QueryLocalJoinedCountResponse{}
+	if err := r.QueryLocalJoinedCount(ctx, &api.QueryLocalJoinedCountRequest{RoomID: req.RoomID}, countRes); err != nil {
+		return err
+	}
+	res.RoomExists = countRes.RoomExists
+	res.HasLocalJoinedUsers = countRes.Count > 0
+	return nil
+}
+
+func (r *Queryer) QueryLocalJoinedCount(ctx context.Context, req *api.QueryLocalJoinedCountRequest, res *api.QueryLocalJoinedCountResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	res.Count, err = r.DB.GetLocalJoinedCount(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetLocalJoinedCount: %w", err)
+	}
+	return nil
+}
+
+func (r *Queryer) QueryEventSignatures(ctx context.Context, req *api.QueryEventSignaturesRequest, res *api.QueryEventSignaturesResponse) error {
+	events, err := r.DB.EventsFromIDs(ctx, []string{req.EventID})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	if len(events) == 0 || events[0].Event == nil {
+		return nil
+	}
+	res.EventExists = true
+	res.Signatures, err = eventSignatures(events[0].JSON())
+	if err != nil {
+		return fmt.Errorf("eventSignatures: %w", err)
+	}
+	return nil
+}
+
+// eventSignatures lists the signatures present in the event JSON, sorted by
+// server name and then key ID.
+func eventSignatures(eventJSON []byte) ([]api.EventSignature, error) {
+	var event struct {
+		Signatures map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal(eventJSON, &event); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	signatures := []api.EventSignature{}
+	for serverName, keys := range event.Signatures {
+		for keyID := range keys {
+			signatures = append(signatures, api.EventSignature{
+				ServerName: serverName,
+				KeyID:      keyID,
+			})
+		}
+	}
+	sort.Slice(signatures, func(i, j int) bool {
+		if signatures[i].ServerName != signatures[j].ServerName {
+			return signatures[i].ServerName < signatures[j].ServerName
+		}
+		return signatures[i].KeyID < signatures[j].KeyID
+	})
+	return signatures, nil
+}
+
+func (r *Queryer) QueryRoomCreator(ctx context.Context, req *api.QueryRoomCreatorRequest, res *api.QueryRoomCreatorResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	createEvent, err := r.DB.GetStateEvent(ctx, req.RoomID, gomatrixserverlib.MRoomCreate, "")
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if createEvent == nil {
+		return fmt.Errorf("room %s has no create event", req.RoomID)
+	}
+	res.RoomExists = true
+	res.Creator, err = version.RoomCreator(createEvent)
+	if err != nil {
+		return fmt.Errorf("version.RoomCreator: %w", err)
+	}
+	return nil
+}
+
+// QueryEventDepths implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventDepths(ctx context.Context, req *api.QueryEventDepthsRequest, res *api.QueryEventDepthsResponse) error {
+	if len(req.EventIDs) == 0 {
+		res.Depths = map[string]int64{}
+		return nil
+	}
+	depths, err := r.DB.EventDepths(ctx, req.EventIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventDepths: %w", err)
+	}
+	res.Depths = depths
+	return nil
+}
+
+// The session rotation defaults from the spec for m.room.encryption.
+const (
+	defaultRotationPeriodMs   = 604800000 // one week
+	defaultRotationPeriodMsgs = 100
+)
+
+// QueryRoomEncryption implements api.RoomserverInternalAPI
+func (r *Queryer) QueryRoomEncryption(ctx context.Context, req *api.QueryRoomEncryptionRequest, res *api.QueryRoomEncryptionResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	encryptionEvent, err := r.DB.GetStateEvent(ctx, req.RoomID, "m.room.encryption", "")
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if encryptionEvent == nil {
+		return nil
+	}
+	var content struct {
+		Algorithm          string `json:"algorithm"`
+		RotationPeriodMs   int64  `json:"rotation_period_ms"`
+		RotationPeriodMsgs int64  `json:"rotation_period_msgs"`
+	}
+	if err = json.Unmarshal(encryptionEvent.Content(), &content); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	res.Encrypted = true
+	res.Algorithm = content.Algorithm
+	res.RotationPeriodMs = content.RotationPeriodMs
+	if res.RotationPeriodMs <= 0 {
+		res.RotationPeriodMs = defaultRotationPeriodMs
+	}
+	res.RotationPeriodMsgs = content.RotationPeriodMsgs
+	if res.RotationPeriodMsgs <= 0 {
+		res.RotationPeriodMsgs = defaultRotationPeriodMsgs
+	}
+	return nil
+}
+
+// purgeCandidate is what we know about a room when deciding whether it
+// could be purged.
+type purgeCandidate struct {
+	localJoined         int
+	localInvited        int
+	lastLocalMembership gomatrixserverlib.Timestamp // zero if there never was one
+	lastEvent           gomatrixserverlib.Timestamp
+}
+
+// eligibleForPurge returns true if nothing in the room would be missed by
+// any local user if it were purged.
+func (c purgeCandidate) eligibleForPurge(req *api.QueryPurgeCandidateRoomsRequest) bool {
+	switch {
+	case c.localJoined > 0:
+		return false
+	case c.localInvited > 0:
+		// A local user might still accept the invite.
+		return false
+	case c.lastLocalMembership >= req.NoLocalMembersSince:
+		return false
+	case c.lastEvent >= req.InactiveSince:
+		return false
+	}
+	return true
+}
+
+// QueryPurgeCandidateRooms implements api.RoomserverInternalAPI
+func (r *Queryer) QueryPurgeCandidateRooms(ctx context.Context, req *api.QueryPurgeCandidateRoomsRequest, res *api.QueryPurgeCandidateRoomsResponse) error {
+	roomIDs, err := r.DB.GetKnownRooms(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetKnownRooms: %w", err)
+	}
+	res.RoomIDs = []string{}
+	for _, roomID := range roomIDs {
+		info, err := r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			return fmt.Errorf("r.DB.RoomInfo: %w", err)
+		}
+		if info == nil || info.IsStub {
+			continue
+		}
+		candidate, err := r.purgeCandidate(ctx, info)
+		if err != nil {
+			return fmt.Errorf("r.purgeCandidate: %w", err)
+		}
+		if candidate.eligibleForPurge(req) {
+			res.RoomIDs = append(res.RoomIDs, roomID)
+		}
+	}
+	return nil
+}
+
+func (r *Queryer) purgeCandidate(ctx context.Context, info *types.RoomInfo) (c purgeCandidate, err error) {
+	if c.localJoined, err = r.DB.GetLocalJoinedCount(ctx, info.RoomNID); err != nil {
+		return c, fmt.Errorf("r.DB.GetLocalJoinedCount: %w", err)
+	}
+	if c.localInvited, err = r.DB.GetLocalInvitedCount(ctx, info.RoomNID); err != nil {
+		return c, fmt.Errorf("r.DB.GetLocalInvitedCount: %w", err)
+	}
+	if c.localJoined > 0 || c.localInvited > 0 {
+		// No need to look any further.
+		return c, nil
+	}
+
+	membershipNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, false, true)
+	if err != nil {
+		return c, fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	if len(membershipNIDs) > 0 {
+		memberships, err := r.DB.Events(ctx, membershipNIDs)
+		if err != nil {
+			return c, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		for _, membership := range memberships {
+			if ts := membership.OriginServerTS(); ts > c.lastLocalMembership {
+				c.lastLocalMembership = ts
+			}
+		}
+	}
+
+	latestEvents, _, _, err := r.DB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return c, fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	latestEventIDs := make([]string, 0, len(latestEvents))
+	for _, ref := range latestEvents {
+		latestEventIDs = append(latestEventIDs, ref.EventID)
+	}
+	events, err := r.DB.EventsFromIDs(ctx, latestEventIDs)
+	if err != nil {
+		return c, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	for _, event := range events {
+		if ts := event.OriginServerTS(); ts > c.lastEvent {
+			c.lastEvent = ts
+		}
+	}
+	return c, nil
+}
+
+const (
+	defaultEventForwardGraphLimit = 100
+	maxEventForwardGraphLimit     = 1000
+)
+
+// QueryEventForwardGraph implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventForwardGraph(ctx context.Context, req *api.QueryEventForwardGraphRequest, res *api.QueryEventForwardGraphResponse) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultEventForwardGraphLimit
+	} else if limit > maxEventForwardGraphLimit {
+		limit = maxEventForwardGraphLimit
+	}
+	var after types.EventNID
+	if req.After != "" {
+		cursor, err := strconv.ParseInt(req.After, 10, 64)
+		if err != nil || cursor < 0 {
+			return fmt.Errorf("invalid cursor %q", req.After)
+		}
+		after = types.EventNID(cursor)
+	}
+
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	res.Events = []api.EventGraphEntry{}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+
+	eventNIDs, err := r.DB.RoomEventNIDsAfter(ctx, info.RoomNID, after, limit)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomEventNIDsAfter: %w", err)
+	}
+	if len(eventNIDs) == 0 {
+		return nil
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.Events: %w", err)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventNID < events[j].EventNID
+	})
+	for _, event := range events {
+		res.Events = append(res.Events, api.EventGraphEntry{
+			EventID:      event.EventID(),
+			PrevEventIDs: event.PrevEventIDs(),
+			AuthEventIDs: event.AuthEventIDs(),
+		})
+	}
+	if len(eventNIDs) == limit {
+		res.Next = strconv.FormatInt(int64(eventNIDs[len(eventNIDs)-1]), 10)
+	}
+	return nil
+}
+
+// QueryUserCapability implements api.RoomserverInternalAPI. The answer comes
+// from authing a hypothetical event against the current state of the room,
+// so the same rules apply as for real events.
+func (r *Queryer) QueryUserCapability(ctx context.Context, req *api.QueryUserCapabilityRequest, res *api.QueryUserCapabilityResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+
+	event, err := r.capabilityEvent(ctx, req, info.RoomVersion)
+	if err != nil {
+		return err
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for _, tuple := range gomatrixserverlib.StateNeededForAuth([]*gomatrixserverlib.Event{event}).Tuples() {
+		stateEvent, serr := r.DB.GetStateEvent(ctx, req.RoomID, tuple.EventType, tuple.StateKey)
+		if serr != nil {
+			return fmt.Errorf("r.DB.GetStateEvent: %w", serr)
+		}
+		if stateEvent == nil {
+			continue
+		}
+		if err = authEvents.AddEvent(stateEvent.Unwrap()); err != nil {
+			return fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+	}
+	if err = gomatrixserverlib.Allowed(event, &authEvents); err != nil {
+		var notAllowed *gomatrixserverlib.NotAllowed
+		if !errors.As(err, &notAllowed) {
+			return fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+		}
+		res.Reason = notAllowed.Message
+		return nil
+	}
+
+	// In newer room versions, redactions are accepted into the room after
+	// only the basic checks above, and whether the sender can redact the
+	// event is decided when the redaction is applied instead. Check the
+	// redact power level here so that the answer is the same for all room
+	// versions.
+	if req.Action == api.CapabilityRedact {
+		create, cerr := gomatrixserverlib.NewCreateContentFromAuthEvents(&authEvents)
+		if cerr != nil {
+			return fmt.Errorf("gomatrixserverlib.NewCreateContentFromAuthEvents: %w", cerr)
+		}
+		powerLevels, perr := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, create.Creator)
+		if perr != nil {
+			return fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromAuthEvents: %w", perr)
+		}
+		if level := powerLevels.UserLevel(req.UserID); level < powerLevels.Redact {
+			res.Reason = fmt.Sprintf("%q is not allowed to redact events sent by other users. %d < %d", req.UserID, level, powerLevels.Redact)
+			return nil
+		}
+	}
+	res.Allowed = true
+	return nil
+}
+
+// capabilityEvent builds the hypothetical event that the user would need to
+// send to perform the requested action. It is never signed or stored.
+func (r *Queryer) capabilityEvent(
+	ctx context.Context, req *api.QueryUserCapabilityRequest, roomVersion gomatrixserverlib.RoomVersion,
+) (*gomatrixserverlib.Event, error) {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID %q: %w", req.UserID, err)
+	}
+	fields := map[string]interface{}{
+		"event_id":         "$capability-check:" + string(domain),
+		"room_id":          req.RoomID,
+		"sender":           req.UserID,
+		"origin_server_ts": gomatrixserverlib.AsTimestamp(time.Now()),
+		"depth":            1,
+		"prev_events":      []interface{}{},
+		"auth_events":      []interface{}{},
+		"content":          map[string]interface{}{},
+	}
+	target := req.TargetUserID
+	if target == "" {
+		target = "@capability-check:" + string(domain)
+	}
+	membership := func(membership string) {
+		fields["type"] = gomatrixserverlib.MRoomMember
+		fields["state_key"] = target
+		fields["content"] = map[string]interface{}{"membership": membership}
+	}
+
+	switch req.Action {
+	case api.CapabilitySendMessage, api.CapabilitySendState:
+		switch req.EventType {
+		case "":
+			return nil, fmt.Errorf("no event type given for %q", req.Action)
+		case gomatrixserverlib.MRoomMember:
+			return nil, fmt.Errorf("membership events must be checked with the invite, kick or ban actions")
+		}
+		fields["type"] = req.EventType
+		if req.Action == api.CapabilitySendState {
+			fields["state_key"] = req.StateKey
+		}
+		if req.EventType == gomatrixserverlib.MRoomPowerLevels {
+			// Don't ask for any changes to the power levels, so that only
+			// whether the user can send the event at all is checked.
+			current, perr := r.DB.GetStateEvent(ctx, req.RoomID, gomatrixserverlib.MRoomPowerLevels, "")
+			if perr != nil {
+				return nil, fmt.Errorf("r.DB.GetStateEvent: %w", perr)
+			}
+			if current != nil {
+				fields["content"] = json.RawMessage(current.Content())
+			}
+		}
+	case api.CapabilityInvite:
+		membership(gomatrixserverlib.Invite)
+	case api.CapabilityKick:
+		membership(gomatrixserverlib.Leave)
+	case api.CapabilityBan:
+		membership(gomatrixserverlib.Ban)
+	case api.CapabilityRedact:
+		fields["type"] = gomatrixserverlib.MRoomRedaction
+		fields["redacts"] = "$capability-check-target:" + string(domain)
+	default:
+		return nil, fmt.Errorf("unknown action %q", req.Action)
+	}
+
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, roomVersion)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.NewEventFromTrustedJSON: %w", err)
+	}
+	return event, nil
+}
+
+const (
+	defaultMostRecentEventsLimit = 20
+	maxMostRecentEventsLimit     = 100
+	// How many events we'll look at for each event that was asked for,
+	// to bound the work done if many recent events are soft-failed.
+	mostRecentEventsScanFactor = 10
+)
+
+// QueryMostRecentEvents implements api.RoomserverInternalAPI. The events are
+// found by walking backwards from the forward extremities of the room, newest
+// first. Rather than checking the history visibility at every event, the walk
+// only happens if the room is currently world-readable, and it stops at the
+// most recent change to the history visibility, since the events before that
+// may not have been world-readable.
+func (r *Queryer) QueryMostRecentEvents(ctx context.Context, req *api.QueryMostRecentEventsRequest, res *api.QueryMostRecentEventsResponse) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultMostRecentEventsLimit
+	} else if limit > maxMostRecentEventsLimit {
+		limit = maxMostRecentEventsLimit
+	}
+
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	res.Events = []*gomatrixserverlib.HeaderedEvent{}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+
+	visibilityEvent, err := r.DB.GetStateEvent(ctx, req.RoomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if visibilityEvent == nil || auth.HistoryVisibilityForRoom([]*gomatrixserverlib.Event{visibilityEvent.Unwrap()}) != "world_readable" {
+		return nil
+	}
+	res.WorldReadable = true
+
+	latest, _, _, err := r.DB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	visited := map[string]struct{}{}
+	var queue []types.Event
+	enqueue := func(eventIDs []string) error {
+		unseen := make([]string, 0, len(eventIDs))
+		for _, eventID := range eventIDs {
+			if _, ok := visited[eventID]; !ok {
+				visited[eventID] = struct{}{}
+				unseen = append(unseen, eventID)
+			}
+		}
+		if len(unseen) == 0 {
+			return nil
+		}
+		events, eerr := r.DB.EventsFromIDs(ctx, unseen)
+		if eerr != nil {
+			return fmt.Errorf("r.DB.EventsFromIDs: %w", eerr)
+		}
+		queue = append(queue, events...)
+		return nil
+	}
+	latestIDs := make([]string, 0, len(latest))
+	for _, ref := range latest {
+		latestIDs = append(latestIDs, ref.EventID)
+	}
+	if err = enqueue(latestIDs); err != nil {
+		return err
+	}
+
+	for scanned := 0; len(queue) > 0 && len(res.Events) < limit && scanned < limit*mostRecentEventsScanFactor; scanned++ {
+		// Always take the newest event that we haven't looked at yet.
+		sort.Slice(queue, func(i, j int) bool {
+			if queue[i].Depth() != queue[j].Depth() {
+				return queue[i].Depth() > queue[j].Depth()
+			}
+			return queue[i].EventNID > queue[j].EventNID
+		})
+		event := queue[0]
+		queue = queue[1:]
+
+		// Only events which were sent to the output stream were accepted
+		// into the room, which excludes soft-failed and rejected events.
+		accepted, serr := r.DB.EventSentToOutput(ctx, event.EventNID)
+		if serr != nil {
+			return fmt.Errorf("r.DB.EventSentToOutput: %w", serr)
+		}
+		if !accepted {
+			if err = enqueue(event.PrevEventIDs()); err != nil {
+				return err
+			}
+			continue
+		}
+		res.Events = append(res.Events, event.Headered(info.RoomVersion))
+		if event.Type() == gomatrixserverlib.MRoomHistoryVisibility && event.StateKeyEquals("") {
+			continue
+		}
+		if err = enqueue(event.PrevEventIDs()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryEventsRedactedBy returns what a redaction event redacted, or will redact once its target arrives.
+func (r *Queryer) QueryEventsRedactedBy(ctx context.Context, req *api.QueryEventsRedactedByRequest, res *api.QueryEventsRedactedByResponse) error {
+	info, err := r.DB.RedactionInfo(ctx, req.RedactionEventID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RedactionInfo: %w", err)
+	}
+	if info == nil {
+		return nil
+	}
+	res.RedactionExists = true
+	res.Redaction, err = r.describeRedaction(ctx, info)
+	return err
+}
+
+// QueryRedactionsByUser returns all of the redactions that a user sent in a room.
+func (r *Queryer) QueryRedactionsByUser(ctx context.Context, req *api.QueryRedactionsByUserRequest, res *api.QueryRedactionsByUserResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	res.Redactions = []api.Redaction{}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+
+	eventNIDs, err := r.DB.RoomEventNIDsOfType(ctx, info.RoomNID, types.MRoomRedactionNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomEventNIDsOfType: %w", err)
+	}
+	if len(eventNIDs) == 0 {
+		return nil
+	}
+	// The sender survives redaction, so it doesn't matter if any of the
+	// redaction events have been redacted themselves.
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.Events: %w", err)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventNID < events[j].EventNID
+	})
+	for _, event := range events {
+		if event.Sender() != req.UserID || event.StateKey() != nil {
+			continue
+		}
+		redactionInfo, rerr := r.DB.RedactionInfo(ctx, event.EventID())
+		if rerr != nil {
+			return fmt.Errorf("r.DB.RedactionInfo: %w", rerr)
+		}
+		if redactionInfo == nil {
+			// Redactions which redact themselves are ignored entirely.
+			continue
+		}
+		redaction, derr := r.describeRedaction(ctx, redactionInfo)
+		if derr != nil {
+			return derr
+		}
+		res.Redactions = append(res.Redactions, *redaction)
+	}
+	return nil
+}
+
+// describeRedaction loads both sides of a redaction and works out whether the
+// redaction has been applied.
+func (r *Queryer) describeRedaction(ctx context.Context, info *tables.RedactionInfo) (*api.Redaction, error) {
+	redaction := &api.Redaction{
+		RedactionEventID: info.RedactionEventID,
+		RedactsEventID:   info.RedactsEventID,
+	}
+	events, err := r.DB.EventsFromIDs(ctx, []string{info.RedactionEventID, info.RedactsEventID})
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	for _, event := range events {
+		switch event.EventID() {
+		case info.RedactionEventID:
+			redaction.RedactionEvent = event.Headered(event.Version())
+		case info.RedactsEventID:
+			redaction.TargetEvent = event.Headered(event.Version())
+		}
+	}
+	switch {
+	case info.Validated:
+		redaction.State = api.RedactionApplied
+	case redaction.TargetEvent == nil:
+		redaction.State = api.RedactionPending
+	default:
+		redaction.State = api.RedactionNotApplied
+	}
+	return redaction, nil
+}
+
+const (
+	defaultServerKeysMaxEvents = 10000
+	maxServerKeysMaxEvents     = 100000
+	// How many events to load from the database at a time.
+	serverKeysChunkSize = 500
+)
+
+// QueryServerKeysUsedForRoom returns the distinct server signing keys which signed the events stored for a room.
+// Signatures survive redaction, so redacted events are included too.
+func (r *Queryer) QueryServerKeysUsedForRoom(ctx context.Context, req *api.QueryServerKeysUsedForRoomRequest, res *api.QueryServerKeysUsedForRoomResponse) error {
+	maxEvents := req.MaxEvents
+	if maxEvents <= 0 {
+		maxEvents = defaultServerKeysMaxEvents
+	} else if maxEvents > maxServerKeysMaxEvents {
+		maxEvents = maxServerKeysMaxEvents
+	}
+
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	res.Keys = []api.ServerKeyUsage{}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+
+	type serverKey struct {
+		serverName gomatrixserverlib.ServerName
+		keyID      gomatrixserverlib.KeyID
+	}
+	counts := map[serverKey]int{}
+	var after types.EventNID
+	for res.EventsScanned < maxEvents {
+		limit := serverKeysChunkSize
+		if remaining := maxEvents - res.EventsScanned; remaining < limit {
+			limit = remaining
+		}
+		eventNIDs, nerr := r.DB.RoomEventNIDsAfter(ctx, info.RoomNID, after, limit)
+		if nerr != nil {
+			return fmt.Errorf("r.DB.RoomEventNIDsAfter: %w", nerr)
+		}
+		if len(eventNIDs) == 0 {
+			break
+		}
+		events, eerr := r.DB.Events(ctx, eventNIDs)
+		if eerr != nil {
+			return fmt.Errorf("r.DB.Events: %w", eerr)
+		}
+		for _, event := range events {
+			gjson.GetBytes(event.JSON(), "signatures").ForEach(func(serverName, keys gjson.Result) bool {
+				keys.ForEach(func(keyID, _ gjson.Result) bool {
+					counts[serverKey{gomatrixserverlib.ServerName(serverName.Str), gomatrixserverlib.KeyID(keyID.Str)}]++
+					return true
+				})
+				return true
+			})
+		}
+		res.EventsScanned += len(eventNIDs)
+		after = eventNIDs[len(eventNIDs)-1]
+	}
+	if res.EventsScanned == maxEvents {
+		more, err := r.DB.RoomEventNIDsAfter(ctx, info.RoomNID, after, 1)
+		if err != nil {
+			return fmt.Errorf("r.DB.RoomEventNIDsAfter: %w", err)
+		}
+		res.Truncated = len(more) > 0
+	}
+
+	for key, count := range counts {
+		res.Keys = append(res.Keys, api.ServerKeyUsage{
+			ServerName: key.serverName,
+			KeyID:      key.keyID,
+			EventCount: count,
+		})
+	}
+	sort.Slice(res.Keys, func(i, j int) bool {
+		if res.Keys[i].ServerName != res.Keys[j].ServerName {
+			return res.Keys[i].ServerName < res.Keys[j].ServerName
+		}
+		return res.Keys[i].KeyID < res.Keys[j].KeyID
+	})
+	return nil
+}
+
+// QueryEventRejectionReason returns whether an event was rejected and why.
+func (r *Queryer) QueryEventRejectionReason(ctx context.Context, req *api.QueryEventRejectionReasonRequest, res *api.QueryEventRejectionReasonResponse) error {
+	exists, rejected, reason, err := r.DB.EventRejectionReason(ctx, req.EventID)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventRejectionReason: %w", err)
+	}
+	res.EventExists = exists
+	res.Rejected = rejected
+	res.Reason = reason
+	return nil
+}
+
+// QueryEventAuthChain implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventAuthChain(ctx context.Context, req *api.QueryEventAuthChainRequest, res *api.QueryEventAuthChainResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	events, err := r.DB.EventsFromIDs(ctx, []string{req.EventID})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	if len(events) == 0 || events[0].Event == nil || events[0].RoomID() != req.RoomID {
+		return nil
+	}
+	res.EventExists = true
+
+	// Walk the auth events of the event, and their auth events, recursively,
+	// using only what we have in the database. referencedBy remembers which
+	// event referred to each auth event, so that we can say which link in
+	// the chain is missing.
+	chain := make(map[string]*gomatrixserverlib.Event)
+	referencedBy := make(map[string]string)
+	var toFetch []string
+	queue := func(event *gomatrixserverlib.Event) {
+		for _, authEventID := range event.AuthEventIDs() {
+			if _, ok := referencedBy[authEventID]; ok {
+				continue
+			}
+			referencedBy[authEventID] = event.EventID()
+			toFetch = append(toFetch, authEventID)
+		}
+	}
+	queue(events[0].Event)
+	for len(toFetch) > 0 {
+		fetching := toFetch
+		toFetch = nil
+		fetched, ferr := r.DB.EventsFromIDs(ctx, fetching)
+		if ferr != nil {
+			return fmt.Errorf("r.DB.EventsFromIDs: %w", ferr)
+		}
+		for _, event := range fetched {
+			if event.Event != nil {
+				chain[event.EventID()] = event.Event
+			}
+		}
+		for _, eventID := range fetching {
+			event, ok := chain[eventID]
+			if !ok {
+				return fmt.Errorf("auth event %s of %s is missing from the database", eventID, referencedBy[eventID])
+			}
+			queue(event)
+		}
+	}
+
+	authEvents := make([]*gomatrixserverlib.Event, 0, len(chain))
+	for _, event := range chain {
+		authEvents = append(authEvents, event)
+	}
+	for _, event := range gomatrixserverlib.ReverseTopologicalOrdering(
+		authEvents,
+		gomatrixserverlib.TopologicalOrderByAuthEvents,
+	) {
+		res.AuthChain = append(res.AuthChain, event.Headered(info.RoomVersion))
+	}
+	return nil
+}
+
+// QueryEventProvenance implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventProvenance(ctx context.Context, req *api.QueryEventProvenanceRequest, res *api.QueryEventProvenanceResponse) error {
+	exists, serverName, receivedAt, err := r.DB.EventProvenance(ctx, req.EventID)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventProvenance: %w", err)
+	}
+	res.EventExists = exists
+	res.ServerName = serverName
+	res.ReceivedAt = receivedAt
+	return nil
+}
+
+// queryInputDeadLettersDefaultLimit is how many dead letters are returned by
+// QueryInputDeadLetters if the request doesn't say.
+const queryInputDeadLettersDefaultLimit = 100
+
+// QueryInputDeadLetters implements api.RoomserverInternalAPI
+func (r *Queryer) QueryInputDeadLetters(ctx context.Context, req *api.QueryInputDeadLettersRequest, res *api.QueryInputDeadLettersResponse) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = queryInputDeadLettersDefaultLimit
+	}
+	deadLetters, err := r.DB.GetInputDeadLetters(ctx, limit)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetInputDeadLetters: %w", err)
+	}
+	res.DeadLetters = deadLetters
+	return nil
+}
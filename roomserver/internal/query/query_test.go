@@ -16,11 +16,23 @@ package query
 
 import (
 	"context"
+	"crypto/ed25519"
+	"database/sql"
 	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -79,6 +91,38 @@ func (db *getEventDB) addFakeEvents(graph map[string][]string) error {
 	return nil
 }
 
+// Adds a fake event to the storage with the given prev events and depth.
+func (db *getEventDB) addFakeEventWithPrevEvents(eventID string, prevIDs []string, depth int64) error {
+	prevEvents := []gomatrixserverlib.EventReference{}
+	for _, prevID := range prevIDs {
+		prevEvents = append(prevEvents, gomatrixserverlib.EventReference{
+			EventID: prevID,
+		})
+	}
+
+	builder := map[string]interface{}{
+		"event_id":    eventID,
+		"prev_events": prevEvents,
+		"depth":       depth,
+	}
+
+	eventJSON, err := json.Marshal(&builder)
+	if err != nil {
+		return err
+	}
+
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(
+		eventJSON, false, gomatrixserverlib.RoomVersionV1,
+	)
+	if err != nil {
+		return err
+	}
+
+	db.eventMap[eventID] = event
+
+	return nil
+}
+
 // EventsFromIDs implements RoomserverInternalAPIEventDB
 func (db *getEventDB) EventsFromIDs(ctx context.Context, eventIDs []string) (res []types.Event, err error) {
 	for _, evID := range eventIDs {
@@ -155,3 +199,1230 @@ func TestGetAuthChainMultiple(t *testing.T) {
 		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
 	}
 }
+
+func createBackfillCandidatesDB(t *testing.T) *getEventDB {
+	db := createEventDB()
+
+	// "f" and "g" are the forward extremities. Events starting with "x" are
+	// referenced but missing from the database.
+	for _, ev := range []struct {
+		eventID string
+		prevIDs []string
+		depth   int64
+	}{
+		{"f", []string{"e", "x1", "x3"}, 6},
+		{"g", []string{"e", "x3"}, 6},
+		{"e", []string{"d", "x2"}, 5},
+		{"d", []string{"x4"}, 4},
+	} {
+		if err := db.addFakeEventWithPrevEvents(ev.eventID, ev.prevIDs, ev.depth); err != nil {
+			t.Fatalf("Failed to add event to db: %v", err)
+		}
+	}
+
+	return db
+}
+
+func TestFindBackfillCandidates(t *testing.T) {
+	db := createBackfillCandidatesDB(t)
+
+	candidates, err := findBackfillCandidates(context.TODO(), db.EventsFromIDs, []string{"f", "g"}, 100)
+	if err != nil {
+		t.Fatalf("findBackfillCandidates failed: %v", err)
+	}
+	SortBackfillCandidates(candidates)
+
+	expected := []api.BackfillCandidate{
+		{EventID: "x3", Distance: 1, ReferencedAtDepth: 6, ReferenceCount: 2},
+		{EventID: "x1", Distance: 1, ReferencedAtDepth: 6, ReferenceCount: 1},
+		{EventID: "x2", Distance: 2, ReferencedAtDepth: 5, ReferenceCount: 1},
+		{EventID: "x4", Distance: 3, ReferencedAtDepth: 4, ReferenceCount: 1},
+	}
+	if !reflect.DeepEqual(candidates, expected) {
+		t.Fatalf("candidates got '%+v', expected '%+v'", candidates, expected)
+	}
+}
+
+func TestFindBackfillCandidatesWalkLimit(t *testing.T) {
+	db := createBackfillCandidatesDB(t)
+
+	// Walking "f", "g" and then "e" should stop the walk before reaching "d",
+	// so the gaps further back in the room aren't found.
+	candidates, err := findBackfillCandidates(context.TODO(), db.EventsFromIDs, []string{"f", "g"}, 3)
+	if err != nil {
+		t.Fatalf("findBackfillCandidates failed: %v", err)
+	}
+
+	var returnedIDs []string
+	for _, candidate := range candidates {
+		returnedIDs = append(returnedIDs, candidate.EventID)
+	}
+
+	expectedIDs := []string{"x1", "x3"}
+
+	if !test.UnsortedStringSliceEqual(expectedIDs, returnedIDs) {
+		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
+	}
+}
+
+func TestSortBackfillCandidates(t *testing.T) {
+	candidates := []api.BackfillCandidate{
+		{EventID: "old", Distance: 1, ReferencedAtDepth: 2, ReferenceCount: 5},
+		{EventID: "far", Distance: 4, ReferencedAtDepth: 100, ReferenceCount: 5},
+		{EventID: "b", Distance: 1, ReferencedAtDepth: 10, ReferenceCount: 1},
+		{EventID: "a", Distance: 1, ReferencedAtDepth: 10, ReferenceCount: 1},
+		{EventID: "popular", Distance: 1, ReferencedAtDepth: 10, ReferenceCount: 3},
+		{EventID: "near", Distance: 0, ReferencedAtDepth: 0, ReferenceCount: 0},
+	}
+	SortBackfillCandidates(candidates)
+
+	var returnedIDs []string
+	for _, candidate := range candidates {
+		returnedIDs = append(returnedIDs, candidate.EventID)
+	}
+
+	expectedIDs := []string{"near", "popular", "a", "b", "old", "far"}
+
+	if !reflect.DeepEqual(expectedIDs, returnedIDs) {
+		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
+	}
+}
+
+func TestEventSignatures(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventJSON string
+		want      []api.EventSignature
+	}{
+		{"no signatures", `{"type":"m.room.message"}`, []api.EventSignature{}},
+		{"empty signatures", `{"type":"m.room.message","signatures":{}}`, []api.EventSignature{}},
+		{"multiple servers", `{"signatures":{
+			"b.com":{"ed25519:2":"sig","ed25519:1":"sig"},
+			"a.com":{"ed25519:abc":"sig"}
+		}}`, []api.EventSignature{
+			{ServerName: "a.com", KeyID: "ed25519:abc"},
+			{ServerName: "b.com", KeyID: "ed25519:1"},
+			{ServerName: "b.com", KeyID: "ed25519:2"},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := eventSignatures([]byte(tc.eventJSON))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// stateEventDB serves current state events from memory. Calling any other
+// storage.Database method will panic.
+type stateEventDB struct {
+	storage.Database
+	rooms map[string]map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent
+}
+
+func (db *stateEventDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if _, ok := db.rooms[roomID]; !ok {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (db *stateEventDB) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	return db.rooms[roomID][gomatrixserverlib.StateKeyTuple{EventType: evType, StateKey: stateKey}], nil
+}
+
+func mustCreateStateEvent(t *testing.T, eventType string, content interface{}) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"event_id":  "$" + eventType + ":localhost",
+		"room_id":   "!room:localhost",
+		"sender":    "@alice:localhost",
+		"type":      eventType,
+		"state_key": "",
+		"content":   content,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func TestQueryRoomEncryption(t *testing.T) {
+	encryptionTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.encryption", StateKey: ""}
+	db := &stateEventDB{
+		rooms: map[string]map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{
+			"!plain:localhost": {},
+			"!encrypted:localhost": {
+				encryptionTuple: mustCreateStateEvent(t, "m.room.encryption", map[string]interface{}{
+					"algorithm":          "m.megolm.v1.aes-sha2",
+					"rotation_period_ms": 3600000,
+				}),
+			},
+		},
+	}
+	r := &Queryer{DB: db}
+
+	tests := []struct {
+		roomID string
+		want   api.QueryRoomEncryptionResponse
+	}{
+		{"!unknown:localhost", api.QueryRoomEncryptionResponse{}},
+		{"!plain:localhost", api.QueryRoomEncryptionResponse{RoomExists: true}},
+		{"!encrypted:localhost", api.QueryRoomEncryptionResponse{
+			RoomExists:         true,
+			Encrypted:          true,
+			Algorithm:          "m.megolm.v1.aes-sha2",
+			RotationPeriodMs:   3600000,
+			RotationPeriodMsgs: defaultRotationPeriodMsgs,
+		}},
+	}
+	for _, tc := range tests {
+		var res api.QueryRoomEncryptionResponse
+		if err := r.QueryRoomEncryption(context.Background(), &api.QueryRoomEncryptionRequest{RoomID: tc.roomID}, &res); err != nil {
+			t.Fatalf("%s: %s", tc.roomID, err)
+		}
+		if !reflect.DeepEqual(res, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.roomID, res, tc.want)
+		}
+	}
+}
+
+func TestPurgeCandidateEligibility(t *testing.T) {
+	req := &api.QueryPurgeCandidateRoomsRequest{
+		NoLocalMembersSince: 2000,
+		InactiveSince:       3000,
+	}
+	tests := []struct {
+		name      string
+		candidate purgeCandidate
+		want      bool
+	}{
+		{"never had local members", purgeCandidate{lastEvent: 2999}, true},
+		{"local members left long ago", purgeCandidate{lastLocalMembership: 1999, lastEvent: 2500}, true},
+		{"local user joined", purgeCandidate{localJoined: 1, lastLocalMembership: 1000, lastEvent: 1000}, false},
+		{"local user invited", purgeCandidate{localInvited: 1, lastLocalMembership: 1000, lastEvent: 1000}, false},
+		{"local member left recently", purgeCandidate{lastLocalMembership: 2000, lastEvent: 2000}, false},
+		{"recent activity", purgeCandidate{lastLocalMembership: 1000, lastEvent: 3000}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.candidate.eligibleForPurge(req); got != tc.want {
+			t.Errorf("%s: got eligible %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// graphDB serves the events of a single room from memory, in NID order.
+// Calling any other storage.Database method will panic.
+type graphDB struct {
+	storage.Database
+	events []types.Event
+}
+
+func (db *graphDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != "!room:localhost" {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (db *graphDB) RoomEventNIDsAfter(ctx context.Context, roomNID types.RoomNID, after types.EventNID, limit int) (nids []types.EventNID, err error) {
+	for _, event := range db.events {
+		if event.EventNID > after && len(nids) < limit {
+			nids = append(nids, event.EventNID)
+		}
+	}
+	return
+}
+
+func (db *graphDB) Events(ctx context.Context, eventNIDs []types.EventNID) (res []types.Event, err error) {
+	// Return the events in reverse order to make sure that the caller sorts them.
+	for i := len(eventNIDs) - 1; i >= 0; i-- {
+		res = append(res, db.events[eventNIDs[i]-1])
+	}
+	return
+}
+
+func TestQueryEventForwardGraph(t *testing.T) {
+	events := createEventDB()
+	if err := events.addFakeEventWithPrevEvents("$a:localhost", nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	db := &graphDB{events: []types.Event{{EventNID: 1, Event: events.eventMap["$a:localhost"]}}}
+	prev := "$a:localhost"
+	for i, eventID := range []string{"$b:localhost", "$c:localhost", "$d:localhost", "$e:localhost"} {
+		if err := events.addFakeEventWithPrevEvents(eventID, []string{prev}, int64(i+2)); err != nil {
+			t.Fatal(err)
+		}
+		db.events = append(db.events, types.Event{EventNID: types.EventNID(i + 2), Event: events.eventMap[eventID]})
+		prev = eventID
+	}
+	r := &Queryer{DB: db}
+
+	var got []api.EventGraphEntry
+	req := &api.QueryEventForwardGraphRequest{RoomID: "!room:localhost", Limit: 2}
+	for chunks := 0; ; chunks++ {
+		if chunks > len(db.events) {
+			t.Fatalf("pagination did not terminate")
+		}
+		var res api.QueryEventForwardGraphResponse
+		if err := r.QueryEventForwardGraph(context.Background(), req, &res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.RoomExists {
+			t.Fatalf("expected room to exist")
+		}
+		got = append(got, res.Events...)
+		if res.Next == "" {
+			break
+		}
+		req.After = res.Next
+	}
+
+	want := []string{"$a:localhost", "$b:localhost", "$c:localhost", "$d:localhost", "$e:localhost"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i, entry := range got {
+		if entry.EventID != want[i] {
+			t.Errorf("event %d: got %s, want %s", i, entry.EventID, want[i])
+		}
+		if i > 0 && !reflect.DeepEqual(entry.PrevEventIDs, []string{want[i-1]}) {
+			t.Errorf("event %s: got prev events %v, want [%s]", entry.EventID, entry.PrevEventIDs, want[i-1])
+		}
+	}
+
+	var res api.QueryEventForwardGraphResponse
+	if err := r.QueryEventForwardGraph(context.Background(), &api.QueryEventForwardGraphRequest{RoomID: "!room:localhost", After: "bad"}, &res); err == nil {
+		t.Errorf("expected an error for an invalid cursor")
+	}
+}
+
+func mustCreateCapabilityRoom(t *testing.T, roomID string, powerLevels map[string]interface{}) map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	room := map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	add := func(eventType, stateKey, sender string, content interface{}) {
+		eventJSON, err := json.Marshal(map[string]interface{}{
+			"event_id":  "$" + eventType + stateKey + ":localhost",
+			"room_id":   roomID,
+			"sender":    sender,
+			"type":      eventType,
+			"state_key": stateKey,
+			"content":   content,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		room[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: stateKey}] = event.Headered(gomatrixserverlib.RoomVersionV1)
+	}
+	add("m.room.create", "", "@alice:localhost", map[string]interface{}{"creator": "@alice:localhost"})
+	add("m.room.join_rules", "", "@alice:localhost", map[string]interface{}{"join_rule": "invite"})
+	add("m.room.power_levels", "", "@alice:localhost", powerLevels)
+	for _, userID := range []string{"@alice:localhost", "@mod:localhost", "@bob:localhost"} {
+		add("m.room.member", userID, userID, map[string]interface{}{"membership": "join"})
+	}
+	return room
+}
+
+func TestQueryUserCapability(t *testing.T) {
+	db := &stateEventDB{
+		rooms: map[string]map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{
+			"!default:localhost": mustCreateCapabilityRoom(t, "!default:localhost", map[string]interface{}{
+				"users":  map[string]int64{"@alice:localhost": 100, "@mod:localhost": 50},
+				"events": map[string]int64{"m.room.power_levels": 100},
+				"invite": 0,
+			}),
+			"!strict:localhost": mustCreateCapabilityRoom(t, "!strict:localhost", map[string]interface{}{
+				"users":  map[string]int64{"@alice:localhost": 100, "@mod:localhost": 50},
+				"events": map[string]int64{"m.room.message": 50, "m.room.topic": 0},
+				"invite": 50,
+				"redact": 100,
+			}),
+		},
+	}
+	r := &Queryer{DB: db}
+
+	tests := []struct {
+		name string
+		req  api.QueryUserCapabilityRequest
+		want bool
+	}{
+		{"member can send messages", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@bob:localhost", Action: api.CapabilitySendMessage, EventType: "m.room.message"}, true},
+		{"non-member can't send messages", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@eve:localhost", Action: api.CapabilitySendMessage, EventType: "m.room.message"}, false},
+		{"member can't send state", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@bob:localhost", Action: api.CapabilitySendState, EventType: "m.room.name"}, false},
+		{"moderator can send state", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@mod:localhost", Action: api.CapabilitySendState, EventType: "m.room.name"}, true},
+		{"admin can send power levels", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@alice:localhost", Action: api.CapabilitySendState, EventType: "m.room.power_levels"}, true},
+		{"moderator can't send power levels", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@mod:localhost", Action: api.CapabilitySendState, EventType: "m.room.power_levels"}, false},
+		{"member can invite", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@bob:localhost", Action: api.CapabilityInvite}, true},
+		{"member can't kick", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@bob:localhost", Action: api.CapabilityKick}, false},
+		{"moderator can kick member", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@mod:localhost", Action: api.CapabilityKick, TargetUserID: "@bob:localhost"}, true},
+		{"moderator can't kick admin", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@mod:localhost", Action: api.CapabilityKick, TargetUserID: "@alice:localhost"}, false},
+		{"moderator can ban", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@mod:localhost", Action: api.CapabilityBan}, true},
+		{"member can't ban", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@bob:localhost", Action: api.CapabilityBan}, false},
+		{"member can't redact", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@bob:localhost", Action: api.CapabilityRedact}, false},
+		{"moderator can redact", api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@mod:localhost", Action: api.CapabilityRedact}, true},
+		{"member can't send messages in strict room", api.QueryUserCapabilityRequest{RoomID: "!strict:localhost", UserID: "@bob:localhost", Action: api.CapabilitySendMessage, EventType: "m.room.message"}, false},
+		{"member can set topic in strict room", api.QueryUserCapabilityRequest{RoomID: "!strict:localhost", UserID: "@bob:localhost", Action: api.CapabilitySendState, EventType: "m.room.topic"}, true},
+		{"member can't invite in strict room", api.QueryUserCapabilityRequest{RoomID: "!strict:localhost", UserID: "@bob:localhost", Action: api.CapabilityInvite}, false},
+		{"moderator can't redact in strict room", api.QueryUserCapabilityRequest{RoomID: "!strict:localhost", UserID: "@mod:localhost", Action: api.CapabilityRedact}, false},
+		{"admin can redact in strict room", api.QueryUserCapabilityRequest{RoomID: "!strict:localhost", UserID: "@alice:localhost", Action: api.CapabilityRedact}, true},
+	}
+	for _, tc := range tests {
+		var res api.QueryUserCapabilityResponse
+		if err := r.QueryUserCapability(context.Background(), &tc.req, &res); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if !res.RoomExists {
+			t.Fatalf("%s: expected room to exist", tc.name)
+		}
+		if res.Allowed != tc.want {
+			t.Errorf("%s: got allowed %v (%s), want %v", tc.name, res.Allowed, res.Reason, tc.want)
+		}
+		if !res.Allowed && res.Reason == "" {
+			t.Errorf("%s: expected a reason", tc.name)
+		}
+	}
+
+	var res api.QueryUserCapabilityResponse
+	if err := r.QueryUserCapability(context.Background(), &api.QueryUserCapabilityRequest{RoomID: "!unknown:localhost", UserID: "@bob:localhost", Action: api.CapabilityInvite}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.RoomExists || res.Allowed {
+		t.Errorf("expected unknown room not to exist, got %+v", res)
+	}
+	if err := r.QueryUserCapability(context.Background(), &api.QueryUserCapabilityRequest{RoomID: "!default:localhost", UserID: "@bob:localhost", Action: "fly"}, &res); err == nil {
+		t.Errorf("expected an error for an unknown action")
+	}
+}
+
+// recentEventsDB serves a single room from memory. Calling any other
+// storage.Database method will panic.
+type recentEventsDB struct {
+	storage.Database
+	events     map[string]types.Event
+	sent       map[types.EventNID]bool
+	latest     []string
+	visibility *gomatrixserverlib.HeaderedEvent
+}
+
+func (db *recentEventsDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != "!room:localhost" {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (db *recentEventsDB) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	if evType == gomatrixserverlib.MRoomHistoryVisibility && stateKey == "" {
+		return db.visibility, nil
+	}
+	return nil, nil
+}
+
+func (db *recentEventsDB) LatestEventIDs(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error) {
+	var refs []gomatrixserverlib.EventReference
+	for _, eventID := range db.latest {
+		refs = append(refs, gomatrixserverlib.EventReference{EventID: eventID})
+	}
+	return refs, 1, 0, nil
+}
+
+func (db *recentEventsDB) EventsFromIDs(ctx context.Context, eventIDs []string) (res []types.Event, err error) {
+	for _, eventID := range eventIDs {
+		if event, ok := db.events[eventID]; ok {
+			res = append(res, event)
+		}
+	}
+	return
+}
+
+func (db *recentEventsDB) EventSentToOutput(ctx context.Context, eventNID types.EventNID) (bool, error) {
+	return db.sent[eventNID], nil
+}
+
+// add adds an event to the room, with the previous event added as its prev event.
+func (db *recentEventsDB) add(t *testing.T, eventID, eventType string, stateKey *string, content map[string]interface{}, prevID string, sent bool) *gomatrixserverlib.Event {
+	t.Helper()
+	fields := map[string]interface{}{
+		"event_id": eventID,
+		"room_id":  "!room:localhost",
+		"sender":   "@alice:localhost",
+		"type":     eventType,
+		"content":  content,
+		"depth":    len(db.events) + 1,
+	}
+	if stateKey != nil {
+		fields["state_key"] = *stateKey
+	}
+	if prevID != "" {
+		fields["prev_events"] = []gomatrixserverlib.EventReference{{EventID: prevID}}
+	}
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nid := types.EventNID(len(db.events) + 1)
+	db.events[eventID] = types.Event{EventNID: nid, Event: event}
+	db.sent[nid] = sent
+	db.latest = []string{eventID}
+	return event
+}
+
+func TestQueryMostRecentEvents(t *testing.T) {
+	emptyStateKey := ""
+	message := map[string]interface{}{"msgtype": "m.text", "body": "hello"}
+	db := &recentEventsDB{events: map[string]types.Event{}, sent: map[types.EventNID]bool{}}
+	db.add(t, "$create:localhost", "m.room.create", &emptyStateKey, map[string]interface{}{"creator": "@alice:localhost"}, "", true)
+	db.add(t, "$old:localhost", "m.room.message", nil, message, "$create:localhost", true)
+	visibility := db.add(t, "$visibility:localhost", "m.room.history_visibility", &emptyStateKey, map[string]interface{}{"history_visibility": "world_readable"}, "$old:localhost", true)
+	redacted := db.add(t, "$redacted:localhost", "m.room.message", nil, message, "$visibility:localhost", true)
+	db.add(t, "$softfailed:localhost", "m.room.message", nil, message, "$redacted:localhost", false)
+	db.add(t, "$message:localhost", "m.room.message", nil, message, "$softfailed:localhost", true)
+	db.add(t, "$redaction:localhost", "m.room.redaction", nil, map[string]interface{}{}, "$message:localhost", true)
+	// The database returns redacted events in their redacted form.
+	redactedEvent := db.events["$redacted:localhost"]
+	redactedEvent.Event = redacted.Redact()
+	db.events["$redacted:localhost"] = redactedEvent
+	db.visibility = visibility.Headered(gomatrixserverlib.RoomVersionV1)
+	r := &Queryer{DB: db}
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{0, []string{"$redaction:localhost", "$message:localhost", "$redacted:localhost", "$visibility:localhost"}},
+		{2, []string{"$redaction:localhost", "$message:localhost"}},
+	}
+	for _, tc := range tests {
+		var res api.QueryMostRecentEventsResponse
+		if err := r.QueryMostRecentEvents(context.Background(), &api.QueryMostRecentEventsRequest{RoomID: "!room:localhost", Limit: tc.limit}, &res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.RoomExists || !res.WorldReadable {
+			t.Fatalf("limit %d: expected a world-readable room, got %+v", tc.limit, res)
+		}
+		var got []string
+		for _, event := range res.Events {
+			got = append(got, event.EventID())
+			if event.EventID() == "$redacted:localhost" && string(event.Content()) != "{}" {
+				t.Errorf("expected the redacted event to be redacted, got content %s", event.Content())
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("limit %d: got %v, want %v", tc.limit, got, tc.want)
+		}
+	}
+
+	// Nothing is returned if the room isn't world-readable.
+	shared := db.add(t, "$shared:localhost", "m.room.history_visibility", &emptyStateKey, map[string]interface{}{"history_visibility": "shared"}, "$redaction:localhost", true)
+	db.visibility = shared.Headered(gomatrixserverlib.RoomVersionV1)
+	var res api.QueryMostRecentEventsResponse
+	if err := r.QueryMostRecentEvents(context.Background(), &api.QueryMostRecentEventsRequest{RoomID: "!room:localhost"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.RoomExists || res.WorldReadable || len(res.Events) != 0 {
+		t.Errorf("expected no events from a room that isn't world-readable, got %+v", res)
+	}
+}
+
+// redactionsDB serves a single room and its redaction bookkeeping from memory.
+// Calling any other storage.Database method will panic.
+type redactionsDB struct {
+	storage.Database
+	events     map[string]types.Event
+	redactions map[string]*tables.RedactionInfo
+}
+
+func (db *redactionsDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != "!room:localhost" {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (db *redactionsDB) RoomEventNIDsOfType(ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID) (nids []types.EventNID, err error) {
+	for _, event := range db.events {
+		if eventTypeNID == types.MRoomRedactionNID && event.Type() == gomatrixserverlib.MRoomRedaction {
+			nids = append(nids, event.EventNID)
+		}
+	}
+	return
+}
+
+func (db *redactionsDB) Events(ctx context.Context, eventNIDs []types.EventNID) (res []types.Event, err error) {
+	for _, event := range db.events {
+		for _, nid := range eventNIDs {
+			if event.EventNID == nid {
+				res = append(res, event)
+			}
+		}
+	}
+	return
+}
+
+func (db *redactionsDB) EventsFromIDs(ctx context.Context, eventIDs []string) (res []types.Event, err error) {
+	for _, eventID := range eventIDs {
+		if event, ok := db.events[eventID]; ok {
+			res = append(res, event)
+		}
+	}
+	return
+}
+
+func (db *redactionsDB) RedactionInfo(ctx context.Context, redactionEventID string) (*tables.RedactionInfo, error) {
+	return db.redactions[redactionEventID], nil
+}
+
+func (db *redactionsDB) add(t *testing.T, eventID, sender, eventType, redacts string) {
+	t.Helper()
+	fields := map[string]interface{}{
+		"event_id": eventID,
+		"room_id":  "!room:localhost",
+		"sender":   sender,
+		"type":     eventType,
+		"content":  map[string]interface{}{},
+		"depth":    len(db.events) + 1,
+	}
+	if redacts != "" {
+		fields["redacts"] = redacts
+	}
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.events[eventID] = types.Event{EventNID: types.EventNID(len(db.events) + 1), Event: event}
+}
+
+func TestQueryRedactions(t *testing.T) {
+	db := &redactionsDB{events: map[string]types.Event{}, redactions: map[string]*tables.RedactionInfo{}}
+	redact := func(redactionEventID, sender, redactsEventID string, validated bool) {
+		db.add(t, redactionEventID, sender, gomatrixserverlib.MRoomRedaction, redactsEventID)
+		db.redactions[redactionEventID] = &tables.RedactionInfo{
+			RedactionEventID: redactionEventID,
+			RedactsEventID:   redactsEventID,
+			Validated:        validated,
+		}
+	}
+	db.add(t, "$applied:localhost", "@bob:localhost", "m.room.message", "")
+	db.add(t, "$kept:localhost", "@bob:localhost", "m.room.message", "")
+	redact("$redaction1:localhost", "@mod:localhost", "$applied:localhost", true)
+	redact("$redaction2:localhost", "@mod:localhost", "$missing:localhost", false)
+	redact("$redaction3:localhost", "@mod:localhost", "$kept:localhost", false)
+	redact("$redaction4:localhost", "@bob:localhost", "$applied:localhost", false)
+	r := &Queryer{DB: db}
+
+	var byRes api.QueryEventsRedactedByResponse
+	if err := r.QueryEventsRedactedBy(context.Background(), &api.QueryEventsRedactedByRequest{RedactionEventID: "$redaction1:localhost"}, &byRes); err != nil {
+		t.Fatal(err)
+	}
+	if !byRes.RedactionExists || byRes.Redaction.State != api.RedactionApplied || byRes.Redaction.TargetEvent == nil || byRes.Redaction.TargetEvent.EventID() != "$applied:localhost" {
+		t.Errorf("expected an applied redaction of $applied:localhost, got %+v", byRes.Redaction)
+	}
+
+	byRes = api.QueryEventsRedactedByResponse{}
+	if err := r.QueryEventsRedactedBy(context.Background(), &api.QueryEventsRedactedByRequest{RedactionEventID: "$redaction2:localhost"}, &byRes); err != nil {
+		t.Fatal(err)
+	}
+	if !byRes.RedactionExists || byRes.Redaction.State != api.RedactionPending || byRes.Redaction.TargetEvent != nil || byRes.Redaction.RedactsEventID != "$missing:localhost" {
+		t.Errorf("expected a pending redaction of $missing:localhost, got %+v", byRes.Redaction)
+	}
+
+	byRes = api.QueryEventsRedactedByResponse{}
+	if err := r.QueryEventsRedactedBy(context.Background(), &api.QueryEventsRedactedByRequest{RedactionEventID: "$unknown:localhost"}, &byRes); err != nil {
+		t.Fatal(err)
+	}
+	if byRes.RedactionExists || byRes.Redaction != nil {
+		t.Errorf("expected an unknown redaction not to exist, got %+v", byRes)
+	}
+
+	var userRes api.QueryRedactionsByUserResponse
+	if err := r.QueryRedactionsByUser(context.Background(), &api.QueryRedactionsByUserRequest{RoomID: "!room:localhost", UserID: "@mod:localhost"}, &userRes); err != nil {
+		t.Fatal(err)
+	}
+	if !userRes.RoomExists {
+		t.Fatalf("expected the room to exist")
+	}
+	var got []string
+	for _, redaction := range userRes.Redactions {
+		got = append(got, redaction.RedactionEventID+" "+redaction.State)
+	}
+	want := []string{
+		"$redaction1:localhost " + api.RedactionApplied,
+		"$redaction2:localhost " + api.RedactionPending,
+		"$redaction3:localhost " + api.RedactionNotApplied,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueryServerKeysUsedForRoom(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(serverName gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID, depth int64) *gomatrixserverlib.Event {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender: "@alice:" + string(serverName),
+			RoomID: "!room:localhost",
+			Type:   "m.room.message",
+			Depth:  depth,
+		}
+		if err = builder.SetContent(map[string]interface{}{"body": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		event, berr := builder.Build(time.Now(), serverName, keyID, private, gomatrixserverlib.RoomVersionV6)
+		if berr != nil {
+			t.Fatal(berr)
+		}
+		return event
+	}
+	// The old key signed two events before it was rotated, and one event
+	// was also signed by another server.
+	countersigned := build("remote", "ed25519:old", 3)
+	signed := countersigned.Sign("other", "ed25519:1", private)
+	db := &graphDB{}
+	for i, event := range []*gomatrixserverlib.Event{
+		build("remote", "ed25519:old", 1),
+		build("localhost", "ed25519:auto", 2),
+		&signed,
+		build("remote", "ed25519:new", 4),
+	} {
+		db.events = append(db.events, types.Event{EventNID: types.EventNID(i + 1), Event: event})
+	}
+	r := &Queryer{DB: db}
+
+	var res api.QueryServerKeysUsedForRoomResponse
+	if err = r.QueryServerKeysUsedForRoom(context.Background(), &api.QueryServerKeysUsedForRoomRequest{RoomID: "!room:localhost"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := []api.ServerKeyUsage{
+		{ServerName: "localhost", KeyID: "ed25519:auto", EventCount: 1},
+		{ServerName: "other", KeyID: "ed25519:1", EventCount: 1},
+		{ServerName: "remote", KeyID: "ed25519:new", EventCount: 1},
+		{ServerName: "remote", KeyID: "ed25519:old", EventCount: 2},
+	}
+	if !res.RoomExists || res.Truncated || res.EventsScanned != 4 || !reflect.DeepEqual(res.Keys, want) {
+		t.Errorf("got %+v, want keys %+v", res, want)
+	}
+
+	// Only the first events are looked at when the room has too many.
+	res = api.QueryServerKeysUsedForRoomResponse{}
+	if err = r.QueryServerKeysUsedForRoom(context.Background(), &api.QueryServerKeysUsedForRoomRequest{RoomID: "!room:localhost", MaxEvents: 2}, &res); err != nil {
+		t.Fatal(err)
+	}
+	want = []api.ServerKeyUsage{
+		{ServerName: "localhost", KeyID: "ed25519:auto", EventCount: 1},
+		{ServerName: "remote", KeyID: "ed25519:old", EventCount: 1},
+	}
+	if !res.Truncated || res.EventsScanned != 2 || !reflect.DeepEqual(res.Keys, want) {
+		t.Errorf("got %+v, want truncated keys %+v", res, want)
+	}
+}
+
+// authChainDB serves the events of a single room from memory, omitting
+// events which it doesn't have like the real database does.
+type authChainDB struct {
+	storage.Database
+	events map[string]*gomatrixserverlib.Event
+}
+
+func (db *authChainDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != "!room:localhost" {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (db *authChainDB) EventsFromIDs(ctx context.Context, eventIDs []string) (res []types.Event, err error) {
+	for _, eventID := range eventIDs {
+		if event, ok := db.events[eventID]; ok {
+			res = append(res, types.Event{Event: event})
+		}
+	}
+	return
+}
+
+func (db *authChainDB) addEvent(t *testing.T, eventID string, authIDs ...string) {
+	t.Helper()
+	authEvents := []gomatrixserverlib.EventReference{}
+	for _, authID := range authIDs {
+		authEvents = append(authEvents, gomatrixserverlib.EventReference{EventID: authID})
+	}
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"event_id":    eventID,
+		"room_id":     "!room:localhost",
+		"auth_events": authEvents,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.events[eventID] = event
+}
+
+func TestQueryEventAuthChain(t *testing.T) {
+	db := &authChainDB{events: map[string]*gomatrixserverlib.Event{}}
+	db.addEvent(t, "$create:localhost")
+	db.addEvent(t, "$join:localhost", "$create:localhost")
+	db.addEvent(t, "$power:localhost", "$create:localhost", "$join:localhost")
+	db.addEvent(t, "$rules:localhost", "$join:localhost", "$power:localhost", "$create:localhost")
+	db.addEvent(t, "$message:localhost", "$rules:localhost", "$create:localhost", "$power:localhost", "$join:localhost")
+	r := &Queryer{DB: db}
+	ctx := context.Background()
+
+	var res api.QueryEventAuthChainResponse
+	if err := r.QueryEventAuthChain(ctx, &api.QueryEventAuthChainRequest{
+		RoomID: "!room:localhost", EventID: "$message:localhost",
+	}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.RoomExists || !res.EventExists {
+		t.Fatalf("expected the room and event to exist: %+v", res)
+	}
+	var got []string
+	for _, event := range res.AuthChain {
+		got = append(got, event.EventID())
+	}
+	want := []string{"$create:localhost", "$join:localhost", "$power:localhost", "$rules:localhost"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got auth chain %v, want %v", got, want)
+	}
+
+	// An event in another room isn't found.
+	res = api.QueryEventAuthChainResponse{}
+	if err := r.QueryEventAuthChain(ctx, &api.QueryEventAuthChainRequest{
+		RoomID: "!other:localhost", EventID: "$message:localhost",
+	}, &res); err != nil || res.RoomExists || res.EventExists {
+		t.Fatalf("expected an unknown room, got %+v, %v", res, err)
+	}
+
+	// A missing link in the chain is an error rather than being skipped.
+	delete(db.events, "$join:localhost")
+	res = api.QueryEventAuthChainResponse{}
+	if err := r.QueryEventAuthChain(ctx, &api.QueryEventAuthChainRequest{
+		RoomID: "!room:localhost", EventID: "$message:localhost",
+	}, &res); err == nil {
+		t.Fatal("expected a missing auth event to be an error")
+	}
+}
+
+// stateAfterEventsDB is a room with a create event and a topic event which
+// was rejected, so the state after the topic event is only the create event.
+type stateAfterEventsDB struct {
+	storage.Database
+	events map[types.EventNID]*gomatrixserverlib.Event
+}
+
+func (db *stateAfterEventsDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV1}, nil
+}
+
+func (db *stateAfterEventsDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	var result []types.StateAtEvent
+	for _, eventID := range eventIDs {
+		switch eventID {
+		case "$m.room.create:localhost":
+			result = append(result, types.StateAtEvent{
+				StateEntry: types.StateEntry{
+					StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomCreateNID, EventStateKeyNID: types.EmptyStateKeyNID},
+					EventNID:      1,
+				},
+			})
+		case "$m.room.topic:localhost":
+			result = append(result, types.StateAtEvent{
+				BeforeStateSnapshotNID: 1,
+				IsRejected:             true,
+				StateEntry: types.StateEntry{
+					StateKeyTuple: types.StateKeyTuple{EventTypeNID: 100, EventStateKeyNID: types.EmptyStateKeyNID},
+					EventNID:      2,
+				},
+			})
+		default:
+			return nil, types.MissingEventError("missing " + eventID)
+		}
+	}
+	return result, nil
+}
+
+func (db *stateAfterEventsDB) EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	result := map[types.EventNID]string{}
+	for _, eventNID := range eventNIDs {
+		result[eventNID] = db.events[eventNID].EventID()
+	}
+	return result, nil
+}
+
+// StateBlockNIDs returns an empty snapshot 0, from before the create event,
+// and snapshot 1 which is made up of block 1.
+func (db *stateAfterEventsDB) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	var result []types.StateBlockNIDList
+	for _, stateNID := range stateNIDs {
+		list := types.StateBlockNIDList{StateSnapshotNID: stateNID}
+		if stateNID == 1 {
+			list.StateBlockNIDs = []types.StateBlockNID{1}
+		}
+		result = append(result, list)
+	}
+	return result, nil
+}
+
+func (db *stateAfterEventsDB) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	var result []types.StateEntryList
+	for range stateBlockNIDs {
+		result = append(result, types.StateEntryList{StateBlockNID: 1, StateEntries: []types.StateEntry{{
+			StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomCreateNID, EventStateKeyNID: types.EmptyStateKeyNID},
+			EventNID:      1,
+		}}})
+	}
+	return result, nil
+}
+
+func (db *stateAfterEventsDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventNID := range eventNIDs {
+		result = append(result, types.Event{EventNID: eventNID, Event: db.events[eventNID]})
+	}
+	return result, nil
+}
+
+func TestQueryStateAfterEventsRejected(t *testing.T) {
+	db := &stateAfterEventsDB{events: map[types.EventNID]*gomatrixserverlib.Event{
+		1: mustCreateStateEvent(t, gomatrixserverlib.MRoomCreate, map[string]interface{}{"creator": "@alice:localhost"}).Unwrap(),
+		2: mustCreateStateEvent(t, "m.room.topic", map[string]interface{}{"topic": "rejected"}).Unwrap(),
+	}}
+	r := &Queryer{DB: db}
+	ctx := context.Background()
+
+	var res api.QueryStateAfterEventsResponse
+	if err := r.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID: "!room:localhost", PrevEventIDs: []string{"$m.room.topic:localhost"},
+	}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.PrevEventsExist {
+		t.Fatal("expected the prev event to exist")
+	}
+	if !reflect.DeepEqual(res.Rejected, map[string]bool{"$m.room.topic:localhost": true}) {
+		t.Fatalf("got rejected %v, want the topic event to be rejected", res.Rejected)
+	}
+	// The rejected topic event isn't part of the state after itself.
+	if len(res.StateEvents) != 1 || res.StateEvents[0].Type() != gomatrixserverlib.MRoomCreate {
+		t.Fatalf("got state events %v, want only the create event", res.StateEvents)
+	}
+
+	res = api.QueryStateAfterEventsResponse{}
+	if err := r.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID: "!room:localhost", PrevEventIDs: []string{"$m.room.create:localhost"},
+	}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Rejected, map[string]bool{"$m.room.create:localhost": false}) {
+		t.Fatalf("got rejected %v, want the create event not to be rejected", res.Rejected)
+	}
+}
+
+func mustOpenSQLiteDatabase(t *testing.T) *sqlite3.Database {
+	t.Helper()
+	cache, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite3.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "roomserver.db")),
+	}, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestQueryInviteInfo(t *testing.T) {
+	ctx := context.Background()
+	db := mustOpenSQLiteDatabase(t)
+	roomNID, err := db.RoomsTable.InsertRoomNID(ctx, nil, "!room:localhost", gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobNID, err := db.EventStateKeysTable.InsertEventStateKeyNID(ctx, nil, "@bob:localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Queryer{DB: db}
+
+	// storeInvite stores an invite event for bob, which gets the next event
+	// NID, without recording it as an active invite yet.
+	storeInvite := func(eventID string) []byte {
+		eventJSON, err := json.Marshal(map[string]interface{}{
+			"event_id":  eventID,
+			"room_id":   "!room:localhost",
+			"sender":    "@alice:localhost",
+			"type":      gomatrixserverlib.MRoomMember,
+			"state_key": "@bob:localhost",
+			"content":   map[string]interface{}{"membership": gomatrixserverlib.Invite},
+			"unsigned": map[string]interface{}{
+				"invite_room_state": []map[string]interface{}{
+					{"type": "m.room.name", "state_key": "", "sender": "@alice:localhost", "content": map[string]interface{}{"name": eventID}},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = db.EventsTable.InsertEvent(
+			ctx, nil, roomNID, types.MRoomMemberNID, bobNID, eventID, []byte(eventID), nil, 1, false, false, "",
+		); err != nil {
+			t.Fatal(err)
+		}
+		return eventJSON
+	}
+	activateInvite := func(eventID string, eventJSON []byte) {
+		if _, err := db.InvitesTable.InsertInviteEvent(ctx, nil, eventID, roomNID, bobNID, 0, eventJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query := func(wantEventID string) {
+		t.Helper()
+		var res api.QueryInviteInfoResponse
+		if err := r.QueryInviteInfo(ctx, &api.QueryInviteInfoRequest{RoomID: "!room:localhost", UserID: "@bob:localhost"}, &res); err != nil {
+			t.Fatal(err)
+		}
+		if wantEventID == "" {
+			if res.InviteExists || res.Event != nil {
+				t.Fatalf("expected no invite, got %+v", res)
+			}
+			return
+		}
+		if !res.InviteExists || res.Event == nil || res.Event.EventID() != wantEventID {
+			t.Fatalf("expected invite %s, got %+v", wantEventID, res)
+		}
+		if len(res.InviteRoomState) != 1 || string(res.InviteRoomState[0].Content()) != `{"name":"`+wantEventID+`"}` {
+			t.Fatalf("expected the invite room state of %s, got %+v", wantEventID, res.InviteRoomState)
+		}
+	}
+
+	query("")
+
+	// A single invite.
+	activateInvite("$invite1:localhost", storeInvite("$invite1:localhost"))
+	query("$invite1:localhost")
+
+	// A retired invite is no longer pending.
+	if _, err = db.InvitesTable.UpdateInviteRetired(ctx, nil, roomNID, bobNID); err != nil {
+		t.Fatal(err)
+	}
+	query("")
+
+	// With two pending invites, the most recent one is used, regardless of
+	// the order in which they were recorded as invites.
+	older := storeInvite("$invite2:localhost")
+	newer := storeInvite("$invite3:localhost")
+	activateInvite("$invite3:localhost", newer)
+	activateInvite("$invite2:localhost", older)
+	query("$invite3:localhost")
+}
+
+func TestQueryStateSnapshotDiff(t *testing.T) {
+	ctx := context.Background()
+	db := mustOpenSQLiteDatabase(t)
+	r := &Queryer{DB: db}
+
+	store := func(eventID, eventType string, content map[string]interface{}) types.StateEntry {
+		t.Helper()
+		eventJSON, err := json.Marshal(map[string]interface{}{
+			"event_id":  eventID,
+			"room_id":   "!room:localhost",
+			"sender":    "@alice:localhost",
+			"type":      eventType,
+			"state_key": "",
+			"content":   content,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, stateAtEvent, _, _, err := db.StoreEvent(ctx, event, nil, false, false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stateAtEvent.StateEntry
+	}
+	create := store("$create:localhost", gomatrixserverlib.MRoomCreate, map[string]interface{}{"creator": "@alice:localhost", "room_version": "1"})
+	oldTopic := store("$oldtopic:localhost", "m.room.topic", map[string]interface{}{"topic": "old"})
+	newTopic := store("$newtopic:localhost", "m.room.topic", map[string]interface{}{"topic": "new"})
+	name := store("$name:localhost", "m.room.name", map[string]interface{}{"name": "room"})
+	info, err := db.RoomInfo(ctx, "!room:localhost")
+	if err != nil || info == nil {
+		t.Fatalf("expected the room to exist: %v", err)
+	}
+	snapshot := func(entries ...types.StateEntry) types.StateSnapshotNID {
+		t.Helper()
+		stateNID, err := db.AddState(ctx, info.RoomNID, nil, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stateNID
+	}
+	before := snapshot(create, oldTopic)
+	after := snapshot(create, newTopic, name)
+
+	// summarise turns a response into sorted event IDs so that it can be
+	// compared regardless of the order of the entries.
+	type summary struct {
+		Added, Removed, Changed []string
+	}
+	summarise := func(res *api.QueryStateSnapshotDiffResponse) summary {
+		var s summary
+		for _, ev := range res.Added {
+			s.Added = append(s.Added, ev.EventID())
+		}
+		for _, ev := range res.Removed {
+			s.Removed = append(s.Removed, ev.EventID())
+		}
+		for _, change := range res.Changed {
+			s.Changed = append(s.Changed, change.Old.EventID()+" -> "+change.New.EventID())
+		}
+		sort.Strings(s.Added)
+		sort.Strings(s.Removed)
+		sort.Strings(s.Changed)
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		old, new types.StateSnapshotNID
+		want     summary
+	}{
+		{
+			name: "added and changed",
+			old:  before, new: after,
+			want: summary{
+				Added:   []string{"$name:localhost"},
+				Changed: []string{"$oldtopic:localhost -> $newtopic:localhost"},
+			},
+		},
+		{
+			name: "removed and changed",
+			old:  after, new: before,
+			want: summary{
+				Removed: []string{"$name:localhost"},
+				Changed: []string{"$newtopic:localhost -> $oldtopic:localhost"},
+			},
+		},
+		{
+			name: "identical",
+			old:  after, new: after,
+			want: summary{},
+		},
+		{
+			name: "from the empty state",
+			old:  0, new: before,
+			want: summary{Added: []string{"$create:localhost", "$oldtopic:localhost"}},
+		},
+		{
+			name: "to the empty state",
+			old:  before, new: 0,
+			want: summary{Removed: []string{"$create:localhost", "$oldtopic:localhost"}},
+		},
+	}
+	for _, tc := range tests {
+		var res api.QueryStateSnapshotDiffResponse
+		if err := r.QueryStateSnapshotDiff(ctx, &api.QueryStateSnapshotDiffRequest{
+			OldStateSnapshotNID: tc.old,
+			NewStateSnapshotNID: tc.new,
+		}, &res); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := summarise(&res); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQueryJoinedUsersInRoom(t *testing.T) {
+	ctx := context.Background()
+	db := mustOpenSQLiteDatabase(t)
+	r := &Queryer{DB: db}
+
+	query := func(roomID string) api.QueryJoinedUsersInRoomResponse {
+		t.Helper()
+		var res api.QueryJoinedUsersInRoomResponse
+		if err := r.QueryJoinedUsersInRoom(ctx, &api.QueryJoinedUsersInRoomRequest{RoomID: roomID}, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res := query("!unknown:localhost"); res.RoomExists {
+		t.Fatalf("expected an unknown room not to exist, got %+v", res)
+	}
+
+	// A room without any latest events is only a stub.
+	if _, err := db.RoomsTable.InsertRoomNID(ctx, nil, "!stub:localhost", gomatrixserverlib.RoomVersionV1); err != nil {
+		t.Fatal(err)
+	}
+	if res := query("!stub:localhost"); res.RoomExists {
+		t.Fatalf("expected a stub room not to exist, got %+v", res)
+	}
+
+	roomNID, err := db.RoomsTable.InsertRoomNID(ctx, nil, "!room:localhost", gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.RoomsTable.UpdateLatestEventNIDs(ctx, nil, roomNID, []types.EventNID{1}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	setMembership := func(userID string, membership tables.MembershipState, eventNID types.EventNID) {
+		t.Helper()
+		userNID, err := db.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, userID)
+		if err == sql.ErrNoRows {
+			userNID, err = db.EventStateKeysTable.InsertEventStateKeyNID(ctx, nil, userID)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.MembershipTable.InsertMembership(ctx, nil, roomNID, userNID, true); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.MembershipTable.UpdateMembership(ctx, nil, roomNID, userNID, userNID, membership, eventNID, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMembership("@bob:localhost", tables.MembershipStateJoin, 2)
+	setMembership("@alice:remote", tables.MembershipStateJoin, 3)
+	setMembership("@charlie:localhost", tables.MembershipStateInvite, 4)
+	setMembership("@dave:localhost", tables.MembershipStateJoin, 5)
+	setMembership("@dave:localhost", tables.MembershipStateLeaveOrBan, 6)
+
+	res := query("!room:localhost")
+	want := []string{"@alice:remote", "@bob:localhost"}
+	if !res.RoomExists || !reflect.DeepEqual(res.UserIDs, want) {
+		t.Fatalf("got %+v, want joined users %v", res, want)
+	}
+}
@@ -24,18 +24,24 @@ const (
 	RoomserverRemoveRoomAliasPath      = "/roomserver/removeRoomAlias"
 
 	// Input operations
-	RoomserverInputRoomEventsPath = "/roomserver/inputRoomEvents"
+	RoomserverInputRoomEventsPath        = "/roomserver/inputRoomEvents"
+	RoomserverInputRoomActivityHintsPath = "/roomserver/inputRoomActivityHints"
 
 	// Perform operations
-	RoomserverPerformInvitePath      = "/roomserver/performInvite"
-	RoomserverPerformPeekPath        = "/roomserver/performPeek"
-	RoomserverPerformUnpeekPath      = "/roomserver/performUnpeek"
-	RoomserverPerformJoinPath        = "/roomserver/performJoin"
-	RoomserverPerformLeavePath       = "/roomserver/performLeave"
-	RoomserverPerformBackfillPath    = "/roomserver/performBackfill"
-	RoomserverPerformPublishPath     = "/roomserver/performPublish"
-	RoomserverPerformInboundPeekPath = "/roomserver/performInboundPeek"
-	RoomserverPerformForgetPath      = "/roomserver/performForget"
+	RoomserverPerformInvitePath                     = "/roomserver/performInvite"
+	RoomserverPerformPeekPath                       = "/roomserver/performPeek"
+	RoomserverPerformUnpeekPath                     = "/roomserver/performUnpeek"
+	RoomserverPerformJoinPath                       = "/roomserver/performJoin"
+	RoomserverPerformLeavePath                      = "/roomserver/performLeave"
+	RoomserverPerformBackfillPath                   = "/roomserver/performBackfill"
+	RoomserverPerformPublishPath                    = "/roomserver/performPublish"
+	RoomserverPerformRoomMaintenancePath            = "/roomserver/performRoomMaintenance"
+	RoomserverPerformRewindRoomStatePath            = "/roomserver/performRewindRoomState"
+	RoomserverPerformReevaluateSoftFailedEventsPath = "/roomserver/performReevaluateSoftFailedEvents"
+	RoomserverPerformReprocessRejectedEventsPath    = "/roomserver/performReprocessRejectedEvents"
+	RoomserverPerformResubmitInputDeadLettersPath   = "/roomserver/performResubmitInputDeadLetters"
+	RoomserverPerformInboundPeekPath                = "/roomserver/performInboundPeek"
+	RoomserverPerformForgetPath                     = "/roomserver/performForget"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -58,6 +64,30 @@ const (
 	RoomserverQueryKnownUsersPath              = "/roomserver/queryKnownUsers"
 	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
 	RoomserverQueryAuthChainPath               = "/roomserver/queryAuthChain"
+	RoomserverQueryStateSnapshotDiffPath       = "/roomserver/queryStateSnapshotDiff"
+	RoomserverQueryInviteInfoPath              = "/roomserver/queryInviteInfo"
+	RoomserverQueryJoinedUsersInRoomPath       = "/roomserver/queryJoinedUsersInRoom"
+	RoomserverQueryBackfillCandidatesPath      = "/roomserver/queryBackfillCandidates"
+	RoomserverQueryRoomsInMaintenancePath      = "/roomserver/queryRoomsInMaintenance"
+	RoomserverQueryStateRewindsPath            = "/roomserver/queryStateRewinds"
+	RoomserverQueryHasLocalJoinedUsersPath     = "/roomserver/queryHasLocalJoinedUsers"
+	RoomserverQueryLocalJoinedCountPath        = "/roomserver/queryLocalJoinedCount"
+	RoomserverQueryEventSignaturesPath         = "/roomserver/queryEventSignatures"
+	RoomserverQueryRoomCreatorPath             = "/roomserver/queryRoomCreator"
+	RoomserverQueryEventDepthsPath             = "/roomserver/queryEventDepths"
+	RoomserverQueryAliasesForRoomPath          = "/roomserver/queryAliasesForRoom"
+	RoomserverQueryRoomEncryptionPath          = "/roomserver/queryRoomEncryption"
+	RoomserverQueryPurgeCandidateRoomsPath     = "/roomserver/queryPurgeCandidateRooms"
+	RoomserverQueryEventForwardGraphPath       = "/roomserver/queryEventForwardGraph"
+	RoomserverQueryUserCapabilityPath          = "/roomserver/queryUserCapability"
+	RoomserverQueryMostRecentEventsPath        = "/roomserver/queryMostRecentEvents"
+	RoomserverQueryEventsRedactedByPath        = "/roomserver/queryEventsRedactedBy"
+	RoomserverQueryRedactionsByUserPath        = "/roomserver/queryRedactionsByUser"
+	RoomserverQueryServerKeysUsedForRoomPath   = "/roomserver/queryServerKeysUsedForRoom"
+	RoomserverQueryEventRejectionReasonPath    = "/roomserver/queryEventRejectionReason"
+	RoomserverQueryEventAuthChainPath          = "/roomserver/queryEventAuthChain"
+	RoomserverQueryEventProvenancePath         = "/roomserver/queryEventProvenance"
+	RoomserverQueryInputDeadLettersPath        = "/roomserver/queryInputDeadLetters"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -172,6 +202,20 @@ func (h *httpRoomserverInternalAPI) InputRoomEvents(
 	}
 }
 
+// InputRoomActivityHints implements RoomserverInputAPI
+func (h *httpRoomserverInternalAPI) InputRoomActivityHints(
+	ctx context.Context,
+	request *api.InputRoomActivityHintsRequest,
+	response *api.InputRoomActivityHintsResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputRoomActivityHints")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverInputRoomActivityHintsPath
+	// Hints are best-effort, so there's nothing to do if this fails.
+	_ = httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpRoomserverInternalAPI) PerformInvite(
 	ctx context.Context,
 	request *api.PerformInviteRequest,
@@ -276,6 +320,91 @@ func (h *httpRoomserverInternalAPI) PerformPublish(
 	}
 }
 
+func (h *httpRoomserverInternalAPI) PerformRoomMaintenance(
+	ctx context.Context,
+	req *api.PerformRoomMaintenanceRequest,
+	res *api.PerformRoomMaintenanceResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformRoomMaintenance")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformRoomMaintenancePath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformRewindRoomState(
+	ctx context.Context,
+	req *api.PerformRewindRoomStateRequest,
+	res *api.PerformRewindRoomStateResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformRewindRoomState")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformRewindRoomStatePath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformReevaluateSoftFailedEvents(
+	ctx context.Context,
+	req *api.PerformReevaluateSoftFailedEventsRequest,
+	res *api.PerformReevaluateSoftFailedEventsResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformReevaluateSoftFailedEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformReevaluateSoftFailedEventsPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformReprocessRejectedEvents(
+	ctx context.Context,
+	req *api.PerformReprocessRejectedEventsRequest,
+	res *api.PerformReprocessRejectedEventsResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformReprocessRejectedEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformReprocessRejectedEventsPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformResubmitInputDeadLetters(
+	ctx context.Context,
+	req *api.PerformResubmitInputDeadLettersRequest,
+	res *api.PerformResubmitInputDeadLettersResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformResubmitInputDeadLetters")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformResubmitInputDeadLettersPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
 // QueryLatestEventsAndState implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryLatestEventsAndState(
 	ctx context.Context,
@@ -550,3 +679,243 @@ func (h *httpRoomserverInternalAPI) PerformForget(ctx context.Context, req *api.
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 
 }
+
+func (h *httpRoomserverInternalAPI) QueryStateSnapshotDiff(
+	ctx context.Context, req *api.QueryStateSnapshotDiffRequest, res *api.QueryStateSnapshotDiffResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryStateSnapshotDiff")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryStateSnapshotDiffPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryInviteInfo(
+	ctx context.Context, req *api.QueryInviteInfoRequest, res *api.QueryInviteInfoResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryInviteInfo")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryInviteInfoPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryJoinedUsersInRoom(
+	ctx context.Context, req *api.QueryJoinedUsersInRoomRequest, res *api.QueryJoinedUsersInRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryJoinedUsersInRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryJoinedUsersInRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryBackfillCandidates(
+	ctx context.Context, req *api.QueryBackfillCandidatesRequest, res *api.QueryBackfillCandidatesResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryBackfillCandidates")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryBackfillCandidatesPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomsInMaintenance(
+	ctx context.Context, req *api.QueryRoomsInMaintenanceRequest, res *api.QueryRoomsInMaintenanceResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomsInMaintenance")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomsInMaintenancePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryStateRewinds(
+	ctx context.Context, req *api.QueryStateRewindsRequest, res *api.QueryStateRewindsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryStateRewinds")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryStateRewindsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryHasLocalJoinedUsers(
+	ctx context.Context, req *api.QueryHasLocalJoinedUsersRequest, res *api.QueryHasLocalJoinedUsersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryHasLocalJoinedUsers")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryHasLocalJoinedUsersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryLocalJoinedCount(
+	ctx context.Context, req *api.QueryLocalJoinedCountRequest, res *api.QueryLocalJoinedCountResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryLocalJoinedCount")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryLocalJoinedCountPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventSignatures(
+	ctx context.Context, req *api.QueryEventSignaturesRequest, res *api.QueryEventSignaturesResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventSignatures")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventSignaturesPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomCreator(
+	ctx context.Context, req *api.QueryRoomCreatorRequest, res *api.QueryRoomCreatorResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomCreator")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomCreatorPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventDepths(
+	ctx context.Context, req *api.QueryEventDepthsRequest, res *api.QueryEventDepthsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventDepths")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventDepthsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryAliasesForRoom(
+	ctx context.Context, req *api.QueryAliasesForRoomRequest, res *api.QueryAliasesForRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAliasesForRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAliasesForRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomEncryption(
+	ctx context.Context, req *api.QueryRoomEncryptionRequest, res *api.QueryRoomEncryptionResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomEncryption")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomEncryptionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryPurgeCandidateRooms(
+	ctx context.Context, req *api.QueryPurgeCandidateRoomsRequest, res *api.QueryPurgeCandidateRoomsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPurgeCandidateRooms")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryPurgeCandidateRoomsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventForwardGraph(
+	ctx context.Context, req *api.QueryEventForwardGraphRequest, res *api.QueryEventForwardGraphResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventForwardGraph")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventForwardGraphPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryUserCapability(
+	ctx context.Context, req *api.QueryUserCapabilityRequest, res *api.QueryUserCapabilityResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryUserCapability")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryUserCapabilityPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryMostRecentEvents(
+	ctx context.Context, req *api.QueryMostRecentEventsRequest, res *api.QueryMostRecentEventsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryMostRecentEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryMostRecentEventsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventsRedactedBy(
+	ctx context.Context, req *api.QueryEventsRedactedByRequest, res *api.QueryEventsRedactedByResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventsRedactedBy")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventsRedactedByPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRedactionsByUser(
+	ctx context.Context, req *api.QueryRedactionsByUserRequest, res *api.QueryRedactionsByUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRedactionsByUser")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRedactionsByUserPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryServerKeysUsedForRoom(
+	ctx context.Context, req *api.QueryServerKeysUsedForRoomRequest, res *api.QueryServerKeysUsedForRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerKeysUsedForRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryServerKeysUsedForRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventRejectionReason(
+	ctx context.Context, req *api.QueryEventRejectionReasonRequest, res *api.QueryEventRejectionReasonResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventRejectionReason")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventRejectionReasonPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventAuthChain(
+	ctx context.Context, req *api.QueryEventAuthChainRequest, res *api.QueryEventAuthChainResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventAuthChain")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventAuthChainPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventProvenance(
+	ctx context.Context, req *api.QueryEventProvenanceRequest, res *api.QueryEventProvenanceResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventProvenance")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventProvenancePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryInputDeadLetters(
+	ctx context.Context, req *api.QueryInputDeadLettersRequest, res *api.QueryInputDeadLettersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryInputDeadLetters")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryInputDeadLettersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
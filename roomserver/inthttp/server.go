@@ -24,6 +24,17 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverInputRoomActivityHintsPath,
+		httputil.MakeInternalAPI("inputRoomActivityHints", func(req *http.Request) util.JSONResponse {
+			var request api.InputRoomActivityHintsRequest
+			var response api.InputRoomActivityHintsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.InputRoomActivityHints(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(RoomserverPerformInvitePath,
 		httputil.MakeInternalAPI("performInvite", func(req *http.Request) util.JSONResponse {
 			var request api.PerformInviteRequest
@@ -107,6 +118,61 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverPerformRoomMaintenancePath,
+		httputil.MakeInternalAPI("performRoomMaintenance", func(req *http.Request) util.JSONResponse {
+			var request api.PerformRoomMaintenanceRequest
+			var response api.PerformRoomMaintenanceResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformRoomMaintenance(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformRewindRoomStatePath,
+		httputil.MakeInternalAPI("performRewindRoomState", func(req *http.Request) util.JSONResponse {
+			var request api.PerformRewindRoomStateRequest
+			var response api.PerformRewindRoomStateResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformRewindRoomState(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformReevaluateSoftFailedEventsPath,
+		httputil.MakeInternalAPI("performReevaluateSoftFailedEvents", func(req *http.Request) util.JSONResponse {
+			var request api.PerformReevaluateSoftFailedEventsRequest
+			var response api.PerformReevaluateSoftFailedEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformReevaluateSoftFailedEvents(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformReprocessRejectedEventsPath,
+		httputil.MakeInternalAPI("performReprocessRejectedEvents", func(req *http.Request) util.JSONResponse {
+			var request api.PerformReprocessRejectedEventsRequest
+			var response api.PerformReprocessRejectedEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformReprocessRejectedEvents(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformResubmitInputDeadLettersPath,
+		httputil.MakeInternalAPI("performResubmitInputDeadLetters", func(req *http.Request) util.JSONResponse {
+			var request api.PerformResubmitInputDeadLettersRequest
+			var response api.PerformResubmitInputDeadLettersResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformResubmitInputDeadLetters(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverQueryPublishedRoomsPath,
 		httputil.MakeInternalAPI("queryPublishedRooms", func(req *http.Request) util.JSONResponse {
@@ -478,4 +544,316 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverQueryStateSnapshotDiffPath,
+		httputil.MakeInternalAPI("queryStateSnapshotDiff", func(req *http.Request) util.JSONResponse {
+			request := api.QueryStateSnapshotDiffRequest{}
+			response := api.QueryStateSnapshotDiffResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryStateSnapshotDiff(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryInviteInfoPath,
+		httputil.MakeInternalAPI("queryInviteInfo", func(req *http.Request) util.JSONResponse {
+			request := api.QueryInviteInfoRequest{}
+			response := api.QueryInviteInfoResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryInviteInfo(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryJoinedUsersInRoomPath,
+		httputil.MakeInternalAPI("queryJoinedUsersInRoom", func(req *http.Request) util.JSONResponse {
+			request := api.QueryJoinedUsersInRoomRequest{}
+			response := api.QueryJoinedUsersInRoomResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryJoinedUsersInRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryBackfillCandidatesPath,
+		httputil.MakeInternalAPI("queryBackfillCandidates", func(req *http.Request) util.JSONResponse {
+			request := api.QueryBackfillCandidatesRequest{}
+			response := api.QueryBackfillCandidatesResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryBackfillCandidates(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomsInMaintenancePath,
+		httputil.MakeInternalAPI("queryRoomsInMaintenance", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomsInMaintenanceRequest{}
+			response := api.QueryRoomsInMaintenanceResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomsInMaintenance(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryStateRewindsPath,
+		httputil.MakeInternalAPI("queryStateRewinds", func(req *http.Request) util.JSONResponse {
+			request := api.QueryStateRewindsRequest{}
+			response := api.QueryStateRewindsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryStateRewinds(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryHasLocalJoinedUsersPath,
+		httputil.MakeInternalAPI("queryHasLocalJoinedUsers", func(req *http.Request) util.JSONResponse {
+			request := api.QueryHasLocalJoinedUsersRequest{}
+			response := api.QueryHasLocalJoinedUsersResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryHasLocalJoinedUsers(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryLocalJoinedCountPath,
+		httputil.MakeInternalAPI("queryLocalJoinedCount", func(req *http.Request) util.JSONResponse {
+			request := api.QueryLocalJoinedCountRequest{}
+			response := api.QueryLocalJoinedCountResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryLocalJoinedCount(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventSignaturesPath,
+		httputil.MakeInternalAPI("queryEventSignatures", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventSignaturesRequest{}
+			response := api.QueryEventSignaturesResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventSignatures(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomCreatorPath,
+		httputil.MakeInternalAPI("queryRoomCreator", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomCreatorRequest{}
+			response := api.QueryRoomCreatorResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomCreator(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventDepthsPath,
+		httputil.MakeInternalAPI("queryEventDepths", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventDepthsRequest{}
+			response := api.QueryEventDepthsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventDepths(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryAliasesForRoomPath,
+		httputil.MakeInternalAPI("queryAliasesForRoom", func(req *http.Request) util.JSONResponse {
+			request := api.QueryAliasesForRoomRequest{}
+			response := api.QueryAliasesForRoomResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryAliasesForRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomEncryptionPath,
+		httputil.MakeInternalAPI("queryRoomEncryption", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomEncryptionRequest{}
+			response := api.QueryRoomEncryptionResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomEncryption(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryPurgeCandidateRoomsPath,
+		httputil.MakeInternalAPI("queryPurgeCandidateRooms", func(req *http.Request) util.JSONResponse {
+			request := api.QueryPurgeCandidateRoomsRequest{}
+			response := api.QueryPurgeCandidateRoomsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryPurgeCandidateRooms(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventForwardGraphPath,
+		httputil.MakeInternalAPI("queryEventForwardGraph", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventForwardGraphRequest{}
+			response := api.QueryEventForwardGraphResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventForwardGraph(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryUserCapabilityPath,
+		httputil.MakeInternalAPI("queryUserCapability", func(req *http.Request) util.JSONResponse {
+			request := api.QueryUserCapabilityRequest{}
+			response := api.QueryUserCapabilityResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryUserCapability(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryMostRecentEventsPath,
+		httputil.MakeInternalAPI("queryMostRecentEvents", func(req *http.Request) util.JSONResponse {
+			request := api.QueryMostRecentEventsRequest{}
+			response := api.QueryMostRecentEventsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryMostRecentEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventsRedactedByPath,
+		httputil.MakeInternalAPI("queryEventsRedactedBy", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventsRedactedByRequest{}
+			response := api.QueryEventsRedactedByResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventsRedactedBy(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRedactionsByUserPath,
+		httputil.MakeInternalAPI("queryRedactionsByUser", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRedactionsByUserRequest{}
+			response := api.QueryRedactionsByUserResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRedactionsByUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryServerKeysUsedForRoomPath,
+		httputil.MakeInternalAPI("queryServerKeysUsedForRoom", func(req *http.Request) util.JSONResponse {
+			request := api.QueryServerKeysUsedForRoomRequest{}
+			response := api.QueryServerKeysUsedForRoomResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryServerKeysUsedForRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventRejectionReasonPath,
+		httputil.MakeInternalAPI("queryEventRejectionReason", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventRejectionReasonRequest{}
+			response := api.QueryEventRejectionReasonResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventRejectionReason(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventAuthChainPath,
+		httputil.MakeInternalAPI("queryEventAuthChain", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventAuthChainRequest{}
+			response := api.QueryEventAuthChainResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventAuthChain(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventProvenancePath,
+		httputil.MakeInternalAPI("queryEventProvenance", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventProvenanceRequest{}
+			response := api.QueryEventProvenanceResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventProvenance(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryInputDeadLettersPath,
+		httputil.MakeInternalAPI("queryInputDeadLetters", func(req *http.Request) util.JSONResponse {
+			request := api.QueryInputDeadLettersRequest{}
+			response := api.QueryInputDeadLettersResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryInputDeadLetters(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
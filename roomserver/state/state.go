@@ -34,6 +34,11 @@ type StateResolution struct {
 	db       storage.Database
 	roomInfo *types.RoomInfo
 	events   map[types.EventNID]*gomatrixserverlib.Event
+	// If set then this algorithm is used instead of the one mandated by
+	// the room version.
+	forcedAlgorithm gomatrixserverlib.StateResAlgorithm
+	// The number of conflicting state sets resolved by the last calculation.
+	conflictingStateSets int
 }
 
 func NewStateResolution(db storage.Database, roomInfo *types.RoomInfo) StateResolution {
@@ -44,6 +49,61 @@ func NewStateResolution(db storage.Database, roomInfo *types.RoomInfo) StateReso
 	}
 }
 
+// AlgorithmForRoomVersion returns the state resolution algorithm which the
+// room version mandates.
+func AlgorithmForRoomVersion(version gomatrixserverlib.RoomVersion) (gomatrixserverlib.StateResAlgorithm, error) {
+	return version.StateResAlgorithm()
+}
+
+// AlgorithmName returns a human-readable name for a state resolution
+// algorithm, for logging and metrics.
+func AlgorithmName(algorithm gomatrixserverlib.StateResAlgorithm) string {
+	switch algorithm {
+	case gomatrixserverlib.StateResV1:
+		return "v1"
+	case gomatrixserverlib.StateResV2:
+		return "v2"
+	}
+	return fmt.Sprintf("unknown(%d)", algorithm)
+}
+
+// ForceAlgorithm makes conflicts be resolved using the given algorithm rather
+// than the one mandated by the room version. This is dangerous, since other
+// servers in the room will still use the algorithm for the room version and
+// we may end up with a different view of the room state to them. It should
+// only be used for recovery and debugging.
+func (v *StateResolution) ForceAlgorithm(algorithm gomatrixserverlib.StateResAlgorithm) {
+	v.forcedAlgorithm = algorithm
+}
+
+// LoadedEvents returns the number of state events which the resolver has
+// loaded from the database and is keeping in memory for reuse.
+func (v *StateResolution) LoadedEvents() int {
+	return len(v.events)
+}
+
+// ConflictingStateSets returns how many state sets had conflicts which were
+// resolved by the last call to CalculateAndStoreStateBeforeEvent or
+// CalculateAndStoreStateAfterEvents, or zero if there were no conflicts.
+func (v *StateResolution) ConflictingStateSets() int {
+	return v.conflictingStateSets
+}
+
+// SetRoomInfo replaces the room info which the resolver uses, so that a
+// resolver can be reused for later events in the same room.
+func (v *StateResolution) SetRoomInfo(roomInfo *types.RoomInfo) {
+	v.roomInfo = roomInfo
+}
+
+// Algorithm returns the state resolution algorithm which is used to resolve
+// conflicts in a room with the given room version.
+func (v *StateResolution) Algorithm(version gomatrixserverlib.RoomVersion) (gomatrixserverlib.StateResAlgorithm, error) {
+	if v.forcedAlgorithm != 0 {
+		return v.forcedAlgorithm, nil
+	}
+	return AlgorithmForRoomVersion(version)
+}
+
 // LoadStateAtSnapshot loads the full state of a room at a particular snapshot.
 // This is typically the state before an event or the current state of a room.
 // Returns a sorted list of state entries or an error if there was a problem talking to the database.
@@ -548,6 +608,7 @@ func (v *StateResolution) CalculateAndStoreStateAfterEvents(
 	prevStates []types.StateAtEvent,
 ) (types.StateSnapshotNID, error) {
 	metrics := calculateStateMetrics{startTime: time.Now(), prevEventLength: len(prevStates)}
+	v.conflictingStateSets = 0
 
 	if len(prevStates) == 0 {
 		// 2) There weren't any prev_events for this event so the state is
@@ -626,6 +687,10 @@ func (v *StateResolution) calculateAndStoreStateAfterManyEvents(
 		return metrics.stop(0, fmt.Errorf("v.calculateStateAfterManyEvents: %w", err))
 	}
 
+	if conflictLength > 0 {
+		v.conflictingStateSets = len(prevStates)
+	}
+
 	// TODO: Check if we can encode the new state as a delta against the
 	// previous state.
 	metrics.conflictLength = conflictLength
@@ -691,7 +756,7 @@ func (v *StateResolution) resolveConflicts(
 	ctx context.Context, version gomatrixserverlib.RoomVersion,
 	notConflicted, conflicted []types.StateEntry,
 ) ([]types.StateEntry, error) {
-	stateResAlgo, err := version.StateResAlgorithm()
+	stateResAlgo, err := v.Algorithm(version)
 	if err != nil {
 		return nil, err
 	}
@@ -945,9 +1010,13 @@ func (v *StateResolution) loadStateEvents(
 	result := make([]*gomatrixserverlib.Event, 0, len(entries))
 	eventEntries := make([]types.StateEntry, 0, len(entries))
 	eventNIDs := make([]types.EventNID, 0, len(entries))
+	eventIDMap := map[string]types.StateEntry{}
 	for _, entry := range entries {
 		if e, ok := v.events[entry.EventNID]; ok {
+			// Events we loaded earlier still need to be in the map, or the
+			// caller won't be able to map them back to their state entries.
 			result = append(result, e)
+			eventIDMap[e.EventID()] = entry
 		} else {
 			eventEntries = append(eventEntries, entry)
 			eventNIDs = append(eventNIDs, entry.EventNID)
@@ -957,7 +1026,6 @@ func (v *StateResolution) loadStateEvents(
 	if err != nil {
 		return nil, nil, err
 	}
-	eventIDMap := map[string]types.StateEntry{}
 	for _, entry := range eventEntries {
 		event, ok := eventMap(events).lookup(entry.EventNID)
 		if !ok {
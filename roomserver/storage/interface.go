@@ -16,6 +16,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -67,10 +68,24 @@ type Database interface {
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot and the redacted event ID if any, or an error.
+	// The rejection reason is stored alongside rejected events, so that we can
+	// tell why they were rejected later on. Events which were rejected only
+	// because they failed the auth checks should have rejectedByAuth set, so
+	// that they can be reprocessed later.
+	// A redaction which arrives before the event it redacts is remembered, and
+	// is applied when the redacted event is stored, in which case the redaction
+	// event and the redacted event ID are returned for the redacted event.
 	StoreEvent(
 		ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID,
-		isRejected bool,
+		isRejected, rejectedByAuth bool, rejectionReason string,
 	) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error)
+	// Stores events in a single transaction, in order, computing the auth event
+	// NIDs of each event from knownNIDs and the events stored before it. This
+	// is used for storing auth chains, so every event must come after its own
+	// auth events. Returns the numeric IDs of the events in the same order.
+	StoreEvents(
+		ctx context.Context, events []types.EventToStore, knownNIDs map[string]types.EventNID,
+	) ([]types.EventNID, error)
 	// Look up the state entries for a list of string event IDs
 	// Returns an error if the there is an error talking to the database
 	// Returns a types.MissingEventError if the event IDs aren't in the database.
@@ -81,6 +96,29 @@ type Database interface {
 	// Look up the numeric IDs for a list of events.
 	// Returns an error if there was a problem talking to the database.
 	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
+	// Look up the depths of the given events without loading the events themselves.
+	// Event IDs which aren't known are omitted from the result.
+	// Returns an error if there was a problem talking to the database.
+	EventDepths(ctx context.Context, eventIDs []string) (map[string]int64, error)
+	// Look up the NIDs of up to limit events in the room, in NID order,
+	// starting after the given event NID. Used to walk all of the events in
+	// a room in chunks.
+	RoomEventNIDsAfter(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// Look up the NIDs of all of the events in the room with the given event
+	// type, in NID order.
+	RoomEventNIDsOfType(ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID) ([]types.EventNID, error)
+	// Look up the redaction bookkeeping for a redaction event. Returns nil if
+	// the redaction event isn't known.
+	RedactionInfo(ctx context.Context, redactionEventID string) (*tables.RedactionInfo, error)
+	// Look up whether an event was rejected and why. The reason is empty if the
+	// event was stored before reasons were recorded.
+	EventRejectionReason(ctx context.Context, eventID string) (exists, isRejected bool, rejectionReason string, err error)
+	// Look up which server gave us an event and when, if it was fetched over
+	// federation. The server name is empty if it wasn't recorded.
+	EventProvenance(ctx context.Context, eventID string) (exists bool, serverName gomatrixserverlib.ServerName, receivedAt gomatrixserverlib.Timestamp, err error)
+	// Look up whether an event has been sent to the output stream, which is
+	// only the case for new events which were accepted into the room.
+	EventSentToOutput(ctx context.Context, eventNID types.EventNID) (bool, error)
 	// Set the state at an event. FIXME TODO: "at"
 	SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
 	// Lookup the event IDs for a batch of event numeric IDs.
@@ -97,8 +135,63 @@ type Database interface {
 	LatestEventIDs(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error)
 	// Look up the active invites targeting a user in a room and return the
 	// numeric state key IDs for the user IDs who sent them along with the event IDs for the invites.
+	// The invites are ordered oldest first.
 	// Returns an error if there was a problem talking to the database.
 	GetInvitesForUser(ctx context.Context, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (senderUserIDs []types.EventStateKeyNID, eventIDs []string, err error)
+	// Look up which of the given output events have already been emitted.
+	OutputEventsSent(ctx context.Context, keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error)
+	// Record that the given output events have been emitted.
+	MarkOutputEventsAsSent(ctx context.Context, keys []types.OutputEventKey) error
+	// Forget about output events which were emitted before the given time, so
+	// that they are no longer suppressed if they are ever produced again.
+	// Returns how many were forgotten.
+	PruneOutputEvents(ctx context.Context, before time.Time) (int64, error)
+	// Put a room into, or take a room out of, maintenance mode.
+	SetRoomMaintenance(ctx context.Context, roomID string, enabled bool) error
+	// Look up the room IDs of all rooms that are in maintenance mode.
+	GetRoomsInMaintenance(ctx context.Context) ([]string, error)
+	// Look up the recorded state rewinds for a room, oldest first.
+	GetStateRewinds(ctx context.Context, roomID string) ([]types.StateRewind, error)
+	// Journal an input event which hasn't been processed yet, so that it can be
+	// resumed after a restart.
+	AddPendingInput(ctx context.Context, roomID, eventID string, inputJSON []byte, queuedAt gomatrixserverlib.Timestamp) error
+	// Remove an input event from the journal once it has been dealt with.
+	RemovePendingInput(ctx context.Context, eventID string) error
+	// Look up the JSON of all journalled input events, oldest first.
+	GetPendingInput(ctx context.Context) ([][]byte, error)
+	// Record an input event which failed to be processed because of an error,
+	// replacing any earlier record for the same event.
+	AddInputDeadLetter(ctx context.Context, deadLetter *types.InputDeadLetter) error
+	// Forget about an input event which failed to be processed.
+	RemoveInputDeadLetter(ctx context.Context, eventID string) error
+	// Look up the recorded failure for an input event, or nil if there isn't one.
+	GetInputDeadLetter(ctx context.Context, eventID string) (*types.InputDeadLetter, error)
+	// Look up at most limit input events which failed to be processed, oldest first.
+	GetInputDeadLetters(ctx context.Context, limit int) ([]types.InputDeadLetter, error)
+	// Record that an event was accepted using partial state, and which server
+	// to ask for the rest of the state before it.
+	RecordPartialStateEvent(ctx context.Context, roomNID types.RoomNID, eventNID types.EventNID, serverName gomatrixserverlib.ServerName) error
+	// Forget that an event had partial state, once its full state is known.
+	RemovePartialStateEvent(ctx context.Context, eventNID types.EventNID) error
+	// Look up all events which are still waiting for their full state.
+	GetPartialStateEvents(ctx context.Context) ([]types.PartialStateEvent, error)
+	// Record that an event was soft-failed, so that it can be re-evaluated later.
+	RecordSoftFailedEvent(ctx context.Context, roomNID types.RoomNID, eventNID types.EventNID, softFailedAt gomatrixserverlib.Timestamp) error
+	// Look up to limit recently soft-failed events in a room, oldest first, having
+	// first forgotten about any which were soft-failed before the given time.
+	GetSoftFailedEventNIDs(ctx context.Context, roomNID types.RoomNID, notBefore gomatrixserverlib.Timestamp, limit int) ([]types.EventNID, error)
+	// Forget that an event was soft-failed.
+	ClearSoftFailedEvent(ctx context.Context, eventNID types.EventNID) error
+	// Look up to limit events in a room which were rejected by auth with NIDs greater than
+	// afterNID, oldest first. Events which were rejected for any other reason, such as being
+	// vetoed or missing prev events, are never returned, since re-running the auth checks
+	// isn't enough to decide whether they should still be rejected.
+	GetRejectedEventNIDs(ctx context.Context, roomNID types.RoomNID, afterNID types.EventNID, limit int) ([]types.EventNID, error)
+	// Mark a rejected event as no longer rejected.
+	UnrejectEvent(ctx context.Context, eventNID types.EventNID) error
+	// Look up the stored JSON for an invite event, including the stripped state in its unsigned section.
+	// Returns sql.ErrNoRows if there is no such invite.
+	GetInviteEventJSON(ctx context.Context, inviteEventID string) ([]byte, error)
 	// Save a given room alias with the room ID it refers to.
 	// Returns an error if there was a problem talking to the database.
 	SetRoomAlias(ctx context.Context, alias string, roomID string, creatorUserID string) error
@@ -127,6 +220,12 @@ type Database interface {
 	// joinOnly is set to true.
 	// Returns an error if there was a problem talking to the database.
 	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool, localOnly bool) ([]types.EventNID, error)
+	// Look up the number of local users who are joined to the room.
+	// Returns an error if there was a problem talking to the database.
+	GetLocalJoinedCount(ctx context.Context, roomNID types.RoomNID) (int, error)
+	// Look up the number of local users who are invited to the room.
+	// Returns an error if there was a problem talking to the database.
+	GetLocalInvitedCount(ctx context.Context, roomNID types.RoomNID) (int, error)
 	// EventsFromIDs looks up the Events for a list of event IDs. Does not error if event was
 	// not found.
 	// Returns an error if the retrieval went wrong.
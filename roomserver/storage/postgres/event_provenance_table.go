@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const eventProvenanceSchema = `
+-- Tracks which server gave us each event that we fetched over federation,
+-- for investigating abuse. Events which were created locally or which were
+-- sent to us aren't recorded here.
+CREATE TABLE IF NOT EXISTS roomserver_event_provenance (
+    -- The event which was fetched
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    -- The server which gave us the event
+    server_name TEXT NOT NULL,
+    -- When we received the event, in milliseconds since the epoch
+    received_at BIGINT NOT NULL
+);
+`
+
+const insertEventProvenanceSQL = "" +
+	"INSERT INTO roomserver_event_provenance (event_nid, server_name, received_at) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectEventProvenanceSQL = "" +
+	"SELECT server_name, received_at FROM roomserver_event_provenance WHERE event_nid = $1"
+
+type eventProvenanceStatements struct {
+	insertEventProvenanceStmt *sql.Stmt
+	selectEventProvenanceStmt *sql.Stmt
+}
+
+func createEventProvenanceTable(db *sql.DB) error {
+	_, err := db.Exec(eventProvenanceSchema)
+	return err
+}
+
+func prepareEventProvenanceTable(db *sql.DB) (tables.EventProvenance, error) {
+	s := &eventProvenanceStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertEventProvenanceStmt, insertEventProvenanceSQL},
+		{&s.selectEventProvenanceStmt, selectEventProvenanceSQL},
+	}.Prepare(db)
+}
+
+func (s *eventProvenanceStatements) InsertEventProvenance(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, serverName gomatrixserverlib.ServerName, receivedAt gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertEventProvenanceStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID), string(serverName), int64(receivedAt))
+	return err
+}
+
+func (s *eventProvenanceStatements) SelectEventProvenance(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) (gomatrixserverlib.ServerName, gomatrixserverlib.Timestamp, error) {
+	var serverName string
+	var receivedAt int64
+	stmt := sqlutil.TxStmt(txn, s.selectEventProvenanceStmt)
+	err := stmt.QueryRowContext(ctx, int64(eventNID)).Scan(&serverName, &receivedAt)
+	return gomatrixserverlib.ServerName(serverName), gomatrixserverlib.Timestamp(receivedAt), err
+}
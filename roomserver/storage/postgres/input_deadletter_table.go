@@ -0,0 +1,149 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const inputDeadLetterSchema = `
+-- Keeps input events which failed to be processed because of an error, rather
+-- than because they were rejected, so that they can be inspected and
+-- re-submitted later.
+CREATE TABLE IF NOT EXISTS roomserver_input_deadletter (
+    -- The ID of the input event
+    event_id TEXT NOT NULL PRIMARY KEY,
+    -- The room that the input event is in
+    room_id TEXT NOT NULL,
+    -- The JSON-encoded InputRoomEvent
+    input_json TEXT NOT NULL,
+    -- The error that processing the input event most recently failed with
+    error TEXT NOT NULL,
+    -- When processing the input event most recently failed, in milliseconds
+    -- since the epoch
+    failed_at BIGINT NOT NULL
+);
+`
+
+const insertInputDeadLetterSQL = "" +
+	"INSERT INTO roomserver_input_deadletter (event_id, room_id, input_json, error, failed_at) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (event_id) DO UPDATE SET input_json = $3, error = $4, failed_at = $5"
+
+const deleteInputDeadLetterSQL = "" +
+	"DELETE FROM roomserver_input_deadletter WHERE event_id = $1"
+
+const selectInputDeadLetterSQL = "" +
+	"SELECT event_id, room_id, input_json, error, failed_at FROM roomserver_input_deadletter WHERE event_id = $1"
+
+const selectInputDeadLettersSQL = "" +
+	"SELECT event_id, room_id, input_json, error, failed_at FROM roomserver_input_deadletter" +
+	" ORDER BY failed_at ASC LIMIT $1"
+
+type inputDeadLetterStatements struct {
+	insertInputDeadLetterStmt  *sql.Stmt
+	deleteInputDeadLetterStmt  *sql.Stmt
+	selectInputDeadLetterStmt  *sql.Stmt
+	selectInputDeadLettersStmt *sql.Stmt
+}
+
+func createInputDeadLetterTable(db *sql.DB) error {
+	_, err := db.Exec(inputDeadLetterSchema)
+	return err
+}
+
+func prepareInputDeadLetterTable(db *sql.DB) (tables.InputDeadLetter, error) {
+	s := &inputDeadLetterStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertInputDeadLetterStmt, insertInputDeadLetterSQL},
+		{&s.deleteInputDeadLetterStmt, deleteInputDeadLetterSQL},
+		{&s.selectInputDeadLetterStmt, selectInputDeadLetterSQL},
+		{&s.selectInputDeadLettersStmt, selectInputDeadLettersSQL},
+	}.Prepare(db)
+}
+
+func (s *inputDeadLetterStatements) InsertInputDeadLetter(
+	ctx context.Context, txn *sql.Tx, deadLetter *types.InputDeadLetter,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertInputDeadLetterStmt)
+	_, err := stmt.ExecContext(
+		ctx, deadLetter.EventID, deadLetter.RoomID, string(deadLetter.InputJSON),
+		deadLetter.Error, int64(deadLetter.FailedAt),
+	)
+	return err
+}
+
+func (s *inputDeadLetterStatements) DeleteInputDeadLetter(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteInputDeadLetterStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *inputDeadLetterStatements) SelectInputDeadLetter(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (*types.InputDeadLetter, error) {
+	var deadLetter types.InputDeadLetter
+	var inputJSON string
+	var failedAt int64
+	stmt := sqlutil.TxStmt(txn, s.selectInputDeadLetterStmt)
+	err := stmt.QueryRowContext(ctx, eventID).Scan(
+		&deadLetter.EventID, &deadLetter.RoomID, &inputJSON, &deadLetter.Error, &failedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	deadLetter.InputJSON = []byte(inputJSON)
+	deadLetter.FailedAt = gomatrixserverlib.Timestamp(failedAt)
+	return &deadLetter, nil
+}
+
+func (s *inputDeadLetterStatements) SelectInputDeadLetters(
+	ctx context.Context, txn *sql.Tx, limit int,
+) ([]types.InputDeadLetter, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectInputDeadLettersStmt)
+	rows, err := stmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectInputDeadLettersStmt: rows.close() failed")
+
+	var deadLetters []types.InputDeadLetter
+	for rows.Next() {
+		var deadLetter types.InputDeadLetter
+		var inputJSON string
+		var failedAt int64
+		if err = rows.Scan(
+			&deadLetter.EventID, &deadLetter.RoomID, &inputJSON, &deadLetter.Error, &failedAt,
+		); err != nil {
+			return nil, err
+		}
+		deadLetter.InputJSON = []byte(inputJSON)
+		deadLetter.FailedAt = gomatrixserverlib.Timestamp(failedAt)
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
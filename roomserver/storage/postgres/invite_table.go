@@ -60,10 +60,18 @@ const insertInviteEventSQL = "" +
 	" sender_nid, invite_event_json) VALUES ($1, $2, $3, $4, $5)" +
 	" ON CONFLICT DO NOTHING"
 
+const selectInviteEventJSONSQL = "" +
+	"SELECT invite_event_json FROM roomserver_invites" +
+	" WHERE invite_event_id = $1"
+
+// Invites are returned oldest first, by the numeric ID of the invite event.
+// Invites whose events haven't been stored come first.
 const selectInviteActiveForUserInRoomSQL = "" +
-	"SELECT invite_event_id, sender_nid FROM roomserver_invites" +
-	" WHERE target_nid = $1 AND room_nid = $2" +
-	" AND NOT retired"
+	"SELECT i.invite_event_id, i.sender_nid FROM roomserver_invites i" +
+	" LEFT JOIN roomserver_events e ON e.event_id = i.invite_event_id" +
+	" WHERE i.target_nid = $1 AND i.room_nid = $2" +
+	" AND NOT i.retired" +
+	" ORDER BY e.event_nid NULLS FIRST"
 
 // Retire every active invite for a user in a room.
 // Ideally we'd know which invite events were retired by a given update so we
@@ -78,6 +86,7 @@ const updateInviteRetiredSQL = "" +
 type inviteStatements struct {
 	insertInviteEventStmt               *sql.Stmt
 	selectInviteActiveForUserInRoomStmt *sql.Stmt
+	selectInviteEventJSONStmt           *sql.Stmt
 	updateInviteRetiredStmt             *sql.Stmt
 }
 
@@ -92,6 +101,7 @@ func prepareInvitesTable(db *sql.DB) (tables.Invites, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertInviteEventStmt, insertInviteEventSQL},
 		{&s.selectInviteActiveForUserInRoomStmt, selectInviteActiveForUserInRoomSQL},
+		{&s.selectInviteEventJSONStmt, selectInviteEventJSONSQL},
 		{&s.updateInviteRetiredStmt, updateInviteRetiredSQL},
 	}.Prepare(db)
 }
@@ -162,3 +172,12 @@ func (s *inviteStatements) SelectInviteActiveForUserInRoom(
 	}
 	return result, eventIDs, rows.Err()
 }
+
+func (s *inviteStatements) SelectInviteEventJSON(
+	ctx context.Context, txn *sql.Tx, inviteEventID string,
+) ([]byte, error) {
+	var inviteEventJSON []byte
+	stmt := sqlutil.TxStmt(txn, s.selectInviteEventJSONStmt)
+	err := stmt.QueryRowContext(ctx, inviteEventID).Scan(&inviteEventJSON)
+	return inviteEventJSON, err
+}
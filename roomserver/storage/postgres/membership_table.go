@@ -90,6 +90,13 @@ const selectLocalMembershipsFromRoomAndMembershipSQL = "" +
 	" WHERE room_nid = $1 AND membership_nid = $2" +
 	" AND target_local = true and forgotten = false"
 
+// selectLocalMembershipCountFromRoomAndMembershipSQL counts the local users with
+// the given membership, for when we don't need the membership events themselves.
+const selectLocalMembershipCountFromRoomAndMembershipSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_membership" +
+	" WHERE room_nid = $1 AND membership_nid = $2" +
+	" AND target_local = true and forgotten = false"
+
 const selectMembershipsFromRoomSQL = "" +
 	"SELECT event_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 and forgotten = false"
@@ -143,20 +150,21 @@ const selectServerInRoomSQL = "" +
 	" WHERE membership_nid = $1 AND room_nid = $2 AND event_state_key LIKE '%:' || $3 LIMIT 1"
 
 type membershipStatements struct {
-	insertMembershipStmt                            *sql.Stmt
-	selectMembershipForUpdateStmt                   *sql.Stmt
-	selectMembershipFromRoomAndTargetStmt           *sql.Stmt
-	selectMembershipsFromRoomAndMembershipStmt      *sql.Stmt
-	selectLocalMembershipsFromRoomAndMembershipStmt *sql.Stmt
-	selectMembershipsFromRoomStmt                   *sql.Stmt
-	selectLocalMembershipsFromRoomStmt              *sql.Stmt
-	updateMembershipStmt                            *sql.Stmt
-	selectRoomsWithMembershipStmt                   *sql.Stmt
-	selectJoinedUsersSetForRoomsStmt                *sql.Stmt
-	selectKnownUsersStmt                            *sql.Stmt
-	updateMembershipForgetRoomStmt                  *sql.Stmt
-	selectLocalServerInRoomStmt                     *sql.Stmt
-	selectServerInRoomStmt                          *sql.Stmt
+	insertMembershipStmt                                *sql.Stmt
+	selectMembershipForUpdateStmt                       *sql.Stmt
+	selectMembershipFromRoomAndTargetStmt               *sql.Stmt
+	selectMembershipsFromRoomAndMembershipStmt          *sql.Stmt
+	selectLocalMembershipsFromRoomAndMembershipStmt     *sql.Stmt
+	selectLocalMembershipCountFromRoomAndMembershipStmt *sql.Stmt
+	selectMembershipsFromRoomStmt                       *sql.Stmt
+	selectLocalMembershipsFromRoomStmt                  *sql.Stmt
+	updateMembershipStmt                                *sql.Stmt
+	selectRoomsWithMembershipStmt                       *sql.Stmt
+	selectJoinedUsersSetForRoomsStmt                    *sql.Stmt
+	selectKnownUsersStmt                                *sql.Stmt
+	updateMembershipForgetRoomStmt                      *sql.Stmt
+	selectLocalServerInRoomStmt                         *sql.Stmt
+	selectServerInRoomStmt                              *sql.Stmt
 }
 
 func createMembershipTable(db *sql.DB) error {
@@ -173,6 +181,7 @@ func prepareMembershipTable(db *sql.DB) (tables.Membership, error) {
 		{&s.selectMembershipFromRoomAndTargetStmt, selectMembershipFromRoomAndTargetSQL},
 		{&s.selectMembershipsFromRoomAndMembershipStmt, selectMembershipsFromRoomAndMembershipSQL},
 		{&s.selectLocalMembershipsFromRoomAndMembershipStmt, selectLocalMembershipsFromRoomAndMembershipSQL},
+		{&s.selectLocalMembershipCountFromRoomAndMembershipStmt, selectLocalMembershipCountFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
 		{&s.selectLocalMembershipsFromRoomStmt, selectLocalMembershipsFromRoomSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
@@ -267,6 +276,16 @@ func (s *membershipStatements) SelectMembershipsFromRoomAndMembership(
 	return eventNIDs, rows.Err()
 }
 
+func (s *membershipStatements) SelectLocalMembershipCountFromRoomAndMembership(
+	ctx context.Context,
+	roomNID types.RoomNID, membership tables.MembershipState,
+) (count int, err error) {
+	err = s.selectLocalMembershipCountFromRoomAndMembershipStmt.QueryRowContext(
+		ctx, roomNID, membership,
+	).Scan(&count)
+	return
+}
+
 func (s *membershipStatements) UpdateMembership(
 	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership tables.MembershipState,
@@ -0,0 +1,125 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const outputEventsSchema = `
+-- Tracks which output events have been emitted for which events, so that
+-- reprocessing an input event doesn't emit the same output event again.
+CREATE TABLE IF NOT EXISTS roomserver_output_events (
+    -- The event ID that the output event was emitted for
+    event_id TEXT NOT NULL,
+    -- The type of the output event, e.g. new_room_event
+    output_type TEXT NOT NULL,
+    -- When the output event was emitted, so that old markers can be pruned
+    sent_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (event_id, output_type)
+);
+CREATE INDEX IF NOT EXISTS roomserver_output_events_sent_at_idx ON roomserver_output_events (sent_at);
+`
+
+const insertOutputEventsSQL = "" +
+	"INSERT INTO roomserver_output_events (event_id, output_type, sent_at)" +
+	" SELECT event_id, output_type, $3 FROM UNNEST($1::TEXT[], $2::TEXT[]) AS keys (event_id, output_type)" +
+	" ON CONFLICT DO NOTHING"
+
+const bulkSelectOutputEventsSQL = "" +
+	"SELECT event_id, output_type FROM roomserver_output_events WHERE event_id = ANY($1)"
+
+const deleteOutputEventsSentBeforeSQL = "" +
+	"DELETE FROM roomserver_output_events WHERE sent_at < $1"
+
+type outputEventsStatements struct {
+	insertOutputEventsStmt           *sql.Stmt
+	bulkSelectOutputEventsStmt       *sql.Stmt
+	deleteOutputEventsSentBeforeStmt *sql.Stmt
+}
+
+func createOutputEventsTable(db *sql.DB) error {
+	_, err := db.Exec(outputEventsSchema)
+	return err
+}
+
+func prepareOutputEventsTable(db *sql.DB) (tables.OutputEvents, error) {
+	s := &outputEventsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertOutputEventsStmt, insertOutputEventsSQL},
+		{&s.bulkSelectOutputEventsStmt, bulkSelectOutputEventsSQL},
+		{&s.deleteOutputEventsSentBeforeStmt, deleteOutputEventsSentBeforeSQL},
+	}.Prepare(db)
+}
+
+func (s *outputEventsStatements) InsertOutputEvents(
+	ctx context.Context, txn *sql.Tx, keys []types.OutputEventKey, sentAt gomatrixserverlib.Timestamp,
+) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(keys))
+	outputTypes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		eventIDs = append(eventIDs, key.EventID)
+		outputTypes = append(outputTypes, key.OutputType)
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertOutputEventsStmt)
+	_, err := stmt.ExecContext(ctx, pq.StringArray(eventIDs), pq.StringArray(outputTypes), sentAt)
+	return err
+}
+
+func (s *outputEventsStatements) BulkSelectOutputEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) ([]types.OutputEventKey, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	stmt := sqlutil.TxStmt(txn, s.bulkSelectOutputEventsStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "BulkSelectOutputEvents: rows.close() failed")
+	var keys []types.OutputEventKey
+	for rows.Next() {
+		var key types.OutputEventKey
+		if err = rows.Scan(&key.EventID, &key.OutputType); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *outputEventsStatements) DeleteOutputEventsSentBefore(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) (int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteOutputEventsSentBeforeStmt)
+	res, err := stmt.ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const roomMaintenanceSchema = `
+-- Tracks which rooms are in maintenance mode. New events for these rooms are
+-- deferred until the room is taken out of maintenance mode.
+CREATE TABLE IF NOT EXISTS roomserver_room_maintenance (
+    -- The room ID of the room in maintenance mode
+    room_id TEXT NOT NULL PRIMARY KEY
+);
+`
+
+const insertRoomMaintenanceSQL = "" +
+	"INSERT INTO roomserver_room_maintenance (room_id) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteRoomMaintenanceSQL = "" +
+	"DELETE FROM roomserver_room_maintenance WHERE room_id = $1"
+
+const selectRoomsInMaintenanceSQL = "" +
+	"SELECT room_id FROM roomserver_room_maintenance"
+
+type roomMaintenanceStatements struct {
+	insertRoomMaintenanceStmt    *sql.Stmt
+	deleteRoomMaintenanceStmt    *sql.Stmt
+	selectRoomsInMaintenanceStmt *sql.Stmt
+}
+
+func createRoomMaintenanceTable(db *sql.DB) error {
+	_, err := db.Exec(roomMaintenanceSchema)
+	return err
+}
+
+func prepareRoomMaintenanceTable(db *sql.DB) (tables.RoomMaintenance, error) {
+	s := &roomMaintenanceStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertRoomMaintenanceStmt, insertRoomMaintenanceSQL},
+		{&s.deleteRoomMaintenanceStmt, deleteRoomMaintenanceSQL},
+		{&s.selectRoomsInMaintenanceStmt, selectRoomsInMaintenanceSQL},
+	}.Prepare(db)
+}
+
+func (s *roomMaintenanceStatements) InsertRoomMaintenance(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertRoomMaintenanceStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *roomMaintenanceStatements) DeleteRoomMaintenance(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRoomMaintenanceStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *roomMaintenanceStatements) SelectRoomsInMaintenance(
+	ctx context.Context, txn *sql.Tx,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomsInMaintenanceStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomsInMaintenanceStmt: rows.close() failed")
+
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
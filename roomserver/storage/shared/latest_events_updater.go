@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -128,6 +129,30 @@ func (u *LatestEventsUpdater) MarkEventAsSent(eventNID types.EventNID) error {
 	})
 }
 
+// OutputEventsSent returns which of the given output events have already
+// been emitted.
+func (u *LatestEventsUpdater) OutputEventsSent(keys []types.OutputEventKey) (map[types.OutputEventKey]bool, error) {
+	return u.d.outputEventsSent(u.ctx, u.txn, keys)
+}
+
+// MarkOutputEventsAsSent records that the given output events have been
+// emitted.
+func (u *LatestEventsUpdater) MarkOutputEventsAsSent(keys []types.OutputEventKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		return u.d.OutputEventsTable.InsertOutputEvents(u.ctx, txn, keys, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
+
+// RecordStateRewind stores a record of the current state of the room being rewound.
+func (u *LatestEventsUpdater) RecordStateRewind(rewind *types.StateRewind) error {
+	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		return u.d.StateRewindsTable.InsertStateRewind(u.ctx, txn, rewind)
+	})
+}
+
 func (u *LatestEventsUpdater) MembershipUpdater(targetUserNID types.EventStateKeyNID, targetLocal bool) (*MembershipUpdater, error) {
 	return u.d.membershipUpdaterTxn(u.ctx, u.txn, u.roomInfo.RoomNID, targetUserNID, targetLocal)
 }
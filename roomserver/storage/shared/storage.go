@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -42,6 +44,14 @@ type Database struct {
 	MembershipTable            tables.Membership
 	PublishedTable             tables.Published
 	RedactionsTable            tables.Redactions
+	OutputEventsTable          tables.OutputEvents
+	RoomMaintenanceTable       tables.RoomMaintenance
+	StateRewindsTable          tables.StateRewinds
+	SoftFailedEventsTable      tables.SoftFailedEvents
+	PendingInputTable          tables.PendingInput
+	EventProvenanceTable       tables.EventProvenance
+	InputDeadLetterTable       tables.InputDeadLetter
+	PartialStateEventsTable    tables.PartialStateEvents
 	GetLatestEventsForUpdateFn func(ctx context.Context, roomInfo types.RoomInfo) (*LatestEventsUpdater, error)
 }
 
@@ -205,7 +215,69 @@ func (d *Database) AddState(
 func (d *Database) EventNIDs(
 	ctx context.Context, eventIDs []string,
 ) (map[string]types.EventNID, error) {
-	return d.EventsTable.BulkSelectEventNID(ctx, eventIDs)
+	return d.EventsTable.BulkSelectEventNID(ctx, nil, eventIDs)
+}
+
+func (d *Database) EventDepths(
+	ctx context.Context, eventIDs []string,
+) (map[string]int64, error) {
+	return d.EventsTable.BulkSelectEventDepth(ctx, eventIDs)
+}
+
+func (d *Database) RoomEventNIDsAfter(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRoomEventNIDsAfter(ctx, roomNID, afterEventNID, limit)
+}
+
+func (d *Database) RoomEventNIDsOfType(
+	ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRoomEventNIDsOfType(ctx, roomNID, eventTypeNID)
+}
+
+func (d *Database) RedactionInfo(ctx context.Context, redactionEventID string) (*tables.RedactionInfo, error) {
+	return d.RedactionsTable.SelectRedactionInfoByRedactionEventID(ctx, nil, redactionEventID)
+}
+
+// EventProvenance returns which server gave us the event and when, if it was
+// fetched over federation. The server name is empty if it wasn't recorded.
+func (d *Database) EventProvenance(
+	ctx context.Context, eventID string,
+) (exists bool, serverName gomatrixserverlib.ServerName, receivedAt gomatrixserverlib.Timestamp, err error) {
+	eventNIDs, err := d.EventNIDs(ctx, []string{eventID})
+	if err != nil {
+		return false, "", 0, err
+	}
+	eventNID, ok := eventNIDs[eventID]
+	if !ok {
+		return false, "", 0, nil
+	}
+	serverName, receivedAt, err = d.EventProvenanceTable.SelectEventProvenance(ctx, nil, eventNID)
+	if err == sql.ErrNoRows {
+		return true, "", 0, nil
+	}
+	if err != nil {
+		return false, "", 0, err
+	}
+	return true, serverName, receivedAt, nil
+}
+
+func (d *Database) EventRejectionReason(
+	ctx context.Context, eventID string,
+) (exists, isRejected bool, rejectionReason string, err error) {
+	isRejected, rejectionReason, err = d.EventsTable.SelectEventRejectionReason(ctx, nil, eventID)
+	if err == sql.ErrNoRows {
+		return false, false, "", nil
+	}
+	if err != nil {
+		return false, false, "", err
+	}
+	return true, isRejected, rejectionReason, nil
+}
+
+func (d *Database) EventSentToOutput(ctx context.Context, eventNID types.EventNID) (bool, error) {
+	return d.EventsTable.SelectEventSentToOutput(ctx, nil, eventNID)
 }
 
 func (d *Database) SetState(
@@ -326,7 +398,7 @@ func (d *Database) RemoveRoomAlias(ctx context.Context, alias string) error {
 func (d *Database) GetMembership(ctx context.Context, roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom, isRoomforgotten bool, err error) {
 	var requestSenderUserNID types.EventStateKeyNID
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		requestSenderUserNID, err = d.assignStateKeyNID(ctx, txn, requestSenderUserID)
+		requestSenderUserNID, err = d.assignStateKeyNID(ctx, txn, nil, requestSenderUserID)
 		return err
 	})
 	if err != nil {
@@ -359,6 +431,27 @@ func (d *Database) GetMembershipEventNIDsForRoom(
 	return d.MembershipTable.SelectMembershipsFromRoom(ctx, roomNID, localOnly)
 }
 
+// GetLocalJoinedCount returns the number of local users who are joined to the
+// room. This is cheaper than GetMembershipEventNIDsForRoom when we don't need
+// the membership events themselves.
+func (d *Database) GetLocalJoinedCount(
+	ctx context.Context, roomNID types.RoomNID,
+) (int, error) {
+	return d.MembershipTable.SelectLocalMembershipCountFromRoomAndMembership(
+		ctx, roomNID, tables.MembershipStateJoin,
+	)
+}
+
+// GetLocalInvitedCount returns the number of local users who have a pending
+// invite to the room.
+func (d *Database) GetLocalInvitedCount(
+	ctx context.Context, roomNID types.RoomNID,
+) (int, error) {
+	return d.MembershipTable.SelectLocalMembershipCountFromRoomAndMembership(
+		ctx, roomNID, tables.MembershipStateInvite,
+	)
+}
+
 func (d *Database) GetInvitesForUser(
 	ctx context.Context,
 	roomNID types.RoomNID,
@@ -367,10 +460,174 @@ func (d *Database) GetInvitesForUser(
 	return d.InvitesTable.SelectInviteActiveForUserInRoom(ctx, targetUserNID, roomNID)
 }
 
+func (d *Database) OutputEventsSent(
+	ctx context.Context, keys []types.OutputEventKey,
+) (map[types.OutputEventKey]bool, error) {
+	return d.outputEventsSent(ctx, nil, keys)
+}
+
+func (d *Database) outputEventsSent(
+	ctx context.Context, txn *sql.Tx, keys []types.OutputEventKey,
+) (map[types.OutputEventKey]bool, error) {
+	eventIDs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		eventIDs = append(eventIDs, key.EventID)
+	}
+	sentKeys, err := d.OutputEventsTable.BulkSelectOutputEvents(ctx, txn, util.UniqueStrings(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	sent := make(map[types.OutputEventKey]bool, len(sentKeys))
+	for _, key := range sentKeys {
+		sent[key] = true
+	}
+	return sent, nil
+}
+
+func (d *Database) MarkOutputEventsAsSent(
+	ctx context.Context, keys []types.OutputEventKey,
+) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.OutputEventsTable.InsertOutputEvents(ctx, txn, keys, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
+
+func (d *Database) PruneOutputEvents(
+	ctx context.Context, before time.Time,
+) (pruned int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pruned, err = d.OutputEventsTable.DeleteOutputEventsSentBefore(ctx, txn, gomatrixserverlib.AsTimestamp(before))
+		return err
+	})
+	return
+}
+
+func (d *Database) SetRoomMaintenance(
+	ctx context.Context, roomID string, enabled bool,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if enabled {
+			return d.RoomMaintenanceTable.InsertRoomMaintenance(ctx, txn, roomID)
+		}
+		return d.RoomMaintenanceTable.DeleteRoomMaintenance(ctx, txn, roomID)
+	})
+}
+
+func (d *Database) GetRoomsInMaintenance(ctx context.Context) ([]string, error) {
+	return d.RoomMaintenanceTable.SelectRoomsInMaintenance(ctx, nil)
+}
+
+func (d *Database) GetStateRewinds(ctx context.Context, roomID string) ([]types.StateRewind, error) {
+	return d.StateRewindsTable.SelectStateRewindsForRoom(ctx, nil, roomID)
+}
+
+func (d *Database) AddPendingInput(
+	ctx context.Context, roomID, eventID string, inputJSON []byte, queuedAt gomatrixserverlib.Timestamp,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PendingInputTable.InsertPendingInput(ctx, txn, roomID, eventID, inputJSON, queuedAt)
+	})
+}
+
+func (d *Database) RemovePendingInput(ctx context.Context, eventID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PendingInputTable.DeletePendingInput(ctx, txn, eventID)
+	})
+}
+
+func (d *Database) GetPendingInput(ctx context.Context) ([][]byte, error) {
+	return d.PendingInputTable.SelectPendingInput(ctx, nil)
+}
+
+func (d *Database) AddInputDeadLetter(ctx context.Context, deadLetter *types.InputDeadLetter) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.InputDeadLetterTable.InsertInputDeadLetter(ctx, txn, deadLetter)
+	})
+}
+
+func (d *Database) RemoveInputDeadLetter(ctx context.Context, eventID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.InputDeadLetterTable.DeleteInputDeadLetter(ctx, txn, eventID)
+	})
+}
+
+func (d *Database) GetInputDeadLetter(ctx context.Context, eventID string) (*types.InputDeadLetter, error) {
+	return d.InputDeadLetterTable.SelectInputDeadLetter(ctx, nil, eventID)
+}
+
+func (d *Database) GetInputDeadLetters(ctx context.Context, limit int) ([]types.InputDeadLetter, error) {
+	return d.InputDeadLetterTable.SelectInputDeadLetters(ctx, nil, limit)
+}
+
+func (d *Database) RecordPartialStateEvent(
+	ctx context.Context, roomNID types.RoomNID, eventNID types.EventNID, serverName gomatrixserverlib.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PartialStateEventsTable.InsertPartialStateEvent(ctx, txn, roomNID, eventNID, serverName)
+	})
+}
+
+func (d *Database) RemovePartialStateEvent(ctx context.Context, eventNID types.EventNID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PartialStateEventsTable.DeletePartialStateEvent(ctx, txn, eventNID)
+	})
+}
+
+func (d *Database) GetPartialStateEvents(ctx context.Context) ([]types.PartialStateEvent, error) {
+	return d.PartialStateEventsTable.SelectPartialStateEvents(ctx, nil)
+}
+
+func (d *Database) RecordSoftFailedEvent(
+	ctx context.Context, roomNID types.RoomNID, eventNID types.EventNID, softFailedAt gomatrixserverlib.Timestamp,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.SoftFailedEventsTable.InsertSoftFailedEvent(ctx, txn, roomNID, eventNID, softFailedAt)
+	})
+}
+
+func (d *Database) GetSoftFailedEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, notBefore gomatrixserverlib.Timestamp, limit int,
+) ([]types.EventNID, error) {
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.SoftFailedEventsTable.DeleteSoftFailedEventsBefore(ctx, txn, roomNID, notBefore)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("d.SoftFailedEventsTable.DeleteSoftFailedEventsBefore: %w", err)
+	}
+	return d.SoftFailedEventsTable.SelectSoftFailedEventNIDs(ctx, nil, roomNID, limit)
+}
+
+func (d *Database) ClearSoftFailedEvent(ctx context.Context, eventNID types.EventNID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.SoftFailedEventsTable.DeleteSoftFailedEvent(ctx, txn, eventNID)
+	})
+}
+
+func (d *Database) GetRejectedEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, afterNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRejectedRoomEventNIDs(ctx, roomNID, afterNID, limit)
+}
+
+func (d *Database) UnrejectEvent(ctx context.Context, eventNID types.EventNID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EventsTable.UpdateEventUnrejected(ctx, txn, eventNID)
+	})
+}
+
+func (d *Database) GetInviteEventJSON(
+	ctx context.Context, inviteEventID string,
+) ([]byte, error) {
+	return d.InvitesTable.SelectInviteEventJSON(ctx, nil, inviteEventID)
+}
+
 func (d *Database) Events(
 	ctx context.Context, eventNIDs []types.EventNID,
 ) ([]types.Event, error) {
-	eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, eventNIDs)
+	eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, nil, eventNIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -460,86 +717,28 @@ func (d *Database) GetLatestEventsForUpdate(
 
 func (d *Database) StoreEvent(
 	ctx context.Context, event *gomatrixserverlib.Event,
-	authEventNIDs []types.EventNID, isRejected bool,
+	authEventNIDs []types.EventNID, isRejected, rejectedByAuth bool, rejectionReason string,
 ) (types.EventNID, types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
 	var (
-		roomNID          types.RoomNID
-		eventTypeNID     types.EventTypeNID
-		eventStateKeyNID types.EventStateKeyNID
-		eventNID         types.EventNID
-		stateNID         types.StateSnapshotNID
-		redactionEvent   *gomatrixserverlib.Event
-		redactedEventID  string
-		err              error
+		roomNID         types.RoomNID
+		stateAtEvent    types.StateAtEvent
+		redactionEvent  *gomatrixserverlib.Event
+		redactedEventID string
+		err             error
 	)
 
+	assigned := &assignedNIDs{}
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		// TODO: Here we should aim to have two different code paths for new rooms
-		// vs existing ones.
-
-		// Get the default room version. If the client doesn't supply a room_version
-		// then we will use our configured default to create the room.
-		// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-createroom
-		// Note that the below logic depends on the m.room.create event being the
-		// first event that is persisted to the database when creating or joining a
-		// room.
-		var roomVersion gomatrixserverlib.RoomVersion
-		if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
-			return fmt.Errorf("extractRoomVersionFromCreateEvent: %w", err)
-		}
-
-		if roomNID, err = d.assignRoomNID(ctx, txn, event.RoomID(), roomVersion); err != nil {
-			return fmt.Errorf("d.assignRoomNID: %w", err)
-		}
-
-		if eventTypeNID, err = d.assignEventTypeNID(ctx, txn, event.Type()); err != nil {
-			return fmt.Errorf("d.assignEventTypeNID: %w", err)
-		}
-
-		eventStateKey := event.StateKey()
-		// Assigned a numeric ID for the state_key if there is one present.
-		// Otherwise set the numeric ID for the state_key to 0.
-		if eventStateKey != nil {
-			if eventStateKeyNID, err = d.assignStateKeyNID(ctx, txn, *eventStateKey); err != nil {
-				return fmt.Errorf("d.assignStateKeyNID: %w", err)
-			}
-		}
-
-		if eventNID, stateNID, err = d.EventsTable.InsertEvent(
-			ctx,
-			txn,
-			roomNID,
-			eventTypeNID,
-			eventStateKeyNID,
-			event.EventID(),
-			event.EventReference().EventSHA256,
-			authEventNIDs,
-			event.Depth(),
-			isRejected,
-		); err != nil {
-			if err == sql.ErrNoRows {
-				// We've already inserted the event so select the numeric event ID
-				eventNID, stateNID, err = d.EventsTable.SelectEvent(ctx, txn, event.EventID())
-			}
-			if err != nil {
-				return fmt.Errorf("d.EventsTable.SelectEvent: %w", err)
-			}
-		}
-
-		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
-			return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
-		}
-		if !isRejected { // ignore rejected redaction events
-			redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
-			if err != nil {
-				return fmt.Errorf("d.handleRedactions: %w", err)
-			}
-		}
-		return nil
+		roomNID, stateAtEvent, redactionEvent, redactedEventID, err = d.storeEvent(
+			ctx, txn, assigned, event, authEventNIDs, isRejected, rejectedByAuth, rejectionReason,
+		)
+		return err
 	})
 	if err != nil {
 		return 0, 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.Writer.Do: %w", err)
 	}
+	assigned.storeInCache(d.Cache)
+	eventNID := stateAtEvent.EventNID
 
 	// We should attempt to update the previous events table with any
 	// references that this new event makes. We do this using a latest
@@ -584,7 +783,149 @@ func (d *Database) StoreEvent(
 		}
 	}
 
-	return eventNID, roomNID, types.StateAtEvent{
+	return eventNID, roomNID, stateAtEvent, redactionEvent, redactedEventID, err
+}
+
+// StoreEvents stores the events in a single transaction, in the order that
+// they are given, which must be an order in which every event comes after
+// its auth events. The auth events of each event must either be in knownNIDs
+// or earlier in events. Either all of the events are stored or none of them
+// are. The server which supplied each event is recorded, if given. Returns
+// the numeric IDs of the events, in the same order.
+//
+// This is meant for storing auth chains as outliers, so unlike StoreEvent,
+// the prev events of the events aren't locked against the latest events of
+// the room while they are stored.
+func (d *Database) StoreEvents(
+	ctx context.Context, events []types.EventToStore, knownNIDs map[string]types.EventNID,
+) ([]types.EventNID, error) {
+	eventNIDs := make([]types.EventNID, len(events))
+	receivedAt := gomatrixserverlib.AsTimestamp(time.Now())
+	assigned := &assignedNIDs{}
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		nids := make(map[string]types.EventNID, len(knownNIDs)+len(events))
+		for eventID, eventNID := range knownNIDs {
+			nids[eventID] = eventNID
+		}
+		for i, ev := range events {
+			authEventNIDs := make([]types.EventNID, 0, len(ev.Event.AuthEventIDs()))
+			for _, authEventID := range ev.Event.AuthEventIDs() {
+				authEventNID, ok := nids[authEventID]
+				if !ok {
+					return fmt.Errorf("missing auth event %s for %s", authEventID, ev.Event.EventID())
+				}
+				authEventNIDs = append(authEventNIDs, authEventNID)
+			}
+			_, stateAtEvent, _, _, err := d.storeEvent(
+				ctx, txn, assigned, ev.Event, authEventNIDs, ev.IsRejected, ev.RejectedByAuth, ev.RejectionReason,
+			)
+			if err != nil {
+				return fmt.Errorf("d.storeEvent: %w", err)
+			}
+			for _, ref := range ev.Event.PrevEvents() {
+				if err = d.PrevEventsTable.InsertPreviousEvent(ctx, txn, ref.EventID, ref.EventSHA256, stateAtEvent.EventNID); err != nil {
+					return fmt.Errorf("d.PrevEventsTable.InsertPreviousEvent: %w", err)
+				}
+			}
+			if ev.SuppliedBy != "" {
+				if err = d.EventProvenanceTable.InsertEventProvenance(ctx, txn, stateAtEvent.EventNID, ev.SuppliedBy, receivedAt); err != nil {
+					return fmt.Errorf("d.EventProvenanceTable.InsertEventProvenance: %w", err)
+				}
+			}
+			eventNIDs[i] = stateAtEvent.EventNID
+			nids[ev.Event.EventID()] = stateAtEvent.EventNID
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("d.Writer.Do: %w", err)
+	}
+	assigned.storeInCache(d.Cache)
+	return eventNIDs, nil
+}
+
+// storeEvent stores the event in the given transaction. It doesn't store the
+// prev events of the event. The numeric IDs for the event type and state key
+// are collected in assigned rather than cached, so that the caller can cache
+// them once the transaction has committed.
+func (d *Database) storeEvent(
+	ctx context.Context, txn *sql.Tx, assigned *assignedNIDs, event *gomatrixserverlib.Event,
+	authEventNIDs []types.EventNID, isRejected, rejectedByAuth bool, rejectionReason string,
+) (
+	roomNID types.RoomNID, stateAtEvent types.StateAtEvent,
+	redactionEvent *gomatrixserverlib.Event, redactedEventID string, err error,
+) {
+	var (
+		eventTypeNID     types.EventTypeNID
+		eventStateKeyNID types.EventStateKeyNID
+		eventNID         types.EventNID
+		stateNID         types.StateSnapshotNID
+	)
+
+	// TODO: Here we should aim to have two different code paths for new rooms
+	// vs existing ones.
+
+	// Get the default room version. If the client doesn't supply a room_version
+	// then we will use our configured default to create the room.
+	// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-createroom
+	// Note that the below logic depends on the m.room.create event being the
+	// first event that is persisted to the database when creating or joining a
+	// room.
+	var roomVersion gomatrixserverlib.RoomVersion
+	if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
+		return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("extractRoomVersionFromCreateEvent: %w", err)
+	}
+
+	if roomNID, err = d.assignRoomNID(ctx, txn, event.RoomID(), roomVersion); err != nil {
+		return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.assignRoomNID: %w", err)
+	}
+
+	if eventTypeNID, err = d.assignEventTypeNID(ctx, txn, assigned, event.Type()); err != nil {
+		return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.assignEventTypeNID: %w", err)
+	}
+
+	eventStateKey := event.StateKey()
+	// Assigned a numeric ID for the state_key if there is one present.
+	// Otherwise set the numeric ID for the state_key to 0.
+	if eventStateKey != nil {
+		if eventStateKeyNID, err = d.assignStateKeyNID(ctx, txn, assigned, *eventStateKey); err != nil {
+			return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.assignStateKeyNID: %w", err)
+		}
+	}
+
+	if eventNID, stateNID, err = d.EventsTable.InsertEvent(
+		ctx,
+		txn,
+		roomNID,
+		eventTypeNID,
+		eventStateKeyNID,
+		event.EventID(),
+		event.EventReference().EventSHA256,
+		authEventNIDs,
+		event.Depth(),
+		isRejected,
+		rejectedByAuth,
+		rejectionReason,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			// We've already inserted the event so select the numeric event ID
+			eventNID, stateNID, err = d.EventsTable.SelectEvent(ctx, txn, event.EventID())
+		}
+		if err != nil {
+			return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.EventsTable.SelectEvent: %w", err)
+		}
+	}
+
+	if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
+		return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+	}
+	if !isRejected { // ignore rejected redaction events
+		redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
+		if err != nil {
+			return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.handleRedactions: %w", err)
+		}
+	}
+	return roomNID, types.StateAtEvent{
 		BeforeStateSnapshotNID: stateNID,
 		StateEntry: types.StateEntry{
 			StateKeyTuple: types.StateKeyTuple{
@@ -593,7 +934,7 @@ func (d *Database) StoreEvent(
 			},
 			EventNID: eventNID,
 		},
-	}, redactionEvent, redactedEventID, err
+	}, redactionEvent, redactedEventID, nil
 }
 
 func (d *Database) PublishRoom(ctx context.Context, roomID string, publish bool) error {
@@ -626,9 +967,51 @@ func (d *Database) assignRoomNID(
 	return roomNID, err
 }
 
+// assignedNIDs collects the numeric IDs for event types and state keys which
+// were looked up or assigned in a transaction. They are only cached once the
+// transaction has committed, as otherwise rolling it back would leave numeric
+// IDs in the cache which don't exist in the database.
+type assignedNIDs struct {
+	eventTypes     map[string]types.EventTypeNID
+	eventStateKeys map[string]types.EventStateKeyNID
+}
+
+func (a *assignedNIDs) addEventTypeNID(eventType string, eventTypeNID types.EventTypeNID) {
+	if a.eventTypes == nil {
+		a.eventTypes = make(map[string]types.EventTypeNID)
+	}
+	a.eventTypes[eventType] = eventTypeNID
+}
+
+func (a *assignedNIDs) addStateKeyNID(eventStateKey string, eventStateKeyNID types.EventStateKeyNID) {
+	if a.eventStateKeys == nil {
+		a.eventStateKeys = make(map[string]types.EventStateKeyNID)
+	}
+	a.eventStateKeys[eventStateKey] = eventStateKeyNID
+}
+
+// storeInCache caches the collected numeric IDs. It must only be called once
+// the transaction that they were assigned in has committed.
+func (a *assignedNIDs) storeInCache(cache caching.RoomServerNIDsCache) {
+	for eventType, eventTypeNID := range a.eventTypes {
+		cache.StoreRoomServerEventTypeNID(eventType, eventTypeNID)
+	}
+	for eventStateKey, eventStateKeyNID := range a.eventStateKeys {
+		cache.StoreRoomServerStateKeyNID(eventStateKey, eventStateKeyNID)
+	}
+}
+
+// assignEventTypeNID looks up or assigns the numeric ID for an event type. If
+// assigned is nil then the numeric ID is cached straight away, otherwise it is
+// collected in assigned to be cached later.
 func (d *Database) assignEventTypeNID(
-	ctx context.Context, txn *sql.Tx, eventType string,
+	ctx context.Context, txn *sql.Tx, assigned *assignedNIDs, eventType string,
 ) (types.EventTypeNID, error) {
+	if assigned != nil {
+		if eventTypeNID, ok := assigned.eventTypes[eventType]; ok {
+			return eventTypeNID, nil
+		}
+	}
 	if eventTypeNID, ok := d.Cache.GetRoomServerEventTypeNID(eventType); ok {
 		return eventTypeNID, nil
 	}
@@ -643,14 +1026,26 @@ func (d *Database) assignEventTypeNID(
 		}
 	}
 	if err == nil {
-		d.Cache.StoreRoomServerEventTypeNID(eventType, eventTypeNID)
+		if assigned != nil {
+			assigned.addEventTypeNID(eventType, eventTypeNID)
+		} else {
+			d.Cache.StoreRoomServerEventTypeNID(eventType, eventTypeNID)
+		}
 	}
 	return eventTypeNID, err
 }
 
+// assignStateKeyNID looks up or assigns the numeric ID for a state key. If
+// assigned is nil then the numeric ID is cached straight away, otherwise it is
+// collected in assigned to be cached later.
 func (d *Database) assignStateKeyNID(
-	ctx context.Context, txn *sql.Tx, eventStateKey string,
+	ctx context.Context, txn *sql.Tx, assigned *assignedNIDs, eventStateKey string,
 ) (types.EventStateKeyNID, error) {
+	if assigned != nil {
+		if eventStateKeyNID, ok := assigned.eventStateKeys[eventStateKey]; ok {
+			return eventStateKeyNID, nil
+		}
+	}
 	if eventStateKeyNID, ok := d.Cache.GetRoomServerStateKeyNID(eventStateKey); ok {
 		return eventStateKeyNID, nil
 	}
@@ -665,7 +1060,11 @@ func (d *Database) assignStateKeyNID(
 		}
 	}
 	if err == nil {
-		d.Cache.StoreRoomServerStateKeyNID(eventStateKey, eventStateKeyNID)
+		if assigned != nil {
+			assigned.addStateKeyNID(eventStateKey, eventStateKeyNID)
+		} else {
+			d.Cache.StoreRoomServerStateKeyNID(eventStateKey, eventStateKeyNID)
+		}
 	}
 	return eventStateKeyNID, err
 }
@@ -741,15 +1140,28 @@ func (d *Database) handleRedactions(
 		// redactions across rooms aren't allowed
 		return nil, "", nil
 	}
+	if !isRedactionEvent {
+		// the redaction arrived before the event it redacts, so the input
+		// path couldn't check that its sender is allowed to redact it
+		allowed, err := d.redactionAllowed(ctx, txn, redactionEvent.Event, redactedEvent.Event)
+		if err != nil {
+			return nil, "", fmt.Errorf("d.redactionAllowed: %w", err)
+		}
+		if !allowed {
+			// leave the redaction unvalidated and the event as it is
+			return nil, "", nil
+		}
+	}
 
-	// mark the event as redacted
+	// mark the event as redacted, after redacting it so that the marker
+	// isn't stripped along with everything else
+	if redactionsArePermanent {
+		redactedEvent.Event = redactedEvent.Redact()
+	}
 	err = redactedEvent.SetUnsignedField("redacted_because", redactionEvent)
 	if err != nil {
 		return nil, "", fmt.Errorf("redactedEvent.SetUnsignedField: %w", err)
 	}
-	if redactionsArePermanent {
-		redactedEvent.Event = redactedEvent.Redact()
-	}
 	// overwrite the eventJSON table
 	err = d.EventJSONTable.InsertEventJSON(ctx, txn, redactedEvent.EventNID, redactedEvent.JSON())
 	if err != nil {
@@ -764,6 +1176,40 @@ func (d *Database) handleRedactions(
 	return redactionEvent.Event, redactedEvent.EventID(), err
 }
 
+// redactionAllowed returns whether the sender of the redaction event is allowed to
+// redact the redacted event, according to the power levels in the auth events of
+// the redaction. The auth events are read within the given transaction.
+func (d *Database) redactionAllowed(
+	ctx context.Context, txn *sql.Tx, redactionEvent, redactedEvent *gomatrixserverlib.Event,
+) (bool, error) {
+	nidMap, err := d.EventsTable.BulkSelectEventNID(ctx, txn, redactionEvent.AuthEventIDs())
+	if err != nil {
+		return false, fmt.Errorf("d.EventsTable.BulkSelectEventNID: %w", err)
+	}
+	eventIDs := make(map[types.EventNID]string, len(nidMap))
+	eventNIDs := make([]types.EventNID, 0, len(nidMap))
+	for eventID, eventNID := range nidMap {
+		eventIDs[eventNID] = eventID
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, txn, eventNIDs)
+	if err != nil {
+		return false, fmt.Errorf("d.EventJSONTable.BulkSelectEventJSON: %w", err)
+	}
+	authEvents := make([]*gomatrixserverlib.Event, 0, len(eventJSONs))
+	for _, eventJSON := range eventJSONs {
+		// the auth events are in the same room, so share the redaction's room version
+		authEvent, err := gomatrixserverlib.NewEventFromTrustedJSONWithEventID(
+			eventIDs[eventJSON.EventNID], eventJSON.EventJSON, false, redactionEvent.Version(),
+		)
+		if err != nil {
+			return false, fmt.Errorf("gomatrixserverlib.NewEventFromTrustedJSONWithEventID: %w", err)
+		}
+		authEvents = append(authEvents, authEvent)
+	}
+	return eventutil.RedactionAllowed(redactionEvent, redactedEvent, authEvents)
+}
+
 // loadRedactionPair returns both the redaction event and the redacted event, else nil.
 func (d *Database) loadRedactionPair(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, event *gomatrixserverlib.Event,
@@ -882,7 +1328,7 @@ func (d *Database) GetStateEvent(ctx context.Context, roomID, evType, stateKey s
 	// return the event requested
 	for _, e := range entries {
 		if e.EventTypeNID == eventTypeNID && e.EventStateKeyNID == stateKeyNID {
-			data, err := d.EventJSONTable.BulkSelectEventJSON(ctx, []types.EventNID{e.EventNID})
+			data, err := d.EventJSONTable.BulkSelectEventJSON(ctx, nil, []types.EventNID{e.EventNID})
 			if err != nil {
 				return nil, err
 			}
@@ -1003,7 +1449,7 @@ func (d *Database) GetBulkStateContent(ctx context.Context, roomIDs []string, tu
 	if err != nil {
 		eventIDs = map[types.EventNID]string{}
 	}
-	events, err := d.EventJSONTable.BulkSelectEventJSON(ctx, eventNIDs)
+	events, err := d.EventJSONTable.BulkSelectEventJSON(ctx, nil, eventNIDs)
 	if err != nil {
 		return nil, fmt.Errorf("GetBulkStateContent: failed to load event JSON for event nids: %w", err)
 	}
@@ -0,0 +1,54 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAddRejectedByAuth(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddRejectedByAuth, DownAddRejectedByAuth)
+}
+
+// UpAddRejectedByAuth adds the rejected_by_auth column. We can't tell why
+// events which were already rejected were rejected, so they are left as not
+// rejected by auth and won't be reprocessed.
+func UpAddRejectedByAuth(tx *sql.Tx) error {
+	// SQLite doesn't support ADD COLUMN IF NOT EXISTS, and the column will
+	// already exist if the table was created with the latest schema.
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('roomserver_events') WHERE name = 'rejected_by_auth';`).Scan(&count); err != nil {
+		return fmt.Errorf("tx.QueryRow.Scan: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := tx.Exec(`ALTER TABLE roomserver_events ADD COLUMN rejected_by_auth BOOLEAN NOT NULL DEFAULT FALSE;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddRejectedByAuth(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE roomserver_events DROP COLUMN rejected_by_auth;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -42,13 +42,15 @@ const eventsSchema = `
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
 	auth_event_nids TEXT NOT NULL DEFAULT '[]',
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	rejection_reason TEXT,
+	rejected_by_auth BOOLEAN NOT NULL DEFAULT FALSE
   );
 `
 
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected, rejection_reason, rejected_by_auth)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	  ON CONFLICT DO NOTHING
 	  RETURNING event_nid, state_snapshot_nid;
 `
@@ -76,6 +78,9 @@ const bulkSelectStateAtEventByIDSQL = "" +
 const updateEventStateSQL = "" +
 	"UPDATE roomserver_events SET state_snapshot_nid = $1 WHERE event_nid = $2"
 
+const selectEventRejectionReasonSQL = "" +
+	"SELECT is_rejected, COALESCE(rejection_reason, '') FROM roomserver_events WHERE event_id = $1"
+
 const selectEventSentToOutputSQL = "" +
 	"SELECT sent_to_output FROM roomserver_events WHERE event_nid = $1"
 
@@ -98,9 +103,27 @@ const bulkSelectEventIDSQL = "" +
 const bulkSelectEventNIDSQL = "" +
 	"SELECT event_id, event_nid FROM roomserver_events WHERE event_id IN ($1)"
 
+const bulkSelectEventDepthSQL = "" +
+	"SELECT event_id, depth FROM roomserver_events WHERE event_id IN ($1)"
+
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid IN ($1)"
 
+const selectRoomEventNIDsAfterSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND event_nid > $2" +
+	" ORDER BY event_nid ASC LIMIT $3"
+
+const selectRoomEventNIDsOfTypeSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND event_type_nid = $2" +
+	" ORDER BY event_nid ASC"
+
+const selectRejectedRoomEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND is_rejected = TRUE AND rejected_by_auth = TRUE" +
+	" AND event_nid > $2 ORDER BY event_nid ASC LIMIT $3"
+
+const updateEventUnrejectedSQL = "" +
+	"UPDATE roomserver_events SET is_rejected = FALSE, rejection_reason = NULL, rejected_by_auth = FALSE WHERE event_nid = $1"
+
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid IN ($1)"
 
@@ -111,6 +134,7 @@ type eventStatements struct {
 	bulkSelectStateEventByIDStmt           *sql.Stmt
 	bulkSelectStateAtEventByIDStmt         *sql.Stmt
 	updateEventStateStmt                   *sql.Stmt
+	selectEventRejectionReasonStmt         *sql.Stmt
 	selectEventSentToOutputStmt            *sql.Stmt
 	updateEventSentToOutputStmt            *sql.Stmt
 	selectEventIDStmt                      *sql.Stmt
@@ -118,6 +142,10 @@ type eventStatements struct {
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
+	selectRoomEventNIDsAfterStmt           *sql.Stmt
+	selectRoomEventNIDsOfTypeStmt          *sql.Stmt
+	selectRejectedRoomEventNIDsStmt        *sql.Stmt
+	updateEventUnrejectedStmt              *sql.Stmt
 	//selectRoomNIDsForEventNIDsStmt           *sql.Stmt
 }
 
@@ -138,12 +166,17 @@ func prepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
+		{&s.selectEventRejectionReasonStmt, selectEventRejectionReasonSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
+		{&s.selectRoomEventNIDsAfterStmt, selectRoomEventNIDsAfterSQL},
+		{&s.selectRoomEventNIDsOfTypeStmt, selectRoomEventNIDsOfTypeSQL},
+		{&s.selectRejectedRoomEventNIDsStmt, selectRejectedRoomEventNIDsSQL},
+		{&s.updateEventUnrejectedStmt, updateEventUnrejectedSQL},
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 	}.Prepare(db)
 }
@@ -159,6 +192,8 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	rejectedByAuth bool,
+	rejectionReason string,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	var eventNID int64
@@ -167,6 +202,8 @@ func (s *eventStatements) InsertEvent(
 	err := insertStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
 		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected,
+		sql.NullString{String: rejectionReason, Valid: rejectionReason != ""},
+		isRejected && rejectedByAuth,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -346,6 +383,14 @@ func (s *eventStatements) UpdateEventState(
 	return err
 }
 
+func (s *eventStatements) SelectEventRejectionReason(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (isRejected bool, rejectionReason string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventRejectionReasonStmt)
+	err = stmt.QueryRowContext(ctx, eventID).Scan(&isRejected, &rejectionReason)
+	return
+}
+
 func (s *eventStatements) SelectEventSentToOutput(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (sentToOutput bool, err error) {
@@ -490,7 +535,7 @@ func (s *eventStatements) BulkSelectEventID(ctx context.Context, eventNIDs []typ
 
 // bulkSelectEventNIDs returns a map from string event ID to numeric event ID.
 // If an event ID is not in the database then it is omitted from the map.
-func (s *eventStatements) BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+func (s *eventStatements) BulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventNID, error) {
 	///////////////
 	iEventIDs := make([]interface{}, len(eventIDs))
 	for k, v := range eventIDs {
@@ -502,7 +547,7 @@ func (s *eventStatements) BulkSelectEventNID(ctx context.Context, eventIDs []str
 		return nil, err
 	}
 	///////////////
-	rows, err := selectStmt.QueryContext(ctx, iEventIDs...)
+	rows, err := sqlutil.TxStmt(txn, selectStmt).QueryContext(ctx, iEventIDs...)
 	if err != nil {
 		return nil, err
 	}
@@ -519,6 +564,36 @@ func (s *eventStatements) BulkSelectEventNID(ctx context.Context, eventIDs []str
 	return results, nil
 }
 
+// BulkSelectEventDepth returns a map from string event ID to event depth.
+// If an event ID is not in the database then it is omitted from the map.
+func (s *eventStatements) BulkSelectEventDepth(ctx context.Context, eventIDs []string) (map[string]int64, error) {
+	iEventIDs := make([]interface{}, len(eventIDs))
+	for k, v := range eventIDs {
+		iEventIDs[k] = v
+	}
+	selectOrig := strings.Replace(bulkSelectEventDepthSQL, "($1)", sqlutil.QueryVariadic(len(iEventIDs)), 1)
+	selectStmt, err := s.db.Prepare(selectOrig)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, selectStmt, "bulkSelectEventDepth: stmt.close() failed")
+	rows, err := selectStmt.QueryContext(ctx, iEventIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectEventDepth: rows.close() failed")
+	results := make(map[string]int64, len(eventIDs))
+	for rows.Next() {
+		var eventID string
+		var depth int64
+		if err = rows.Scan(&eventID, &depth); err != nil {
+			return nil, err
+		}
+		results[eventID] = depth
+	}
+	return results, rows.Err()
+}
+
 func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error) {
 	var result int64
 	iEventIDs := make([]interface{}, len(eventNIDs))
@@ -573,3 +648,66 @@ func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
 }
+
+func (s *eventStatements) SelectRoomEventNIDsAfter(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectRoomEventNIDsAfterStmt.QueryContext(ctx, int64(roomNID), int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDsAfter: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectRoomEventNIDsOfType(
+	ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID,
+) ([]types.EventNID, error) {
+	rows, err := s.selectRoomEventNIDsOfTypeStmt.QueryContext(ctx, int64(roomNID), int64(eventTypeNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDsOfType: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectRejectedRoomEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, afterNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectRejectedRoomEventNIDsStmt.QueryContext(ctx, int64(roomNID), int64(afterNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRejectedRoomEventNIDs: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) UpdateEventUnrejected(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventUnrejectedStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
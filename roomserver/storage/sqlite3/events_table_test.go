@@ -0,0 +1,167 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestBulkSelectEventDepth(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to an in-memory database gets its own database.
+	db.SetMaxOpenConns(1)
+	if err = createEventsTable(db); err != nil {
+		t.Fatal(err)
+	}
+	tab, err := prepareEventsTable(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, _, err = tab.InsertEvent(
+			ctx, nil, testRoomNID, types.MRoomMemberNID, types.EventStateKeyNID(i),
+			fmt.Sprintf("$event%d:localhost", i), []byte{byte(i)}, nil, int64(i*10), false, false, "",
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depths, err := tab.BulkSelectEventDepth(ctx, []string{"$event1:localhost", "$event3:localhost", "$unknown:localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"$event1:localhost": 10, "$event3:localhost": 30}
+	if len(depths) != len(want) {
+		t.Fatalf("got %d depths, wanted %d: %v", len(depths), len(want), depths)
+	}
+	for eventID, depth := range want {
+		if depths[eventID] != depth {
+			t.Errorf("got depth %d for %s, wanted %d", depths[eventID], eventID, depth)
+		}
+	}
+}
+
+func TestSelectEventRejectionReason(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if err = createEventsTable(db); err != nil {
+		t.Fatal(err)
+	}
+	tab, err := prepareEventsTable(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rejectionReason := range []string{"", "missing prev events and no other servers to ask"} {
+		if _, _, err = tab.InsertEvent(
+			ctx, nil, testRoomNID, types.MRoomMemberNID, types.EventStateKeyNID(i+1),
+			fmt.Sprintf("$event%d:localhost", i+1), []byte{byte(i)}, nil, int64(i), rejectionReason != "", false, rejectionReason,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		eventID    string
+		wantReject bool
+		wantReason string
+	}{
+		{"$event1:localhost", false, ""},
+		{"$event2:localhost", true, "missing prev events and no other servers to ask"},
+	}
+	for _, tc := range tests {
+		isRejected, reason, serr := tab.SelectEventRejectionReason(ctx, nil, tc.eventID)
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		if isRejected != tc.wantReject || reason != tc.wantReason {
+			t.Errorf("%s: got %v %q, want %v %q", tc.eventID, isRejected, reason, tc.wantReject, tc.wantReason)
+		}
+	}
+	if _, _, err = tab.SelectEventRejectionReason(ctx, nil, "$unknown:localhost"); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown event, got %v", err)
+	}
+}
+
+func TestSelectRejectedRoomEventNIDs(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if err = createEventsTable(db); err != nil {
+		t.Fatal(err)
+	}
+	tab, err := prepareEventsTable(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []struct {
+		isRejected     bool
+		rejectedByAuth bool
+		reason         string
+	}{
+		{false, false, ""},
+		{true, true, "sender is not in the room"},
+		{true, false, "event rejected by acceptance webhook"},
+		{true, false, "missing prev events and no other servers to ask"},
+		{true, true, "sender is not in the room"},
+		// This isn't rejected, so rejectedByAuth should be ignored.
+		{false, true, ""},
+	}
+	for i, ev := range events {
+		if _, _, err = tab.InsertEvent(
+			ctx, nil, testRoomNID, types.MRoomMemberNID, types.EventStateKeyNID(i+1),
+			fmt.Sprintf("$event%d:localhost", i+1), []byte{byte(i)}, nil, int64(i), ev.isRejected, ev.rejectedByAuth, ev.reason,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eventNIDs, err := tab.SelectRejectedRoomEventNIDs(ctx, testRoomNID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []types.EventNID{2, 5}; !reflect.DeepEqual(eventNIDs, want) {
+		t.Fatalf("got rejected event NIDs %v, want %v", eventNIDs, want)
+	}
+
+	if err = tab.UpdateEventUnrejected(ctx, nil, 2); err != nil {
+		t.Fatal(err)
+	}
+	eventNIDs, err = tab.SelectRejectedRoomEventNIDs(ctx, testRoomNID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []types.EventNID{5}; !reflect.DeepEqual(eventNIDs, want) {
+		t.Fatalf("got rejected event NIDs %v after unrejecting, want %v", eventNIDs, want)
+	}
+}
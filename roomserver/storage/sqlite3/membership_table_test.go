@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+const testRoomNID = types.RoomNID(1)
+
+// mustCreateMembershipTable creates a membership table in an in-memory database
+// and joins the given numbers of local and remote users to the test room.
+func mustCreateMembershipTable(t testing.TB, local, remote int) tables.Membership {
+	t.Helper()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to an in-memory database gets its own database.
+	db.SetMaxOpenConns(1)
+	// Some of the membership queries join against the event state keys.
+	if err = createEventStateKeysTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err = createMembershipTable(db); err != nil {
+		t.Fatal(err)
+	}
+	tab, err := prepareMembershipTable(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 1; i <= local+remote; i++ {
+		userNID := types.EventStateKeyNID(i)
+		if err = tab.InsertMembership(ctx, nil, testRoomNID, userNID, i <= local); err != nil {
+			t.Fatal(err)
+		}
+		if err = tab.UpdateMembership(ctx, nil, testRoomNID, userNID, userNID, tables.MembershipStateJoin, types.EventNID(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tab
+}
+
+func TestSelectLocalMembershipCountFromRoomAndMembership(t *testing.T) {
+	ctx := context.Background()
+	tab := mustCreateMembershipTable(t, 3, 5)
+
+	eventNIDs, err := tab.SelectMembershipsFromRoomAndMembership(ctx, testRoomNID, tables.MembershipStateJoin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := tab.SelectLocalMembershipCountFromRoomAndMembership(ctx, testRoomNID, tables.MembershipStateJoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || count != len(eventNIDs) {
+		t.Fatalf("got count %d, wanted 3 to match %d event NIDs", count, len(eventNIDs))
+	}
+
+	count, err = tab.SelectLocalMembershipCountFromRoomAndMembership(ctx, testRoomNID+1, tables.MembershipStateJoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got count %d for unknown room, wanted 0", count)
+	}
+}
+
+// BenchmarkLocalJoinedMembers compares loading all local joined membership
+// event NIDs against counting them, which is all that is needed to decide
+// whether we are still in the room.
+func BenchmarkLocalJoinedMembers(b *testing.B) {
+	ctx := context.Background()
+	for _, local := range []int{10, 1000, 10000} {
+		tab := mustCreateMembershipTable(b, local, local)
+		b.Run(fmt.Sprintf("EventNIDs/local=%d", local), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := tab.SelectMembershipsFromRoomAndMembership(ctx, testRoomNID, tables.MembershipStateJoin, true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Count/local=%d", local), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := tab.SelectLocalMembershipCountFromRoomAndMembership(ctx, testRoomNID, tables.MembershipStateJoin); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestOutputEventsRetention(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to an in-memory database gets its own database.
+	db.SetMaxOpenConns(1)
+	if err = createOutputEventsTable(db); err != nil {
+		t.Fatal(err)
+	}
+	tab, err := prepareOutputEventsTable(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKeys := []types.OutputEventKey{
+		{EventID: "$old:localhost", OutputType: "new_room_event"},
+		{EventID: "$old:localhost", OutputType: "redacted_event"},
+	}
+	newKeys := []types.OutputEventKey{
+		{EventID: "$new:localhost", OutputType: "new_room_event"},
+	}
+	if err = tab.InsertOutputEvents(ctx, nil, oldKeys, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err = tab.InsertOutputEvents(ctx, nil, newKeys, 2000); err != nil {
+		t.Fatal(err)
+	}
+	// Marking an output event as sent again is a no-op.
+	if err = tab.InsertOutputEvents(ctx, nil, newKeys, 3000); err != nil {
+		t.Fatal(err)
+	}
+
+	selectSent := func() []types.OutputEventKey {
+		keys, err := tab.BulkSelectOutputEvents(ctx, nil, []string{"$old:localhost", "$new:localhost", "$unknown:localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].EventID+keys[i].OutputType < keys[j].EventID+keys[j].OutputType
+		})
+		return keys
+	}
+	if got, want := selectSent(), append(append([]types.OutputEventKey{}, newKeys...), oldKeys...); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got sent output events %v, want %v", got, want)
+	}
+
+	// Only the markers from before the cut-off are deleted.
+	pruned, err := tab.DeleteOutputEventsSentBefore(ctx, nil, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != int64(len(oldKeys)) {
+		t.Fatalf("got %d pruned output events, want %d", pruned, len(oldKeys))
+	}
+	if got := selectSent(); !reflect.DeepEqual(got, newKeys) {
+		t.Fatalf("got sent output events %v, want %v", got, newKeys)
+	}
+}
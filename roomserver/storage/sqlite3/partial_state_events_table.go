@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const partialStateEventsSchema = `
+-- Tracks events which were accepted using only part of the state before them,
+-- as happens with partial state (faster) room joins. The rest of the state is
+-- fetched in the background, after which the event is removed from here.
+CREATE TABLE IF NOT EXISTS roomserver_partial_state_events (
+    -- The event which only has partial state
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    -- The room that the event is in
+    room_nid BIGINT NOT NULL,
+    -- The server to ask for the full state before the event
+    server_name TEXT NOT NULL
+);
+`
+
+const insertPartialStateEventSQL = "" +
+	"INSERT INTO roomserver_partial_state_events (event_nid, room_nid, server_name) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const deletePartialStateEventSQL = "" +
+	"DELETE FROM roomserver_partial_state_events WHERE event_nid = $1"
+
+const selectPartialStateEventsSQL = "" +
+	"SELECT event_nid, room_nid, server_name FROM roomserver_partial_state_events ORDER BY event_nid ASC"
+
+type partialStateEventsStatements struct {
+	insertPartialStateEventStmt  *sql.Stmt
+	deletePartialStateEventStmt  *sql.Stmt
+	selectPartialStateEventsStmt *sql.Stmt
+}
+
+func createPartialStateEventsTable(db *sql.DB) error {
+	_, err := db.Exec(partialStateEventsSchema)
+	return err
+}
+
+func preparePartialStateEventsTable(db *sql.DB) (tables.PartialStateEvents, error) {
+	s := &partialStateEventsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertPartialStateEventStmt, insertPartialStateEventSQL},
+		{&s.deletePartialStateEventStmt, deletePartialStateEventSQL},
+		{&s.selectPartialStateEventsStmt, selectPartialStateEventsSQL},
+	}.Prepare(db)
+}
+
+func (s *partialStateEventsStatements) InsertPartialStateEvent(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNID types.EventNID, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertPartialStateEventStmt)
+	_, err := stmt.ExecContext(ctx, eventNID, roomNID, serverName)
+	return err
+}
+
+func (s *partialStateEventsStatements) DeletePartialStateEvent(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePartialStateEventStmt)
+	_, err := stmt.ExecContext(ctx, eventNID)
+	return err
+}
+
+func (s *partialStateEventsStatements) SelectPartialStateEvents(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.PartialStateEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPartialStateEventsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPartialStateEventsStmt: rows.close() failed")
+
+	var events []types.PartialStateEvent
+	for rows.Next() {
+		var event types.PartialStateEvent
+		if err = rows.Scan(&event.EventNID, &event.RoomNID, &event.ServerName); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pendingInputSchema = `
+-- Journals input events which were submitted synchronously and haven't been
+-- processed yet, so that they can be resumed if the roomserver restarts
+-- before processing them.
+CREATE TABLE IF NOT EXISTS roomserver_pending_input (
+    -- The ID of the input event
+    event_id TEXT NOT NULL PRIMARY KEY,
+    -- The room that the input event is in
+    room_id TEXT NOT NULL,
+    -- The JSON-encoded InputRoomEvent
+    input_json TEXT NOT NULL,
+    -- When the input event was submitted, in milliseconds since the epoch
+    queued_at BIGINT NOT NULL
+);
+`
+
+const insertPendingInputSQL = "" +
+	"INSERT INTO roomserver_pending_input (event_id, room_id, input_json, queued_at) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT DO NOTHING"
+
+const deletePendingInputSQL = "" +
+	"DELETE FROM roomserver_pending_input WHERE event_id = $1"
+
+const selectPendingInputSQL = "" +
+	"SELECT input_json FROM roomserver_pending_input ORDER BY queued_at ASC"
+
+type pendingInputStatements struct {
+	insertPendingInputStmt *sql.Stmt
+	deletePendingInputStmt *sql.Stmt
+	selectPendingInputStmt *sql.Stmt
+}
+
+func createPendingInputTable(db *sql.DB) error {
+	_, err := db.Exec(pendingInputSchema)
+	return err
+}
+
+func preparePendingInputTable(db *sql.DB) (tables.PendingInput, error) {
+	s := &pendingInputStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertPendingInputStmt, insertPendingInputSQL},
+		{&s.deletePendingInputStmt, deletePendingInputSQL},
+		{&s.selectPendingInputStmt, selectPendingInputSQL},
+	}.Prepare(db)
+}
+
+func (s *pendingInputStatements) InsertPendingInput(
+	ctx context.Context, txn *sql.Tx, roomID, eventID string, inputJSON []byte, queuedAt gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertPendingInputStmt)
+	_, err := stmt.ExecContext(ctx, eventID, roomID, string(inputJSON), int64(queuedAt))
+	return err
+}
+
+func (s *pendingInputStatements) DeletePendingInput(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePendingInputStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *pendingInputStatements) SelectPendingInput(
+	ctx context.Context, txn *sql.Tx,
+) ([][]byte, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPendingInputStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPendingInputStmt: rows.close() failed")
+
+	var inputs [][]byte
+	for rows.Next() {
+		var inputJSON string
+		if err = rows.Scan(&inputJSON); err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, []byte(inputJSON))
+	}
+	return inputs, rows.Err()
+}
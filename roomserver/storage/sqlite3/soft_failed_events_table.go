@@ -0,0 +1,124 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const softFailedEventsSchema = `
+-- Tracks new events which were soft-failed recently, so that they can be
+-- re-evaluated if the state of the room changes in a way that means they
+-- would now pass the soft-fail checks.
+CREATE TABLE IF NOT EXISTS roomserver_soft_failed_events (
+    -- The event which was soft-failed
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    -- The room that the event is in
+    room_nid BIGINT NOT NULL,
+    -- When the event was soft-failed, in milliseconds since the epoch
+    soft_failed_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_soft_failed_events_room_nid_idx ON roomserver_soft_failed_events (room_nid, soft_failed_at);
+`
+
+const insertSoftFailedEventSQL = "" +
+	"INSERT INTO roomserver_soft_failed_events (event_nid, room_nid, soft_failed_at) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectSoftFailedEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_soft_failed_events WHERE room_nid = $1" +
+	" ORDER BY soft_failed_at ASC, event_nid ASC LIMIT $2"
+
+const deleteSoftFailedEventSQL = "" +
+	"DELETE FROM roomserver_soft_failed_events WHERE event_nid = $1"
+
+const deleteSoftFailedEventsBeforeSQL = "" +
+	"DELETE FROM roomserver_soft_failed_events WHERE room_nid = $1 AND soft_failed_at < $2"
+
+type softFailedEventsStatements struct {
+	insertSoftFailedEventStmt        *sql.Stmt
+	selectSoftFailedEventNIDsStmt    *sql.Stmt
+	deleteSoftFailedEventStmt        *sql.Stmt
+	deleteSoftFailedEventsBeforeStmt *sql.Stmt
+}
+
+func createSoftFailedEventsTable(db *sql.DB) error {
+	_, err := db.Exec(softFailedEventsSchema)
+	return err
+}
+
+func prepareSoftFailedEventsTable(db *sql.DB) (tables.SoftFailedEvents, error) {
+	s := &softFailedEventsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertSoftFailedEventStmt, insertSoftFailedEventSQL},
+		{&s.selectSoftFailedEventNIDsStmt, selectSoftFailedEventNIDsSQL},
+		{&s.deleteSoftFailedEventStmt, deleteSoftFailedEventSQL},
+		{&s.deleteSoftFailedEventsBeforeStmt, deleteSoftFailedEventsBeforeSQL},
+	}.Prepare(db)
+}
+
+func (s *softFailedEventsStatements) InsertSoftFailedEvent(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNID types.EventNID, softFailedAt gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertSoftFailedEventStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID), int64(roomNID), int64(softFailedAt))
+	return err
+}
+
+func (s *softFailedEventsStatements) SelectSoftFailedEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, limit int,
+) ([]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectSoftFailedEventNIDsStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSoftFailedEventNIDsStmt: rows.close() failed")
+
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *softFailedEventsStatements) DeleteSoftFailedEvent(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteSoftFailedEventStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
+
+func (s *softFailedEventsStatements) DeleteSoftFailedEventsBefore(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, before gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteSoftFailedEventsBeforeStmt)
+	_, err := stmt.ExecContext(ctx, int64(roomNID), int64(before))
+	return err
+}
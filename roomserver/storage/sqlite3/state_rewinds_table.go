@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const stateRewindsSchema = `
+-- Records every time the current state of a room was rewound to the state
+-- after an earlier event, so that the rewind can be undone if needed.
+CREATE TABLE IF NOT EXISTS roomserver_state_rewinds (
+    rewind_id INTEGER PRIMARY KEY,
+    -- The room whose state was rewound
+    room_id TEXT NOT NULL,
+    -- The event whose state the room was rewound to
+    target_event_id TEXT NOT NULL,
+    -- When the rewind happened, in milliseconds since the epoch
+    rewound_at BIGINT NOT NULL,
+    -- The current state snapshot of the room from before the rewind
+    previous_state_snapshot_nid BIGINT NOT NULL,
+    -- A JSON array of the forward extremities of the room from before the rewind
+    previous_latest_event_ids TEXT NOT NULL,
+    -- The current state snapshot of the room after the rewind
+    new_state_snapshot_nid BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_state_rewinds_room_id_idx ON roomserver_state_rewinds (room_id);
+`
+
+const insertStateRewindSQL = "" +
+	"INSERT INTO roomserver_state_rewinds" +
+	" (room_id, target_event_id, rewound_at, previous_state_snapshot_nid, previous_latest_event_ids, new_state_snapshot_nid)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectStateRewindsForRoomSQL = "" +
+	"SELECT room_id, target_event_id, rewound_at, previous_state_snapshot_nid, previous_latest_event_ids, new_state_snapshot_nid" +
+	" FROM roomserver_state_rewinds WHERE room_id = $1 ORDER BY rewind_id ASC"
+
+type stateRewindsStatements struct {
+	insertStateRewindStmt         *sql.Stmt
+	selectStateRewindsForRoomStmt *sql.Stmt
+}
+
+func createStateRewindsTable(db *sql.DB) error {
+	_, err := db.Exec(stateRewindsSchema)
+	return err
+}
+
+func prepareStateRewindsTable(db *sql.DB) (tables.StateRewinds, error) {
+	s := &stateRewindsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertStateRewindStmt, insertStateRewindSQL},
+		{&s.selectStateRewindsForRoomStmt, selectStateRewindsForRoomSQL},
+	}.Prepare(db)
+}
+
+func (s *stateRewindsStatements) InsertStateRewind(
+	ctx context.Context, txn *sql.Tx, rewind *types.StateRewind,
+) error {
+	previousLatestEventIDs, err := json.Marshal(rewind.PreviousLatestEventIDs)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertStateRewindStmt)
+	_, err = stmt.ExecContext(
+		ctx, rewind.RoomID, rewind.TargetEventID, rewind.RewoundAt,
+		rewind.PreviousStateSnapshotNID, string(previousLatestEventIDs), rewind.NewStateSnapshotNID,
+	)
+	return err
+}
+
+func (s *stateRewindsStatements) SelectStateRewindsForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) ([]types.StateRewind, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStateRewindsForRoomStmt)
+	rows, err := stmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateRewindsForRoomStmt: rows.close() failed")
+
+	var rewinds []types.StateRewind
+	for rows.Next() {
+		var rewind types.StateRewind
+		var previousLatestEventIDs string
+		if err = rows.Scan(
+			&rewind.RoomID, &rewind.TargetEventID, &rewind.RewoundAt,
+			&rewind.PreviousStateSnapshotNID, &previousLatestEventIDs, &rewind.NewStateSnapshotNID,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(previousLatestEventIDs), &rewind.PreviousLatestEventIDs); err != nil {
+			return nil, err
+		}
+		rewinds = append(rewinds, rewind)
+	}
+	return rewinds, rows.Err()
+}
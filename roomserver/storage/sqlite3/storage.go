@@ -61,6 +61,8 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	m := sqlutil.NewMigrations()
 	deltas.LoadAddForgottenColumn(m)
 	deltas.LoadStateBlocksRefactor(m)
+	deltas.LoadAddRejectionReason(m)
+	deltas.LoadAddRejectedByAuth(m)
 	if err := m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -114,6 +116,30 @@ func (d *Database) create(db *sql.DB) error {
 	if err := createRedactionsTable(db); err != nil {
 		return err
 	}
+	if err := createOutputEventsTable(db); err != nil {
+		return err
+	}
+	if err := createRoomMaintenanceTable(db); err != nil {
+		return err
+	}
+	if err := createStateRewindsTable(db); err != nil {
+		return err
+	}
+	if err := createSoftFailedEventsTable(db); err != nil {
+		return err
+	}
+	if err := createPendingInputTable(db); err != nil {
+		return err
+	}
+	if err := createEventProvenanceTable(db); err != nil {
+		return err
+	}
+	if err := createInputDeadLetterTable(db); err != nil {
+		return err
+	}
+	if err := createPartialStateEventsTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -171,6 +197,38 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	outputEvents, err := prepareOutputEventsTable(db)
+	if err != nil {
+		return err
+	}
+	roomMaintenance, err := prepareRoomMaintenanceTable(db)
+	if err != nil {
+		return err
+	}
+	stateRewinds, err := prepareStateRewindsTable(db)
+	if err != nil {
+		return err
+	}
+	softFailedEvents, err := prepareSoftFailedEventsTable(db)
+	if err != nil {
+		return err
+	}
+	pendingInput, err := preparePendingInputTable(db)
+	if err != nil {
+		return err
+	}
+	eventProvenance, err := prepareEventProvenanceTable(db)
+	if err != nil {
+		return err
+	}
+	inputDeadLetter, err := prepareInputDeadLetterTable(db)
+	if err != nil {
+		return err
+	}
+	partialStateEvents, err := preparePartialStateEventsTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                         db,
 		Cache:                      cache,
@@ -188,6 +246,14 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		MembershipTable:            membership,
 		PublishedTable:             published,
 		RedactionsTable:            redactions,
+		OutputEventsTable:          outputEvents,
+		RoomMaintenanceTable:       roomMaintenance,
+		StateRewindsTable:          stateRewinds,
+		SoftFailedEventsTable:      softFailedEvents,
+		PendingInputTable:          pendingInput,
+		EventProvenanceTable:       eventProvenance,
+		InputDeadLetterTable:       inputDeadLetter,
+		PartialStateEventsTable:    partialStateEvents,
 		GetLatestEventsForUpdateFn: d.GetLatestEventsForUpdate,
 	}
 	return nil
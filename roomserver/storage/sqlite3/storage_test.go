@@ -0,0 +1,339 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// mustOpenDatabase opens a database in a temporary file, since each
+// connection to an in-memory database gets its own database.
+func mustOpenDatabase(t testing.TB) *Database {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "roomserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	cache, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "roomserver.db")),
+	}, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// mustBuildAuthChain builds a chain of n events in a new room, starting with
+// the create event, where each event is authed by the create event and the
+// event before it.
+func mustBuildAuthChain(t testing.TB, roomID string, n int) []*gomatrixserverlib.Event {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make([]*gomatrixserverlib.Event, 0, n)
+	for i := 0; i < n; i++ {
+		eventType, stateKey := "m.room.create", ""
+		content := map[string]interface{}{"creator": "@alice:remote", "room_version": "6"}
+		var authEvents []string
+		if i > 0 {
+			eventType, stateKey = "m.room.test", fmt.Sprintf("%d", i)
+			content = map[string]interface{}{"i": i}
+			authEvents = []string{events[0].EventID()}
+			if i > 1 {
+				authEvents = append(authEvents, events[i-1].EventID())
+			}
+		}
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:     "@alice:remote",
+			RoomID:     roomID,
+			Type:       eventType,
+			StateKey:   &stateKey,
+			PrevEvents: authEvents,
+			AuthEvents: authEvents,
+			Depth:      int64(i + 1),
+		}
+		if err = builder.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		ev, berr := builder.Build(time.Now(), "remote", "ed25519:test", private, gomatrixserverlib.RoomVersionV6)
+		if berr != nil {
+			t.Fatal(berr)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func toStore(events []*gomatrixserverlib.Event) []types.EventToStore {
+	result := make([]types.EventToStore, len(events))
+	for i, ev := range events {
+		result[i] = types.EventToStore{Event: ev}
+	}
+	return result
+}
+
+func TestStoreEvents(t *testing.T) {
+	ctx := context.Background()
+	db := mustOpenDatabase(t)
+	events := mustBuildAuthChain(t, "!room:remote", 5)
+	eventIDs := make([]string, len(events))
+	for i, ev := range events {
+		eventIDs[i] = ev.EventID()
+	}
+
+	// The batch fails part of the way through because the last event's auth
+	// events aren't known, so nothing should be stored.
+	if _, err := db.StoreEvents(ctx, toStore([]*gomatrixserverlib.Event{events[0], events[1], events[3]}), nil); err == nil {
+		t.Fatal("expected storing events with missing auth events to fail")
+	}
+	nids, err := db.EventNIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nids) != 0 {
+		t.Fatalf("expected nothing to be stored, got %v", nids)
+	}
+	// The numeric IDs assigned in the rolled back transaction mustn't be cached.
+	if nid, ok := db.Cache.GetRoomServerEventTypeNID("m.room.test"); ok {
+		t.Fatalf("expected the event type not to be cached, got NID %d", nid)
+	}
+	if nid, ok := db.Cache.GetRoomServerStateKeyNID("1"); ok {
+		t.Fatalf("expected the state key not to be cached, got NID %d", nid)
+	}
+
+	// The first event is already known, the rest are stored together.
+	createNID, _, _, _, _, err := db.StoreEvent(ctx, events[0], nil, false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventNIDs, err := db.StoreEvents(ctx, toStore(events[1:]), map[string]types.EventNID{events[0].EventID(): createNID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nids, err = db.EventNIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nids) != len(events) || nids[events[0].EventID()] != createNID {
+		t.Fatalf("expected all events to be stored, got %v", nids)
+	}
+	for i, ev := range events[1:] {
+		if nids[ev.EventID()] != eventNIDs[i] {
+			t.Fatalf("event %s: got NID %d, stored as %d", ev.EventID(), eventNIDs[i], nids[ev.EventID()])
+		}
+	}
+	// Once committed, the numeric IDs are cached and match the database.
+	eventTypeNIDs, err := db.EventTypesTable.BulkSelectEventTypeNID(ctx, []string{"m.room.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nid, ok := db.Cache.GetRoomServerEventTypeNID("m.room.test"); !ok || nid != eventTypeNIDs["m.room.test"] {
+		t.Fatalf("expected the event type to be cached as NID %d, got %d", eventTypeNIDs["m.room.test"], nid)
+	}
+}
+
+func BenchmarkStoreAuthChain(b *testing.B) {
+	const chainLength = 200
+	ctx := context.Background()
+	db := mustOpenDatabase(b)
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			events := mustBuildAuthChain(b, fmt.Sprintf("!single%d:remote", i), chainLength)
+			b.StartTimer()
+			known := make(map[string]types.EventNID, len(events))
+			for _, ev := range events {
+				authEventNIDs := make([]types.EventNID, 0, len(ev.AuthEventIDs()))
+				for _, authEventID := range ev.AuthEventIDs() {
+					authEventNIDs = append(authEventNIDs, known[authEventID])
+				}
+				eventNID, _, _, _, _, err := db.StoreEvent(ctx, ev, authEventNIDs, false, false, "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				known[ev.EventID()] = eventNID
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			events := toStore(mustBuildAuthChain(b, fmt.Sprintf("!batch%d:remote", i), chainLength))
+			b.StartTimer()
+			if _, err := db.StoreEvents(ctx, events, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestEventProvenance(t *testing.T) {
+	ctx := context.Background()
+	db := mustOpenDatabase(t)
+	events := mustBuildAuthChain(t, "!room:remote", 3)
+
+	// The create event was created locally, the others were fetched.
+	createNID, _, _, _, _, err := db.StoreEvent(ctx, events[0], nil, false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.StoreEvents(ctx, []types.EventToStore{
+		{Event: events[1], SuppliedBy: "a"},
+		{Event: events[2], SuppliedBy: "b"},
+	}, map[string]types.EventNID{events[0].EventID(): createNID}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		eventID    string
+		wantExists bool
+		wantServer gomatrixserverlib.ServerName
+	}{
+		{events[0].EventID(), true, ""},
+		{events[1].EventID(), true, "a"},
+		{events[2].EventID(), true, "b"},
+		{"$unknown:remote", false, ""},
+	}
+	for _, tc := range tests {
+		exists, serverName, receivedAt, perr := db.EventProvenance(ctx, tc.eventID)
+		if perr != nil {
+			t.Fatal(perr)
+		}
+		if exists != tc.wantExists || serverName != tc.wantServer {
+			t.Errorf("%s: got exists %v, server %q, want %v, %q", tc.eventID, exists, serverName, tc.wantExists, tc.wantServer)
+		}
+		if (serverName != "") != (receivedAt != 0) {
+			t.Errorf("%s: got received at %d for server %q", tc.eventID, receivedAt, serverName)
+		}
+	}
+}
+
+func TestStoreEventAppliesPendingRedaction(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(sender, eventType string, stateKey *string, redacts string, content map[string]interface{}, authEvents []string) *gomatrixserverlib.Event {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:     sender,
+			RoomID:     "!room:remote",
+			Type:       eventType,
+			StateKey:   stateKey,
+			Redacts:    redacts,
+			PrevEvents: authEvents,
+			AuthEvents: authEvents,
+			Depth:      int64(len(authEvents) + 1),
+		}
+		if err = builder.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		ev, berr := builder.Build(time.Now(), "remote", "ed25519:test", private, gomatrixserverlib.RoomVersionV6)
+		if berr != nil {
+			t.Fatal(berr)
+		}
+		return ev
+	}
+
+	tests := []struct {
+		name            string
+		targetSender    string
+		redactionSender string
+		wantRedacted    bool
+	}{
+		{"own event", "@alice:remote", "@alice:remote", true},
+		{"with the redact power level", "@bob:remote", "@alice:remote", true},
+		{"without the redact power level", "@alice:remote", "@bob:remote", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := mustOpenDatabase(t)
+			emptyStateKey := ""
+			create := build("@alice:remote", gomatrixserverlib.MRoomCreate, &emptyStateKey, "", map[string]interface{}{
+				"creator": "@alice:remote", "room_version": "6",
+			}, nil)
+			target := build(tc.targetSender, "m.room.message", nil, "", map[string]interface{}{
+				"body": "secret",
+			}, []string{create.EventID()})
+			redaction := build(tc.redactionSender, gomatrixserverlib.MRoomRedaction, nil, target.EventID(), map[string]interface{}{}, []string{create.EventID()})
+
+			createNID, _, _, _, _, err := db.StoreEvent(ctx, create, nil, false, false, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The redaction arrives first, so there is nothing to redact yet.
+			_, _, _, redactionEvent, redactedEventID, err := db.StoreEvent(ctx, redaction, []types.EventNID{createNID}, false, false, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if redactionEvent != nil || redactedEventID != "" {
+				t.Fatalf("expected nothing to be redacted yet, got %q", redactedEventID)
+			}
+			// Storing the target applies the pending redaction to it, if the
+			// sender of the redaction is allowed to redact it.
+			_, _, _, redactionEvent, redactedEventID, err = db.StoreEvent(ctx, target, []types.EventNID{createNID}, false, false, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			events, err := db.EventsFromIDs(ctx, []string{target.EventID()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			if !tc.wantRedacted {
+				if redactionEvent != nil || redactedEventID != "" {
+					t.Fatalf("expected the target not to be redacted, got %q", redactedEventID)
+				}
+				if body := gjson.GetBytes(events[0].Content(), "body"); body.String() != "secret" {
+					t.Fatalf("expected the stored target not to be redacted, got content %s", events[0].Content())
+				}
+				return
+			}
+			if redactedEventID != target.EventID() || redactionEvent == nil || redactionEvent.EventID() != redaction.EventID() {
+				t.Fatalf("expected the target to be redacted by the pending redaction, got %q", redactedEventID)
+			}
+			if body := gjson.GetBytes(events[0].Content(), "body"); body.Exists() {
+				t.Fatalf("expected the stored target to be redacted, got content %s", events[0].Content())
+			}
+			if redacts := gjson.GetBytes(events[0].Unsigned(), "redacted_because.redacts"); redacts.String() != target.EventID() {
+				t.Fatalf("expected the stored target to be marked as redacted, got unsigned %s", events[0].Unsigned())
+			}
+		})
+	}
+}
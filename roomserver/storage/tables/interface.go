@@ -18,7 +18,7 @@ type EventJSONPair struct {
 type EventJSON interface {
 	// Insert the event JSON. On conflict, replace the event JSON with the new value (for redactions).
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
-	BulkSelectEventJSON(ctx context.Context, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	BulkSelectEventJSON(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]EventJSONPair, error)
 }
 
 type EventTypes interface {
@@ -37,7 +37,7 @@ type EventStateKeys interface {
 type Events interface {
 	InsertEvent(
 		ctx context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string,
-		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected bool,
+		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected, rejectedByAuth bool, rejectionReason string,
 	) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	// bulkSelectStateEventByID lookups a list of state events by event ID.
@@ -49,6 +49,9 @@ type Events interface {
 	// If we do not have the state for any of the requested events it returns a types.MissingEventError.
 	BulkSelectStateAtEventByID(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error)
 	UpdateEventState(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
+	// SelectEventRejectionReason returns whether the event was rejected and,
+	// if known, why. Returns sql.ErrNoRows if the event isn't known.
+	SelectEventRejectionReason(ctx context.Context, txn *sql.Tx, eventID string) (isRejected bool, rejectionReason string, err error)
 	SelectEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (sentToOutput bool, err error)
 	UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
 	SelectEventID(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (eventID string, err error)
@@ -58,7 +61,22 @@ type Events interface {
 	BulkSelectEventID(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
 	// BulkSelectEventNIDs returns a map from string event ID to numeric event ID.
 	// If an event ID is not in the database then it is omitted from the map.
-	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
+	BulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventNID, error)
+	// BulkSelectEventDepth returns a map from string event ID to event depth.
+	// If an event ID is not in the database then it is omitted from the map.
+	BulkSelectEventDepth(ctx context.Context, eventIDs []string) (map[string]int64, error)
+	// SelectRoomEventNIDsAfter returns up to limit event NIDs in the room which
+	// are greater than the given event NID, in ascending order.
+	SelectRoomEventNIDsAfter(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// SelectRoomEventNIDsOfType returns the NIDs of all events in the room with
+	// the given event type, in ascending order.
+	SelectRoomEventNIDsOfType(ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID) ([]types.EventNID, error)
+	// SelectRejectedRoomEventNIDs returns the NIDs of up to limit events in the
+	// room which were rejected by auth, with NIDs greater than afterNID, in
+	// ascending order. Events rejected for any other reason aren't returned.
+	SelectRejectedRoomEventNIDs(ctx context.Context, roomNID types.RoomNID, afterNID types.EventNID, limit int) ([]types.EventNID, error)
+	// UpdateEventUnrejected marks the event as no longer rejected.
+	UpdateEventUnrejected(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
 }
@@ -105,8 +123,11 @@ type PreviousEvents interface {
 type Invites interface {
 	InsertInviteEvent(ctx context.Context, txn *sql.Tx, inviteEventID string, roomNID types.RoomNID, targetUserNID, senderUserNID types.EventStateKeyNID, inviteEventJSON []byte) (bool, error)
 	UpdateInviteRetired(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) ([]string, error)
-	// SelectInviteActiveForUserInRoom returns a list of sender state key NIDs and invite event IDs matching those nids.
+	// SelectInviteActiveForUserInRoom returns a list of sender state key NIDs and invite event IDs matching those nids,
+	// oldest invite first.
 	SelectInviteActiveForUserInRoom(ctx context.Context, targetUserNID types.EventStateKeyNID, roomNID types.RoomNID) ([]types.EventStateKeyNID, []string, error)
+	// SelectInviteEventJSON returns the stored JSON of an invite event, or sql.ErrNoRows if there is no such invite.
+	SelectInviteEventJSON(ctx context.Context, txn *sql.Tx, inviteEventID string) ([]byte, error)
 }
 
 type MembershipState int64
@@ -124,6 +145,8 @@ type Membership interface {
 	SelectMembershipFromRoomAndTarget(ctx context.Context, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (types.EventNID, MembershipState, bool, error)
 	SelectMembershipsFromRoom(ctx context.Context, roomNID types.RoomNID, localOnly bool) (eventNIDs []types.EventNID, err error)
 	SelectMembershipsFromRoomAndMembership(ctx context.Context, roomNID types.RoomNID, membership MembershipState, localOnly bool) (eventNIDs []types.EventNID, err error)
+	// SelectLocalMembershipCountFromRoomAndMembership returns the number of local users with the given membership in the room.
+	SelectLocalMembershipCountFromRoomAndMembership(ctx context.Context, roomNID types.RoomNID, membership MembershipState) (int, error)
 	UpdateMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership MembershipState, eventNID types.EventNID, forgotten bool) error
 	SelectRoomsWithMembership(ctx context.Context, userID types.EventStateKeyNID, membershipState MembershipState) ([]types.RoomNID, error)
 	// SelectJoinedUsersSetForRooms returns the set of all users in the rooms who are joined to any of these rooms, along with the
@@ -161,6 +184,81 @@ type Redactions interface {
 	MarkRedactionValidated(ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool) error
 }
 
+type OutputEvents interface {
+	// InsertOutputEvents records that the given output events were emitted at
+	// the given time. Inserting the same key twice is a no-op.
+	InsertOutputEvents(ctx context.Context, txn *sql.Tx, keys []types.OutputEventKey, sentAt gomatrixserverlib.Timestamp) error
+	// BulkSelectOutputEvents returns the output events of any type which have
+	// already been emitted for the given event IDs.
+	BulkSelectOutputEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.OutputEventKey, error)
+	// DeleteOutputEventsSentBefore forgets about output events which were
+	// emitted before the given time, returning how many were deleted.
+	DeleteOutputEventsSentBefore(ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp) (int64, error)
+}
+
+type RoomMaintenance interface {
+	// InsertRoomMaintenance puts a room into maintenance mode. Inserting the same room twice is a no-op.
+	InsertRoomMaintenance(ctx context.Context, txn *sql.Tx, roomID string) error
+	// DeleteRoomMaintenance takes a room out of maintenance mode.
+	DeleteRoomMaintenance(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectRoomsInMaintenance returns the room IDs of all rooms in maintenance mode.
+	SelectRoomsInMaintenance(ctx context.Context, txn *sql.Tx) ([]string, error)
+}
+
+type PartialStateEvents interface {
+	// InsertPartialStateEvent records that an event was accepted with partial state. Inserting the same event twice is a no-op.
+	InsertPartialStateEvent(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNID types.EventNID, serverName gomatrixserverlib.ServerName) error
+	// DeletePartialStateEvent forgets that an event was accepted with partial state.
+	DeletePartialStateEvent(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
+	// SelectPartialStateEvents returns all events which are still waiting for their full state.
+	SelectPartialStateEvents(ctx context.Context, txn *sql.Tx) ([]types.PartialStateEvent, error)
+}
+
+type StateRewinds interface {
+	// InsertStateRewind records that the current state of a room was rewound.
+	InsertStateRewind(ctx context.Context, txn *sql.Tx, rewind *types.StateRewind) error
+	// SelectStateRewindsForRoom returns all recorded rewinds for a room, oldest first.
+	SelectStateRewindsForRoom(ctx context.Context, txn *sql.Tx, roomID string) ([]types.StateRewind, error)
+}
+
+type PendingInput interface {
+	// InsertPendingInput journals an input event which hasn't been processed yet. Inserting the same event twice is a no-op.
+	InsertPendingInput(ctx context.Context, txn *sql.Tx, roomID, eventID string, inputJSON []byte, queuedAt gomatrixserverlib.Timestamp) error
+	// DeletePendingInput removes an input event from the journal.
+	DeletePendingInput(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectPendingInput returns the JSON of all journalled input events, oldest first.
+	SelectPendingInput(ctx context.Context, txn *sql.Tx) ([][]byte, error)
+}
+
+type InputDeadLetter interface {
+	// InsertInputDeadLetter records an input event which failed to be processed. If the event was already recorded then the error and time are updated.
+	InsertInputDeadLetter(ctx context.Context, txn *sql.Tx, deadLetter *types.InputDeadLetter) error
+	// DeleteInputDeadLetter forgets about an input event which failed to be processed.
+	DeleteInputDeadLetter(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectInputDeadLetter returns the recorded failure for an input event, or nil if there isn't one.
+	SelectInputDeadLetter(ctx context.Context, txn *sql.Tx, eventID string) (*types.InputDeadLetter, error)
+	// SelectInputDeadLetters returns up to limit recorded failures, oldest first.
+	SelectInputDeadLetters(ctx context.Context, txn *sql.Tx, limit int) ([]types.InputDeadLetter, error)
+}
+
+type SoftFailedEvents interface {
+	// InsertSoftFailedEvent records that an event was soft-failed. Inserting the same event twice is a no-op.
+	InsertSoftFailedEvent(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNID types.EventNID, softFailedAt gomatrixserverlib.Timestamp) error
+	// SelectSoftFailedEventNIDs returns up to limit soft-failed events in a room, oldest first.
+	SelectSoftFailedEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, limit int) ([]types.EventNID, error)
+	// DeleteSoftFailedEvent forgets that an event was soft-failed.
+	DeleteSoftFailedEvent(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
+	// DeleteSoftFailedEventsBefore forgets about events in a room which were soft-failed before the given time.
+	DeleteSoftFailedEventsBefore(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, before gomatrixserverlib.Timestamp) error
+}
+
+type EventProvenance interface {
+	// InsertEventProvenance records which server gave us an event. Only the first server is recorded.
+	InsertEventProvenance(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, serverName gomatrixserverlib.ServerName, receivedAt gomatrixserverlib.Timestamp) error
+	// SelectEventProvenance returns which server gave us an event and when, or sql.ErrNoRows if not recorded.
+	SelectEventProvenance(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (gomatrixserverlib.ServerName, gomatrixserverlib.Timestamp, error)
+}
+
 // StrippedEvent represents a stripped event for returning extracted content values.
 type StrippedEvent struct {
 	RoomID       string
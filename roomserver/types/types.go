@@ -169,6 +169,19 @@ type Event struct {
 	*gomatrixserverlib.Event
 }
 
+// An EventToStore is an event to be stored in bulk, along with whether it was
+// rejected and why.
+type EventToStore struct {
+	Event           *gomatrixserverlib.Event
+	IsRejected      bool
+	RejectionReason string
+	// True if the event was rejected only because it failed the auth checks,
+	// so it might be accepted if it is reprocessed with better auth events.
+	RejectedByAuth bool
+	// The server which gave us the event, if it was fetched over federation.
+	SuppliedBy gomatrixserverlib.ServerName
+}
+
 const (
 	// MRoomCreateNID is the numeric ID for the "m.room.create" event type.
 	MRoomCreateNID = 1
@@ -216,3 +229,44 @@ type RoomInfo struct {
 	StateSnapshotNID StateSnapshotNID
 	IsStub           bool
 }
+
+// InputDeadLetter is an input event which failed to be processed because of
+// an error, rather than because it was rejected.
+type InputDeadLetter struct {
+	EventID string `json:"event_id"`
+	RoomID  string `json:"room_id"`
+	// The JSON-encoded InputRoomEvent, as it was submitted.
+	InputJSON []byte                      `json:"input_json"`
+	Error     string                      `json:"error"`
+	FailedAt  gomatrixserverlib.Timestamp `json:"failed_at"`
+}
+
+// StateRewind records a room's current state being rewound to the state after
+// an earlier event, along with what the current state was beforehand so that
+// the rewind can be undone if needed.
+type StateRewind struct {
+	RoomID        string                      `json:"room_id"`
+	TargetEventID string                      `json:"target_event_id"`
+	RewoundAt     gomatrixserverlib.Timestamp `json:"rewound_at"`
+	// The current state snapshot and forward extremities of the room from
+	// before the rewind.
+	PreviousStateSnapshotNID StateSnapshotNID `json:"previous_state_snapshot_nid"`
+	PreviousLatestEventIDs   []string         `json:"previous_latest_event_ids"`
+	// The current state snapshot of the room after the rewind.
+	NewStateSnapshotNID StateSnapshotNID `json:"new_state_snapshot_nid"`
+}
+
+// PartialStateEvent records an event that was accepted using only part of the
+// state before it, and which server to ask for the rest of that state.
+type PartialStateEvent struct {
+	RoomNID    RoomNID
+	EventNID   EventNID
+	ServerName gomatrixserverlib.ServerName
+}
+
+// An OutputEventKey identifies an output event of a given type which was
+// emitted for an event, so that it isn't emitted again.
+type OutputEventKey struct {
+	EventID    string
+	OutputType string
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// BodyPattern is a sample validator which matches the body of messages against
+// regular expressions, e.g. to stop links to certain domains:
+//
+//	validator.Register("no-bad-links", &validator.BodyPattern{
+//	  Reject: []*regexp.Regexp{regexp.MustCompile(`https?://bad\.example\.com/`)},
+//	})
+//
+// Events matching any of the Reject patterns are rejected. Otherwise, events
+// matching any of the Quarantine patterns are quarantined. Both the body and
+// formatted_body content fields are checked.
+type BodyPattern struct {
+	Reject     []*regexp.Regexp
+	Quarantine []*regexp.Regexp
+}
+
+// Validate implements Validator.
+func (v *BodyPattern) Validate(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName,
+) (Result, error) {
+	content := event.Content()
+	bodies := []string{
+		gjson.GetBytes(content, "body").Str,
+		gjson.GetBytes(content, "formatted_body").Str,
+	}
+	if pattern := matchAny(v.Reject, bodies); pattern != nil {
+		return Result{Reject, fmt.Sprintf("body matches %q", pattern)}, nil
+	}
+	if pattern := matchAny(v.Quarantine, bodies); pattern != nil {
+		return Result{Quarantine, fmt.Sprintf("body matches %q", pattern)}, nil
+	}
+	return Result{Outcome: Accept}, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, bodies []string) *regexp.Regexp {
+	for _, pattern := range patterns {
+		for _, body := range bodies {
+			if body != "" && pattern.MatchString(body) {
+				return pattern
+			}
+		}
+	}
+	return nil
+}
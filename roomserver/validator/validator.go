@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package validator allows custom content policies to be applied to new events
+// received by the roomserver, without patching the roomserver itself.
+//
+// Validators are registered by name, typically from an init function in a
+// custom build of Dendrite, and must be registered before the roomserver is
+// started. Like hooks, validators only run in the same process as the
+// roomserver. No validators are registered by default.
+package validator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Outcome is the decision that a validator makes about an event.
+type Outcome int
+
+const (
+	// Accept lets the event continue to be processed as normal.
+	Accept Outcome = iota
+	// Reject stores the event as rejected, as if it had failed auth checks.
+	Reject
+	// Quarantine stores the event but soft-fails it, so that it doesn't
+	// become a forward extremity or get sent to clients, but remains
+	// available for inspection.
+	Quarantine
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	case Quarantine:
+		return "quarantine"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
+
+// Result is returned by a validator.
+type Result struct {
+	Outcome Outcome
+	// A human-readable reason, which is logged and, for rejected events,
+	// used as the rejection reason.
+	Reason string
+}
+
+// Validator inspects new events that have passed auth checks.
+//
+// Validate is called with a context that is cancelled once the configured
+// timeout has passed, after which the result is ignored and the event is
+// accepted. Validators should therefore avoid slow operations. If Validate
+// returns an error then it is logged and the event is accepted.
+type Validator interface {
+	Validate(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName) (Result, error)
+}
+
+// Func is an adapter to allow the use of ordinary functions as validators.
+type Func func(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName) (Result, error)
+
+// Validate calls f(ctx, event, origin).
+func (f Func) Validate(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName) (Result, error) {
+	return f(ctx, event, origin)
+}
+
+// Named is a validator along with the name it was registered with.
+type Named struct {
+	Name      string
+	Validator Validator
+}
+
+var (
+	registered   []Named
+	registeredMu sync.Mutex
+)
+
+// Register makes a validator available to the roomserver under the given name.
+// Validators run in the order in which they are registered. Register panics if
+// a validator is registered twice with the same name.
+func Register(name string, v Validator) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	if v == nil {
+		panic("validator: Register validator is nil")
+	}
+	for _, n := range registered {
+		if n.Name == name {
+			panic("validator: Register called twice for validator " + name)
+		}
+	}
+	registered = append(registered, Named{Name: name, Validator: v})
+}
+
+// Registered returns all of the registered validators, in the order in which
+// they were registered.
+func Registered() []Named {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	return append([]Named(nil), registered...)
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateMessage(t *testing.T, content map[string]interface{}) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"event_id": "$test:localhost",
+		"room_id":  "!test:localhost",
+		"sender":   "@test:localhost",
+		"origin":   "localhost",
+		"type":     "m.room.message",
+		"content":  content,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func TestBodyPattern(t *testing.T) {
+	v := &BodyPattern{
+		Reject:     []*regexp.Regexp{regexp.MustCompile(`https?://bad\.example\.com/`)},
+		Quarantine: []*regexp.Regexp{regexp.MustCompile(`(?i)free crypto`)},
+	}
+	tests := []struct {
+		name    string
+		content map[string]interface{}
+		want    Outcome
+	}{
+		{"plain message", map[string]interface{}{"body": "hello"}, Accept},
+		{"no body", map[string]interface{}{}, Accept},
+		{"bad link", map[string]interface{}{"body": "see https://bad.example.com/x"}, Reject},
+		{"bad link in formatted body", map[string]interface{}{"body": "see here", "formatted_body": `<a href="http://bad.example.com/">here</a>`}, Reject},
+		{"quarantined", map[string]interface{}{"body": "FREE CRYPTO"}, Quarantine},
+		{"reject wins", map[string]interface{}{"body": "free crypto at https://bad.example.com/"}, Reject},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := v.Validate(context.Background(), mustCreateMessage(t, tc.content), "localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Outcome != tc.want {
+				t.Fatalf("got %s (%q), want %s", res.Outcome, res.Reason, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegisterRejectsDuplicateNames(t *testing.T) {
+	defer func() {
+		registeredMu.Lock()
+		registered = nil
+		registeredMu.Unlock()
+	}()
+	Register("first", &BodyPattern{})
+	Register("second", &BodyPattern{})
+	if got := Registered(); len(got) != 2 || got[0].Name != "first" || got[1].Name != "second" {
+		t.Fatalf("unexpected registered validators: %+v", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected duplicate registration to panic")
+		}
+	}()
+	Register("first", &BodyPattern{})
+}
@@ -15,6 +15,7 @@
 package version
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -63,6 +64,38 @@ func SupportedRoomVersion(version gomatrixserverlib.RoomVersion) (gomatrixserver
 	return result, nil
 }
 
+// roomVersionsWithCreatorField are the room versions in which the creator of a
+// room is given by the "creator" field of the m.room.create event content.
+// Room version 11 removed the field, so in that and later versions the sender
+// of the create event is the creator.
+var roomVersionsWithCreatorField = map[gomatrixserverlib.RoomVersion]struct{}{
+	"1": {}, "2": {}, "3": {}, "4": {}, "5": {},
+	"6": {}, "7": {}, "8": {}, "9": {}, "10": {},
+}
+
+// RoomCreator returns the user ID of the creator of a room, given its
+// m.room.create event, applying the rules for the room version.
+func RoomCreator(createEvent *gomatrixserverlib.HeaderedEvent) (string, error) {
+	if createEvent.Type() != gomatrixserverlib.MRoomCreate || !createEvent.StateKeyEquals("") {
+		return "", fmt.Errorf("event %s is not a create event", createEvent.EventID())
+	}
+	if _, ok := roomVersionsWithCreatorField[createEvent.RoomVersion]; !ok {
+		return createEvent.Sender(), nil
+	}
+	var content struct {
+		Creator string `json:"creator"`
+	}
+	if err := json.Unmarshal(createEvent.Content(), &content); err != nil {
+		return "", fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if content.Creator == "" {
+		// The auth rules don't enforce that the field is present, so fall
+		// back to the sender, which must be on the same server.
+		return createEvent.Sender(), nil
+	}
+	return content.Creator, nil
+}
+
 // UnknownVersionError is caused when the room version is not known.
 type UnknownVersionError struct {
 	Version gomatrixserverlib.RoomVersion
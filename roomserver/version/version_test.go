@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateEvent(t *testing.T, eventType string, content map[string]interface{}) *gomatrixserverlib.Event {
+	t.Helper()
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"event_id":  "$create:localhost",
+		"room_id":   "!test:localhost",
+		"sender":    "@sender:localhost",
+		"type":      eventType,
+		"state_key": "",
+		"content":   content,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestRoomCreator(t *testing.T) {
+	withCreator := mustCreateEvent(t, gomatrixserverlib.MRoomCreate, map[string]interface{}{"creator": "@creator:localhost"})
+	withoutCreator := mustCreateEvent(t, gomatrixserverlib.MRoomCreate, map[string]interface{}{})
+
+	tests := []struct {
+		name        string
+		event       *gomatrixserverlib.Event
+		roomVersion gomatrixserverlib.RoomVersion
+		want        string
+	}{
+		{"v1 uses creator field", withCreator, gomatrixserverlib.RoomVersionV1, "@creator:localhost"},
+		{"v6 uses creator field", withCreator, gomatrixserverlib.RoomVersionV6, "@creator:localhost"},
+		{"v10 uses creator field", withCreator, "10", "@creator:localhost"},
+		{"v11 uses sender", withCreator, "11", "@sender:localhost"},
+		{"missing creator field falls back to sender", withoutCreator, gomatrixserverlib.RoomVersionV6, "@sender:localhost"},
+		{"v11 without creator field", withoutCreator, "11", "@sender:localhost"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := RoomCreator(tc.event.Headered(tc.roomVersion))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	notCreate := mustCreateEvent(t, gomatrixserverlib.MRoomName, map[string]interface{}{"name": "test"})
+	if _, err := RoomCreator(notCreate.Headered(gomatrixserverlib.RoomVersionV6)); err == nil {
+		t.Fatal("expected an error for a non-create event")
+	}
+}
@@ -17,9 +17,11 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
@@ -38,6 +40,38 @@ type AppServiceAPI struct {
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
 
 	ConfigFiles []string `yaml:"config_files"`
+
+	// NormalizeServerNames lowercases the server name portion of user IDs and
+	// room aliases, and strips default ports from it, before matching them
+	// against appservice namespaces. The localpart is never changed.
+	NormalizeServerNames bool `yaml:"normalize_server_names"`
+
+	// AccessTokenInQuery sends the homeserver token to application services
+	// in the access_token query parameter, for older application services
+	// which don't accept it in the Authorization header.
+	AccessTokenInQuery bool `yaml:"access_token_in_query"`
+
+	// MaxConcurrentRequests caps the number of outbound query requests to
+	// application services which can be in flight at once, across all
+	// application services and queries. If zero then there is no cap.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+
+	// QueryRetry controls how queries to application services, such as
+	// whether a room alias or user ID exists, are retried when they fail.
+	QueryRetry QueryRetryOptions `yaml:"query_retry"`
+
+	// QueryCache remembers the answers of application services about whether
+	// room aliases and user IDs exist, so that they aren't asked every time.
+	QueryCache QueryCacheOptions `yaml:"query_cache"`
+
+	// ThirdPartyProtocolsRefreshInterval is how long the third party protocols
+	// described by application services are remembered before they are asked
+	// again. If zero then they are asked every time.
+	ThirdPartyProtocolsRefreshInterval time.Duration `yaml:"third_party_protocols_refresh_interval"`
+
+	// HTTPClient controls the HTTP client used for all requests to
+	// application services.
+	HTTPClient AppServiceHTTPClientOptions `yaml:"http_client"`
 }
 
 func (c *AppServiceAPI) Defaults(generate bool) {
@@ -47,12 +81,116 @@ func (c *AppServiceAPI) Defaults(generate bool) {
 	if generate {
 		c.Database.ConnectionString = "file:appservice.db"
 	}
+	c.MaxConcurrentRequests = 64
+	c.QueryRetry.Defaults()
+	c.QueryCache.Defaults()
+	c.ThirdPartyProtocolsRefreshInterval = time.Minute * 5
+	c.HTTPClient.Defaults()
 }
 
 func (c *AppServiceAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "app_service_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "app_service_api.internal_api.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "app_service_api.database.connection_string", string(c.Database.ConnectionString))
+	if c.MaxConcurrentRequests < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "app_service_api.max_concurrent_requests", c.MaxConcurrentRequests))
+	}
+	c.QueryRetry.Verify(configErrs)
+	c.QueryCache.Verify(configErrs)
+	if c.ThirdPartyProtocolsRefreshInterval < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "app_service_api.third_party_protocols_refresh_interval", c.ThirdPartyProtocolsRefreshInterval))
+	}
+	c.HTTPClient.Verify(configErrs)
+}
+
+type QueryRetryOptions struct {
+	// The maximum number of times that a query is sent, including the first
+	// time. Queries are only retried if the request failed or the application
+	// service responded with a server error. If zero then queries are sent once.
+	Attempts int `yaml:"attempts"`
+	// How long to wait before the first retry. The delay doubles with each
+	// retry, with some random jitter added.
+	BaseDelay time.Duration `yaml:"base_delay"`
+}
+
+func (c *QueryRetryOptions) Defaults() {
+	c.Attempts = 3
+	c.BaseDelay = time.Millisecond * 200
+}
+
+func (c *QueryRetryOptions) Verify(configErrs *ConfigErrors) {
+	if c.Attempts < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "app_service_api.query_retry.attempts", c.Attempts))
+	}
+	if c.BaseDelay < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "app_service_api.query_retry.base_delay", c.BaseDelay))
+	}
+}
+
+type QueryCacheOptions struct {
+	// The maximum number of answers to remember. If zero then application
+	// services are asked every time.
+	Size int `yaml:"size"`
+	// How long we remember that a room alias or user ID exists.
+	TTL time.Duration `yaml:"ttl"`
+	// How long we remember that a room alias or user ID doesn't exist. This
+	// should be shorter than the TTL, since it may be created at any time.
+	// If zero then these answers aren't remembered.
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+}
+
+func (c *QueryCacheOptions) Defaults() {
+	c.Size = 1000
+	c.TTL = time.Minute
+	c.NegativeTTL = time.Second * 10
+}
+
+func (c *QueryCacheOptions) Verify(configErrs *ConfigErrors) {
+	if c.Size < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "app_service_api.query_cache.size", c.Size))
+	}
+	if c.Size > 0 && c.TTL <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "app_service_api.query_cache.ttl", c.TTL))
+	}
+	if c.NegativeTTL < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "app_service_api.query_cache.negative_ttl", c.NegativeTTL))
+	}
+}
+
+type AppServiceHTTPClientOptions struct {
+	// How long to wait for a whole request to an application service,
+	// including reading the response. If zero then there is no timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// The maximum number of idle connections to keep open, across all
+	// application services, and to each application service. If the latter
+	// is zero then connections aren't reused.
+	MaxIdleConns        int `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	// How long an idle connection is kept open. If zero then idle connections
+	// are kept open until the limits above are reached.
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+}
+
+func (c *AppServiceHTTPClientOptions) Defaults() {
+	c.Timeout = time.Second * 30
+	c.MaxIdleConns = 100
+	c.MaxIdleConnsPerHost = 0
+	c.IdleConnTimeout = time.Second * 90
+}
+
+func (c *AppServiceHTTPClientOptions) Verify(configErrs *ConfigErrors) {
+	if c.Timeout < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "app_service_api.http_client.timeout", c.Timeout))
+	}
+	if c.MaxIdleConns < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "app_service_api.http_client.max_idle_conns", c.MaxIdleConns))
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "app_service_api.http_client.max_idle_conns_per_host", c.MaxIdleConnsPerHost))
+	}
+	if c.IdleConnTimeout < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "app_service_api.http_client.idle_conn_timeout", c.IdleConnTimeout))
+	}
 }
 
 // ApplicationServiceNamespace is the namespace that a specific application
@@ -79,7 +217,8 @@ type ApplicationServiceNamespace struct {
 type ApplicationService struct {
 	// User-defined, unique, persistent ID of the application service
 	ID string `yaml:"id"`
-	// Base URL of the application service
+	// Base URL of the application service. A unix:// URL, such as
+	// unix:///run/bridge.sock, reaches it over a Unix domain socket.
 	URL string `yaml:"url"`
 	// Application service token provided in requests to a homeserver
 	ASToken string `yaml:"as_token"`
@@ -94,6 +233,33 @@ type ApplicationService struct {
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// An optional template for the URLs of requests that we make to the
+	// application service, e.g. to route them through a gateway that needs
+	// path rewriting or extra query parameters. The placeholders {base_url},
+	// {path} and {access_token} are replaced with the application service URL,
+	// the escaped request path and the escaped homeserver token respectively.
+	// If empty then requests go to the application service URL as normal.
+	URLTemplate string `yaml:"url_template"`
+	// Optional extra HTTP headers to send with requests that we make to the
+	// application service.
+	RequestHeaders map[string]string `yaml:"request_headers"`
+	// Whether to normalize server names before namespace matching, copied
+	// from the app_service_api section of the Dendrite config
+	NormalizeServerNames bool `yaml:"-"`
+	// Whether to also send the homeserver token in the query string, copied
+	// from the app_service_api section of the Dendrite config
+	AccessTokenInQuery bool `yaml:"-"`
+}
+
+// ExpandURLTemplate returns the URL for a request to the given escaped path
+// on the application service using its URL template. It must only be called
+// if the application service has a URL template.
+func (a *ApplicationService) ExpandURLTemplate(escapedPath string) string {
+	return strings.NewReplacer(
+		"{base_url}", a.URL,
+		"{path}", escapedPath,
+		"{access_token}", url.QueryEscape(a.HSToken),
+	).Replace(a.URLTemplate)
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
@@ -117,6 +283,9 @@ func (a *ApplicationService) IsInterestedInRoomID(
 func (a *ApplicationService) IsInterestedInUserID(
 	userID string,
 ) bool {
+	if a.NormalizeServerNames {
+		userID = normalizeServerNameInID(userID)
+	}
 	if namespaceSlice, ok := a.NamespaceMap["users"]; ok {
 		for _, namespace := range namespaceSlice {
 			if namespace.RegexpObject.MatchString(userID) {
@@ -149,6 +318,9 @@ func (a *ApplicationService) OwnsNamespaceCoveringUserId(
 func (a *ApplicationService) IsInterestedInRoomAlias(
 	roomAlias string,
 ) bool {
+	if a.NormalizeServerNames {
+		roomAlias = normalizeServerNameInID(roomAlias)
+	}
 	if namespaceSlice, ok := a.NamespaceMap["aliases"]; ok {
 		for _, namespace := range namespaceSlice {
 			if namespace.RegexpObject.MatchString(roomAlias) {
@@ -160,6 +332,36 @@ func (a *ApplicationService) IsInterestedInRoomAlias(
 	return false
 }
 
+// normalizeServerNameInID normalizes the server name portion of a user ID or
+// room alias, i.e. everything after the first colon. The domain is lowercased,
+// a trailing dot is removed and the port is dropped if it is 443 or 8448. The
+// localpart is returned untouched.
+func normalizeServerNameInID(id string) string {
+	sep := strings.IndexByte(id, ':')
+	if sep < 0 {
+		return id
+	}
+	localpart, serverName := id[:sep], id[sep+1:]
+
+	host, port := serverName, ""
+	if strings.HasPrefix(serverName, "[") {
+		// IPv6 literal, e.g. [::1]:8448
+		if end := strings.IndexByte(serverName, ']'); end >= 0 {
+			host, port = serverName[:end+1], strings.TrimPrefix(serverName[end+1:], ":")
+		}
+	} else if i := strings.LastIndexByte(serverName, ':'); i >= 0 {
+		host, port = serverName[:i], serverName[i+1:]
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	switch port {
+	case "", "443", "8448":
+		return localpart + ":" + host
+	default:
+		return localpart + ":" + host + ":" + port
+	}
+}
+
 // loadAppServices iterates through all application service config files
 // and loads their data into the config object for later access.
 func loadAppServices(config *AppServiceAPI, derived *Derived) error {
@@ -186,6 +388,9 @@ func loadAppServices(config *AppServiceAPI, derived *Derived) error {
 			return err
 		}
 
+		appservice.NormalizeServerNames = config.NormalizeServerNames
+		appservice.AccessTokenInQuery = config.AccessTokenInQuery
+
 		// Append the parsed application service to the global config
 		derived.ApplicationServices = append(
 			derived.ApplicationServices, appservice,
@@ -312,6 +517,15 @@ func checkErrors(config *AppServiceAPI, derived *Derived) (err error) {
 		// Check if the url has trailing /'s. If so, remove them
 		appservice.URL = strings.TrimRight(appservice.URL, "/")
 
+		// Check that the URL template, if any, produces valid URLs.
+		if appservice.URLTemplate != "" {
+			if u, perr := url.Parse(appservice.ExpandURLTemplate("/path")); perr != nil || u.Scheme == "" || u.Host == "" {
+				return ConfigErrors([]string{fmt.Sprintf(
+					"Application service %s has an invalid url_template %q", appservice.ID, appservice.URLTemplate,
+				)})
+			}
+		}
+
 		// Check if we've already seen this ID. No two application services
 		// can have the same ID or token.
 		if idMap[appservice.ID] {
@@ -335,10 +549,6 @@ func checkErrors(config *AppServiceAPI, derived *Derived) (err error) {
 		if appservice.RateLimited {
 			log.Warn("WARNING: Application service option rate_limited is currently unimplemented")
 		}
-		// TODO: Remove once protocols is implemented
-		if len(appservice.Protocols) > 0 {
-			log.Warn("WARNING: Application service option protocols is currently unimplemented")
-		}
 	}
 
 	return setupRegexps(config, derived)
@@ -19,6 +19,11 @@ type JetStream struct {
 	TopicPrefix string `yaml:"topic_prefix"`
 	// Keep all storage in memory. This is mostly useful for unit tests.
 	InMemory bool `yaml:"in_memory"`
+	// The number of partitions to spread output room events over, by room ID.
+	// If zero then output room events aren't partitioned. Consumers refuse to
+	// start after switching between zero and non-zero if they still have
+	// events to process from before the switch.
+	OutputRoomEventPartitions int `yaml:"output_room_event_partitions"`
 }
 
 func (c *JetStream) TopicFor(name string) string {
@@ -32,6 +37,7 @@ func (c *JetStream) Durable(name string) nats.SubOpt {
 func (c *JetStream) Defaults(generate bool) {
 	c.Addresses = []string{}
 	c.TopicPrefix = "Dendrite"
+	c.OutputRoomEventPartitions = 0
 	if generate {
 		c.StoragePath = Path("./")
 	}
@@ -43,4 +49,7 @@ func (c *JetStream) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if !isMonolith {
 		checkNotZero(configErrs, "global.jetstream.addresses", int64(len(c.Addresses)))
 	}
+	if c.OutputRoomEventPartitions < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "global.jetstream.output_room_event_partitions", c.OutputRoomEventPartitions))
+	}
 }
@@ -1,11 +1,143 @@
 package config
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// What to do with new events whose origin_server_ts is implausibly far
+	// into the future compared to our own clock.
+	FutureEvents FutureEventsOptions `yaml:"future_events"`
+
+	// What to do with new events received over federation from servers that
+	// aren't currently in the room.
+	NonMemberOrigins NonMemberOriginsOptions `yaml:"non_member_origins"`
+
+	// How many auth events from a single auth chain can have their signatures
+	// verified at the same time when fetching missing auth events. If zero
+	// then this is the number of CPUs available, i.e. GOMAXPROCS.
+	AuthEventVerificationWorkers int `yaml:"auth_event_verification_workers"`
+
+	// An optional webhook which is consulted before new events are accepted.
+	AcceptanceWebhook AcceptanceWebhookOptions `yaml:"acceptance_webhook"`
+
+	// An optional webhook which is told about events that were rejected.
+	RejectionWebhook RejectionWebhookOptions `yaml:"rejection_webhook"`
+
+	// Per-origin server metrics and quotas for events received over federation.
+	OriginLimits OriginLimitsOptions `yaml:"origin_limits"`
+
+	// How long each registered event validator has to make a decision about
+	// a new event before it is skipped.
+	EventValidatorTimeout time.Duration `yaml:"event_validator_timeout"`
+
+	// Whether recently soft-failed events are re-evaluated when the state of
+	// their room changes, so that they can be accepted after all.
+	SoftFailReevaluation SoftFailReevaluationOptions `yaml:"soft_fail_reevaluation"`
+
+	// Whether input events which are submitted synchronously are journalled
+	// to the database until they have been processed, so that they are
+	// processed after a restart rather than lost. Input events which are
+	// submitted asynchronously are always queued durably in JetStream.
+	PersistInputQueue bool `yaml:"persist_input_queue"`
+
+	// Prioritise input events for rooms that users are actively looking at
+	// when the roomserver is busy.
+	ActivityPriority ActivityPriorityOptions `yaml:"activity_priority"`
+
+	// How many recently emitted redactions to remember in memory, so that
+	// duplicate redaction output events can be skipped without asking the
+	// database. If zero then the database is always asked.
+	RedactionDedupWindow int `yaml:"redaction_dedup_window"`
+
+	// How long to remember which output events have been emitted, so that
+	// reprocessing an input event doesn't emit them again. If zero then they
+	// are remembered forever.
+	OutputEventRetention time.Duration `yaml:"output_event_retention"`
+
+	// Rooms whose state must never be overwritten by the state given to us
+	// with an event, e.g. when rejoining over federation. Instead the given
+	// state is always merged with the state that we already have.
+	NeverOverwriteStateRooms []string `yaml:"never_overwrite_state_rooms"`
+
+	// How long to wait for the database when checking whether an outlier
+	// has already been stored, before processing it anyway. If zero then the
+	// check is only bounded by the time limit for processing the event.
+	OutlierDedupTimeout time.Duration `yaml:"outlier_dedup_timeout"`
+
+	// Which events are server notices, which are delivered under a relaxed
+	// acceptance policy.
+	ServerNotices ServerNoticesOptions `yaml:"server_notices"`
+
+	// What to do with new events whose auth events can't be fetched from
+	// any of the servers in the room.
+	AuthFetchFailure AuthFetchFailureOptions `yaml:"auth_fetch_failure"`
+
+	// The maximum number of auth events that can be held in memory at once
+	// while processing a single event. Events with larger auth chains are
+	// given up on. If zero then there is no limit.
+	MaxKnownAuthEvents int `yaml:"max_known_auth_events"`
+
+	// The maximum number of events in an auth chain that a remote server gives
+	// us for an event. Longer auth chains are refused. If zero then there is
+	// no limit.
+	MaxAuthChainLength int `yaml:"max_auth_chain_length"`
+
+	// The maximum number of events that can be fetched over federation to
+	// fill in the missing prev events and state of a single new event. The
+	// event is rejected once more are needed. If zero then there is no limit.
+	MaxMissingEvents int `yaml:"max_missing_events"`
+
+	// An optional log of the decision made about each processed event.
+	DecisionLog DecisionLogOptions `yaml:"decision_log"`
+
+	// An in-memory cache of auth events which were recently fetched over
+	// federation, so that they aren't verified and stored again for other
+	// events in the same room.
+	AuthEventCache AuthEventCacheOptions `yaml:"auth_event_cache"`
+
+	// An in-memory cache of which servers recently answered our federation
+	// requests for events in each room, and which failed to.
+	ServerReputation ServerReputationOptions `yaml:"server_reputation"`
+
+	// How requests to other servers for the auth events of an event are
+	// spaced out and limited when servers fail to answer.
+	FederationRetry FederationRetryOptions `yaml:"federation_retry"`
+
+	// An in-memory cache of the events which were recently processed for each
+	// client transaction ID, so that retried sends aren't processed twice.
+	TransactionDedup TransactionDedupOptions `yaml:"transaction_dedup"`
+
+	// Rooms created on this server whose new events are never soft-failed
+	// for failing auth against the current room state.
+	SoftFailDisabledRooms []string `yaml:"soft_fail_disabled_rooms"`
+
+	// Force specific rooms to use a state resolution algorithm other than
+	// the one mandated by their room version. Dangerous, for recovery only.
+	ForcedStateResolution ForcedStateResolutionOptions `yaml:"forced_state_resolution"`
+
+	// An in-memory cache of state resolvers for recently active rooms, so
+	// that consecutive events in a room reuse the state events which were
+	// already loaded for the room.
+	StateResolutionCache StateResolutionCacheOptions `yaml:"state_resolution_cache"`
+
+	// Whether new events created on this server have their auth events loaded
+	// straight from the database, skipping the machinery for fetching missing
+	// auth events over federation. Events received over federation are never
+	// affected, and the auth checks themselves still happen either way.
+	TrustLocalAuthEvents bool `yaml:"trust_local_auth_events"`
+
+	// How the metrics about processing events are labelled.
+	EventMetrics EventMetricsOptions `yaml:"event_metrics"`
 }
 
 func (c *RoomServer) Defaults(generate bool) {
@@ -15,10 +147,576 @@ func (c *RoomServer) Defaults(generate bool) {
 	if generate {
 		c.Database.ConnectionString = "file:roomserver.db"
 	}
+	c.FutureEvents.Defaults()
+	c.NonMemberOrigins.Defaults()
+	c.AuthEventVerificationWorkers = 0
+	c.AcceptanceWebhook.Defaults()
+	c.RejectionWebhook.Defaults()
+	c.OriginLimits.Defaults()
+	c.EventValidatorTimeout = time.Millisecond * 500
+	c.SoftFailReevaluation.Defaults()
+	c.PersistInputQueue = false
+	c.ActivityPriority.Defaults()
+	c.RedactionDedupWindow = 0
+	c.OutputEventRetention = time.Hour * 24 * 7
+	c.OutlierDedupTimeout = 0
+	c.ServerNotices.Defaults()
+	c.AuthFetchFailure.Defaults()
+	c.MaxKnownAuthEvents = 0
+	c.MaxAuthChainLength = 5000
+	c.MaxMissingEvents = 0
+	c.DecisionLog.Defaults()
+	c.AuthEventCache.Defaults()
+	c.ServerReputation.Defaults()
+	c.FederationRetry.Defaults()
+	c.TransactionDedup.Defaults()
+	c.ForcedStateResolution.Defaults()
+	c.StateResolutionCache.Defaults()
+	c.TrustLocalAuthEvents = true
+	c.EventMetrics.Defaults()
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
+	c.FutureEvents.Verify(configErrs)
+	c.NonMemberOrigins.Verify(configErrs)
+	if c.AuthEventVerificationWorkers < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.auth_event_verification_workers", c.AuthEventVerificationWorkers))
+	}
+	c.AcceptanceWebhook.Verify(configErrs)
+	c.RejectionWebhook.Verify(configErrs)
+	c.OriginLimits.Verify(configErrs)
+	if c.EventValidatorTimeout <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.event_validator_timeout", c.EventValidatorTimeout))
+	}
+	c.SoftFailReevaluation.Verify(configErrs)
+	c.ActivityPriority.Verify(configErrs)
+	if c.RedactionDedupWindow < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.redaction_dedup_window", c.RedactionDedupWindow))
+	}
+	if c.OutputEventRetention < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.output_event_retention", c.OutputEventRetention))
+	}
+	if c.OutlierDedupTimeout < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.outlier_dedup_timeout", c.OutlierDedupTimeout))
+	}
+	c.ServerNotices.Verify(configErrs)
+	c.AuthFetchFailure.Verify(configErrs)
+	if c.MaxKnownAuthEvents < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.max_known_auth_events", c.MaxKnownAuthEvents))
+	}
+	if c.MaxAuthChainLength < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.max_auth_chain_length", c.MaxAuthChainLength))
+	}
+	if c.MaxMissingEvents < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.max_missing_events", c.MaxMissingEvents))
+	}
+	c.DecisionLog.Verify(configErrs)
+	c.AuthEventCache.Verify(configErrs)
+	c.ServerReputation.Verify(configErrs)
+	c.FederationRetry.Verify(configErrs)
+	c.TransactionDedup.Verify(configErrs)
+	for _, roomID := range c.SoftFailDisabledRooms {
+		// Only rooms created on this server can be listed, so that this
+		// can't be used to weaken the protection for other servers' rooms.
+		_, domain, err := gomatrixserverlib.SplitID('!', roomID)
+		if err != nil || (c.Matrix != nil && domain != c.Matrix.ServerName) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.soft_fail_disabled_rooms", roomID))
+		}
+	}
+	c.ForcedStateResolution.Verify(configErrs)
+	c.StateResolutionCache.Verify(configErrs)
+	c.EventMetrics.Verify(configErrs)
+}
+
+const (
+	// FutureEventsActionAllow accepts future-dated events as normal.
+	FutureEventsActionAllow = "allow"
+	// FutureEventsActionFlag accepts future-dated events but logs and counts them.
+	FutureEventsActionFlag = "flag"
+	// FutureEventsActionSoftFail stores future-dated events but soft-fails them
+	// so that they don't become forward extremities or get sent to clients.
+	FutureEventsActionSoftFail = "soft_fail"
+)
+
+type FutureEventsOptions struct {
+	// The action to take: "allow", "flag" or "soft_fail". Defaults to "allow".
+	Action string `yaml:"action"`
+	// How far ahead of our clock the origin_server_ts of an event can be
+	// before the action above is taken.
+	MaxSkew time.Duration `yaml:"max_skew"`
+}
+
+func (c *FutureEventsOptions) Defaults() {
+	c.Action = FutureEventsActionAllow
+	c.MaxSkew = time.Minute * 5
+}
+
+func (c *FutureEventsOptions) Verify(configErrs *ConfigErrors) {
+	switch c.Action {
+	case "", FutureEventsActionAllow, FutureEventsActionFlag, FutureEventsActionSoftFail:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.future_events.action", c.Action))
+	}
+	if c.MaxSkew < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.future_events.max_skew", c.MaxSkew))
+	}
+}
+
+const (
+	// NonMemberOriginsActionAllow accepts events from non-member origins as normal.
+	NonMemberOriginsActionAllow = "allow"
+	// NonMemberOriginsActionFlag accepts events from non-member origins but
+	// logs and counts them.
+	NonMemberOriginsActionFlag = "flag"
+	// NonMemberOriginsActionSoftFail stores events from non-member origins but
+	// soft-fails them.
+	NonMemberOriginsActionSoftFail = "soft_fail"
+)
+
+type NonMemberOriginsOptions struct {
+	// The action to take: "allow", "flag" or "soft_fail". Defaults to "allow".
+	Action string `yaml:"action"`
+}
+
+func (c *NonMemberOriginsOptions) Defaults() {
+	c.Action = NonMemberOriginsActionAllow
+}
+
+func (c *NonMemberOriginsOptions) Verify(configErrs *ConfigErrors) {
+	switch c.Action {
+	case "", NonMemberOriginsActionAllow, NonMemberOriginsActionFlag, NonMemberOriginsActionSoftFail:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.non_member_origins.action", c.Action))
+	}
+}
+
+type AcceptanceWebhookOptions struct {
+	// The URL to POST new events to before they are accepted. If this is
+	// empty then the webhook is disabled.
+	URL string `yaml:"url"`
+	// How long to wait for the webhook to respond.
+	Timeout time.Duration `yaml:"timeout"`
+	// If true, events are rejected when the webhook can't be reached or
+	// doesn't respond in time. Otherwise they are accepted.
+	FailClosed bool `yaml:"fail_closed"`
+}
+
+func (c *AcceptanceWebhookOptions) Defaults() {
+	c.URL = ""
+	c.Timeout = time.Second * 2
+	c.FailClosed = false
+}
+
+func (c *AcceptanceWebhookOptions) Verify(configErrs *ConfigErrors) {
+	if c.URL == "" {
+		return
+	}
+	checkURL(configErrs, "room_server.acceptance_webhook.url", c.URL)
+	if c.Timeout <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.acceptance_webhook.timeout", c.Timeout))
+	}
+}
+
+type RejectionWebhookOptions struct {
+	// The URL to POST rejected events to. If this is empty then the webhook
+	// is disabled.
+	URL string `yaml:"url"`
+	// How long to wait for the webhook to respond.
+	Timeout time.Duration `yaml:"timeout"`
+	// How many rejections can be waiting to be sent to the webhook. If the
+	// webhook can't keep up then further rejections are dropped, rather than
+	// slowing down event processing.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+func (c *RejectionWebhookOptions) Defaults() {
+	c.URL = ""
+	c.Timeout = time.Second * 5
+	c.BufferSize = 1024
+}
+
+func (c *RejectionWebhookOptions) Verify(configErrs *ConfigErrors) {
+	if c.URL == "" {
+		return
+	}
+	checkURL(configErrs, "room_server.rejection_webhook.url", c.URL)
+	if c.Timeout <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.rejection_webhook.timeout", c.Timeout))
+	}
+	checkPositive(configErrs, "room_server.rejection_webhook.buffer_size", int64(c.BufferSize))
+}
+
+const (
+	// OriginQuotaActionDefer defers events over the quota, so that they are
+	// retried later once the origin server is back within its quota.
+	OriginQuotaActionDefer = "defer"
+	// OriginQuotaActionSoftFail stores events over the quota but soft-fails them.
+	OriginQuotaActionSoftFail = "soft_fail"
+)
+
+type OriginLimitsOptions struct {
+	// How many origin servers get their own label in the per-origin metrics.
+	// The busiest servers are labelled individually and all other servers are
+	// aggregated together, to keep the number of metric series bounded.
+	MetricsTopServers int `yaml:"metrics_top_servers"`
+	// The sustained rate of new events per second that will be accepted from
+	// any one origin server. If this is zero then there is no quota.
+	EventsPerSecond float64 `yaml:"events_per_second"`
+	// How many events an origin server can send in a burst above the sustained rate.
+	Burst int `yaml:"burst"`
+	// What to do with events over the quota: "defer" or "soft_fail".
+	Action string `yaml:"action"`
+}
+
+func (c *OriginLimitsOptions) Defaults() {
+	c.MetricsTopServers = 20
+	c.EventsPerSecond = 0
+	c.Burst = 100
+	c.Action = OriginQuotaActionDefer
+}
+
+func (c *OriginLimitsOptions) Verify(configErrs *ConfigErrors) {
+	if c.MetricsTopServers < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.origin_limits.metrics_top_servers", c.MetricsTopServers))
+	}
+	if c.EventsPerSecond < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %f", "room_server.origin_limits.events_per_second", c.EventsPerSecond))
+	}
+	if c.EventsPerSecond == 0 {
+		return
+	}
+	checkPositive(configErrs, "room_server.origin_limits.burst", int64(c.Burst))
+	switch c.Action {
+	case OriginQuotaActionDefer, OriginQuotaActionSoftFail:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.origin_limits.action", c.Action))
+	}
+}
+
+type SoftFailReevaluationOptions struct {
+	// Whether soft-failed events are recorded and re-evaluated. Defaults to false.
+	Enabled bool `yaml:"enabled"`
+	// How long after being soft-failed an event is still eligible to be
+	// re-evaluated. Older events are forgotten about.
+	MaxAge time.Duration `yaml:"max_age"`
+	// The maximum number of soft-failed events in a room to re-evaluate each
+	// time the state of the room changes.
+	MaxEventsPerPass int `yaml:"max_events_per_pass"`
+}
+
+func (c *SoftFailReevaluationOptions) Defaults() {
+	c.Enabled = false
+	c.MaxAge = time.Hour * 24
+	c.MaxEventsPerPass = 50
+}
+
+func (c *SoftFailReevaluationOptions) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.MaxAge <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.soft_fail_reevaluation.max_age", c.MaxAge))
+	}
+	checkPositive(configErrs, "room_server.soft_fail_reevaluation.max_events_per_pass", int64(c.MaxEventsPerPass))
+}
+
+type ActivityPriorityOptions struct {
+	// The maximum number of input events that can be processed at the same
+	// time across all rooms. When this many events are being processed,
+	// events for active rooms are processed next, ahead of events for other
+	// rooms. If this is zero then there is no limit and no prioritisation.
+	MaxConcurrentEvents int `yaml:"max_concurrent_events"`
+	// How long a room is considered active for after a user was last seen
+	// looking at it.
+	HintDuration time.Duration `yaml:"hint_duration"`
+}
+
+func (c *ActivityPriorityOptions) Defaults() {
+	c.MaxConcurrentEvents = 0
+	c.HintDuration = time.Minute * 2
+}
+
+func (c *ActivityPriorityOptions) Verify(configErrs *ConfigErrors) {
+	if c.MaxConcurrentEvents < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.activity_priority.max_concurrent_events", c.MaxConcurrentEvents))
+	}
+	if c.MaxConcurrentEvents > 0 && c.HintDuration <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.activity_priority.hint_duration", c.HintDuration))
+	}
+}
+
+type ServerNoticesOptions struct {
+	// Whether server notices get the relaxed acceptance policy.
+	Enabled bool `yaml:"enabled"`
+	// The localpart of the local user that sends server notices.
+	LocalPart string `yaml:"local_part"`
+	// If given, only events in these rooms are server notices.
+	RoomIDs []string `yaml:"room_ids"`
+}
+
+func (c *ServerNoticesOptions) Defaults() {
+	c.Enabled = false
+	c.LocalPart = "notices"
+}
+
+func (c *ServerNoticesOptions) Verify(configErrs *ConfigErrors) {
+	if c.Enabled {
+		checkNotEmpty(configErrs, "room_server.server_notices.local_part", c.LocalPart)
+	}
+}
+
+const (
+	// AuthFetchFailureActionReject gives up on events straight away if their
+	// auth events can't be fetched.
+	AuthFetchFailureActionReject = "reject"
+	// AuthFetchFailureActionDefer defers events if their auth events can't be
+	// fetched, so that they are retried later when other servers may be able
+	// to provide them.
+	AuthFetchFailureActionDefer = "defer"
+)
+
+type AuthFetchFailureOptions struct {
+	// What to do with new events whose auth events can't be fetched:
+	// "reject" or "defer".
+	Action string `yaml:"action"`
+	// How long to keep retrying a deferred event for before giving up on it.
+	MaxDeferAge time.Duration `yaml:"max_defer_age"`
+}
+
+func (c *AuthFetchFailureOptions) Defaults() {
+	c.Action = AuthFetchFailureActionReject
+	c.MaxDeferAge = time.Hour
+}
+
+func (c *AuthFetchFailureOptions) Verify(configErrs *ConfigErrors) {
+	switch c.Action {
+	case "", AuthFetchFailureActionReject:
+	case AuthFetchFailureActionDefer:
+		if c.MaxDeferAge <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.auth_fetch_failure.max_defer_age", c.MaxDeferAge))
+		}
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.auth_fetch_failure.action", c.Action))
+	}
+}
+
+type DecisionLogOptions struct {
+	// The file to append decisions to, one JSON object per line. If empty
+	// then decisions aren't logged.
+	Path Path `yaml:"path"`
+	// How many decisions can be waiting to be written to the file. If the
+	// file can't keep up then further decisions are dropped, rather than
+	// slowing down event processing.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+func (c *DecisionLogOptions) Defaults() {
+	c.Path = ""
+	c.BufferSize = 1024
+}
+
+func (c *DecisionLogOptions) Verify(configErrs *ConfigErrors) {
+	if c.Path == "" {
+		return
+	}
+	checkPositive(configErrs, "room_server.decision_log.buffer_size", int64(c.BufferSize))
+}
+
+type AuthEventCacheOptions struct {
+	// The maximum number of auth events to cache across all rooms. If zero
+	// then nothing is cached.
+	Size int `yaml:"size"`
+	// How long an auth event is cached for after it was fetched.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c *AuthEventCacheOptions) Defaults() {
+	c.Size = 0
+	c.TTL = time.Minute * 10
+}
+
+func (c *AuthEventCacheOptions) Verify(configErrs *ConfigErrors) {
+	if c.Size < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.auth_event_cache.size", c.Size))
+	}
+	if c.Size > 0 && c.TTL <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.auth_event_cache.ttl", c.TTL))
+	}
+}
+
+type ServerReputationOptions struct {
+	// The maximum number of servers to remember across all rooms. If zero
+	// then servers are always asked in the order that they were found.
+	Size int `yaml:"size"`
+	// How long we remember whether a server answered or not.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c *ServerReputationOptions) Defaults() {
+	c.Size = 1000
+	c.TTL = time.Minute * 10
+}
+
+func (c *ServerReputationOptions) Verify(configErrs *ConfigErrors) {
+	if c.Size < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.server_reputation.size", c.Size))
+	}
+	if c.Size > 0 && c.TTL <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.server_reputation.ttl", c.TTL))
+	}
+}
+
+type FederationRetryOptions struct {
+	// The maximum number of requests made to other servers to fetch the auth
+	// events of a single event. If zero then every server can be asked.
+	MaxAttempts int `yaml:"max_attempts"`
+	// How long to wait before asking the next server after one fails. The
+	// delay doubles for each consecutive failure, with some jitter, and goes
+	// back to nothing once a server answers. If zero then there is no delay.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	// The longest delay between asking servers.
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+func (c *FederationRetryOptions) Defaults() {
+	c.MaxAttempts = 0
+	c.BaseDelay = time.Millisecond * 100
+	c.MaxDelay = time.Second * 2
+}
+
+func (c *FederationRetryOptions) Verify(configErrs *ConfigErrors) {
+	if c.MaxAttempts < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.federation_retry.max_attempts", c.MaxAttempts))
+	}
+	if c.BaseDelay < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.federation_retry.base_delay", c.BaseDelay))
+	}
+	if c.BaseDelay > 0 && c.MaxDelay < c.BaseDelay {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.federation_retry.max_delay", c.MaxDelay))
+	}
+}
+
+type TransactionDedupOptions struct {
+	// The maximum number of transactions to remember. If zero then events are
+	// never deduplicated by transaction ID.
+	Size int `yaml:"size"`
+	// How long a transaction is remembered for after its event was processed.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c *TransactionDedupOptions) Defaults() {
+	c.Size = 10000
+	c.TTL = time.Minute * 10
+}
+
+func (c *TransactionDedupOptions) Verify(configErrs *ConfigErrors) {
+	if c.Size < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.transaction_dedup.size", c.Size))
+	}
+	if c.Size > 0 && c.TTL <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.transaction_dedup.ttl", c.TTL))
+	}
+}
+
+const (
+	// StateResolutionV1 is the original state resolution algorithm, used by
+	// room version 1.
+	StateResolutionV1 = "v1"
+	// StateResolutionV2 is the state resolution algorithm used by room
+	// versions 2 and above.
+	StateResolutionV2 = "v2"
+)
+
+type ForcedStateResolutionOptions struct {
+	// Whether the overrides below are applied at all. Forcing a room to use
+	// a different algorithm to the other servers in the room can leave us
+	// with a different view of the room state to them, so this must be
+	// turned on explicitly.
+	Enabled bool `yaml:"enabled"`
+	// A map of room ID to the state resolution algorithm to use for that
+	// room, either "v1" or "v2".
+	Rooms map[string]string `yaml:"rooms"`
+}
+
+func (c *ForcedStateResolutionOptions) Defaults() {
+	c.Enabled = false
+	c.Rooms = nil
+}
+
+func (c *ForcedStateResolutionOptions) Verify(configErrs *ConfigErrors) {
+	for roomID, algorithm := range c.Rooms {
+		if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.forced_state_resolution.rooms", roomID))
+		}
+		switch algorithm {
+		case StateResolutionV1, StateResolutionV2:
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.forced_state_resolution.rooms", algorithm))
+		}
+	}
+}
+
+type StateResolutionCacheOptions struct {
+	// The maximum number of rooms to cache a state resolver for. If zero
+	// then a new state resolver is used for every event.
+	Size int `yaml:"size"`
+	// The maximum number of state events to keep loaded for each room. A
+	// room's state resolver is thrown away once it has loaded more than this.
+	MaxEvents int `yaml:"max_events"`
+}
+
+func (c *StateResolutionCacheOptions) Defaults() {
+	c.Size = 16
+	c.MaxEvents = 1000
+}
+
+func (c *StateResolutionCacheOptions) Verify(configErrs *ConfigErrors) {
+	if c.Size < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.state_resolution_cache.size", c.Size))
+	}
+	if c.Size > 0 {
+		checkPositive(configErrs, "room_server.state_resolution_cache.max_events", int64(c.MaxEvents))
+	}
+}
+
+const (
+	// EventMetricsRoomLabelRoomID labels event metrics with the room ID.
+	EventMetricsRoomLabelRoomID = "room_id"
+	// EventMetricsRoomLabelRoomVersion labels event metrics with the room
+	// version instead of the room ID.
+	EventMetricsRoomLabelRoomVersion = "room_version"
+	// EventMetricsRoomLabelRoomHash labels event metrics with a bucket that
+	// the room ID hashes to instead of the room ID.
+	EventMetricsRoomLabelRoomHash = "room_hash"
+	// EventMetricsRoomLabelNone doesn't label event metrics by room at all.
+	EventMetricsRoomLabelNone = "none"
+)
+
+type EventMetricsOptions struct {
+	// How the processroomevent_duration_millis and state resolution metrics
+	// are labelled by room: "room_id", "room_version", "room_hash" or "none".
+	// Labelling by room ID creates a series for every room, which is costly
+	// with many rooms.
+	// Defaults to "room_id".
+	RoomLabel string `yaml:"room_label"`
+	// How many buckets room IDs are hashed into when labelling by "room_hash".
+	RoomHashBuckets int `yaml:"room_hash_buckets"`
+}
+
+func (c *EventMetricsOptions) Defaults() {
+	c.RoomLabel = EventMetricsRoomLabelRoomID
+	c.RoomHashBuckets = 64
+}
+
+func (c *EventMetricsOptions) Verify(configErrs *ConfigErrors) {
+	switch c.RoomLabel {
+	case "", EventMetricsRoomLabelRoomID, EventMetricsRoomLabelRoomVersion, EventMetricsRoomLabelNone:
+	case EventMetricsRoomLabelRoomHash:
+		checkPositive(configErrs, "room_server.event_metrics.room_hash_buckets", int64(c.RoomHashBuckets))
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.event_metrics.room_label", c.RoomLabel))
+	}
 }
@@ -245,6 +245,59 @@ func TestReadKey(t *testing.T) {
 	}
 }
 
+func TestNormalizeServerNameInID(t *testing.T) {
+	tests := map[string]string{
+		"@Alice:Example.ORG":        "@Alice:example.org",
+		"@Alice:EXAMPLE.org:8448":   "@Alice:example.org",
+		"#Room:Example.org.:443":    "#Room:example.org",
+		"@bob:Example.org:8008":     "@bob:example.org:8008",
+		"@bob:[::1]:8448":           "@bob:[::1]",
+		"@bob:[::1]:1234":           "@bob:[::1]:1234",
+		"@UPPER.Case_Local:Foo.Bar": "@UPPER.Case_Local:foo.bar",
+		"no-server-name":            "no-server-name",
+	}
+	for input, want := range tests {
+		if got := normalizeServerNameInID(input); got != want {
+			t.Errorf("normalizeServerNameInID(%q): wanted %q, got %q", input, want, got)
+		}
+	}
+}
+
+func TestAppserviceInterestWithMixedCaseServerNames(t *testing.T) {
+	as := ApplicationService{
+		NamespaceMap: map[string][]ApplicationServiceNamespace{
+			"users":   {{Regex: "^@_irc_.*:example\\.org$"}},
+			"aliases": {{Regex: "^#_irc_.*:example\\.org$"}},
+		},
+	}
+	for key := range as.NamespaceMap {
+		if err := compileNamespaceRegexes(as.NamespaceMap[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if as.IsInterestedInUserID("@_irc_alice:Example.ORG") {
+		t.Error("expected no interest in mixed-case user ID without normalization")
+	}
+
+	as.NormalizeServerNames = true
+	if !as.IsInterestedInUserID("@_irc_alice:Example.ORG") {
+		t.Error("expected interest in mixed-case user ID")
+	}
+	if !as.IsInterestedInUserID("@_irc_alice:EXAMPLE.org:8448") {
+		t.Error("expected interest in user ID with default port")
+	}
+	if !as.IsInterestedInRoomAlias("#_irc_room:eXample.Org:443") {
+		t.Error("expected interest in mixed-case room alias")
+	}
+	if as.IsInterestedInUserID("@_IRC_alice:example.org") {
+		t.Error("expected the localpart not to be normalized")
+	}
+	if as.IsInterestedInUserID("@_irc_alice:example.org:8008") {
+		t.Error("expected non-default ports to be kept")
+	}
+}
+
 const testKeyID = "ed25519:c8NsuQ"
 
 const testKey = `
@@ -74,8 +74,12 @@ func setupNATS(cfg *config.JetStream, nc *natsclient.Conn) (nats.JetStreamContex
 		if err != nil && err != natsclient.ErrStreamNotFound {
 			logrus.WithError(err).Fatal("Unable to get stream info")
 		}
+		subjects := []string{name}
+		if partitionedStreams[stream.Name] {
+			subjects = append(subjects, name+".>")
+		}
 		if info == nil {
-			stream.Subjects = []string{name}
+			stream.Subjects = subjects
 
 			// If we're trying to keep everything in memory (e.g. unit tests)
 			// then overwrite the storage policy.
@@ -90,6 +94,14 @@ func setupNATS(cfg *config.JetStream, nc *natsclient.Conn) (nats.JetStreamContex
 			if _, err = s.AddStream(&namespaced); err != nil {
 				logrus.WithError(err).WithField("stream", name).Fatal("Unable to add stream")
 			}
+		} else if len(info.Config.Subjects) < len(subjects) {
+			// The stream was created before it could be partitioned, so
+			// allow it to take messages for the partitions too.
+			updated := info.Config
+			updated.Subjects = subjects
+			if _, err = s.UpdateStream(&updated); err != nil {
+				logrus.WithError(err).WithField("stream", name).Fatal("Unable to update stream")
+			}
 		}
 	}
 
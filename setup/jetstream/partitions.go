@@ -0,0 +1,88 @@
+package jetstream
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+// partitionedStreams are the streams which can have messages published to
+// partitions, as subjects below the stream name.
+var partitionedStreams = map[string]bool{
+	OutputRoomEvent: true,
+}
+
+// PartitionForRoom returns which of the given number of partitions the events
+// for a room belong to. A room always maps to the same partition for the same
+// number of partitions.
+func PartitionForRoom(roomID string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(roomID))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// RoomSubject returns the subject to publish a message about a room to on the
+// given topic. If partitions is zero then the topic isn't partitioned and the
+// topic itself is returned.
+func RoomSubject(topic, roomID string, partitions int) string {
+	if partitions <= 0 {
+		return topic
+	}
+	return PartitionSubject(topic, PartitionForRoom(roomID, partitions))
+}
+
+// PartitionSubject returns the subject for a single partition of the topic,
+// e.g. for a consumer which only handles some partitions.
+func PartitionSubject(topic string, partition int) string {
+	return topic + "." + strconv.Itoa(partition)
+}
+
+// SubscribeSubject returns the subject to subscribe to in order to receive
+// all messages on the topic, whether it is partitioned or not.
+func SubscribeSubject(topic string, partitions int) string {
+	if partitions <= 0 {
+		return topic
+	}
+	return topic + ".>"
+}
+
+// PrepareDurable makes sure that the durable consumer on the stream can be
+// subscribed to the subject. Changing the number of partitions changes the
+// subject that consumers subscribe to, which NATS won't allow for a durable
+// consumer that already exists with a different subject. If the existing
+// durable has delivered and had acknowledged all of the messages on its old
+// subject then it is deleted, so that subscribing recreates it on the new
+// subject. Otherwise an error is returned rather than losing those messages,
+// and the previous number of partitions must be used until they have been
+// consumed.
+func PrepareDurable(js nats.JetStreamContext, stream, durable, subject string) error {
+	info, err := js.ConsumerInfo(stream, durable)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("js.ConsumerInfo: %w", err)
+	}
+	// A durable with no filter subject receives every message on the stream,
+	// so it doesn't matter which subject we subscribe to.
+	if info.Config.FilterSubject == "" || info.Config.FilterSubject == subject {
+		return nil
+	}
+	if pending := info.NumPending + uint64(info.NumAckPending); pending > 0 {
+		return fmt.Errorf(
+			"durable consumer %q still has %d messages to process on subject %q, so it can't be moved to subject %q "+
+				"until they have been processed: keep the previous output_room_event_partitions setting until then",
+			durable, pending, info.Config.FilterSubject, subject,
+		)
+	}
+	if err = js.DeleteConsumer(stream, durable); err != nil {
+		return fmt.Errorf("js.DeleteConsumer: %w", err)
+	}
+	return nil
+}
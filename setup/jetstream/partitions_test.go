@@ -0,0 +1,118 @@
+package jetstream
+
+import (
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func mustStartJetStream(t *testing.T) nats.JetStreamContext {
+	t.Helper()
+	srv, err := natsserver.NewServer(&natsserver.Options{
+		ServerName:      "test",
+		DontListen:      true,
+		JetStream:       true,
+		StoreDir:        t.TempDir(),
+		NoSystemAccount: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(time.Second * 10) {
+		t.Fatal("NATS did not start in time")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func TestPrepareDurable(t *testing.T) {
+	js := mustStartJetStream(t)
+	const stream, durable = "TestOutputRoomEvent", "TestConsumer"
+	partitioned := SubscribeSubject(stream, 4)
+	if _, err := js.AddStream(&nats.StreamConfig{
+		Name:      stream,
+		Subjects:  []string{stream, partitioned},
+		Retention: nats.InterestPolicy,
+		Storage:   nats.MemoryStorage,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// There's nothing to do if the durable doesn't exist yet.
+	if err := PrepareDurable(js, stream, durable, partitioned); err != nil {
+		t.Fatalf("PrepareDurable with no durable: %s", err)
+	}
+
+	// Create a durable on the unpartitioned subject, as if the stream was
+	// consumed before partitions were configured, and leave a message on it.
+	if _, err := js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:        durable,
+		DeliverSubject: nats.NewInbox(),
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+		FilterSubject:  stream,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.Publish(stream, []byte("unpartitioned")); err != nil {
+		t.Fatal(err)
+	}
+	if err := PrepareDurable(js, stream, durable, stream); err != nil {
+		t.Fatalf("PrepareDurable with the same subject: %s", err)
+	}
+
+	// The durable can't be moved to the partitions until that message has
+	// been processed, otherwise it would be lost.
+	if err := PrepareDurable(js, stream, durable, partitioned); err == nil {
+		t.Fatal("expected PrepareDurable to refuse to move a durable with pending messages")
+	}
+	if _, err := js.ConsumerInfo(stream, durable); err != nil {
+		t.Fatalf("expected the durable to still exist: %s", err)
+	}
+
+	// Process the message on the old subject.
+	sub, err := js.SubscribeSync(stream, nats.Durable(durable), nats.DeliverAll(), nats.ManualAck())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sub.NextMsg(time.Second * 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = msg.AckSync(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Now the durable can be moved, and receives messages for the partitions.
+	if err = PrepareDurable(js, stream, durable, partitioned); err != nil {
+		t.Fatalf("PrepareDurable after processing pending messages: %s", err)
+	}
+	sub, err = js.SubscribeSync(partitioned, nats.Durable(durable), nats.DeliverAll(), nats.ManualAck())
+	if err != nil {
+		t.Fatalf("failed to subscribe to the partitions: %s", err)
+	}
+	if _, err = js.Publish(RoomSubject(stream, "!room:localhost", 4), []byte("partitioned")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = sub.NextMsg(time.Second * 5); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "partitioned" {
+		t.Fatalf("got message %q, want %q", msg.Data, "partitioned")
+	}
+}
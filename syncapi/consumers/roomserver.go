@@ -38,7 +38,8 @@ type OutputRoomEventConsumer struct {
 	cfg          *config.SyncAPI
 	rsAPI        api.RoomserverInternalAPI
 	jetstream    nats.JetStreamContext
-	durable      nats.SubOpt
+	stream       string
+	durable      string
 	topic        string
 	db           storage.Database
 	pduStream    types.StreamProvider
@@ -58,11 +59,15 @@ func NewOutputRoomEventConsumer(
 	rsAPI api.RoomserverInternalAPI,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
-		ctx:          process.Context(),
-		cfg:          cfg,
-		jetstream:    js,
-		topic:        cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
-		durable:      cfg.Matrix.JetStream.Durable("SyncAPIRoomServerConsumer"),
+		ctx:       process.Context(),
+		cfg:       cfg,
+		jetstream: js,
+		stream:    cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
+		topic: jetstream.SubscribeSubject(
+			cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
+			cfg.Matrix.JetStream.OutputRoomEventPartitions,
+		),
+		durable:      cfg.Matrix.JetStream.TopicFor("SyncAPIRoomServerConsumer"),
 		db:           store,
 		notifier:     notifier,
 		pduStream:    pduStream,
@@ -73,8 +78,11 @@ func NewOutputRoomEventConsumer(
 
 // Start consuming from room servers
 func (s *OutputRoomEventConsumer) Start() error {
+	if err := jetstream.PrepareDurable(s.jetstream, s.stream, s.durable, s.topic); err != nil {
+		return err
+	}
 	_, err := s.jetstream.Subscribe(
-		s.topic, s.onMessage, s.durable,
+		s.topic, s.onMessage, nats.Durable(s.durable),
 		nats.DeliverAll(),
 		nats.ManualAck(),
 	)
@@ -110,6 +118,8 @@ func (s *OutputRoomEventConsumer) onMessage(msg *nats.Msg) {
 			err = s.onNewRoomEvent(s.ctx, *output.NewRoomEvent)
 		case api.OutputTypeOldRoomEvent:
 			err = s.onOldRoomEvent(s.ctx, *output.OldRoomEvent)
+		case api.OutputTypeBackfilledRoomEvent:
+			err = s.onBackfilledRoomEvent(s.ctx, *output.BackfilledRoomEvent)
 		case api.OutputTypeNewInviteEvent:
 			s.onNewInviteEvent(s.ctx, *output.NewInviteEvent)
 		case api.OutputTypeRetireInviteEvent:
@@ -250,6 +260,28 @@ func (s *OutputRoomEventConsumer) onOldRoomEvent(
 	return nil
 }
 
+// onBackfilledRoomEvent stores an event that was backfilled from another
+// server. Like the events that we backfill for /messages, it precedes the
+// timeline that clients already have, so it is excluded from sync and nobody
+// is woken up for it.
+func (s *OutputRoomEventConsumer) onBackfilledRoomEvent(
+	ctx context.Context, msg api.OutputBackfilledRoomEvent,
+) error {
+	ev := msg.Event
+	if _, err := s.db.WriteEvent(
+		ctx,
+		ev,
+		[]*gomatrixserverlib.HeaderedEvent{},
+		[]string{}, // adds no state
+		[]string{}, // removes no state
+		nil,        // no transaction
+		true,       // exclude from sync
+	); err != nil {
+		return fmt.Errorf("s.db.WriteEvent: %w", err)
+	}
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) notifyJoinedPeeks(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, sp types.StreamPosition) (types.StreamPosition, error) {
 	if ev.Type() != gomatrixserverlib.MRoomMember {
 		return sp, nil
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -83,6 +84,11 @@ func OnIncomingMessagesRequest(
 		}
 	}
 
+	// The user is looking at this room, so let the roomserver know that it
+	// should prioritise new events for it. This is only a hint, so don't hold
+	// up the request waiting for it.
+	go hintRoomActivity(rsAPI, roomID)
+
 	// Extract parameters from the request's URL.
 	// Pagination tokens.
 	var fromStream *types.StreamingToken
@@ -212,6 +218,14 @@ func OnIncomingMessagesRequest(
 	}
 }
 
+func hintRoomActivity(rsAPI api.RoomserverInternalAPI, roomID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	rsAPI.InputRoomActivityHints(ctx, &api.InputRoomActivityHintsRequest{
+		RoomIDs: []string{roomID},
+	}, &api.InputRoomActivityHintsResponse{})
+}
+
 func checkIsRoomForgotten(ctx context.Context, roomID, userID string, rsAPI api.RoomserverInternalAPI) (bool, error) {
 	req := api.QueryMembershipForUserRequest{
 		RoomID: roomID,